@@ -0,0 +1,189 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+)
+
+// Alert is a notification regarding a condition operators should be aware of
+type Alert struct {
+	// Type is the alert type
+	Type string `json:"type"`
+	// Resolved indicates the condition which triggered an earlier alert has cleared
+	Resolved bool `json:"resolved"`
+	// Source is the instance which raised the alert
+	Source string `json:"source"`
+	// Stream is the name of the stream the alert is about, if any
+	Stream string `json:"stream,omitempty"`
+	// Consumer is the name of the consumer the alert is about, if any
+	Consumer string `json:"consumer,omitempty"`
+	// Subject is the subject the alert is about, if any
+	Subject string `json:"subject,omitempty"`
+	// Message is a human readable description of the alert
+	Message string `json:"message"`
+	// Timestamp is when the alert was raised
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// String toString function for Alert
+func (a Alert) String() string {
+	state := "FIRING"
+	if a.Resolved {
+		state = "RESOLVED"
+	}
+	if a.Stream == "" && a.Subject != "" {
+		return fmt.Sprintf("ALERT[%s %s] subject %s", a.Type, state, a.Subject)
+	}
+	if a.Consumer == "" {
+		return fmt.Sprintf("ALERT[%s %s] %s", a.Type, state, a.Stream)
+	}
+	return fmt.Sprintf("ALERT[%s %s] %s@%s", a.Type, state, a.Consumer, a.Stream)
+}
+
+// AlertSink delivers alerts to an external system
+type AlertSink interface {
+	// Send delivers an alert
+	Send(alert Alert, ctxt context.Context) error
+}
+
+// ==============================================================================
+
+// webhookAlertSink implements AlertSink by POSTing alerts to a webhook
+type webhookAlertSink struct {
+	common.Component
+	url    string
+	client *http.Client
+}
+
+// GetWebhookAlertSink define an AlertSink which POSTs alerts as JSON to a webhook URL
+func GetWebhookAlertSink(url string, timeout time.Duration, instance string) (AlertSink, error) {
+	logTags := log.Fields{
+		"module": "alerts", "component": "webhook-sink", "instance": instance,
+	}
+	return &webhookAlertSink{
+		Component: common.Component{LogTags: logTags},
+		url:       url,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Send delivers an alert
+func (s *webhookAlertSink) Send(alert Alert, ctxt context.Context) error {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	payload, err := json.Marshal(&alert)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to serialize %s", alert)
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctxt, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to define webhook request")
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to send %s", alert)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("webhook responded with %d", resp.StatusCode)
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to send %s", alert)
+		return err
+	}
+	log.WithFields(localLogTags).Debugf("Sent %s", alert)
+	return nil
+}
+
+// ==============================================================================
+
+// natsAlertSink implements AlertSink by publishing alerts on a NATS subject
+type natsAlertSink struct {
+	common.Component
+	subject string
+	nats    *core.NatsClient
+}
+
+// GetNATSAlertSink define an AlertSink which publishes alerts as JSON on a NATS subject
+func GetNATSAlertSink(
+	natsClient *core.NatsClient, subject string, instance string,
+) (AlertSink, error) {
+	logTags := log.Fields{
+		"module": "alerts", "component": "nats-sink", "instance": instance,
+	}
+	return &natsAlertSink{
+		Component: common.Component{LogTags: logTags},
+		subject:   subject,
+		nats:      natsClient,
+	}, nil
+}
+
+// Send delivers an alert
+func (s *natsAlertSink) Send(alert Alert, ctxt context.Context) error {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	payload, err := json.Marshal(&alert)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to serialize %s", alert)
+		return err
+	}
+	if err := s.nats.NATs().Publish(s.subject, payload); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to send %s on %s", alert, s.subject)
+		return err
+	}
+	log.WithFields(localLogTags).Debugf("Sent %s on %s", alert, s.subject)
+	return nil
+}
+
+// ==============================================================================
+
+// multiAlertSink implements AlertSink by delivering alerts to multiple sinks
+type multiAlertSink struct {
+	sinks []AlertSink
+}
+
+// GetMultiAlertSink define an AlertSink which delivers alerts to all of the provided sinks
+func GetMultiAlertSink(sinks ...AlertSink) AlertSink {
+	return &multiAlertSink{sinks: sinks}
+}
+
+// Send delivers an alert
+func (s *multiAlertSink) Send(alert Alert, ctxt context.Context) error {
+	var firstErr error
+	for _, sink := range s.sinks {
+		if err := sink.Send(alert, ctxt); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,75 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookAlertSink(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	rxAlerts := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		assert.Nil(json.NewDecoder(r.Body).Decode(&alert))
+		rxAlerts <- alert
+		if alert.Message == "reject" {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	uut, err := GetWebhookAlertSink(server.URL, time.Second, "ut-webhook-sink")
+	assert.Nil(err)
+
+	testAlert := Alert{
+		Type:      "testing",
+		Source:    "unit-test",
+		Stream:    "stream",
+		Consumer:  "consumer",
+		Message:   "hello",
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+	}
+
+	// Case 0: normal delivery
+	{
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Nil(uut.Send(testAlert, ctxt))
+		rx := <-rxAlerts
+		assert.Equal(testAlert, rx)
+	}
+
+	// Case 1: webhook rejects the alert
+	{
+		testAlert.Message = "reject"
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.NotNil(uut.Send(testAlert, ctxt))
+		<-rxAlerts
+	}
+}
@@ -16,12 +16,20 @@ package apis
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/apex/log"
 	"github.com/google/uuid"
+	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
@@ -57,7 +65,9 @@ func getStdRESTErrorMsg(code int, message *string) StandardResponse {
 func writeRESTResponse(
 	w http.ResponseWriter, r *http.Request, respCode int, resp interface{},
 ) error {
-	w.Header().Set("content-type", "application/json")
+	if w.Header().Get("content-type") == "" {
+		w.Header().Set("content-type", "application/json")
+	}
 	if r.Context().Value(common.RequestParam{}) != nil {
 		v, ok := r.Context().Value(common.RequestParam{}).(common.RequestParam)
 		if ok {
@@ -65,7 +75,7 @@ func writeRESTResponse(
 		}
 	}
 	w.WriteHeader(respCode)
-	t, err := json.Marshal(resp)
+	t, err := common.JSON().Marshal(resp)
 	if err != nil {
 		w.WriteHeader(500)
 		return err
@@ -97,6 +107,131 @@ func RegisterPathPrefix(
 // APIRestHandler base REST handler
 type APIRestHandler struct {
 	common.Component
+	// subjects are the rules the subjects given by clients must follow
+	subjects common.SubjectRules
+}
+
+// checkSubject helper function to normalize and validate a subject given by a client. A
+// filter may contain wildcards. If the subject is invalid, a 400 response describing the
+// offending token is sent, and false is returned.
+func (h APIRestHandler) checkSubject(
+	w http.ResponseWriter, r *http.Request, restCall, subject string, filter bool,
+) (string, bool) {
+	var err error
+	if filter {
+		subject, err = h.subjects.ValidateSubjectFilter(subject)
+	} else {
+		subject, err = h.subjects.ValidateSubject(subject)
+	}
+	if err != nil {
+		localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Error("Subject rejected")
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return "", false
+	}
+	return subject, true
+}
+
+// badQueryParam helper function to reject a request with an invalid query parameter
+func (h APIRestHandler) badQueryParam(
+	w http.ResponseWriter, r *http.Request, restCall string, err error, msg string,
+) {
+	localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+	log.WithError(err).WithFields(localLogTags).Errorf(msg)
+	h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+}
+
+// readQueryParam helper function to read a query parameter which may be given at most once.
+// Returns the value, and whether it was given. If given more than once, a 400 response is
+// sent, and ok is false.
+func (h APIRestHandler) readQueryParam(
+	w http.ResponseWriter, r *http.Request, restCall, name string,
+) (value string, given bool, ok bool) {
+	t, given := r.URL.Query()[name]
+	if !given {
+		return "", false, true
+	}
+	if len(t) != 1 {
+		h.badQueryParam(w, r, restCall, nil, fmt.Sprintf("Multiple %s", name))
+		return "", true, false
+	}
+	return t[0], true, true
+}
+
+// parseIntParam helper function to parse an integer query parameter, which is fallback if
+// not given. If positive, the parameter must be positive when given. If invalid, a 400
+// response is sent, and false is returned.
+func (h APIRestHandler) parseIntParam(
+	w http.ResponseWriter, r *http.Request, restCall, name string, fallback int, positive bool,
+) (int, bool) {
+	t, given, ok := h.readQueryParam(w, r, restCall, name)
+	if !given || !ok {
+		return fallback, ok
+	}
+	p, err := strconv.Atoi(t)
+	if err != nil || (positive && p <= 0) {
+		h.badQueryParam(w, r, restCall, err, fmt.Sprintf("Unable to parse %s", name))
+		return fallback, false
+	}
+	return p, true
+}
+
+// parseFloatParam helper function to parse a float query parameter, which is fallback if
+// not given. If positive, the parameter must be positive when given. If invalid, a 400
+// response is sent, and false is returned.
+func (h APIRestHandler) parseFloatParam(
+	w http.ResponseWriter, r *http.Request, restCall, name string, fallback float64, positive bool,
+) (float64, bool) {
+	t, given, ok := h.readQueryParam(w, r, restCall, name)
+	if !given || !ok {
+		return fallback, ok
+	}
+	p, err := strconv.ParseFloat(t, 64)
+	if err != nil || (positive && p <= 0) {
+		h.badQueryParam(w, r, restCall, err, fmt.Sprintf("Unable to parse %s", name))
+		return fallback, false
+	}
+	return p, true
+}
+
+// parseBoolParam helper function to parse a boolean query parameter, which is fallback if
+// not given. If invalid, a 400 response is sent, and false is returned.
+func (h APIRestHandler) parseBoolParam(
+	w http.ResponseWriter, r *http.Request, restCall, name string, fallback bool,
+) (bool, bool) {
+	t, given, ok := h.readQueryParam(w, r, restCall, name)
+	if !given || !ok {
+		return fallback, ok
+	}
+	p, err := strconv.ParseBool(t)
+	if err != nil {
+		h.badQueryParam(w, r, restCall, err, fmt.Sprintf("Unable to parse %s", name))
+		return fallback, false
+	}
+	return p, true
+}
+
+// parseDurationParam helper function to parse a duration query parameter, which is
+// fallback if not given. If positive, the parameter must be positive when given. If
+// invalid, a 400 response is sent, and false is returned.
+func (h APIRestHandler) parseDurationParam(
+	w http.ResponseWriter,
+	r *http.Request,
+	restCall, name string,
+	fallback time.Duration,
+	positive bool,
+) (time.Duration, bool) {
+	t, given, ok := h.readQueryParam(w, r, restCall, name)
+	if !given || !ok {
+		return fallback, ok
+	}
+	p, err := time.ParseDuration(t)
+	if err != nil || (positive && p <= 0) {
+		h.badQueryParam(w, r, restCall, err, fmt.Sprintf("Unable to parse %s", name))
+		return fallback, false
+	}
+	return p, true
 }
 
 // reply helper function for writing responses
@@ -135,3 +270,226 @@ func (h APIRestHandler) attachRequestID(next http.HandlerFunc) http.HandlerFunc
 		next(rw, r.WithContext(ctx))
 	}
 }
+
+// RequireBearerToken middleware function to reject API requests which do not carry the
+// expected bearer token
+func (h APIRestHandler) RequireBearerToken(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			provided := strings.TrimPrefix(auth, "Bearer ")
+			if provided == auth || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				msg := "Missing or invalid bearer token"
+				localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+				log.WithFields(localLogTags).Warnf("Rejected %s %s: %s", r.Method, r.URL, msg)
+				h.reply(
+					rw,
+					http.StatusUnauthorized,
+					getStdRESTErrorMsg(http.StatusUnauthorized, &msg),
+					r.Method+" "+r.URL.Path,
+					r,
+				)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// requestPrincipal context key for the authenticated principal of a request
+type requestPrincipal struct{}
+
+// GetRequestPrincipal returns the authenticated principal of a request, if any
+func GetRequestPrincipal(ctxt context.Context) (string, bool) {
+	principal, ok := ctxt.Value(requestPrincipal{}).(string)
+	return principal, ok
+}
+
+// certificatePrincipals helper function to list the principal names a client certificate
+// identifies: the subject common name, and the DNS, email, and URI SANs.
+func certificatePrincipals(cert *x509.Certificate) []string {
+	result := []string{}
+	if cert.Subject.CommonName != "" {
+		result = append(result, cert.Subject.CommonName)
+	}
+	result = append(result, cert.DNSNames...)
+	result = append(result, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		result = append(result, uri.String())
+	}
+	return result
+}
+
+// RequireClientCertificate middleware function to reject API requests which did not present
+// a verified client certificate. If allowed is not empty, the certificate must also identify
+// one of the allowed principals.
+//
+// The matched principal is attached to the request context.
+func (h APIRestHandler) RequireClientCertificate(allowed []string) mux.MiddlewareFunc {
+	allowedSet := map[string]bool{}
+	for _, principal := range allowed {
+		allowedSet[principal] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			principal := ""
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				for _, name := range certificatePrincipals(r.TLS.VerifiedChains[0][0]) {
+					if len(allowedSet) == 0 || allowedSet[name] {
+						principal = name
+						break
+					}
+				}
+			}
+			if principal == "" {
+				msg := "Missing or unauthorized client certificate"
+				localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+				log.WithFields(localLogTags).Warnf("Rejected %s %s: %s", r.Method, r.URL, msg)
+				h.reply(
+					rw,
+					http.StatusUnauthorized,
+					getStdRESTErrorMsg(http.StatusUnauthorized, &msg),
+					r.Method+" "+r.URL.Path,
+					r,
+				)
+				return
+			}
+			if tenant, ok := r.Context().Value(accessLogTenantKey{}).(*accessLogTenant); ok {
+				tenant.name = principal
+			}
+			ctx := context.WithValue(r.Context(), requestPrincipal{}, principal)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// AnonymousLogTenant is the tenant whose key encrypts the access log of requests without an
+// authenticated principal
+const AnonymousLogTenant = "-"
+
+// accessLogTenantKey context key for the tenant owning the access log line of a request
+type accessLogTenantKey struct{}
+
+// accessLogTenant the tenant owning the access log line of a request. It is updated once the
+// request is authenticated, which happens after the logging middleware saw the request.
+type accessLogTenant struct {
+	name string
+}
+
+// encryptedAccessLogLine writes the access log line of a request to the tenant's log
+type encryptedAccessLogLine struct {
+	APIRestHandler
+	writer common.EncryptedLogWriter
+	tenant *accessLogTenant
+	ctxt   context.Context
+}
+
+// Write logging support
+func (l encryptedAccessLogLine) Write(p []byte) (n int, err error) {
+	if err := l.writer.WriteLine(l.tenant.name, p, l.ctxt); err != nil {
+		localLogTags, _ := common.UpdateLogTags(l.LogTags, l.ctxt)
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to write access log of tenant %s", l.tenant.name,
+		)
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// EncryptedAccessLog middleware function to write the access log of API requests, in the
+// Apache combined log format, to the encrypted log of each request's tenant. The tenant is
+// the principal authenticated with RequireClientCertificate, or AnonymousLogTenant.
+func (h APIRestHandler) EncryptedAccessLog(writer common.EncryptedLogWriter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			tenant := &accessLogTenant{name: AnonymousLogTenant}
+			ctx := context.WithValue(r.Context(), accessLogTenantKey{}, tenant)
+			out := encryptedAccessLogLine{
+				APIRestHandler: h, writer: writer, tenant: tenant, ctxt: ctx,
+			}
+			handlers.CombinedLoggingHandler(out, next).ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// TrustForwardedFor middleware function to take the client address of an API request from
+// the X-Forwarded-For header, when the request arrives from a trusted proxy.
+//
+// The rightmost address not belonging to a trusted proxy is used, as addresses to its left
+// are supplied by the caller, and can not be trusted.
+func TrustForwardedFor(trusted []*net.IPNet) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			forwarded := r.Header.Values("X-Forwarded-For")
+			if len(forwarded) == 0 || !common.IPInNets(net.ParseIP(host), trusted) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			hops := strings.Split(strings.Join(forwarded, ","), ",")
+			client := ""
+			for idx := len(hops) - 1; idx >= 0; idx-- {
+				ip := net.ParseIP(strings.TrimSpace(hops[idx]))
+				if ip == nil {
+					break
+				}
+				client = ip.String()
+				if !common.IPInNets(ip, trusted) {
+					break
+				}
+			}
+			if client != "" {
+				r.RemoteAddr = net.JoinHostPort(client, "0")
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// EnforceRequestQuota middleware function to count API requests against the quota of their
+// client, which is the authenticated principal of a request if any, or its client address.
+// Requests over the quota are rejected with 429.
+//
+// Every response carries the state of the client's quota in the X-RateLimit-Limit,
+// X-RateLimit-Remaining, and X-RateLimit-Reset headers, the last being the seconds until the
+// quota is replenished.
+func (h APIRestHandler) EnforceRequestQuota(quota common.RequestQuota) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			client, ok := GetRequestPrincipal(r.Context())
+			if !ok || client == "" {
+				host, _, err := net.SplitHostPort(r.RemoteAddr)
+				if err != nil {
+					host = r.RemoteAddr
+				}
+				client = host
+			}
+			state := quota.Take(client)
+			resetSeconds := int(math.Ceil(time.Until(state.Reset).Seconds()))
+			if resetSeconds < 0 {
+				resetSeconds = 0
+			}
+			rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(state.Limit))
+			rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(state.Remaining))
+			rw.Header().Set("X-RateLimit-Reset", strconv.Itoa(resetSeconds))
+			if !state.Allowed {
+				msg := "Request quota exceeded"
+				localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+				log.WithFields(localLogTags).Warnf("Rejected %s %s: %s", r.Method, r.URL, msg)
+				rw.Header().Set("Retry-After", strconv.Itoa(resetSeconds))
+				h.reply(
+					rw,
+					http.StatusTooManyRequests,
+					getStdRESTErrorMsg(http.StatusTooManyRequests, &msg),
+					r.Method+" "+r.URL.Path,
+					r,
+				)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -17,39 +17,276 @@ package apis
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
 	"github.com/alwitt/httpmq/dataplane"
+	"github.com/alwitt/httpmq/filters"
+	"github.com/alwitt/httpmq/hooks"
+	"github.com/alwitt/httpmq/management"
+	"github.com/alwitt/httpmq/metrics"
 	"github.com/apex/log"
 	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/nats-io/nats.go"
 )
 
+// StreamAutoCreateParam settings for defining a stream when publishing to a subject
+// which no stream is listening on
+type StreamAutoCreateParam struct {
+	// Controller is the JetStream controller used to define the stream
+	Controller management.JetStreamController
+	// Limits are the data retention limits applied to the new stream
+	Limits management.JSStreamLimits
+}
+
+// StreamTailParam settings for stream tail sessions
+type StreamTailParam struct {
+	// MaxDuration is the longest a tail session can last
+	MaxDuration time.Duration
+	// MaxRate is the max number of messages per second sent on a tail session. Messages above
+	// the rate are dropped. Zero means no limit.
+	MaxRate float64
+	// PayloadAccess decides which principals see the message bodies. If nil, all do.
+	PayloadAccess dataplane.PayloadAccessControl
+	// PublicStreams admits anonymous subscribers to the public streams. If nil, no stream
+	// is public.
+	PublicStreams dataplane.PublicStreamGate
+}
+
+// exportFlushInterval is the number of exported messages between flushes of the response
+const exportFlushInterval = 100
+
+// exportParquetRowGroupSize is the number of exported messages per row group of a Parquet
+// export. A row group is sent once full.
+const exportParquetRowGroupSize = 1000
+
+// ExportParam settings for exporting ranges of streams
+type ExportParam struct {
+	// MaxDuration is the longest an export can last
+	MaxDuration time.Duration
+	// MaxRate is the max number of messages per second exported. The export slows down to
+	// the rate. Zero means no limit.
+	MaxRate float64
+}
+
+// RequestReplyParam settings for request / reply over JetStream
+type RequestReplyParam struct {
+	// Requester sends requests, and gathers their replies
+	Requester dataplane.JetStreamRequester
+	// MaxTimeout is the longest a client can wait for replies to a request
+	MaxTimeout time.Duration
+}
+
+// PublishParam settings for publishing messages
+type PublishParam struct {
+	// AckWait is how long a publish waits for the JetStream ACK, unless overridden by the
+	// request. Zero means until the client ends the request.
+	AckWait time.Duration
+	// RetryAfter is when a client should retry a publish rejected due to too many publishes
+	// awaiting ACK
+	RetryAfter time.Duration
+	// Buffers is the pool the published message bodies are decoded into. If nil, each
+	// message body is decoded into a newly allocated buffer.
+	Buffers common.BufferPool
+	// Anomalies tracks the publish rate of each subject for anomalies. If nil, the rates
+	// are not tracked.
+	Anomalies metrics.PublishAnomalyDetector
+	// Inspector checks the content of messages against the inspection rules of their
+	// streams before publishing. If nil, the content is not checked.
+	Inspector dataplane.ContentInspector
+	// Router sends the messages matching its routing table through other NATS connections.
+	// If nil, all messages are published through the server's own connection.
+	Router dataplane.PublishRouter
+	// Failover sends messages to a secondary NATS cluster while the server's own is failing.
+	// If nil, messages are only published through the server's own connection.
+	Failover dataplane.PublishFailover
+	// Quotas reports how much of its limits the stream storing a published message uses. If
+	// nil, the usage is not reported.
+	Quotas dataplane.StreamQuotaReporter
+	// PIIScanner checks messages for PII against the PII policies of their streams before
+	// publishing. If nil, messages are not scanned.
+	PIIScanner dataplane.PIIScanner
+	// Grants issues the tokens of signed publish URLs. If nil, signed publishes are not
+	// supported.
+	Grants dataplane.PublishGrantIssuer
+}
+
+// BatchFetchParam settings for fetching batches of messages through pull consumers
+type BatchFetchParam struct {
+	// Fetcher reads and commits the batches
+	Fetcher dataplane.JetStreamBatchFetcher
+	// MaxBatch is the max number of messages in one batch
+	MaxBatch int
+	// MaxWait is the longest a client can wait for messages
+	MaxWait time.Duration
+}
+
+// SessionWriteBufferParam settings for the write buffers of push subscribe sessions
+type SessionWriteBufferParam struct {
+	// MaxBytes is the max number of bytes buffered for sending to a client
+	MaxBytes int
+	// Policy is what to do with a message which does not fit in the buffer
+	Policy dataplane.SlowClientPolicy
+	// DrainTimeout is how long an ending session waits for its buffered messages to be sent,
+	// before dropping the connection
+	DrainTimeout time.Duration
+	// Metrics records how full the buffers get. Optional.
+	Metrics metrics.SessionBufferMetrics
+}
+
+// SessionLimitParam settings for ending long held push subscribe sessions. A session ended
+// on a limit tells the client to reconnect. Zero means no limit.
+type SessionLimitParam struct {
+	// MaxDuration is the longest a session lasts
+	MaxDuration time.Duration
+	// IdleTimeout is the longest a session goes without delivering a message
+	IdleTimeout time.Duration
+	// MaxTrackingPanics is the number of panics the tracking of a session's inflight messages
+	// recovers from before the session fails. Zero for no limit.
+	MaxTrackingPanics int
+	// AckDrainTimeout is how long a session ended on a limit, or on server stop, waits for
+	// the client to ACK the messages it was sent, after it stops reading new messages. Zero
+	// to end the session immediately.
+	AckDrainTimeout time.Duration
+}
+
 // APIRestJetStreamDataplaneHandler REST handler for JetStream dataplane
 type APIRestJetStreamDataplaneHandler struct {
 	APIRestHandler
 	natsClient   *core.NatsClient
 	publisher    dataplane.JetStreamPublisher
 	ackBroadcast dataplane.JetStreamACKBroadcaster
-	validate     *validator.Validate
-	baseContext  context.Context
-	wg           *sync.WaitGroup
+	// externalACKPrefix is the subject prefix external workers send ACKs to, if enabled
+	externalACKPrefix string
+	streamAutoCreate  *StreamAutoCreateParam
+	publish           PublishParam
+	inflightPersist   dataplane.InflightMsgPersistence
+	redactor          dataplane.MessageRedactor
+	keepAlive         time.Duration
+	writeBuffer       SessionWriteBufferParam
+	sessionLimits     SessionLimitParam
+	tail              StreamTailParam
+	export            ExportParam
+	importer          dataplane.BulkImporter
+	rpc               RequestReplyParam
+	fetch             BatchFetchParam
+	sessions          dataplane.SubscriptionSessionRegistry
+	tenantClients     core.NatsClientPool
+	filters           filters.Registry
+	latency           metrics.ConsumerLatencyTracker
+	tiers             dataplane.DeliveryTierCoordinator
+	fairness          dataplane.DeliveryGroupBalancer
+	leases            dataplane.ConsumerLeaseManager
+	affinity          dataplane.ConsumerAffinity
+	clusterSessions   dataplane.ClusterSessionRegistry
+	slo               metrics.SLOTracker
+	sessionEvents     dataplane.SessionEventNotifier
+	tracer            dataplane.MessageTracer
+	graphQL           GraphQLParam
+	// dispatchers tracks the dispatchers of the running sessions
+	dispatchers dataplane.DispatcherRegistry
+	// drain tracks the sessions draining on shutdown
+	drain       dataplane.DrainMonitor
+	validate    *validator.Validate
+	baseContext context.Context
+	wg          *sync.WaitGroup
+}
+
+// DataplaneHandlerOptions the optional collaborators of APIRestJetStreamDataplaneHandler.
+// Each left nil (or empty) disables the feature it supports.
+type DataplaneHandlerOptions struct {
+	// ExternalACKPrefix if set, ACKs are also received from external workers
+	ExternalACKPrefix string
+	// StreamAutoCreate if set, publishing to a subject with no matching stream defines one
+	StreamAutoCreate *StreamAutoCreateParam
+	// InflightPersist if set, records of inflight messages are persisted, instead of only
+	// being held in memory
+	InflightPersist dataplane.InflightMsgPersistence
+	// Redactor if set, is applied to all messages sent to clients
+	Redactor dataplane.MessageRedactor
+	// Importer if set, messages can be bulk imported from NDJSON uploads
+	Importer dataplane.BulkImporter
+	// Sessions if set, push subscribe sessions through durable consumers are issued resume
+	// tokens, with which clients can resume the sessions after reconnecting
+	Sessions dataplane.SubscriptionSessionRegistry
+	// TenantClients if set, requests are served with NATS clients connected with the
+	// credentials of each request's authenticated principal
+	TenantClients core.NatsClientPool
+	// FilterRegistry if set, the filter modules of durable consumers decide whether each
+	// message delivered through the consumers is forwarded, dropped, or transformed
+	FilterRegistry filters.Registry
+	// Latency if set, the ACK latency of durable consumers on push subscriptions is tracked,
+	// and delivery to consumers found to be slow is throttled
+	Latency metrics.ConsumerLatencyTracker
+	// Tiers if set, push subscribe sessions in a delivery group can be standby sessions,
+	// which only join the group while it has no primary session
+	Tiers dataplane.DeliveryTierCoordinator
+	// Fairness if set, messages are deflected away from push subscribe sessions which are
+	// slow to ACK, toward the other sessions of their delivery group on this replica
+	Fairness dataplane.DeliveryGroupBalancer
+	// Leases if set, push subscribe sessions can pin their durable consumer, and sessions of
+	// a pinned consumer other than the lease holder are refused
+	Leases dataplane.ConsumerLeaseManager
+	// Affinity if set, push subscribe sessions of a durable consumer assigned to another
+	// replica are redirected to that replica
+	Affinity dataplane.ConsumerAffinity
+	// ClusterSessions if set, the push subscribe sessions of this replica are shared with the
+	// other replicas, and a consumer with sessions running on another replica is redirected
+	// there, instead of to the replica assigned it
+	ClusterSessions dataplane.ClusterSessionRegistry
+	// SLO if set, the success and latency of publishes and deliveries are tracked against
+	// the service level objectives
+	SLO metrics.SLOTracker
+	// SessionEvents if set, external systems are notified when push subscribe sessions
+	// start, end, or error
+	SessionEvents dataplane.SessionEventNotifier
+	// Tracer if set, the messages sent to clients on the traced subjects and consumers are
+	// recorded for debugging
+	Tracer dataplane.MessageTracer
 }
 
 // GetAPIRestJetStreamDataplaneHandler define APIRestJetStreamDataplaneHandler
+//
+// The subjects given by clients must follow subjectRules.
+// publish bounds how long a publish waits for its ACK.
+// If keepAlive is not zero, an empty line is sent on a subscription stream which has been
+// idle for keepAlive, so intermediaries do not drop the stream.
+// writeBuffer bounds the messages buffered for a subscription client which is not reading,
+// and decides what happens to messages once the buffer is full.
+// sessionLimits bound how long push subscribe sessions last.
+// tail bounds the stream tail sessions, export bounds the exports of stream ranges, rpc
+// handles request / reply, and fetch handles fetching batches through pull consumers.
+// If graphQL.Enabled, messages can be subscribed to through GraphQL subscriptions.
+// opts provides the optional collaborators.
 func GetAPIRestJetStreamDataplaneHandler(
 	client *core.NatsClient,
 	runTimePublisher dataplane.JetStreamPublisher,
 	ackBroadcast dataplane.JetStreamACKBroadcaster,
+	subjectRules common.SubjectRules,
+	publish PublishParam,
+	keepAlive time.Duration,
+	writeBuffer SessionWriteBufferParam,
+	sessionLimits SessionLimitParam,
+	tail StreamTailParam,
+	export ExportParam,
+	rpc RequestReplyParam,
+	fetch BatchFetchParam,
+	graphQL GraphQLParam,
+	opts DataplaneHandlerOptions,
 	baseContext context.Context,
 	wg *sync.WaitGroup,
 ) (APIRestJetStreamDataplaneHandler, error) {
@@ -57,37 +294,378 @@ func GetAPIRestJetStreamDataplaneHandler(
 		"module":    "rest",
 		"component": "jetstream-dataplane",
 	}
+	validate := validator.New()
+	if err := validate.Struct(&subjectRules); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Subject rules invalid")
+		return APIRestJetStreamDataplaneHandler{}, err
+	}
+	dispatchers := dataplane.GetDispatcherRegistry()
 	return APIRestJetStreamDataplaneHandler{
 		APIRestHandler: APIRestHandler{
 			Component: common.Component{LogTags: logTags},
+			subjects:  subjectRules,
 		},
-		natsClient:   client,
-		publisher:    runTimePublisher,
-		ackBroadcast: ackBroadcast,
-		validate:     validator.New(),
-		baseContext:  baseContext,
-		wg:           wg,
+		natsClient:        client,
+		publisher:         runTimePublisher,
+		ackBroadcast:      ackBroadcast,
+		externalACKPrefix: opts.ExternalACKPrefix,
+		streamAutoCreate:  opts.StreamAutoCreate,
+		publish:           publish,
+		inflightPersist:   opts.InflightPersist,
+		redactor:          opts.Redactor,
+		keepAlive:         keepAlive,
+		writeBuffer:       writeBuffer,
+		sessionLimits:     sessionLimits,
+		tail:              tail,
+		export:            export,
+		importer:          opts.Importer,
+		rpc:               rpc,
+		fetch:             fetch,
+		sessions:          opts.Sessions,
+		tenantClients:     opts.TenantClients,
+		filters:           opts.FilterRegistry,
+		latency:           opts.Latency,
+		tiers:             opts.Tiers,
+		fairness:          opts.Fairness,
+		leases:            opts.Leases,
+		affinity:          opts.Affinity,
+		clusterSessions:   opts.ClusterSessions,
+		slo:               opts.SLO,
+		sessionEvents:     opts.SessionEvents,
+		tracer:            opts.Tracer,
+		graphQL:           graphQL,
+		dispatchers:       dispatchers,
+		drain:             dataplane.GetDrainMonitor(dispatchers),
+		validate:          validate,
+		baseContext:       baseContext,
+		wg:                wg,
 	}, nil
 }
 
+// autoStreamName helper function to define the name of an automatically created stream
+// based on the subject it will listen on
+func autoStreamName(subject string) string {
+	return strings.NewReplacer(".", "_", "/", "_", "\\", "_").Replace(subject)
+}
+
+// autoStreamUniqueName helper function to define the name of an automatically created
+// stream, for a subject whose autoStreamName is taken by the stream of another subject
+// (e.g. "a.b" and "a_b")
+func autoStreamUniqueName(subject string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(subject))
+	return fmt.Sprintf("%s_%08x", autoStreamName(subject), hash.Sum32())
+}
+
+// autoCreateStream helper function to define a new stream for a subject based on the
+// stream auto-create settings
+//
+// A stream of the same name listening on the subject, e.g. defined by a concurrent
+// publish, is used as is. If the name is taken by the stream of another subject, the
+// stream is defined under a name unique to the subject instead. Returns the name of the
+// stream, and whether it was defined by this call.
+func (h APIRestJetStreamDataplaneHandler) autoCreateStream(
+	subject string, ctxt context.Context,
+) (string, bool, error) {
+	controller := h.streamAutoCreate.Controller
+	for _, streamName := range []string{autoStreamName(subject), autoStreamUniqueName(subject)} {
+		param := management.JSStreamParam{
+			Name:           streamName,
+			Subjects:       []string{subject},
+			JSStreamLimits: h.streamAutoCreate.Limits,
+		}
+		err := controller.CreateStream(param, ctxt)
+		if err == nil {
+			return streamName, true, nil
+		}
+		existing, getErr := controller.GetStream(streamName, ctxt)
+		if getErr != nil {
+			return "", false, err
+		}
+		for _, listening := range existing.Config.Subjects {
+			if common.SubjectMatches(listening, subject) {
+				return streamName, false, nil
+			}
+		}
+	}
+	return "", false, fmt.Errorf("stream names for subject %s are taken by other streams", subject)
+}
+
 // =======================================================================
 // Message publish
 
 // -----------------------------------------------------------------------
 
+// decodeB64Body helper function to read a Base64 encoded request body
+func decodeB64Body(r *http.Request) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := decodeB64BodyInto(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeB64BodyInto helper function to read a Base64 encoded request body into a buffer
+func decodeB64BodyInto(buf *bytes.Buffer, r *http.Request) error {
+	decodeNum, err := common.DecodeBase64Into(buf, r.Body, r.ContentLength)
+	if err != nil {
+		return fmt.Errorf("Failed to base64 decode body")
+	}
+	if decodeNum == 0 {
+		return fmt.Errorf("Base64 decode resulted in empty body")
+	}
+	return nil
+}
+
+// decodePublishBody helper function to read a Base64 encoded message to publish. The
+// message is decoded into a buffer from the publish buffer pool; the returned release
+// function must be called once the message is no longer used.
+func (h APIRestJetStreamDataplaneHandler) decodePublishBody(
+	r *http.Request,
+) ([]byte, func(), error) {
+	if h.publish.Buffers == nil {
+		msg, err := decodeB64Body(r)
+		return msg, func() {}, err
+	}
+	buf := h.publish.Buffers.Get()
+	if err := decodeB64BodyInto(buf, r); err != nil {
+		h.publish.Buffers.Put(buf)
+		return nil, nil, err
+	}
+	return buf.Bytes(), func() { h.publish.Buffers.Put(buf) }, nil
+}
+
+// errNoTenant returned when a request needs per-tenant credentials, but has no
+// authenticated principal
+var errNoTenant = errors.New("no authenticated tenant")
+
+// requestTransport the NATS client, and the components using it, serving a request
+type requestTransport struct {
+	client    *core.NatsClient
+	publisher dataplane.JetStreamPublisher
+	// publishClient is the NATS client of publisher, which differs from client while
+	// publishes are failed over to the secondary cluster
+	publishClient *core.NatsClient
+	// failedOver is set while publishes are failed over to the secondary cluster
+	failedOver   bool
+	ackBroadcast dataplane.JetStreamACKBroadcaster
+	// tenant is set if client is connected with the credentials of the request's tenant
+	tenant string
+	// release must be called once done with the client
+	release func()
+}
+
+// transportFor helper function to select the NATS client serving a request. With per-tenant
+// credentials, this is the client connected with the credentials of the request's
+// authenticated principal.
+func (h APIRestJetStreamDataplaneHandler) transportFor(r *http.Request) (requestTransport, error) {
+	if h.tenantClients == nil {
+		transport := requestTransport{
+			client:        h.natsClient,
+			publisher:     h.publisher,
+			publishClient: h.natsClient,
+			ackBroadcast:  h.ackBroadcast,
+			release:       func() {},
+		}
+		if h.publish.Failover != nil {
+			transport.publishClient, transport.publisher, transport.failedOver =
+				h.publish.Failover.Active()
+		}
+		return transport, nil
+	}
+	tenant, ok := GetRequestPrincipal(r.Context())
+	if !ok || tenant == "" {
+		return requestTransport{}, errNoTenant
+	}
+	client, release, err := h.tenantClients.Acquire(tenant, r.Context())
+	if err != nil {
+		return requestTransport{}, err
+	}
+	publisher, err := dataplane.GetJetStreamPublisher(client, tenant)
+	if err != nil {
+		release()
+		return requestTransport{}, err
+	}
+	ackBroadcast, err := dataplane.GetJetStreamACKBroadcaster(client, tenant)
+	if err != nil {
+		release()
+		return requestTransport{}, err
+	}
+	return requestTransport{
+		client:        client,
+		publisher:     publisher,
+		publishClient: client,
+		ackBroadcast:  ackBroadcast,
+		tenant:        tenant,
+		release:       release,
+	}, nil
+}
+
+// replyTransportError helper function to reply to a request for which no NATS client could
+// be selected
+func (h APIRestJetStreamDataplaneHandler) replyTransportError(
+	w http.ResponseWriter, r *http.Request, restCall string, err error,
+) {
+	localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+	respCode := http.StatusInternalServerError
+	msg := "Unable to connect with tenant credentials"
+	if errors.Is(err, errNoTenant) {
+		respCode = http.StatusUnauthorized
+		msg = "Per-tenant credentials need an authenticated client"
+	} else if errors.Is(err, core.ErrUnknownTenant) {
+		respCode = http.StatusForbidden
+		msg = "No credentials for tenant"
+	}
+	log.WithError(err).WithFields(localLogTags).Errorf(msg)
+	h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+}
+
+// replyNotSupportedForTenants helper function to reject a request the server can not serve
+// with per-tenant credentials. Returns true if the request is rejected.
+func (h APIRestJetStreamDataplaneHandler) replyNotSupportedForTenants(
+	w http.ResponseWriter, r *http.Request, restCall string,
+) bool {
+	if h.tenantClients == nil {
+		return false
+	}
+	localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+	msg := "Not supported with per-tenant credentials"
+	log.WithFields(localLogTags).Errorf(msg)
+	h.reply(
+		w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg), restCall, r,
+	)
+	return true
+}
+
+// publishContext helper function to define the context of a publish, which ends once the
+// publish has waited ack_wait, or the server default, for the JetStream ACK
+func (h APIRestJetStreamDataplaneHandler) publishContext(
+	r *http.Request,
+) (context.Context, context.CancelFunc, error) {
+	ackWait := h.publish.AckWait
+	if t := r.URL.Query().Get("ack_wait"); t != "" {
+		p, err := time.ParseDuration(t)
+		if err != nil || p <= 0 {
+			return nil, nil, fmt.Errorf("Unable to parse ack_wait")
+		}
+		ackWait = p
+	}
+	if ackWait == 0 {
+		ctxt, cancel := context.WithCancel(r.Context())
+		return ctxt, cancel, nil
+	}
+	ctxt, cancel := context.WithTimeout(r.Context(), ackWait)
+	return ctxt, cancel, nil
+}
+
+// setStreamQuotaHeaders helper function to tell a client how much of its limits the stream
+// storing a subject uses
+func (h APIRestJetStreamDataplaneHandler) setStreamQuotaHeaders(
+	w http.ResponseWriter, r *http.Request, subject string,
+) {
+	usage, ok, err := h.publish.Quotas.Usage(subject, r.Context())
+	if err != nil {
+		localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+		log.WithError(err).WithFields(localLogTags).Debugf("Unable to read stream quota of %s", subject)
+		return
+	}
+	if !ok {
+		return
+	}
+	w.Header().Set("Httpmq-Quota-Stream", usage.Stream)
+	w.Header().Set("Httpmq-Quota-Bytes-Used", strconv.FormatUint(usage.Bytes, 10))
+	if usage.MaxBytes > 0 {
+		w.Header().Set("Httpmq-Quota-Bytes-Limit", strconv.FormatInt(usage.MaxBytes, 10))
+	}
+	w.Header().Set("Httpmq-Quota-Msgs-Used", strconv.FormatUint(usage.Msgs, 10))
+	if usage.MaxMsgs > 0 {
+		w.Header().Set("Httpmq-Quota-Msgs-Limit", strconv.FormatInt(usage.MaxMsgs, 10))
+	}
+}
+
+// readPublishExpectations helper function to read the optimistic concurrency expectations
+// of a publish from the request headers. Returns whether any expectation is set.
+func readPublishExpectations(r *http.Request) (dataplane.PublishExpectations, bool, error) {
+	expect := dataplane.PublishExpectations{
+		MsgID:     r.Header.Get("Httpmq-Msg-Id"),
+		Stream:    r.Header.Get("Httpmq-Expected-Stream"),
+		LastMsgID: r.Header.Get("Httpmq-Expected-Last-Msg-Id"),
+	}
+	if t := r.Header.Get("Httpmq-Expected-Last-Sequence"); t != "" {
+		p, err := strconv.ParseUint(t, 10, 64)
+		if err != nil {
+			return expect, false, fmt.Errorf("Unable to parse Httpmq-Expected-Last-Sequence")
+		}
+		expect.LastSequence = &p
+	}
+	expected := expect.MsgID != "" ||
+		expect.Stream != "" ||
+		expect.LastMsgID != "" ||
+		expect.LastSequence != nil
+	return expect, expected, nil
+}
+
+// setPublishBackpressureHeaders helper function to tell a client when to retry a publish
+// rejected due to too many publishes awaiting ACK
+func (h APIRestJetStreamDataplaneHandler) setPublishBackpressureHeaders(
+	w http.ResponseWriter, client *core.NatsClient,
+) {
+	retryAfter := int(math.Ceil(h.publish.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set(
+		"Httpmq-Publish-Pending", strconv.Itoa(client.JetStream().PublishAsyncPending()),
+	)
+}
+
 // PublishMessage godoc
 // @Summary Publish a message
-// @Description Publish a Base64 encoded message to a JetStream subject
+// @Description Publish a Base64 encoded message to a JetStream subject. With ack_policy "wait",
+// the call returns once JetStream ACKs the message is stored, or the client ends the request.
+// With ack_policy "none", the call returns once the message is sent to NATS; failures, such
+// as no stream matching the subject, are not reported, and streams are not auto-created.
+// The Httpmq-Expected-* headers make the publish conditional on the state of the stream,
+// for optimistic concurrency control; the message is rejected with 409 if the stream does
+// not meet them. A message matching a route of the server's publish routing table, by
+// subject prefix or request header, is published to the first healthy destination of the
+// route. If enabled, the response reports how much of its limits the stream storing the
+// message uses, as last read within the server's cache TTL. If the stream has a PII policy,
+// a message in which PII is found is rejected with 400, redacted, or tagged with the
+// Httpmq-PII-Detected header, as the policy decides.
 // @tags Dataplane,post,publish
 // @Accept plain
 // @Produce json
 // @Param subjectName path string true "JetStream subject to publish under"
+// @Param ack_policy query string false "Whether to wait for JetStream to ACK the message: wait, none (DEFAULT: wait)"
+// @Param ack_wait query string false "How long to wait for the ACK, e.g. 5s (DEFAULT: server setting)"
+// @Param Httpmq-Msg-Id header string false "ID of the message, for later publishes to expect"
+// @Param Httpmq-Expected-Stream header string false "Only store the message if stored by this stream"
+// @Param Httpmq-Expected-Last-Sequence header integer false "Only store the message if the last message of the stream has this sequence number"
+// @Param Httpmq-Expected-Last-Msg-Id header string false "Only store the message if the last message of the stream has this ID"
 // @Param message body string true "Message to publish in Base64 encoding"
 // @Success 200 {object} StandardResponse "success"
 // @Failure 400 {object} StandardResponse "error"
+// @Failure 403 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
+// @Failure 409 {object} StandardResponse "error"
 // @Failure 500 {object} StandardResponse "error"
-// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Failure 503 {object} StandardResponse "error"
+// @Failure 504 {object} StandardResponse "error"
+// @Header 200,400,403,409,500,503,504 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 503 {string} Retry-After "Seconds to wait before retrying"
+// @Header 503 {string} Httpmq-Publish-Pending "Number of publishes awaiting ACK"
+// @Header 200 {string} Httpmq-Stream-Created "Name of the stream this publish defined for the subject, if any"
+// @Header 200 {string} Httpmq-Stream "Stream which stored the message, if publish expectations are set"
+// @Header 200 {integer} Httpmq-Sequence "Sequence number of the message, if publish expectations are set"
+// @Header 200 {string} Httpmq-Publish-Destination "Destination the message was routed to, if any"
+// @Header 200,400 {string} Httpmq-PII-Detected "Detectors which found PII in the message, if any"
+// @Header 200 {string} Httpmq-Quota-Stream "Stream storing the message, if quota usage is reported"
+// @Header 200 {integer} Httpmq-Quota-Bytes-Used "Size of the messages stored by the stream"
+// @Header 200 {integer} Httpmq-Quota-Bytes-Limit "Max size of the messages stored by the stream, if limited"
+// @Header 200 {integer} Httpmq-Quota-Msgs-Used "Number of messages stored by the stream"
+// @Header 200 {integer} Httpmq-Quota-Msgs-Limit "Max number of messages stored by the stream, if limited"
 // @Router /v1/data/subject/{subjectName} [post]
 func (h APIRestJetStreamDataplaneHandler) PublishMessage(w http.ResponseWriter, r *http.Request) {
 	restCall := "POST /v1/data/subject/{subjectName}"
@@ -114,44 +692,177 @@ func (h APIRestJetStreamDataplaneHandler) PublishMessage(w http.ResponseWriter,
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
+	if subjectName, ok = h.checkSubject(w, r, restCall, subjectName, false); !ok {
+		return
+	}
 
-	// Decode the message
-	var decodedMsg []byte
-	{
-		decoder := base64.NewDecoder(base64.StdEncoding, r.Body)
-		buf := new(bytes.Buffer)
-		decodeNum, err := io.Copy(buf, decoder)
-		if err != nil {
-			msg := "Failed to base64 decode body"
-			log.WithError(err).WithFields(localLogTags).Errorf(msg)
-			h.reply(
-				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
-			)
-			return
-		}
-		if decodeNum == 0 {
-			msg := "Base64 decode resulted in empty body"
+	ackPolicy := dataplane.PublishAckWait
+	if p := r.URL.Query().Get("ack_policy"); p != "" {
+		ackPolicy = dataplane.PublishAckPolicy(p)
+		if ackPolicy != dataplane.PublishAckWait && ackPolicy != dataplane.PublishAckNone {
+			msg := fmt.Sprintf("Unknown ack_policy '%s'", p)
 			log.WithFields(localLogTags).Errorf(msg)
 			h.reply(
 				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
 			)
 			return
 		}
-		decodedMsg = buf.Bytes()
 	}
 
+	expect, expected, err := readPublishExpectations(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if expected && ackPolicy != dataplane.PublishAckWait {
+		msg := "Publish expectations need ack_policy wait"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	transport, err := h.transportFor(r)
+	if err != nil {
+		h.replyTransportError(w, r, restCall, err)
+		return
+	}
+	defer transport.release()
+
+	// Messages published with tenant credentials are not routed, as the destinations are
+	// connected with the server's credentials
+	var route *dataplane.PublishRoute
+	if h.publish.Router != nil && transport.tenant == "" {
+		route = h.publish.Router.Match(subjectName, r.Header)
+	}
+
+	pubCtxt, cancel, err := h.publishContext(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	defer cancel()
+
+	// Decode the message
+	decodedMsg, release, err := h.decodePublishBody(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	defer release()
+	if !h.inspectContent(w, r, restCall, subjectName, decodedMsg) {
+		return
+	}
+	scan, ok := h.scanPII(w, r, restCall, subjectName, decodedMsg, true)
+	if !ok {
+		return
+	}
+	decodedMsg = scan.Message
+
 	// Publish the message
-	if err := h.publisher.Publish(subjectName, decodedMsg, r.Context()); err != nil {
+	var published dataplane.PublishResult
+	publishWith := func(publisher dataplane.JetStreamPublisher) error {
+		if scan.Action == dataplane.PIIActionTag {
+			// Only a message with headers can carry the tag, which is always sent waiting for
+			// the ACK
+			toSend := nats.NewMsg(subjectName)
+			toSend.Data = decodedMsg
+			toSend.Header.Set(dataplane.PIIDetectedHeader, strings.Join(scan.Detected, ","))
+			expect.Apply(toSend)
+			published = publisher.PublishMsg(toSend, pubCtxt)
+			return published.Err
+		}
+		if expected {
+			published = publisher.PublishWithExpectations(subjectName, decodedMsg, expect, pubCtxt)
+			return published.Err
+		}
+		return publisher.PublishWithPolicy(subjectName, decodedMsg, ackPolicy, pubCtxt)
+	}
+	destination := ""
+	publish := func() error {
+		if route == nil {
+			return publishWith(transport.publisher)
+		}
+		var err error
+		destination, err = h.publish.Router.Publish(route, publishWith, pubCtxt)
+		return err
+	}
+	publishStart := time.Now()
+	err = publish()
+	// No stream is listening on the subject, define one if permitted. Streams are defined
+	// through the server's own client, so not for requests served with tenant credentials,
+	// routed to other destinations, or failed over to the secondary cluster. A publish which
+	// does not wait for the ACK never learns that no stream is listening, so it does not
+	// define one.
+	if err != nil &&
+		h.streamAutoCreate != nil &&
+		transport.tenant == "" &&
+		route == nil &&
+		!transport.failedOver &&
+		dataplane.IsNoStreamError(err) {
+		streamName, created, createErr := h.autoCreateStream(subjectName, r.Context())
+		if createErr != nil {
+			respCode := http.StatusInternalServerError
+			if errors.Is(createErr, hooks.ErrRejected) {
+				respCode = http.StatusForbidden
+			}
+			msg := fmt.Sprintf("Unable to define stream for subject %s", subjectName)
+			log.WithError(createErr).WithFields(localLogTags).Errorf(msg)
+			h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+			return
+		}
+		if created {
+			log.WithFields(localLogTags).Infof(
+				"Defined stream %s for subject %s on publish", streamName, subjectName,
+			)
+			w.Header().Set("Httpmq-Stream-Created", streamName)
+		}
+		err = publish()
+	}
+	h.recordPublishSLO(err, time.Since(publishStart))
+	h.recordPublishRate(subjectName, err)
+	if err != nil {
+		respCode := http.StatusInternalServerError
 		msg := fmt.Sprintf("Unable to publish message to %s", subjectName)
+		if errors.Is(err, hooks.ErrRejected) {
+			respCode = http.StatusForbidden
+			msg = fmt.Sprintf("Message to %s rejected: %s", subjectName, err)
+		} else if dataplane.IsPublishExpectationError(err) {
+			respCode = http.StatusConflict
+			msg = fmt.Sprintf("Message to %s not stored: %s", subjectName, err)
+		} else if dataplane.IsPublishBackpressureError(err) {
+			respCode = http.StatusServiceUnavailable
+			msg = "Too many publishes awaiting ACK"
+			h.setPublishBackpressureHeaders(w, transport.publishClient)
+		} else if errors.Is(err, dataplane.ErrNoHealthyDestination) {
+			respCode = http.StatusServiceUnavailable
+			msg = fmt.Sprintf("No healthy destination for message to %s", subjectName)
+		} else if pubCtxt.Err() == context.DeadlineExceeded {
+			respCode = http.StatusGatewayTimeout
+			msg = fmt.Sprintf("No ACK for message to %s within ack_wait", subjectName)
+		}
 		log.WithError(err).WithFields(localLogTags).Errorf(msg)
-		h.reply(
-			w, http.StatusInternalServerError, getStdRESTErrorMsg(
-				http.StatusInternalServerError, &msg,
-			), restCall, r,
-		)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
 		return
 	}
 
+	if destination != "" {
+		w.Header().Set("Httpmq-Publish-Destination", destination)
+	}
+	// Stream usage is read through the server's own client, so only reported for messages
+	// it published
+	if h.publish.Quotas != nil && transport.tenant == "" && route == nil && !transport.failedOver {
+		h.setStreamQuotaHeaders(w, r, subjectName)
+	}
+	if expected {
+		w.Header().Set("Httpmq-Stream", published.Stream)
+		w.Header().Set("Httpmq-Sequence", strconv.FormatUint(published.Sequence, 10))
+	}
 	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
 }
 
@@ -162,28 +873,3807 @@ func (h APIRestJetStreamDataplaneHandler) PublishMessageHandler() http.HandlerFu
 	})
 }
 
-// =======================================================================
-// Message subscription
-
 // -----------------------------------------------------------------------
 
-// ReceiveMsgACK godoc
-// @Summary Handle ACK for message
-// @Description Process JetStream message ACK for a stream / consumer
-// @tags Dataplane,post,subscribe
+// APIRestReqFanOutPublish parameters for publishing one message to multiple subjects
+type APIRestReqFanOutPublish struct {
+	// Subjects is the list of subjects to publish the message under
+	Subjects []string `json:"subjects" validate:"required,min=1,dive,required"`
+	// Message is the message body, Base64 encoded
+	Message []byte `json:"b64_msg" validate:"required"`
+}
+
+// pooledB64Message is a Base64 encoded JSON string decoded into a pooled buffer
+type pooledB64Message struct {
+	buf *bytes.Buffer
+}
+
+// UnmarshalJSON decode the Base64 encoded JSON string into the buffer
+func (m pooledB64Message) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return fmt.Errorf("b64_msg is not a string")
+	}
+	encoded := data[1 : len(data)-1]
+	// Base64 never needs escaping, but "/" may still be escaped by some encoders
+	if bytes.IndexByte(encoded, '\\') >= 0 {
+		var unquoted string
+		if err := common.JSON().Unmarshal(data, &unquoted); err != nil {
+			return err
+		}
+		encoded = []byte(unquoted)
+	}
+	_, err := common.DecodeBase64Into(m.buf, bytes.NewReader(encoded), int64(len(encoded)))
+	return err
+}
+
+// decodeFanOutPublish helper function to parse a fan-out publish request. With a publish
+// buffer pool, the request body and the decoded message are held in pooled buffers; the
+// returned release function must be called once the message is no longer used.
+func (h APIRestJetStreamDataplaneHandler) decodeFanOutPublish(
+	r *http.Request,
+) (APIRestReqFanOutPublish, func(), error) {
+	var params APIRestReqFanOutPublish
+	if h.publish.Buffers == nil {
+		err := common.JSON().NewDecoder(r.Body).Decode(&params)
+		return params, func() {}, err
+	}
+	body := h.publish.Buffers.Get()
+	msg := h.publish.Buffers.Get()
+	release := func() {
+		h.publish.Buffers.Put(body)
+		h.publish.Buffers.Put(msg)
+	}
+	if r.ContentLength > 0 {
+		body.Grow(int(r.ContentLength) + bytes.MinRead)
+	}
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		release()
+		return params, nil, err
+	}
+	parsed := struct {
+		Subjects []string         `json:"subjects"`
+		Message  pooledB64Message `json:"b64_msg"`
+	}{Message: pooledB64Message{buf: msg}}
+	if err := common.JSON().Unmarshal(body.Bytes(), &parsed); err != nil {
+		release()
+		return params, nil, err
+	}
+	params.Subjects = parsed.Subjects
+	if msg.Len() > 0 {
+		params.Message = msg.Bytes()
+	}
+	return params, release, nil
+}
+
+// APIRestRespPublishResult the outcome of publishing to one subject
+type APIRestRespPublishResult struct {
+	// Subject is the subject the message was published under
+	Subject string `json:"subject"`
+	// Success indicates whether the publish was successful
+	Success bool `json:"success"`
+	// Stream is the stream which stored the message
+	Stream string `json:"stream,omitempty"`
+	// Sequence is the message sequence number within the stream
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Error is the description of the failure, if any
+	Error *string `json:"error,omitempty"`
+}
+
+// APIRestRespFanOutPublish response for publishing one message to multiple subjects
+type APIRestRespFanOutPublish struct {
+	StandardResponse
+	// Results are the per subject publish outcomes, in the same order as the request
+	Results []APIRestRespPublishResult `json:"results"`
+}
+
+// FanOutPublishMessage godoc
+// @Summary Publish a message to multiple subjects
+// @Description Publish one message to multiple JetStream subjects in one call. The result
+// of publishing to each subject is reported separately.
+// @tags Dataplane,post,publish
+// @Accept json
+// @Produce json
+// @Param ack_wait query string false "How long to wait for the ACKs, e.g. 5s (DEFAULT: server setting)"
+// @Param param body APIRestReqFanOutPublish true "Subjects and message to publish"
+// @Success 200 {object} APIRestRespFanOutPublish "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 403 {object} APIRestRespFanOutPublish "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} APIRestRespFanOutPublish "error"
+// @Failure 503 {object} APIRestRespFanOutPublish "error"
+// @Header 200,400,403,500,503 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 503 {string} Retry-After "Seconds to wait before retrying"
+// @Header 503 {string} Httpmq-Publish-Pending "Number of publishes awaiting ACK"
+// @Router /v1/data/subjects [post]
+func (h APIRestJetStreamDataplaneHandler) FanOutPublishMessage(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "POST /v1/data/subjects"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	params, release, err := h.decodeFanOutPublish(r)
+	if err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	defer release()
+
+	if err := h.validate.Struct(&params); err != nil {
+		msg := "Bad request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	for idx, subject := range params.Subjects {
+		var ok bool
+		if params.Subjects[idx], ok = h.checkSubject(w, r, restCall, subject, false); !ok {
+			return
+		}
+	}
+
+	transport, err := h.transportFor(r)
+	if err != nil {
+		h.replyTransportError(w, r, restCall, err)
+		return
+	}
+	defer transport.release()
+
+	pubCtxt, cancel, err := h.publishContext(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	defer cancel()
+
+	for _, subject := range params.Subjects {
+		if !h.inspectContent(w, r, restCall, subject, params.Message) {
+			return
+		}
+		if _, ok := h.scanPII(w, r, restCall, subject, params.Message, false); !ok {
+			return
+		}
+	}
+
+	// Publish the message
+	publishStart := time.Now()
+	results := transport.publisher.PublishToSubjects(params.Subjects, params.Message, pubCtxt)
+	for _, result := range results {
+		h.recordPublishSLO(result.Err, time.Since(publishStart))
+		h.recordPublishRate(result.Subject, result.Err)
+	}
+	resp := APIRestRespFanOutPublish{
+		StandardResponse: getStdRESTSuccessMsg(),
+		Results:          make([]APIRestRespPublishResult, len(results)),
+	}
+	failed := 0
+	backpressured := 0
+	rejected := 0
+	for idx, result := range results {
+		resp.Results[idx] = APIRestRespPublishResult{
+			Subject:  result.Subject,
+			Success:  result.Err == nil,
+			Stream:   result.Stream,
+			Sequence: result.Sequence,
+		}
+		if result.Err != nil {
+			failed++
+			if dataplane.IsPublishBackpressureError(result.Err) {
+				backpressured++
+			} else if errors.Is(result.Err, hooks.ErrRejected) {
+				rejected++
+			}
+			errMsg := result.Err.Error()
+			resp.Results[idx].Error = &errMsg
+			log.WithError(result.Err).WithFields(localLogTags).Errorf(
+				"Unable to publish message to %s", result.Subject,
+			)
+		}
+	}
+
+	if failed > 0 {
+		respCode := http.StatusInternalServerError
+		// Only ask the client to retry later if that would resolve all the failures
+		if backpressured == failed {
+			respCode = http.StatusServiceUnavailable
+			h.setPublishBackpressureHeaders(w, transport.publishClient)
+		} else if rejected == failed {
+			respCode = http.StatusForbidden
+		}
+		msg := fmt.Sprintf("Unable to publish message to %d of %d subjects", failed, len(results))
+		resp.StandardResponse = getStdRESTErrorMsg(respCode, &msg)
+		h.reply(w, respCode, resp, restCall, r)
+		return
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// FanOutPublishMessageHandler Wrapper around FanOutPublishMessage
+func (h APIRestJetStreamDataplaneHandler) FanOutPublishMessageHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.FanOutPublishMessage(w, r)
+	})
+}
+
+// APIRestReqTransactionMessage a message published as part of a transaction
+type APIRestReqTransactionMessage struct {
+	// Subject is the subject to publish the message under
+	Subject string `json:"subject" validate:"required"`
+	// Message is the message body, Base64 encoded
+	Message []byte `json:"b64_msg" validate:"required"`
+}
+
+// APIRestReqTransactionPublish parameters for publishing messages as one transaction
+type APIRestReqTransactionPublish struct {
+	// Messages are the messages of the transaction
+	Messages []APIRestReqTransactionMessage `json:"messages" validate:"required,min=1,dive"`
+}
+
+// APIRestRespTransactionResult the outcome of publishing one message of a transaction
+type APIRestRespTransactionResult struct {
+	APIRestRespPublishResult
+	// Tombstone is the outcome of publishing the tombstone of the message, if it was stored
+	// but the transaction failed
+	Tombstone *APIRestRespPublishResult `json:"tombstone,omitempty"`
+}
+
+// APIRestRespTransactionPublish response for publishing messages as one transaction
+type APIRestRespTransactionPublish struct {
+	StandardResponse
+	// TransactionID is the ID of the transaction, carried by each of its messages and
+	// tombstones in the Httpmq-Transaction-ID header
+	TransactionID string `json:"transaction_id"`
+	// Committed indicates whether every message of the transaction was stored
+	Committed bool `json:"committed"`
+	// Results are the per message outcomes, in the same order as the request
+	Results []APIRestRespTransactionResult `json:"results"`
+}
+
+// restPublishResult helper function to describe the outcome of a publish
+func restPublishResult(result dataplane.PublishResult) APIRestRespPublishResult {
+	desc := APIRestRespPublishResult{
+		Subject:  result.Subject,
+		Success:  result.Err == nil,
+		Stream:   result.Stream,
+		Sequence: result.Sequence,
+	}
+	if result.Err != nil {
+		errMsg := result.Err.Error()
+		desc.Error = &errMsg
+	}
+	return desc
+}
+
+// TransactionPublishMessages godoc
+// @Summary Publish messages as one transaction
+// @Description Publish a set of messages to multiple subjects, all or nothing on a best
+// effort basis. The streams of all subjects are checked before anything is published. If
+// any message is then not stored, a tombstone is published for each message which was,
+// carrying the Httpmq-Tombstone header with the "<stream>:<sequence>" of that message.
+// @tags Dataplane,post,publish
+// @Accept json
+// @Produce json
+// @Param ack_wait query string false "How long to wait for the ACKs, e.g. 5s (DEFAULT: server setting)"
+// @Param param body APIRestReqTransactionPublish true "Messages to publish"
+// @Success 200 {object} APIRestRespTransactionPublish "success"
+// @Failure 400 {object} APIRestRespTransactionPublish "error"
+// @Failure 403 {object} APIRestRespTransactionPublish "error"
+// @Failure 404 {string} string "error"
+// @Failure 409 {object} APIRestRespTransactionPublish "error"
+// @Failure 500 {object} APIRestRespTransactionPublish "error"
+// @Failure 503 {object} APIRestRespTransactionPublish "error"
+// @Header 200,400,403,409,500,503 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 503 {string} Retry-After "Seconds to wait before retrying"
+// @Header 503 {string} Httpmq-Publish-Pending "Number of publishes awaiting ACK"
+// @Router /v1/data/transaction [post]
+func (h APIRestJetStreamDataplaneHandler) TransactionPublishMessages(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "POST /v1/data/transaction"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	var params APIRestReqTransactionPublish
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if err := h.validate.Struct(&params); err != nil {
+		msg := "Bad request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	for idx, msg := range params.Messages {
+		var ok bool
+		if params.Messages[idx].Subject, ok = h.checkSubject(
+			w, r, restCall, msg.Subject, false,
+		); !ok {
+			return
+		}
+	}
+
+	transport, err := h.transportFor(r)
+	if err != nil {
+		h.replyTransportError(w, r, restCall, err)
+		return
+	}
+	defer transport.release()
+
+	pubCtxt, cancel, err := h.publishContext(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	defer cancel()
+
+	msgs := make([]dataplane.TransactionMessage, len(params.Messages))
+	for idx, msg := range params.Messages {
+		if !h.inspectContent(w, r, restCall, msg.Subject, msg.Message) {
+			return
+		}
+		scan, ok := h.scanPII(w, r, restCall, msg.Subject, msg.Message, true)
+		if !ok {
+			return
+		}
+		msgs[idx] = dataplane.TransactionMessage{Subject: msg.Subject, Message: scan.Message}
+		if scan.Action == dataplane.PIIActionTag {
+			msgs[idx].Header = nats.Header{}
+			msgs[idx].Header.Set(dataplane.PIIDetectedHeader, strings.Join(scan.Detected, ","))
+		}
+	}
+
+	// Publish the messages
+	publishStart := time.Now()
+	result := transport.publisher.PublishTransaction(msgs, pubCtxt)
+	resp := APIRestRespTransactionPublish{
+		StandardResponse: getStdRESTSuccessMsg(),
+		TransactionID:    result.ID,
+		Committed:        result.Committed,
+		Results:          make([]APIRestRespTransactionResult, len(result.Results)),
+	}
+	for idx, msgResult := range result.Results {
+		if !errors.Is(msgResult.Err, dataplane.ErrTransactionAborted) {
+			h.recordPublishSLO(msgResult.Err, time.Since(publishStart))
+		}
+		h.recordPublishRate(msgResult.Subject, msgResult.Err)
+		resp.Results[idx].APIRestRespPublishResult = restPublishResult(msgResult.PublishResult)
+		if msgResult.Tombstone != nil {
+			tombstone := restPublishResult(*msgResult.Tombstone)
+			resp.Results[idx].Tombstone = &tombstone
+		}
+	}
+
+	if !result.Committed {
+		failed := result.Failed()
+		count := func(match func(error) bool) int {
+			matched := 0
+			for _, msgResult := range failed {
+				if match(msgResult.Err) {
+					matched++
+				}
+			}
+			return matched
+		}
+		isRejected := func(err error) bool {
+			return errors.Is(err, hooks.ErrRejected)
+		}
+		// Only report a specific cause if it explains all the failures
+		respCode := http.StatusInternalServerError
+		if count(dataplane.IsNoStreamError) == len(failed) {
+			respCode = http.StatusBadRequest
+		} else if count(isRejected) == len(failed) {
+			respCode = http.StatusForbidden
+		} else if count(dataplane.IsPublishExpectationError) == len(failed) {
+			respCode = http.StatusConflict
+		} else if count(dataplane.IsPublishBackpressureError) == len(failed) {
+			respCode = http.StatusServiceUnavailable
+			h.setPublishBackpressureHeaders(w, transport.publishClient)
+		}
+		msg := fmt.Sprintf(
+			"Transaction %s failed on %d of %d messages", result.ID, len(failed), len(result.Results),
+		)
+		log.WithFields(localLogTags).Errorf(msg)
+		resp.StandardResponse = getStdRESTErrorMsg(respCode, &msg)
+		h.reply(w, respCode, resp, restCall, r)
+		return
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// TransactionPublishMessagesHandler Wrapper around TransactionPublishMessages
+func (h APIRestJetStreamDataplaneHandler) TransactionPublishMessagesHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.TransactionPublishMessages(w, r)
+	})
+}
+
+// recordPublishSLO helper function to record a publish against the service level objectives.
+// Publishes refused for reasons of the client's own are not counted.
+func (h APIRestJetStreamDataplaneHandler) recordPublishSLO(err error, latency time.Duration) {
+	if h.slo == nil ||
+		errors.Is(err, hooks.ErrRejected) ||
+		dataplane.IsPublishExpectationError(err) ||
+		dataplane.IsNoStreamError(err) {
+		return
+	}
+	h.slo.Record(metrics.SLOPathPublish, err == nil, latency)
+}
+
+// inspectContent helper function to check the content of a message before publishing it.
+// Replies to the request, and returns false, if the message is rejected.
+func (h APIRestJetStreamDataplaneHandler) inspectContent(
+	w http.ResponseWriter, r *http.Request, restCall, subject string, msg []byte,
+) bool {
+	if h.publish.Inspector == nil {
+		return true
+	}
+	err := h.publish.Inspector.Inspect(subject, msg, r.Context())
+	if err == nil {
+		return true
+	}
+	localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+	respCode := http.StatusInternalServerError
+	errMsg := fmt.Sprintf("Unable to inspect message to %s", subject)
+	if errors.Is(err, dataplane.ErrContentRejected) {
+		respCode = http.StatusBadRequest
+		errMsg = fmt.Sprintf("Message to %s rejected: %s", subject, err)
+	}
+	log.WithError(err).WithFields(localLogTags).Errorf(errMsg)
+	h.reply(w, respCode, getStdRESTErrorMsg(respCode, &errMsg), restCall, r)
+	return false
+}
+
+// scanPII helper function to scan a message for PII before publishing it. Replies to the
+// request, and returns false, if the message is rejected. Paths which can not publish the
+// redacted or tagged message, as indicated by rewritable, reject those as well.
+//
+// The detectors finding PII are reported in the Httpmq-PII-Detected response header.
+func (h APIRestJetStreamDataplaneHandler) scanPII(
+	w http.ResponseWriter, r *http.Request, restCall, subject string, msg []byte, rewritable bool,
+) (dataplane.PIIScanResult, bool) {
+	if h.publish.PIIScanner == nil {
+		return dataplane.PIIScanResult{Message: msg}, true
+	}
+	scan, err := h.publish.PIIScanner.Scan(subject, msg, r.Context())
+	if err == nil && !rewritable && scan.Action != "" {
+		err = fmt.Errorf(
+			"stream %s: %w: %s, and its %s action needs the message published to the subject alone",
+			scan.Stream,
+			dataplane.ErrPIIRejected,
+			strings.Join(scan.Detected, ", "),
+			scan.Action,
+		)
+	}
+	if len(scan.Detected) > 0 {
+		w.Header().Set(dataplane.PIIDetectedHeader, strings.Join(scan.Detected, ","))
+	}
+	if err == nil {
+		return scan, true
+	}
+	localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+	respCode := http.StatusInternalServerError
+	errMsg := fmt.Sprintf("Unable to scan message to %s for PII", subject)
+	if errors.Is(err, dataplane.ErrPIIRejected) {
+		respCode = http.StatusBadRequest
+		errMsg = fmt.Sprintf("Message to %s rejected: %s", subject, err)
+	}
+	log.WithError(err).WithFields(localLogTags).Errorf(errMsg)
+	h.reply(w, respCode, getStdRESTErrorMsg(respCode, &errMsg), restCall, r)
+	return scan, false
+}
+
+// recordPublishRate helper function to count a successful publish toward the publish rate
+// of its subject
+func (h APIRestJetStreamDataplaneHandler) recordPublishRate(subject string, err error) {
+	if h.publish.Anomalies != nil && err == nil {
+		h.publish.Anomalies.Record(subject)
+	}
+}
+
+// recordDeliverySLO helper function to record a message delivery against the service level
+// objectives. The latency is from when the stream stored the message.
+func (h APIRestJetStreamDataplaneHandler) recordDeliverySLO(msg *nats.Msg, success bool) {
+	if h.slo == nil {
+		return
+	}
+	var latency time.Duration
+	if meta, err := msg.Metadata(); err == nil {
+		latency = time.Since(meta.Timestamp)
+	}
+	h.slo.Record(metrics.SLOPathDelivery, success, latency)
+}
+
+// traceDelivery helper function to record a message sent to a client in the message trace
+func (h APIRestJetStreamDataplaneHandler) traceDelivery(
+	msg *nats.Msg, outcome dataplane.TraceOutcome,
+) {
+	if h.tracer != nil {
+		h.tracer.Record(msg, outcome)
+	}
+}
+
+// =======================================================================
+// Request / reply
+
+// -----------------------------------------------------------------------
+
+// APIRestRespRPCReplies response carrying the replies to a request
+type APIRestRespRPCReplies struct {
+	StandardResponse
+	// CorrelationID is the correlation ID of the request
+	CorrelationID string `json:"correlation_id"`
+	// Replies are the replies received for the request
+	Replies []dataplane.RPCReply `json:"replies"`
+}
+
+// RequestReply godoc
+// @Summary Send a request and wait for the reply
+// @Description Publish a Base64 encoded request message to a JetStream subject, and wait for
+// the replies correlated with it. The request carries the headers Httpmq-Correlation-ID and
+// Httpmq-Reply-To; responders reply by publishing to the subject in Httpmq-Reply-To.
+// @tags Dataplane,post,publish
+// @Accept plain
+// @Produce json
+// @Param subjectName path string true "JetStream subject to publish the request under"
+// @Param Httpmq-Correlation-ID header string false "Correlation ID of the request (DEFAULT: generated)"
+// @Param timeout query string false "How long to wait for replies, e.g. 5s (DEFAULT and max: server setting)"
+// @Param max_replies query integer false "Stop waiting after this many replies (DEFAULT: 1)"
+// @Param message body string true "Request message in Base64 encoding"
+// @Success 200 {object} APIRestRespRPCReplies "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 504 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,504 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 200,504 {string} Httpmq-Correlation-ID "Correlation ID of the request"
+// @Router /v1/data/subject/{subjectName}/request [post]
+func (h APIRestJetStreamDataplaneHandler) RequestReply(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/data/subject/{subjectName}/request"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.replyNotSupportedForTenants(w, r, restCall) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	subjectName, ok := vars["subjectName"]
+	if !ok {
+		msg := "No subject name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if subjectName, ok = h.checkSubject(w, r, restCall, subjectName, false); !ok {
+		return
+	}
+
+	correlationID := r.Header.Get(dataplane.RPCCorrelationIDHeader)
+	if correlationID == "" {
+		correlationID = uuid.New().String()
+	} else if !dataplane.IsValidCorrelationID(correlationID) {
+		msg := "Correlation ID can not contain '.', '*', '>', or whitespace"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	timeout := h.rpc.MaxTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		p, err := time.ParseDuration(t)
+		if err != nil || p <= 0 {
+			msg := "Unable to parse timeout"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(
+				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+			)
+			return
+		}
+		if p < timeout {
+			timeout = p
+		}
+	}
+
+	maxReplies := 1
+	if m := r.URL.Query().Get("max_replies"); m != "" {
+		p, err := strconv.Atoi(m)
+		if err != nil || p <= 0 {
+			msg := "Unable to parse max_replies"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(
+				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+			)
+			return
+		}
+		maxReplies = p
+	}
+
+	// Decode the message
+	decodedMsg, release, err := h.decodePublishBody(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	defer release()
+	if !h.inspectContent(w, r, restCall, subjectName, decodedMsg) {
+		return
+	}
+	if _, ok := h.scanPII(w, r, restCall, subjectName, decodedMsg, false); !ok {
+		return
+	}
+
+	w.Header().Set(dataplane.RPCCorrelationIDHeader, correlationID)
+
+	ctxt, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	replies, err := h.rpc.Requester.Request(
+		subjectName, correlationID, decodedMsg, maxReplies, ctxt,
+	)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to send request to %s", subjectName)
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	if len(replies) == 0 {
+		msg := fmt.Sprintf("No reply to request %s within %s", correlationID, timeout)
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusGatewayTimeout, getStdRESTErrorMsg(
+				http.StatusGatewayTimeout, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	h.reply(w, http.StatusOK, APIRestRespRPCReplies{
+		StandardResponse: getStdRESTSuccessMsg(),
+		CorrelationID:    correlationID,
+		Replies:          replies,
+	}, restCall, r)
+}
+
+// RequestReplyHandler Wrapper around RequestReply
+func (h APIRestJetStreamDataplaneHandler) RequestReplyHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.RequestReply(w, r)
+	})
+}
+
+// =======================================================================
+// Message subscription
+
+// -----------------------------------------------------------------------
+
+// ReceiveMsgACK godoc
+// @Summary Handle ACK for message
+// @Description Process JetStream message ACK for a stream / consumer
+// @tags Dataplane,post,subscribe
+// @Accept json
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Param sequenceNum body dataplane.AckSeqNum true "Message message sequence numbers"
+// @Param type query string false "Kind of ACK: ack, nak, term, progress (DEFAULT: ack)"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/stream/{streamName}/consumer/{consumerName}/ack [post]
+func (h APIRestJetStreamDataplaneHandler) ReceiveMsgACK(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/data/stream/{streamName}/consumer/{consumerName}/ack"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+		)
+		return
+	}
+
+	var sequence dataplane.AckSeqNum
+	if err := common.JSON().NewDecoder(r.Body).Decode(&sequence); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	// Validate input
+	if err := h.validate.Struct(&sequence); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	ackInfo := dataplane.AckIndication{
+		Stream: streamName, Consumer: consumerName, SeqNum: dataplane.AckSeqNum{
+			Stream: sequence.Stream, Consumer: sequence.Consumer,
+		},
+		Type: dataplane.AckType(r.URL.Query().Get("type")),
+	}
+	if err := h.validate.Struct(&ackInfo); err != nil {
+		msg := fmt.Sprintf("Unknown ACK type '%s'", ackInfo.Type)
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	transport, err := h.transportFor(r)
+	if err != nil {
+		h.replyTransportError(w, r, restCall, err)
+		return
+	}
+	defer transport.release()
+
+	// Broadcast the ACK
+	if err := transport.ackBroadcast.BroadcastACK(ackInfo, r.Context()); err != nil {
+		msg := fmt.Sprintf("Failed to broadcast ACK %s", ackInfo.String())
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
+
+// ReceiveMsgACKHandler Wrapper around ReceiveMsgACK
+func (h APIRestJetStreamDataplaneHandler) ReceiveMsgACKHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.ReceiveMsgACK(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespInflightMessages response listing the messages of a consumer awaiting ACK
+type APIRestRespInflightMessages struct {
+	StandardResponse
+	// Messages are the messages awaiting ACK, oldest first
+	Messages []dataplane.SessionInflightMessage `json:"messages"`
+}
+
+// GetInflightMessages godoc
+// @Summary Query for messages of a consumer awaiting ACK
+// @Description Query for the messages delivered through a consumer which are still awaiting
+// @Description ACK, by the sessions running on this dataplane instance. Each message gives
+// @Description its sequence numbers, when it was delivered, and how long it has been awaiting ACK.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} APIRestRespInflightMessages "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/stream/{streamName}/consumer/{consumerName}/inflight [get]
+func (h APIRestJetStreamDataplaneHandler) GetInflightMessages(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/data/stream/{streamName}/consumer/{consumerName}/inflight"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+		)
+		return
+	}
+
+	msgs, err := h.dispatchers.ListInflight(streamName, consumerName, r.Context())
+	if err != nil {
+		msg := "Failed to list inflight messages"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	resp := APIRestRespInflightMessages{
+		StandardResponse: StandardResponse{Success: true},
+		Messages:         msgs,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetInflightMessagesHandler Wrapper around GetInflightMessages
+func (h APIRestJetStreamDataplaneHandler) GetInflightMessagesHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetInflightMessages(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespFetchBatch response carrying a batch of messages fetched through a pull consumer
+type APIRestRespFetchBatch struct {
+	StandardResponse
+	// Messages are the messages fetched
+	Messages []dataplane.MsgToDeliver `json:"messages"`
+	// CommitToken ACKs the messages fetched through the consumer up to this batch once
+	// committed. Not set if no messages were fetched.
+	CommitToken string `json:"commit_token,omitempty"`
+}
+
+// FetchBatch godoc
+// @Summary Fetch a batch of messages
+// @Description Fetch a batch of messages through a JetStream pull consumer. The messages are
+// not ACKed individually; instead, committing the returned commit token ACKs every message
+// fetched through the consumer up to this batch. Messages dropped by the consumer's filter
+// are left out of the batch, but are still ACKed by the commit token.
+// @tags Dataplane,post,subscribe
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream pull consumer name"
+// @Param subject_name query string true "JetStream subject to fetch from"
+// @Param batch query integer false "Max number of messages to fetch (DEFAULT and max: server setting)"
+// @Param wait query string false "How long to wait for messages, e.g. 5s (DEFAULT and max: server setting)"
+// @Success 200 {object} APIRestRespFetchBatch "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/stream/{streamName}/consumer/{consumerName}/fetch [post]
+func (h APIRestJetStreamDataplaneHandler) FetchBatch(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/data/stream/{streamName}/consumer/{consumerName}/fetch"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.replyNotSupportedForTenants(w, r, restCall) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	subjectName := r.URL.Query().Get("subject_name")
+	if subjectName == "" {
+		msg := "Missing fetch subject"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if subjectName, ok = h.checkSubject(w, r, restCall, subjectName, true); !ok {
+		return
+	}
+	batchSize := h.fetch.MaxBatch
+	if b := r.URL.Query().Get("batch"); b != "" {
+		p, err := strconv.Atoi(b)
+		if err != nil || p <= 0 {
+			msg := "Unable to parse batch"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(
+				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+			)
+			return
+		}
+		if p < batchSize {
+			batchSize = p
+		}
+	}
+	wait := h.fetch.MaxWait
+	if t := r.URL.Query().Get("wait"); t != "" {
+		p, err := time.ParseDuration(t)
+		if err != nil || p <= 0 {
+			msg := "Unable to parse wait"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(
+				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+			)
+			return
+		}
+		if p < wait {
+			wait = p
+		}
+	}
+
+	ctxt, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	msgs, token, err := h.fetch.Fetcher.Fetch(streamName, consumerName, subjectName, batchSize, ctxt)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to fetch from %s@%s", consumerName, streamName)
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	var filter filters.Filter
+	if h.filters != nil && len(msgs) > 0 {
+		filter, err = h.filters.LoadFilter(streamName, consumerName, r.Context())
+		if errors.Is(err, filters.ErrNoFilter) {
+			filter = nil
+		} else if err != nil {
+			msg := "Unable to load message filter"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(
+				w, http.StatusInternalServerError, getStdRESTErrorMsg(
+					http.StatusInternalServerError, &msg,
+				), restCall, r,
+			)
+			return
+		}
+		if filter != nil {
+			defer func() {
+				if err := filter.Close(context.Background()); err != nil {
+					log.WithError(err).WithFields(localLogTags).Errorf("Failed to close message filter")
+				}
+			}()
+		}
+	}
+
+	resp := APIRestRespFetchBatch{
+		StandardResponse: getStdRESTSuccessMsg(),
+		Messages:         make([]dataplane.MsgToDeliver, 0, len(msgs)),
+		CommitToken:      token,
+	}
+	for _, msg := range msgs {
+		// Uncommitted messages are redelivered, so fail the whole batch
+		if filter != nil {
+			if msg, err = dataplane.ApplyMessageFilter(filter, msg, r.Context()); err != nil {
+				errMsg := "Failed to filter message"
+				log.WithError(err).WithFields(localLogTags).Errorf(errMsg)
+				h.reply(
+					w, http.StatusInternalServerError, getStdRESTErrorMsg(
+						http.StatusInternalServerError, &errMsg,
+					), restCall, r,
+				)
+				return
+			}
+			// Dropped messages are still ACKed by the commit token
+			if msg == nil {
+				continue
+			}
+		}
+		if h.redactor != nil {
+			if msg, err = h.redactor.Redact(streamName, consumerName, msg); err != nil {
+				errMsg := "Failed to redact message"
+				log.WithError(err).WithFields(localLogTags).Errorf(errMsg)
+				h.reply(
+					w, http.StatusInternalServerError, getStdRESTErrorMsg(
+						http.StatusInternalServerError, &errMsg,
+					), restCall, r,
+				)
+				return
+			}
+		}
+		converted, err := dataplane.ConvertJSMessageDeliver(subjectName, msg)
+		if err != nil {
+			errMsg := "Failed to convert message"
+			log.WithError(err).WithFields(localLogTags).Errorf(errMsg)
+			h.reply(
+				w, http.StatusInternalServerError, getStdRESTErrorMsg(
+					http.StatusInternalServerError, &errMsg,
+				), restCall, r,
+			)
+			return
+		}
+		resp.Messages = append(resp.Messages, converted)
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// FetchBatchHandler Wrapper around FetchBatch
+func (h APIRestJetStreamDataplaneHandler) FetchBatchHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.FetchBatch(w, r)
+	})
+}
+
+// APIRestReqCommitBatch parameters for committing fetched messages
+type APIRestReqCommitBatch struct {
+	// CommitToken is the commit token of a fetched batch
+	CommitToken string `json:"commit_token" validate:"required"`
+}
+
+// APIRestRespCommitBatch response for committing fetched messages
+type APIRestRespCommitBatch struct {
+	StandardResponse
+	// Committed is the number of messages ACKed
+	Committed int `json:"committed"`
+}
+
+// CommitBatch godoc
+// @Summary Commit fetched messages
+// @Description ACK every message fetched through a JetStream pull consumer up to a commit
+// token. A commit token is only valid on the dataplane instance which issued it, and only
+// for a limited time.
+// @tags Dataplane,post,subscribe
+// @Accept json
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream pull consumer name"
+// @Param param body APIRestReqCommitBatch true "Commit token"
+// @Success 200 {object} APIRestRespCommitBatch "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/stream/{streamName}/consumer/{consumerName}/commit [post]
+func (h APIRestJetStreamDataplaneHandler) CommitBatch(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/data/stream/{streamName}/consumer/{consumerName}/commit"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.replyNotSupportedForTenants(w, r, restCall) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	var params APIRestReqCommitBatch
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if err := h.validate.Struct(&params); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	committed, err := h.fetch.Fetcher.Commit(
+		streamName, consumerName, params.CommitToken, r.Context(),
+	)
+	if err != nil {
+		respCode := http.StatusInternalServerError
+		if errors.Is(err, dataplane.ErrInvalidCommitToken) {
+			respCode = http.StatusBadRequest
+		}
+		msg := fmt.Sprintf("Unable to commit for %s@%s: %s", consumerName, streamName, err.Error())
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+		return
+	}
+
+	h.reply(w, http.StatusOK, APIRestRespCommitBatch{
+		StandardResponse: getStdRESTSuccessMsg(),
+		Committed:        committed,
+	}, restCall, r)
+}
+
+// CommitBatchHandler Wrapper around CommitBatch
+func (h APIRestJetStreamDataplaneHandler) CommitBatchHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.CommitBatch(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// PushSubscribe godoc
+// @Summary Establish a pull subscribe session
+// @Description Establish a JetStream pull subscribe session for a client. This is a long lived
+// server send event stream. The stream will close on client disconnect, server shutdown,
+// server internal error, or on reaching a server session limit, which ends with 503 and
+// "reconnect": true. A standby session of a delivery group waits until the group has no
+// primary session before joining it, and ends with 409 once a primary session connects.
+// With replica affinity, a session is redirected with 307 to the replica assigned the consumer.
+// A session of a consumer pinned to another session is refused with 409, giving the lease.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Param subject_name query string true "JetStream subject to subscribe to"
+// @Param max_msg_inflight query integer false "Max number of inflight messages (DEFAULT: 1)"
+// @Param delivery_group query string false "Needed if consumer uses delivery groups"
+// @Param max_unacked query integer false "Max number of messages sent awaiting ACK (DEFAULT: consumer max inflight)"
+// @Param ordered query boolean false "Only send a message once all earlier messages are ACKed (DEFAULT: false)"
+// @Param ack_deadline query string false "NAK a message not ACKed within this duration, e.g. 30s, so it is redelivered sooner than the consumer AckWait (DEFAULT: none)"
+// @Param warmup_rate query number false "Start delivering at this many messages per second, ramping up until the backlog is drained (DEFAULT: no warm-up)"
+// @Param warmup_doubling query string false "How often the warm-up delivery rate doubles, e.g. 10s (DEFAULT: 10s)"
+// @Param selector query string false "Only deliver messages matching this expression, e.g. headers.type = 'order' AND json.amount > 100. Not supported with delivery_group."
+// @Param metadata query []string false "Annotate messages with these computed fields: attempt, published, time_in_queue, lag, or all" collectionFormat(csv)
+// @Param standby query boolean false "Only join the delivery group while it has no primary session (DEFAULT: false)"
+// @Param pin query boolean false "Pin the consumer to this session with a lease, refusing other sessions (DEFAULT: false)"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 409 {object} APIRestRespConsumerPinned "consumer pinned to another session"
+// @Failure 503 {object} APIRestRespSessionEnd "session limit reached"
+// @Header 200,400,409,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 200 {string} Httpmq-Resume-Token "Resume token of the session, if resumable"
+// @Header 200,307 {string} Httpmq-Replica "Replica assigned the consumer, with replica affinity"
+// @Router /v1/data/stream/{streamName}/consumer/{consumerName} [get]
+func (h APIRestJetStreamDataplaneHandler) PushSubscribe(w http.ResponseWriter, r *http.Request) {
+	h.pushSubscribe(
+		w, r, "GET /v1/data/stream/{streamName}/consumer/{consumerName}", false, false,
+	)
+}
+
+// PushSubscribeHandler Wrapper around PushSubscribe
+func (h APIRestJetStreamDataplaneHandler) PushSubscribeHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.PushSubscribe(w, r)
+	})
+}
+
+// EphemeralPushSubscribe godoc
+// @Summary Establish a push subscribe session with an ephemeral consumer
+// @Description Establish a JetStream push subscribe session for a client, through a consumer
+// which exists only for the duration of the session. The consumer name is given by the
+// Httpmq-Consumer-Name response header, and by each message, for use when ACKing messages.
+// This is a long lived server send event stream. The stream will close on client disconnect,
+// server shutdown, server internal error, or on reaching a server session limit.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param subject_name query string true "JetStream subject to subscribe to"
+// @Param max_msg_inflight query integer false "Max number of inflight messages (DEFAULT: 1)"
+// @Param deliver_new query boolean false "Only deliver messages published after the session starts (DEFAULT: false)"
+// @Param max_unacked query integer false "Max number of messages sent awaiting ACK (DEFAULT: max_msg_inflight)"
+// @Param ordered query boolean false "Only send a message once all earlier messages are ACKed (DEFAULT: false)"
+// @Param ack_deadline query string false "NAK a message not ACKed within this duration, e.g. 30s, so it is redelivered sooner than the consumer AckWait (DEFAULT: none)"
+// @Param warmup_rate query number false "Start delivering at this many messages per second, ramping up until the backlog is drained (DEFAULT: no warm-up)"
+// @Param warmup_doubling query string false "How often the warm-up delivery rate doubles, e.g. 10s (DEFAULT: 10s)"
+// @Param selector query string false "Only deliver messages matching this expression, e.g. headers.type = 'order' AND json.amount > 100. Not supported with delivery_group."
+// @Param metadata query []string false "Annotate messages with these computed fields: attempt, published, time_in_queue, lag, or all" collectionFormat(csv)
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 503 {object} APIRestRespSessionEnd "session limit reached"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 200 {string} Httpmq-Consumer-Name "Name of the ephemeral consumer"
+// @Router /v1/data/stream/{streamName}/consumer [get]
+func (h APIRestJetStreamDataplaneHandler) EphemeralPushSubscribe(
+	w http.ResponseWriter, r *http.Request,
+) {
+	h.pushSubscribe(w, r, "GET /v1/data/stream/{streamName}/consumer", true, false)
+}
+
+// EphemeralPushSubscribeHandler Wrapper around EphemeralPushSubscribe
+func (h APIRestJetStreamDataplaneHandler) EphemeralPushSubscribeHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.EphemeralPushSubscribe(w, r)
+	})
+}
+
+// MultiSourcePushSubscribe godoc
+// @Summary Establish a push subscribe session over several consumers
+// @Description Establish a JetStream push subscribe session for a client, which reads through
+// several durable consumers, and sends their messages over the one stream. Each message gives
+// its source as "<stream>/<consumer>", and is ACKed through its own stream and consumer.
+// This is a long lived server send event stream. The stream will close on client disconnect,
+// server shutdown, server internal error, or on reaching a server session limit.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param source query []string true "Source to read from, as <stream>/<consumer>/<subject>" collectionFormat(multi)
+// @Param max_msg_inflight query integer false "Max number of inflight messages per source (DEFAULT: 1)"
+// @Param max_unacked query integer false "Max number of messages sent awaiting ACK per source (DEFAULT: consumer max inflight)"
+// @Param ordered query boolean false "Only send a message once all earlier messages of its source are ACKed (DEFAULT: false)"
+// @Param ack_deadline query string false "NAK a message not ACKed within this duration, e.g. 30s, so it is redelivered sooner than the consumer AckWait (DEFAULT: none)"
+// @Param warmup_rate query number false "Start delivering at this many messages per second, ramping up until the backlog is drained (DEFAULT: no warm-up)"
+// @Param warmup_doubling query string false "How often the warm-up delivery rate doubles, e.g. 10s (DEFAULT: 10s)"
+// @Param selector query string false "Only deliver messages matching this expression, e.g. headers.type = 'order' AND json.amount > 100. Not supported with delivery_group."
+// @Param metadata query []string false "Annotate messages with these computed fields: attempt, published, time_in_queue, lag, or all" collectionFormat(csv)
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 503 {object} APIRestRespSessionEnd "session limit reached"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/subscribe [get]
+func (h APIRestJetStreamDataplaneHandler) MultiSourcePushSubscribe(
+	w http.ResponseWriter, r *http.Request,
+) {
+	h.pushSubscribe(w, r, "GET /v1/data/subscribe", false, true)
+}
+
+// MultiSourcePushSubscribeHandler Wrapper around MultiSourcePushSubscribe
+func (h APIRestJetStreamDataplaneHandler) MultiSourcePushSubscribeHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.MultiSourcePushSubscribe(w, r)
+	})
+}
+
+// ResumeSubscription godoc
+// @Summary Resume a push subscribe session
+// @Description Resume a push subscribe session through a durable consumer after the client
+// reconnects. The session is identified by a resume token, which is sent with each message and
+// keep-alive of the session, and continues with the same stream, consumer, and parameters.
+// Messages delivered earlier in the session can still be ACKed. With redeliver_inflight, the
+// messages delivered earlier in the session which are still awaiting ACK are sent again at
+// once, instead of after JetStream's ACK wait. If the session is still running on this
+// instance, e.g. over an abandoned connection, that run ends with 409.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param Httpmq-Resume-Token header string true "Resume token of the session"
+// @Param redeliver_inflight query boolean false "Send again the messages still awaiting ACK (DEFAULT: false)"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 403 {object} StandardResponse "error"
+// @Failure 409 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 503 {object} APIRestRespSessionEnd "session limit reached"
+// @Header 200,400,403,409,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 200 {string} Httpmq-Resume-Token "Resume token of the session"
+// @Header 200,307 {string} Httpmq-Replica "Replica assigned the consumer, with replica affinity"
+// @Router /v1/data/resume [get]
+func (h APIRestJetStreamDataplaneHandler) ResumeSubscription(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/data/resume"
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.sessions == nil {
+		msg := "Session resume is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	token := r.Header.Get("Httpmq-Resume-Token")
+	if token == "" {
+		msg := "No resume token provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	session, err := h.sessions.ReadToken(token)
+	if err != nil {
+		msg := "Invalid resume token"
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if h.affinity != nil && h.redirectToConsumerOwner(w, r, session.Stream, session.Consumer) {
+		return
+	}
+	redeliverInflight, ok := h.parseBoolParam(w, r, restCall, "redeliver_inflight", false)
+	if !ok {
+		return
+	}
+
+	h.runPushSubscribe(
+		w,
+		r,
+		restCall,
+		pushSubscribeParam{SubscriptionSession: session, redeliverInflight: redeliverInflight},
+		true,
+	)
+}
+
+// ResumeSubscriptionHandler Wrapper around ResumeSubscription
+func (h APIRestJetStreamDataplaneHandler) ResumeSubscriptionHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.ResumeSubscription(w, r)
+	})
+}
+
+// pushSubscribe helper function to run a push subscribe session. If ephemeral, the session
+// reads through a new ephemeral consumer, instead of the named durable consumer. If
+// multiSource, the session reads through each durable consumer given by the source queries.
+func (h APIRestJetStreamDataplaneHandler) pushSubscribe(
+	w http.ResponseWriter, r *http.Request, restCall string, ephemeral, multiSource bool,
+) {
+	localLogTagsInitial, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	// --------------------------------------------------------------------------
+	// Read operation parameters
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok && !multiSource {
+		msg := "No stream name provided"
+		log.WithFields(localLogTagsInitial).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok && !ephemeral && !multiSource {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTagsInitial).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	// Sessions of a durable consumer are served by the replica holding its dispatcher
+	if h.affinity != nil && !ephemeral && !multiSource &&
+		h.redirectToConsumerOwner(w, r, streamName, consumerName) {
+		return
+	}
+
+	// Read query parameters
+	var subjectName string
+	requestQueries := r.URL.Query()
+	// Read the sources of a multi-source session
+	var sources []dataplane.DispatchSource
+	if multiSource {
+		t, ok := requestQueries["source"]
+		if !ok {
+			h.badQueryParam(w, r, restCall, nil, "No sources provided")
+			return
+		}
+		for _, oneSource := range t {
+			parts := strings.SplitN(oneSource, "/", 3)
+			if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+				h.badQueryParam(
+					w, r, restCall, nil,
+					fmt.Sprintf("Source %s is not <stream>/<consumer>/<subject>", oneSource),
+				)
+				return
+			}
+			if parts[2], ok = h.checkSubject(w, r, restCall, parts[2], true); !ok {
+				return
+			}
+			sources = append(
+				sources, dataplane.DispatchSource{Stream: parts[0], Consumer: parts[1], Subject: parts[2]},
+			)
+		}
+	}
+	// Read the subject
+	if !multiSource {
+		t, ok := requestQueries["subject_name"]
+		if !ok || len(t) != 1 {
+			h.badQueryParam(w, r, restCall, nil, "Missing subscribe subject / Multiple subjects")
+			return
+		}
+		if subjectName, ok = h.checkSubject(w, r, restCall, t[0], true); !ok {
+			return
+		}
+	}
+	// Read the max inflight messages
+	maxInflightMsg, ok := h.parseIntParam(w, r, restCall, "max_msg_inflight", 1, false)
+	if !ok {
+		return
+	}
+	// Read the delivery group
+	var deliveryGroup *string
+	group, given, ok := h.readQueryParam(w, r, restCall, "delivery_group")
+	if !ok {
+		return
+	}
+	if given {
+		deliveryGroup = &group
+	}
+	if ephemeral && deliveryGroup != nil {
+		h.badQueryParam(w, r, restCall, nil, "Ephemeral consumers do not support delivery groups")
+		return
+	}
+	if multiSource && deliveryGroup != nil {
+		h.badQueryParam(w, r, restCall, nil, "Multi-source sessions do not support delivery groups")
+		return
+	}
+	// Read whether to only deliver new messages
+	if _, given := requestQueries["deliver_new"]; given && !ephemeral {
+		h.badQueryParam(
+			w, r, restCall, nil, "deliver_new is only supported with ephemeral consumers",
+		)
+		return
+	}
+	deliverNew, ok := h.parseBoolParam(w, r, restCall, "deliver_new", false)
+	if !ok {
+		return
+	}
+
+	// Read the delivery concurrency
+	var concurrency dataplane.DeliveryConcurrency
+	if concurrency.MaxUnacked, ok = h.parseIntParam(
+		w, r, restCall, "max_unacked", 0, true,
+	); !ok {
+		return
+	}
+	if concurrency.Ordered, ok = h.parseBoolParam(w, r, restCall, "ordered", false); !ok {
+		return
+	}
+	if concurrency.AckDeadline, ok = h.parseDurationParam(
+		w, r, restCall, "ack_deadline", 0, true,
+	); !ok {
+		return
+	}
+	if concurrency.WarmUpRate, ok = h.parseFloatParam(
+		w, r, restCall, "warmup_rate", 0, true,
+	); !ok {
+		return
+	}
+	if concurrency.WarmUpDoubling, ok = h.parseDurationParam(
+		w, r, restCall, "warmup_doubling", 0, true,
+	); !ok {
+		return
+	}
+	// Read the message selector
+	selector, _, ok := h.readQueryParam(w, r, restCall, "selector")
+	if !ok {
+		return
+	}
+	// Read the delivery metadata fields to annotate messages with
+	var metadata dataplane.DeliveryMetadataMask
+	if t, ok := requestQueries["metadata"]; ok {
+		p, err := dataplane.ParseDeliveryMetadataMask(t)
+		if err != nil {
+			h.badQueryParam(w, r, restCall, err, "Unable to parse metadata")
+			return
+		}
+		metadata = p
+	}
+	// Read whether this is a standby session
+	standby, ok := h.parseBoolParam(w, r, restCall, "standby", false)
+	if !ok {
+		return
+	}
+	if standby {
+		var msg string
+		if h.tiers == nil {
+			msg = "Standby sessions are not enabled"
+		} else if deliveryGroup == nil {
+			msg = "Standby sessions need a delivery group"
+		}
+		if msg != "" {
+			h.badQueryParam(w, r, restCall, nil, msg)
+			return
+		}
+	}
+
+	// Read whether to pin the consumer to this session
+	pin, ok := h.parseBoolParam(w, r, restCall, "pin", false)
+	if !ok {
+		return
+	}
+	if pin {
+		var msg string
+		if h.leases == nil {
+			msg = "Consumer pinning is not enabled"
+		} else if ephemeral || multiSource {
+			msg = "Only durable consumer sessions can pin their consumer"
+		} else if deliveryGroup != nil {
+			msg = "Consumers shared by a delivery group can not be pinned"
+		}
+		if msg != "" {
+			h.badQueryParam(w, r, restCall, nil, msg)
+			return
+		}
+	}
+
+	// --------------------------------------------------------------------------
+	// Start operation
+
+	param := pushSubscribeParam{
+		SubscriptionSession: dataplane.SubscriptionSession{
+			Stream:        streamName,
+			Subject:       subjectName,
+			Consumer:      consumerName,
+			DeliveryGroup: deliveryGroup,
+			MaxInflight:   maxInflightMsg,
+			Concurrency:   concurrency,
+			Selector:      selector,
+			Standby:       standby,
+			Metadata:      metadata,
+			Pinned:        pin,
+		},
+		ephemeral:  ephemeral,
+		deliverNew: deliverNew,
+		sources:    sources,
+	}
+	// Sessions through one durable consumer can be resumed
+	if h.sessions != nil && !ephemeral && !multiSource {
+		param.ID = uuid.New().String()
+	}
+	h.runPushSubscribe(w, r, restCall, param, false)
+}
+
+// affinityRedirectedQuery is the query parameter marking a request redirected to the
+// replica assigned its consumer
+const affinityRedirectedQuery = "replica_redirect"
+
+// redirectToConsumerOwner redirect a request to the replica assigned its consumer, unless
+// this is the replica. Returns whether the request was redirected.
+//
+// A request already redirected once is not redirected again, so replicas disagreeing on the
+// set of replicas do not redirect a client in a loop.
+func (h APIRestJetStreamDataplaneHandler) redirectToConsumerOwner(
+	w http.ResponseWriter, r *http.Request, stream, consumer string,
+) bool {
+	owner := h.affinity.Owner(stream, consumer)
+	// Follow the sessions already running, e.g. placed before the set of replicas changed
+	if h.clusterSessions != nil {
+		running := h.clusterSessions.ConsumerReplicas(stream, consumer)
+		if len(running) > 0 {
+			placed := running[0]
+			for _, replica := range running {
+				if replica == owner {
+					placed = owner
+				}
+			}
+			owner = placed
+		}
+	}
+	w.Header().Set("Httpmq-Replica", owner)
+	if owner == h.affinity.Self() {
+		return false
+	}
+	query := r.URL.Query()
+	if query.Get(affinityRedirectedQuery) != "" {
+		localLogTags, _ := common.UpdateLogTags(h.LogTags, r.Context())
+		log.WithFields(localLogTags).Warnf(
+			"Serving consumer %s@%s assigned to %s after a redirect", consumer, stream, owner,
+		)
+		return false
+	}
+	query.Set(affinityRedirectedQuery, "true")
+	location := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	http.Redirect(
+		w, r, strings.TrimRight(owner, "/")+location.RequestURI(), http.StatusTemporaryRedirect,
+	)
+	return true
+}
+
+// pushSubscribeParam parameters of a push subscribe session
+type pushSubscribeParam struct {
+	// SubscriptionSession the session parameters. The session is resumable if ID is set.
+	dataplane.SubscriptionSession
+	ephemeral  bool
+	deliverNew bool
+	// sources the (stream, consumer) pairs of a multi-source session, without dispatchers
+	sources []dataplane.DispatchSource
+	// redeliverInflight whether to send again the messages of a resumed session still
+	// awaiting ACK
+	redeliverInflight bool
+}
+
+// releaseDispatchSources helper function to release the subscriptions of the sources of a
+// multi-source session which failed to start. A source is bound to its consumer once
+// defined, and only releases it once started, and its context ends; cancel must end the
+// context of the source dispatchers.
+func releaseDispatchSources(sources []dataplane.DispatchSource, cancel context.CancelFunc) {
+	cancel()
+	for _, source := range sources {
+		// Sources which already started return an error, and release on their own
+		_ = source.Dispatcher.Start(
+			func(*nats.Msg, context.Context) error { return context.Canceled },
+			func(error) {},
+		)
+	}
+}
+
+// APIRestRespSessionHeartbeat keep-alive sent on an idle resumable subscription session
+type APIRestRespSessionHeartbeat struct {
+	// Heartbeat marks the line as a keep-alive, not a message
+	Heartbeat bool `json:"heartbeat"`
+	// ResumeToken is the token for resuming the session
+	ResumeToken string `json:"resume_token"`
+}
+
+// warmUpReportInterval is how often the progress of a delivery warm-up is sent to the client
+const warmUpReportInterval = time.Second
+
+// dispatcherStopTimeout is how long an ending session waits for its dispatcher to stop
+// reading from JetStream
+const dispatcherStopTimeout = time.Second * 5
+
+// APIRestRespWarmUpProgress progress line sent on a push subscription session while its
+// delivery warms up
+type APIRestRespWarmUpProgress struct {
+	// WarmUp is the progress of the warm-up
+	WarmUp dataplane.WarmUpProgress `json:"warmup"`
+}
+
+// APIRestRespConsumerPinned response refusing a push subscribe session of a consumer pinned
+// to another session
+type APIRestRespConsumerPinned struct {
+	StandardResponse
+	// Lease is the lease of the session the consumer is pinned to
+	Lease dataplane.ConsumerLease `json:"lease"`
+}
+
+// APIRestRespSessionEnd response ending a push subscribe session which reached a session
+// limit. The client should reconnect, or resume the session if resumable.
+type APIRestRespSessionEnd struct {
+	StandardResponse
+	// Reconnect marks the session as ended by the server, with the client to reconnect
+	Reconnect bool `json:"reconnect"`
+	// Reason is the limit which ended the session: max_duration, or idle_timeout
+	Reason string `json:"reason"`
+	// ResumeToken is the token for resuming the session, if resumable
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// pushSession state of a run of a push subscribe session
+type pushSession struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	restCall string
+	param    pushSubscribeParam
+	// resumed whether the run takes over from an earlier run of the session
+	resumed bool
+	// resumable whether the session can be resumed
+	resumable bool
+	sessionID string
+	logTags   log.Fields
+	flusher   http.Flusher
+	transport requestTransport
+	selector  dataplane.MessageSelector
+	// runtimeCtxt ends with the run; cancel ends it early
+	runtimeCtxt context.Context
+	cancel      context.CancelFunc
+	// cleanups release what the run holds once it ends, in reverse order
+	cleanups []func()
+	// dispatcherWG tracks the routines the dispatchers of the run start
+	dispatcherWG    *sync.WaitGroup
+	inflightPersist dataplane.InflightMsgPersistence
+	// superseded ends the run if the session is resumed over another connection
+	superseded  chan struct{}
+	resumeToken string
+	// keepAliveTick is not set if keep-alive is disabled, nor are sessionExpired and
+	// idleCheckTick if their session limit is not set
+	keepAliveTick    <-chan time.Time
+	sessionExpired   <-chan time.Time
+	idleCheckTick    <-chan time.Time
+	primaryConnected <-chan bool
+	leaseLost        <-chan struct{}
+	dispatcher       dataplane.MessageDispatcher
+	// multiDispatcher is the dispatcher of a multi-source session
+	multiDispatcher dataplane.MultiSourceDispatcher
+	// sources are the defined sources of a multi-source session
+	sources       []dataplane.DispatchSource
+	msgBuffer     chan *nats.Msg
+	internalError chan error
+	sessionBuffer dataplane.SessionWriteBuffer
+	started       time.Time
+	event         dataplane.SessionEvent
+	stats         dataplane.SessionStats
+	// complete marks the end of the delivery loop. The final response is only written once
+	// the session buffer has stopped writing to the client.
+	complete   bool
+	finalReply func()
+	// endReason is why the session ended; sessions ending on an error are errored
+	endReason string
+	errored   bool
+	lastWrite time.Time
+	// lastDelivered is when a message was last queued for the client; keep-alives do not count
+	lastDelivered time.Time
+	// paused holds the message waiting for room in the session buffer. No more messages are
+	// read while it waits.
+	paused *nats.Msg
+}
+
+// onEnd register a function releasing what the run holds once it ends
+func (s *pushSession) onEnd(cleanup func()) {
+	s.cleanups = append(s.cleanups, cleanup)
+}
+
+// release release what the run holds, in the reverse order it was taken
+func (s *pushSession) release() {
+	for idx := len(s.cleanups) - 1; idx >= 0; idx-- {
+		s.cleanups[idx]()
+	}
+}
+
+// runPushSubscribe helper function to run a push subscribe session. If resumed, the session
+// takes over from any earlier run of it.
+func (h APIRestJetStreamDataplaneHandler) runPushSubscribe(
+	w http.ResponseWriter,
+	r *http.Request,
+	restCall string,
+	param pushSubscribeParam,
+	resumed bool,
+) {
+	s := &pushSession{
+		w:         w,
+		r:         r,
+		restCall:  restCall,
+		param:     param,
+		resumed:   resumed,
+		resumable: param.ID != "",
+	}
+	defer s.release()
+	if !h.preparePushSession(s) || !h.awaitPrimarySessions(s) || !h.checkConsumerLease(s) ||
+		!h.startPushSessionDispatcher(s) || !h.openPushSession(s) {
+		return
+	}
+	h.deliverPushSession(s)
+	h.drainPushSession(s)
+	h.endPushSession(s)
+}
+
+// replyPushSession helper function to end a push subscribe session with an error response,
+// before any message is sent
+func (h APIRestJetStreamDataplaneHandler) replyPushSession(
+	s *pushSession, err error, respCode int, msg string,
+) {
+	log.WithError(err).WithFields(s.logTags).Errorf(msg)
+	h.reply(s.w, respCode, getStdRESTErrorMsg(respCode, &msg), s.restCall, s.r)
+}
+
+// preparePushSession helper function to validate a push subscribe session, and take what it
+// needs to run. Returns false if the session was refused.
+func (h APIRestJetStreamDataplaneHandler) preparePushSession(s *pushSession) bool {
+	var err error
+	param := s.param
+
+	// Define custom log tags for this instance
+	s.logTags = log.Fields{
+		"module":         "rest",
+		"component":      "jetstream-dataplane",
+		"instance":       "push-subscribe",
+		"stream":         param.Stream,
+		"subject":        param.Subject,
+		"consumer":       param.Consumer,
+		"delivery_group": param.DeliveryGroup,
+	}
+	if len(param.sources) > 0 {
+		sourceTags := make([]string, 0, len(param.sources))
+		for _, source := range param.sources {
+			sourceTags = append(sourceTags, source.Tag())
+		}
+		s.logTags["sources"] = sourceTags
+	}
+	if s.r.Context().Value(common.RequestParam{}) != nil {
+		v, ok := s.r.Context().Value(common.RequestParam{}).(common.RequestParam)
+		if ok {
+			v.UpdateLogTags(s.logTags)
+		}
+	}
+
+	// Compile the selector once for the session
+	if param.Selector != "" {
+		// Messages not selected are ACKed, so they would not reach the rest of the group
+		if param.DeliveryGroup != nil && *param.DeliveryGroup != "" {
+			h.replyPushSession(
+				s, nil, http.StatusBadRequest, "Selectors are not supported with delivery groups",
+			)
+			return false
+		}
+		if s.selector, err = dataplane.CompileMessageSelector(param.Selector); err != nil {
+			h.replyPushSession(s, err, http.StatusBadRequest, err.Error())
+			return false
+		}
+	}
+
+	// Create stream flusher
+	var ok bool
+	if s.flusher, ok = s.w.(http.Flusher); !ok {
+		h.replyPushSession(s, nil, http.StatusInternalServerError, "Streaming not supported")
+		return false
+	}
+
+	if s.transport, err = h.transportFor(s.r); err != nil {
+		h.replyTransportError(s.w, s.r, s.restCall, err)
+		return false
+	}
+	s.onEnd(s.transport.release)
+	if !s.resumed {
+		s.param.Tenant = s.transport.tenant
+	} else if param.Tenant != s.transport.tenant {
+		h.replyPushSession(s, nil, http.StatusForbidden, "Session belongs to another tenant")
+		return false
+	}
+
+	s.runtimeCtxt, s.cancel = context.WithCancel(s.r.Context())
+	s.onEnd(s.cancel)
+	s.inflightPersist = h.inflightPersist
+	s.dispatcherWG = h.wg
+	s.superseded = make(chan struct{})
+	if s.resumable {
+		s.logTags["session"] = param.ID
+		var stopOnce sync.Once
+		stop := func() {
+			stopOnce.Do(func() { close(s.superseded) })
+		}
+		sessionPersist, detach, err := h.sessions.Attach(param.ID, stop, s.r.Context())
+		if err != nil {
+			h.replyPushSession(s, err, http.StatusInternalServerError, "Unable to take over session")
+			return false
+		}
+		s.inflightPersist = sessionPersist
+		// The session only detaches once its subscription has ended, so a later run does not
+		// bind to the consumer while this run is still bound.
+		sessionWG := &sync.WaitGroup{}
+		s.dispatcherWG = sessionWG
+		h.wg.Add(1)
+		s.onEnd(func() {
+			defer h.wg.Done()
+			s.cancel()
+			sessionWG.Wait()
+			detach()
+		})
+		if s.resumeToken, err = h.sessions.IssueToken(s.param.SubscriptionSession); err != nil {
+			h.replyPushSession(
+				s, err, http.StatusInternalServerError, "Unable to issue resume token",
+			)
+			return false
+		}
+	}
+	s.sessionID = param.ID
+	if s.sessionID == "" {
+		s.sessionID = uuid.New().String()
+	}
+
+	if h.keepAlive > 0 {
+		keepAliveTicker := time.NewTicker(h.keepAlive)
+		s.onEnd(keepAliveTicker.Stop)
+		s.keepAliveTick = keepAliveTicker.C
+	}
+	// Sessions end on reaching a session limit, so held connections do not pin the consumer
+	// forever
+	if h.sessionLimits.MaxDuration > 0 {
+		sessionTimer := time.NewTimer(h.sessionLimits.MaxDuration)
+		s.onEnd(func() { sessionTimer.Stop() })
+		s.sessionExpired = sessionTimer.C
+	}
+	if h.sessionLimits.IdleTimeout > 0 {
+		idleCheckTicker := time.NewTicker(h.sessionLimits.IdleTimeout / 4)
+		s.onEnd(idleCheckTicker.Stop)
+		s.idleCheckTick = idleCheckTicker.C
+	}
+	return true
+}
+
+// sessionKeepAlive helper function to define the keep-alive sent on an idle push subscribe
+// session
+func (h APIRestJetStreamDataplaneHandler) sessionKeepAlive(s *pushSession) (string, error) {
+	if !s.resumable {
+		return "", nil
+	}
+	heartbeat := APIRestRespSessionHeartbeat{Heartbeat: true}
+	var err error
+	if heartbeat.ResumeToken, err = h.sessions.IssueToken(s.param.SubscriptionSession); err != nil {
+		return "", err
+	}
+	serialize, err := common.JSON().Marshal(&heartbeat)
+	if err != nil {
+		return "", err
+	}
+	return string(serialize), nil
+}
+
+// replySessionLimit helper function to end a push subscribe session which reached a session
+// limit
+func (h APIRestJetStreamDataplaneHandler) replySessionLimit(s *pushSession, reason string) {
+	msg := fmt.Sprintf("Session limit %s reached, reconnect", reason)
+	resp := APIRestRespSessionEnd{
+		StandardResponse: getStdRESTErrorMsg(http.StatusServiceUnavailable, &msg),
+		Reconnect:        true,
+		Reason:           reason,
+	}
+	if s.resumable {
+		token, err := h.sessions.IssueToken(s.param.SubscriptionSession)
+		if err != nil {
+			log.WithError(err).WithFields(s.logTags).Errorf("Failed to issue resume token")
+		}
+		resp.ResumeToken = token
+	}
+	h.reply(s.w, http.StatusServiceUnavailable, resp, s.restCall, s.r)
+}
+
+// awaitPrimarySessions helper function to coordinate a push subscribe session with the
+// other tiers of its delivery group. The primary sessions of a delivery group announce
+// themselves, so the standby sessions of the group know when to join it; a standby session
+// waits here until the group has no primary session. Returns false if the session ended
+// while waiting.
+func (h APIRestJetStreamDataplaneHandler) awaitPrimarySessions(s *pushSession) bool {
+	param := s.param
+	if h.tiers == nil || param.DeliveryGroup == nil {
+		return true
+	}
+	var err error
+	if param.Standby {
+		s.logTags["tier"] = "standby"
+		s.primaryConnected, err = h.tiers.WatchPrimaries(
+			param.Stream, param.Consumer, *param.DeliveryGroup, s.dispatcherWG, s.runtimeCtxt,
+		)
+	} else {
+		err = h.tiers.AnnouncePrimary(
+			param.Stream, param.Consumer, *param.DeliveryGroup, s.dispatcherWG, s.runtimeCtxt,
+		)
+	}
+	if err != nil {
+		h.replyPushSession(
+			s, err, http.StatusInternalServerError, "Unable to coordinate with delivery group",
+		)
+		return false
+	}
+	if !param.Standby || s.primaryConnected == nil {
+		return true
+	}
+
+	// Hold the connection open while a primary session is connected
+	if s.resumable {
+		s.w.Header().Set("Httpmq-Resume-Token", s.resumeToken)
+	}
+	s.w.WriteHeader(http.StatusOK)
+	s.flusher.Flush()
+	log.WithFields(s.logTags).Info("Standby PUSH subscription waiting for primary sessions to end")
+	for waiting := true; waiting; {
+		select {
+		case connected := <-s.primaryConnected:
+			waiting = connected
+		case <-s.keepAliveTick:
+			keepAlive, err := h.sessionKeepAlive(s)
+			if err != nil {
+				log.WithError(err).WithFields(s.logTags).Errorf("Failed to define keep-alive")
+				break
+			}
+			if _, err := fmt.Fprintf(s.w, "%s\n", keepAlive); err != nil {
+				log.WithError(err).WithFields(s.logTags).Errorf("Failed to transmit keep-alive")
+				return false
+			}
+			s.flusher.Flush()
+		case <-h.baseContext.Done():
+			msg := "Server stopping"
+			h.reply(
+				s.w, http.StatusInternalServerError, getStdRESTErrorMsg(
+					http.StatusInternalServerError, &msg,
+				), s.restCall, s.r,
+			)
+			return false
+		case <-s.r.Context().Done():
+			h.reply(s.w, http.StatusOK, getStdRESTSuccessMsg(), s.restCall, s.r)
+			return false
+		case <-s.superseded:
+			msg := "Session resumed over another connection"
+			h.reply(
+				s.w, http.StatusConflict, getStdRESTErrorMsg(http.StatusConflict, &msg), s.restCall, s.r,
+			)
+			return false
+		case <-s.sessionExpired:
+			log.WithFields(s.logTags).Info("Terminating standby PUSH subscription on max duration")
+			h.replySessionLimit(s, "max_duration")
+			return false
+		}
+	}
+	log.WithFields(s.logTags).Info("Standby PUSH subscription joining delivery group")
+	return true
+}
+
+// checkConsumerLease helper function to refuse a push subscribe session of a consumer
+// pinned to another session, and to pin the consumer to the session if asked. Returns false
+// if the session was refused.
+func (h APIRestJetStreamDataplaneHandler) checkConsumerLease(s *pushSession) bool {
+	param := s.param
+	if h.leases == nil || param.ephemeral {
+		return true
+	}
+	var err error
+	if param.Pinned {
+		principal, _ := GetRequestPrincipal(s.r.Context())
+		s.leaseLost, err = h.leases.Acquire(dataplane.ConsumerLease{
+			Stream:     param.Stream,
+			Consumer:   param.Consumer,
+			Holder:     s.sessionID,
+			Principal:  principal,
+			ClientAddr: s.r.RemoteAddr,
+		}, s.dispatcherWG, s.runtimeCtxt)
+	} else if len(param.sources) > 0 {
+		for _, source := range param.sources {
+			if err = h.leases.Check(source.Stream, source.Consumer, s.sessionID); err != nil {
+				break
+			}
+		}
+	} else {
+		err = h.leases.Check(param.Stream, param.Consumer, s.sessionID)
+	}
+	if err == nil {
+		return true
+	}
+	var held *dataplane.LeaseHeldError
+	if errors.As(err, &held) {
+		msg := fmt.Sprintf("Consumer pinned to session %s", held.Lease.Holder)
+		log.WithFields(s.logTags).Errorf(msg)
+		h.reply(s.w, http.StatusConflict, APIRestRespConsumerPinned{
+			StandardResponse: getStdRESTErrorMsg(http.StatusConflict, &msg),
+			Lease:            held.Lease,
+		}, s.restCall, s.r)
+		return false
+	}
+	h.replyPushSession(s, err, http.StatusInternalServerError, "Unable to check consumer lease")
+	return false
+}
+
+// startPushSessionDispatcher helper function to define the dispatcher of a push subscribe
+// session, and begin reading from JetStream. Returns false if the session failed to start.
+func (h APIRestJetStreamDataplaneHandler) startPushSessionDispatcher(s *pushSession) bool {
+	var err error
+	param := s.param
+	concurrency := param.Concurrency
+	concurrency.MaxTrackingPanics = h.sessionLimits.MaxTrackingPanics
+	// Only sessions which drain their messages when ending need to track them without a limit
+	concurrency.Drainable = h.sessionLimits.AckDrainTimeout > 0 && !param.ephemeral
+	if len(param.sources) > 0 {
+		for _, source := range param.sources {
+			if source.Dispatcher, err = dataplane.GetPushMessageDispatcher(
+				s.transport.client,
+				source.Stream,
+				source.Subject,
+				source.Consumer,
+				nil,
+				param.MaxInflight,
+				concurrency,
+				dataplane.PushDispatcherOptions{
+					ExternalACKPrefix: h.externalACKPrefix,
+					Persistence:       s.inflightPersist,
+					Redactor:          h.redactor,
+					Selector:          s.selector,
+					FilterRegistry:    h.filters,
+					Latency:           h.latency,
+				},
+				s.dispatcherWG,
+				s.runtimeCtxt,
+			); err != nil {
+				err = fmt.Errorf("source %s: %w", source.Tag(), err)
+				break
+			}
+			s.sources = append(s.sources, source)
+		}
+		if err == nil {
+			s.multiDispatcher, err = dataplane.GetMultiSourceDispatcher(s.sources)
+		}
+		if err != nil {
+			releaseDispatchSources(s.sources, s.cancel)
+		} else {
+			s.dispatcher = s.multiDispatcher
+		}
+	} else if param.ephemeral {
+		s.dispatcher, err = dataplane.GetEphemeralPushMessageDispatcher(
+			s.transport.client,
+			param.Stream,
+			param.Subject,
+			param.deliverNew,
+			param.MaxInflight,
+			concurrency,
+			dataplane.PushDispatcherOptions{
+				ExternalACKPrefix: h.externalACKPrefix,
+				Redactor:          h.redactor,
+				Selector:          s.selector,
+			},
+			s.dispatcherWG,
+			s.runtimeCtxt,
+		)
+	} else {
+		// Balance delivery with the other sessions of the delivery group
+		var groupMember dataplane.GroupMember
+		if h.fairness != nil && param.DeliveryGroup != nil {
+			groupMember = h.fairness.Join(param.Stream, param.Consumer, *param.DeliveryGroup)
+			s.onEnd(groupMember.Leave)
+		}
+		s.dispatcher, err = dataplane.GetPushMessageDispatcher(
+			s.transport.client,
+			param.Stream,
+			param.Subject,
+			param.Consumer,
+			param.DeliveryGroup,
+			param.MaxInflight,
+			concurrency,
+			dataplane.PushDispatcherOptions{
+				ExternalACKPrefix: h.externalACKPrefix,
+				Persistence:       s.inflightPersist,
+				Redactor:          h.redactor,
+				Selector:          s.selector,
+				FilterRegistry:    h.filters,
+				Latency:           h.latency,
+				Fairness:          groupMember,
+			},
+			s.dispatcherWG,
+			s.runtimeCtxt,
+		)
+	}
+	if err != nil && s.resumed && strings.Contains(err.Error(), "already bound") {
+		h.replyPushSession(s, err, http.StatusConflict, "Session still active on another instance")
+		return false
+	} else if err != nil {
+		h.replyPushSession(s, err, http.StatusInternalServerError, "Unable to define dispatcher")
+		return false
+	}
+
+	// Handle error which occur when interacting with JetStream
+	bufferSize := param.MaxInflight * 2
+	if len(param.sources) > 0 {
+		bufferSize *= len(param.sources)
+	}
+	s.internalError = make(chan error, bufferSize)
+	errorHandler := func(err error) {
+		s.internalError <- err
+	}
+
+	// Handle messages read from JetStream
+	s.msgBuffer = make(chan *nats.Msg, bufferSize)
+	msgHandler := func(msg *nats.Msg, ctxt context.Context) error {
+		select {
+		case s.msgBuffer <- msg:
+			return nil
+		case <-ctxt.Done():
+			return ctxt.Err()
+		case <-s.runtimeCtxt.Done():
+			return s.runtimeCtxt.Err()
+		}
+	}
+
+	if param.ephemeral {
+		s.logTags["consumer"] = s.dispatcher.Consumer()
+		s.w.Header().Set("Httpmq-Consumer-Name", s.dispatcher.Consumer())
+	}
+	if s.resumable {
+		s.w.Header().Set("Httpmq-Resume-Token", s.resumeToken)
+	}
+
+	// Begin reading from JetStream
+	if err := s.dispatcher.Start(msgHandler, errorHandler); err != nil {
+		releaseDispatchSources(s.sources, s.cancel)
+		h.replyPushSession(s, err, http.StatusInternalServerError, "Unable to start dispatcher")
+		return false
+	}
+	s.onEnd(h.dispatchers.Register(s.sessionID, s.dispatcher))
+	return true
+}
+
+// openPushSession helper function to open a push subscribe session whose dispatcher has
+// started, and announce it. Returns false if the session failed to open.
+func (h APIRestJetStreamDataplaneHandler) openPushSession(s *pushSession) bool {
+	var err error
+	param := s.param
+
+	// Send again what earlier runs of the session delivered, but the client never ACKed
+	if s.resumed && param.redeliverInflight {
+		pending := h.sessions.InflightMessages(param.ID)
+		if len(pending) > 0 {
+			log.WithFields(s.logTags).Infof("Redelivering %d inflight messages", len(pending))
+			if err := s.dispatcher.Redeliver(pending); err != nil {
+				h.replyPushSession(
+					s, err, http.StatusInternalServerError, "Unable to redeliver inflight messages",
+				)
+				return false
+			}
+		}
+	}
+
+	s.started = time.Now()
+
+	// Share the running session with the other replicas
+	if h.clusterSessions != nil {
+		active := []dataplane.ActiveSession{{
+			Stream: param.Stream, Consumer: s.dispatcher.Consumer(), Subject: param.Subject,
+		}}
+		if len(param.sources) > 0 {
+			active = active[:0]
+			for _, source := range param.sources {
+				active = append(active, dataplane.ActiveSession{
+					Stream: source.Stream, Consumer: source.Consumer, Subject: source.Subject,
+				})
+			}
+		}
+		for idx, session := range active {
+			session.ID = s.sessionID
+			if len(active) > 1 {
+				session.ID = fmt.Sprintf("%s-%d", s.sessionID, idx)
+			}
+			session.DeliveryGroup = param.DeliveryGroup
+			session.Started = s.started
+			s.onEnd(h.clusterSessions.Register(session))
+		}
+	}
+
+	// Messages are sent to the client through a bounded buffer, so a client which stops
+	// reading does not block the session
+	if s.sessionBuffer, err = dataplane.GetSessionWriteBuffer(
+		s.w, s.flusher.Flush, h.writeBuffer.MaxBytes,
+	); err != nil {
+		h.replyPushSession(
+			s, err, http.StatusInternalServerError, "Unable to define session write buffer",
+		)
+		return false
+	}
+
+	// Tell external systems who is consuming what
+	s.event = dataplane.SessionEvent{
+		SessionID:     s.sessionID,
+		Stream:        param.Stream,
+		Consumer:      s.dispatcher.Consumer(),
+		Subject:       param.Subject,
+		DeliveryGroup: param.DeliveryGroup,
+		ClientAddr:    s.r.RemoteAddr,
+		Started:       s.started,
+	}
+	for _, source := range param.sources {
+		s.event.Sources = append(s.event.Sources, source.Tag())
+	}
+	s.event.Principal, _ = GetRequestPrincipal(s.r.Context())
+	if h.sessionEvents != nil {
+		started := s.event
+		started.Type = dataplane.SessionStarted
+		h.sessionEvents.Notify(started)
+	}
+	return true
+}
+
+// failPushSession helper function to end the delivery of a push subscribe session on an
+// error
+func (h APIRestJetStreamDataplaneHandler) failPushSession(s *pushSession, err error, msg string) {
+	s.cancel()
+	s.complete = true
+	s.endReason = msg
+	s.errored = true
+	log.WithError(err).WithFields(s.logTags).Errorf(msg)
+	s.finalReply = func() {
+		h.reply(
+			s.w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), s.restCall, s.r,
+		)
+	}
+}
+
+// endPushSessionWith helper function to end the delivery of a push subscribe session
+// without fault, with the final response sent by finalReply
+func (h APIRestJetStreamDataplaneHandler) endPushSessionWith(
+	s *pushSession, reason, logMsg string, finalReply func(),
+) {
+	s.complete = true
+	log.WithFields(s.logTags).Info(logMsg)
+	s.endReason = reason
+	s.finalReply = finalReply
+}
+
+// deliverSessionMsg helper function to queue a message for the client of a push subscribe
+// session
+func (h APIRestJetStreamDataplaneHandler) deliverSessionMsg(s *pushSession, msg *nats.Msg) {
+	var err error
+	fields := dataplane.DeliveryFields{Metadata: s.param.Metadata}
+	if s.resumable {
+		if fields.ResumeToken, err = h.sessions.IssueToken(s.param.SubscriptionSession); err != nil {
+			h.failPushSession(s, err, "Failed to issue resume token")
+			return
+		}
+	}
+	msgSubject := s.param.Subject
+	if s.multiDispatcher != nil {
+		source, err := s.multiDispatcher.Source(msg)
+		if err != nil {
+			h.failPushSession(s, err, "Failed to find message source")
+			return
+		}
+		msgSubject = source.Subject
+		fields.Source = source.Tag()
+	}
+	// Frame in the transmission format, and queue for sending. The buffer flushes once no
+	// more messages are queued. With HTTP/2, this packs a burst of messages into fewer
+	// DATA frames.
+	written, err := dataplane.WriteJSMessageDeliver(s.sessionBuffer, msgSubject, msg, fields)
+	if errors.Is(err, dataplane.ErrWriteBufferFull) {
+		if h.writeBuffer.Metrics != nil {
+			h.writeBuffer.Metrics.RecordOverflow(string(h.writeBuffer.Policy))
+		}
+		switch h.writeBuffer.Policy {
+		case dataplane.SlowClientPause:
+			s.paused = msg
+		case dataplane.SlowClientDropNAK:
+			h.recordDeliverySLO(msg, false)
+			h.traceDelivery(msg, dataplane.TraceDropped)
+			s.stats.Dropped++
+			log.WithFields(s.logTags).Warnf("Client not reading, dropping %s", msg.Subject)
+			if err := msg.Nak(); err != nil {
+				log.WithError(err).WithFields(s.logTags).Errorf("Failed to NAK dropped message")
+			}
+		default:
+			h.recordDeliverySLO(msg, false)
+			h.traceDelivery(msg, dataplane.TraceFailed)
+			h.failPushSession(s, err, "Client not reading, ending session")
+		}
+		return
+	} else if err != nil {
+		h.recordDeliverySLO(msg, false)
+		h.traceDelivery(msg, dataplane.TraceFailed)
+		h.failPushSession(s, err, "Failed to transmit message")
+		return
+	}
+	h.recordDeliverySLO(msg, true)
+	h.traceDelivery(msg, dataplane.TraceDelivered)
+	s.stats.Delivered++
+	s.stats.DeliveredBytes += uint64(written)
+	s.lastWrite = time.Now()
+	s.lastDelivered = s.lastWrite
+	log.WithFields(s.logTags).Debugf("Queued %dB", written)
+}
+
+// deliverPushSession helper function to send messages to the client of a push subscribe
+// session, until the session ends
+func (h APIRestJetStreamDataplaneHandler) deliverPushSession(s *pushSession) {
+	// Report the progress of the delivery warm-up until the backlog is drained
+	var warmUpTick <-chan time.Time
+	var lastWarmUp dataplane.WarmUpProgress
+	if _, ok := s.dispatcher.WarmUp(); ok {
+		warmUpTicker := time.NewTicker(warmUpReportInterval)
+		defer warmUpTicker.Stop()
+		warmUpTick = warmUpTicker.C
+	}
+
+	conflictReply := func(msg string) func() {
+		return func() {
+			h.reply(
+				s.w, http.StatusConflict, getStdRESTErrorMsg(http.StatusConflict, &msg), s.restCall, s.r,
+			)
+		}
+	}
+	s.lastWrite = time.Now()
+	s.lastDelivered = s.lastWrite
+	for !s.complete {
+		msgInput := s.msgBuffer
+		var drained <-chan struct{}
+		if s.paused != nil {
+			msgInput = nil
+			drained = s.sessionBuffer.Drained()
+		}
+		select {
+		case <-s.keepAliveTick:
+			// A session with messages still queued is not idle
+			if time.Since(s.lastWrite) < h.keepAlive || s.sessionBuffer.Stats().Buffered > 0 {
+				break
+			}
+			keepAlive, err := h.sessionKeepAlive(s)
+			if err != nil {
+				h.failPushSession(s, err, "Failed to define keep-alive")
+				break
+			}
+			if _, err := fmt.Fprintf(s.sessionBuffer, "%s\n", keepAlive); err != nil {
+				h.failPushSession(s, err, "Failed to transmit keep-alive")
+				break
+			}
+			s.lastWrite = time.Now()
+		case <-warmUpTick:
+			progress, _ := s.dispatcher.WarmUp()
+			// Only report progress once there is some
+			if progress.Delivered == lastWarmUp.Delivered && progress.Active {
+				break
+			}
+			lastWarmUp = progress
+			serialize, err := common.JSON().Marshal(&APIRestRespWarmUpProgress{WarmUp: progress})
+			if err != nil {
+				h.failPushSession(s, err, "Failed to define warm-up progress")
+				break
+			}
+			if _, err := fmt.Fprintf(s.sessionBuffer, "%s\n", serialize); err != nil {
+				h.failPushSession(s, err, "Failed to transmit warm-up progress")
+				break
+			}
+			s.lastWrite = time.Now()
+			if !progress.Active {
+				warmUpTick = nil
+			}
+		case <-h.baseContext.Done():
+			// Server stopping
+			h.endPushSessionWith(
+				s, "server_stop", "Terminating PUSH subscription on server stop", func() {
+					msg := "Server stopping"
+					h.reply(
+						s.w, http.StatusInternalServerError, getStdRESTErrorMsg(
+							http.StatusInternalServerError, &msg,
+						), s.restCall, s.r,
+					)
+				},
+			)
+		case <-s.r.Context().Done():
+			// Request closed
+			h.endPushSessionWith(
+				s, "client_disconnect", "Terminating PUSH subscription on request end", func() {
+					h.reply(s.w, http.StatusOK, getStdRESTSuccessMsg(), s.restCall, s.r)
+				},
+			)
+		case connected := <-s.primaryConnected:
+			// A standby session gives way once a primary session connects
+			if connected {
+				h.endPushSessionWith(
+					s,
+					"primary_connected",
+					"Terminating standby PUSH subscription on primary connect",
+					conflictReply("Primary session connected"),
+				)
+			}
+		case <-s.sessionExpired:
+			h.endPushSessionWith(
+				s, "max_duration", "Terminating PUSH subscription on max duration", func() {
+					h.replySessionLimit(s, "max_duration")
+				},
+			)
+		case <-s.idleCheckTick:
+			// A session with messages still queued is not idle
+			if time.Since(s.lastDelivered) < h.sessionLimits.IdleTimeout ||
+				s.sessionBuffer.Stats().Buffered > 0 {
+				break
+			}
+			h.endPushSessionWith(s, "idle_timeout", "Terminating idle PUSH subscription", func() {
+				h.replySessionLimit(s, "idle_timeout")
+			})
+		case <-s.superseded:
+			// Session resumed over another connection
+			h.endPushSessionWith(
+				s,
+				"session_resumed",
+				"Terminating PUSH subscription on session resume",
+				conflictReply("Session resumed over another connection"),
+			)
+		case <-s.leaseLost:
+			// Lease broken by an admin, or taken over by another session
+			h.endPushSessionWith(
+				s,
+				"lease_broken",
+				"Terminating PUSH subscription on consumer lease loss",
+				conflictReply("Consumer lease broken"),
+			)
+		case err, ok := <-s.internalError:
+			// Internal system error
+			if ok {
+				h.failPushSession(s, err, "Error occurred interacting with JetStream")
+			} else {
+				err := fmt.Errorf("jetstream interaction internal error channel read fail")
+				h.failPushSession(s, err, "Internal error channel read fail")
+			}
+		case <-s.sessionBuffer.Done():
+			h.failPushSession(s, s.sessionBuffer.Err(), "Failed to transmit message")
+		case <-drained:
+			// Retry the paused message now the buffer has room
+			msg := s.paused
+			s.paused = nil
+			h.deliverSessionMsg(s, msg)
+		case msg, ok := <-msgInput:
+			// Send out a new message
+			if ok && msg != nil {
+				h.deliverSessionMsg(s, msg)
+			} else {
+				err := fmt.Errorf("jetstream message channel read fail")
+				h.failPushSession(s, err, "Message channel read fail")
+			}
+		}
+	}
+}
+
+// drainPushSession helper function to let the client of a push subscribe session ending
+// without fault ACK what it was sent. Ephemeral consumers are deleted once the session stops
+// reading, so their messages can not be ACKed.
+func (h APIRestJetStreamDataplaneHandler) drainPushSession(s *pushSession) {
+	switch s.endReason {
+	case "server_stop", "max_duration", "idle_timeout", "primary_connected":
+	default:
+		return
+	}
+	if h.sessionLimits.AckDrainTimeout <= 0 || s.param.ephemeral {
+		return
+	}
+	drainCtxt, drainCancel := context.WithTimeout(s.r.Context(), h.sessionLimits.AckDrainTimeout)
+	defer drainCancel()
+	drainResult := make(chan error, 1)
+	go func() {
+		drainResult <- s.dispatcher.Drain(drainCtxt)
+	}()
+	// Messages already read still go out, so the client can ACK them
+	for draining := true; draining; {
+		select {
+		case err := <-drainResult:
+			if err != nil {
+				log.WithError(err).WithFields(s.logTags).Warn("Ending session with messages awaiting ACK")
+			}
+			draining = false
+		case msg := <-s.msgBuffer:
+			if s.paused == nil && s.sessionBuffer.Err() == nil {
+				h.deliverSessionMsg(s, msg)
+				break
+			}
+			// The client can no longer be sent the message, so give it back
+			if err := s.dispatcher.Nak(msg); err != nil {
+				log.WithError(err).WithFields(s.logTags).Errorf("Failed to NAK undelivered message")
+			}
+		}
+	}
+}
+
+// endPushSession helper function to stop the dispatcher of a push subscribe session, and
+// write the final response once the client is no longer sent messages
+func (h APIRestJetStreamDataplaneHandler) endPushSession(s *pushSession) {
+	stopCtxt, stopCancel := context.WithTimeout(context.Background(), dispatcherStopTimeout)
+	if err := s.dispatcher.Stop(stopCtxt); err != nil {
+		log.WithError(err).WithFields(s.logTags).Error("Failed to stop dispatcher")
+	}
+	stopCancel()
+	s.cancel()
+
+	// Stop sending to the client before writing the final response
+	stopped := s.sessionBuffer.Close(h.writeBuffer.DrainTimeout)
+	if h.writeBuffer.Metrics != nil {
+		h.writeBuffer.Metrics.ObserveHighWater(s.sessionBuffer.Stats().HighWater)
+	}
+	if h.sessionEvents != nil {
+		ended := s.event
+		ended.Type = dataplane.SessionEnded
+		if s.errored {
+			ended.Type = dataplane.SessionErrored
+		}
+		ended.Reason = s.endReason
+		s.stats.Duration = time.Since(s.started)
+		ended.Stats = &s.stats
+		h.sessionEvents.Notify(ended)
+	}
+	if !stopped {
+		// The client is not reading. Aborting the handler resets the stream, which also ends
+		// the write blocked on the client.
+		log.WithFields(s.logTags).Warn("Dropping connection of client not reading")
+		panic(http.ErrAbortHandler)
+	}
+	if s.sessionBuffer.Err() == nil && s.finalReply != nil {
+		s.finalReply()
+	}
+	// On final flush
+	s.flusher.Flush()
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespTailSummary response concluding a stream tail session
+type APIRestRespTailSummary struct {
+	StandardResponse
+	// Delivered is the number of messages sent
+	Delivered uint64 `json:"delivered"`
+	// Dropped is the number of messages not sent, due to the rate limit
+	Dropped uint64 `json:"dropped"`
+}
+
+// TailStream godoc
+// @Summary Tail a stream
+// @Description Stream the messages published to a stream from now on, in a human readable form,
+// for live debugging. Messages are sent as indented JSON objects, and need not be ACKed. The
+// session is rate limited, and ends after a max duration with a summary of the session, sent
+// as the last line of the stream. An error after the session started is sent in its place.
+// Depending on the payload access policy, a principal may only see the metadata of messages.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param subject_name query string false "Only tail messages of this subject / subject filter"
+// @Param duration query string false "How long to tail for, e.g. 30s (DEFAULT and max: server setting)"
+// @Success 200 {object} APIRestRespTailSummary "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/stream/{streamName}/tail [get]
+func (h APIRestJetStreamDataplaneHandler) TailStream(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/data/stream/{streamName}/tail"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	h.tailStream(w, r, restCall, localLogTags, streamName, false)
+}
+
+// TailStreamHandler Wrapper around TailStream
+func (h APIRestJetStreamDataplaneHandler) TailStreamHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.TailStream(w, r)
+	})
+}
+
+// tailStream helper function to run a tail session of a stream. A public session reads the
+// stream with the server's own NATS client, as it has no principal.
+func (h APIRestJetStreamDataplaneHandler) tailStream(
+	w http.ResponseWriter,
+	r *http.Request,
+	restCall string,
+	localLogTags log.Fields,
+	streamName string,
+	public bool,
+) {
+	subjectName := r.URL.Query().Get("subject_name")
+	if subjectName != "" {
+		var ok bool
+		if subjectName, ok = h.checkSubject(w, r, restCall, subjectName, true); !ok {
+			return
+		}
+	}
+	duration := h.tail.MaxDuration
+	if t := r.URL.Query().Get("duration"); t != "" {
+		p, err := time.ParseDuration(t)
+		if err != nil || p <= 0 {
+			msg := "Unable to parse duration"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(
+				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+			)
+			return
+		}
+		if p < duration {
+			duration = p
+		}
+	}
+
+	writeFlusher, ok := w.(http.Flusher)
+	if !ok {
+		msg := "Streaming not supported"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	transport := requestTransport{client: h.natsClient, release: func() {}}
+	if !public {
+		var err error
+		if transport, err = h.transportFor(r); err != nil {
+			h.replyTransportError(w, r, restCall, err)
+			return
+		}
+	}
+	defer transport.release()
+
+	tailer, err := dataplane.GetJetStreamTailer(transport.client, streamName, subjectName)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to tail stream %s", streamName)
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	defer func() {
+		_ = tailer.Close()
+	}()
+
+	// Principals limited to metadata see no message body
+	metadataOnly := false
+	if h.tail.PayloadAccess != nil {
+		principal, _ := GetRequestPrincipal(r.Context())
+		metadataOnly =
+			h.tail.PayloadAccess.Access(principal, streamName) == dataplane.PayloadAccessMetadata
+	}
+
+	// The session ends after the duration, on request end, or on server stop
+	tailCtxt, cancel := context.WithTimeout(r.Context(), duration)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.baseContext.Done():
+			cancel()
+		case <-tailCtxt.Done():
+		}
+	}()
+
+	var minInterval time.Duration
+	if h.tail.MaxRate > 0 {
+		minInterval = time.Duration(float64(time.Second) / h.tail.MaxRate)
+	}
+	// Send the response headers now, so the client knows the session started
+	writeFlusher.Flush()
+	summary := APIRestRespTailSummary{StandardResponse: getStdRESTSuccessMsg()}
+	var lastSent time.Time
+	for {
+		msg, err := tailer.NextMsg(tailCtxt)
+		if err != nil {
+			if tailCtxt.Err() != nil {
+				break
+			}
+			msg := "Error occurred reading from JetStream"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.writeStreamRecord(
+				w, writeFlusher, getStdRESTErrorMsg(http.StatusInternalServerError, &msg), localLogTags,
+			)
+			return
+		}
+		if minInterval > 0 && time.Since(lastSent) < minInterval {
+			summary.Dropped++
+			continue
+		}
+		// A tail session is not a durable consumer, so it is never exempt from redaction
+		if h.redactor != nil {
+			if msg, err = h.redactor.Redact(streamName, "", msg); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to redact message")
+				continue
+			}
+		}
+		converted, err := dataplane.ConvertTailMessage(msg)
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Failed to convert message")
+			continue
+		}
+		if metadataOnly {
+			converted.WithholdPayload()
+		}
+		serialize, err := common.JSON().MarshalIndent(&converted, "", "  ")
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Failed to serialize message")
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", serialize); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Failed to transmit message")
+			return
+		}
+		writeFlusher.Flush()
+		lastSent = time.Now()
+		summary.Delivered++
+	}
+	log.WithFields(localLogTags).Infof(
+		"Ending tail of stream %s: %d delivered, %d dropped",
+		streamName, summary.Delivered, summary.Dropped,
+	)
+	h.writeStreamRecord(w, writeFlusher, summary, localLogTags)
+}
+
+// writeStreamRecord helper function to write a record on a stream whose response headers
+// were already sent, as a line of its own
+func (h APIRestJetStreamDataplaneHandler) writeStreamRecord(
+	w http.ResponseWriter, writeFlusher http.Flusher, record interface{}, localLogTags log.Fields,
+) {
+	serialize, err := common.JSON().Marshal(record)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to serialize stream record")
+		return
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", serialize); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to transmit stream record")
+		return
+	}
+	writeFlusher.Flush()
+}
+
+// PublicSubscribe godoc
+// @Summary Subscribe to a public stream
+// @Description Anonymously stream the messages published to a public stream from now on,
+// @Description for public event feeds such as status pages. No credentials are needed, and
+// @Description messages need not be ACKed. The session is the same as a stream tail session,
+// @Description and the number of connections to a stream from one client address is capped.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param subject_name query string false "Only receive messages of this subject / subject filter"
+// @Param duration query string false "How long to subscribe for, e.g. 30s (DEFAULT and max: server setting)"
+// @Success 200 {object} APIRestRespTailSummary "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 429 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,429,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/public/stream/{streamName} [get]
+func (h APIRestJetStreamDataplaneHandler) PublicSubscribe(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/public/stream/{streamName}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.tail.PublicStreams == nil {
+		msg := "Public streams not enabled"
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	clientAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientAddr = r.RemoteAddr
+	}
+	release, err := h.tail.PublicStreams.Admit(streamName, clientAddr)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch err {
+		case dataplane.ErrNotPublicStream:
+			code = http.StatusNotFound
+		case dataplane.ErrPublicConnectionLimit:
+			code = http.StatusTooManyRequests
+		}
+		msg := fmt.Sprintf("Unable to subscribe to stream %s: %s", streamName, err)
+		log.WithFields(localLogTags).Warn(msg)
+		h.reply(w, code, getStdRESTErrorMsg(code, &msg), restCall, r)
+		return
+	}
+	defer release()
+
+	h.tailStream(w, r, restCall, localLogTags, streamName, true)
+}
+
+// PublicSubscribeHandler Wrapper around PublicSubscribe
+func (h APIRestJetStreamDataplaneHandler) PublicSubscribeHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.PublicSubscribe(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// readExportRange helper function to read the range of an export from the request query
+func readExportRange(r *http.Request) (dataplane.ExportRange, error) {
+	var exportRange dataplane.ExportRange
+	query := r.URL.Query()
+	for param, target := range map[string]*uint64{
+		"start_seq": &exportRange.StartSequence, "end_seq": &exportRange.EndSequence,
+	} {
+		if t := query.Get(param); t != "" {
+			p, err := strconv.ParseUint(t, 10, 64)
+			if err != nil {
+				return exportRange, fmt.Errorf("Unable to parse %s", param)
+			}
+			*target = p
+		}
+	}
+	for param, target := range map[string]*time.Time{
+		"start_time": &exportRange.StartTime, "end_time": &exportRange.EndTime,
+	} {
+		if t := query.Get(param); t != "" {
+			p, err := time.Parse(time.RFC3339, t)
+			if err != nil {
+				return exportRange, fmt.Errorf("Unable to parse %s", param)
+			}
+			*target = p
+		}
+	}
+	return exportRange, exportRange.Validate()
+}
+
+// ExportStream godoc
+// @Summary Export a range of a stream
+// @Description Stream out a sequence or time range of the messages of a stream as NDJSON, one
+// @Description JSON object per message with its metadata and Base64 encoded body, for
+// @Description analytics backfills. Messages need not be ACKed. The export is rate limited,
+// @Description and ends with the range, or after a max duration. The Httpmq-Export-Count
+// @Description and Httpmq-Export-Complete trailers report the outcome. Depending on the
+// @Description payload access policy, a principal may only see the metadata of messages.
+// @Description With format=envelope, each message is a dataplane.MsgEnvelope instead. With
+// @Description format=parquet, the export is a Parquet file with one row per message.
+// @tags Dataplane,get,subscribe
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param format query string false "Export format: ndjson, envelope, parquet (DEFAULT: ndjson)"
+// @Param subject_name query string false "Only export messages of this subject / subject filter"
+// @Param start_seq query integer false "Sequence number of the first message"
+// @Param start_time query string false "Earliest store time of the first message, in RFC3339"
+// @Param end_seq query integer false "Sequence number of the last message (DEFAULT: last message when the export started)"
+// @Param end_time query string false "Latest store time of the last message, in RFC3339"
+// @Success 200 {object} dataplane.ExportMessage "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/stream/{streamName}/export [get]
+func (h APIRestJetStreamDataplaneHandler) ExportStream(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/data/stream/{streamName}/export"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "ndjson", "envelope", "parquet":
+	default:
+		msg := fmt.Sprintf("Unknown export format '%s'", format)
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	subjectName := r.URL.Query().Get("subject_name")
+	if subjectName != "" {
+		var ok bool
+		if subjectName, ok = h.checkSubject(w, r, restCall, subjectName, true); !ok {
+			return
+		}
+	}
+	exportRange, err := readExportRange(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	writeFlusher, ok := w.(http.Flusher)
+	if !ok {
+		msg := "Streaming not supported"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	transport, err := h.transportFor(r)
+	if err != nil {
+		h.replyTransportError(w, r, restCall, err)
+		return
+	}
+	defer transport.release()
+
+	exporter, err := dataplane.GetJetStreamExporter(
+		transport.client, streamName, subjectName, exportRange,
+	)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to export stream %s", streamName)
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	defer func() {
+		_ = exporter.Close()
+	}()
+
+	// Principals limited to metadata see no message body
+	metadataOnly := false
+	if h.tail.PayloadAccess != nil {
+		principal, _ := GetRequestPrincipal(r.Context())
+		metadataOnly =
+			h.tail.PayloadAccess.Access(principal, streamName) == dataplane.PayloadAccessMetadata
+	}
+
+	// The export ends after the max duration, on request end, or on server stop
+	exportCtxt, cancel := context.WithTimeout(r.Context(), h.export.MaxDuration)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.baseContext.Done():
+			cancel()
+		case <-exportCtxt.Done():
+		}
+	}()
+
+	var minInterval time.Duration
+	if h.export.MaxRate > 0 {
+		minInterval = time.Duration(float64(time.Second) / h.export.MaxRate)
+	}
+	if format == "parquet" {
+		w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Trailer", "Httpmq-Export-Count, Httpmq-Export-Complete")
+	w.WriteHeader(http.StatusOK)
+	writeFlusher.Flush()
+	var parquet dataplane.ExportParquetWriter
+	if format == "parquet" {
+		if parquet, err = dataplane.GetExportParquetWriter(w, exportParquetRowGroupSize); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Failed to start Parquet export")
+			return
+		}
+	}
+	exported := 0
+	complete := false
+	var lastSent time.Time
+	for {
+		msg, err := exporter.NextMsg(exportCtxt)
+		if errors.Is(err, io.EOF) {
+			complete = true
+			break
+		} else if err != nil {
+			if exportCtxt.Err() == nil {
+				log.WithError(err).WithFields(localLogTags).Errorf(
+					"Error occurred reading from JetStream",
+				)
+			}
+			break
+		}
+		// Throttle the export, instead of dropping messages as a tail session does
+		if wait := minInterval - time.Since(lastSent); minInterval > 0 && wait > 0 {
+			select {
+			case <-exportCtxt.Done():
+			case <-time.After(wait):
+			}
+			if exportCtxt.Err() != nil {
+				break
+			}
+		}
+		// An export is not a durable consumer, so it is never exempt from redaction
+		if h.redactor != nil {
+			if msg, err = h.redactor.Redact(streamName, "", msg); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to redact message")
+				break
+			}
+		}
+		envelope := dataplane.NewMsgEnvelope(msg)
+		if metadataOnly {
+			envelope = envelope.WithholdPayload()
+		}
+		var serialize []byte
+		var converted dataplane.ExportMessage
+		if format != "envelope" {
+			if converted, err = envelope.ToExport(); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to convert message")
+				break
+			}
+		}
+		if parquet != nil {
+			// Parquet rows are sent as their row group fills
+			if err := parquet.Write(converted); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to transmit message")
+				return
+			}
+		} else {
+			if format == "envelope" {
+				serialize, err = common.JSON().Marshal(&envelope)
+			} else {
+				serialize, err = common.JSON().Marshal(&converted)
+			}
+			if err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to serialize message")
+				break
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", serialize); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to transmit message")
+				return
+			}
+		}
+		lastSent = time.Now()
+		exported++
+		if exported%exportFlushInterval == 0 {
+			writeFlusher.Flush()
+		}
+	}
+	// A Parquet export cut short is still a readable file, of the messages sent
+	if parquet != nil {
+		if err := parquet.Close(); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Failed to transmit Parquet footer")
+			return
+		}
+	}
+	w.Header().Set("Httpmq-Export-Count", strconv.Itoa(exported))
+	w.Header().Set("Httpmq-Export-Complete", strconv.FormatBool(complete))
+	writeFlusher.Flush()
+	log.WithFields(localLogTags).Infof(
+		"Ending export of stream %s: %d exported, complete %v", streamName, exported, complete,
+	)
+}
+
+// ExportStreamHandler Wrapper around ExportStream
+func (h APIRestJetStreamDataplaneHandler) ExportStreamHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.ExportStream(w, r)
+	})
+}
+
+// =======================================================================
+// Bulk import
+
+// -----------------------------------------------------------------------
+
+// importTokenHeader is the request header carrying the token of the import to resume
+const importTokenHeader = "Httpmq-Import-Token"
+
+// APIRestRespImport response for the progress of a bulk import
+type APIRestRespImport struct {
+	StandardResponse
+	// Import is the progress of the import, with the token to resume it
+	Import *dataplane.ImportProgress `json:"import,omitempty"`
+}
+
+// ImportMessages godoc
+// @Summary Bulk import messages
+// @Description Publish the messages of an NDJSON upload, one JSON object per line with the
+// @Description subject, headers, and Base64 encoded body of a message, as produced by a
+// @Description stream export. Messages are published with bounded concurrency, and the
+// @Description import stops at the first message not published. Streams are not created
+// @Description automatically. The response reports the progress, with a token to resume the
+// @Description import with an upload starting after the committed lines. Messages published
+// @Description again on resume are dropped by JetStream as duplicates. An empty upload starts
+// @Description an import without publishing, so its progress can be followed while the
+// @Description first upload runs.
+// @tags Dataplane,post,publish
+// @Accept plain
+// @Produce json
+// @Param Httpmq-Import-Token header string false "Token of the import to resume"
+// @Param upload body string true "NDJSON messages"
+// @Success 200 {object} APIRestRespImport "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 409 {object} StandardResponse "error"
+// @Failure 500 {object} APIRestRespImport "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,409,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/import [post]
+func (h APIRestJetStreamDataplaneHandler) ImportMessages(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/data/import"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.importer == nil {
+		msg := "Bulk import is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	transport, err := h.transportFor(r)
+	if err != nil {
+		h.replyTransportError(w, r, restCall, err)
+		return
+	}
+	defer transport.release()
+
+	progress, err := h.importer.Import(
+		r.Body, r.Header.Get(importTokenHeader), transport.publisher, r.Context(),
+	)
+	if err != nil {
+		respCode := http.StatusInternalServerError
+		msg := "Unable to start import"
+		if errors.Is(err, dataplane.ErrInvalidImportToken) {
+			respCode = http.StatusBadRequest
+			msg = err.Error()
+		} else if errors.Is(err, dataplane.ErrImportRunning) {
+			respCode = http.StatusConflict
+			msg = "An upload of the import is still running"
+		}
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+		return
+	}
+
+	if progress.Error != "" {
+		msg := fmt.Sprintf("Import %s stopped at %s", progress.ID, progress.Error)
+		log.WithFields(localLogTags).Errorf(msg)
+		resp := APIRestRespImport{
+			StandardResponse: getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			Import:           &progress,
+		}
+		h.reply(w, http.StatusInternalServerError, resp, restCall, r)
+		return
+	}
+	h.reply(
+		w,
+		http.StatusOK,
+		APIRestRespImport{StandardResponse: getStdRESTSuccessMsg(), Import: &progress},
+		restCall,
+		r,
+	)
+}
+
+// ImportMessagesHandler Wrapper around ImportMessages
+func (h APIRestJetStreamDataplaneHandler) ImportMessagesHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.ImportMessages(w, r)
+	})
+}
+
+// GetImportProgress godoc
+// @Summary Query for the progress of a bulk import
+// @Description Query for the progress of a bulk import run recently on this dataplane
+// @Description instance, including while an upload is running.
+// @tags Dataplane,get
+// @Produce json
+// @Param importID path string true "Import ID"
+// @Success 200 {object} APIRestRespImport "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/import/{importID} [get]
+func (h APIRestJetStreamDataplaneHandler) GetImportProgress(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/data/import/{importID}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.importer == nil {
+		msg := "Bulk import is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	importID, ok := vars["importID"]
+	if !ok {
+		msg := "No import ID provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	progress, ok := h.importer.Progress(importID)
+	if !ok {
+		msg := fmt.Sprintf("Import %s is not known", importID)
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusNotFound, getStdRESTErrorMsg(http.StatusNotFound, &msg), restCall, r)
+		return
+	}
+	h.reply(
+		w,
+		http.StatusOK,
+		APIRestRespImport{StandardResponse: getStdRESTSuccessMsg(), Import: &progress},
+		restCall,
+		r,
+	)
+}
+
+// GetImportProgressHandler Wrapper around GetImportProgress
+func (h APIRestJetStreamDataplaneHandler) GetImportProgressHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetImportProgress(w, r)
+	})
+}
+
+// =======================================================================
+// Service level objectives
+
+// -----------------------------------------------------------------------
+
+// APIRestRespSLOReport response for the service level of the dataplane
+type APIRestRespSLOReport struct {
+	StandardResponse
+	// Paths are the service levels of the publish and delivery paths
+	Paths []metrics.SLOPathReport `json:"paths"`
+}
+
+// GetSLOReport godoc
+// @Summary Query for service level objective compliance
+// @Description Query for the availability and latency of the publish and delivery paths of
+// @Description this dataplane instance over each SLO window, their compliance with the
+// @Description objectives, and how fast their error budgets are burning.
+// @tags Dataplane,get,health
+// @Produce json
+// @Success 200 {object} APIRestRespSLOReport "success"
+// @Failure 400 {string} string "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /slo [get]
+func (h APIRestJetStreamDataplaneHandler) GetSLOReport(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /slo"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.slo == nil {
+		msg := "SLO tracking is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	resp := APIRestRespSLOReport{
+		StandardResponse: getStdRESTSuccessMsg(),
+		Paths:            h.slo.Report(),
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetSLOReportHandler Wrapper around GetSLOReport
+func (h APIRestJetStreamDataplaneHandler) GetSLOReportHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetSLOReport(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// DrainMonitor the tracker of the sessions draining on shutdown
+func (h APIRestJetStreamDataplaneHandler) DrainMonitor() dataplane.DrainMonitor {
+	return h.drain
+}
+
+// APIRestRespDrainStatus response to the drain progress query
+type APIRestRespDrainStatus struct {
+	StandardResponse
+	// Drain is the progress of draining the sessions on shutdown
+	Drain dataplane.DrainStatus `json:"drain"`
+}
+
+// GetDrainStatus godoc
+// @Summary Query for the progress of draining sessions on shutdown
+// @Description Query for the number of sessions still running and messages awaiting ACK
+// @Description on this dataplane instance, and when the drain for shutdown is estimated to
+// @Description complete. Orchestrators can poll this while the instance shuts down to
+// @Description decide when to kill it.
+// @tags Dataplane,get,health
+// @Produce json
+// @Success 200 {object} APIRestRespDrainStatus "success"
+// @Failure 400 {string} string "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /drain [get]
+func (h APIRestJetStreamDataplaneHandler) GetDrainStatus(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /drain"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	status, err := h.drain.Status(r.Context())
+	if err != nil {
+		msg := "Failed to query the drain progress"
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	resp := APIRestRespDrainStatus{StandardResponse: getStdRESTSuccessMsg(), Drain: status}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetDrainStatusHandler Wrapper around GetDrainStatus
+func (h APIRestJetStreamDataplaneHandler) GetDrainStatusHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetDrainStatus(w, r)
+	})
+}
+
+// =======================================================================
+// Message trace
+
+// -----------------------------------------------------------------------
+
+// APIRestRespMessageTrace response for the message trace of the dataplane
+type APIRestRespMessageTrace struct {
+	StandardResponse
+	// Traces are the recent messages of each traced subject and consumer
+	Traces []dataplane.MessageTrace `json:"traces"`
+}
+
+// GetMessageTrace godoc
+// @Summary Query for the recent messages of the traced subjects and consumers
+// @Description Query for the metadata, and optionally the start of the payload, of the
+// @Description recent messages this dataplane instance sent to clients on each traced
+// @Description subject and consumer. Requires an authenticated principal; payloads are
+// @Description withheld from principals limited to metadata, and redaction rules apply.
+// @tags Dataplane,get
+// @Produce json
+// @Success 200 {object} APIRestRespMessageTrace "success"
+// @Failure 400 {string} string "error"
+// @Failure 401 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,401,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/trace [get]
+func (h APIRestJetStreamDataplaneHandler) GetMessageTrace(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/data/trace"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.tracer == nil {
+		msg := "Message trace is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	// Traces carry message headers and payloads, so they are only shown to a known
+	// principal, with the same payload access and redaction as a tail session
+	principal, ok := GetRequestPrincipal(r.Context())
+	if !ok || principal == "" {
+		msg := "Message trace requires an authenticated principal"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusUnauthorized, getStdRESTErrorMsg(http.StatusUnauthorized, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	traces := h.tracer.Report()
+	for traceIdx := range traces {
+		records := traces[traceIdx].Records
+		for idx := range records {
+			h.screenTraceRecord(principal, &records[idx], localLogTags)
+		}
+	}
+
+	resp := APIRestRespMessageTrace{
+		StandardResponse: getStdRESTSuccessMsg(),
+		Traces:           traces,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// screenTraceRecord apply the payload access of the principal, and the redaction rules,
+// to a message trace record
+func (h APIRestJetStreamDataplaneHandler) screenTraceRecord(
+	principal string, record *dataplane.MessageTraceRecord, logTags log.Fields,
+) {
+	if h.tail.PayloadAccess != nil &&
+		h.tail.PayloadAccess.Access(principal, record.Stream) == dataplane.PayloadAccessMetadata {
+		record.WithholdPayload()
+	}
+	// The viewer is not the traced consumer, so it is never exempt from redaction
+	if h.redactor == nil {
+		return
+	}
+	redacted, err := h.redactor.Redact(
+		record.Stream, "", &nats.Msg{Subject: record.Subject, Header: record.Header, Data: record.Payload},
+	)
+	if err != nil {
+		// A truncated payload may not parse, so withhold what could not be redacted
+		log.WithError(err).WithFields(logTags).Debugf("Failed to redact traced message")
+		record.Header = nil
+		record.WithholdPayload()
+		return
+	}
+	record.Header = redacted.Header
+	if !record.PayloadWithheld {
+		record.Payload = redacted.Data
+	}
+}
+
+// GetMessageTraceHandler Wrapper around GetMessageTrace
+func (h APIRestJetStreamDataplaneHandler) GetMessageTraceHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetMessageTrace(w, r)
+	})
+}
+
+// =======================================================================
+// Publish grants
+
+// -----------------------------------------------------------------------
+
+// APIRestReqPublishGrant parameters for issuing a publish grant
+type APIRestReqPublishGrant struct {
+	// Subject is the subject the grant allows publishing to
+	Subject string `json:"subject" validate:"required"`
+	// MaxMessages is the number of messages the grant allows publishing
+	MaxMessages int `json:"max_msgs" validate:"required,gte=1"`
+	// TTL duration (ns) the grant is valid for
+	TTL time.Duration `json:"ttl" validate:"required,gt=0" swaggertype:"primitive,integer"`
+}
+
+// APIRestRespPublishGrant response for issuing a publish grant
+type APIRestRespPublishGrant struct {
+	StandardResponse
+	// Grant is the issued grant
+	Grant dataplane.PublishGrant `json:"grant"`
+	// Token is the signed token of the grant
+	Token string `json:"token"`
+	// URL is the path of the signed URL publishing with the grant
+	URL string `json:"url"`
+}
+
+// IssuePublishGrant godoc
+// @Summary Issue a signed publish URL
+// @Description Issue a short-lived token granting publishing a number of messages to one
+// @Description subject, without other credentials. The token is returned with the path of
+// @Description the signed URL publishing with it, for handing to untrusted edge devices or
+// @Description third parties.
+// @tags Dataplane,post,publish
 // @Accept json
 // @Produce json
-// @Param streamName path string true "JetStream stream name"
-// @Param consumerName path string true "JetStream consumer name"
-// @Param sequenceNum body dataplane.AckSeqNum true "Message message sequence numbers"
-// @Success 200 {object} StandardResponse "success"
+// @Param grant body APIRestReqPublishGrant true "Grant to issue"
+// @Success 200 {object} APIRestRespPublishGrant "success"
 // @Failure 400 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
-// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
-// @Router /v1/data/stream/{streamName}/consumer/{consumerName}/ack [post]
-func (h APIRestJetStreamDataplaneHandler) ReceiveMsgACK(w http.ResponseWriter, r *http.Request) {
-	restCall := "POST /v1/data/stream/{streamName}/consumer/{consumerName}/ack"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/grant [post]
+func (h APIRestJetStreamDataplaneHandler) IssuePublishGrant(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "POST /v1/data/grant"
 
 	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
 	if err != nil {
@@ -199,92 +4689,106 @@ func (h APIRestJetStreamDataplaneHandler) ReceiveMsgACK(w http.ResponseWriter, r
 		return
 	}
 
-	vars := mux.Vars(r)
-	streamName, ok := vars["streamName"]
-	if !ok {
-		msg := "No stream name provided"
-		log.WithFields(localLogTags).Errorf(msg)
-		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
-		return
-	}
-	consumerName, ok := vars["consumerName"]
-	if !ok {
-		msg := "No consumer name provided"
+	if h.publish.Grants == nil {
+		msg := "Publish grants are not enabled"
 		log.WithFields(localLogTags).Errorf(msg)
 		h.reply(
-			w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
 		)
 		return
 	}
+	// Granted publishes are sent with the server's own credentials
+	if h.replyNotSupportedForTenants(w, r, restCall) {
+		return
+	}
 
-	var sequence dataplane.AckSeqNum
-	if err := json.NewDecoder(r.Body).Decode(&sequence); err != nil {
+	var params APIRestReqPublishGrant
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
 		msg := "Unable to parse request body"
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
-
-	// Validate input
-	if err := h.validate.Struct(&sequence); err != nil {
-		msg := "Unable to parse request body"
+	if err := h.validate.Struct(&params); err != nil {
+		msg := "Bad request body"
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
-
-	ackInfo := dataplane.AckIndication{
-		Stream: streamName, Consumer: consumerName, SeqNum: dataplane.AckSeqNum{
-			Stream: sequence.Stream, Consumer: sequence.Consumer,
-		},
+	subject, ok := h.checkSubject(w, r, restCall, params.Subject, false)
+	if !ok {
+		return
 	}
 
-	// Broadcast the ACK
-	if err := h.ackBroadcast.BroadcastACK(ackInfo, r.Context()); err != nil {
-		msg := fmt.Sprintf("Failed to broadcast ACK %s", ackInfo.String())
-		log.WithError(err).WithFields(localLogTags).Error(msg)
-		h.reply(
-			w, http.StatusInternalServerError, getStdRESTErrorMsg(
-				http.StatusInternalServerError, &msg,
-			), restCall, r,
-		)
+	token, grant, err := h.publish.Grants.Issue(subject, params.MaxMessages, params.TTL)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to issue publish grant")
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
+	log.WithFields(localLogTags).Infof(
+		"Issued publish grant %s for %d messages to %s until %s",
+		grant.ID,
+		grant.MaxMessages,
+		grant.Subject,
+		grant.Expires.Format(time.RFC3339),
+	)
 
-	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+	resp := APIRestRespPublishGrant{
+		StandardResponse: getStdRESTSuccessMsg(),
+		Grant:            grant,
+		Token:            token,
+		URL: fmt.Sprintf(
+			"%s/signed/subject/%s?token=%s",
+			strings.TrimSuffix(r.URL.Path, "/data/grant"),
+			url.PathEscape(subject),
+			url.QueryEscape(token),
+		),
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
 }
 
-// ReceiveMsgACKHandler Wrapper around ReceiveMsgACK
-func (h APIRestJetStreamDataplaneHandler) ReceiveMsgACKHandler() http.HandlerFunc {
+// IssuePublishGrantHandler Wrapper around IssuePublishGrant
+func (h APIRestJetStreamDataplaneHandler) IssuePublishGrantHandler() http.HandlerFunc {
 	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
-		h.ReceiveMsgACK(w, r)
+		h.IssuePublishGrant(w, r)
 	})
 }
 
 // -----------------------------------------------------------------------
 
-// PushSubscribe godoc
-// @Summary Establish a pull subscribe session
-// @Description Establish a JetStream pull subscribe session for a client. This is a long lived
-// server send event stream. The stream will close on client disconnect, server shutdown, or
-// server internal error.
-// @tags Dataplane,get,subscribe
+// SignedPublishMessage godoc
+// @Summary Publish a message with a signed URL
+// @Description Publish a Base64 encoded message to a JetStream subject, authorized by the
+// @Description publish grant token of the URL instead of the server's credentials. Each
+// @Description accepted request counts against the messages the grant allows, whether or
+// @Description not the message is stored. The call returns once JetStream ACKs the message.
+// @tags Dataplane,post,publish
+// @Accept plain
 // @Produce json
-// @Param streamName path string true "JetStream stream name"
-// @Param consumerName path string true "JetStream consumer name"
-// @Param subject_name query string true "JetStream subject to subscribe to"
-// @Param max_msg_inflight query integer false "Max number of inflight messages (DEFAULT: 1)"
-// @Param delivery_group query string false "Needed if consumer uses delivery groups"
+// @Param subjectName path string true "JetStream subject to publish under"
+// @Param token query string true "Publish grant token"
+// @Param ack_wait query string false "How long to wait for the ACK, e.g. 5s (DEFAULT: server setting)"
+// @Param message body string true "Message to publish in Base64 encoding"
 // @Success 200 {object} StandardResponse "success"
 // @Failure 400 {object} StandardResponse "error"
+// @Failure 403 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
-// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
-// @Router /v1/data/stream/{streamName}/consumer/{consumerName} [get]
-func (h APIRestJetStreamDataplaneHandler) PushSubscribe(w http.ResponseWriter, r *http.Request) {
-	restCall := "GET /v1/data/stream/{streamName}/consumer/{consumerName}"
+// @Failure 501 {object} StandardResponse "error"
+// @Failure 503 {object} StandardResponse "error"
+// @Failure 504 {object} StandardResponse "error"
+// @Header 200,400,403,500,501,503,504 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 200,400,500,503,504 {integer} Httpmq-Grant-Remaining "Number of messages the grant still allows"
+// @Router /v1/signed/subject/{subjectName} [post]
+func (h APIRestJetStreamDataplaneHandler) SignedPublishMessage(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "POST /v1/signed/subject/{subjectName}"
 
-	localLogTagsInitial, err := common.UpdateLogTags(h.LogTags, r.Context())
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
 	if err != nil {
 		msg := "Prep failed"
 		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
@@ -298,246 +4802,183 @@ func (h APIRestJetStreamDataplaneHandler) PushSubscribe(w http.ResponseWriter, r
 		return
 	}
 
-	// --------------------------------------------------------------------------
-	// Read operation parameters
+	if h.publish.Grants == nil {
+		msg := "Publish grants are not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+	if h.replyNotSupportedForTenants(w, r, restCall) {
+		return
+	}
+
 	vars := mux.Vars(r)
-	streamName, ok := vars["streamName"]
+	subjectName, ok := vars["subjectName"]
 	if !ok {
-		msg := "No stream name provided"
-		log.WithFields(localLogTagsInitial).Errorf(msg)
+		msg := "No subject name provided"
+		log.WithFields(localLogTags).Errorf(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
-	consumerName, ok := vars["consumerName"]
-	if !ok {
-		msg := "No consumer name provided"
-		log.WithFields(localLogTagsInitial).Errorf(msg)
-		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+	if subjectName, ok = h.checkSubject(w, r, restCall, subjectName, false); !ok {
 		return
 	}
 
-	// Read query parameters
-	var subjectName string
-	var deliveryGroup *string
-	maxInflightMsg := 1
-	deliveryGroup = nil
-	requestQueries := r.URL.Query()
-	// Read the subject
-	{
-		t, ok := requestQueries["subject_name"]
-		if !ok || len(t) != 1 {
-			msg := "Missing subscribe subject / Multiple subjects"
-			log.WithFields(localLogTagsInitial).Errorf(msg)
-			h.reply(
-				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
-			)
-			return
-		}
-		subjectName = t[0]
-	}
-	// Read the max inflight messages
-	{
-		t, ok := requestQueries["max_msg_inflight"]
-		if ok {
-			if len(t) != 1 {
-				msg := "Multiple max_msg_inflight"
-				log.WithFields(localLogTagsInitial).Errorf(msg)
-				h.reply(
-					w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
-				)
-				return
-			}
-			p, err := strconv.Atoi(t[0])
-			if err != nil {
-				msg := "Unable to parse max_msg_inflight"
-				log.WithError(err).WithFields(localLogTagsInitial).Errorf(msg)
-				h.reply(
-					w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
-				)
-				return
-			}
-			maxInflightMsg = p
-		}
+	grant, remaining, err := h.publish.Grants.Use(r.URL.Query().Get("token"), subjectName)
+	if err != nil {
+		msg := fmt.Sprintf("Publish to %s not granted: %s", subjectName, err)
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusForbidden, getStdRESTErrorMsg(http.StatusForbidden, &msg), restCall, r)
+		return
 	}
-	// Read the delivery group
-	{
-		t, ok := requestQueries["delivery_group"]
-		if ok {
-			if len(t) != 1 {
-				msg := "Multiple delivery groups"
-				log.WithFields(localLogTagsInitial).Errorf(msg)
-				h.reply(
-					w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
-				)
-				return
-			}
-			deliveryGroup = new(string)
-			*deliveryGroup = t[0]
-		}
+	w.Header().Set("Httpmq-Grant-Remaining", strconv.Itoa(remaining))
+
+	transport, err := h.transportFor(r)
+	if err != nil {
+		h.replyTransportError(w, r, restCall, err)
+		return
 	}
+	defer transport.release()
 
-	// --------------------------------------------------------------------------
-	// Start operation
+	pubCtxt, cancel, err := h.publishContext(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	defer cancel()
 
-	// Define custom log tags for this instance
-	logTags := log.Fields{
-		"module":         "rest",
-		"component":      "jetstream-dataplane",
-		"instance":       "push-subscribe",
-		"stream":         streamName,
-		"subject":        subjectName,
-		"consumer":       consumerName,
-		"delivery_group": deliveryGroup,
+	// Decode the message
+	decodedMsg, release, err := h.decodePublishBody(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
 	}
-	if r.Context().Value(common.RequestParam{}) != nil {
-		v, ok := r.Context().Value(common.RequestParam{}).(common.RequestParam)
-		if ok {
-			v.UpdateLogTags(logTags)
-		}
+	defer release()
+	if !h.inspectContent(w, r, restCall, subjectName, decodedMsg) {
+		return
 	}
-
-	// Create stream flusher
-	writeFlusher, ok := w.(http.Flusher)
+	scan, ok := h.scanPII(w, r, restCall, subjectName, decodedMsg, true)
 	if !ok {
-		msg := "Streaming not supported"
-		log.WithFields(logTags).Errorf(msg)
-		h.reply(
-			w, http.StatusInternalServerError, getStdRESTErrorMsg(
-				http.StatusInternalServerError, &msg,
-			), restCall, r,
-		)
 		return
 	}
 
-	// Create the dispatcher
-	runtimeCtxt, cancel := context.WithCancel(r.Context())
-	defer cancel()
-	dispatcher, err := dataplane.GetPushMessageDispatcher(
-		h.natsClient,
-		streamName,
-		subjectName,
-		consumerName,
-		deliveryGroup,
-		maxInflightMsg,
-		h.wg,
-		runtimeCtxt,
-	)
-	if err != nil {
-		msg := "Unable to define dispatcher"
-		log.WithError(err).WithFields(logTags).Errorf(msg)
-		h.reply(
-			w, http.StatusInternalServerError, getStdRESTErrorMsg(
-				http.StatusInternalServerError, &msg,
-			), restCall, r,
+	// Publish the message
+	publishStart := time.Now()
+	if scan.Action == dataplane.PIIActionTag {
+		toSend := nats.NewMsg(subjectName)
+		toSend.Data = scan.Message
+		toSend.Header.Set(dataplane.PIIDetectedHeader, strings.Join(scan.Detected, ","))
+		err = transport.publisher.PublishMsg(toSend, pubCtxt).Err
+	} else {
+		err = transport.publisher.PublishWithPolicy(
+			subjectName, scan.Message, dataplane.PublishAckWait, pubCtxt,
 		)
+	}
+	h.recordPublishSLO(err, time.Since(publishStart))
+	h.recordPublishRate(subjectName, err)
+	if err != nil {
+		respCode := http.StatusInternalServerError
+		msg := fmt.Sprintf("Unable to publish message to %s", subjectName)
+		if errors.Is(err, hooks.ErrRejected) {
+			respCode = http.StatusForbidden
+			msg = fmt.Sprintf("Message to %s rejected: %s", subjectName, err)
+		} else if dataplane.IsPublishBackpressureError(err) {
+			respCode = http.StatusServiceUnavailable
+			msg = "Too many publishes awaiting ACK"
+			h.setPublishBackpressureHeaders(w, transport.publishClient)
+		} else if pubCtxt.Err() == context.DeadlineExceeded {
+			respCode = http.StatusGatewayTimeout
+			msg = fmt.Sprintf("No ACK for message to %s within ack_wait", subjectName)
+		}
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
 		return
 	}
+	common.ThrottledDebugf(
+		log.WithFields(localLogTags), "Published to %s with grant %s", subjectName, grant.ID,
+	)
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
 
-	// Handle error which occur when interacting with JetStream
-	internalError := make(chan error, maxInflightMsg*2)
-	errorHandler := func(err error) {
-		internalError <- err
-	}
+// SignedPublishMessageHandler Wrapper around SignedPublishMessage
+func (h APIRestJetStreamDataplaneHandler) SignedPublishMessageHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.SignedPublishMessage(w, r)
+	})
+}
 
-	// Handle messages read from JetStream
-	msgBuffer := make(chan *nats.Msg, maxInflightMsg*2)
-	msgHandler := func(msg *nats.Msg, ctxt context.Context) error {
-		select {
-		case msgBuffer <- msg:
-			return nil
-		case <-ctxt.Done():
-			return ctxt.Err()
-		case <-runtimeCtxt.Done():
-			return runtimeCtxt.Err()
-		}
-	}
+// =======================================================================
+// Publish failover
 
-	// Begin reading from JetStream
-	if err := dispatcher.Start(msgHandler, errorHandler); err != nil {
-		msg := "Unable to start dispatcher"
-		log.WithError(err).WithFields(logTags).Errorf(msg)
+// -----------------------------------------------------------------------
+
+// APIRestRespPublishFailoverStatus response for the state of publish failover
+type APIRestRespPublishFailoverStatus struct {
+	StandardResponse
+	// Failover is the state of publish failover
+	Failover dataplane.PublishFailoverStatus `json:"failover"`
+}
+
+// GetPublishFailoverStatus godoc
+// @Summary Query for the NATS cluster publishes are sent to
+// @Description Query for whether this dataplane instance publishes to the primary or the
+// @Description secondary NATS cluster, and the health of both.
+// @tags Dataplane,get,health
+// @Produce json
+// @Success 200 {object} APIRestRespPublishFailoverStatus "success"
+// @Failure 400 {string} string "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /failover [get]
+func (h APIRestJetStreamDataplaneHandler) GetPublishFailoverStatus(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /failover"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
 		h.reply(
-			w, http.StatusInternalServerError, getStdRESTErrorMsg(
-				http.StatusInternalServerError, &msg,
-			), restCall, r,
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
 		)
 		return
 	}
 
-	// Process events
-	complete := false
-	onError := func(err error, msg string) {
-		cancel()
-		complete = true
-		log.WithError(err).WithFields(logTags).Errorf(msg)
+	if h.publish.Failover == nil {
+		msg := "Publish failover is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
 		h.reply(
-			w, http.StatusInternalServerError, getStdRESTErrorMsg(
-				http.StatusInternalServerError, &msg,
-			), restCall, r,
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
 		)
+		return
 	}
-	for !complete {
-		select {
-		case <-h.baseContext.Done():
-			// Server stopping
-			complete = true
-			log.WithFields(logTags).Info("Terminating PUSH subscription on server stop")
-			msg := "Server stopping"
-			h.reply(
-				w, http.StatusInternalServerError, getStdRESTErrorMsg(
-					http.StatusInternalServerError, &msg,
-				), restCall, r,
-			)
-		case <-r.Context().Done():
-			// Request closed
-			complete = true
-			log.WithFields(logTags).Info("Terminating PUSH subscription on request end")
-			h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
-		case err, ok := <-internalError:
-			// Internal system error
-			if ok {
-				onError(err, "Error occurred interacting with JetStream")
-			} else {
-				err := fmt.Errorf("jetstream interaction internal error channel read fail")
-				onError(err, "Internal error channel read fail")
-			}
-		case msg, ok := <-msgBuffer:
-			// Send out a new message
-			if ok && msg != nil {
-				// Convert to transmission format
-				converted, err := dataplane.ConvertJSMessageDeliver(subjectName, msg)
-				if err != nil {
-					onError(err, "Failed to convert message for transmission")
-					break
-				}
-				// Serialize as JSON
-				serialize, err := json.Marshal(&converted)
-				if err != nil {
-					onError(err, "Failed to serialize message for transmission")
-					break
-				}
-				// Send and flush
-				written, err := fmt.Fprintf(w, "%s\n", serialize)
-				writeFlusher.Flush()
-				if err != nil {
-					onError(err, "Failed to transmit message")
-					break
-				}
-				log.WithFields(logTags).Debugf("Written %dB", written)
-			} else {
-				err := fmt.Errorf("jetstream message channel read fail")
-				onError(err, "Message channel read fail")
-			}
-		}
+
+	resp := APIRestRespPublishFailoverStatus{
+		StandardResponse: getStdRESTSuccessMsg(),
+		Failover:         h.publish.Failover.Status(),
 	}
-	// On final flush
-	writeFlusher.Flush()
+	h.reply(w, http.StatusOK, resp, restCall, r)
 }
 
-// PushSubscribeHandler Wrapper around PushSubscribe
-func (h APIRestJetStreamDataplaneHandler) PushSubscribeHandler() http.HandlerFunc {
+// GetPublishFailoverStatusHandler Wrapper around GetPublishFailoverStatus
+func (h APIRestJetStreamDataplaneHandler) GetPublishFailoverStatusHandler() http.HandlerFunc {
 	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
-		h.PushSubscribe(w, r)
+		h.GetPublishFailoverStatus(w, r)
 	})
 }
 
@@ -572,18 +5013,27 @@ func (h APIRestJetStreamDataplaneHandler) AliveHandler() http.HandlerFunc {
 
 // Ready godoc
 // @Summary For readiness check
-// @Description Will return success if REST API module is ready for use
+// @Description Will return success if REST API module is ready for use. Not ready once the
+// @Description sessions are draining for shutdown.
 // @tags Dataplane,get,health
 // @Produce json
 // @Success 200 {object} StandardResponse "success"
 // @Failure 400 {string} string "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
+// @Failure 503 {object} StandardResponse "error"
 // @Router /ready [get]
 func (h APIRestJetStreamDataplaneHandler) Ready(w http.ResponseWriter, r *http.Request) {
 	restCall := "GET /ready"
 	msg := "not ready"
-	if h.natsClient.NATs().Status() == nats.CONNECTED {
+	if h.drain.Draining() {
+		msg = "draining for shutdown"
+		h.reply(
+			w, http.StatusServiceUnavailable, getStdRESTErrorMsg(
+				http.StatusServiceUnavailable, &msg,
+			), restCall, r,
+		)
+	} else if h.natsClient.NATs().Status() == nats.CONNECTED {
 		h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
 	} else {
 		h.reply(
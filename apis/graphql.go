@@ -0,0 +1,606 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apis
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/net/websocket"
+)
+
+// GraphQLWSProtocol is the WebSocket subprotocol of GraphQL subscriptions
+const GraphQLWSProtocol = "graphql-transport-ws"
+
+// graphQLInitTimeout is how long a GraphQL WebSocket client has to initialize the connection
+const graphQLInitTimeout = time.Second * 10
+
+// GraphQLParam settings for the GraphQL subscriptions of the dataplane. GraphQL queries of
+// streams and consumers are served by the management API.
+type GraphQLParam struct {
+	// Enabled serves GraphQL subscriptions to messages
+	Enabled bool
+}
+
+// APIRestReqGraphQL a GraphQL request
+type APIRestReqGraphQL struct {
+	// Query is the GraphQL document
+	Query string `json:"query" validate:"required"`
+	// OperationName is the operation of the document to execute, if it has several
+	OperationName string `json:"operationName,omitempty"`
+	// Variables are the values of the operation variables
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQLError an error of a GraphQL request
+type GraphQLError struct {
+	// Message is the error message
+	Message string `json:"message"`
+}
+
+// APIRestRespGraphQL a GraphQL response
+type APIRestRespGraphQL struct {
+	// Data is the result of the operation, if it was executed
+	Data interface{} `json:"data,omitempty" swaggertype:"object"`
+	// Errors are the errors of the request, if any
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+// graphQLFailure helper function to define the response of a failed GraphQL request
+func graphQLFailure(err error) APIRestRespGraphQL {
+	return APIRestRespGraphQL{Errors: []GraphQLError{{Message: err.Error()}}}
+}
+
+// graphQLWSMessage a message of the graphql-transport-ws protocol
+type graphQLWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ==============================================================================
+// Schema
+
+// graphQLStringArg helper function to read a string argument of a field
+func graphQLStringArg(args map[string]interface{}, name string, required bool) (string, error) {
+	value, ok := args[name]
+	if !ok || value == nil {
+		if required {
+			return "", fmt.Errorf("argument %s required", name)
+		}
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %s must be a String", name)
+	}
+	return s, nil
+}
+
+// graphQLConsumer helper function to define the GraphQL object of a consumer
+func graphQLConsumer(info *nats.ConsumerInfo) common.GraphQLObject {
+	return common.GraphQLObject{TypeName: "Consumer", Fields: map[string]interface{}{
+		"name":              info.Name,
+		"stream":            info.Stream,
+		"durable":           info.Config.Durable != "",
+		"created":           info.Created.Format(time.RFC3339Nano),
+		"deliveredSequence": info.Delivered.Stream,
+		"ackFloorSequence":  info.AckFloor.Stream,
+		"numPending":        info.NumPending,
+		"numAckPending":     info.NumAckPending,
+		"numRedelivered":    info.NumRedelivered,
+		"numWaiting":        info.NumWaiting,
+		"pushBound":         info.PushBound,
+	}}
+}
+
+// graphQLStream helper function to define the GraphQL object of a stream
+func graphQLStream(
+	controller management.JetStreamController, info *nats.StreamInfo, ctxt context.Context,
+) common.GraphQLObject {
+	name := info.Config.Name
+	return common.GraphQLObject{TypeName: "Stream", Fields: map[string]interface{}{
+		"name":          name,
+		"subjects":      info.Config.Subjects,
+		"created":       info.Created.Format(time.RFC3339Nano),
+		"messages":      info.State.Msgs,
+		"bytes":         info.State.Bytes,
+		"firstSequence": info.State.FirstSeq,
+		"lastSequence":  info.State.LastSeq,
+		"consumerCount": info.State.Consumers,
+		"consumers": common.GraphQLFieldFunc(func(map[string]interface{}) (interface{}, error) {
+			all := controller.GetAllConsumersForStream(name, ctxt)
+			names := make([]string, 0, len(all))
+			for consumer := range all {
+				names = append(names, consumer)
+			}
+			sort.Strings(names)
+			consumers := make([]common.GraphQLObject, 0, len(names))
+			for _, consumer := range names {
+				consumers = append(consumers, graphQLConsumer(all[consumer]))
+			}
+			return consumers, nil
+		}),
+		"consumer": common.GraphQLFieldFunc(func(args map[string]interface{}) (interface{}, error) {
+			consumer, err := graphQLStringArg(args, "name", true)
+			if err != nil {
+				return nil, err
+			}
+			info, err := controller.GetConsumerForStream(name, consumer, ctxt)
+			if err != nil {
+				return nil, err
+			}
+			return graphQLConsumer(info), nil
+		}),
+	}}
+}
+
+// graphQLQueryRoot helper function to define the root object of GraphQL queries
+func graphQLQueryRoot(
+	controller management.JetStreamController, ctxt context.Context,
+) common.GraphQLObject {
+	return common.GraphQLObject{TypeName: "Query", Fields: map[string]interface{}{
+		"streams": common.GraphQLFieldFunc(func(map[string]interface{}) (interface{}, error) {
+			all := controller.GetAllStreams(ctxt)
+			names := make([]string, 0, len(all))
+			for stream := range all {
+				names = append(names, stream)
+			}
+			sort.Strings(names)
+			streams := make([]common.GraphQLObject, 0, len(names))
+			for _, stream := range names {
+				streams = append(streams, graphQLStream(controller, all[stream], ctxt))
+			}
+			return streams, nil
+		}),
+		"stream": common.GraphQLFieldFunc(func(args map[string]interface{}) (interface{}, error) {
+			stream, err := graphQLStringArg(args, "name", true)
+			if err != nil {
+				return nil, err
+			}
+			info, err := controller.GetStream(stream, ctxt)
+			if err != nil {
+				return nil, err
+			}
+			return graphQLStream(controller, info, ctxt), nil
+		}),
+	}}
+}
+
+// graphQLMessage helper function to define the GraphQL object of a message
+func graphQLMessage(msg dataplane.TailMessage) common.GraphQLObject {
+	headerNames := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	headers := make([]common.GraphQLObject, 0, len(headerNames))
+	for _, name := range headerNames {
+		headers = append(headers, common.GraphQLObject{
+			TypeName: "Header",
+			Fields:   map[string]interface{}{"name": name, "values": msg.Headers[name]},
+		})
+	}
+	var body interface{}
+	if len(msg.JSON) > 0 {
+		body = msg.JSON
+	}
+	var b64Msg interface{}
+	if msg.Message != nil {
+		b64Msg = base64.StdEncoding.EncodeToString(msg.Message)
+	}
+	var text interface{}
+	if msg.Text != "" {
+		text = msg.Text
+	}
+	return common.GraphQLObject{TypeName: "Message", Fields: map[string]interface{}{
+		"stream":          msg.Stream,
+		"subject":         msg.Subject,
+		"sequence":        msg.Sequence,
+		"timestamp":       msg.Timestamp.Format(time.RFC3339Nano),
+		"headers":         headers,
+		"size":            msg.Size,
+		"payloadWithheld": msg.PayloadWithheld,
+		"json":            body,
+		"text":            text,
+		"b64Msg":          b64Msg,
+	}}
+}
+
+// ==============================================================================
+// Queries
+
+// GraphQLQuery godoc
+// @Summary GraphQL queries
+// @Description Execute a GraphQL query for streams and consumers. The query type has the
+// @Description fields streams, and stream(name); a stream has the fields consumers, and
+// @Description consumer(name). Fragments, directives, mutations, and introspection are not
+// @Description supported. Subscriptions to messages are served by the dataplane.
+// @tags Management,post,graphql
+// @Accept json
+// @Produce json
+// @Param param body APIRestReqGraphQL true "GraphQL request"
+// @Success 200 {object} APIRestRespGraphQL "success"
+// @Failure 400 {object} APIRestRespGraphQL "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/graphql [post]
+func (h APIRestJetStreamManagementHandler) GraphQLQuery(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/admin/graphql"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	var params APIRestReqGraphQL
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		log.WithError(err).WithFields(localLogTags).Error("Unable to parse request body")
+		h.reply(w, http.StatusBadRequest, graphQLFailure(err), restCall, r)
+		return
+	}
+	if err := h.validate.Struct(&params); err != nil {
+		log.WithError(err).WithFields(localLogTags).Error("Bad request body")
+		h.reply(w, http.StatusBadRequest, graphQLFailure(err), restCall, r)
+		return
+	}
+	op, err := parseGraphQL(params)
+	if err == nil && op.Type != "query" {
+		err = fmt.Errorf("%s operations are not supported over HTTP", op.Type)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Error("Invalid GraphQL request")
+		h.reply(w, http.StatusBadRequest, graphQLFailure(err), restCall, r)
+		return
+	}
+
+	h.reply(w, http.StatusOK, executeGraphQLQuery(h.core, op, params, r.Context()), restCall, r)
+}
+
+// GraphQLQueryHandler Wrapper around GraphQLQuery
+func (h APIRestJetStreamManagementHandler) GraphQLQueryHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GraphQLQuery(w, r)
+	})
+}
+
+// parseGraphQL helper function to parse the operation of a GraphQL request
+func parseGraphQL(params APIRestReqGraphQL) (common.GraphQLOperation, error) {
+	ops, err := common.ParseGraphQL(params.Query)
+	if err != nil {
+		return common.GraphQLOperation{}, err
+	}
+	return common.SelectGraphQLOperation(ops, params.OperationName)
+}
+
+// executeGraphQLQuery helper function to execute a GraphQL query
+func executeGraphQLQuery(
+	controller management.JetStreamController,
+	op common.GraphQLOperation,
+	params APIRestReqGraphQL,
+	ctxt context.Context,
+) APIRestRespGraphQL {
+	data, err := common.ExecuteGraphQL(op, graphQLQueryRoot(controller, ctxt), params.Variables)
+	if err != nil {
+		return graphQLFailure(err)
+	}
+	return APIRestRespGraphQL{Data: data}
+}
+
+// ==============================================================================
+// Subscriptions
+
+// GraphQLSubscribe godoc
+// @Summary GraphQL subscriptions
+// @Description Serve GraphQL operations over a WebSocket, with the graphql-transport-ws
+// @Description protocol. The subscription type has the field messages(stream, subject), which
+// @Description delivers the messages published to a stream from the start of the
+// @Description subscription. Messages need not be ACKed. A subscription is rate limited, and
+// @Description completes after a max duration, as a stream tail session. Queries are served
+// @Description by the management API.
+// @tags Dataplane,get,graphql,subscribe
+// @Param Sec-WebSocket-Protocol header string true "Must offer graphql-transport-ws"
+// @Success 101 {string} string "WebSocket"
+// @Failure 400 {string} string "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/data/graphql [get]
+func (h APIRestJetStreamDataplaneHandler) GraphQLSubscribe(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/data/graphql"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if !h.graphQL.Enabled {
+		msg := "GraphQL API not enabled"
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+	// Streams are read with the server's own credentials
+	if h.replyNotSupportedForTenants(w, r, restCall) {
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, _ *http.Request) error {
+			for _, protocol := range config.Protocol {
+				if protocol == GraphQLWSProtocol {
+					config.Protocol = []string{GraphQLWSProtocol}
+					return nil
+				}
+			}
+			return fmt.Errorf("subprotocol %s required", GraphQLWSProtocol)
+		},
+		Handler: func(conn *websocket.Conn) {
+			h.serveGraphQLWS(conn, r, localLogTags)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// GraphQLSubscribeHandler Wrapper around GraphQLSubscribe
+func (h APIRestJetStreamDataplaneHandler) GraphQLSubscribeHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GraphQLSubscribe(w, r)
+	})
+}
+
+// serveGraphQLWS helper function to serve the graphql-transport-ws protocol on a WebSocket.
+// The connection is closed on a protocol violation.
+func (h APIRestJetStreamDataplaneHandler) serveGraphQLWS(
+	conn *websocket.Conn, r *http.Request, localLogTags log.Fields,
+) {
+	connCtxt, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-h.baseContext.Done():
+			// Unblock the read of the next client message
+			_ = conn.Close()
+		case <-connCtxt.Done():
+		}
+	}()
+
+	send := func(msg graphQLWSMessage) {
+		if err := websocket.JSON.Send(conn, msg); err != nil {
+			log.WithError(err).WithFields(localLogTags).Error("Failed to send GraphQL message")
+		}
+	}
+	var lock sync.Mutex
+	operations := map[string]context.CancelFunc{}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, stop := range operations {
+			stop()
+		}
+	}()
+
+	initialized := false
+	_ = conn.SetReadDeadline(time.Now().Add(graphQLInitTimeout))
+	for {
+		var msg graphQLWSMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			log.WithError(err).WithFields(localLogTags).Debug("GraphQL connection ended")
+			return
+		}
+		switch msg.Type {
+		case "connection_init":
+			if initialized {
+				log.WithFields(localLogTags).Error("GraphQL connection initialized twice")
+				return
+			}
+			initialized = true
+			_ = conn.SetReadDeadline(time.Time{})
+			send(graphQLWSMessage{Type: "connection_ack"})
+		case "ping":
+			send(graphQLWSMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			var params APIRestReqGraphQL
+			if !initialized || msg.ID == "" || json.Unmarshal(msg.Payload, &params) != nil {
+				log.WithFields(localLogTags).Error("Invalid GraphQL subscribe message")
+				return
+			}
+			lock.Lock()
+			if _, ok := operations[msg.ID]; ok {
+				lock.Unlock()
+				log.WithFields(localLogTags).Errorf("GraphQL operation %s already exists", msg.ID)
+				return
+			}
+			opCtxt, stop := context.WithCancel(connCtxt)
+			operations[msg.ID] = stop
+			lock.Unlock()
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				result := h.runGraphQLOperation(params, r, opCtxt, localLogTags, func(payload interface{}) {
+					serialized, _ := json.Marshal(payload)
+					send(graphQLWSMessage{ID: id, Type: "next", Payload: serialized})
+				})
+				lock.Lock()
+				_, running := operations[id]
+				delete(operations, id)
+				lock.Unlock()
+				stop()
+				// No completion is sent for an operation the client completed
+				if !running {
+					return
+				}
+				if len(result) > 0 {
+					serialized, _ := json.Marshal(result)
+					send(graphQLWSMessage{ID: id, Type: "error", Payload: serialized})
+				} else {
+					send(graphQLWSMessage{ID: id, Type: "complete"})
+				}
+			}(msg.ID)
+		case "complete":
+			lock.Lock()
+			if stop, ok := operations[msg.ID]; ok {
+				delete(operations, msg.ID)
+				stop()
+			}
+			lock.Unlock()
+		default:
+			log.WithFields(localLogTags).Errorf("Unknown GraphQL message type %s", msg.Type)
+			return
+		}
+	}
+}
+
+// runGraphQLOperation helper function to run a GraphQL operation of a WebSocket client,
+// passing each result to next. Returns the errors failing the operation, if any.
+func (h APIRestJetStreamDataplaneHandler) runGraphQLOperation(
+	params APIRestReqGraphQL,
+	r *http.Request,
+	ctxt context.Context,
+	localLogTags log.Fields,
+	next func(payload interface{}),
+) []GraphQLError {
+	op, err := parseGraphQL(params)
+	if err != nil {
+		return graphQLFailure(err).Errors
+	}
+	switch op.Type {
+	case "subscription":
+	case "query":
+		return graphQLFailure(fmt.Errorf("queries are served by the management API")).Errors
+	default:
+		return graphQLFailure(fmt.Errorf("%s operations are not supported", op.Type)).Errors
+	}
+
+	if len(op.Selections) != 1 || op.Selections[0].Name != "messages" {
+		return graphQLFailure(fmt.Errorf("a subscription selects the messages field alone")).Errors
+	}
+	args := op.FieldArguments(op.Selections[0], params.Variables)
+	streamName, err := graphQLStringArg(args, "stream", true)
+	if err != nil {
+		return graphQLFailure(err).Errors
+	}
+	subjectName, err := graphQLStringArg(args, "subject", false)
+	if err != nil {
+		return graphQLFailure(err).Errors
+	}
+	if subjectName != "" {
+		if subjectName, err = h.subjects.ValidateSubjectFilter(subjectName); err != nil {
+			return graphQLFailure(err).Errors
+		}
+	}
+	logTags := log.Fields{}
+	for k, v := range localLogTags {
+		logTags[k] = v
+	}
+	logTags["stream"] = streamName
+
+	tailer, err := dataplane.GetJetStreamTailer(h.natsClient, streamName, subjectName)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to read stream")
+		return graphQLFailure(fmt.Errorf("unable to read stream %s", streamName)).Errors
+	}
+	defer func() {
+		_ = tailer.Close()
+	}()
+
+	// Principals limited to metadata see no message body
+	metadataOnly := false
+	if h.tail.PayloadAccess != nil {
+		principal, _ := GetRequestPrincipal(r.Context())
+		metadataOnly =
+			h.tail.PayloadAccess.Access(principal, streamName) == dataplane.PayloadAccessMetadata
+	}
+
+	// A subscription is bounded as a tail session
+	subCtxt, cancel := context.WithTimeout(ctxt, h.tail.MaxDuration)
+	defer cancel()
+	var minInterval time.Duration
+	if h.tail.MaxRate > 0 {
+		minInterval = time.Duration(float64(time.Second) / h.tail.MaxRate)
+	}
+	var lastSent time.Time
+	for {
+		msg, err := tailer.NextMsg(subCtxt)
+		if err != nil {
+			if subCtxt.Err() != nil {
+				return nil
+			}
+			log.WithError(err).WithFields(logTags).Error("Error occurred reading from JetStream")
+			return graphQLFailure(fmt.Errorf("unable to read stream %s", streamName)).Errors
+		}
+		if minInterval > 0 && time.Since(lastSent) < minInterval {
+			continue
+		}
+		if h.redactor != nil {
+			if msg, err = h.redactor.Redact(streamName, "", msg); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to redact message")
+				continue
+			}
+		}
+		converted, err := dataplane.ConvertTailMessage(msg)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Failed to convert message")
+			continue
+		}
+		if metadataOnly {
+			converted.WithholdPayload()
+		}
+		root := common.GraphQLObject{TypeName: "Subscription", Fields: map[string]interface{}{
+			"messages": common.GraphQLFieldFunc(func(map[string]interface{}) (interface{}, error) {
+				return graphQLMessage(converted), nil
+			}),
+		}}
+		data, err := common.ExecuteGraphQL(op, root, params.Variables)
+		if err != nil {
+			return graphQLFailure(err).Errors
+		}
+		next(APIRestRespGraphQL{Data: data})
+		lastSent = time.Now()
+	}
+}
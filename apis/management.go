@@ -15,13 +15,24 @@
 package apis
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/alwitt/httpmq/archive"
 	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/alwitt/httpmq/filters"
+	"github.com/alwitt/httpmq/hooks"
 	"github.com/alwitt/httpmq/management"
+	"github.com/alwitt/httpmq/metrics"
 	"github.com/apex/log"
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
@@ -31,25 +42,106 @@ import (
 // APIRestJetStreamManagementHandler REST handler for JetStream management
 type APIRestJetStreamManagementHandler struct {
 	APIRestHandler
-	core     management.JetStreamController
-	validate *validator.Validate
+	core       management.JetStreamController
+	guardrails management.StreamRetentionGuardrails
+	consumers  management.ConsumerDefaults
+	filters    filters.Registry
+	latency    metrics.ConsumerLatencyCollector
+	events     management.TopologyEventFeed
+	sessions   dataplane.ClusterSessionRegistry
+	archives   archive.Archiver
+	replays    archive.Replayer
+	leases     dataplane.ConsumerLeaseManager
+	deliveries management.ConsumerDeliveryMonitor
+	recovery   management.ConsumerRecovery
+	// dataplaneURL is the URL of the dataplane server hypermedia responses link to
+	dataplaneURL string
+	validate     *validator.Validate
 }
 
 // GetAPIRestJetStreamManagementHandler define APIRestJetStreamManagementHandler
+//
+// Stream data retention limits requested through the APIs must be within the guardrails.
+// Consumers created through the APIs take the consumer defaults for settings not specified.
+// If filterRegistry is nil, the consumer filter APIs are disabled.
+// If latency is nil, the consumer latency API is disabled.
+// If events is nil, the topology event feed API is disabled.
+// If sessions is nil, the active session API is disabled.
+// If archives is nil, the stream archival APIs are disabled.
+// If replays is nil, the archive replay APIs are disabled.
+// If leases is nil, the consumer lease APIs are disabled.
+// If deliveries is nil, the consumer delivery event API is disabled.
+// If recovery is nil, the orphaned consumer API is disabled.
+// If dataplaneURL is not empty, hypermedia responses link to the messages of streams and
+// consumers on the dataplane server at that URL.
 func GetAPIRestJetStreamManagementHandler(
 	core management.JetStreamController,
+	guardrails management.StreamRetentionGuardrails,
+	consumerDefaults management.ConsumerDefaults,
+	subjectRules common.SubjectRules,
+	filterRegistry filters.Registry,
+	latency metrics.ConsumerLatencyCollector,
+	events management.TopologyEventFeed,
+	sessions dataplane.ClusterSessionRegistry,
+	archives archive.Archiver,
+	replays archive.Replayer,
+	leases dataplane.ConsumerLeaseManager,
+	deliveries management.ConsumerDeliveryMonitor,
+	recovery management.ConsumerRecovery,
+	dataplaneURL string,
 ) (APIRestJetStreamManagementHandler, error) {
 	logTags := log.Fields{
 		"module":    "rest",
 		"component": "jetstream-management",
 	}
+	validate := validator.New()
+	if err := validate.Struct(&guardrails); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Stream retention guardrails invalid")
+		return APIRestJetStreamManagementHandler{}, err
+	}
+	if err := validate.Struct(&consumerDefaults); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Consumer defaults invalid")
+		return APIRestJetStreamManagementHandler{}, err
+	}
+	if err := validate.Struct(&subjectRules); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Subject rules invalid")
+		return APIRestJetStreamManagementHandler{}, err
+	}
 	return APIRestJetStreamManagementHandler{
 		APIRestHandler: APIRestHandler{
 			Component: common.Component{LogTags: logTags},
-		}, core: core, validate: validator.New(),
+			subjects:  subjectRules,
+		},
+		core:         core,
+		guardrails:   guardrails,
+		consumers:    consumerDefaults,
+		filters:      filterRegistry,
+		latency:      latency,
+		events:       events,
+		sessions:     sessions,
+		archives:     archives,
+		replays:      replays,
+		leases:       leases,
+		deliveries:   deliveries,
+		recovery:     recovery,
+		dataplaneURL: dataplaneURL,
+		validate:     validate,
 	}, nil
 }
 
+// checkGuardrails helper function to verify stream limits against the retention guardrails.
+// Returns a description of the violations, or nil if there are none.
+func (h APIRestJetStreamManagementHandler) checkGuardrails(
+	limits management.JSStreamLimits,
+) *string {
+	violations := h.guardrails.Check(limits)
+	if len(violations) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("Retention limits rejected: %s", strings.Join(violations, "; "))
+	return &msg
+}
+
 // APIRestRespStreamConfig adhoc structure for persenting nats.StreamConfig
 type APIRestRespStreamConfig struct {
 	// Name is the stream name
@@ -149,6 +241,9 @@ type APIRestRespConsumerConfig struct {
 	MaxDeliver int `json:"max_deliver,omitempty"`
 	// AckWait duration (ns) to wait for an ACK for the delivery of a message
 	AckWait time.Duration `json:"ack_wait" swaggertype:"primitive,integer"`
+	// Backoff durations (ns) to wait for an ACK before each redelivery of a message, replacing
+	// AckWait. Only reported when querying for one consumer.
+	Backoff []time.Duration `json:"backoff,omitempty" swaggertype:"array,integer"`
 	// FilterSubject sets the consumer to filter for subjects matching this NATs subject string
 	//
 	// See https://docs.nats.io/running-a-nats-service/nats_admin/jetstream_admin/naming
@@ -157,6 +252,11 @@ type APIRestRespConsumerConfig struct {
 	MaxWaiting int `json:"max_waiting,omitempty"`
 	// MaxAckPending controls the max number of un-ACKed messages permitted in-flight
 	MaxAckPending int `json:"max_ack_pending,omitempty"`
+	// ReplayPolicy is whether messages are sent as fast as possible (instant), or at the
+	// rate they were published (original)
+	ReplayPolicy string `json:"replay_policy,omitempty"`
+	// SampleFrequency is the percentage of ACKs JetStream samples, if sampling
+	SampleFrequency string `json:"sample_frequency,omitempty"`
 }
 
 // APIRestRespSequenceInfo adhoc structure for persenting nats.SequenceInfo
@@ -194,6 +294,16 @@ type APIRestRespConsumerInfo struct {
 	NumWaiting int `json:"num_waiting"`
 	// NumPending is the number of message to be delivered for this consumer
 	NumPending uint64 `json:"num_pending"`
+	// PushBound is whether a client is currently subscribed to this consumer
+	PushBound bool `json:"push_bound"`
+}
+
+// replayPolicyName helper function to name a consumer replay policy
+func replayPolicyName(policy nats.ReplayPolicy) string {
+	if policy == nats.ReplayOriginalPolicy {
+		return "original"
+	}
+	return "instant"
 }
 
 // convertConsumerInfo convert *nats.ConsumerInfo into APIRestRespConsumerInfo
@@ -203,14 +313,16 @@ func convertConsumerInfo(original *nats.ConsumerInfo) APIRestRespConsumerInfo {
 		Name:    original.Name,
 		Created: original.Created,
 		Config: APIRestRespConsumerConfig{
-			Description:    original.Config.Description,
-			DeliverSubject: original.Config.DeliverSubject,
-			DeliverGroup:   original.Config.DeliverGroup,
-			MaxDeliver:     original.Config.MaxDeliver,
-			AckWait:        original.Config.AckWait,
-			FilterSubject:  original.Config.FilterSubject,
-			MaxWaiting:     original.Config.MaxWaiting,
-			MaxAckPending:  original.Config.MaxAckPending,
+			Description:     common.GatewayConsumerNotes(original.Config.Description),
+			DeliverSubject:  original.Config.DeliverSubject,
+			DeliverGroup:    original.Config.DeliverGroup,
+			MaxDeliver:      original.Config.MaxDeliver,
+			AckWait:         original.Config.AckWait,
+			FilterSubject:   original.Config.FilterSubject,
+			MaxWaiting:      original.Config.MaxWaiting,
+			MaxAckPending:   original.Config.MaxAckPending,
+			ReplayPolicy:    replayPolicyName(original.Config.ReplayPolicy),
+			SampleFrequency: original.Config.SampleFrequency,
 		},
 		Delivered: APIRestRespSequenceInfo{
 			Consumer: original.Delivered.Consumer,
@@ -226,7 +338,173 @@ func convertConsumerInfo(original *nats.ConsumerInfo) APIRestRespConsumerInfo {
 		NumRedelivered: original.NumRedelivered,
 		NumWaiting:     original.NumWaiting,
 		NumPending:     original.NumPending,
+		PushBound:      original.PushBound,
+	}
+}
+
+// =======================================================================
+// Hypermedia
+
+// HALMediaType is the media type of hypermedia responses, which clients request with the
+// Accept header
+const HALMediaType = "application/hal+json"
+
+// HALLink is a link to a related resource
+type HALLink struct {
+	// Href is the URL of the resource
+	Href string `json:"href"`
+}
+
+// HALLinks are the links of a resource, by relation
+type HALLinks map[string]HALLink
+
+// APIRestHALStream a stream, with links to its related resources
+type APIRestHALStream struct {
+	APIRestRespStreamInfo
+	Links HALLinks `json:"_links"`
+}
+
+// APIRestHALConsumer a consumer, with links to its related resources
+type APIRestHALConsumer struct {
+	APIRestRespConsumerInfo
+	Links HALLinks `json:"_links"`
+}
+
+// APIRestHALRespOneJetStream hypermedia response for listing one stream
+type APIRestHALRespOneJetStream struct {
+	StandardResponse
+	APIRestHALStream
+}
+
+// APIRestHALRespOneJetStreamConsumer hypermedia response for listing one consumer
+type APIRestHALRespOneJetStreamConsumer struct {
+	StandardResponse
+	APIRestHALConsumer
+}
+
+// APIRestHALRespAllJetStreams hypermedia response for listing all streams
+type APIRestHALRespAllJetStreams struct {
+	StandardResponse
+	Links    HALLinks `json:"_links"`
+	Embedded struct {
+		Streams []APIRestHALStream `json:"streams"`
+	} `json:"_embedded"`
+}
+
+// APIRestHALRespAllJetStreamConsumers hypermedia response for listing all consumers of a
+// stream
+type APIRestHALRespAllJetStreamConsumers struct {
+	StandardResponse
+	Links    HALLinks `json:"_links"`
+	Embedded struct {
+		Consumers []APIRestHALConsumer `json:"consumers"`
+	} `json:"_embedded"`
+}
+
+// wantsHAL whether the client requested a hypermedia response
+func wantsHAL(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err == nil && mediaType == HALMediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// halLinker the paths the links of a request's resources are built from
+type halLinker struct {
+	// admin is the path of the management APIs of the request's API version
+	admin string
+	// data is the URL of the data APIs of the same API version, if known
+	data string
+}
+
+// halLinkerFor helper function to define the halLinker of a request on a stream resource
+func (h APIRestJetStreamManagementHandler) halLinkerFor(r *http.Request) halLinker {
+	// Stream and consumer names can not contain "/"
+	admin := r.URL.Path[:strings.LastIndex(r.URL.Path, "/admin/stream")+len("/admin")]
+	linker := halLinker{admin: admin}
+	if h.dataplaneURL != "" {
+		version := path.Base(strings.TrimSuffix(admin, "/admin"))
+		linker.data = strings.TrimRight(h.dataplaneURL, "/") + "/" + version + "/data"
+	}
+	return linker
+}
+
+// halStreamLinks the links of a stream
+func (h APIRestJetStreamManagementHandler) halStreamLinks(l halLinker, stream string) HALLinks {
+	self := fmt.Sprintf("%s/stream/%s", l.admin, url.PathEscape(stream))
+	links := HALLinks{
+		"self":        {Href: self},
+		"collection":  {Href: l.admin + "/stream"},
+		"consumers":   {Href: self + "/consumer"},
+		"utilization": {Href: self + "/utilization"},
+	}
+	if h.latency != nil {
+		links["latency"] = HALLink{Href: self + "/latency"}
+	}
+	if l.data != "" {
+		links["messages"] = HALLink{
+			Href: fmt.Sprintf("%s/stream/%s/tail", l.data, url.PathEscape(stream)),
+		}
+		links["export"] = HALLink{
+			Href: fmt.Sprintf("%s/stream/%s/export", l.data, url.PathEscape(stream)),
+		}
+	}
+	return links
+}
+
+// halConsumerLinks the links of a consumer
+func (h APIRestJetStreamManagementHandler) halConsumerLinks(
+	l halLinker, stream, consumer string,
+) HALLinks {
+	streamPath := fmt.Sprintf("%s/stream/%s", l.admin, url.PathEscape(stream))
+	self := fmt.Sprintf("%s/consumer/%s", streamPath, url.PathEscape(consumer))
+	links := HALLinks{
+		"self":       {Href: self},
+		"collection": {Href: streamPath + "/consumer"},
+		"stream":     {Href: streamPath},
+	}
+	if h.filters != nil {
+		links["filter"] = HALLink{Href: self + "/filter"}
+	}
+	if h.leases != nil {
+		links["lease"] = HALLink{Href: self + "/lease"}
+	}
+	if h.deliveries != nil {
+		links["events"] = HALLink{Href: self + "/events"}
+	}
+	if h.latency != nil {
+		links["latency"] = HALLink{Href: streamPath + "/latency"}
 	}
+	if l.data != "" {
+		links["messages"] = HALLink{
+			Href: fmt.Sprintf(
+				"%s/stream/%s/consumer/%s", l.data, url.PathEscape(stream), url.PathEscape(consumer),
+			),
+		}
+	}
+	return links
+}
+
+// replyNegotiated helper function to write a response in the format the client requested.
+// hal defines the hypermedia response, for clients requesting one.
+func (h APIRestJetStreamManagementHandler) replyNegotiated(
+	w http.ResponseWriter,
+	resp interface{},
+	hal func(halLinker) interface{},
+	restCall string,
+	r *http.Request,
+) {
+	w.Header().Add("Vary", "Accept")
+	if wantsHAL(r) {
+		w.Header().Set("content-type", HALMediaType)
+		resp = hal(h.halLinkerFor(r))
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
 }
 
 // =======================================================================
@@ -243,9 +521,10 @@ func convertConsumerInfo(original *nats.ConsumerInfo) APIRestRespConsumerInfo {
 // @Param setting body management.JSStreamParam true "JetStream stream setting"
 // @Success 200 {object} StandardResponse "success"
 // @Failure 400 {object} StandardResponse "error"
+// @Failure 403 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
-// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Header 200,400,403,500 {string} Httpmq-Request-ID "Request ID to match against logs"
 // @Router /v1/admin/stream [post]
 func (h APIRestJetStreamManagementHandler) CreateStream(w http.ResponseWriter, r *http.Request) {
 	restCall := "POST /v1/admin/stream"
@@ -266,21 +545,36 @@ func (h APIRestJetStreamManagementHandler) CreateStream(w http.ResponseWriter, r
 
 	// Parse the parameters
 	var params management.JSStreamParam
-	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
 		msg := "Unable to parse request body"
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
 
+	for idx, subject := range params.Subjects {
+		var ok bool
+		if params.Subjects[idx], ok = h.checkSubject(w, r, restCall, subject, true); !ok {
+			return
+		}
+	}
+
+	h.guardrails.ApplyDefaults(&params.JSStreamLimits)
+	if msg := h.checkGuardrails(params.JSStreamLimits); msg != nil {
+		log.WithFields(localLogTags).Error(*msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, msg), restCall, r)
+		return
+	}
+
 	if err := h.core.CreateStream(params, r.Context()); err != nil {
+		respCode := http.StatusInternalServerError
 		msg := "Failed to create new stream"
+		if errors.Is(err, hooks.ErrRejected) {
+			respCode = http.StatusForbidden
+			msg = fmt.Sprintf("Stream rejected: %s", err)
+		}
 		log.WithError(err).WithFields(localLogTags).Error(msg)
-		h.reply(
-			w, http.StatusInternalServerError, getStdRESTErrorMsg(
-				http.StatusInternalServerError, &msg,
-			), restCall, r,
-		)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
 		return
 	}
 
@@ -306,8 +600,10 @@ type APIRestRespAllJetStreams struct {
 // GetAllStreams godoc
 // @Summary Query for info on all streams
 // @Description Query for the details of all streams
+// @Description With Accept: application/hal+json, the response is a APIRestHALRespAllJetStreams, linking
+// @Description to the related resources.
 // @tags Management,get,stream
-// @Produce json
+// @Produce json,application/hal+json
 // @Param setting body management.JSStreamParam true "JetStream stream setting"
 // @Success 200 {object} APIRestRespAllJetStreams "success"
 // @Failure 400 {object} StandardResponse "error"
@@ -326,8 +622,27 @@ func (h APIRestJetStreamManagementHandler) GetAllStreams(w http.ResponseWriter,
 	resp := APIRestRespAllJetStreams{
 		StandardResponse: StandardResponse{Success: true}, Streams: convertedInfo,
 	}
+	hal := func(l halLinker) interface{} {
+		halResp := APIRestHALRespAllJetStreams{
+			StandardResponse: resp.StandardResponse,
+			Links:            HALLinks{"self": {Href: l.admin + "/stream"}},
+		}
+		streamNames := make([]string, 0, len(convertedInfo))
+		for streamName := range convertedInfo {
+			streamNames = append(streamNames, streamName)
+		}
+		sort.Strings(streamNames)
+		halResp.Embedded.Streams = []APIRestHALStream{}
+		for _, streamName := range streamNames {
+			halResp.Embedded.Streams = append(halResp.Embedded.Streams, APIRestHALStream{
+				APIRestRespStreamInfo: convertedInfo[streamName],
+				Links:                 h.halStreamLinks(l, streamName),
+			})
+		}
+		return halResp
+	}
 
-	h.reply(w, http.StatusOK, resp, restCall, r)
+	h.replyNegotiated(w, resp, hal, restCall, r)
 }
 
 // GetAllStreamsHandler Wrapper around GetAllStreams
@@ -349,8 +664,10 @@ type APIRestRespOneJetStream struct {
 // GetStream godoc
 // @Summary Query for info on one stream
 // @Description Query for the details of one stream
+// @Description With Accept: application/hal+json, the response is a APIRestHALRespOneJetStream, linking
+// @Description to the related resources.
 // @tags Management,get,stream
-// @Produce json
+// @Produce json,application/hal+json
 // @Param streamName path string true "JetStream stream name"
 // @Success 200 {object} APIRestRespOneJetStream "success"
 // @Failure 400 {object} StandardResponse "error"
@@ -399,8 +716,16 @@ func (h APIRestJetStreamManagementHandler) GetStream(w http.ResponseWriter, r *h
 		StandardResponse: StandardResponse{Success: true},
 		Stream:           convertStreamInfo(streamInfo),
 	}
+	hal := func(l halLinker) interface{} {
+		return APIRestHALRespOneJetStream{
+			StandardResponse: resp.StandardResponse,
+			APIRestHALStream: APIRestHALStream{
+				APIRestRespStreamInfo: resp.Stream, Links: h.halStreamLinks(l, streamName),
+			},
+		}
+	}
 
-	h.reply(w, http.StatusOK, resp, restCall, r)
+	h.replyNegotiated(w, resp, hal, restCall, r)
 }
 
 // GetStreamHandler Wrapper around GetStream
@@ -412,6 +737,81 @@ func (h APIRestJetStreamManagementHandler) GetStreamHandler() http.HandlerFunc {
 
 // -----------------------------------------------------------------------
 
+// APIRestRespStreamUtilization response for querying the storage utilization of one stream
+type APIRestRespStreamUtilization struct {
+	StandardResponse
+	// Utilization the storage utilization of the stream relative to its limits
+	Utilization management.StreamUtilization `json:"utilization,omitempty"`
+}
+
+// GetStreamUtilization godoc
+// @Summary Query for storage utilization of one stream
+// @Description Query for the message count and message bytes of one stream relative to its limits
+// @tags Management,get,stream
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Success 200 {object} APIRestRespStreamUtilization "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/utilization [get]
+func (h APIRestJetStreamManagementHandler) GetStreamUtilization(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/stream/{streamName}/utilization"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	streamInfo, err := h.core.GetStream(streamName, r.Context())
+	if err != nil {
+		msg := fmt.Sprintf("Unable fetch stream %s info", streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	resp := APIRestRespStreamUtilization{
+		StandardResponse: StandardResponse{Success: true},
+		Utilization:      management.GetStreamUtilization(streamInfo),
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetStreamUtilizationHandler Wrapper around GetStreamUtilization
+func (h APIRestJetStreamManagementHandler) GetStreamUtilizationHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetStreamUtilization(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
 // APIRestReqStreamSubjects subject change parameters
 type APIRestReqStreamSubjects struct {
 	// Subjects the list of new subject this stream will listen to
@@ -461,7 +861,7 @@ func (h APIRestJetStreamManagementHandler) ChangeStreamSubjects(
 	}
 
 	var subjects APIRestReqStreamSubjects
-	if err := json.NewDecoder(r.Body).Decode(&subjects); err != nil {
+	if err := common.JSON().NewDecoder(r.Body).Decode(&subjects); err != nil {
 		msg := "Unable to parse request body"
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
@@ -475,6 +875,12 @@ func (h APIRestJetStreamManagementHandler) ChangeStreamSubjects(
 		return
 	}
 
+	for idx, subject := range subjects.Subjects {
+		if subjects.Subjects[idx], ok = h.checkSubject(w, r, restCall, subject, true); !ok {
+			return
+		}
+	}
+
 	if err := h.core.ChangeStreamSubjects(streamName, subjects.Subjects, r.Context()); err != nil {
 		msg := fmt.Sprintf("Failed to change stream %s subjects", streamName)
 		log.WithError(err).WithFields(localLogTags).Error(msg)
@@ -541,13 +947,19 @@ func (h APIRestJetStreamManagementHandler) UpdateStreamLimits(
 	}
 
 	var limits management.JSStreamLimits
-	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+	if err := common.JSON().NewDecoder(r.Body).Decode(&limits); err != nil {
 		msg := "Unable to parse request body"
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
 
+	if msg := h.checkGuardrails(limits); msg != nil {
+		log.WithFields(localLogTags).Error(*msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, msg), restCall, r)
+		return
+	}
+
 	if err := h.core.UpdateStreamLimits(streamName, limits, r.Context()); err != nil {
 		msg := fmt.Sprintf("Failed to change stream %s limits", streamName)
 		log.WithError(err).WithFields(localLogTags).Error(msg)
@@ -571,20 +983,25 @@ func (h APIRestJetStreamManagementHandler) UpdateStreamLimitsHandler() http.Hand
 
 // -----------------------------------------------------------------------
 
-// DeleteStream godoc
-// @Summary Delete a stream
-// @Description Delete a stream
-// @tags Management,delete,stream
+// UpdateStreamRetention godoc
+// @Summary Change retention of a stream
+// @Description Change the max age, max bytes, and max messages retention limits of a stream.
+// @Description The new limits must be within the operator defined guardrails.
+// @tags Management,put,stream
+// @Accept json
 // @Produce json
 // @Param streamName path string true "JetStream stream name"
+// @Param retention body management.JSStreamRetention true "New stream retention limits"
 // @Success 200 {object} StandardResponse "success"
 // @Failure 400 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
 // @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
-// @Router /v1/admin/stream/{streamName} [delete]
-func (h APIRestJetStreamManagementHandler) DeleteStream(w http.ResponseWriter, r *http.Request) {
-	restCall := "DELETE /v1/admin/stream/{streamName}"
+// @Router /v1/admin/stream/{streamName}/retention [put]
+func (h APIRestJetStreamManagementHandler) UpdateStreamRetention(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "PUT /v1/admin/stream/{streamName}/retention"
 
 	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
 	if err != nil {
@@ -609,8 +1026,29 @@ func (h APIRestJetStreamManagementHandler) DeleteStream(w http.ResponseWriter, r
 		return
 	}
 
-	if err := h.core.DeleteStream(streamName, r.Context()); err != nil {
-		msg := fmt.Sprintf("Failed to delete stream %s", streamName)
+	var retention management.JSStreamRetention
+	if err := common.JSON().NewDecoder(r.Body).Decode(&retention); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	limits := retention.StreamLimits()
+	if limits.MaxMsgs == nil && limits.MaxBytes == nil && limits.MaxAge == nil {
+		msg := "No retention limits provided"
+		log.WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	if msg := h.checkGuardrails(limits); msg != nil {
+		log.WithFields(localLogTags).Error(*msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, msg), restCall, r)
+		return
+	}
+
+	if err := h.core.UpdateStreamLimits(streamName, limits, r.Context()); err != nil {
+		msg := fmt.Sprintf("Failed to change stream %s retention", streamName)
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(
 			w, http.StatusInternalServerError, getStdRESTErrorMsg(
@@ -623,34 +1061,39 @@ func (h APIRestJetStreamManagementHandler) DeleteStream(w http.ResponseWriter, r
 	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
 }
 
-// DeleteStreamHandler Wrapper around DeleteStream
-func (h APIRestJetStreamManagementHandler) DeleteStreamHandler() http.HandlerFunc {
+// UpdateStreamRetentionHandler Wrapper around UpdateStreamRetention
+func (h APIRestJetStreamManagementHandler) UpdateStreamRetentionHandler() http.HandlerFunc {
 	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
-		h.DeleteStream(w, r)
+		h.UpdateStreamRetention(w, r)
 	})
 }
 
-// =======================================================================
-// Consumer related management
-
 // -----------------------------------------------------------------------
 
-// CreateConsumer godoc
-// @Summary Create a consumer on a stream
-// @Description Create a new consumer on a stream. The stream must already be defined.
-// @tags Management,post,consumer
+// APIRestRespStreamCompaction response for compacting a stream
+type APIRestRespStreamCompaction struct {
+	StandardResponse
+	// Compaction the outcome of the compaction
+	Compaction management.StreamCompactionResult `json:"compaction,omitempty"`
+}
+
+// CompactStream godoc
+// @Summary Compact a stream
+// @Description Remove the superseded messages of each subject of a stream, keeping only the latest `keep` messages of each subject.
+// @Description Intended for streams used as change-logs. The stream is read in full, so this can take a while for a large stream.
+// @tags Management,post,stream
 // @Accept json
 // @Produce json
 // @Param streamName path string true "JetStream stream name"
-// @Param consumerParam body management.JetStreamConsumerParam true "Consumer parameters"
-// @Success 200 {object} StandardResponse "success"
+// @Param compaction body management.JSStreamCompactionParam true "Stream compaction parameters"
+// @Success 200 {object} APIRestRespStreamCompaction "success"
 // @Failure 400 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
 // @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
-// @Router /v1/admin/stream/{streamName}/consumer [post]
-func (h APIRestJetStreamManagementHandler) CreateConsumer(w http.ResponseWriter, r *http.Request) {
-	restCall := "POST /v1/admin/stream/{streamName}/consumer"
+// @Router /v1/admin/stream/{streamName}/compact [post]
+func (h APIRestJetStreamManagementHandler) CompactStream(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/admin/stream/{streamName}/compact"
 
 	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
 	if err != nil {
@@ -675,16 +1118,23 @@ func (h APIRestJetStreamManagementHandler) CreateConsumer(w http.ResponseWriter,
 		return
 	}
 
-	var params management.JetStreamConsumerParam
-	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+	var param management.JSStreamCompactionParam
+	if err := common.JSON().NewDecoder(r.Body).Decode(&param); err != nil {
 		msg := "Unable to parse request body"
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
+	if err := h.validate.Struct(&param); err != nil {
+		msg := "Invalid compaction parameters"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
 
-	if err := h.core.CreateConsumerForStream(streamName, params, r.Context()); err != nil {
-		msg := fmt.Sprintf("Failed to create consumer on stream %s", streamName)
+	result, err := h.core.CompactStream(streamName, param, r.Context())
+	if err != nil {
+		msg := fmt.Sprintf("Failed to compact stream %s", streamName)
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(
 			w, http.StatusInternalServerError, getStdRESTErrorMsg(
@@ -693,42 +1143,51 @@ func (h APIRestJetStreamManagementHandler) CreateConsumer(w http.ResponseWriter,
 		)
 		return
 	}
+	resp := APIRestRespStreamCompaction{
+		StandardResponse: StandardResponse{Success: true},
+		Compaction:       result,
+	}
 
-	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+	h.reply(w, http.StatusOK, resp, restCall, r)
 }
 
-// CreateConsumerHandler Wrapper around CreateConsumer
-func (h APIRestJetStreamManagementHandler) CreateConsumerHandler() http.HandlerFunc {
+// CompactStreamHandler Wrapper around CompactStream
+func (h APIRestJetStreamManagementHandler) CompactStreamHandler() http.HandlerFunc {
 	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
-		h.CreateConsumer(w, r)
+		h.CompactStream(w, r)
 	})
 }
 
 // -----------------------------------------------------------------------
 
-// APIRestRespAllJetStreamConsumers response for listing all consumers
-type APIRestRespAllJetStreamConsumers struct {
+// APIRestRespStreamPurgePreview response for previewing a stream purge
+type APIRestRespStreamPurgePreview struct {
 	StandardResponse
-	// Consumers the set of consumer details mapped against consumer name
-	Consumers map[string]APIRestRespConsumerInfo `json:"consumers,omitempty"`
+	// Preview how much of the stream the purge would remove
+	Preview management.StreamPurgePreview `json:"preview,omitempty"`
 }
 
-// GetAllConsumers godoc
-// @Summary Get all consumers of a stream
-// @Description Query for the details of all consumers of a stream
-// @tags Management,get,consumer
+// PreviewStreamPurge godoc
+// @Summary Preview a stream purge
+// @Description Report how many messages, and bytes, of a stream a purge of the selected messages would remove, without removing them.
+// @Description Messages are selected by subject filter and / or sequence range. JetStream only tracks the size of the whole stream, so the bytes of a selection are estimated from the average message size.
+// @Description A sequence range is read in full if the stream has deleted messages, or a subject filter is given.
+// @tags Management,get,stream
 // @Produce json
 // @Param streamName path string true "JetStream stream name"
-// @Success 200 {object} APIRestRespAllJetStreamConsumers "success"
+// @Param subject query string false "Only count messages of subjects matching this subject filter"
+// @Param from_seq query integer false "First sequence number of the range (DEFAULT: first message)"
+// @Param to_seq query integer false "Last sequence number of the range (DEFAULT: last message)"
+// @Success 200 {object} APIRestRespStreamPurgePreview "success"
 // @Failure 400 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
 // @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
-// @Router /v1/admin/stream/{streamName}/consumer [get]
-func (h APIRestJetStreamManagementHandler) GetAllConsumers(
+// @Router /v1/admin/stream/{streamName}/purge/preview [get]
+func (h APIRestJetStreamManagementHandler) PreviewStreamPurge(
 	w http.ResponseWriter, r *http.Request,
 ) {
-	restCall := "GET /v1/admin/stream/{streamName}/consumer"
+	restCall := "GET /v1/admin/stream/{streamName}/purge/preview"
 
 	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
 	if err != nil {
@@ -753,49 +1212,71 @@ func (h APIRestJetStreamManagementHandler) GetAllConsumers(
 		return
 	}
 
-	consumers := h.core.GetAllConsumersForStream(streamName, r.Context())
-	converted := make(map[string]APIRestRespConsumerInfo)
-	for consumerName, consumerInfo := range consumers {
-		converted[consumerName] = convertConsumerInfo(consumerInfo)
+	query := r.URL.Query()
+	param := management.JSStreamPurgePreviewParam{Subject: query.Get("subject")}
+	for name, target := range map[string]*uint64{
+		"from_seq": &param.FromSeq, "to_seq": &param.ToSeq,
+	} {
+		if value := query.Get(name); value != "" {
+			if *target, err = strconv.ParseUint(value, 10, 64); err != nil {
+				msg := fmt.Sprintf("Unable to parse %s", name)
+				log.WithError(err).WithFields(localLogTags).Error(msg)
+				h.reply(
+					w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+				)
+				return
+			}
+		}
 	}
-	resp := APIRestRespAllJetStreamConsumers{
+	if err := h.validate.Struct(&param); err != nil {
+		msg := "Invalid purge preview parameters"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	preview, err := h.core.PreviewStreamPurge(streamName, param, r.Context())
+	if err != nil {
+		msg := fmt.Sprintf("Failed to preview purge of stream %s", streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	resp := APIRestRespStreamPurgePreview{
 		StandardResponse: StandardResponse{Success: true},
-		Consumers:        converted,
+		Preview:          preview,
 	}
+
 	h.reply(w, http.StatusOK, resp, restCall, r)
 }
 
-// GetAllConsumersHandler Wrapper around GetAllConsumers
-func (h APIRestJetStreamManagementHandler) GetAllConsumersHandler() http.HandlerFunc {
+// PreviewStreamPurgeHandler Wrapper around PreviewStreamPurge
+func (h APIRestJetStreamManagementHandler) PreviewStreamPurgeHandler() http.HandlerFunc {
 	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
-		h.GetAllConsumers(w, r)
+		h.PreviewStreamPurge(w, r)
 	})
 }
 
 // -----------------------------------------------------------------------
 
-// APIRestRespOneJetStreamConsumer response for listing one consumer
-type APIRestRespOneJetStreamConsumer struct {
-	StandardResponse
-	// Consumer the details regarding this consumer
-	Consumer APIRestRespConsumerInfo `json:"consumer,omitempty"`
-}
-
-// GetConsumer godoc
-// @Summary Get one consumer of a stream
-// @Description Query for the details of a consumer on a stream
-// @tags Management,get,consumer
+// DeleteStream godoc
+// @Summary Delete a stream
+// @Description Delete a stream
+// @tags Management,delete,stream
 // @Produce json
 // @Param streamName path string true "JetStream stream name"
-// @Param consumerName path string true "JetStream consumer name"
-// @Success 200 {object} APIRestRespOneJetStreamConsumer "success"
+// @Success 200 {object} StandardResponse "success"
 // @Failure 400 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
 // @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
-// @Router /v1/admin/stream/{streamName}/consumer/{consumerName} [get]
-func (h APIRestJetStreamManagementHandler) GetConsumer(w http.ResponseWriter, r *http.Request) {
-	restCall := "GET /v1/admin/stream/{streamName}/consumer/{consumerName}"
+// @Router /v1/admin/stream/{streamName} [delete]
+func (h APIRestJetStreamManagementHandler) DeleteStream(w http.ResponseWriter, r *http.Request) {
+	restCall := "DELETE /v1/admin/stream/{streamName}"
 
 	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
 	if err != nil {
@@ -819,17 +1300,116 @@ func (h APIRestJetStreamManagementHandler) GetConsumer(w http.ResponseWriter, r
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
-	consumerName, ok := vars["consumerName"]
+
+	if err := h.core.DeleteStream(streamName, r.Context()); err != nil {
+		msg := fmt.Sprintf("Failed to delete stream %s", streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
+
+// DeleteStreamHandler Wrapper around DeleteStream
+func (h APIRestJetStreamManagementHandler) DeleteStreamHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.DeleteStream(w, r)
+	})
+}
+
+// =======================================================================
+// Consumer related management
+
+// -----------------------------------------------------------------------
+
+// APIRestRespCreateConsumer response for creating a consumer
+type APIRestRespCreateConsumer struct {
+	StandardResponse
+	// Consumer the details of the new consumer, with its effective config
+	Consumer *APIRestRespConsumerInfo `json:"consumer,omitempty"`
+}
+
+// CreateConsumer godoc
+// @Summary Create a consumer on a stream
+// @Description Create a new consumer on a stream. The stream must already be defined.
+// @Description Settings not specified take the server defaults, if any; the response carries
+// @Description the effective config of the new consumer.
+// @tags Management,post,consumer
+// @Accept json
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerParam body management.JetStreamConsumerParam true "Consumer parameters"
+// @Success 200 {object} APIRestRespCreateConsumer "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer [post]
+func (h APIRestJetStreamManagementHandler) CreateConsumer(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/admin/stream/{streamName}/consumer"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
 	if !ok {
-		msg := "No consumer name provided"
+		msg := "No stream name provided"
 		log.WithFields(localLogTags).Errorf(msg)
 		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
 		return
 	}
 
-	info, err := h.core.GetConsumerForStream(streamName, consumerName, r.Context())
-	if err != nil {
-		msg := fmt.Sprintf("Failed to read consumer %s on stream %s", consumerName, streamName)
+	var params management.JetStreamConsumerParam
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	if params.FilterSubject != nil {
+		filter, ok := h.checkSubject(w, r, restCall, *params.FilterSubject, true)
+		if !ok {
+			return
+		}
+		params.FilterSubject = &filter
+	}
+
+	h.consumers.ApplyDefaults(&params)
+	if err := h.validate.Struct(&params); err != nil {
+		msg := fmt.Sprintf("Consumer parameters invalid after applying defaults: %s", err)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if params.SampleFrequency != nil {
+		if err := management.ValidateConsumerSampleFrequency(*params.SampleFrequency); err != nil {
+			msg := err.Error()
+			log.WithError(err).WithFields(localLogTags).Error(msg)
+			h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+			return
+		}
+	}
+
+	if err := h.core.CreateConsumerForStream(streamName, params, r.Context()); err != nil {
+		msg := fmt.Sprintf("Failed to create consumer on stream %s", streamName)
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(
 			w, http.StatusInternalServerError, getStdRESTErrorMsg(
@@ -839,37 +1419,48 @@ func (h APIRestJetStreamManagementHandler) GetConsumer(w http.ResponseWriter, r
 		return
 	}
 
-	resp := APIRestRespOneJetStreamConsumer{
-		StandardResponse: StandardResponse{Success: true},
-		Consumer:         convertConsumerInfo(info),
+	resp := APIRestRespCreateConsumer{StandardResponse: getStdRESTSuccessMsg()}
+	// The consumer is defined; failing to read it back does not fail the request
+	info, err := h.core.GetConsumerForStream(streamName, params.Name, r.Context())
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to read back consumer %s of stream %s", params.Name, streamName,
+		)
+	} else {
+		converted := convertConsumerInfo(info)
+		converted.Config.Backoff = params.Backoff
+		resp.Consumer = &converted
 	}
 	h.reply(w, http.StatusOK, resp, restCall, r)
 }
 
-// GetConsumerHandler Wrapper around GetConsumer
-func (h APIRestJetStreamManagementHandler) GetConsumerHandler() http.HandlerFunc {
+// CreateConsumerHandler Wrapper around CreateConsumer
+func (h APIRestJetStreamManagementHandler) CreateConsumerHandler() http.HandlerFunc {
 	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
-		h.GetConsumer(w, r)
+		h.CreateConsumer(w, r)
 	})
 }
 
 // -----------------------------------------------------------------------
 
-// DeleteConsumer godoc
-// @Summary Delete one consumer of a stream
-// @Description Delete one consumer of a stream
-// @tags Management,delete,consumer
+// CloneConsumer godoc
+// @Summary Clone a consumer on a stream
+// @Description Create a new consumer on a stream with the configuration of an existing consumer.
+// @Description The new consumer can optionally start after the existing consumer's ACK floor.
+// @tags Management,post,consumer
+// @Accept json
 // @Produce json
 // @Param streamName path string true "JetStream stream name"
-// @Param consumerName path string true "JetStream consumer name"
+// @Param consumerName path string true "Source JetStream consumer name"
+// @Param cloneParam body management.JetStreamConsumerCloneParam true "Clone parameters"
 // @Success 200 {object} StandardResponse "success"
 // @Failure 400 {object} StandardResponse "error"
 // @Failure 404 {string} string "error"
 // @Failure 500 {object} StandardResponse "error"
 // @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
-// @Router /v1/admin/stream/{streamName}/consumer/{consumerName} [delete]
-func (h APIRestJetStreamManagementHandler) DeleteConsumer(w http.ResponseWriter, r *http.Request) {
-	restCall := "DELETE /v1/admin/stream/{streamName}/consumer/{consumerName}"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/clone [post]
+func (h APIRestJetStreamManagementHandler) CloneConsumer(w http.ResponseWriter, r *http.Request) {
+	restCall := "POST /v1/admin/stream/{streamName}/consumer/{consumerName}/clone"
 
 	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
 	if err != nil {
@@ -901,8 +1492,24 @@ func (h APIRestJetStreamManagementHandler) DeleteConsumer(w http.ResponseWriter,
 		return
 	}
 
-	if err := h.core.DeleteConsumerOnStream(streamName, consumerName, r.Context()); err != nil {
-		msg := fmt.Sprintf("Failed to delete consumer %s on stream %s", consumerName, streamName)
+	var params management.JetStreamConsumerCloneParam
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if err := h.validate.Struct(&params); err != nil {
+		msg := "Invalid clone parameters"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	if err := h.core.CloneConsumerForStream(
+		streamName, consumerName, params, r.Context(),
+	); err != nil {
+		msg := fmt.Sprintf("Failed to clone consumer %s on stream %s", consumerName, streamName)
 		log.WithError(err).WithFields(localLogTags).Error(msg)
 		h.reply(
 			w, http.StatusInternalServerError, getStdRESTErrorMsg(
@@ -915,15 +1522,2336 @@ func (h APIRestJetStreamManagementHandler) DeleteConsumer(w http.ResponseWriter,
 	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
 }
 
-// DeleteConsumerHandler Wrapper around DeleteConsumer
-func (h APIRestJetStreamManagementHandler) DeleteConsumerHandler() http.HandlerFunc {
+// CloneConsumerHandler Wrapper around CloneConsumer
+func (h APIRestJetStreamManagementHandler) CloneConsumerHandler() http.HandlerFunc {
 	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
-		h.DeleteConsumer(w, r)
+		h.CloneConsumer(w, r)
 	})
 }
 
-// =======================================================================
-// Health Checks
+// -----------------------------------------------------------------------
+
+// APIRestRespAllJetStreamConsumers response for listing all consumers
+type APIRestRespAllJetStreamConsumers struct {
+	StandardResponse
+	// Consumers the set of consumer details mapped against consumer name
+	Consumers map[string]APIRestRespConsumerInfo `json:"consumers,omitempty"`
+}
+
+// GetAllConsumers godoc
+// @Summary Get all consumers of a stream
+// @Description Query for the details of all consumers of a stream
+// @Description With Accept: application/hal+json, the response is a APIRestHALRespAllJetStreamConsumers, linking
+// @Description to the related resources.
+// @tags Management,get,consumer
+// @Produce json,application/hal+json
+// @Param streamName path string true "JetStream stream name"
+// @Success 200 {object} APIRestRespAllJetStreamConsumers "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer [get]
+func (h APIRestJetStreamManagementHandler) GetAllConsumers(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/stream/{streamName}/consumer"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	consumers := h.core.GetAllConsumersForStream(streamName, r.Context())
+	converted := make(map[string]APIRestRespConsumerInfo)
+	for consumerName, consumerInfo := range consumers {
+		converted[consumerName] = convertConsumerInfo(consumerInfo)
+	}
+	resp := APIRestRespAllJetStreamConsumers{
+		StandardResponse: StandardResponse{Success: true},
+		Consumers:        converted,
+	}
+	hal := func(l halLinker) interface{} {
+		halResp := APIRestHALRespAllJetStreamConsumers{
+			StandardResponse: resp.StandardResponse,
+			Links: HALLinks{
+				"self":   {Href: h.halStreamLinks(l, streamName)["consumers"].Href},
+				"stream": {Href: h.halStreamLinks(l, streamName)["self"].Href},
+			},
+		}
+		consumerNames := make([]string, 0, len(converted))
+		for consumerName := range converted {
+			consumerNames = append(consumerNames, consumerName)
+		}
+		sort.Strings(consumerNames)
+		halResp.Embedded.Consumers = []APIRestHALConsumer{}
+		for _, consumerName := range consumerNames {
+			halResp.Embedded.Consumers = append(halResp.Embedded.Consumers, APIRestHALConsumer{
+				APIRestRespConsumerInfo: converted[consumerName],
+				Links:                   h.halConsumerLinks(l, streamName, consumerName),
+			})
+		}
+		return halResp
+	}
+	h.replyNegotiated(w, resp, hal, restCall, r)
+}
+
+// GetAllConsumersHandler Wrapper around GetAllConsumers
+func (h APIRestJetStreamManagementHandler) GetAllConsumersHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetAllConsumers(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespOneJetStreamConsumer response for listing one consumer
+type APIRestRespOneJetStreamConsumer struct {
+	StandardResponse
+	// Consumer the details regarding this consumer
+	Consumer APIRestRespConsumerInfo `json:"consumer,omitempty"`
+}
+
+// GetConsumer godoc
+// @Summary Get one consumer of a stream
+// @Description Query for the details of a consumer on a stream
+// @Description With Accept: application/hal+json, the response is a APIRestHALRespOneJetStreamConsumer, linking
+// @Description to the related resources.
+// @tags Management,get,consumer
+// @Produce json,application/hal+json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} APIRestRespOneJetStreamConsumer "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName} [get]
+func (h APIRestJetStreamManagementHandler) GetConsumer(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/admin/stream/{streamName}/consumer/{consumerName}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	info, err := h.core.GetConsumerForStream(streamName, consumerName, r.Context())
+	if err != nil {
+		msg := fmt.Sprintf("Failed to read consumer %s on stream %s", consumerName, streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	backoff, err := h.core.GetConsumerBackoff(streamName, consumerName, r.Context())
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Failed to read consumer %s on stream %s backoff", consumerName, streamName,
+		)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	resp := APIRestRespOneJetStreamConsumer{
+		StandardResponse: StandardResponse{Success: true},
+		Consumer:         convertConsumerInfo(info),
+	}
+	resp.Consumer.Config.Backoff = backoff
+	hal := func(l halLinker) interface{} {
+		return APIRestHALRespOneJetStreamConsumer{
+			StandardResponse: resp.StandardResponse,
+			APIRestHALConsumer: APIRestHALConsumer{
+				APIRestRespConsumerInfo: resp.Consumer,
+				Links:                   h.halConsumerLinks(l, streamName, consumerName),
+			},
+		}
+	}
+	h.replyNegotiated(w, resp, hal, restCall, r)
+}
+
+// GetConsumerHandler Wrapper around GetConsumer
+func (h APIRestJetStreamManagementHandler) GetConsumerHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetConsumer(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespConsumerDiff response for comparing two consumers of a stream
+type APIRestRespConsumerDiff struct {
+	StandardResponse
+	// Diff the progress of the two consumers
+	Diff management.ConsumerDiff `json:"diff,omitempty"`
+}
+
+// DiffConsumers godoc
+// @Summary Compare two consumers of a stream
+// @Description Compare the ACK floors, and delivered positions, of two consumers of the same stream, reporting the ranges of messages one has processed but the other has not.
+// @Description Useful when migrating consumers, or verifying a replacement consumer has caught up.
+// @tags Management,get,consumer
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Param otherConsumer path string true "JetStream consumer to compare against"
+// @Success 200 {object} APIRestRespConsumerDiff "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/diff/{otherConsumer} [get]
+func (h APIRestJetStreamManagementHandler) DiffConsumers(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/admin/stream/{streamName}/consumer/{consumerName}/diff/{otherConsumer}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	otherConsumer, ok := vars["otherConsumer"]
+	if !ok {
+		msg := "No consumer to compare against provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	diff, err := h.core.DiffConsumers(streamName, consumerName, otherConsumer, r.Context())
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Failed to compare consumers %s and %s on stream %s",
+			consumerName,
+			otherConsumer,
+			streamName,
+		)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	resp := APIRestRespConsumerDiff{
+		StandardResponse: StandardResponse{Success: true},
+		Diff:             diff,
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// DiffConsumersHandler Wrapper around DiffConsumers
+func (h APIRestJetStreamManagementHandler) DiffConsumersHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.DiffConsumers(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespConsumerRedelivery response for forcing a consumer to redeliver its pending
+// messages
+type APIRestRespConsumerRedelivery struct {
+	StandardResponse
+	// Redelivery the outcome of the redelivery
+	Redelivery *management.ConsumerRedelivery `json:"redelivery,omitempty"`
+}
+
+// RedeliverConsumerPending godoc
+// @Summary Redeliver the pending messages of a consumer
+// @Description Force a consumer to redeliver its pending (delivered but not ACKed) messages at
+// @Description once, by recreating it to start after its ACK floor. Messages past the ACK
+// @Description floor which were individually ACKed are delivered again as well. Active push
+// @Description subscribe sessions of the consumer may end. To confirm, "confirm" must repeat
+// @Description the consumer name. A consumer which can not be recreated is left deleted, and
+// @Description the error gives the stream sequence to restart it at.
+// @tags Management,post,consumer
+// @Accept json
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Param param body management.JetStreamConsumerRedeliverParam true "Confirmation"
+// @Success 200 {object} APIRestRespConsumerRedelivery "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/redeliver [post]
+func (h APIRestJetStreamManagementHandler) RedeliverConsumerPending(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "POST /v1/admin/stream/{streamName}/consumer/{consumerName}/redeliver"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	var params management.JetStreamConsumerRedeliverParam
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		msg := "Unable to parse request body"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if err := h.validate.Struct(&params); err != nil || params.Confirm != consumerName {
+		msg := fmt.Sprintf("Confirm the redelivery by setting confirm to '%s'", consumerName)
+		log.WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	redelivery, err := h.core.RedeliverConsumerPending(streamName, consumerName, r.Context())
+	if err != nil {
+		msg := fmt.Sprintf(
+			"Failed to redeliver pending messages of consumer %s on stream %s",
+			consumerName,
+			streamName,
+		)
+		// The consumer is gone, so the operator must know where to restart it
+		if errors.Is(err, management.ErrConsumerDeleted) {
+			msg = fmt.Sprintf(
+				"Consumer %s on stream %s was deleted, but not recreated; recreate it to start at stream sequence %d",
+				consumerName,
+				streamName,
+				redelivery.AckFloor+1,
+			)
+		}
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	resp := APIRestRespConsumerRedelivery{
+		StandardResponse: getStdRESTSuccessMsg(), Redelivery: &redelivery,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// RedeliverConsumerPendingHandler Wrapper around RedeliverConsumerPending
+func (h APIRestJetStreamManagementHandler) RedeliverConsumerPendingHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.RedeliverConsumerPending(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// DeleteConsumer godoc
+// @Summary Delete one consumer of a stream
+// @Description Delete one consumer of a stream
+// @tags Management,delete,consumer
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName} [delete]
+func (h APIRestJetStreamManagementHandler) DeleteConsumer(w http.ResponseWriter, r *http.Request) {
+	restCall := "DELETE /v1/admin/stream/{streamName}/consumer/{consumerName}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	if err := h.core.DeleteConsumerOnStream(streamName, consumerName, r.Context()); err != nil {
+		msg := fmt.Sprintf("Failed to delete consumer %s on stream %s", consumerName, streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
+
+// DeleteConsumerHandler Wrapper around DeleteConsumer
+func (h APIRestJetStreamManagementHandler) DeleteConsumerHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.DeleteConsumer(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespConsumerFilter response for describing the filter module of a consumer
+type APIRestRespConsumerFilter struct {
+	StandardResponse
+	// Filter the details regarding the filter module
+	Filter filters.ModuleInfo `json:"filter,omitempty"`
+}
+
+// readFilterPathVars helper function to read the stream and consumer name of a filter request.
+// Returns false if the reply has already been sent.
+func (h APIRestJetStreamManagementHandler) readFilterPathVars(
+	w http.ResponseWriter, r *http.Request, restCall string, localLogTags log.Fields,
+) (string, string, bool) {
+	if h.filters == nil {
+		msg := "Consumer filters are not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return "", "", false
+	}
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return "", "", false
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return "", "", false
+	}
+	return streamName, consumerName, true
+}
+
+// PutConsumerFilter godoc
+// @Summary Upload the filter module of a consumer
+// @Description Upload a WASM module which decides, per message, whether messages delivered
+// @Description to a consumer are forwarded, dropped, or transformed. Replaces any existing
+// @Description filter module of the consumer. Running sessions keep their current filter.
+// @tags Management,put,consumer
+// @Accept plain
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Param module body string true "WASM module in Base64 encoding"
+// @Success 200 {object} APIRestRespConsumerFilter "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/filter [put]
+func (h APIRestJetStreamManagementHandler) PutConsumerFilter(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "PUT /v1/admin/stream/{streamName}/consumer/{consumerName}/filter"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	streamName, consumerName, ok := h.readFilterPathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	if _, err := h.core.GetConsumerForStream(streamName, consumerName, r.Context()); err != nil {
+		msg := fmt.Sprintf("Failed to read consumer %s on stream %s", consumerName, streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	// Base64 encoding inflates the module by 4/3
+	r.Body = http.MaxBytesReader(w, r.Body, int64(filters.MaxModuleSize/3+1)*4)
+	module, err := decodeB64Body(r)
+	if err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	info, err := h.filters.PutFilter(streamName, consumerName, module, r.Context())
+	if err != nil {
+		respCode := http.StatusInternalServerError
+		msg := fmt.Sprintf(
+			"Failed to store filter of consumer %s on stream %s", consumerName, streamName,
+		)
+		if errors.Is(err, filters.ErrInvalidModule) {
+			respCode = http.StatusBadRequest
+			msg = err.Error()
+		}
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+		return
+	}
+
+	resp := APIRestRespConsumerFilter{
+		StandardResponse: StandardResponse{Success: true},
+		Filter:           info,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// PutConsumerFilterHandler Wrapper around PutConsumerFilter
+func (h APIRestJetStreamManagementHandler) PutConsumerFilterHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.PutConsumerFilter(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// GetConsumerFilter godoc
+// @Summary Get the filter module of a consumer
+// @Description Query for the details of the filter module of a consumer
+// @tags Management,get,consumer
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} APIRestRespConsumerFilter "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/filter [get]
+func (h APIRestJetStreamManagementHandler) GetConsumerFilter(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/stream/{streamName}/consumer/{consumerName}/filter"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	streamName, consumerName, ok := h.readFilterPathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	info, err := h.filters.GetFilter(streamName, consumerName, r.Context())
+	if err != nil {
+		respCode := http.StatusInternalServerError
+		msg := fmt.Sprintf(
+			"Failed to read filter of consumer %s on stream %s", consumerName, streamName,
+		)
+		if errors.Is(err, filters.ErrNoFilter) {
+			respCode = http.StatusNotFound
+			msg = fmt.Sprintf("Consumer %s on stream %s has no filter", consumerName, streamName)
+		}
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+		return
+	}
+
+	resp := APIRestRespConsumerFilter{
+		StandardResponse: StandardResponse{Success: true},
+		Filter:           info,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetConsumerFilterHandler Wrapper around GetConsumerFilter
+func (h APIRestJetStreamManagementHandler) GetConsumerFilterHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetConsumerFilter(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// DeleteConsumerFilter godoc
+// @Summary Delete the filter module of a consumer
+// @Description Delete the filter module of a consumer. Running sessions keep their current filter.
+// @tags Management,delete,consumer
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/filter [delete]
+func (h APIRestJetStreamManagementHandler) DeleteConsumerFilter(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "DELETE /v1/admin/stream/{streamName}/consumer/{consumerName}/filter"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	streamName, consumerName, ok := h.readFilterPathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	if err := h.filters.DeleteFilter(streamName, consumerName, r.Context()); err != nil {
+		respCode := http.StatusInternalServerError
+		msg := fmt.Sprintf(
+			"Failed to delete filter of consumer %s on stream %s", consumerName, streamName,
+		)
+		if errors.Is(err, filters.ErrNoFilter) {
+			respCode = http.StatusNotFound
+			msg = fmt.Sprintf("Consumer %s on stream %s has no filter", consumerName, streamName)
+		}
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+		return
+	}
+
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
+
+// DeleteConsumerFilterHandler Wrapper around DeleteConsumerFilter
+func (h APIRestJetStreamManagementHandler) DeleteConsumerFilterHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.DeleteConsumerFilter(w, r)
+	})
+}
+
+// =======================================================================
+// Stream archival
+
+// -----------------------------------------------------------------------
+
+// APIRestReqArchive request for defining an archive
+type APIRestReqArchive struct {
+	// Stream is the name of the stream archived
+	Stream string `json:"stream" validate:"required"`
+	// Consumer is the durable pull consumer the archive drains
+	Consumer string `json:"consumer" validate:"required"`
+	// BatchSize is the max number of messages per archive file
+	BatchSize int `json:"batch_size" validate:"required,gte=1"`
+	// FlushInterval is the longest a message waits before its batch is written, in
+	// nanoseconds. It must be shorter than the consumer's ACK wait.
+	FlushInterval time.Duration `json:"flush_interval" validate:"required" swaggertype:"primitive,integer"`
+}
+
+// APIRestRespArchive response for describing an archive
+type APIRestRespArchive struct {
+	StandardResponse
+	// Archive the definition and status of the archive
+	Archive archive.Info `json:"archive"`
+}
+
+// APIRestRespAllArchives response for describing all archives
+type APIRestRespAllArchives struct {
+	StandardResponse
+	// Archives the definition and status of each archive
+	Archives []archive.Info `json:"archives"`
+}
+
+// APIRestRespArchiveManifest response for the manifest of an archive
+type APIRestRespArchiveManifest struct {
+	StandardResponse
+	// Manifest the index of the archive files
+	Manifest archive.Manifest `json:"manifest"`
+}
+
+// readArchivePathVars helper function to read the archive name of an archive request.
+// Returns false if the reply has already been sent.
+func (h APIRestJetStreamManagementHandler) readArchivePathVars(
+	w http.ResponseWriter, r *http.Request, restCall string, localLogTags log.Fields,
+) (string, bool) {
+	if !h.checkArchivesEnabled(w, r, restCall, localLogTags) {
+		return "", false
+	}
+	archiveName, ok := mux.Vars(r)["archiveName"]
+	if !ok {
+		msg := "No archive name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return "", false
+	}
+	return archiveName, true
+}
+
+// checkArchivesEnabled helper function to reject archive requests if archival is not
+// enabled. Returns false if the reply has already been sent.
+func (h APIRestJetStreamManagementHandler) checkArchivesEnabled(
+	w http.ResponseWriter, r *http.Request, restCall string, localLogTags log.Fields,
+) bool {
+	if h.archives != nil {
+		return true
+	}
+	msg := "Stream archival is not enabled"
+	log.WithFields(localLogTags).Errorf(msg)
+	h.reply(
+		w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+		restCall, r,
+	)
+	return false
+}
+
+// replyArchiveError helper function to reply to a failed archive request
+func (h APIRestJetStreamManagementHandler) replyArchiveError(
+	w http.ResponseWriter,
+	r *http.Request,
+	restCall string,
+	localLogTags log.Fields,
+	archiveName string,
+	err error,
+) {
+	respCode := http.StatusInternalServerError
+	msg := fmt.Sprintf("Failed to process archive %s", archiveName)
+	if errors.Is(err, archive.ErrUnknownArchive) {
+		respCode = http.StatusNotFound
+		msg = fmt.Sprintf("Archive %s is not defined", archiveName)
+	} else if errors.Is(err, archive.ErrInvalidDefinition) {
+		respCode = http.StatusBadRequest
+		msg = err.Error()
+	}
+	log.WithError(err).WithFields(localLogTags).Error(msg)
+	h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+}
+
+// PutArchive godoc
+// @Summary Define a stream archive
+// @Description Define an archive which continuously drains a durable pull consumer, writing
+// @Description batches of its messages as gzip compressed NDJSON files to object storage,
+// @Description indexed by the archive's manifest. Messages are ACKed once their file is
+// @Description recorded in the manifest. Replaces any archive of the same name.
+// @tags Management,put,archive
+// @Accept json
+// @Produce json
+// @Param archiveName path string true "Archive name"
+// @Param setting body APIRestReqArchive true "Archive definition"
+// @Success 200 {object} APIRestRespArchive "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/archive/{archiveName} [put]
+func (h APIRestJetStreamManagementHandler) PutArchive(w http.ResponseWriter, r *http.Request) {
+	restCall := "PUT /v1/admin/archive/{archiveName}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	archiveName, ok := h.readArchivePathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	var params APIRestReqArchive
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		msg := "Unable to parse archive definition"
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if err := h.validate.Struct(&params); err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf("Archive definition invalid")
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	info, err := h.archives.PutArchive(archive.Definition{
+		Name:          archiveName,
+		Stream:        params.Stream,
+		Consumer:      params.Consumer,
+		BatchSize:     params.BatchSize,
+		FlushInterval: params.FlushInterval,
+	}, r.Context())
+	if err != nil {
+		h.replyArchiveError(w, r, restCall, localLogTags, archiveName, err)
+		return
+	}
+
+	resp := APIRestRespArchive{
+		StandardResponse: StandardResponse{Success: true},
+		Archive:          info,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// PutArchiveHandler Wrapper around PutArchive
+func (h APIRestJetStreamManagementHandler) PutArchiveHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.PutArchive(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// GetAllArchives godoc
+// @Summary Get all stream archives
+// @Description Query for the definition and worker status of all archives
+// @tags Management,get,archive
+// @Produce json
+// @Success 200 {object} APIRestRespAllArchives "success"
+// @Failure 400 {string} string "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/archive [get]
+func (h APIRestJetStreamManagementHandler) GetAllArchives(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/admin/archive"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if !h.checkArchivesEnabled(w, r, restCall, localLogTags) {
+		return
+	}
+
+	archives, err := h.archives.ListArchives(r.Context())
+	if err != nil {
+		msg := "Failed to list archives"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	resp := APIRestRespAllArchives{
+		StandardResponse: StandardResponse{Success: true},
+		Archives:         archives,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetAllArchivesHandler Wrapper around GetAllArchives
+func (h APIRestJetStreamManagementHandler) GetAllArchivesHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetAllArchives(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// GetArchive godoc
+// @Summary Get a stream archive
+// @Description Query for the definition and worker status of an archive
+// @tags Management,get,archive
+// @Produce json
+// @Param archiveName path string true "Archive name"
+// @Success 200 {object} APIRestRespArchive "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/archive/{archiveName} [get]
+func (h APIRestJetStreamManagementHandler) GetArchive(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/admin/archive/{archiveName}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	archiveName, ok := h.readArchivePathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	info, err := h.archives.GetArchive(archiveName, r.Context())
+	if err != nil {
+		h.replyArchiveError(w, r, restCall, localLogTags, archiveName, err)
+		return
+	}
+
+	resp := APIRestRespArchive{
+		StandardResponse: StandardResponse{Success: true},
+		Archive:          info,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetArchiveHandler Wrapper around GetArchive
+func (h APIRestJetStreamManagementHandler) GetArchiveHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetArchive(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// DeleteArchive godoc
+// @Summary Delete a stream archive
+// @Description Stop an archive, and delete its definition. The archive files and manifest
+// @Description are kept in object storage, and the consumer is not deleted.
+// @tags Management,delete,archive
+// @Produce json
+// @Param archiveName path string true "Archive name"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/archive/{archiveName} [delete]
+func (h APIRestJetStreamManagementHandler) DeleteArchive(w http.ResponseWriter, r *http.Request) {
+	restCall := "DELETE /v1/admin/archive/{archiveName}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	archiveName, ok := h.readArchivePathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	if err := h.archives.DeleteArchive(archiveName, r.Context()); err != nil {
+		h.replyArchiveError(w, r, restCall, localLogTags, archiveName, err)
+		return
+	}
+
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
+
+// DeleteArchiveHandler Wrapper around DeleteArchive
+func (h APIRestJetStreamManagementHandler) DeleteArchiveHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.DeleteArchive(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// GetArchiveManifest godoc
+// @Summary Get the manifest of a stream archive
+// @Description Query for the index of the files of an archive, with the sequence and time
+// @Description range of the messages of each file. Manifests of deleted archives are kept.
+// @tags Management,get,archive
+// @Produce json
+// @Param archiveName path string true "Archive name"
+// @Success 200 {object} APIRestRespArchiveManifest "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/archive/{archiveName}/manifest [get]
+func (h APIRestJetStreamManagementHandler) GetArchiveManifest(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/archive/{archiveName}/manifest"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	archiveName, ok := h.readArchivePathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	manifest, err := h.archives.GetManifest(archiveName, r.Context())
+	if err != nil {
+		h.replyArchiveError(w, r, restCall, localLogTags, archiveName, err)
+		return
+	}
+
+	resp := APIRestRespArchiveManifest{
+		StandardResponse: StandardResponse{Success: true},
+		Manifest:         manifest,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetArchiveManifestHandler Wrapper around GetArchiveManifest
+func (h APIRestJetStreamManagementHandler) GetArchiveManifestHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetArchiveManifest(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestReqReplay request for replaying archived messages
+type APIRestReqReplay struct {
+	// StartTime is the earliest store time of the messages replayed, in RFC3339
+	StartTime time.Time `json:"start_time,omitempty"`
+	// EndTime is the latest store time of the messages replayed, in RFC3339
+	EndTime time.Time `json:"end_time,omitempty"`
+	// Subject is the subject the messages are published to
+	Subject string `json:"subject" validate:"required"`
+	// Rate is the max number of messages per second published. Zero means no limit.
+	Rate float64 `json:"rate,omitempty" validate:"gte=0"`
+}
+
+// APIRestRespReplay response for the progress of a replay
+type APIRestRespReplay struct {
+	StandardResponse
+	// Replay the progress of the replay
+	Replay archive.ReplayProgress `json:"replay"`
+}
+
+// APIRestRespAllReplays response for the progress of all replays
+type APIRestRespAllReplays struct {
+	StandardResponse
+	// Replays the progress of the running and recently finished replays
+	Replays []archive.ReplayProgress `json:"replays"`
+}
+
+// checkReplaysEnabled helper function to reject replay requests if replay is not enabled.
+// Returns false if the reply has already been sent.
+func (h APIRestJetStreamManagementHandler) checkReplaysEnabled(
+	w http.ResponseWriter, r *http.Request, restCall string, localLogTags log.Fields,
+) bool {
+	if h.replays != nil {
+		return true
+	}
+	msg := "Archive replay is not enabled"
+	log.WithFields(localLogTags).Errorf(msg)
+	h.reply(
+		w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+		restCall, r,
+	)
+	return false
+}
+
+// readReplayPathVars helper function to read the replay ID of a replay request. Returns
+// false if the reply has already been sent.
+func (h APIRestJetStreamManagementHandler) readReplayPathVars(
+	w http.ResponseWriter, r *http.Request, restCall string, localLogTags log.Fields,
+) (string, bool) {
+	if !h.checkReplaysEnabled(w, r, restCall, localLogTags) {
+		return "", false
+	}
+	replayID, ok := mux.Vars(r)["replayID"]
+	if !ok {
+		msg := "No replay ID provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return "", false
+	}
+	return replayID, true
+}
+
+// replyReplayError helper function to reply to a failed replay request
+func (h APIRestJetStreamManagementHandler) replyReplayError(
+	w http.ResponseWriter,
+	r *http.Request,
+	restCall string,
+	localLogTags log.Fields,
+	replayID string,
+	err error,
+) {
+	respCode := http.StatusInternalServerError
+	msg := fmt.Sprintf("Failed to process replay %s", replayID)
+	if errors.Is(err, archive.ErrUnknownReplay) {
+		respCode = http.StatusNotFound
+		msg = fmt.Sprintf("Replay %s is not known", replayID)
+	}
+	log.WithError(err).WithFields(localLogTags).Error(msg)
+	h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+}
+
+// StartArchiveReplay godoc
+// @Summary Replay archived messages
+// @Description Start re-publishing the archived messages of a store time range to a subject,
+// @Description at up to a rate. Replayed messages keep their headers, and carry the
+// @Description Httpmq-Replay-Source-Stream, Httpmq-Replay-Source-Subject, and
+// @Description Httpmq-Replay-Source-Sequence headers. Returns the replay to follow.
+// @tags Management,post,archive
+// @Accept json
+// @Produce json
+// @Param archiveName path string true "Archive name"
+// @Param setting body APIRestReqReplay true "Replay range and target"
+// @Success 200 {object} APIRestRespReplay "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/archive/{archiveName}/replay [post]
+func (h APIRestJetStreamManagementHandler) StartArchiveReplay(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "POST /v1/admin/archive/{archiveName}/replay"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if !h.checkReplaysEnabled(w, r, restCall, localLogTags) {
+		return
+	}
+	archiveName, ok := h.readArchivePathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	var params APIRestReqReplay
+	if err := common.JSON().NewDecoder(r.Body).Decode(&params); err != nil {
+		msg := "Unable to parse replay parameters"
+		log.WithError(err).WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if err := h.validate.Struct(&params); err != nil {
+		msg := err.Error()
+		log.WithError(err).WithFields(localLogTags).Errorf("Replay parameters invalid")
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if params.Subject, ok = h.checkSubject(w, r, restCall, params.Subject, false); !ok {
+		return
+	}
+
+	progress, err := h.replays.StartReplay(archive.ReplayParam{
+		Archive:   archiveName,
+		StartTime: params.StartTime,
+		EndTime:   params.EndTime,
+		Subject:   params.Subject,
+		Rate:      params.Rate,
+	}, r.Context())
+	if err != nil {
+		respCode := http.StatusInternalServerError
+		msg := fmt.Sprintf("Failed to replay archive %s", archiveName)
+		if errors.Is(err, archive.ErrUnknownArchive) {
+			respCode = http.StatusNotFound
+			msg = fmt.Sprintf("Archive %s has no manifest", archiveName)
+		} else if errors.Is(err, archive.ErrInvalidReplay) {
+			respCode = http.StatusBadRequest
+			msg = err.Error()
+		}
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+		return
+	}
+
+	resp := APIRestRespReplay{
+		StandardResponse: StandardResponse{Success: true},
+		Replay:           progress,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// StartArchiveReplayHandler Wrapper around StartArchiveReplay
+func (h APIRestJetStreamManagementHandler) StartArchiveReplayHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.StartArchiveReplay(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// GetAllReplays godoc
+// @Summary Get all archive replays
+// @Description Query for the progress of the running and recently finished archive replays
+// @tags Management,get,archive
+// @Produce json
+// @Success 200 {object} APIRestRespAllReplays "success"
+// @Failure 400 {string} string "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/replay [get]
+func (h APIRestJetStreamManagementHandler) GetAllReplays(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/admin/replay"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if !h.checkReplaysEnabled(w, r, restCall, localLogTags) {
+		return
+	}
+
+	resp := APIRestRespAllReplays{
+		StandardResponse: StandardResponse{Success: true},
+		Replays:          h.replays.ListReplays(),
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetAllReplaysHandler Wrapper around GetAllReplays
+func (h APIRestJetStreamManagementHandler) GetAllReplaysHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetAllReplays(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// GetReplay godoc
+// @Summary Get an archive replay
+// @Description Query for the progress of an archive replay
+// @tags Management,get,archive
+// @Produce json
+// @Param replayID path string true "Replay ID"
+// @Success 200 {object} APIRestRespReplay "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/replay/{replayID} [get]
+func (h APIRestJetStreamManagementHandler) GetReplay(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/admin/replay/{replayID}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	replayID, ok := h.readReplayPathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	progress, err := h.replays.GetReplay(replayID)
+	if err != nil {
+		h.replyReplayError(w, r, restCall, localLogTags, replayID, err)
+		return
+	}
+
+	resp := APIRestRespReplay{
+		StandardResponse: StandardResponse{Success: true},
+		Replay:           progress,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetReplayHandler Wrapper around GetReplay
+func (h APIRestJetStreamManagementHandler) GetReplayHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetReplay(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// CancelReplay godoc
+// @Summary Cancel an archive replay
+// @Description Stop a running archive replay. Messages already published are kept.
+// @tags Management,delete,archive
+// @Produce json
+// @Param replayID path string true "Replay ID"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/replay/{replayID} [delete]
+func (h APIRestJetStreamManagementHandler) CancelReplay(w http.ResponseWriter, r *http.Request) {
+	restCall := "DELETE /v1/admin/replay/{replayID}"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	replayID, ok := h.readReplayPathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	if err := h.replays.CancelReplay(replayID); err != nil {
+		h.replyReplayError(w, r, restCall, localLogTags, replayID, err)
+		return
+	}
+
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
+
+// CancelReplayHandler Wrapper around CancelReplay
+func (h APIRestJetStreamManagementHandler) CancelReplayHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.CancelReplay(w, r)
+	})
+}
+
+// =======================================================================
+// Consumer latency
+
+// -----------------------------------------------------------------------
+
+// APIRestRespConsumerLatency response for the ACK latency of the consumers of a stream
+type APIRestRespConsumerLatency struct {
+	StandardResponse
+	// Reports are the latency reports of each consumer, per dataplane instance
+	Reports []metrics.ConsumerLatencyReport `json:"reports"`
+}
+
+// GetConsumerLatency godoc
+// @Summary Query for ACK latency of the consumers of a stream
+// @Description Query for the recent latency from publish to ACK of the messages delivered
+// @Description through each consumer of a stream, as reported by the dataplane instances.
+// @Description A consumer is slow if its p99 latency is above the dataplane's threshold.
+// @tags Management,get,consumer
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param slow query boolean false "Only return reports of slow consumers"
+// @Success 200 {object} APIRestRespConsumerLatency "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/latency [get]
+func (h APIRestJetStreamManagementHandler) GetConsumerLatency(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/stream/{streamName}/latency"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.latency == nil {
+		msg := "Consumer latency reports are not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+
+	slowOnly := false
+	if s := r.URL.Query().Get("slow"); s != "" {
+		p, err := strconv.ParseBool(s)
+		if err != nil {
+			msg := "Unable to parse slow"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(
+				w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r,
+			)
+			return
+		}
+		slowOnly = p
+	}
+
+	reports := []metrics.ConsumerLatencyReport{}
+	for _, report := range h.latency.Reports(streamName) {
+		if slowOnly && !report.Slow {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	resp := APIRestRespConsumerLatency{
+		StandardResponse: StandardResponse{Success: true},
+		Reports:          reports,
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetConsumerLatencyHandler Wrapper around GetConsumerLatency
+func (h APIRestJetStreamManagementHandler) GetConsumerLatencyHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetConsumerLatency(w, r)
+	})
+}
+
+// =======================================================================
+// Consumer leases
+
+// -----------------------------------------------------------------------
+
+// APIRestRespConsumerLeases response for the leases pinning consumers to sessions
+type APIRestRespConsumerLeases struct {
+	StandardResponse
+	// Leases are the leases currently held
+	Leases []dataplane.ConsumerLease `json:"leases"`
+}
+
+// APIRestRespConsumerLease response for the lease pinning a consumer to a session
+type APIRestRespConsumerLease struct {
+	StandardResponse
+	// Lease is the lease of the consumer
+	Lease dataplane.ConsumerLease `json:"lease"`
+}
+
+// checkLeasesEnabled helper function to reject lease requests if consumer pinning is not
+// enabled. Returns false if the reply has already been sent.
+func (h APIRestJetStreamManagementHandler) checkLeasesEnabled(
+	w http.ResponseWriter, r *http.Request, restCall string, localLogTags log.Fields,
+) bool {
+	if h.leases != nil {
+		return true
+	}
+	msg := "Consumer pinning is not enabled"
+	log.WithFields(localLogTags).Errorf(msg)
+	h.reply(
+		w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+		restCall, r,
+	)
+	return false
+}
+
+// readLeasePathVars helper function to read the stream and consumer of a lease request.
+// Returns false if the reply has already been sent.
+func (h APIRestJetStreamManagementHandler) readLeasePathVars(
+	w http.ResponseWriter, r *http.Request, restCall string, localLogTags log.Fields,
+) (string, string, bool) {
+	if !h.checkLeasesEnabled(w, r, restCall, localLogTags) {
+		return "", "", false
+	}
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return "", "", false
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return "", "", false
+	}
+	return streamName, consumerName, true
+}
+
+// replyLeaseError helper function to reply to a failed lease request
+func (h APIRestJetStreamManagementHandler) replyLeaseError(
+	w http.ResponseWriter,
+	r *http.Request,
+	restCall string,
+	localLogTags log.Fields,
+	streamName, consumerName string,
+	err error,
+) {
+	respCode := http.StatusInternalServerError
+	msg := fmt.Sprintf("Failed to read lease of consumer %s@%s", consumerName, streamName)
+	if errors.Is(err, dataplane.ErrNoLease) {
+		respCode = http.StatusNotFound
+		msg = fmt.Sprintf("Consumer %s@%s is not pinned", consumerName, streamName)
+	}
+	log.WithError(err).WithFields(localLogTags).Error(msg)
+	h.reply(w, respCode, getStdRESTErrorMsg(respCode, &msg), restCall, r)
+}
+
+// GetAllConsumerLeases godoc
+// @Summary Get all consumer leases
+// @Description Query for the leases pinning durable consumers to push subscribe sessions
+// @tags Management,get,consumer
+// @Produce json
+// @Success 200 {object} APIRestRespConsumerLeases "success"
+// @Failure 400 {string} string "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/lease [get]
+func (h APIRestJetStreamManagementHandler) GetAllConsumerLeases(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/lease"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if !h.checkLeasesEnabled(w, r, restCall, localLogTags) {
+		return
+	}
+
+	leases, err := h.leases.ListLeases()
+	if err != nil {
+		msg := "Failed to list consumer leases"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	resp := APIRestRespConsumerLeases{
+		StandardResponse: StandardResponse{Success: true},
+		Leases:           leases,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetAllConsumerLeasesHandler Wrapper around GetAllConsumerLeases
+func (h APIRestJetStreamManagementHandler) GetAllConsumerLeasesHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetAllConsumerLeases(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// GetConsumerLease godoc
+// @Summary Get the lease of a consumer
+// @Description Query for the lease pinning a durable consumer to a push subscribe session
+// @tags Management,get,consumer
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} APIRestRespConsumerLease "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/lease [get]
+func (h APIRestJetStreamManagementHandler) GetConsumerLease(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/stream/{streamName}/consumer/{consumerName}/lease"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	streamName, consumerName, ok := h.readLeasePathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	lease, err := h.leases.GetLease(streamName, consumerName)
+	if err != nil {
+		h.replyLeaseError(w, r, restCall, localLogTags, streamName, consumerName, err)
+		return
+	}
+
+	resp := APIRestRespConsumerLease{
+		StandardResponse: StandardResponse{Success: true},
+		Lease:            lease,
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetConsumerLeaseHandler Wrapper around GetConsumerLease
+func (h APIRestJetStreamManagementHandler) GetConsumerLeaseHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetConsumerLease(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// BreakConsumerLease godoc
+// @Summary Break the lease of a consumer
+// @Description Force-break the lease pinning a durable consumer to a push subscribe session.
+// @Description The session holding the lease ends, and other sessions may bind the consumer.
+// @tags Management,delete,consumer
+// @Produce json
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} StandardResponse "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {object} StandardResponse "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,404,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/lease [delete]
+func (h APIRestJetStreamManagementHandler) BreakConsumerLease(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "DELETE /v1/admin/stream/{streamName}/consumer/{consumerName}/lease"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	streamName, consumerName, ok := h.readLeasePathVars(w, r, restCall, localLogTags)
+	if !ok {
+		return
+	}
+
+	if err := h.leases.BreakLease(streamName, consumerName); err != nil {
+		h.replyLeaseError(w, r, restCall, localLogTags, streamName, consumerName, err)
+		return
+	}
+	log.WithFields(localLogTags).Infof("Broke lease of consumer %s@%s", consumerName, streamName)
+
+	h.reply(w, http.StatusOK, getStdRESTSuccessMsg(), restCall, r)
+}
+
+// BreakConsumerLeaseHandler Wrapper around BreakConsumerLease
+func (h APIRestJetStreamManagementHandler) BreakConsumerLeaseHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.BreakConsumerLease(w, r)
+	})
+}
+
+// =======================================================================
+// Active sessions
+
+// -----------------------------------------------------------------------
+
+// APIRestRespActiveSessions response for the push subscribe sessions of the dataplane replicas
+type APIRestRespActiveSessions struct {
+	StandardResponse
+	// Sessions are the push subscribe sessions running on the dataplane replicas
+	Sessions []dataplane.ActiveSession `json:"sessions"`
+}
+
+// GetActiveSessions godoc
+// @Summary Query for push subscribe sessions of the dataplane replicas
+// @Description Query for the push subscribe sessions running on each dataplane replica, as
+// @Description shared by the replicas over the session gossip subject.
+// @tags Management,get,consumer
+// @Produce json
+// @Param stream query string false "Only return sessions of this stream"
+// @Param consumer query string false "Only return sessions of this consumer"
+// @Success 200 {object} APIRestRespActiveSessions "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/sessions [get]
+func (h APIRestJetStreamManagementHandler) GetActiveSessions(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/sessions"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.sessions == nil {
+		msg := "Session gossip is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+	consumer := r.URL.Query().Get("consumer")
+	sessions := []dataplane.ActiveSession{}
+	for _, session := range h.sessions.Sessions() {
+		if (stream != "" && session.Stream != stream) ||
+			(consumer != "" && session.Consumer != consumer) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	resp := APIRestRespActiveSessions{
+		StandardResponse: StandardResponse{Success: true},
+		Sessions:         sessions,
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetActiveSessionsHandler Wrapper around GetActiveSessions
+func (h APIRestJetStreamManagementHandler) GetActiveSessionsHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetActiveSessions(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// APIRestRespOrphanedConsumers response for the consumers found without a session on
+// recovery
+type APIRestRespOrphanedConsumers struct {
+	StandardResponse
+	// Consumers are the consumers httpmq created which no session was bound to
+	Consumers []management.OrphanedConsumer `json:"consumers"`
+}
+
+// GetOrphanedConsumers godoc
+// @Summary Query for consumers left without a session
+// @Description Query for the push consumers created through httpmq which were found with no
+// @Description session bound. Ephemeral consumers are deleted once they stay unbound for the
+// @Description grace period; durable consumers are reported as unbound until a session binds
+// @Description to them, including the ones other management replicas found.
+// @tags Management,get,consumer
+// @Produce json
+// @Success 200 {object} APIRestRespOrphanedConsumers "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/orphans [get]
+func (h APIRestJetStreamManagementHandler) GetOrphanedConsumers(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/orphans"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.recovery == nil {
+		msg := "Consumer recovery is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+
+	resp := APIRestRespOrphanedConsumers{
+		StandardResponse: StandardResponse{Success: true},
+		Consumers:        h.recovery.Orphans(r.Context()),
+	}
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetOrphanedConsumersHandler Wrapper around GetOrphanedConsumers
+func (h APIRestJetStreamManagementHandler) GetOrphanedConsumersHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetOrphanedConsumers(w, r)
+	})
+}
+
+// =======================================================================
+// Health Checks
+
+// -----------------------------------------------------------------------
+
+// APIRestRespAccountUsage response for querying the JetStream usage of the account
+type APIRestRespAccountUsage struct {
+	StandardResponse
+	// Usage the JetStream usage of the account relative to its limits
+	Usage management.AccountUsage `json:"usage,omitempty"`
+}
+
+// GetAccountUsage godoc
+// @Summary Query for JetStream usage of the account
+// @Description Query for the storage, stream count, and consumer count of the connected JetStream account relative to its limits
+// @tags Management,get,account
+// @Produce json
+// @Success 200 {object} APIRestRespAccountUsage "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Header 200,400,500 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/account [get]
+func (h APIRestJetStreamManagementHandler) GetAccountUsage(w http.ResponseWriter, r *http.Request) {
+	restCall := "GET /v1/admin/account"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	accountInfo, err := h.core.GetAccountInfo(r.Context())
+	if err != nil {
+		msg := "Unable fetch account info"
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	resp := APIRestRespAccountUsage{
+		StandardResponse: StandardResponse{Success: true},
+		Usage:            management.GetAccountUsage(accountInfo),
+	}
+
+	h.reply(w, http.StatusOK, resp, restCall, r)
+}
+
+// GetAccountUsageHandler Wrapper around GetAccountUsage
+func (h APIRestJetStreamManagementHandler) GetAccountUsageHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.GetAccountUsage(w, r)
+	})
+}
+
+// -----------------------------------------------------------------------
+
+// topologyEventKeepAlive is the interval between keep-alive comments on an idle event feed
+const topologyEventKeepAlive = time.Second * 15
+
+// StreamTopologyEvents godoc
+// @Summary Follow stream and consumer events
+// @Description Follow the events of streams and consumers being created, updated, or deleted,
+// and of consumer errors, as a server-sent event stream. Each event is sent with its ID, type,
+// and JSON description. The latest events are retained, so a client which reconnects with
+// the Last-Event-ID header first receives the events it missed.
+// @tags Management,get,events
+// @Produce text/event-stream
+// @Param Last-Event-ID header integer false "ID of the last event received"
+// @Success 200 {object} management.TopologyEvent "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/events [get]
+func (h APIRestJetStreamManagementHandler) StreamTopologyEvents(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/events"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.events == nil {
+		msg := "Topology event feed is not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+	var lastEventID uint64
+	if t := r.Header.Get("Last-Event-ID"); t != "" {
+		if lastEventID, err = strconv.ParseUint(t, 10, 64); err != nil {
+			msg := "Unable to parse Last-Event-ID"
+			log.WithError(err).WithFields(localLogTags).Errorf(msg)
+			h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+			return
+		}
+	}
+	writeFlusher, ok := w.(http.Flusher)
+	if !ok {
+		msg := "Streaming not supported"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	backlog, events, cancel := h.events.Subscribe(lastEventID)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	writeEvent := func(event management.TopologyEvent) error {
+		serialize, err := common.JSON().Marshal(&event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, serialize)
+		return err
+	}
+	for _, event := range backlog {
+		if err := writeEvent(event); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Failed to send event")
+			return
+		}
+	}
+	writeFlusher.Flush()
+
+	keepAlive := time.NewTicker(topologyEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to send keep-alive")
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// Dropped for falling behind; the client reconnects to catch up
+				log.WithFields(localLogTags).Warn("Ending event feed of client falling behind")
+				return
+			}
+			if err := writeEvent(event); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to send event")
+				return
+			}
+		}
+		writeFlusher.Flush()
+	}
+}
+
+// StreamTopologyEventsHandler Wrapper around StreamTopologyEvents
+func (h APIRestJetStreamManagementHandler) StreamTopologyEventsHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.StreamTopologyEvents(w, r)
+	})
+}
+
+// StreamConsumerDeliveryEvents godoc
+// @Summary Follow the delivery events of a consumer
+// @Description Follow the messages a consumer gave up on after reaching its max deliveries,
+// the messages terminated by clients, and the ACKs sampled by JetStream when the consumer
+// has a sample_frequency, as a server-sent event stream. Each event is sent with its type,
+// and JSON description. Events are not retained.
+// @tags Management,get,events
+// @Produce text/event-stream
+// @Param streamName path string true "JetStream stream name"
+// @Param consumerName path string true "JetStream consumer name"
+// @Success 200 {object} management.ConsumerDeliveryEvent "success"
+// @Failure 400 {object} StandardResponse "error"
+// @Failure 404 {string} string "error"
+// @Failure 500 {object} StandardResponse "error"
+// @Failure 501 {object} StandardResponse "error"
+// @Header 200,400,500,501 {string} Httpmq-Request-ID "Request ID to match against logs"
+// @Router /v1/admin/stream/{streamName}/consumer/{consumerName}/events [get]
+func (h APIRestJetStreamManagementHandler) StreamConsumerDeliveryEvents(
+	w http.ResponseWriter, r *http.Request,
+) {
+	restCall := "GET /v1/admin/stream/{streamName}/consumer/{consumerName}/events"
+
+	localLogTags, err := common.UpdateLogTags(h.LogTags, r.Context())
+	if err != nil {
+		msg := "Prep failed"
+		log.WithError(err).WithFields(h.LogTags).Error("Failed to update logtags")
+		h.reply(
+			w,
+			http.StatusInternalServerError,
+			getStdRESTErrorMsg(http.StatusInternalServerError, &msg),
+			restCall,
+			r,
+		)
+		return
+	}
+
+	if h.deliveries == nil {
+		msg := "Consumer delivery events are not enabled"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusNotImplemented, getStdRESTErrorMsg(http.StatusNotImplemented, &msg),
+			restCall, r,
+		)
+		return
+	}
+	vars := mux.Vars(r)
+	streamName, ok := vars["streamName"]
+	if !ok {
+		msg := "No stream name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	consumerName, ok := vars["consumerName"]
+	if !ok {
+		msg := "No consumer name provided"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(w, http.StatusBadRequest, getStdRESTErrorMsg(http.StatusBadRequest, &msg), restCall, r)
+		return
+	}
+	if _, err := h.core.GetConsumerForStream(streamName, consumerName, r.Context()); err != nil {
+		msg := fmt.Sprintf("Failed to read consumer %s on stream %s", consumerName, streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	writeFlusher, ok := w.(http.Flusher)
+	if !ok {
+		msg := "Streaming not supported"
+		log.WithFields(localLogTags).Errorf(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+
+	events, cancel, err := h.deliveries.Watch(streamName, consumerName)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to follow consumer %s on stream %s", consumerName, streamName)
+		log.WithError(err).WithFields(localLogTags).Error(msg)
+		h.reply(
+			w, http.StatusInternalServerError, getStdRESTErrorMsg(
+				http.StatusInternalServerError, &msg,
+			), restCall, r,
+		)
+		return
+	}
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	writeFlusher.Flush()
+
+	keepAlive := time.NewTicker(topologyEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to send keep-alive")
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				log.WithFields(localLogTags).Warn("Ending delivery events of client falling behind")
+				return
+			}
+			serialize, err := common.JSON().Marshal(&event)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, serialize)
+			}
+			if err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to send event")
+				return
+			}
+		}
+		writeFlusher.Flush()
+	}
+}
+
+// StreamConsumerDeliveryEventsHandler Wrapper around StreamConsumerDeliveryEvents
+func (h APIRestJetStreamManagementHandler) StreamConsumerDeliveryEventsHandler() http.HandlerFunc {
+	return h.attachRequestID(func(w http.ResponseWriter, r *http.Request) {
+		h.StreamConsumerDeliveryEvents(w, r)
+	})
+}
 
 // -----------------------------------------------------------------------
 
@@ -0,0 +1,85 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apis
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// APIVersion is one version of the REST API, served under its own path prefix
+type APIVersion struct {
+	// Name is the path prefix of the version, e.g. "v1"
+	Name string
+	// Deprecated is when the version was deprecated. The version is not deprecated if zero.
+	Deprecated time.Time
+	// Sunset is when the version stops being served. Not scheduled if zero.
+	Sunset time.Time
+	// Successor is the name of the version replacing this one, if any
+	Successor string
+}
+
+// deprecationHeaders middleware marking the responses of a deprecated API version with the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers, and a link to the same path in the
+// successor version
+func (v APIVersion) deprecationHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", v.Deprecated.Unix()))
+		if !v.Sunset.IsZero() {
+			w.Header().Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if v.Successor != "" {
+			current := "/" + v.Name + "/"
+			if idx := strings.Index(r.URL.Path, current); idx >= 0 {
+				successor := r.URL.Path[:idx] + "/" + v.Successor + "/" + r.URL.Path[idx+len(current):]
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RegisterAPIVersions registers the path prefix of each API version, and calls define to
+// register the routes of that version. The versions are served side by side; responses of
+// a deprecated version carry deprecation headers.
+func RegisterAPIVersions(
+	parentRouter *mux.Router,
+	versions []APIVersion,
+	define func(version APIVersion, versionRouter *mux.Router),
+) {
+	for _, version := range versions {
+		versionRouter := RegisterPathPrefix(parentRouter, "/"+version.Name, nil)
+		if !version.Deprecated.IsZero() {
+			versionRouter.Use(version.deprecationHeaders)
+		}
+		define(version, versionRouter)
+	}
+}
+
+// APIFeatureGates the feature-gated API handlers which are enabled, by feature name
+type APIFeatureGates map[string]bool
+
+// Gate returns the handlers of a feature-gated route if the feature is enabled. Otherwise,
+// no handlers are returned, so the route is not found.
+func (g APIFeatureGates) Gate(feature string, methodHandlers MethodHandlers) MethodHandlers {
+	if g[feature] {
+		return methodHandlers
+	}
+	return nil
+}
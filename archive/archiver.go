@@ -0,0 +1,622 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/alwitt/httpmq/storage"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrUnknownArchive returned when an archive is not defined
+var ErrUnknownArchive = errors.New("unknown archive")
+
+// ErrInvalidDefinition returned when an archive definition can not be used
+var ErrInvalidDefinition = errors.New("invalid archive definition")
+
+// archiveNamePattern is the pattern of valid archive names, which are used in object keys
+var archiveNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// archivePollInterval is the longest a worker waits for messages before checking whether
+// its batch is due, or it is stopped
+const archivePollInterval = time.Second
+
+// archiveRetryDelay is how long a worker waits after failing to archive a batch
+const archiveRetryDelay = time.Second * 5
+
+// Definition defines an archive of a stream, read through a durable pull consumer
+type Definition struct {
+	// Name is the name of the archive. Its objects are stored under "<name>/".
+	Name string `json:"name" validate:"required"`
+	// Stream is the name of the stream archived
+	Stream string `json:"stream" validate:"required"`
+	// Consumer is the durable pull consumer the archive drains. Messages not matching its
+	// filter are not archived.
+	Consumer string `json:"consumer" validate:"required"`
+	// BatchSize is the max number of messages per archive file
+	BatchSize int `json:"batch_size" validate:"required,gte=1,lte=100000"`
+	// FlushInterval is the longest a message waits before its batch is written, even if the
+	// batch is not full. It must be shorter than the consumer's ACK wait.
+	FlushInterval time.Duration `json:"flush_interval" validate:"required,gte=1000000000" swaggertype:"primitive,integer"`
+}
+
+// Status is the state of the worker of an archive on this instance
+type Status struct {
+	// Running indicates the worker is draining the consumer
+	Running bool `json:"running"`
+	// Files is the number of files written since the worker started
+	Files uint64 `json:"files"`
+	// Messages is the number of messages archived since the worker started
+	Messages uint64 `json:"messages"`
+	// LastSequence is the stream sequence number of the last message archived
+	LastSequence uint64 `json:"last_sequence,omitempty"`
+	// LastFlush is when the last file was written
+	LastFlush *time.Time `json:"last_flush,omitempty"`
+	// LastError describes the last failure of the worker, cleared once a file is written
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Info describes an archive
+type Info struct {
+	// Definition is the definition of the archive
+	Definition Definition `json:"definition"`
+	// Status is the state of the archive's worker
+	Status Status `json:"status"`
+}
+
+// ManifestEntry indexes one archive file
+type ManifestEntry struct {
+	// Key is the object key of the file
+	Key string `json:"key"`
+	// FirstSequence is the lowest stream sequence number of the messages in the file
+	FirstSequence uint64 `json:"first_seq"`
+	// LastSequence is the highest stream sequence number of the messages in the file
+	LastSequence uint64 `json:"last_seq"`
+	// FirstTime is the earliest store time of the messages in the file
+	FirstTime time.Time `json:"first_time"`
+	// LastTime is the latest store time of the messages in the file
+	LastTime time.Time `json:"last_time"`
+	// Messages is the number of messages in the file
+	Messages int `json:"messages"`
+	// Bytes is the compressed size of the file
+	Bytes int `json:"bytes"`
+}
+
+// Manifest indexes the files of an archive, ordered by sequence number
+type Manifest struct {
+	// Archive is the name of the archive
+	Archive string `json:"archive"`
+	// Stream is the name of the stream archived
+	Stream string `json:"stream"`
+	// Files are the archive files
+	Files []ManifestEntry `json:"files"`
+	// Updated is when the manifest was last written
+	Updated time.Time `json:"updated"`
+}
+
+// manifestKey helper function to define the object key of the manifest of an archive
+func manifestKey(archive string) string {
+	return fmt.Sprintf("%s/manifest.json", archive)
+}
+
+// fileKey helper function to define the object key of an archive file
+func fileKey(archive string, first, last uint64) string {
+	return fmt.Sprintf("%s/data/%020d-%020d.ndjson.gz", archive, first, last)
+}
+
+// add records a file in the manifest, replacing the entry of a previous write of the file
+func (m *Manifest) add(entry ManifestEntry) {
+	for idx, existing := range m.Files {
+		if existing.Key == entry.Key {
+			m.Files[idx] = entry
+			return
+		}
+	}
+	m.Files = append(m.Files, entry)
+	sort.SliceStable(m.Files, func(i, j int) bool {
+		return m.Files[i].FirstSequence < m.Files[j].FirstSequence
+	})
+}
+
+// writeArchiveFile encode a batch of messages as a gzip compressed NDJSON archive file, one
+// export message per line. Returns the file, and its manifest entry without the key.
+func writeArchiveFile(msgs []*nats.Msg) ([]byte, ManifestEntry, error) {
+	entry := ManifestEntry{}
+	buf := bytes.Buffer{}
+	writer := gzip.NewWriter(&buf)
+	for idx, msg := range msgs {
+		converted, err := dataplane.ConvertExportMessage(msg)
+		if err != nil {
+			return nil, entry, err
+		}
+		if idx == 0 || converted.Sequence < entry.FirstSequence {
+			entry.FirstSequence = converted.Sequence
+		}
+		if converted.Sequence > entry.LastSequence {
+			entry.LastSequence = converted.Sequence
+		}
+		if idx == 0 || converted.Timestamp.Before(entry.FirstTime) {
+			entry.FirstTime = converted.Timestamp
+		}
+		if converted.Timestamp.After(entry.LastTime) {
+			entry.LastTime = converted.Timestamp
+		}
+		serialize, err := common.JSON().Marshal(&converted)
+		if err != nil {
+			return nil, entry, err
+		}
+		if _, err := writer.Write(append(serialize, '\n')); err != nil {
+			return nil, entry, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, entry, err
+	}
+	entry.Messages = len(msgs)
+	entry.Bytes = buf.Len()
+	return buf.Bytes(), entry, nil
+}
+
+// Archiver manages the archives of streams, and runs their workers. Each worker drains its
+// archive's consumer in batches, writes each batch as a file to the object store, records
+// the file in the archive's manifest, and only then ACKs the messages.
+type Archiver interface {
+	// PutArchive defines an archive, replacing any archive of the same name, and starts its
+	// worker
+	PutArchive(definition Definition, ctxt context.Context) (Info, error)
+	// GetArchive describes an archive. Returns ErrUnknownArchive if it is not defined.
+	GetArchive(name string, ctxt context.Context) (Info, error)
+	// ListArchives describes all archives
+	ListArchives(ctxt context.Context) ([]Info, error)
+	// DeleteArchive stops the worker of an archive, and removes its definition. The archive
+	// files and manifest are kept.
+	DeleteArchive(name string, ctxt context.Context) error
+	// GetManifest reads the manifest of an archive. Returns ErrUnknownArchive if the archive
+	// has no manifest.
+	GetManifest(name string, ctxt context.Context) (Manifest, error)
+	// Close stops all workers
+	Close() error
+}
+
+// archiveWorker the worker of one archive
+type archiveWorker struct {
+	definition Definition
+	lock       sync.Mutex
+	status     Status
+	stop       context.CancelFunc
+	done       chan struct{}
+}
+
+// getStatus helper function to read the status of the worker
+func (w *archiveWorker) getStatus() Status {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.status
+}
+
+// setError helper function to record a failure of the worker
+func (w *archiveWorker) setError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.status.LastError = err.Error()
+}
+
+// archiverImpl implements Archiver
+type archiverImpl struct {
+	common.Component
+	nats        *core.NatsClient
+	definitions storage.KeyValueStore
+	objects     ObjectStore
+	validate    *validator.Validate
+	lock        sync.Mutex
+	workers     map[string]*archiveWorker
+	runCtxt     context.Context
+}
+
+// GetArchiver define a new Archiver, storing archive definitions in definitions and archive
+// files in objects. The workers of the stored archives are started, and run until Close is
+// called or ctxt ends.
+//
+// Only one instance should run the workers of an archive.
+func GetArchiver(
+	natsClient *core.NatsClient,
+	definitions storage.KeyValueStore,
+	objects ObjectStore,
+	instance string,
+	ctxt context.Context,
+) (Archiver, error) {
+	logTags := log.Fields{
+		"module": "archive", "component": "archiver", "instance": instance,
+	}
+	archiver := &archiverImpl{
+		Component:   common.Component{LogTags: logTags},
+		nats:        natsClient,
+		definitions: definitions,
+		objects:     objects,
+		validate:    validator.New(),
+		workers:     map[string]*archiveWorker{},
+		runCtxt:     ctxt,
+	}
+	names, err := definitions.Keys("", ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to list archives")
+		return nil, err
+	}
+	for _, name := range names {
+		definition, err := archiver.readDefinition(name, ctxt)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read archive %s", name)
+			return nil, err
+		}
+		archiver.startWorker(definition)
+	}
+	return archiver, nil
+}
+
+// readDefinition helper function to read the stored definition of an archive
+func (a *archiverImpl) readDefinition(name string, ctxt context.Context) (Definition, error) {
+	var definition Definition
+	raw, err := a.definitions.Get(name, ctxt)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return definition, ErrUnknownArchive
+	} else if err != nil {
+		return definition, err
+	}
+	err = json.Unmarshal(raw, &definition)
+	return definition, err
+}
+
+// checkDefinition helper function to verify an archive can drain its consumer
+func (a *archiverImpl) checkDefinition(definition Definition) error {
+	if err := a.validate.Struct(&definition); err != nil {
+		return err
+	}
+	if !archiveNamePattern.MatchString(definition.Name) {
+		return fmt.Errorf("archive name '%s' must only contain [a-zA-Z0-9_-]", definition.Name)
+	}
+	info, err := a.nats.JetStream().ConsumerInfo(definition.Stream, definition.Consumer)
+	if err != nil {
+		return err
+	}
+	if info.Config.Durable == "" || info.Config.DeliverSubject != "" {
+		return fmt.Errorf("consumer %s is not a durable pull consumer", definition.Consumer)
+	}
+	if info.Config.AckPolicy == nats.AckNonePolicy {
+		return fmt.Errorf("consumer %s does not require ACKs", definition.Consumer)
+	}
+	if definition.FlushInterval >= info.Config.AckWait {
+		return fmt.Errorf(
+			"flush interval %s is not shorter than the ACK wait %s of consumer %s",
+			definition.FlushInterval,
+			info.Config.AckWait,
+			definition.Consumer,
+		)
+	}
+	if info.Config.MaxAckPending > 0 && definition.BatchSize > info.Config.MaxAckPending {
+		return fmt.Errorf(
+			"batch size %d is above the max ACK pending %d of consumer %s",
+			definition.BatchSize,
+			info.Config.MaxAckPending,
+			definition.Consumer,
+		)
+	}
+	return nil
+}
+
+// PutArchive defines an archive, and starts its worker
+func (a *archiverImpl) PutArchive(definition Definition, ctxt context.Context) (Info, error) {
+	localLogTags, err := common.UpdateLogTags(a.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(a.LogTags).Errorf("Failed to update logtags")
+		return Info{}, err
+	}
+	if err := a.checkDefinition(definition); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Invalid archive %s", definition.Name)
+		return Info{}, fmt.Errorf("%w: %s", ErrInvalidDefinition, err)
+	}
+	serialize, err := json.Marshal(&definition)
+	if err != nil {
+		return Info{}, err
+	}
+	if err := a.definitions.Put(definition.Name, serialize, ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to store archive %s", definition.Name,
+		)
+		return Info{}, err
+	}
+	a.stopWorker(definition.Name)
+	worker := a.startWorker(definition)
+	log.WithFields(localLogTags).Infof(
+		"Archiving consumer %s@%s as %s", definition.Consumer, definition.Stream, definition.Name,
+	)
+	return Info{Definition: definition, Status: worker.getStatus()}, nil
+}
+
+// describe helper function to describe an archive
+func (a *archiverImpl) describe(definition Definition) Info {
+	info := Info{Definition: definition}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if worker, ok := a.workers[definition.Name]; ok {
+		info.Status = worker.getStatus()
+	}
+	return info
+}
+
+// GetArchive describes an archive
+func (a *archiverImpl) GetArchive(name string, ctxt context.Context) (Info, error) {
+	definition, err := a.readDefinition(name, ctxt)
+	if err != nil {
+		return Info{}, err
+	}
+	return a.describe(definition), nil
+}
+
+// ListArchives describes all archives
+func (a *archiverImpl) ListArchives(ctxt context.Context) ([]Info, error) {
+	names, err := a.definitions.Keys("", ctxt)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	result := []Info{}
+	for _, name := range names {
+		definition, err := a.readDefinition(name, ctxt)
+		if errors.Is(err, ErrUnknownArchive) {
+			// Deleted while listing
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, a.describe(definition))
+	}
+	return result, nil
+}
+
+// DeleteArchive stops the worker of an archive, and removes its definition
+func (a *archiverImpl) DeleteArchive(name string, ctxt context.Context) error {
+	if _, err := a.readDefinition(name, ctxt); err != nil {
+		return err
+	}
+	a.stopWorker(name)
+	return a.definitions.Delete(name, ctxt)
+}
+
+// readManifest helper function to read the manifest of an archive
+func readManifest(objects ObjectStore, name string, ctxt context.Context) (Manifest, error) {
+	var manifest Manifest
+	raw, err := objects.GetObject(manifestKey(name), ctxt)
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(raw, &manifest)
+	return manifest, err
+}
+
+// GetManifest reads the manifest of an archive
+func (a *archiverImpl) GetManifest(name string, ctxt context.Context) (Manifest, error) {
+	manifest, err := readManifest(a.objects, name, ctxt)
+	if errors.Is(err, ErrObjectNotFound) {
+		return manifest, ErrUnknownArchive
+	}
+	return manifest, err
+}
+
+// Close stops all workers
+func (a *archiverImpl) Close() error {
+	a.lock.Lock()
+	names := make([]string, 0, len(a.workers))
+	for name := range a.workers {
+		names = append(names, name)
+	}
+	a.lock.Unlock()
+	for _, name := range names {
+		a.stopWorker(name)
+	}
+	return nil
+}
+
+// startWorker helper function to start the worker of an archive
+func (a *archiverImpl) startWorker(definition Definition) *archiveWorker {
+	ctxt, cancel := context.WithCancel(a.runCtxt)
+	worker := &archiveWorker{
+		definition: definition,
+		status:     Status{Running: true},
+		stop:       cancel,
+		done:       make(chan struct{}),
+	}
+	a.lock.Lock()
+	a.workers[definition.Name] = worker
+	a.lock.Unlock()
+	go func() {
+		defer close(worker.done)
+		a.runWorker(worker, ctxt)
+		worker.lock.Lock()
+		worker.status.Running = false
+		worker.lock.Unlock()
+	}()
+	return worker
+}
+
+// stopWorker helper function to stop the worker of an archive, and wait for it to end
+func (a *archiverImpl) stopWorker(name string) {
+	a.lock.Lock()
+	worker, ok := a.workers[name]
+	delete(a.workers, name)
+	a.lock.Unlock()
+	if ok {
+		worker.stop()
+		<-worker.done
+	}
+}
+
+// runWorker drain the consumer of an archive until ctxt ends
+func (a *archiverImpl) runWorker(worker *archiveWorker, ctxt context.Context) {
+	definition := worker.definition
+	logTags := log.Fields{}
+	for key, value := range a.LogTags {
+		logTags[key] = value
+	}
+	logTags["archive"] = definition.Name
+
+	var sub *nats.Subscription
+	for sub == nil {
+		info, err := a.nats.JetStream().ConsumerInfo(definition.Stream, definition.Consumer)
+		if err == nil {
+			sub, err = a.nats.JetStream().PullSubscribe(
+				info.Config.FilterSubject,
+				definition.Consumer,
+				nats.Bind(definition.Stream, definition.Consumer),
+			)
+		}
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf(
+				"Unable to pull subscribe with %s@%s", definition.Consumer, definition.Stream,
+			)
+			worker.setError(err)
+			select {
+			case <-ctxt.Done():
+				return
+			case <-time.After(archiveRetryDelay):
+			}
+		}
+	}
+	// Bound subscriptions do not delete the consumer when unsubscribing
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unsubscribe failed")
+		}
+	}()
+
+	batch := []*nats.Msg{}
+	var flushAt time.Time
+	// Messages not yet archived are redelivered sooner if NAKed
+	defer func() {
+		for _, msg := range batch {
+			_ = msg.Nak()
+		}
+	}()
+	for ctxt.Err() == nil {
+		wait := archivePollInterval
+		if len(batch) > 0 {
+			if untilFlush := time.Until(flushAt); untilFlush < wait {
+				wait = untilFlush
+			}
+		}
+		if wait > 0 {
+			fetchCtxt, cancel := context.WithTimeout(ctxt, wait)
+			msgs, err := sub.Fetch(definition.BatchSize-len(batch), nats.Context(fetchCtxt))
+			cancel()
+			if err != nil && fetchCtxt.Err() == nil {
+				log.WithError(err).WithFields(logTags).Errorf(
+					"Unable to fetch from %s@%s", definition.Consumer, definition.Stream,
+				)
+				worker.setError(err)
+				select {
+				case <-ctxt.Done():
+				case <-time.After(archiveRetryDelay):
+				}
+				continue
+			}
+			if len(batch) == 0 && len(msgs) > 0 {
+				flushAt = time.Now().Add(definition.FlushInterval)
+			}
+			batch = append(batch, msgs...)
+		}
+		if len(batch) == 0 ||
+			(len(batch) < definition.BatchSize && time.Now().Before(flushAt)) {
+			continue
+		}
+		if err := a.archiveBatch(worker, batch, ctxt); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf(
+				"Failed to archive %d messages", len(batch),
+			)
+			worker.setError(err)
+			for _, msg := range batch {
+				_ = msg.Nak()
+			}
+			batch = batch[:0]
+			select {
+			case <-ctxt.Done():
+			case <-time.After(archiveRetryDelay):
+			}
+			continue
+		}
+		for _, msg := range batch {
+			if err := msg.Ack(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to ACK archived message")
+			}
+		}
+		batch = batch[:0]
+	}
+}
+
+// archiveBatch write a batch of messages as an archive file, and record it in the manifest
+// of the archive
+func (a *archiverImpl) archiveBatch(
+	worker *archiveWorker, batch []*nats.Msg, ctxt context.Context,
+) error {
+	name := worker.definition.Name
+	file, entry, err := writeArchiveFile(batch)
+	if err != nil {
+		return err
+	}
+	entry.Key = fileKey(name, entry.FirstSequence, entry.LastSequence)
+	if err := a.objects.PutObject(entry.Key, file, "application/gzip", ctxt); err != nil {
+		return err
+	}
+	manifest, err := readManifest(a.objects, name, ctxt)
+	if errors.Is(err, ErrObjectNotFound) {
+		manifest = Manifest{Archive: name, Stream: worker.definition.Stream}
+	} else if err != nil {
+		return err
+	}
+	manifest.add(entry)
+	manifest.Updated = time.Now().UTC()
+	serialize, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	if err := a.objects.PutObject(manifestKey(name), serialize, "application/json", ctxt); err != nil {
+		return err
+	}
+
+	worker.lock.Lock()
+	defer worker.lock.Unlock()
+	worker.status.Files++
+	worker.status.Messages += uint64(entry.Messages)
+	if entry.LastSequence > worker.status.LastSequence {
+		worker.status.LastSequence = entry.LastSequence
+	}
+	flushed := manifest.Updated
+	worker.status.LastFlush = &flushed
+	worker.status.LastError = ""
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryObjectStore an in-memory ObjectStore
+type memoryObjectStore struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memoryObjectStore) PutObject(
+	key string, body []byte, contentType string, ctxt context.Context,
+) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[key] = body
+	return nil
+}
+
+func (s *memoryObjectStore) GetObject(key string, ctxt context.Context) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	body, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return body, nil
+}
+
+// testArchiveMsg helper function to define a JetStream message of stream "orders"
+func testArchiveMsg(seq uint64) *nats.Msg {
+	msg := nats.NewMsg("orders.new")
+	msg.Reply = fmt.Sprintf("$JS.ACK.orders.c.1.%d.%d.%d.0", seq, seq, 1634000000000000000+seq)
+	msg.Data = []byte(fmt.Sprintf("order-%d", seq))
+	msg.Sub = &nats.Subscription{}
+	return msg
+}
+
+func TestWriteArchiveFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file, entry, err := writeArchiveFile(
+		[]*nats.Msg{testArchiveMsg(12), testArchiveMsg(10), testArchiveMsg(11)},
+	)
+	assert.Nil(err)
+	assert.Equal(uint64(10), entry.FirstSequence)
+	assert.Equal(uint64(12), entry.LastSequence)
+	assert.Equal(int64(1634000000000000010), entry.FirstTime.UnixNano())
+	assert.Equal(int64(1634000000000000012), entry.LastTime.UnixNano())
+	assert.Equal(3, entry.Messages)
+	assert.Equal(len(file), entry.Bytes)
+
+	reader, err := gzip.NewReader(bytes.NewReader(file))
+	assert.Nil(err)
+	scanner := bufio.NewScanner(reader)
+	lines := []dataplane.ExportMessage{}
+	for scanner.Scan() {
+		var line dataplane.ExportMessage
+		assert.Nil(common.JSON().Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	assert.Len(lines, 3)
+	assert.Equal(uint64(12), lines[0].Sequence)
+	assert.Equal([]byte("order-12"), lines[0].Message)
+
+	// Case 1: not a JetStream message
+	_, _, err = writeArchiveFile([]*nats.Msg{nats.NewMsg("orders.new")})
+	assert.NotNil(err)
+}
+
+func TestArchiveBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	objects := &memoryObjectStore{objects: map[string][]byte{}}
+	uut := &archiverImpl{objects: objects}
+	worker := &archiveWorker{definition: Definition{Name: "orders-archive", Stream: "orders"}}
+	ctxt := context.Background()
+
+	// Case 0: no manifest yet
+	{
+		_, err := uut.GetManifest("orders-archive", ctxt)
+		assert.ErrorIs(err, ErrUnknownArchive)
+	}
+
+	// Case 1: batches are indexed in sequence order
+	assert.Nil(uut.archiveBatch(worker, []*nats.Msg{testArchiveMsg(3), testArchiveMsg(4)}, ctxt))
+	assert.Nil(uut.archiveBatch(worker, []*nats.Msg{testArchiveMsg(1), testArchiveMsg(2)}, ctxt))
+	manifest, err := uut.GetManifest("orders-archive", ctxt)
+	assert.Nil(err)
+	assert.Equal("orders", manifest.Stream)
+	assert.Len(manifest.Files, 2)
+	assert.Equal(uint64(1), manifest.Files[0].FirstSequence)
+	assert.Equal("orders-archive/data/00000000000000000001-00000000000000000002.ndjson.gz",
+		manifest.Files[0].Key)
+	assert.Contains(objects.objects, manifest.Files[0].Key)
+	assert.Equal(uint64(3), manifest.Files[1].FirstSequence)
+
+	status := worker.getStatus()
+	assert.Equal(uint64(2), status.Files)
+	assert.Equal(uint64(4), status.Messages)
+	assert.Equal(uint64(4), status.LastSequence)
+	assert.NotNil(status.LastFlush)
+
+	// Case 2: rewriting a batch replaces its entry
+	assert.Nil(uut.archiveBatch(worker, []*nats.Msg{testArchiveMsg(1), testArchiveMsg(2)}, ctxt))
+	{
+		raw, err := objects.GetObject(manifestKey("orders-archive"), ctxt)
+		assert.Nil(err)
+		var manifest Manifest
+		assert.Nil(json.Unmarshal(raw, &manifest))
+		assert.Len(manifest.Files, 2)
+	}
+}
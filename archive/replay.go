@@ -0,0 +1,407 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrUnknownReplay returned when a replay is not known
+var ErrUnknownReplay = errors.New("unknown replay")
+
+// ErrInvalidReplay returned when a replay can not be started with its parameters
+var ErrInvalidReplay = errors.New("invalid replay")
+
+// maxFinishedReplays is the number of finished replays kept for querying
+const maxFinishedReplays = 64
+
+// replayAckWait is how long a replayed message waits for its publish ACK
+const replayAckWait = time.Second * 30
+
+// Headers added to replayed messages
+const (
+	// ReplaySourceStreamHeader is the stream a replayed message was archived from
+	ReplaySourceStreamHeader = "Httpmq-Replay-Source-Stream"
+	// ReplaySourceSubjectHeader is the subject a replayed message was originally published to
+	ReplaySourceSubjectHeader = "Httpmq-Replay-Source-Subject"
+	// ReplaySourceSequenceHeader is the stream sequence number of a replayed message
+	ReplaySourceSequenceHeader = "Httpmq-Replay-Source-Sequence"
+)
+
+// ReplayState is the state of a replay
+type ReplayState string
+
+const (
+	// ReplayRunning the replay is publishing messages
+	ReplayRunning ReplayState = "running"
+	// ReplayCompleted all messages in the range were published
+	ReplayCompleted ReplayState = "completed"
+	// ReplayCancelled the replay was cancelled
+	ReplayCancelled ReplayState = "cancelled"
+	// ReplayFailed the replay stopped on an error
+	ReplayFailed ReplayState = "failed"
+)
+
+// ReplayParam selects the archived messages to replay, and where to
+type ReplayParam struct {
+	// Archive is the name of the archive
+	Archive string `json:"archive" validate:"required"`
+	// StartTime is the earliest store time of the messages replayed. No limit if zero.
+	StartTime time.Time `json:"start_time,omitempty"`
+	// EndTime is the latest store time of the messages replayed. No limit if zero.
+	EndTime time.Time `json:"end_time,omitempty"`
+	// Subject is the subject the messages are published to
+	Subject string `json:"subject" validate:"required"`
+	// Rate is the max number of messages per second published. Zero means no limit.
+	Rate float64 `json:"rate,omitempty" validate:"gte=0"`
+}
+
+// ReplayProgress is the progress of a replay
+type ReplayProgress struct {
+	// ID identifies the replay
+	ID string `json:"id"`
+	// Param are the parameters of the replay
+	Param ReplayParam `json:"param"`
+	// State is the state of the replay
+	State ReplayState `json:"state"`
+	// Files is the number of archive files in the range
+	Files int `json:"files"`
+	// FilesRead is the number of archive files read
+	FilesRead int `json:"files_read"`
+	// Published is the number of messages published
+	Published uint64 `json:"published"`
+	// LastSequence is the stream sequence number of the last message published
+	LastSequence uint64 `json:"last_sequence,omitempty"`
+	// Started is when the replay started
+	Started time.Time `json:"started"`
+	// Ended is when the replay ended
+	Ended *time.Time `json:"ended,omitempty"`
+	// Error describes the failure which stopped the replay
+	Error string `json:"error,omitempty"`
+}
+
+// inRange helper function to check whether a store time is within the replay range
+func (p ReplayParam) inRange(timestamp time.Time) bool {
+	if !p.StartTime.IsZero() && timestamp.Before(p.StartTime) {
+		return false
+	}
+	if !p.EndTime.IsZero() && timestamp.After(p.EndTime) {
+		return false
+	}
+	return true
+}
+
+// selectFiles helper function to select the files of a manifest which may hold messages in
+// the replay range
+func (p ReplayParam) selectFiles(manifest Manifest) []ManifestEntry {
+	selected := []ManifestEntry{}
+	for _, entry := range manifest.Files {
+		if !p.StartTime.IsZero() && entry.LastTime.Before(p.StartTime) {
+			continue
+		}
+		if !p.EndTime.IsZero() && entry.FirstTime.After(p.EndTime) {
+			continue
+		}
+		selected = append(selected, entry)
+	}
+	return selected
+}
+
+// Replayer re-publishes archived messages. The messages of each archive file are published
+// in the order they were archived, with their original headers, and headers recording their
+// source. Each message is published with a message ID derived from the replay and its
+// sequence number, so messages archived in more than one file are only stored once within
+// the duplicate window of the target stream.
+type Replayer interface {
+	// StartReplay starts replaying the archived messages of a time range
+	StartReplay(param ReplayParam, ctxt context.Context) (ReplayProgress, error)
+	// GetReplay reports the progress of a replay. Returns ErrUnknownReplay if the replay is
+	// not known.
+	GetReplay(id string) (ReplayProgress, error)
+	// ListReplays reports the progress of the running and recently finished replays
+	ListReplays() []ReplayProgress
+	// CancelReplay stops a running replay
+	CancelReplay(id string) error
+}
+
+// replayRun a replay known to the replayer
+type replayRun struct {
+	progress ReplayProgress
+	cancel   context.CancelFunc
+}
+
+// replayerImpl implements Replayer
+type replayerImpl struct {
+	common.Component
+	objects   ObjectStore
+	publisher dataplane.JetStreamPublisher
+	validate  *validator.Validate
+	lock      sync.Mutex
+	replays   map[string]*replayRun
+	runCtxt   context.Context
+	wg        *sync.WaitGroup
+}
+
+// GetReplayer define a new Replayer, reading archives from objects, and publishing through
+// publisher. Replays run until cancelled, or ctxt ends.
+func GetReplayer(
+	objects ObjectStore,
+	publisher dataplane.JetStreamPublisher,
+	instance string,
+	ctxt context.Context,
+	wg *sync.WaitGroup,
+) (Replayer, error) {
+	logTags := log.Fields{
+		"module": "archive", "component": "replayer", "instance": instance,
+	}
+	return &replayerImpl{
+		Component: common.Component{LogTags: logTags},
+		objects:   objects,
+		publisher: publisher,
+		validate:  validator.New(),
+		replays:   map[string]*replayRun{},
+		runCtxt:   ctxt,
+		wg:        wg,
+	}, nil
+}
+
+// StartReplay starts replaying the archived messages of a time range
+func (r *replayerImpl) StartReplay(
+	param ReplayParam, ctxt context.Context,
+) (ReplayProgress, error) {
+	localLogTags, err := common.UpdateLogTags(r.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to update logtags")
+		return ReplayProgress{}, err
+	}
+	if err := r.validate.Struct(&param); err != nil {
+		return ReplayProgress{}, fmt.Errorf("%w: %s", ErrInvalidReplay, err)
+	}
+	if !param.StartTime.IsZero() && !param.EndTime.IsZero() && param.EndTime.Before(param.StartTime) {
+		return ReplayProgress{}, fmt.Errorf("%w: end time is before start time", ErrInvalidReplay)
+	}
+	manifest, err := readManifest(r.objects, param.Archive, ctxt)
+	if errors.Is(err, ErrObjectNotFound) {
+		return ReplayProgress{}, ErrUnknownArchive
+	} else if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to read manifest of archive %s", param.Archive,
+		)
+		return ReplayProgress{}, err
+	}
+	files := param.selectFiles(manifest)
+
+	runCtxt, cancel := context.WithCancel(r.runCtxt)
+	run := &replayRun{
+		progress: ReplayProgress{
+			ID:      uuid.New().String(),
+			Param:   param,
+			State:   ReplayRunning,
+			Files:   len(files),
+			Started: time.Now().UTC(),
+		},
+		cancel: cancel,
+	}
+	r.lock.Lock()
+	r.dropFinished()
+	r.replays[run.progress.ID] = run
+	progress := run.progress
+	r.lock.Unlock()
+
+	log.WithFields(localLogTags).Infof(
+		"Replaying %d files of archive %s to %s as %s",
+		len(files), param.Archive, param.Subject, progress.ID,
+	)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+		err := r.replay(run, files, runCtxt)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		ended := time.Now().UTC()
+		run.progress.Ended = &ended
+		switch {
+		case err == nil:
+			run.progress.State = ReplayCompleted
+		case runCtxt.Err() != nil:
+			run.progress.State = ReplayCancelled
+		default:
+			run.progress.State = ReplayFailed
+			run.progress.Error = err.Error()
+		}
+		log.WithError(err).WithFields(r.LogTags).Infof(
+			"Replay %s %s: %d published", run.progress.ID, run.progress.State, run.progress.Published,
+		)
+	}()
+	return progress, nil
+}
+
+// dropFinished helper function to forget the oldest finished replays beyond the number kept.
+// The lock must be held.
+func (r *replayerImpl) dropFinished() {
+	finished := []*replayRun{}
+	for _, run := range r.replays {
+		if run.progress.Ended != nil {
+			finished = append(finished, run)
+		}
+	}
+	if len(finished) < maxFinishedReplays {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].progress.Ended.Before(*finished[j].progress.Ended)
+	})
+	for _, run := range finished[:len(finished)-maxFinishedReplays+1] {
+		delete(r.replays, run.progress.ID)
+	}
+}
+
+// replay publish the messages of the selected files in the replay range
+func (r *replayerImpl) replay(run *replayRun, files []ManifestEntry, ctxt context.Context) error {
+	param := run.progress.Param
+	var interval time.Duration
+	if param.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / param.Rate)
+	}
+	var lastSent time.Time
+	for _, entry := range files {
+		file, err := r.objects.GetObject(entry.Key, ctxt)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", entry.Key, err)
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(file))
+		if err != nil {
+			return fmt.Errorf("unable to decompress %s: %w", entry.Key, err)
+		}
+		lines := bufio.NewReader(reader)
+		for {
+			line, readErr := lines.ReadBytes('\n')
+			if readErr != nil && readErr != io.EOF {
+				return fmt.Errorf("unable to read %s: %w", entry.Key, readErr)
+			}
+			if len(bytes.TrimSpace(line)) > 0 {
+				var archived dataplane.ExportMessage
+				if err := common.JSON().Unmarshal(line, &archived); err != nil {
+					return fmt.Errorf("unable to parse %s: %w", entry.Key, err)
+				}
+				if param.inRange(archived.Timestamp) {
+					if interval > 0 {
+						select {
+						case <-ctxt.Done():
+							return ctxt.Err()
+						case <-time.After(time.Until(lastSent.Add(interval))):
+						}
+					}
+					if err := r.publish(run, archived, ctxt); err != nil {
+						return err
+					}
+					lastSent = time.Now()
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+		}
+		r.lock.Lock()
+		run.progress.FilesRead++
+		r.lock.Unlock()
+	}
+	return nil
+}
+
+// publish helper function to publish one archived message to the replay subject
+func (r *replayerImpl) publish(
+	run *replayRun, archived dataplane.ExportMessage, ctxt context.Context,
+) error {
+	msg := nats.NewMsg(run.progress.Param.Subject)
+	for name, values := range archived.Headers {
+		for _, value := range values {
+			msg.Header.Add(name, value)
+		}
+	}
+	msg.Header.Set(ReplaySourceStreamHeader, archived.Stream)
+	msg.Header.Set(ReplaySourceSubjectHeader, archived.Subject)
+	msg.Header.Set(ReplaySourceSequenceHeader, strconv.FormatUint(archived.Sequence, 10))
+	msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s-%d", run.progress.ID, archived.Sequence))
+	msg.Data = archived.Message
+	publishCtxt, cancel := context.WithTimeout(ctxt, replayAckWait)
+	defer cancel()
+	if result := r.publisher.PublishMsg(msg, publishCtxt); result.Err != nil {
+		if ctxt.Err() != nil {
+			return ctxt.Err()
+		}
+		return fmt.Errorf("unable to publish sequence %d: %w", archived.Sequence, result.Err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	run.progress.Published++
+	run.progress.LastSequence = archived.Sequence
+	return nil
+}
+
+// GetReplay reports the progress of a replay
+func (r *replayerImpl) GetReplay(id string) (ReplayProgress, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	run, ok := r.replays[id]
+	if !ok {
+		return ReplayProgress{}, ErrUnknownReplay
+	}
+	return run.progress, nil
+}
+
+// ListReplays reports the progress of the running and recently finished replays
+func (r *replayerImpl) ListReplays() []ReplayProgress {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make([]ReplayProgress, 0, len(r.replays))
+	for _, run := range r.replays {
+		result = append(result, run.progress)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started.Before(result[j].Started)
+	})
+	return result
+}
+
+// CancelReplay stops a running replay
+func (r *replayerImpl) CancelReplay(id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	run, ok := r.replays[id]
+	if !ok {
+		return ErrUnknownReplay
+	}
+	run.cancel()
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeReplayPublisher records the messages published, blocking while hold is set
+type fakeReplayPublisher struct {
+	dataplane.JetStreamPublisher
+	lock      sync.Mutex
+	hold      chan struct{}
+	published []*nats.Msg
+}
+
+func (p *fakeReplayPublisher) PublishMsg(
+	msg *nats.Msg, ctxt context.Context,
+) dataplane.PublishResult {
+	if p.hold != nil {
+		select {
+		case <-p.hold:
+		case <-ctxt.Done():
+			return dataplane.PublishResult{Subject: msg.Subject, Err: ctxt.Err()}
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.published = append(p.published, msg)
+	return dataplane.PublishResult{Subject: msg.Subject}
+}
+
+// waitReplay helper function to wait for a replay to end
+func waitReplay(t *testing.T, uut Replayer, id string) ReplayProgress {
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); {
+		progress, err := uut.GetReplay(id)
+		assert.Nil(t, err)
+		if progress.State != ReplayRunning {
+			return progress
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("Replay %s did not end", id)
+	return ReplayProgress{}
+}
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-replay"
+
+	objects := &memoryObjectStore{objects: map[string][]byte{}}
+	archiver := &archiverImpl{objects: objects}
+	worker := &archiveWorker{definition: Definition{Name: "orders-archive", Stream: "orders"}}
+	ctxt := context.Background()
+	for first := uint64(1); first <= 9; first += 3 {
+		batch := []*nats.Msg{}
+		for seq := first; seq < first+3; seq++ {
+			msg := testArchiveMsg(seq)
+			msg.Header.Set("Trace-ID", fmt.Sprintf("t%d", seq))
+			batch = append(batch, msg)
+		}
+		assert.Nil(archiver.archiveBatch(worker, batch, ctxt))
+	}
+	timeOf := func(seq uint64) time.Time {
+		return time.Unix(0, int64(1634000000000000000+seq))
+	}
+
+	publisher := &fakeReplayPublisher{}
+	wg := sync.WaitGroup{}
+	uut, err := GetReplayer(objects, publisher, testName, ctxt, &wg)
+	assert.Nil(err)
+
+	// Case 0: invalid parameters
+	{
+		_, err := uut.StartReplay(ReplayParam{Archive: "orders-archive"}, ctxt)
+		assert.ErrorIs(err, ErrInvalidReplay)
+		_, err = uut.StartReplay(ReplayParam{
+			Archive:   "orders-archive",
+			Subject:   "replay.orders",
+			StartTime: timeOf(5),
+			EndTime:   timeOf(4),
+		}, ctxt)
+		assert.ErrorIs(err, ErrInvalidReplay)
+		_, err = uut.StartReplay(ReplayParam{Archive: "unknown", Subject: "replay.orders"}, ctxt)
+		assert.ErrorIs(err, ErrUnknownArchive)
+	}
+
+	// Case 1: replay a time range
+	{
+		progress, err := uut.StartReplay(ReplayParam{
+			Archive:   "orders-archive",
+			Subject:   "replay.orders",
+			StartTime: timeOf(3),
+			EndTime:   timeOf(5),
+		}, ctxt)
+		assert.Nil(err)
+		assert.Equal(2, progress.Files)
+		progress = waitReplay(t, uut, progress.ID)
+		assert.Equal(ReplayCompleted, progress.State)
+		assert.Equal(2, progress.FilesRead)
+		assert.Equal(uint64(3), progress.Published)
+		assert.Equal(uint64(5), progress.LastSequence)
+		assert.Len(publisher.published, 3)
+		msg := publisher.published[0]
+		assert.Equal("replay.orders", msg.Subject)
+		assert.Equal([]byte("order-3"), msg.Data)
+		assert.Equal("t3", msg.Header.Get("Trace-ID"))
+		assert.Equal("orders", msg.Header.Get(ReplaySourceStreamHeader))
+		assert.Equal("orders.new", msg.Header.Get(ReplaySourceSubjectHeader))
+		assert.Equal("3", msg.Header.Get(ReplaySourceSequenceHeader))
+		assert.Equal(fmt.Sprintf("%s-3", progress.ID), msg.Header.Get(nats.MsgIdHdr))
+	}
+
+	// Case 2: cancel a replay
+	{
+		publisher.hold = make(chan struct{})
+		progress, err := uut.StartReplay(
+			ReplayParam{Archive: "orders-archive", Subject: "replay.orders", Rate: 1000}, ctxt,
+		)
+		assert.Nil(err)
+		assert.Equal(3, progress.Files)
+		publisher.hold <- struct{}{}
+		assert.Nil(uut.CancelReplay(progress.ID))
+		progress = waitReplay(t, uut, progress.ID)
+		assert.Equal(ReplayCancelled, progress.State)
+		assert.Equal(uint64(1), progress.Published)
+		assert.NotNil(progress.Ended)
+		assert.Len(uut.ListReplays(), 2)
+	}
+
+	// Case 3: unknown replay
+	{
+		_, err := uut.GetReplay("unknown")
+		assert.ErrorIs(err, ErrUnknownReplay)
+		assert.ErrorIs(uut.CancelReplay("unknown"), ErrUnknownReplay)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,223 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive drains stream consumers into batched, compressed files on S3-compatible
+// object storage, indexed by a manifest per archive, for retention beyond JetStream limits.
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrObjectNotFound returned when an object is not present in the object store
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore stores archive files and manifests
+type ObjectStore interface {
+	// PutObject stores an object under a key, replacing any previous object
+	PutObject(key string, body []byte, contentType string, ctxt context.Context) error
+	// GetObject fetches the object stored under a key. Returns ErrObjectNotFound if the key
+	// is not present.
+	GetObject(key string, ctxt context.Context) ([]byte, error)
+}
+
+// S3Param settings for an S3-compatible object store
+type S3Param struct {
+	// Endpoint is the base URL of the S3 API, such as "https://s3.us-east-1.amazonaws.com"
+	Endpoint string `validate:"required,url"`
+	// Region is the region requests are signed for
+	Region string `validate:"required"`
+	// Bucket is the bucket objects are stored in. Objects are addressed path-style, so
+	// the bucket name need not be a valid host name.
+	Bucket string `validate:"required"`
+	// AccessKey is the access key ID requests are signed with
+	AccessKey string `validate:"required"`
+	// SecretKey is the secret access key requests are signed with
+	SecretKey string `validate:"required"`
+	// Timeout is how long one request can take
+	Timeout time.Duration `validate:"gt=0"`
+}
+
+// s3StoreImpl implements ObjectStore with the S3 REST API, signing requests with AWS
+// Signature Version 4
+type s3StoreImpl struct {
+	common.Component
+	param    S3Param
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// GetS3ObjectStore define a new S3-compatible ObjectStore
+func GetS3ObjectStore(param S3Param, instance string) (ObjectStore, error) {
+	logTags := log.Fields{
+		"module": "archive", "component": "s3-store", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("S3 parameters invalid")
+		return nil, err
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(param.Endpoint, "/"))
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("S3 endpoint invalid")
+		return nil, err
+	}
+	return &s3StoreImpl{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: param.Timeout},
+	}, nil
+}
+
+// objectURL helper function to define the path-style URL of an object
+func (s *s3StoreImpl) objectURL(key string) *url.URL {
+	target := *s.endpoint
+	target.Path = fmt.Sprintf("%s/%s/%s", s.endpoint.Path, s.param.Bucket, key)
+	return &target
+}
+
+// do helper function to sign and send a request. Returns the response body of a successful
+// request.
+func (s *s3StoreImpl) do(req *http.Request, body []byte) ([]byte, error) {
+	signS3Request(req, body, s.param.Region, s.param.AccessKey, s.param.SecretKey, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf(
+			"%s %s failed with %d: %s", req.Method, req.URL.Path, resp.StatusCode, respBody,
+		)
+	}
+	return respBody, nil
+}
+
+// PutObject stores an object under a key
+func (s *s3StoreImpl) PutObject(
+	key string, body []byte, contentType string, ctxt context.Context,
+) error {
+	req, err := http.NewRequestWithContext(
+		ctxt, http.MethodPut, s.objectURL(key).String(), bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	_, err = s.do(req, body)
+	return err
+}
+
+// GetObject fetches the object stored under a key
+func (s *s3StoreImpl) GetObject(key string, ctxt context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctxt, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(req, nil)
+}
+
+// s3Escape helper function to URI encode a path as required by Signature Version 4
+func s3Escape(path string) string {
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		segments[idx] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+	return strings.Join(segments, "/")
+}
+
+// hmacSHA256 helper function to compute a HMAC-SHA256
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request sign a request with AWS Signature Version 4 for the S3 service. All headers
+// set on the request are signed. The request must have no query.
+func signS3Request(
+	req *http.Request, body []byte, region, accessKey, secretKey string, now time.Time,
+) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(fmt.Sprintf("%s:%s\n", name, headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		// Object requests have no query
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", day, region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
@@ -0,0 +1,656 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/http2"
+)
+
+// benchTimestampLen the length of the publish timestamp at the start of each bench message
+const benchTimestampLen = 8
+
+// benchWarmUpInterval interval between warm up messages while waiting for subscribers
+const benchWarmUpInterval = time.Millisecond * 100
+
+// benchWarmUpTimeout how long to wait for subscribers to start
+const benchWarmUpTimeout = time.Second * 10
+
+// BenchCLIArgs arguments
+type BenchCLIArgs struct {
+	// GatewayURL is the base URL of the dataplane server, including any path prefix
+	GatewayURL string `validate:"required,url"`
+	// CAFile is the PEM file of CAs for verifying the dataplane server over HTTPS
+	CAFile string
+	// AuthToken is the bearer token sent with each request
+	AuthToken string
+	// Subject is the subject to publish to
+	Subject string `validate:"required"`
+	// Stream is the stream to subscribe to. Required if there are subscribers.
+	Stream string `validate:"required_unless=Subscribers 0"`
+	// MessageSize is the size in bytes of each message
+	MessageSize uint `validate:"gte=8"`
+	// Rate is the total number of messages published per second. "0" publishes as fast as
+	// the publishers can.
+	Rate float64 `validate:"gte=0"`
+	// Publishers is the number of concurrent publishers
+	Publishers uint `validate:"gte=1"`
+	// Subscribers is the number of concurrent subscribers
+	Subscribers uint
+	// MaxInflight is the max number of messages awaiting ACK per subscriber
+	MaxInflight uint `validate:"gte=1"`
+	// Duration is how long to publish for
+	Duration time.Duration `validate:"gt=0"`
+	// DrainWait is how long to wait after publishing for subscribers to catch up
+	DrainWait time.Duration `validate:"gte=0"`
+}
+
+// GetBenchCLIFlags retreive the set of CMD flags for the bench subcommand
+func GetBenchCLIFlags(args *BenchCLIArgs) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "bench-gateway-url",
+			Usage:       "Base URL of the dataplane server",
+			Aliases:     []string{"bgu"},
+			EnvVars:     []string{"BENCH_GATEWAY_URL"},
+			Value:       "http://127.0.0.1:3001",
+			DefaultText: "http://127.0.0.1:3001",
+			Destination: &args.GatewayURL,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "bench-ca-file",
+			Usage:       "PEM file of CAs for verifying the dataplane server (empty: system CAs)",
+			Aliases:     []string{"bcf"},
+			EnvVars:     []string{"BENCH_CA_FILE"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.CAFile,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "bench-auth-token",
+			Usage:       "Bearer token sent with each request",
+			Aliases:     []string{"bat"},
+			EnvVars:     []string{"BENCH_AUTH_TOKEN"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.AuthToken,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "bench-subject",
+			Usage:       "Subject to publish to",
+			Aliases:     []string{"bsj"},
+			EnvVars:     []string{"BENCH_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Subject,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "bench-stream",
+			Usage:       "Stream to subscribe to (required with subscribers)",
+			Aliases:     []string{"bst"},
+			EnvVars:     []string{"BENCH_STREAM"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Stream,
+			Required:    false,
+		},
+		&cli.UintFlag{
+			Name:        "bench-message-size",
+			Usage:       "Size in bytes of each message",
+			Aliases:     []string{"bms"},
+			EnvVars:     []string{"BENCH_MESSAGE_SIZE"},
+			Value:       256,
+			DefaultText: "256",
+			Destination: &args.MessageSize,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "bench-rate",
+			Usage:       "Total messages published per second (0: no limit)",
+			Aliases:     []string{"br"},
+			EnvVars:     []string{"BENCH_RATE"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.Rate,
+			Required:    false,
+		},
+		&cli.UintFlag{
+			Name:        "bench-publishers",
+			Usage:       "Number of concurrent publishers",
+			Aliases:     []string{"bp"},
+			EnvVars:     []string{"BENCH_PUBLISHERS"},
+			Value:       1,
+			DefaultText: "1",
+			Destination: &args.Publishers,
+			Required:    false,
+		},
+		&cli.UintFlag{
+			Name:        "bench-subscribers",
+			Usage:       "Number of concurrent subscribers, each receiving every message",
+			Aliases:     []string{"bs"},
+			EnvVars:     []string{"BENCH_SUBSCRIBERS"},
+			Value:       1,
+			DefaultText: "1",
+			Destination: &args.Subscribers,
+			Required:    false,
+		},
+		&cli.UintFlag{
+			Name:        "bench-max-inflight",
+			Usage:       "Max number of messages awaiting ACK per subscriber",
+			Aliases:     []string{"bmi"},
+			EnvVars:     []string{"BENCH_MAX_INFLIGHT"},
+			Value:       16,
+			DefaultText: "16",
+			Destination: &args.MaxInflight,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "bench-duration",
+			Usage:       "How long to publish for",
+			Aliases:     []string{"bd"},
+			EnvVars:     []string{"BENCH_DURATION"},
+			Value:       time.Second * 10,
+			DefaultText: "10s",
+			Destination: &args.Duration,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "bench-drain-wait",
+			Usage:       "Max duration to wait after publishing for subscribers to receive all messages",
+			Aliases:     []string{"bdw"},
+			EnvVars:     []string{"BENCH_DRAIN_WAIT"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.DrainWait,
+			Required:    false,
+		},
+	}
+}
+
+// ============================================================================
+
+// BenchLatency summarizes a set of latency samples
+type BenchLatency struct {
+	// Samples is the number of samples
+	Samples int `json:"samples"`
+	// P50 is the median latency
+	P50 time.Duration `json:"p50"`
+	// P90 is the 90th percentile latency
+	P90 time.Duration `json:"p90"`
+	// P99 is the 99th percentile latency
+	P99 time.Duration `json:"p99"`
+	// Max is the highest latency
+	Max time.Duration `json:"max"`
+}
+
+// BenchReport the outcome of a bench run
+type BenchReport struct {
+	// Duration is how long the publishers ran for
+	Duration time.Duration `json:"duration"`
+	// Published is the number of messages published
+	Published uint64 `json:"published"`
+	// PublishErrors is the number of failed publishes
+	PublishErrors uint64 `json:"publish_errors"`
+	// PublishRate is the number of messages published per second
+	PublishRate float64 `json:"publish_rate"`
+	// PublishLatency is the latency of the publish requests
+	PublishLatency BenchLatency `json:"publish_latency"`
+	// Received is the number of messages received across all subscribers
+	Received uint64 `json:"received"`
+	// ReceiveRate is the number of messages received per second across all subscribers
+	ReceiveRate float64 `json:"receive_rate"`
+	// AckErrors is the number of failed ACKs
+	AckErrors uint64 `json:"ack_errors"`
+	// EndToEndLatency is the latency from publish to reception by a subscriber
+	EndToEndLatency BenchLatency `json:"end_to_end_latency"`
+}
+
+// latencyRecorder collects latency samples from concurrent users
+type latencyRecorder struct {
+	lock    sync.Mutex
+	samples []time.Duration
+}
+
+// record add one sample
+func (r *latencyRecorder) record(latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.samples = append(r.samples, latency)
+}
+
+// summarize compute the percentiles of the samples
+func (r *latencyRecorder) summarize() BenchLatency {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := BenchLatency{Samples: len(r.samples)}
+	if len(r.samples) == 0 {
+		return result
+	}
+	sort.Slice(r.samples, func(i, j int) bool { return r.samples[i] < r.samples[j] })
+	percentile := func(p float64) time.Duration {
+		idx := int(math.Ceil(p*float64(len(r.samples)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		return r.samples[idx]
+	}
+	result.P50 = percentile(0.5)
+	result.P90 = percentile(0.9)
+	result.P99 = percentile(0.99)
+	result.Max = r.samples[len(r.samples)-1]
+	return result
+}
+
+// benchRunner runs one bench
+type benchRunner struct {
+	params   BenchCLIArgs
+	client   *http.Client
+	baseURL  string
+	logTags  log.Fields
+	payload  []byte
+	pubLat   latencyRecorder
+	e2eLat   latencyRecorder
+	pubCount uint64
+	pubErrs  uint64
+	rxCount  uint64
+	ackErrs  uint64
+}
+
+// defineBenchClient helper function to define the HTTP/2 client for the bench
+func defineBenchClient(params BenchCLIArgs) (*http.Client, error) {
+	target, err := url.Parse(params.GatewayURL)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http2.Transport{}
+	switch target.Scheme {
+	case "http":
+		// Cleartext HTTP/2, as served by the dataplane without TLS
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}
+	case "https":
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if params.CAFile != "" {
+			caPEM, err := os.ReadFile(params.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no CA certificates found in %s", params.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("unsupported gateway URL scheme %s", target.Scheme)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// RunBench generate publish and subscribe load against a running dataplane server, and
+// report the throughput and latency observed
+//
+// Each bench message starts with its publish timestamp, from which subscribers compute the
+// end-to-end latency. Subscribers read through ephemeral consumers which only deliver
+// messages published after they start, so each subscriber receives every message.
+//
+// A subscribe session only responds once it has a message to send, so warm up messages,
+// with a zero timestamp, are published until every subscriber has responded.
+func RunBench(
+	params BenchCLIArgs, instance string, runTimeContext context.Context,
+) (BenchReport, error) {
+	logTags := log.Fields{
+		"module":    "cmd",
+		"component": "bench",
+		"instance":  instance,
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&params); err != nil {
+		log.WithError(err).WithFields(logTags).Error("Invalid CMD args")
+		return BenchReport{}, err
+	}
+
+	client, err := defineBenchClient(params)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define HTTP client")
+		return BenchReport{}, err
+	}
+
+	payload := bytes.Repeat([]byte("x"), int(params.MessageSize))
+	runner := &benchRunner{
+		params:  params,
+		client:  client,
+		baseURL: strings.TrimSuffix(params.GatewayURL, "/"),
+		logTags: logTags,
+		payload: payload,
+	}
+
+	// Subscribers must be reading before publishing starts, or they miss messages
+	subCtxt, subCancel := context.WithCancel(runTimeContext)
+	defer subCancel()
+	subWG := sync.WaitGroup{}
+	defer subWG.Wait()
+	subStarted := make(chan error, params.Subscribers)
+	for itr := uint(0); itr < params.Subscribers; itr++ {
+		subWG.Add(1)
+		go func() {
+			defer subWG.Done()
+			resp, err := runner.subscribe(subCtxt)
+			subStarted <- err
+			if err == nil {
+				runner.readMessages(resp, subCtxt)
+			}
+		}()
+	}
+	if err := runner.warmUp(subStarted, runTimeContext); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to start subscribers")
+		return BenchReport{}, err
+	}
+
+	// Publish for the duration of the bench
+	pubCtxt, pubCancel := context.WithTimeout(runTimeContext, params.Duration)
+	defer pubCancel()
+	pubWG := sync.WaitGroup{}
+	startTime := time.Now()
+	for itr := uint(0); itr < params.Publishers; itr++ {
+		pubWG.Add(1)
+		go func() {
+			defer pubWG.Done()
+			runner.publishMessages(pubCtxt)
+		}()
+	}
+	pubWG.Wait()
+	elapsed := time.Since(startTime)
+	log.WithFields(logTags).Infof(
+		"Published %d messages in %s", atomic.LoadUint64(&runner.pubCount), elapsed,
+	)
+
+	// Give the subscribers time to receive what was published
+	expected := atomic.LoadUint64(&runner.pubCount) * uint64(params.Subscribers)
+	drainDeadline := time.Now().Add(params.DrainWait)
+	for atomic.LoadUint64(&runner.rxCount) < expected && time.Now().Before(drainDeadline) {
+		select {
+		case <-runTimeContext.Done():
+			drainDeadline = time.Now()
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+	subCancel()
+	subWG.Wait()
+
+	report := BenchReport{
+		Duration:        elapsed,
+		Published:       atomic.LoadUint64(&runner.pubCount),
+		PublishErrors:   atomic.LoadUint64(&runner.pubErrs),
+		PublishLatency:  runner.pubLat.summarize(),
+		Received:        atomic.LoadUint64(&runner.rxCount),
+		AckErrors:       atomic.LoadUint64(&runner.ackErrs),
+		EndToEndLatency: runner.e2eLat.summarize(),
+	}
+	if elapsed > 0 {
+		report.PublishRate = float64(report.Published) / elapsed.Seconds()
+		report.ReceiveRate = float64(report.Received) / elapsed.Seconds()
+	}
+	if report.Received < expected {
+		log.WithFields(logTags).Warnf(
+			"Subscribers received %d of %d messages", report.Received, expected,
+		)
+	}
+	return report, nil
+}
+
+// newRequest helper function to define a request to the dataplane server
+func (b *benchRunner) newRequest(
+	method, path string, body io.Reader, ctxt context.Context,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctxt, method, b.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if b.params.AuthToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", b.params.AuthToken))
+	}
+	return req, nil
+}
+
+// warmUp publish warm up messages until all subscribers have started
+func (b *benchRunner) warmUp(subStarted chan error, ctxt context.Context) error {
+	if b.params.Subscribers == 0 {
+		return nil
+	}
+	path := fmt.Sprintf("/v1/data/subject/%s", url.PathEscape(b.params.Subject))
+	// The timestamp of a warm up message is zero
+	body := base64.StdEncoding.EncodeToString(make([]byte, len(b.payload)))
+	timeout := time.After(benchWarmUpTimeout)
+	ticker := time.NewTicker(benchWarmUpInterval)
+	defer ticker.Stop()
+	started := uint(0)
+	for {
+		select {
+		case err := <-subStarted:
+			if err != nil {
+				return err
+			}
+			started++
+			if started == b.params.Subscribers {
+				return nil
+			}
+		case <-ticker.C:
+			req, err := b.newRequest(http.MethodPost, path, strings.NewReader(body), ctxt)
+			if err != nil {
+				return err
+			}
+			resp, err := b.client.Do(req)
+			if err != nil {
+				return err
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("warm up publish failed with %d", resp.StatusCode)
+			}
+		case <-timeout:
+			return fmt.Errorf("only %d of %d subscribers started", started, b.params.Subscribers)
+		case <-ctxt.Done():
+			return ctxt.Err()
+		}
+	}
+}
+
+// publishMessages publish messages until ctxt ends, at this publisher's share of the rate
+func (b *benchRunner) publishMessages(ctxt context.Context) {
+	var interval time.Duration
+	if b.params.Rate > 0 {
+		interval = time.Duration(
+			float64(time.Second) * float64(b.params.Publishers) / b.params.Rate,
+		)
+	}
+	path := fmt.Sprintf("/v1/data/subject/%s", url.PathEscape(b.params.Subject))
+	msg := make([]byte, len(b.payload))
+	copy(msg, b.payload)
+	next := time.Now()
+	for {
+		if interval > 0 {
+			wait := time.Until(next)
+			if wait > 0 {
+				select {
+				case <-ctxt.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+			next = next.Add(interval)
+		}
+		if ctxt.Err() != nil {
+			return
+		}
+		start := time.Now()
+		binary.BigEndian.PutUint64(msg[:benchTimestampLen], uint64(start.UnixNano()))
+		body := base64.StdEncoding.EncodeToString(msg)
+		req, err := b.newRequest(http.MethodPost, path, strings.NewReader(body), ctxt)
+		if err != nil {
+			log.WithError(err).WithFields(b.logTags).Errorf("Unable to define publish request")
+			return
+		}
+		resp, err := b.client.Do(req)
+		if err != nil {
+			if ctxt.Err() != nil {
+				return
+			}
+			atomic.AddUint64(&b.pubErrs, 1)
+			log.WithError(err).WithFields(b.logTags).Debugf("Publish failed")
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			atomic.AddUint64(&b.pubErrs, 1)
+			log.WithFields(b.logTags).Debugf("Publish failed with %d", resp.StatusCode)
+			continue
+		}
+		b.pubLat.record(time.Since(start))
+		atomic.AddUint64(&b.pubCount, 1)
+	}
+}
+
+// subscribe start a subscribe session
+func (b *benchRunner) subscribe(ctxt context.Context) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("subject_name", b.params.Subject)
+	query.Set("deliver_new", "true")
+	query.Set("max_msg_inflight", fmt.Sprintf("%d", b.params.MaxInflight))
+	path := fmt.Sprintf(
+		"/v1/data/stream/%s/consumer?%s", url.PathEscape(b.params.Stream), query.Encode(),
+	)
+	req, err := b.newRequest(http.MethodGet, path, nil, ctxt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("subscribe failed with %d: %s", resp.StatusCode, msg)
+	}
+	return resp, nil
+}
+
+// readMessages read the messages of a subscribe session until it ends, and ACK them
+func (b *benchRunner) readMessages(resp *http.Response, ctxt context.Context) {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	ackWG := sync.WaitGroup{}
+	defer ackWG.Wait()
+	scanner := bufio.NewScanner(resp.Body)
+	// Base64 and the JSON envelope add to the size of each message
+	scanner.Buffer(make([]byte, 64*1024), int(b.params.MessageSize)*2+64*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			// Keep alive
+			continue
+		}
+		var msg dataplane.MsgToDeliver
+		if err := json.Unmarshal(line, &msg); err != nil {
+			log.WithError(err).WithFields(b.logTags).Errorf("Unable to parse message")
+			continue
+		}
+		if len(msg.Message) >= benchTimestampLen {
+			// Warm up messages are ACKed, but not counted
+			published := int64(binary.BigEndian.Uint64(msg.Message[:benchTimestampLen]))
+			if published != 0 {
+				b.e2eLat.record(time.Since(time.Unix(0, published)))
+				atomic.AddUint64(&b.rxCount, 1)
+			}
+		}
+		ackWG.Add(1)
+		go func() {
+			defer ackWG.Done()
+			b.ackMessage(msg, ctxt)
+		}()
+	}
+	if err := scanner.Err(); err != nil && ctxt.Err() == nil {
+		log.WithError(err).WithFields(b.logTags).Errorf("Subscribe session failed")
+	}
+}
+
+// ackMessage ACK a received message
+func (b *benchRunner) ackMessage(msg dataplane.MsgToDeliver, ctxt context.Context) {
+	body, err := json.Marshal(dataplane.AckSeqNum{
+		Stream: msg.Sequence.Stream, Consumer: msg.Sequence.Consumer,
+	})
+	if err != nil {
+		atomic.AddUint64(&b.ackErrs, 1)
+		return
+	}
+	path := fmt.Sprintf(
+		"/v1/data/stream/%s/consumer/%s/ack",
+		url.PathEscape(msg.Stream),
+		url.PathEscape(msg.Consumer),
+	)
+	req, err := b.newRequest(http.MethodPost, path, bytes.NewReader(body), ctxt)
+	if err != nil {
+		atomic.AddUint64(&b.ackErrs, 1)
+		return
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		if ctxt.Err() == nil {
+			atomic.AddUint64(&b.ackErrs, 1)
+		}
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		atomic.AddUint64(&b.ackErrs, 1)
+	}
+}
@@ -22,50 +22,1796 @@ import (
 	"time"
 
 	"github.com/alwitt/httpmq/apis"
+	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
 	"github.com/alwitt/httpmq/dataplane"
+	"github.com/alwitt/httpmq/filters"
+	"github.com/alwitt/httpmq/hooks"
+	"github.com/alwitt/httpmq/management"
+	"github.com/alwitt/httpmq/metrics"
+	"github.com/alwitt/httpmq/storage"
 	"github.com/apex/log"
 	"github.com/go-playground/validator/v10"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/h2c"
 )
 
 // DataplaneRestEndpoints end-point path configs for dataplane API
 type DataplaneRestEndpoints struct {
 	PathPrefix string
+	// V1Deprecated is when the v1 APIs were deprecated in favor of v2, in RFC 3339
+	V1Deprecated string `validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	// V1Sunset is when the v1 APIs stop being served, in RFC 3339
+	V1Sunset string `validate:"excluded_without=V1Deprecated,omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+}
+
+// DataplaneSessionWriteBuffer settings for the write buffers of subscription sessions
+type DataplaneSessionWriteBuffer struct {
+	MaxBytes     uint          `validate:"gt=0"`
+	Policy       string        `validate:"oneof=disconnect pause drop-nak"`
+	DrainTimeout time.Duration `validate:"gt=0"`
+}
+
+// DataplaneStreamAutoCreate settings for automatically defining streams on first publish
+type DataplaneStreamAutoCreate struct {
+	Enabled  bool
+	MaxAge   time.Duration `validate:"gte=0"`
+	MaxBytes int64         `validate:"gte=-1"`
+	MaxMsgs  int64         `validate:"gte=-1"`
+}
+
+// DataplaneInflightPersistence settings for persisting inflight message records
+type DataplaneInflightPersistence struct {
+	Enabled bool
+	Backend string
+	Path    string
+	Bucket  string
+	TTL     time.Duration
+}
+
+// DataplaneHTTP2Settings HTTP/2 settings for the dataplane server
+type DataplaneHTTP2Settings struct {
+	MaxConcurrentStreams uint
+	IdleTimeout          time.Duration `validate:"gte=0"`
+	PriorityScheduling   bool
+	StreamKeepAlive      time.Duration `validate:"gte=0"`
+}
+
+// DataplanePublish settings for publishing messages
+type DataplanePublish struct {
+	AckWait    time.Duration `validate:"gte=0"`
+	RetryAfter time.Duration `validate:"gte=0"`
+	// BufferMaxRetained is the largest message body buffer kept for reuse. "0" disables
+	// pooling of message body buffers.
+	BufferMaxRetained uint
+	// InspectionRulesFile is the JSON content inspection rules of each stream
+	InspectionRulesFile string
+	// InspectionCacheTTL is how long the stream storing a subject is cached for inspection
+	InspectionCacheTTL time.Duration `validate:"gt=0"`
+	// RoutingTableFile is the JSON routing table of publishes to other NATS connections
+	RoutingTableFile string
+	// RoutingHealthInterval is how often the health of the routed destinations is checked
+	RoutingHealthInterval time.Duration `validate:"gt=0"`
+	// QuotaHeaders is whether publishes report how much of its limits their stream uses
+	QuotaHeaders bool
+	// QuotaCacheTTL is how long the usage of a stream is cached for the quota headers
+	QuotaCacheTTL time.Duration `validate:"gt=0"`
+	// PIIRulesFile is the JSON PII detectors, and PII policy of each stream
+	PIIRulesFile string
+	// PIICacheTTL is how long the stream storing a subject is cached for PII scanning
+	PIICacheTTL time.Duration `validate:"gt=0"`
+	// GrantMaxTTL is the longest a publish grant may be valid. "0" disables signed publishes.
+	GrantMaxTTL time.Duration `validate:"gte=0"`
+	// GrantKey is the key signing publish grant tokens
+	GrantKey string
+}
+
+// DataplaneRequestQuota settings for limiting the requests of each client
+type DataplaneRequestQuota struct {
+	// Limit is the most requests a client makes within a window. "0" for no limit.
+	Limit  int           `validate:"gte=0"`
+	Window time.Duration `validate:"gt=0"`
+}
+
+// DataplaneStreamTail settings for stream tail sessions
+type DataplaneStreamTail struct {
+	MaxDuration time.Duration `validate:"gt=0"`
+	MaxRate     float64       `validate:"gte=0"`
+	// PayloadAccessFile is the JSON payload access policy of tail sessions
+	PayloadAccessFile string
+	// PublicStreamsFile is the JSON file of the streams open to anonymous subscribers
+	PublicStreamsFile string
+}
+
+// DataplaneExport settings for exporting ranges of streams
+type DataplaneExport struct {
+	MaxDuration time.Duration `validate:"gt=0"`
+	MaxRate     float64       `validate:"gte=0"`
+}
+
+// DataplaneImport settings for bulk importing messages
+type DataplaneImport struct {
+	// Concurrency is the max number of messages of an upload awaiting ACK. Zero disables
+	// bulk import.
+	Concurrency  int           `validate:"gte=0"`
+	MaxLineBytes int           `validate:"gte=1"`
+	TokenTTL     time.Duration `validate:"gt=0"`
+	TokenKey     string
+}
+
+// DataplaneRequestReply settings for request / reply over JetStream
+type DataplaneRequestReply struct {
+	ReplyPrefix string        `validate:"required"`
+	MaxTimeout  time.Duration `validate:"gt=0"`
+}
+
+// DataplaneBatchFetch settings for fetching batches through pull consumers
+type DataplaneBatchFetch struct {
+	MaxBatch  int           `validate:"gt=0"`
+	MaxWait   time.Duration `validate:"gt=0"`
+	CommitTTL time.Duration `validate:"gt=0"`
+}
+
+// DataplaneTenantCredentials settings for serving requests with NATS credentials per tenant
+type DataplaneTenantCredentials struct {
+	Provider     string `validate:"omitempty,oneof=file vault http"`
+	Dir          string
+	VaultAddress string
+	VaultToken   string
+	VaultPath    string
+	ServiceURL   string
+	ServiceToken string
+	Timeout      time.Duration `validate:"gt=0"`
+	IdleTimeout  time.Duration `validate:"gt=0"`
+}
+
+// DataplaneSessionResume settings for resuming push subscribe sessions
+type DataplaneSessionResume struct {
+	TokenTTL time.Duration `validate:"gte=0"`
+	TokenKey string
+}
+
+// DataplaneDeliveryTiers settings for primary and standby sessions of delivery groups
+type DataplaneDeliveryTiers struct {
+	BeaconInterval time.Duration `validate:"gte=0"`
+}
+
+// DataplaneGroupFairness settings for balancing delivery between the sessions of delivery
+// groups
+type DataplaneGroupFairness struct {
+	SkewFactor     float64 `validate:"gte=0"`
+	MinUnacked     int     `validate:"gte=1"`
+	MaxDeflections int     `validate:"gte=1"`
+}
+
+// DataplaneConsumerLeases settings for pinning durable consumers to push subscribe sessions
+type DataplaneConsumerLeases struct {
+	// Bucket is the JetStream KV bucket holding the leases. Empty to disable pinning.
+	Bucket string
+	TTL    time.Duration `validate:"gte=1s"`
+}
+
+// DataplaneSessionLimits settings for ending long held push subscribe sessions
+type DataplaneSessionLimits struct {
+	MaxDuration       time.Duration `validate:"gte=0"`
+	IdleTimeout       time.Duration `validate:"gte=0"`
+	MaxTrackingPanics int           `validate:"gte=0"`
+	AckDrainTimeout   time.Duration `validate:"gte=0"`
+	// ShutdownDrainTimeout is how long the server waits for the sessions to end on shutdown
+	ShutdownDrainTimeout time.Duration `validate:"gte=0"`
+}
+
+// DataplaneFilters settings for running the WASM filter modules of consumers
+type DataplaneFilters struct {
+	Bucket      string
+	MaxMemoryMB uint          `validate:"lte=4096"`
+	Timeout     time.Duration `validate:"gte=0"`
+}
+
+// DataplaneConsumerLatency settings for tracking the ACK latency of consumers
+type DataplaneConsumerLatency struct {
+	Window         time.Duration `validate:"gt=0"`
+	SlowThreshold  time.Duration `validate:"gte=0"`
+	MinSamples     uint          `validate:"gte=1"`
+	ThrottleRate   float64       `validate:"gte=0"`
+	ReportSubject  string
+	ReportInterval time.Duration `validate:"gt=0"`
+}
+
+// DataplaneReplicaAffinity settings for serving each durable consumer from one replica
+type DataplaneReplicaAffinity struct {
+	// Replicas is the comma separated list of the base URLs of all replicas
+	Replicas string
+	// Self is the base URL of this replica
+	Self string `validate:"required_with=Replicas"`
+}
+
+// DataplaneSessionGossip settings for sharing push subscribe sessions between replicas
+type DataplaneSessionGossip struct {
+	Subject  string
+	Interval time.Duration `validate:"gt=0"`
+}
+
+// DataplaneSessionEvents settings for notifying external systems of push subscribe session
+// lifecycle events
+type DataplaneSessionEvents struct {
+	WebhookURL     string        `validate:"omitempty,url"`
+	WebhookTimeout time.Duration `validate:"gt=0"`
+	NATSSubject    string
+	QueueLength    int `validate:"gte=1"`
+}
+
+// DataplaneSampling settings for copying a share of the messages to inspection destinations
+type DataplaneSampling struct {
+	RulesFile      string
+	WebhookTimeout time.Duration `validate:"gt=0"`
+	QueueLength    int           `validate:"gte=1"`
+}
+
+// statsDMaxPacketSize is the most bytes pushed to StatsD in one UDP packet, to fit in the
+// common Ethernet MTU
+const statsDMaxPacketSize = 1432
+
+// DataplaneStatsD settings for pushing the metrics to a StatsD server
+type DataplaneStatsD struct {
+	Address  string
+	Flavor   string `validate:"oneof=statsd dogstatsd"`
+	Prefix   string
+	Tags     string
+	Interval time.Duration `validate:"gt=0"`
+}
+
+// DataplaneSLO settings for tracking the service level objectives
+type DataplaneSLO struct {
+	AvailabilityObjective float64       `validate:"gte=0,lt=1"`
+	LatencyThreshold      time.Duration `validate:"gt=0"`
+	LatencyObjective      float64       `validate:"gt=0,lt=1"`
+	Windows               string        `validate:"required"`
+	Resolution            time.Duration `validate:"gt=0"`
+}
+
+// DataplaneMessageTrace settings for tracing the messages sent to clients
+type DataplaneMessageTrace struct {
+	Subjects     string
+	Consumers    string
+	WindowSize   int `validate:"gte=1"`
+	PayloadBytes int `validate:"gte=0"`
+}
+
+// DataplanePublishAnomaly settings for detecting anomalies in the publish rate of subjects
+type DataplanePublishAnomaly struct {
+	Interval      time.Duration `validate:"gte=0"`
+	Alpha         float64       `validate:"gt=0,lte=1"`
+	SpikeFactor   float64       `validate:"gt=1"`
+	DroughtFactor float64       `validate:"gte=0,lt=1"`
+	MinRate       float64       `validate:"gte=0"`
+	Warmup        int           `validate:"gte=1"`
+	MaxSubjects   int           `validate:"gte=1"`
+}
+
+// DataplanePublishFailover settings for failing publishes over to a secondary NATS cluster
+type DataplanePublishFailover struct {
+	// SecondaryURI is the secondary NATS cluster. Empty to disable failover.
+	SecondaryURI      string        `validate:"omitempty,uri"`
+	ProbeInterval     time.Duration `validate:"gt=0"`
+	FailureThreshold  int           `validate:"gte=1"`
+	RecoveryThreshold int           `validate:"gte=1"`
 }
 
 // DataplaneCLIArgs arguments
 type DataplaneCLIArgs struct {
-	ServerPort int `validate:"required,gt=0,lt=65536"`
-	Endpoints  DataplaneRestEndpoints
+	ServerPort          int `validate:"required,gt=0,lt=65536"`
+	Listener            ServerListenerArgs
+	Endpoints           DataplaneRestEndpoints
+	HTTP2               DataplaneHTTP2Settings
+	SessionWriteBuffer  DataplaneSessionWriteBuffer
+	StreamAutoCreate    DataplaneStreamAutoCreate
+	Publish             DataplanePublish
+	InflightPersistence DataplaneInflightPersistence
+	StreamTail          DataplaneStreamTail
+	Export              DataplaneExport
+	Import              DataplaneImport
+	RedactionRulesFile  string
+	// GraphQL enables the GraphQL subscriptions to messages
+	GraphQL bool
+	// ExternalACKPrefix is the subject prefix external workers send ACKs to over NATS.
+	// Empty to only accept ACKs over HTTP.
+	ExternalACKPrefix string
+	Subjects          SubjectRuleArgs
+	RequestReply      DataplaneRequestReply
+	BatchFetch        DataplaneBatchFetch
+	SessionResume     DataplaneSessionResume
+	DeliveryTiers     DataplaneDeliveryTiers
+	GroupFairness     DataplaneGroupFairness
+	ConsumerLeases    DataplaneConsumerLeases
+	SessionLimits     DataplaneSessionLimits
+	TenantCredentials DataplaneTenantCredentials
+	Filters           DataplaneFilters
+	ConsumerLatency   DataplaneConsumerLatency
+	ReplicaAffinity   DataplaneReplicaAffinity
+	SessionGossip     DataplaneSessionGossip
+	SessionEvents     DataplaneSessionEvents
+	Sampling          DataplaneSampling
+	StatsD            DataplaneStatsD
+	SLO               DataplaneSLO
+	MessageTrace      DataplaneMessageTrace
+	Alerts            AlertSinkArgs
+	PublishAnomaly    DataplanePublishAnomaly
+	PublishFailover   DataplanePublishFailover
+	RequestQuota      DataplaneRequestQuota
+	Preflight         PreflightArgs
+	AccessLog         AccessLogArgs
 }
 
 // GetDataplaneCLIFlags retreive the set of CMD flags for dataplane server
 func GetDataplaneCLIFlags(args *DataplaneCLIArgs) []cli.Flag {
 	return []cli.Flag{
 		&cli.IntFlag{
-			Name:        "dataplane-server-port",
-			Usage:       "Dataplane server port",
-			Aliases:     []string{"dsp"},
-			EnvVars:     []string{"DATAPLANE_SERVER_PORT"},
-			Value:       3001,
-			DefaultText: "3001",
-			Destination: &args.ServerPort,
+			Name:        "dataplane-server-port",
+			Usage:       "Dataplane server port",
+			Aliases:     []string{"dsp"},
+			EnvVars:     []string{"DATAPLANE_SERVER_PORT"},
+			Value:       3001,
+			DefaultText: "3001",
+			Destination: &args.ServerPort,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-listen-address",
+			Usage:       "Dataplane server bind address (default: all interfaces)",
+			Aliases:     []string{"dsla"},
+			EnvVars:     []string{"DATAPLANE_SERVER_LISTEN_ADDRESS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.Address,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-tls-cert",
+			Usage:       "Dataplane server TLS certificate PEM file (enables TLS)",
+			Aliases:     []string{"dstc"},
+			EnvVars:     []string{"DATAPLANE_SERVER_TLS_CERT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.TLSCertFile,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-tls-key",
+			Usage:       "Dataplane server TLS private key PEM file",
+			Aliases:     []string{"dstk"},
+			EnvVars:     []string{"DATAPLANE_SERVER_TLS_KEY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.TLSKeyFile,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-server-tls-reload-interval",
+			Usage:       "Interval between checks of the TLS certificate files for changes",
+			Aliases:     []string{"dstri"},
+			EnvVars:     []string{"DATAPLANE_SERVER_TLS_RELOAD_INTERVAL"},
+			Value:       time.Minute,
+			DefaultText: "1m",
+			Destination: &args.Listener.TLSReloadInterval,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-acme-domains",
+			Usage:       "Comma separated domains to obtain TLS certificates for with ACME (enables TLS)",
+			Aliases:     []string{"dsad"},
+			EnvVars:     []string{"DATAPLANE_SERVER_ACME_DOMAINS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ACMEDomains,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-acme-cache-dir",
+			Usage:       "Directory for caching ACME certificates",
+			Aliases:     []string{"dsacd"},
+			EnvVars:     []string{"DATAPLANE_SERVER_ACME_CACHE_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ACMECacheDir,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-acme-email",
+			Usage:       "Contact email for the ACME account",
+			Aliases:     []string{"dsae"},
+			EnvVars:     []string{"DATAPLANE_SERVER_ACME_EMAIL"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ACMEEmail,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-tls-client-ca",
+			Usage:       "CA PEM file for verifying client certificates (requires client certificates)",
+			Aliases:     []string{"dstca"},
+			EnvVars:     []string{"DATAPLANE_SERVER_TLS_CLIENT_CA"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ClientCAFile,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-allowed-clients",
+			Usage:       "Comma separated client certificate CN / SANs permitted to call the APIs (default: any)",
+			Aliases:     []string{"dsac"},
+			EnvVars:     []string{"DATAPLANE_SERVER_ALLOWED_CLIENTS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.AllowedClients,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-auth-token",
+			Usage:       "If set, dataplane API requests must carry this bearer token",
+			Aliases:     []string{"dsat"},
+			EnvVars:     []string{"DATAPLANE_SERVER_AUTH_TOKEN"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.AuthToken,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "dataplane-server-proxy-protocol",
+			Usage:       "Require a PROXY protocol (v1 or v2) header on connections from trusted proxies",
+			Aliases:     []string{"dspp"},
+			EnvVars:     []string{"DATAPLANE_SERVER_PROXY_PROTOCOL"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Listener.ProxyProtocol,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-trusted-proxies",
+			Usage:       "Comma separated CIDRs / IPs of proxies trusted to report the client address",
+			Aliases:     []string{"dstp"},
+			EnvVars:     []string{"DATAPLANE_SERVER_TRUSTED_PROXIES"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.TrustedProxies,
+			Required:    false,
+		},
+		// End-point related
+		&cli.StringFlag{
+			Name:        "dataplane-server-endpoint-prefix",
+			Usage:       "Set the end-point path prefix for the dataplane APIs",
+			Aliases:     []string{"dsep"},
+			EnvVars:     []string{"DATAPLANE_SERVER_ENDPOINT_PREFIX"},
+			Value:       "/",
+			DefaultText: "/",
+			Destination: &args.Endpoints.PathPrefix,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-v1-deprecated",
+			Usage:       "When the v1 dataplane APIs were deprecated, in RFC 3339. v1 responses then carry deprecation headers.",
+			Aliases:     []string{"dsvd"},
+			EnvVars:     []string{"DATAPLANE_SERVER_V1_DEPRECATED"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Endpoints.V1Deprecated,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-server-v1-sunset",
+			Usage:       "When the deprecated v1 dataplane APIs stop being served, in RFC 3339",
+			Aliases:     []string{"dsvs"},
+			EnvVars:     []string{"DATAPLANE_SERVER_V1_SUNSET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Endpoints.V1Sunset,
+			Required:    false,
+		},
+		// HTTP/2 related
+		&cli.UintFlag{
+			Name:        "dataplane-http2-max-concurrent-streams",
+			Usage:       "Max number of concurrent HTTP/2 streams per client connection (0: default of 250)",
+			Aliases:     []string{"dhmcs"},
+			EnvVars:     []string{"DATAPLANE_HTTP2_MAX_CONCURRENT_STREAMS"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.HTTP2.MaxConcurrentStreams,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-http2-idle-timeout",
+			Usage:       "Close HTTP/2 client connections with no active streams after this long (0: never)",
+			Aliases:     []string{"dhit"},
+			EnvVars:     []string{"DATAPLANE_HTTP2_IDLE_TIMEOUT"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.HTTP2.IdleTimeout,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "dataplane-http2-priority-scheduling",
+			Usage:       "Schedule HTTP/2 frame writes based on the stream priorities set by clients",
+			Aliases:     []string{"dhps"},
+			EnvVars:     []string{"DATAPLANE_HTTP2_PRIORITY_SCHEDULING"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.HTTP2.PriorityScheduling,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-stream-keep-alive",
+			Usage:       "Interval between keep-alive empty lines sent on idle subscription streams (0: disabled)",
+			Aliases:     []string{"dska"},
+			EnvVars:     []string{"DATAPLANE_STREAM_KEEP_ALIVE"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.HTTP2.StreamKeepAlive,
+			Required:    false,
+		},
+		// Session write buffer related
+		&cli.UintFlag{
+			Name:        "dataplane-session-write-buffer",
+			Usage:       "Max bytes of messages buffered for a subscription client which is not reading",
+			Aliases:     []string{"dswb"},
+			EnvVars:     []string{"DATAPLANE_SESSION_WRITE_BUFFER"},
+			Value:       1 << 20,
+			DefaultText: "1048576",
+			Destination: &args.SessionWriteBuffer.MaxBytes,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-session-slow-client-policy",
+			Usage:       "What to do once a session write buffer is full: [disconnect pause drop-nak]",
+			Aliases:     []string{"dswp"},
+			EnvVars:     []string{"DATAPLANE_SESSION_SLOW_CLIENT_POLICY"},
+			Value:       "pause",
+			DefaultText: "pause",
+			Destination: &args.SessionWriteBuffer.Policy,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-session-drain-timeout",
+			Usage:       "How long an ending session waits to send its buffered messages before dropping the connection",
+			Aliases:     []string{"dswd"},
+			EnvVars:     []string{"DATAPLANE_SESSION_DRAIN_TIMEOUT"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.SessionWriteBuffer.DrainTimeout,
+			Required:    false,
+		},
+		// Stream auto-create related
+		&cli.BoolFlag{
+			Name:        "dataplane-auto-create-stream",
+			Usage:       "Define a stream for a subject if no stream matches it on publish",
+			Aliases:     []string{"dacs"},
+			EnvVars:     []string{"DATAPLANE_AUTO_CREATE_STREAM"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.StreamAutoCreate.Enabled,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-auto-create-stream-max-age",
+			Usage:       "Max message age for automatically defined streams",
+			Aliases:     []string{"dacsma"},
+			EnvVars:     []string{"DATAPLANE_AUTO_CREATE_STREAM_MAX_AGE"},
+			Value:       time.Hour * 24,
+			DefaultText: "24h",
+			Destination: &args.StreamAutoCreate.MaxAge,
+			Required:    false,
+		},
+		&cli.Int64Flag{
+			Name:        "dataplane-auto-create-stream-max-bytes",
+			Usage:       "Max message bytes for automatically defined streams (-1: unlimited)",
+			Aliases:     []string{"dacsmb"},
+			EnvVars:     []string{"DATAPLANE_AUTO_CREATE_STREAM_MAX_BYTES"},
+			Value:       -1,
+			DefaultText: "-1",
+			Destination: &args.StreamAutoCreate.MaxBytes,
+			Required:    false,
+		},
+		&cli.Int64Flag{
+			Name:        "dataplane-auto-create-stream-max-msgs",
+			Usage:       "Max message count for automatically defined streams (-1: unlimited)",
+			Aliases:     []string{"dacsmm"},
+			EnvVars:     []string{"DATAPLANE_AUTO_CREATE_STREAM_MAX_MSGS"},
+			Value:       -1,
+			DefaultText: "-1",
+			Destination: &args.StreamAutoCreate.MaxMsgs,
+			Required:    false,
+		},
+		// Publish related
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-ack-wait",
+			Usage:       "Default max duration a publish waits for JetStream ACK (0: until the request ends)",
+			Aliases:     []string{"dpaw"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ACK_WAIT"},
+			Value:       0,
+			DefaultText: "0s",
+			Destination: &args.Publish.AckWait,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-retry-after",
+			Usage:       "Retry-After given to publishes rejected due to too many publishes awaiting ACK",
+			Aliases:     []string{"dpra"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_RETRY_AFTER"},
+			Value:       time.Second,
+			DefaultText: "1s",
+			Destination: &args.Publish.RetryAfter,
+			Required:    false,
+		},
+		&cli.UintFlag{
+			Name:        "dataplane-publish-buffer-max-retained",
+			Usage:       "Largest publish message body buffer, in bytes, kept for reuse (0: no pooling)",
+			Aliases:     []string{"dpbmr"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_BUFFER_MAX_RETAINED"},
+			Value:       1 << 20,
+			DefaultText: "1048576",
+			Destination: &args.Publish.BufferMaxRetained,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-publish-content-inspection-rules",
+			Usage:       "JSON file of the content inspection rules of each stream (empty: disabled)",
+			Aliases:     []string{"dpcir"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_CONTENT_INSPECTION_RULES"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Publish.InspectionRulesFile,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-content-inspection-cache-ttl",
+			Usage:       "How long the stream storing a subject is cached for content inspection",
+			Aliases:     []string{"dpcit"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_CONTENT_INSPECTION_CACHE_TTL"},
+			Value:       time.Second * 30,
+			DefaultText: "30s",
+			Destination: &args.Publish.InspectionCacheTTL,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-publish-routing-table",
+			Usage:       "JSON file routing publishes to other NATS connections by subject prefix or header (empty: disabled)",
+			Aliases:     []string{"dprt"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ROUTING_TABLE"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Publish.RoutingTableFile,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-routing-health-interval",
+			Usage:       "How often the health of the publish routing destinations is checked",
+			Aliases:     []string{"dprhi"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ROUTING_HEALTH_INTERVAL"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.Publish.RoutingHealthInterval,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "dataplane-publish-stream-quota-headers",
+			Usage:       "Report how much of its limits the stream of a published message uses in response headers",
+			Aliases:     []string{"dpsqh"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_STREAM_QUOTA_HEADERS"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Publish.QuotaHeaders,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-stream-quota-cache-ttl",
+			Usage:       "How long the usage of a stream is cached for the stream quota headers",
+			Aliases:     []string{"dpsqt"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_STREAM_QUOTA_CACHE_TTL"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.Publish.QuotaCacheTTL,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-publish-pii-rules",
+			Usage:       "JSON file of the PII detectors, and the PII policy of each stream (empty: disabled)",
+			Aliases:     []string{"dppr"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_PII_RULES"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Publish.PIIRulesFile,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-pii-cache-ttl",
+			Usage:       "How long the stream storing a subject is cached for PII scanning",
+			Aliases:     []string{"dppct"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_PII_CACHE_TTL"},
+			Value:       time.Second * 30,
+			DefaultText: "30s",
+			Destination: &args.Publish.PIICacheTTL,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-grant-max-ttl",
+			Usage:       "Longest a signed publish URL may be valid (0: signed publishes disabled)",
+			Aliases:     []string{"dpgmt"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_GRANT_MAX_TTL"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.Publish.GrantMaxTTL,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-publish-grant-key",
+			Usage:       "Key signing publish grant tokens, shared by instances which accept each other's tokens (default: random)",
+			Aliases:     []string{"dpgk"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_GRANT_KEY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Publish.GrantKey,
+			Required:    false,
+		},
+		// Inflight message persistence related
+		&cli.BoolFlag{
+			Name:        "dataplane-persist-inflight",
+			Usage:       "Persist inflight message records, so messages can be ACKed across restarts",
+			Aliases:     []string{"dpi"},
+			EnvVars:     []string{"DATAPLANE_PERSIST_INFLIGHT"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.InflightPersistence.Enabled,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-persist-inflight-backend",
+			Usage:       "Storage backend for inflight message records (memory, bolt, jetstream)",
+			Aliases:     []string{"dpibe"},
+			EnvVars:     []string{"DATAPLANE_PERSIST_INFLIGHT_BACKEND"},
+			Value:       storage.BackendJetStream,
+			DefaultText: storage.BackendJetStream,
+			Destination: &args.InflightPersistence.Backend,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-persist-inflight-path",
+			Usage:       "Database file for inflight message records with the bolt backend",
+			Aliases:     []string{"dpip"},
+			EnvVars:     []string{"DATAPLANE_PERSIST_INFLIGHT_PATH"},
+			Value:       "httpmq-inflight.db",
+			DefaultText: "httpmq-inflight.db",
+			Destination: &args.InflightPersistence.Path,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-persist-inflight-bucket",
+			Usage:       "Storage bucket for inflight message records",
+			Aliases:     []string{"dpib"},
+			EnvVars:     []string{"DATAPLANE_PERSIST_INFLIGHT_BUCKET"},
+			Value:       "httpmq-inflight",
+			DefaultText: "httpmq-inflight",
+			Destination: &args.InflightPersistence.Bucket,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-persist-inflight-ttl",
+			Usage:       "Retention period of inflight message records (0: unlimited)",
+			Aliases:     []string{"dpit"},
+			EnvVars:     []string{"DATAPLANE_PERSIST_INFLIGHT_TTL"},
+			Value:       time.Hour,
+			DefaultText: "1h",
+			Destination: &args.InflightPersistence.TTL,
+			Required:    false,
+		},
+		// Redaction related
+		&cli.StringFlag{
+			Name:        "dataplane-redaction-rules",
+			Usage:       "JSON file of per-stream rules for redacting messages before delivery",
+			Aliases:     []string{"drr"},
+			EnvVars:     []string{"DATAPLANE_REDACTION_RULES"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.RedactionRulesFile,
+			Required:    false,
+		},
+		// External ACK related
+		&cli.StringFlag{
+			Name:        "dataplane-external-ack-subject-prefix",
+			Usage:       "Subject prefix to receive ACKs from external workers over NATS (empty: disabled)",
+			Aliases:     []string{"deas"},
+			EnvVars:     []string{"DATAPLANE_EXTERNAL_ACK_SUBJECT_PREFIX"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.ExternalACKPrefix,
+			Required:    false,
+		},
+		// Subject validation related
+		&cli.IntFlag{
+			Name:        "dataplane-subject-max-depth",
+			Usage:       "Max number of tokens in a publish or subscribe subject (0: no limit)",
+			Aliases:     []string{"dsmx"},
+			EnvVars:     []string{"DATAPLANE_SUBJECT_MAX_DEPTH"},
+			Value:       16,
+			DefaultText: "16",
+			Destination: &args.Subjects.MaxDepth,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-subject-reserved-prefixes",
+			Usage:       "Comma separated subject prefixes clients may not publish or subscribe to",
+			Aliases:     []string{"dsrv"},
+			EnvVars:     []string{"DATAPLANE_SUBJECT_RESERVED_PREFIXES"},
+			Value:       "$JS,$KV,$O,$SYS",
+			DefaultText: "$JS,$KV,$O,$SYS",
+			Destination: &args.Subjects.ReservedPrefixes,
+			Required:    false,
+		},
+		// Stream tail related
+		&cli.DurationFlag{
+			Name:        "dataplane-tail-max-duration",
+			Usage:       "Max duration of a stream tail session",
+			Aliases:     []string{"dtmd"},
+			EnvVars:     []string{"DATAPLANE_TAIL_MAX_DURATION"},
+			Value:       time.Minute * 5,
+			DefaultText: "5m",
+			Destination: &args.StreamTail.MaxDuration,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-tail-max-rate",
+			Usage:       "Max messages per second sent on a stream tail session (0: no limit)",
+			Aliases:     []string{"dtmr"},
+			EnvVars:     []string{"DATAPLANE_TAIL_MAX_RATE"},
+			Value:       10,
+			DefaultText: "10",
+			Destination: &args.StreamTail.MaxRate,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tail-payload-access",
+			Usage:       "JSON file of the rules limiting principals to message metadata on stream tail sessions (empty: all see payloads)",
+			Aliases:     []string{"dtpa"},
+			EnvVars:     []string{"DATAPLANE_TAIL_PAYLOAD_ACCESS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.StreamTail.PayloadAccessFile,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tail-public-streams",
+			Usage:       "JSON file of the streams anonymous clients can subscribe to, with their per-IP connection caps (empty: none)",
+			Aliases:     []string{"dtps"},
+			EnvVars:     []string{"DATAPLANE_TAIL_PUBLIC_STREAMS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.StreamTail.PublicStreamsFile,
+			Required:    false,
+		},
+		// GraphQL related
+		&cli.BoolFlag{
+			Name:        "dataplane-graphql",
+			Usage:       "Serve GraphQL subscriptions to messages",
+			Aliases:     []string{"dgql"},
+			EnvVars:     []string{"DATAPLANE_GRAPHQL"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.GraphQL,
+			Required:    false,
+		},
+		// Stream export related
+		&cli.DurationFlag{
+			Name:        "dataplane-export-max-duration",
+			Usage:       "Max duration of a stream export",
+			Aliases:     []string{"dxmd"},
+			EnvVars:     []string{"DATAPLANE_EXPORT_MAX_DURATION"},
+			Value:       time.Hour,
+			DefaultText: "1h",
+			Destination: &args.Export.MaxDuration,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-export-max-rate",
+			Usage:       "Max messages per second sent on a stream export (0: no limit)",
+			Aliases:     []string{"dxmr"},
+			EnvVars:     []string{"DATAPLANE_EXPORT_MAX_RATE"},
+			Value:       1000,
+			DefaultText: "1000",
+			Destination: &args.Export.MaxRate,
+			Required:    false,
+		},
+		// Bulk import related
+		&cli.IntFlag{
+			Name:        "dataplane-import-concurrency",
+			Usage:       "Max messages of a bulk import upload awaiting ACK (0: bulk import disabled)",
+			Aliases:     []string{"dimc"},
+			EnvVars:     []string{"DATAPLANE_IMPORT_CONCURRENCY"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.Import.Concurrency,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-import-max-line-bytes",
+			Usage:       "Longest line of a bulk import upload accepted",
+			Aliases:     []string{"dimb"},
+			EnvVars:     []string{"DATAPLANE_IMPORT_MAX_LINE_BYTES"},
+			Value:       1048576,
+			DefaultText: "1048576",
+			Destination: &args.Import.MaxLineBytes,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-import-token-ttl",
+			Usage:       "Duration a bulk import can be resumed for after its last upload",
+			Aliases:     []string{"dimt"},
+			EnvVars:     []string{"DATAPLANE_IMPORT_TOKEN_TTL"},
+			Value:       time.Hour * 24,
+			DefaultText: "24h",
+			Destination: &args.Import.TokenTTL,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-import-token-key",
+			Usage:       "Key signing bulk import tokens, shared by instances which accept each other's tokens (default: random)",
+			Aliases:     []string{"dimk"},
+			EnvVars:     []string{"DATAPLANE_IMPORT_TOKEN_KEY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Import.TokenKey,
+			Required:    false,
+		},
+		// Request / reply related
+		&cli.StringFlag{
+			Name:        "dataplane-rpc-reply-prefix",
+			Usage:       "Subject prefix replies to requests are sent under",
+			Aliases:     []string{"drrp"},
+			EnvVars:     []string{"DATAPLANE_RPC_REPLY_PREFIX"},
+			Value:       "httpmq.rpc.reply",
+			DefaultText: "httpmq.rpc.reply",
+			Destination: &args.RequestReply.ReplyPrefix,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-rpc-max-timeout",
+			Usage:       "Max duration to wait for replies to a request",
+			Aliases:     []string{"drmt"},
+			EnvVars:     []string{"DATAPLANE_RPC_MAX_TIMEOUT"},
+			Value:       time.Second * 30,
+			DefaultText: "30s",
+			Destination: &args.RequestReply.MaxTimeout,
+			Required:    false,
+		},
+		// Batch fetch related
+		&cli.IntFlag{
+			Name:        "dataplane-fetch-max-batch",
+			Usage:       "Max number of messages in one fetched batch",
+			Aliases:     []string{"dfmb"},
+			EnvVars:     []string{"DATAPLANE_FETCH_MAX_BATCH"},
+			Value:       100,
+			DefaultText: "100",
+			Destination: &args.BatchFetch.MaxBatch,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-fetch-max-wait",
+			Usage:       "Max duration to wait for messages when fetching a batch",
+			Aliases:     []string{"dfmw"},
+			EnvVars:     []string{"DATAPLANE_FETCH_MAX_WAIT"},
+			Value:       time.Second * 30,
+			DefaultText: "30s",
+			Destination: &args.BatchFetch.MaxWait,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-fetch-commit-ttl",
+			Usage:       "Duration a commit token for a fetched batch remains valid",
+			Aliases:     []string{"dfct"},
+			EnvVars:     []string{"DATAPLANE_FETCH_COMMIT_TTL"},
+			Value:       time.Minute * 5,
+			DefaultText: "5m",
+			Destination: &args.BatchFetch.CommitTTL,
+			Required:    false,
+		},
+		// Session resume related
+		&cli.DurationFlag{
+			Name:        "dataplane-resume-token-ttl",
+			Usage:       "Duration a push subscribe session resume token remains valid (0: resume disabled)",
+			Aliases:     []string{"drtt"},
+			EnvVars:     []string{"DATAPLANE_RESUME_TOKEN_TTL"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.SessionResume.TokenTTL,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-resume-token-key",
+			Usage:       "Key signing resume tokens, shared by instances which accept each other's tokens (default: random)",
+			Aliases:     []string{"drtk"},
+			EnvVars:     []string{"DATAPLANE_RESUME_TOKEN_KEY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.SessionResume.TokenKey,
+			Required:    false,
+		},
+		// Delivery tier related
+		&cli.DurationFlag{
+			Name:        "dataplane-delivery-tier-beacon-interval",
+			Usage:       "Interval between beacons of primary sessions of delivery groups (0: standby sessions disabled)",
+			Aliases:     []string{"ddtb"},
+			EnvVars:     []string{"DATAPLANE_DELIVERY_TIER_BEACON_INTERVAL"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.DeliveryTiers.BeaconInterval,
+			Required:    false,
+		},
+		// Delivery group fairness related
+		&cli.Float64Flag{
+			Name:        "dataplane-group-fairness-skew",
+			Usage:       "Pass over a delivery group session with more than this many times the messages awaiting ACK of the least loaded other session (0: disabled)",
+			Aliases:     []string{"dgfs"},
+			EnvVars:     []string{"DATAPLANE_GROUP_FAIRNESS_SKEW"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.GroupFairness.SkewFactor,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-group-fairness-min-unacked",
+			Usage:       "Delivery group sessions with fewer messages awaiting ACK are never passed over",
+			Aliases:     []string{"dgfm"},
+			EnvVars:     []string{"DATAPLANE_GROUP_FAIRNESS_MIN_UNACKED"},
+			Value:       4,
+			DefaultText: "4",
+			Destination: &args.GroupFairness.MinUnacked,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-group-fairness-max-deflections",
+			Usage:       "Messages delivered this many times are sent to whichever session receives them",
+			Aliases:     []string{"dgfd"},
+			EnvVars:     []string{"DATAPLANE_GROUP_FAIRNESS_MAX_DEFLECTIONS"},
+			Value:       2,
+			DefaultText: "2",
+			Destination: &args.GroupFairness.MaxDeflections,
+			Required:    false,
+		},
+		// Consumer lease related
+		&cli.StringFlag{
+			Name:        "dataplane-consumer-lease-bucket",
+			Usage:       "JetStream KV bucket holding the leases of consumers pinned to sessions (empty: pinning disabled)",
+			Aliases:     []string{"dclb"},
+			EnvVars:     []string{"DATAPLANE_CONSUMER_LEASE_BUCKET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.ConsumerLeases.Bucket,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-consumer-lease-ttl",
+			Usage:       "How long a consumer lease lasts without renewal by its session",
+			Aliases:     []string{"dclt"},
+			EnvVars:     []string{"DATAPLANE_CONSUMER_LEASE_TTL"},
+			Value:       time.Second * 30,
+			DefaultText: "30s",
+			Destination: &args.ConsumerLeases.TTL,
+			Required:    false,
+		},
+		// Session limit related
+		&cli.DurationFlag{
+			Name:        "dataplane-session-max-duration",
+			Usage:       "Longest a push subscribe session lasts before the client is told to reconnect (0: no limit)",
+			Aliases:     []string{"dsmd"},
+			EnvVars:     []string{"DATAPLANE_SESSION_MAX_DURATION"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.SessionLimits.MaxDuration,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-session-idle-timeout",
+			Usage:       "Longest a push subscribe session goes without delivering a message before the client is told to reconnect (0: no limit)",
+			Aliases:     []string{"dsit"},
+			EnvVars:     []string{"DATAPLANE_SESSION_IDLE_TIMEOUT"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.SessionLimits.IdleTimeout,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-session-max-tracking-panics",
+			Usage:       "Fail a push subscribe session once the tracking of its inflight messages recovered from this many panics (0: no limit)",
+			Aliases:     []string{"dsmtp"},
+			EnvVars:     []string{"DATAPLANE_SESSION_MAX_TRACKING_PANICS"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.SessionLimits.MaxTrackingPanics,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-session-ack-drain-timeout",
+			Usage:       "How long a push subscribe session ended on a limit or server stop waits for the client to ACK the messages it was sent (0: end immediately)",
+			Aliases:     []string{"dsadt"},
+			EnvVars:     []string{"DATAPLANE_SESSION_ACK_DRAIN_TIMEOUT"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.SessionLimits.AckDrainTimeout,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-session-shutdown-drain-timeout",
+			Usage:       "How long the server waits on shutdown for the push subscribe sessions to end, reporting the progress at /drain, before closing the connections left (0: close immediately)",
+			Aliases:     []string{"dssdt"},
+			EnvVars:     []string{"DATAPLANE_SESSION_SHUTDOWN_DRAIN_TIMEOUT"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.SessionLimits.ShutdownDrainTimeout,
+			Required:    false,
+		},
+		// Per-tenant credentials related
+		&cli.StringFlag{
+			Name:        "dataplane-tenant-creds-provider",
+			Usage:       "Serve requests with NATS credentials of the client's tenant, resolved by: file, vault, http (default: disabled)",
+			Aliases:     []string{"dtcp"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_PROVIDER"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.TenantCredentials.Provider,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tenant-creds-dir",
+			Usage:       "Directory holding a '<tenant>.creds' NATS credentials file per tenant, for the file provider",
+			Aliases:     []string{"dtcd"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.TenantCredentials.Dir,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tenant-creds-vault-addr",
+			Usage:       "Vault server address, for the vault provider",
+			Aliases:     []string{"dtcva"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_VAULT_ADDR", "VAULT_ADDR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.TenantCredentials.VaultAddress,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tenant-creds-vault-token",
+			Usage:       "Vault token, for the vault provider",
+			Aliases:     []string{"dtcvt"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_VAULT_TOKEN", "VAULT_TOKEN"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.TenantCredentials.VaultToken,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tenant-creds-vault-path",
+			Usage:       "Vault API path under which each tenant's credentials are a secret, e.g. secret/data/httpmq",
+			Aliases:     []string{"dtcvp"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_VAULT_PATH"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.TenantCredentials.VaultPath,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tenant-creds-url",
+			Usage:       "URL of the service returning each tenant's credentials, for the http provider",
+			Aliases:     []string{"dtcu"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_URL"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.TenantCredentials.ServiceURL,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-tenant-creds-url-token",
+			Usage:       "Bearer token for calling the credentials service, for the http provider",
+			Aliases:     []string{"dtcut"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_URL_TOKEN"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.TenantCredentials.ServiceToken,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-tenant-creds-timeout",
+			Usage:       "Timeout for resolving a tenant's credentials",
+			Aliases:     []string{"dtct"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CREDS_TIMEOUT"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.TenantCredentials.Timeout,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-tenant-client-idle-timeout",
+			Usage:       "Duration a tenant's NATS connection is kept open while unused",
+			Aliases:     []string{"dtcit"},
+			EnvVars:     []string{"DATAPLANE_TENANT_CLIENT_IDLE_TIMEOUT"},
+			Value:       time.Minute * 5,
+			DefaultText: "5m",
+			Destination: &args.TenantCredentials.IdleTimeout,
+			Required:    false,
+		},
+		// Consumer filter related
+		&cli.StringFlag{
+			Name:        "dataplane-filter-bucket",
+			Usage:       "JetStream KV bucket storing consumer WASM filter modules (empty: disabled)",
+			Aliases:     []string{"dfb"},
+			EnvVars:     []string{"DATAPLANE_FILTER_BUCKET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Filters.Bucket,
+			Required:    false,
+		},
+		&cli.UintFlag{
+			Name:        "dataplane-filter-max-memory",
+			Usage:       "Max memory in MB of each filter instance (0: unlimited)",
+			Aliases:     []string{"dfmm"},
+			EnvVars:     []string{"DATAPLANE_FILTER_MAX_MEMORY"},
+			Value:       16,
+			DefaultText: "16",
+			Destination: &args.Filters.MaxMemoryMB,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-filter-timeout",
+			Usage:       "Max duration a filter may run on one message (0: unlimited)",
+			Aliases:     []string{"dft"},
+			EnvVars:     []string{"DATAPLANE_FILTER_TIMEOUT"},
+			Value:       time.Millisecond * 100,
+			DefaultText: "100ms",
+			Destination: &args.Filters.Timeout,
+			Required:    false,
+		},
+		// Consumer latency related
+		&cli.DurationFlag{
+			Name:        "dataplane-latency-window",
+			Usage:       "Recent period over which the ACK latency of a consumer is summarized",
+			Aliases:     []string{"dlw"},
+			EnvVars:     []string{"DATAPLANE_LATENCY_WINDOW"},
+			Value:       time.Minute * 5,
+			DefaultText: "5m",
+			Destination: &args.ConsumerLatency.Window,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-latency-slow-threshold",
+			Usage:       "p99 ACK latency above which a consumer is slow (0: disabled)",
+			Aliases:     []string{"dlst"},
+			EnvVars:     []string{"DATAPLANE_LATENCY_SLOW_THRESHOLD"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.ConsumerLatency.SlowThreshold,
+			Required:    false,
+		},
+		&cli.UintFlag{
+			Name:        "dataplane-latency-min-samples",
+			Usage:       "Min number of ACKs within the window for a consumer to be slow",
+			Aliases:     []string{"dlms"},
+			EnvVars:     []string{"DATAPLANE_LATENCY_MIN_SAMPLES"},
+			Value:       20,
+			DefaultText: "20",
+			Destination: &args.ConsumerLatency.MinSamples,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-latency-throttle-rate",
+			Usage:       "Max messages per second delivered to a slow consumer (0: no limit)",
+			Aliases:     []string{"dltr"},
+			EnvVars:     []string{"DATAPLANE_LATENCY_THROTTLE_RATE"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.ConsumerLatency.ThrottleRate,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-latency-report-subject",
+			Usage:       "NATS subject consumer latency reports are published under (empty: disabled)",
+			Aliases:     []string{"dlrs"},
+			EnvVars:     []string{"DATAPLANE_LATENCY_REPORT_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.ConsumerLatency.ReportSubject,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-latency-report-interval",
+			Usage:       "Interval between consumer latency reports",
+			Aliases:     []string{"dlri"},
+			EnvVars:     []string{"DATAPLANE_LATENCY_REPORT_INTERVAL"},
+			Value:       time.Second * 30,
+			DefaultText: "30s",
+			Destination: &args.ConsumerLatency.ReportInterval,
+			Required:    false,
+		},
+		// Replica affinity related
+		&cli.StringFlag{
+			Name:        "dataplane-replicas",
+			Usage:       "Comma separated base URLs of all dataplane replicas, to serve each durable consumer from one replica (empty: disabled)",
+			Aliases:     []string{"drps"},
+			EnvVars:     []string{"DATAPLANE_REPLICAS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.ReplicaAffinity.Replicas,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-replica-self",
+			Usage:       "Base URL of this dataplane replica, as listed in --dataplane-replicas",
+			Aliases:     []string{"drpself"},
+			EnvVars:     []string{"DATAPLANE_REPLICA_SELF"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.ReplicaAffinity.Self,
+			Required:    false,
+		},
+		// Session gossip related
+		&cli.StringFlag{
+			Name:        "dataplane-session-gossip-subject",
+			Usage:       "NATS subject for sharing the push subscribe sessions of each replica (empty: disabled)",
+			Aliases:     []string{"dsgs"},
+			EnvVars:     []string{"DATAPLANE_SESSION_GOSSIP_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.SessionGossip.Subject,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-session-gossip-interval",
+			Usage:       "Interval between shares of the push subscribe sessions of this replica",
+			Aliases:     []string{"dsgi"},
+			EnvVars:     []string{"DATAPLANE_SESSION_GOSSIP_INTERVAL"},
+			Value:       time.Second * 10,
+			DefaultText: "10s",
+			Destination: &args.SessionGossip.Interval,
+			Required:    false,
+		},
+		// Session lifecycle event related
+		&cli.StringFlag{
+			Name:        "dataplane-session-events-webhook",
+			Usage:       "Webhook URL to POST push subscribe session start, end, and error events to",
+			Aliases:     []string{"dsew"},
+			EnvVars:     []string{"DATAPLANE_SESSION_EVENTS_WEBHOOK"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.SessionEvents.WebhookURL,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-session-events-webhook-timeout",
+			Usage:       "Timeout of each session event webhook call",
+			Aliases:     []string{"dsewt"},
+			EnvVars:     []string{"DATAPLANE_SESSION_EVENTS_WEBHOOK_TIMEOUT"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.SessionEvents.WebhookTimeout,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-session-events-subject",
+			Usage:       "NATS subject to publish push subscribe session start, end, and error events on",
+			Aliases:     []string{"dses"},
+			EnvVars:     []string{"DATAPLANE_SESSION_EVENTS_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.SessionEvents.NATSSubject,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-session-events-queue",
+			Usage:       "Max number of session events waiting to be sent, beyond which events are dropped",
+			Aliases:     []string{"dseq"},
+			EnvVars:     []string{"DATAPLANE_SESSION_EVENTS_QUEUE"},
+			Value:       1024,
+			DefaultText: "1024",
+			Destination: &args.SessionEvents.QueueLength,
+			Required:    false,
+		},
+		// Message sampling related
+		&cli.StringFlag{
+			Name:        "dataplane-sampling-rules",
+			Usage:       "JSON file of the rules sampling messages to inspection destinations (empty: disabled)",
+			Aliases:     []string{"dsr"},
+			EnvVars:     []string{"DATAPLANE_SAMPLING_RULES"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Sampling.RulesFile,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-sampling-webhook-timeout",
+			Usage:       "Timeout of each message sample webhook call",
+			Aliases:     []string{"dswt"},
+			EnvVars:     []string{"DATAPLANE_SAMPLING_WEBHOOK_TIMEOUT"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.Sampling.WebhookTimeout,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-sampling-queue",
+			Usage:       "Max number of message samples waiting to be sent, beyond which samples are dropped",
+			Aliases:     []string{"dsq"},
+			EnvVars:     []string{"DATAPLANE_SAMPLING_QUEUE"},
+			Value:       1024,
+			DefaultText: "1024",
+			Destination: &args.Sampling.QueueLength,
+			Required:    false,
+		},
+		// StatsD related
+		&cli.StringFlag{
+			Name:        "dataplane-statsd-address",
+			Usage:       "host:port of the StatsD server to push the metrics to over UDP (empty: disabled)",
+			Aliases:     []string{"dsda"},
+			EnvVars:     []string{"DATAPLANE_STATSD_ADDRESS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.StatsD.Address,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-statsd-flavor",
+			Usage:       "Dialect of the StatsD server [statsd, dogstatsd]",
+			Aliases:     []string{"dsdf"},
+			EnvVars:     []string{"DATAPLANE_STATSD_FLAVOR"},
+			Value:       "dogstatsd",
+			DefaultText: "dogstatsd",
+			Destination: &args.StatsD.Flavor,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-statsd-prefix",
+			Usage:       "Prefix of the metric names pushed to StatsD",
+			Aliases:     []string{"dsdp"},
+			EnvVars:     []string{"DATAPLANE_STATSD_PREFIX"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.StatsD.Prefix,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-statsd-tags",
+			Usage:       "Comma separated key:value tags added to the metrics pushed to DogStatsD",
+			Aliases:     []string{"dsdt"},
+			EnvVars:     []string{"DATAPLANE_STATSD_TAGS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.StatsD.Tags,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-statsd-interval",
+			Usage:       "Interval between pushes of the metrics to StatsD",
+			Aliases:     []string{"dsdi"},
+			EnvVars:     []string{"DATAPLANE_STATSD_INTERVAL"},
+			Value:       time.Second * 10,
+			DefaultText: "10s",
+			Destination: &args.StatsD.Interval,
+			Required:    false,
+		},
+		// SLO related
+		&cli.Float64Flag{
+			Name:        "dataplane-slo-availability",
+			Usage:       "Target ratio of publishes and deliveries which succeed, e.g. 0.999 (0: SLO tracking disabled)",
+			Aliases:     []string{"dsloa"},
+			EnvVars:     []string{"DATAPLANE_SLO_AVAILABILITY"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.SLO.AvailabilityObjective,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-slo-latency-threshold",
+			Usage:       "Latency above which a successful publish or delivery is slow",
+			Aliases:     []string{"dslolt"},
+			EnvVars:     []string{"DATAPLANE_SLO_LATENCY_THRESHOLD"},
+			Value:       time.Millisecond * 500,
+			DefaultText: "500ms",
+			Destination: &args.SLO.LatencyThreshold,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-slo-latency-objective",
+			Usage:       "Target ratio of successful publishes and deliveries which are not slow",
+			Aliases:     []string{"dslolo"},
+			EnvVars:     []string{"DATAPLANE_SLO_LATENCY_OBJECTIVE"},
+			Value:       0.99,
+			DefaultText: "0.99",
+			Destination: &args.SLO.LatencyObjective,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-slo-windows",
+			Usage:       "Comma separated sliding windows the SLOs are evaluated over",
+			Aliases:     []string{"dslow"},
+			EnvVars:     []string{"DATAPLANE_SLO_WINDOWS"},
+			Value:       "5m,1h,6h",
+			DefaultText: "5m,1h,6h",
+			Destination: &args.SLO.Windows,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-slo-resolution",
+			Usage:       "Granularity of the SLO sliding windows",
+			Aliases:     []string{"dslor"},
+			EnvVars:     []string{"DATAPLANE_SLO_RESOLUTION"},
+			Value:       time.Second * 10,
+			DefaultText: "10s",
+			Destination: &args.SLO.Resolution,
+			Required:    false,
+		},
+		// Message trace related
+		&cli.StringFlag{
+			Name:        "dataplane-trace-subjects",
+			Usage:       "Comma separated subjects whose messages sent to clients are traced (NATS wildcards allowed)",
+			Aliases:     []string{"dmts"},
+			EnvVars:     []string{"DATAPLANE_TRACE_SUBJECTS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.MessageTrace.Subjects,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-trace-consumers",
+			Usage:       "Comma separated <stream>/<consumer> whose messages sent to clients are traced",
+			Aliases:     []string{"dmtc"},
+			EnvVars:     []string{"DATAPLANE_TRACE_CONSUMERS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.MessageTrace.Consumers,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-trace-window",
+			Usage:       "Number of recent messages kept for each traced subject and consumer",
+			Aliases:     []string{"dmtw"},
+			EnvVars:     []string{"DATAPLANE_TRACE_WINDOW"},
+			Value:       100,
+			DefaultText: "100",
+			Destination: &args.MessageTrace.WindowSize,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-trace-payload-bytes",
+			Usage:       "Bytes of each traced message payload kept (0: payloads not kept)",
+			Aliases:     []string{"dmtp"},
+			EnvVars:     []string{"DATAPLANE_TRACE_PAYLOAD_BYTES"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.MessageTrace.PayloadBytes,
+			Required:    false,
+		},
+		// Alert related
+		&cli.StringFlag{
+			Name:        "dataplane-alert-webhook-url",
+			Usage:       "Webhook URL to POST alerts to",
+			Aliases:     []string{"dalw"},
+			EnvVars:     []string{"DATAPLANE_ALERT_WEBHOOK_URL"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Alerts.WebhookURL,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-alert-webhook-timeout",
+			Usage:       "Timeout when POSTing alerts to the webhook",
+			Aliases:     []string{"dalt"},
+			EnvVars:     []string{"DATAPLANE_ALERT_WEBHOOK_TIMEOUT"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.Alerts.WebhookTimeout,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-alert-nats-subject",
+			Usage:       "NATS subject to publish alerts on",
+			Aliases:     []string{"dals"},
+			EnvVars:     []string{"DATAPLANE_ALERT_NATS_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Alerts.NATSSubject,
+			Required:    false,
+		},
+		// Publish rate anomaly related
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-anomaly-interval",
+			Usage:       "Interval between samples of the publish rate of each subject (0: anomaly detection disabled)",
+			Aliases:     []string{"dani"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ANOMALY_INTERVAL"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.PublishAnomaly.Interval,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-publish-anomaly-alpha",
+			Usage:       "Smoothing factor of the moving average publish rate of each subject",
+			Aliases:     []string{"dana"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ANOMALY_ALPHA"},
+			Value:       0.1,
+			DefaultText: "0.1",
+			Destination: &args.PublishAnomaly.Alpha,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-publish-anomaly-spike-factor",
+			Usage:       "Times the average publish rate of a subject its rate must exceed to spike",
+			Aliases:     []string{"dans"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ANOMALY_SPIKE_FACTOR"},
+			Value:       3,
+			DefaultText: "3",
+			Destination: &args.PublishAnomaly.SpikeFactor,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-publish-anomaly-drought-factor",
+			Usage:       "Fraction of the average publish rate of a subject its rate must fall below to be in a drought",
+			Aliases:     []string{"dand"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ANOMALY_DROUGHT_FACTOR"},
+			Value:       0.2,
+			DefaultText: "0.2",
+			Destination: &args.PublishAnomaly.DroughtFactor,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "dataplane-publish-anomaly-min-rate",
+			Usage:       "Average publish rate (msg/s) below which a subject is too quiet to judge",
+			Aliases:     []string{"danm"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ANOMALY_MIN_RATE"},
+			Value:       1,
+			DefaultText: "1",
+			Destination: &args.PublishAnomaly.MinRate,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-publish-anomaly-warmup",
+			Usage:       "Number of samples of a subject's publish rate taken before it is judged",
+			Aliases:     []string{"danw"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ANOMALY_WARMUP"},
+			Value:       10,
+			DefaultText: "10",
+			Destination: &args.PublishAnomaly.Warmup,
 			Required:    false,
 		},
-		// End-point related
+		&cli.IntFlag{
+			Name:        "dataplane-publish-anomaly-max-subjects",
+			Usage:       "Max number of subjects whose publish rate is tracked",
+			Aliases:     []string{"danx"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_ANOMALY_MAX_SUBJECTS"},
+			Value:       1000,
+			DefaultText: "1000",
+			Destination: &args.PublishAnomaly.MaxSubjects,
+			Required:    false,
+		},
+		// Request quota related
+		&cli.IntFlag{
+			Name:        "dataplane-request-quota-limit",
+			Usage:       "Max data API requests of a client within a quota window (0: no limit)",
+			Aliases:     []string{"drql"},
+			EnvVars:     []string{"DATAPLANE_REQUEST_QUOTA_LIMIT"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.RequestQuota.Limit,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-request-quota-window",
+			Usage:       "Length of a data API request quota window",
+			Aliases:     []string{"drqw"},
+			EnvVars:     []string{"DATAPLANE_REQUEST_QUOTA_WINDOW"},
+			Value:       time.Minute,
+			DefaultText: "1m",
+			Destination: &args.RequestQuota.Window,
+			Required:    false,
+		},
+		// Publish failover related
 		&cli.StringFlag{
-			Name:        "dataplane-server-endpoint-prefix",
-			Usage:       "Set the end-point path prefix for the dataplane APIs",
-			Aliases:     []string{"dsep"},
-			EnvVars:     []string{"DATAPLANE_SERVER_ENDPOINT_PREFIX"},
-			Value:       "/",
-			DefaultText: "/",
-			Destination: &args.Endpoints.PathPrefix,
+			Name:        "dataplane-publish-failover-secondary-uri",
+			Usage:       "Secondary NATS cluster publishes fail over to (empty: failover disabled)",
+			Aliases:     []string{"dpfsu"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_FAILOVER_SECONDARY_URI"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.PublishFailover.SecondaryURI,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-publish-failover-probe-interval",
+			Usage:       "How often the health of the primary and secondary NATS clusters is probed",
+			Aliases:     []string{"dpfpi"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_FAILOVER_PROBE_INTERVAL"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.PublishFailover.ProbeInterval,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-publish-failover-failure-threshold",
+			Usage:       "Consecutive failed probes of the primary NATS cluster before failing over",
+			Aliases:     []string{"dpfft"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_FAILOVER_FAILURE_THRESHOLD"},
+			Value:       3,
+			DefaultText: "3",
+			Destination: &args.PublishFailover.FailureThreshold,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "dataplane-publish-failover-recovery-threshold",
+			Usage:       "Consecutive successful probes of the primary NATS cluster before failing back",
+			Aliases:     []string{"dpfrt"},
+			EnvVars:     []string{"DATAPLANE_PUBLISH_FAILOVER_RECOVERY_THRESHOLD"},
+			Value:       6,
+			DefaultText: "6",
+			Destination: &args.PublishFailover.RecoveryThreshold,
+			Required:    false,
+		},
+		// Preflight related
+		&cli.BoolFlag{
+			Name:        "check",
+			Usage:       "Run only the preflight checks of the dataplane server, and exit",
+			EnvVars:     []string{"DATAPLANE_CHECK"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Preflight.CheckOnly,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-preflight-requirements",
+			Usage:       "JSON file of the streams and consumers which must exist before starting",
+			Aliases:     []string{"dpr"},
+			EnvVars:     []string{"DATAPLANE_PREFLIGHT_REQUIREMENTS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Preflight.RequirementsFile,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "dataplane-preflight-create-missing",
+			Usage:       "Create the required streams and consumers which do not exist",
+			Aliases:     []string{"dpcm"},
+			EnvVars:     []string{"DATAPLANE_PREFLIGHT_CREATE_MISSING"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Preflight.CreateMissing,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "dataplane-preflight-timeout",
+			Usage:       "Timeout of each preflight check against JetStream",
+			Aliases:     []string{"dpt"},
+			EnvVars:     []string{"DATAPLANE_PREFLIGHT_TIMEOUT"},
+			Value:       time.Second * 10,
+			DefaultText: "10s",
+			Destination: &args.Preflight.Timeout,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-access-log-encrypt-dir",
+			Usage:       "Directory to write the access log of each tenant to, encrypted with the tenant's key, instead of the server log",
+			Aliases:     []string{"daled"},
+			EnvVars:     []string{"DATAPLANE_ACCESS_LOG_ENCRYPT_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.AccessLog.EncryptDir,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dataplane-access-log-key-dir",
+			Usage:       "Directory of the hex encoded access log key of each tenant, in the file <tenant>.key",
+			Aliases:     []string{"dalkd"},
+			EnvVars:     []string{"DATAPLANE_ACCESS_LOG_KEY_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.AccessLog.KeyDir,
 			Required:    false,
 		},
 	}
@@ -76,6 +1822,7 @@ func RunDataplaneServer(
 	params DataplaneCLIArgs,
 	instance string,
 	natsClient *core.NatsClient,
+	natsParam core.NATSConnectParams,
 	runTimeContext context.Context,
 	wg *sync.WaitGroup,
 ) error {
@@ -91,6 +1838,16 @@ func RunDataplaneServer(
 		return err
 	}
 
+	if err := runPreflight(
+		params.Preflight, params.Listener, natsClient, instance, logTags, runTimeContext,
+	); err != nil {
+		return err
+	}
+	if params.Preflight.CheckOnly {
+		log.WithFields(logTags).Info("Preflight checks passed")
+		return nil
+	}
+
 	msgPub, err := dataplane.GetJetStreamPublisher(natsClient, instance)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf("Unable to define message publisher")
@@ -103,10 +1860,693 @@ func RunDataplaneServer(
 		return err
 	}
 
+	// Stream auto-create is opt-in
+	var streamAutoCreate *apis.StreamAutoCreateParam
+	if params.StreamAutoCreate.Enabled {
+		controller, err := management.GetJetStreamController(natsClient, instance)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define JetStream controller")
+			return err
+		}
+		streamAutoCreate = &apis.StreamAutoCreateParam{
+			Controller: controller,
+			Limits: management.JSStreamLimits{
+				MaxAge:   &params.StreamAutoCreate.MaxAge,
+				MaxBytes: &params.StreamAutoCreate.MaxBytes,
+				MaxMsgs:  &params.StreamAutoCreate.MaxMsgs,
+			},
+		}
+		log.WithFields(logTags).Warn("Streams will be defined automatically on publish")
+	}
+
+	// Inflight message persistence is opt-in
+	var inflightPersist dataplane.InflightMsgPersistence
+	if params.InflightPersistence.Enabled {
+		storeParam := storage.KeyValueStoreParam{
+			Backend: params.InflightPersistence.Backend,
+			Bucket:  params.InflightPersistence.Bucket,
+			Path:    params.InflightPersistence.Path,
+			TTL:     params.InflightPersistence.TTL,
+		}
+		if err := validate.Struct(&storeParam); err != nil {
+			log.WithError(err).WithFields(logTags).Error("Invalid inflight persistence args")
+			return err
+		}
+		store, err := storage.GetKeyValueStore(storeParam, natsClient)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define inflight record store")
+			return err
+		}
+		defer func() {
+			if err := store.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close inflight record store")
+			}
+		}()
+		inflightPersist, err = dataplane.GetInflightPersistence(natsClient, store, instance)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define inflight persistence")
+			return err
+		}
+	}
+
+	// Message redaction is opt-in
+	var redactor dataplane.MessageRedactor
+	if params.RedactionRulesFile != "" {
+		rules, err := dataplane.LoadRedactionRules(params.RedactionRulesFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read redaction rules")
+			return err
+		}
+		redactor, err = dataplane.GetMessageRedactor(rules)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define message redactor")
+			return err
+		}
+		log.WithFields(logTags).Infof("Redacting messages of %d streams", len(rules))
+	}
+
+	// Payload access rules of tail sessions are opt-in
+	var payloadAccess dataplane.PayloadAccessControl
+	if params.StreamTail.PayloadAccessFile != "" {
+		policy, err := dataplane.LoadPayloadAccessPolicy(params.StreamTail.PayloadAccessFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read payload access policy")
+			return err
+		}
+		payloadAccess, err = dataplane.GetPayloadAccessControl(policy)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define payload access control")
+			return err
+		}
+	}
+
+	// The GraphQL API is opt-in
+	graphQL := apis.GraphQLParam{Enabled: params.GraphQL}
+
+	// Public streams are opt-in
+	var publicStreams dataplane.PublicStreamGate
+	if params.StreamTail.PublicStreamsFile != "" {
+		streams, err := dataplane.LoadPublicStreams(params.StreamTail.PublicStreamsFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read public streams")
+			return err
+		}
+		publicStreams, err = dataplane.GetPublicStreamGate(streams)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define public streams")
+			return err
+		}
+		log.WithFields(logTags).Infof("Serving %d public streams", len(streams))
+	}
+
+	// Consumer filters are opt-in
+	var filterRegistry filters.Registry
+	if params.Filters.Bucket != "" {
+		store, err := storage.GetKeyValueStore(storage.KeyValueStoreParam{
+			Backend: storage.BackendJetStream, Bucket: params.Filters.Bucket,
+		}, natsClient)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define filter module store")
+			return err
+		}
+		defer func() {
+			if err := store.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close filter module store")
+			}
+		}()
+		filterRegistry, err = filters.GetRegistry(
+			store,
+			filters.Limits{
+				MaxMemoryMB: uint32(params.Filters.MaxMemoryMB), Timeout: params.Filters.Timeout,
+			},
+			instance,
+			runTimeContext,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define filter registry")
+			return err
+		}
+		defer func() {
+			if err := filterRegistry.Close(context.Background()); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close filter registry")
+			}
+		}()
+	}
+
+	// Consumer ACK latency is exported as Prometheus metrics
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	latency, err := metrics.GetConsumerLatencyTracker(
+		metrics.ConsumerLatencyParam{
+			Window:        params.ConsumerLatency.Window,
+			SlowThreshold: params.ConsumerLatency.SlowThreshold,
+			MinSamples:    uint64(params.ConsumerLatency.MinSamples),
+			ThrottleRate:  params.ConsumerLatency.ThrottleRate,
+		},
+		metricsRegistry,
+		instance,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define consumer latency tracker")
+		return err
+	}
+
+	// Published message bodies are decoded into pooled buffers
+	var publishBuffers common.BufferPool
+	if params.Publish.BufferMaxRetained > 0 {
+		publishBuffers, err = common.GetBufferPool(int(params.Publish.BufferMaxRetained))
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define publish buffer pool")
+			return err
+		}
+		if err := metrics.RegisterBufferPoolMetrics(
+			publishBuffers, "publish", metricsRegistry,
+		); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to register publish buffer pool metrics")
+			return err
+		}
+	}
+
+	// Content inspection of published messages is opt-in
+	var inspector dataplane.ContentInspector
+	if params.Publish.InspectionRulesFile != "" {
+		rules, err := dataplane.LoadContentInspectionRules(params.Publish.InspectionRulesFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read content inspection rules")
+			return err
+		}
+		inspector, err = dataplane.GetContentInspector(
+			natsClient, rules, params.Publish.InspectionCacheTTL,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define content inspector")
+			return err
+		}
+		log.WithFields(logTags).Infof("Inspecting messages published to %d streams", len(rules))
+	}
+
+	var streamQuotas dataplane.StreamQuotaReporter
+	if params.Publish.QuotaHeaders {
+		streamQuotas, err = dataplane.GetStreamQuotaReporter(natsClient, params.Publish.QuotaCacheTTL)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define stream quota reporter")
+			return err
+		}
+	}
+
+	// PII scanning of published messages is opt-in
+	var piiScanner dataplane.PIIScanner
+	if params.Publish.PIIRulesFile != "" {
+		rules, err := dataplane.LoadPIIScanRules(params.Publish.PIIRulesFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read PII scan rules")
+			return err
+		}
+		detectionMetrics, err := metrics.GetPIIDetectionMetrics(metricsRegistry)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to register PII detection metrics")
+			return err
+		}
+		piiScanner, err = dataplane.GetPIIScanner(
+			natsClient, rules, params.Publish.PIICacheTTL, detectionMetrics,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define PII scanner")
+			return err
+		}
+		log.WithFields(logTags).Infof(
+			"Scanning messages published to %d streams for PII", len(rules.Streams),
+		)
+	}
+
+	var publishGrants dataplane.PublishGrantIssuer
+	if params.Publish.GrantMaxTTL > 0 {
+		publishGrants, err = dataplane.GetPublishGrantIssuer(
+			[]byte(params.Publish.GrantKey), params.Publish.GrantMaxTTL, instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define publish grant issuer")
+			return err
+		}
+	}
+
+	var requestQuota common.RequestQuota
+	if params.RequestQuota.Limit > 0 {
+		requestQuota, err = common.GetRequestQuota(common.RequestQuotaParam{
+			Limit: params.RequestQuota.Limit, Window: params.RequestQuota.Window,
+		})
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define request quota")
+			return err
+		}
+	}
+
+	if err := metrics.RegisterTaskProcessorMetrics(metricsRegistry); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to register task processor metrics")
+		return err
+	}
+
+	drainMetrics, err := metrics.GetDrainMetrics(metricsRegistry)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define drain metrics")
+		return err
+	}
+
+	sessionBufferMetrics, err := metrics.GetSessionBufferMetrics(metricsRegistry)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to register session buffer metrics")
+		return err
+	}
+
+	// SLO tracking is opt-in
+	var slo metrics.SLOTracker
+	if params.SLO.AvailabilityObjective > 0 {
+		windows := []time.Duration{}
+		for _, entry := range splitCommaList(params.SLO.Windows) {
+			window, err := time.ParseDuration(entry)
+			if err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Unable to parse SLO window %s", entry)
+				return err
+			}
+			windows = append(windows, window)
+		}
+		slo, err = metrics.GetSLOTracker(
+			metrics.SLOParam{
+				AvailabilityObjective: params.SLO.AvailabilityObjective,
+				LatencyThreshold:      params.SLO.LatencyThreshold,
+				LatencyObjective:      params.SLO.LatencyObjective,
+				Windows:               windows,
+				Resolution:            params.SLO.Resolution,
+			},
+			metricsRegistry,
+			instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define SLO tracker")
+			return err
+		}
+	}
+
+	requester, err := dataplane.GetJetStreamRequester(
+		natsClient, params.RequestReply.ReplyPrefix, instance,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define requester")
+		return err
+	}
+
+	fetcher, err := dataplane.GetJetStreamBatchFetcher(
+		natsClient, params.BatchFetch.CommitTTL, instance,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define batch fetcher")
+		return err
+	}
+
+	// Bulk import is opt-in
+	var importer dataplane.BulkImporter
+	if params.Import.Concurrency > 0 {
+		importer, err = dataplane.GetBulkImporter(
+			dataplane.BulkImportParam{
+				Concurrency:  params.Import.Concurrency,
+				MaxLineBytes: params.Import.MaxLineBytes,
+				TokenTTL:     params.Import.TokenTTL,
+				AckWait:      params.Publish.AckWait,
+				Subjects:     defineSubjectRules(params.Subjects),
+			},
+			[]byte(params.Import.TokenKey),
+			inspector,
+			instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define bulk importer")
+			return err
+		}
+	}
+
+	var sessions dataplane.SubscriptionSessionRegistry
+	if params.SessionResume.TokenTTL > 0 {
+		sessions, err = dataplane.GetSubscriptionSessionRegistry(
+			natsClient,
+			[]byte(params.SessionResume.TokenKey),
+			params.SessionResume.TokenTTL,
+			inflightPersist,
+			instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define session registry")
+			return err
+		}
+	}
+
+	var tiers dataplane.DeliveryTierCoordinator
+	if params.DeliveryTiers.BeaconInterval > 0 {
+		tiers, err = dataplane.GetDeliveryTierCoordinator(
+			natsClient, params.DeliveryTiers.BeaconInterval, instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define delivery tier coordinator")
+			return err
+		}
+	}
+
+	var fairness dataplane.DeliveryGroupBalancer
+	if params.GroupFairness.SkewFactor > 0 {
+		fairness, err = dataplane.GetDeliveryGroupBalancer(
+			dataplane.GroupFairnessParam{
+				SkewFactor:     params.GroupFairness.SkewFactor,
+				MinUnacked:     params.GroupFairness.MinUnacked,
+				MaxDeflections: params.GroupFairness.MaxDeflections,
+			},
+			instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define delivery group balancer")
+			return err
+		}
+	}
+
+	var leases dataplane.ConsumerLeaseManager
+	if params.ConsumerLeases.Bucket != "" {
+		leases, err = dataplane.GetConsumerLeaseManager(
+			natsClient, params.ConsumerLeases.Bucket, params.ConsumerLeases.TTL, instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define consumer lease manager")
+			return err
+		}
+	}
+
+	var affinity dataplane.ConsumerAffinity
+	if params.ReplicaAffinity.Replicas != "" {
+		affinity, err = dataplane.GetConsumerAffinity(
+			params.ReplicaAffinity.Self, splitCommaList(params.ReplicaAffinity.Replicas),
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define replica affinity")
+			return err
+		}
+	}
+
 	localCtxt, lclCancel := context.WithCancel(runTimeContext)
 	defer lclCancel()
+
+	var tenantClients core.NatsClientPool
+	if params.TenantCredentials.Provider != "" {
+		tenantClients, err = defineTenantClients(
+			params.TenantCredentials, params.Listener, natsParam, localCtxt, wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define tenant clients")
+			return err
+		}
+		defer tenantClients.Close(context.Background())
+	}
+
+	// Publish routing to other NATS connections is opt-in
+	var publishRouter dataplane.PublishRouter
+	if params.Publish.RoutingTableFile != "" {
+		table, err := dataplane.LoadPublishRoutingTable(params.Publish.RoutingTableFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read publish routing table")
+			return err
+		}
+		publishRouter, err = dataplane.GetPublishRouter(
+			table, natsParam, natsClient, params.Publish.RoutingHealthInterval, instance, localCtxt, wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define publish router")
+			return err
+		}
+		defer publishRouter.Close(context.Background())
+		log.WithFields(logTags).Infof(
+			"Routing publishes to %d destinations on %d routes",
+			len(table.Destinations), len(table.Routes),
+		)
+	}
+
+	// Active-passive failover of publishes is opt-in
+	var publishFailover dataplane.PublishFailover
+	if params.PublishFailover.SecondaryURI != "" {
+		secondaryParam := natsParam
+		secondaryParam.ServerURI = params.PublishFailover.SecondaryURI
+		publishFailover, err = dataplane.GetPublishFailover(
+			dataplane.PublishFailoverParam{
+				ProbeInterval:     params.PublishFailover.ProbeInterval,
+				FailureThreshold:  params.PublishFailover.FailureThreshold,
+				RecoveryThreshold: params.PublishFailover.RecoveryThreshold,
+			},
+			natsClient,
+			secondaryParam,
+			instance,
+			localCtxt,
+			wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define publish failover")
+			return err
+		}
+		defer publishFailover.Close(context.Background())
+	}
+
+	var clusterSessions dataplane.ClusterSessionRegistry
+	if params.SessionGossip.Subject != "" {
+		// Replicas are known by their base URL with replica affinity, so redirects can follow
+		// the sessions
+		replica := instance
+		if affinity != nil {
+			replica = affinity.Self()
+		}
+		clusterSessions, err = dataplane.GetClusterSessionRegistry(
+			natsClient,
+			params.SessionGossip.Subject,
+			replica,
+			params.SessionGossip.Interval,
+			instance,
+			localCtxt,
+			wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define cluster session registry")
+			return err
+		}
+	}
+
+	// Session lifecycle events are opt-in
+	var sessionEvents dataplane.SessionEventNotifier
+	if params.SessionEvents.WebhookURL != "" || params.SessionEvents.NATSSubject != "" {
+		sessionEvents, err = dataplane.GetSessionEventNotifier(
+			dataplane.SessionEventParam{
+				WebhookURL:     params.SessionEvents.WebhookURL,
+				WebhookTimeout: params.SessionEvents.WebhookTimeout,
+				NATSSubject:    params.SessionEvents.NATSSubject,
+				QueueLength:    params.SessionEvents.QueueLength,
+			},
+			natsClient,
+			instance,
+			localCtxt,
+			wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define session event notifier")
+			return err
+		}
+	}
+
+	// Message sampling is opt-in
+	if params.Sampling.RulesFile != "" {
+		rules, err := dataplane.LoadSamplingRules(params.Sampling.RulesFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read sampling rules")
+			return err
+		}
+		sampler, err := dataplane.GetMessageSampler(
+			dataplane.MessageSamplerParam{
+				Rules:          rules,
+				WebhookTimeout: params.Sampling.WebhookTimeout,
+				QueueLength:    params.Sampling.QueueLength,
+			},
+			natsClient,
+			instance,
+			localCtxt,
+			wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define message sampler")
+			return err
+		}
+		if err := hooks.Register("message-sampling", sampler); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to register message sampler")
+			return err
+		}
+		defer hooks.Unregister("message-sampling")
+	}
+
+	// Message trace is opt-in
+	var tracer dataplane.MessageTracer
+	traceSubjects := splitCommaList(params.MessageTrace.Subjects)
+	traceConsumers := splitCommaList(params.MessageTrace.Consumers)
+	if len(traceSubjects) > 0 || len(traceConsumers) > 0 {
+		tracer, err = dataplane.GetMessageTracer(dataplane.MessageTraceParam{
+			Subjects:     traceSubjects,
+			Consumers:    traceConsumers,
+			WindowSize:   params.MessageTrace.WindowSize,
+			PayloadBytes: params.MessageTrace.PayloadBytes,
+		})
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define message tracer")
+			return err
+		}
+	}
+
+	// Publish rate anomaly detection is opt-in
+	var publishAnomalies metrics.PublishAnomalyDetector
+	if params.PublishAnomaly.Interval > 0 {
+		alertSink, err := defineAlertSink(params.Alerts, instance, natsClient)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define alert sink")
+			return err
+		}
+		if alertSink == nil {
+			log.WithFields(logTags).Warn("Publish anomaly detection enabled, but no alert sink defined")
+		}
+		publishAnomalies, err = metrics.GetPublishAnomalyDetector(
+			metrics.PublishAnomalyParam{
+				Alpha:         params.PublishAnomaly.Alpha,
+				SpikeFactor:   params.PublishAnomaly.SpikeFactor,
+				DroughtFactor: params.PublishAnomaly.DroughtFactor,
+				MinRate:       params.PublishAnomaly.MinRate,
+				Warmup:        params.PublishAnomaly.Warmup,
+				MaxSubjects:   params.PublishAnomaly.MaxSubjects,
+			},
+			alertSink,
+			metricsRegistry,
+			instance,
+			localCtxt,
+			wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define publish anomaly detector")
+			return err
+		}
+		if err := publishAnomalies.Start(params.PublishAnomaly.Interval); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to start publish anomaly detector")
+			return err
+		}
+	}
+
+	// Pushing the metrics to StatsD is opt-in
+	if params.StatsD.Address != "" {
+		exporter, err := metrics.GetStatsDExporter(
+			metrics.StatsDParam{
+				Address:       params.StatsD.Address,
+				Flavor:        metrics.StatsDFlavor(params.StatsD.Flavor),
+				Prefix:        params.StatsD.Prefix,
+				Tags:          splitCommaList(params.StatsD.Tags),
+				MaxPacketSize: statsDMaxPacketSize,
+			},
+			metricsRegistry,
+			instance,
+			localCtxt,
+			wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define StatsD exporter")
+			return err
+		}
+		if err := exporter.Start(params.StatsD.Interval); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to start StatsD exporter")
+			return err
+		}
+	}
+
+	// Consumer latency reports for the management API are opt-in
+	if params.ConsumerLatency.ReportSubject != "" {
+		reporter, err := metrics.GetConsumerLatencyReporter(
+			natsClient, latency, params.ConsumerLatency.ReportSubject, instance, localCtxt, wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define latency reporter")
+			return err
+		}
+		if err := reporter.Start(params.ConsumerLatency.ReportInterval); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to start latency reporter")
+			return err
+		}
+	}
+
 	httpHandler, err := apis.GetAPIRestJetStreamDataplaneHandler(
-		natsClient, msgPub, ackPub, localCtxt, wg,
+		natsClient,
+		msgPub,
+		ackPub,
+		defineSubjectRules(params.Subjects),
+		apis.PublishParam{
+			AckWait:    params.Publish.AckWait,
+			RetryAfter: params.Publish.RetryAfter,
+			Buffers:    publishBuffers,
+			Anomalies:  publishAnomalies,
+			Inspector:  inspector,
+			Router:     publishRouter,
+			Failover:   publishFailover,
+			Quotas:     streamQuotas,
+			PIIScanner: piiScanner,
+			Grants:     publishGrants,
+		},
+		params.HTTP2.StreamKeepAlive,
+		apis.SessionWriteBufferParam{
+			MaxBytes:     int(params.SessionWriteBuffer.MaxBytes),
+			Policy:       dataplane.SlowClientPolicy(params.SessionWriteBuffer.Policy),
+			DrainTimeout: params.SessionWriteBuffer.DrainTimeout,
+			Metrics:      sessionBufferMetrics,
+		},
+		apis.SessionLimitParam{
+			MaxDuration:       params.SessionLimits.MaxDuration,
+			IdleTimeout:       params.SessionLimits.IdleTimeout,
+			MaxTrackingPanics: params.SessionLimits.MaxTrackingPanics,
+			AckDrainTimeout:   params.SessionLimits.AckDrainTimeout,
+		},
+		apis.StreamTailParam{
+			MaxDuration:   params.StreamTail.MaxDuration,
+			MaxRate:       params.StreamTail.MaxRate,
+			PayloadAccess: payloadAccess,
+			PublicStreams: publicStreams,
+		},
+		apis.ExportParam{
+			MaxDuration: params.Export.MaxDuration, MaxRate: params.Export.MaxRate,
+		},
+		apis.RequestReplyParam{
+			Requester: requester, MaxTimeout: params.RequestReply.MaxTimeout,
+		},
+		apis.BatchFetchParam{
+			Fetcher:  fetcher,
+			MaxBatch: params.BatchFetch.MaxBatch,
+			MaxWait:  params.BatchFetch.MaxWait,
+		},
+		graphQL,
+		apis.DataplaneHandlerOptions{
+			ExternalACKPrefix: params.ExternalACKPrefix,
+			StreamAutoCreate:  streamAutoCreate,
+			InflightPersist:   inflightPersist,
+			Redactor:          redactor,
+			Importer:          importer,
+			Sessions:          sessions,
+			TenantClients:     tenantClients,
+			FilterRegistry:    filterRegistry,
+			Latency:           latency,
+			Tiers:             tiers,
+			Fairness:          fairness,
+			Leases:            leases,
+			Affinity:          affinity,
+			ClusterSessions:   clusterSessions,
+			SLO:               slo,
+			SessionEvents:     sessionEvents,
+			Tracer:            tracer,
+		},
+		localCtxt,
+		wg,
 	)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf("Unable to define HTTP handler")
@@ -119,24 +2559,148 @@ func RunDataplaneServer(
 	router := mux.NewRouter()
 	mainRouter := apis.RegisterPathPrefix(router, params.Endpoints.PathPrefix, nil)
 
-	// Message publish
-	_ = apis.RegisterPathPrefix(
-		mainRouter, "/v1/data/subject/{subjectName}", map[string]http.HandlerFunc{
-			"post": httpHandler.PublishMessageHandler(),
-		},
-	)
+	apiVersions, err := defineAPIVersions(params.Endpoints.V1Deprecated, params.Endpoints.V1Sunset)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define API versions")
+		return err
+	}
+	// The API versions currently share the same handlers
+	apis.RegisterAPIVersions(
+		mainRouter, apiVersions, func(_ apis.APIVersion, versionRouter *mux.Router) {
+			dataAPIRouter := apis.RegisterPathPrefix(versionRouter, "/data", nil)
+			defineAPIAuth(dataAPIRouter, httpHandler.APIRestHandler, params.Listener)
+			// Requests count against the quota of their authenticated principal, so the quota
+			// applies after authentication
+			if requestQuota != nil {
+				dataAPIRouter.Use(httpHandler.EnforceRequestQuota(requestQuota))
+			}
 
-	// Subscription
-	subscribeAPIRouter := apis.RegisterPathPrefix(
-		mainRouter,
-		"/v1/data/stream/{streamName}/consumer/{consumerName}",
-		map[string]http.HandlerFunc{
-			"get": httpHandler.PushSubscribeHandler(),
-		},
-	)
-	_ = apis.RegisterPathPrefix(
-		subscribeAPIRouter, "/ack", map[string]http.HandlerFunc{
-			"post": httpHandler.ReceiveMsgACKHandler(),
+			// Message publish
+			publishAPIRouter := apis.RegisterPathPrefix(
+				dataAPIRouter, "/subject/{subjectName}", map[string]http.HandlerFunc{
+					"post": httpHandler.PublishMessageHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				publishAPIRouter, "/request", map[string]http.HandlerFunc{
+					"post": httpHandler.RequestReplyHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/subjects", map[string]http.HandlerFunc{
+					"post": httpHandler.FanOutPublishMessageHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/transaction", map[string]http.HandlerFunc{
+					"post": httpHandler.TransactionPublishMessagesHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/grant", map[string]http.HandlerFunc{
+					"post": httpHandler.IssuePublishGrantHandler(),
+				},
+			)
+
+			// Signed publishes are authorized by their grant token instead
+			signedAPIRouter := apis.RegisterPathPrefix(versionRouter, "/signed", nil)
+			if requestQuota != nil {
+				signedAPIRouter.Use(httpHandler.EnforceRequestQuota(requestQuota))
+			}
+			_ = apis.RegisterPathPrefix(
+				signedAPIRouter, "/subject/{subjectName}", map[string]http.HandlerFunc{
+					"post": httpHandler.SignedPublishMessageHandler(),
+				},
+			)
+
+			// GraphQL
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/graphql", map[string]http.HandlerFunc{
+					"get": httpHandler.GraphQLSubscribeHandler(),
+				},
+			)
+
+			// Public streams need no credentials
+			publicAPIRouter := apis.RegisterPathPrefix(versionRouter, "/public", nil)
+			if requestQuota != nil {
+				publicAPIRouter.Use(httpHandler.EnforceRequestQuota(requestQuota))
+			}
+			_ = apis.RegisterPathPrefix(
+				publicAPIRouter, "/stream/{streamName}", map[string]http.HandlerFunc{
+					"get": httpHandler.PublicSubscribeHandler(),
+				},
+			)
+
+			// Subscription
+			subscribeAPIRouter := apis.RegisterPathPrefix(
+				dataAPIRouter,
+				"/stream/{streamName}/consumer/{consumerName}",
+				map[string]http.HandlerFunc{
+					"get": httpHandler.PushSubscribeHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				subscribeAPIRouter, "/ack", map[string]http.HandlerFunc{
+					"post": httpHandler.ReceiveMsgACKHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				subscribeAPIRouter, "/fetch", map[string]http.HandlerFunc{
+					"post": httpHandler.FetchBatchHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				subscribeAPIRouter, "/commit", map[string]http.HandlerFunc{
+					"post": httpHandler.CommitBatchHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				subscribeAPIRouter, "/inflight", map[string]http.HandlerFunc{
+					"get": httpHandler.GetInflightMessagesHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/stream/{streamName}/consumer", map[string]http.HandlerFunc{
+					"get": httpHandler.EphemeralPushSubscribeHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/stream/{streamName}/tail", map[string]http.HandlerFunc{
+					"get": httpHandler.TailStreamHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/stream/{streamName}/export", map[string]http.HandlerFunc{
+					"get": httpHandler.ExportStreamHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/import/{importID}", map[string]http.HandlerFunc{
+					"get": httpHandler.GetImportProgressHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/import", map[string]http.HandlerFunc{
+					"post": httpHandler.ImportMessagesHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/subscribe", map[string]http.HandlerFunc{
+					"get": httpHandler.MultiSourcePushSubscribeHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/resume", map[string]http.HandlerFunc{
+					"get": httpHandler.ResumeSubscriptionHandler(),
+				},
+			)
+
+			// Debugging
+			_ = apis.RegisterPathPrefix(
+				dataAPIRouter, "/trace", map[string]http.HandlerFunc{
+					"get": httpHandler.GetMessageTraceHandler(),
+				},
+			)
 		},
 	)
 
@@ -147,35 +2711,70 @@ func RunDataplaneServer(
 	_ = apis.RegisterPathPrefix(mainRouter, "/ready", map[string]http.HandlerFunc{
 		"get": httpHandler.ReadyHandler(),
 	})
+	// The drain, SLO, and failover reports reveal the sessions and traffic of the server, so
+	// they are authenticated like the data API
+	drainRouter := apis.RegisterPathPrefix(mainRouter, "/drain", map[string]http.HandlerFunc{
+		"get": httpHandler.GetDrainStatusHandler(),
+	})
+	defineAPIAuth(drainRouter, httpHandler.APIRestHandler, params.Listener)
 
-	// Add logging
-	router.Use(func(next http.Handler) http.Handler {
-		return handlers.CombinedLoggingHandler(httpHandler, next)
+	// Metrics
+	_ = apis.RegisterPathPrefix(mainRouter, "/metrics", map[string]http.HandlerFunc{
+		"get": promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP,
+	})
+	sloRouter := apis.RegisterPathPrefix(mainRouter, "/slo", map[string]http.HandlerFunc{
+		"get": httpHandler.GetSLOReportHandler(),
 	})
+	defineAPIAuth(sloRouter, httpHandler.APIRestHandler, params.Listener)
+	failoverRouter := apis.RegisterPathPrefix(mainRouter, "/failover", map[string]http.HandlerFunc{
+		"get": httpHandler.GetPublishFailoverStatusHandler(),
+	})
+	defineAPIAuth(failoverRouter, httpHandler.APIRestHandler, params.Listener)
+
+	// Add logging
+	accessLog, err := defineAccessLog(params.AccessLog, httpHandler.APIRestHandler)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define access log")
+		return err
+	}
+	router.Use(accessLog)
+
+	h2Srv := &http2.Server{
+		MaxConcurrentStreams: uint32(params.HTTP2.MaxConcurrentStreams),
+		IdleTimeout:          params.HTTP2.IdleTimeout,
+	}
+	if params.HTTP2.PriorityScheduling {
+		h2Srv.NewWriteScheduler = func() http2.WriteScheduler {
+			return http2.NewPriorityWriteScheduler(nil)
+		}
+	}
 
-	serverListen := fmt.Sprintf(":%d", params.ServerPort)
 	httpSrv := &http.Server{
-		Addr:         serverListen,
 		WriteTimeout: time.Second * 60,
-		Handler:      h2c.NewHandler(router, &http2.Server{}),
 	}
 
 	// Cancel runtime context on shutdown
 	httpSrv.RegisterOnShutdown(lclCancel)
 
 	// Start the server
-	go func() {
-		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.WithError(err).Error("HTTP Server Failure")
-		}
-	}()
-
-	log.WithFields(logTags).Infof("Started HTTP server on http://%s", serverListen)
+	if err := startHTTPServer(
+		httpSrv, router, h2Srv, params.ServerPort, params.Listener, logTags, localCtxt, wg,
+	); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to start HTTP server")
+		return err
+	}
 
 	// ============================================================================
 
 	<-runTimeContext.Done()
 
+	// The sessions are ending; keep serving until they finish draining
+	if params.SessionLimits.ShutdownDrainTimeout > 0 {
+		waitForSessionDrain(
+			httpHandler.DrainMonitor(), drainMetrics, params.SessionLimits.ShutdownDrainTimeout, logTags,
+		)
+	}
+
 	// Stop the HTTP server
 	{
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
@@ -187,3 +2786,85 @@ func RunDataplaneServer(
 
 	return nil
 }
+
+// drainProgressInterval is how often the progress of draining the sessions on shutdown
+// is reported
+const drainProgressInterval = time.Second * 2
+
+// waitForSessionDrain helper function to wait for the sessions to end on shutdown, up to
+// timeout, reporting the progress along the way
+func waitForSessionDrain(
+	monitor dataplane.DrainMonitor,
+	drainMetrics metrics.DrainMetrics,
+	timeout time.Duration,
+	logTags log.Fields,
+) {
+	ctxt, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := monitor.Start(timeout, ctxt); err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to start tracking session drain")
+		return
+	}
+	ticker := time.NewTicker(drainProgressInterval)
+	defer ticker.Stop()
+	for {
+		status, err := monitor.Status(ctxt)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Error("Unable to query session drain progress")
+		} else {
+			remaining := time.Until(*status.EstimatedCompletion)
+			drainMetrics.ObserveDrain(status.Sessions, status.InflightMessages, remaining)
+			if status.Done() {
+				log.WithFields(logTags).Info("All sessions drained")
+				return
+			}
+			log.WithFields(logTags).Infof(
+				"Draining %d sessions with %d messages awaiting ACK, estimated done in %s",
+				status.Sessions,
+				status.InflightMessages,
+				remaining.Round(time.Second),
+			)
+		}
+		select {
+		case <-ctxt.Done():
+			log.WithFields(logTags).Warn("Session drain timed out, closing remaining connections")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// defineTenantClients helper function to define the pool of NATS clients connected with the
+// credentials of each tenant
+func defineTenantClients(
+	params DataplaneTenantCredentials,
+	listener ServerListenerArgs,
+	natsParam core.NATSConnectParams,
+	ctxt context.Context,
+	wg *sync.WaitGroup,
+) (core.NatsClientPool, error) {
+	// Tenants are identified by their client certificates
+	if listener.ClientCAFile == "" {
+		return nil, fmt.Errorf("per-tenant credentials need client certificates")
+	}
+	var provider core.CredentialProvider
+	var err error
+	switch params.Provider {
+	case "file":
+		provider, err = core.GetFileCredentialProvider(params.Dir)
+	case "vault":
+		provider, err = core.GetVaultCredentialProvider(
+			params.VaultAddress, params.VaultToken, params.VaultPath, params.Timeout,
+		)
+	case "http":
+		provider, err = core.GetHTTPCredentialProvider(
+			params.ServiceURL, params.ServiceToken, params.Timeout,
+		)
+	default:
+		err = fmt.Errorf("unknown credential provider '%s'", params.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return core.GetNatsClientPool(natsParam, provider, params.IdleTimeout, ctxt, wg)
+}
@@ -0,0 +1,123 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/urfave/cli/v2"
+)
+
+// DecryptLogCLIArgs arguments
+type DecryptLogCLIArgs struct {
+	// KeyDir is the directory of the tenants' access log keys
+	KeyDir string `validate:"required"`
+	// Tenant is the tenant owning the logs. Empty to take it from the name of each log file.
+	Tenant string
+}
+
+// GetDecryptLogCLIFlags retreive the set of CMD flags for the decrypt-log subcommand
+func GetDecryptLogCLIFlags(args *DecryptLogCLIArgs) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "decrypt-log-key-dir",
+			Usage:       "Directory of the hex encoded access log key of each tenant, in the file <tenant>.key",
+			Aliases:     []string{"dlkd"},
+			EnvVars:     []string{"DECRYPT_LOG_KEY_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.KeyDir,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "decrypt-log-tenant",
+			Usage:       "Tenant owning the log files (default: taken from each log file name)",
+			Aliases:     []string{"dlt"},
+			EnvVars:     []string{"DECRYPT_LOG_TENANT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Tenant,
+			Required:    false,
+		},
+	}
+}
+
+// RunDecryptLog decrypt the encrypted log files of tenants, writing the lines to out
+func RunDecryptLog(
+	params DecryptLogCLIArgs, files []string, out io.Writer, ctxt context.Context,
+) error {
+	logTags := log.Fields{"module": "cmd", "component": "decrypt-log"}
+
+	validate := validator.New()
+	if err := validate.Struct(&params); err != nil {
+		log.WithError(err).WithFields(logTags).Error("Invalid CMD args")
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no log files to decrypt")
+	}
+
+	keys, err := common.GetFileKeyProvider(params.KeyDir)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to read key directory")
+		return err
+	}
+
+	for _, file := range files {
+		tenant := params.Tenant
+		if tenant == "" {
+			name := filepath.Base(file)
+			if !strings.HasSuffix(name, common.EncryptedLogSuffix) {
+				return fmt.Errorf(
+					"tenant of %s unknown: name does not end with %s", file, common.EncryptedLogSuffix,
+				)
+			}
+			if tenant, err = url.PathUnescape(
+				strings.TrimSuffix(name, common.EncryptedLogSuffix),
+			); err != nil {
+				return fmt.Errorf("tenant of %s unknown: %w", file, err)
+			}
+		}
+		key, err := keys.Key(tenant, ctxt)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("No key to decrypt %s", file)
+			return err
+		}
+		if err := decryptLogFile(file, key, tenant, out); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to decrypt %s", file)
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptLogFile helper function to decrypt one log file
+func decryptLogFile(file string, key []byte, tenant string, out io.Writer) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return common.DecryptLog(key, tenant, in, out)
+}
@@ -16,31 +16,150 @@ package cmd
 
 import (
 	"context"
-	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/alwitt/httpmq/alerts"
 	"github.com/alwitt/httpmq/apis"
+	"github.com/alwitt/httpmq/archive"
 	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/alwitt/httpmq/filters"
 	"github.com/alwitt/httpmq/management"
+	"github.com/alwitt/httpmq/metrics"
+	"github.com/alwitt/httpmq/operator"
+	"github.com/alwitt/httpmq/storage"
+	"github.com/alwitt/httpmq/ui"
 	"github.com/apex/log"
 	"github.com/go-playground/validator/v10"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/h2c"
 )
 
 // ManagementRestEndpoints end-point path configs for management control API
 type ManagementRestEndpoints struct {
 	PathPrefix string
+	// V1Deprecated is when the v1 APIs were deprecated in favor of v2, in RFC 3339
+	V1Deprecated string `validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	// V1Sunset is when the v1 APIs stop being served, in RFC 3339
+	V1Sunset string `validate:"excluded_without=V1Deprecated,omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	// DataplaneURL is the URL of the dataplane server, which hypermedia responses link to
+	DataplaneURL string `validate:"omitempty,url"`
+}
+
+// AlertSinkArgs settings for where alerts are delivered
+type AlertSinkArgs struct {
+	WebhookURL     string `validate:"omitempty,url"`
+	WebhookTimeout time.Duration
+	NATSSubject    string
+}
+
+// ConsumerMonitorArgs settings for consumer activity monitoring
+type ConsumerMonitorArgs struct {
+	Interval      time.Duration `validate:"gt=0"`
+	MaxLag        uint64
+	MaxAckSilence time.Duration `validate:"gte=0"`
+}
+
+// StreamMonitorArgs settings for stream storage utilization monitoring
+type StreamMonitorArgs struct {
+	Interval  time.Duration `validate:"gt=0"`
+	WarnRatio float64       `validate:"gte=0,lte=1"`
+}
+
+// RetentionGuardrailArgs settings for the upper bounds on stream data retention limits
+type RetentionGuardrailArgs struct {
+	MaxMsgs  int64         `validate:"gte=0"`
+	MaxBytes int64         `validate:"gte=0"`
+	MaxAge   time.Duration `validate:"gte=0"`
+}
+
+// ConsumerDefaultArgs settings for the defaults of consumers created through the APIs
+type ConsumerDefaultArgs struct {
+	MaxInflight  int           `validate:"gte=0"`
+	MaxRetry     int           `validate:"gte=-1"`
+	AckWait      time.Duration `validate:"gte=0"`
+	ReplayPolicy string        `validate:"omitempty,oneof=instant original"`
+	Mode         string        `validate:"omitempty,oneof=push pull"`
+}
+
+// ArchiveArgs settings for archiving streams to S3-compatible object storage
+type ArchiveArgs struct {
+	// Bucket is the JetStream KV bucket storing the archive definitions. Empty disables
+	// stream archival.
+	Bucket      string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Timeout   time.Duration `validate:"gt=0"`
+}
+
+// ConsumerLatencyArgs settings for gathering the consumer latency reports of the dataplane
+type ConsumerLatencyArgs struct {
+	ReportSubject string
+	ReportExpiry  time.Duration `validate:"gt=0"`
+}
+
+// SessionGossipArgs settings for following the sessions of the dataplane replicas
+type SessionGossipArgs struct {
+	Subject string
+	// Interval is the session gossip interval of the dataplane replicas
+	Interval time.Duration `validate:"gt=0"`
+}
+
+// ConsumerRecoveryArgs settings for recovering the consumers left without a session
+type ConsumerRecoveryArgs struct {
+	Enabled bool
+	// Grace is how long an ephemeral consumer stays unbound before it is deleted, and the
+	// interval between reconciles
+	Grace time.Duration `validate:"gt=0"`
+}
+
+// AdminUIArgs settings for the embedded admin UI
+type AdminUIArgs struct {
+	Enabled  bool
+	SpecFile string
+}
+
+// TopologyOperatorArgs settings for reconciling Kubernetes custom resources
+type TopologyOperatorArgs struct {
+	Enabled   bool
+	Namespace string
+	Resync    time.Duration `validate:"gte=1s"`
 }
 
 // ManagementCLIArgs arguments
 type ManagementCLIArgs struct {
-	ServerPort int `validate:"required,gt=0,lt=65536"`
-	Endpoints  ManagementRestEndpoints
+	ServerPort       int `validate:"required,gt=0,lt=65536"`
+	Listener         ServerListenerArgs
+	Endpoints        ManagementRestEndpoints
+	Alerts           AlertSinkArgs
+	ConsumerMonitor  ConsumerMonitorArgs
+	StreamMonitor    StreamMonitorArgs
+	Retention        RetentionGuardrailArgs
+	ConsumerDefault  ConsumerDefaultArgs
+	Subjects         SubjectRuleArgs
+	FilterBucket     string
+	LeaseBucket      string
+	Archive          ArchiveArgs
+	Latency          ConsumerLatencyArgs
+	EventRetain      int `validate:"gte=0"`
+	AdvisoryMonitor  bool
+	ConsumerRecovery ConsumerRecoveryArgs
+	SessionGossip    SessionGossipArgs
+	UI               AdminUIArgs
+	Operator         TopologyOperatorArgs
+	Preflight        PreflightArgs
+	AccessLog        AccessLogArgs
 }
 
 // GetManagementCLIFlags retreive the set of CMD flags for management server
@@ -56,6 +175,126 @@ func GetManagementCLIFlags(args *ManagementCLIArgs) []cli.Flag {
 			Destination: &args.ServerPort,
 			Required:    false,
 		},
+		&cli.StringFlag{
+			Name:        "management-server-listen-address",
+			Usage:       "Management server bind address (default: all interfaces)",
+			Aliases:     []string{"msla"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_LISTEN_ADDRESS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.Address,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-tls-cert",
+			Usage:       "Management server TLS certificate PEM file (enables TLS)",
+			Aliases:     []string{"mstc"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_TLS_CERT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.TLSCertFile,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-tls-key",
+			Usage:       "Management server TLS private key PEM file",
+			Aliases:     []string{"mstk"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_TLS_KEY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.TLSKeyFile,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-server-tls-reload-interval",
+			Usage:       "Interval between checks of the TLS certificate files for changes",
+			Aliases:     []string{"mstri"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_TLS_RELOAD_INTERVAL"},
+			Value:       time.Minute,
+			DefaultText: "1m",
+			Destination: &args.Listener.TLSReloadInterval,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-acme-domains",
+			Usage:       "Comma separated domains to obtain TLS certificates for with ACME (enables TLS)",
+			Aliases:     []string{"msad"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_ACME_DOMAINS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ACMEDomains,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-acme-cache-dir",
+			Usage:       "Directory for caching ACME certificates",
+			Aliases:     []string{"msacd"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_ACME_CACHE_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ACMECacheDir,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-acme-email",
+			Usage:       "Contact email for the ACME account",
+			Aliases:     []string{"msae"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_ACME_EMAIL"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ACMEEmail,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-tls-client-ca",
+			Usage:       "CA PEM file for verifying client certificates (requires client certificates)",
+			Aliases:     []string{"mstca"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_TLS_CLIENT_CA"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.ClientCAFile,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-allowed-clients",
+			Usage:       "Comma separated client certificate CN / SANs permitted to call the APIs (default: any)",
+			Aliases:     []string{"msac"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_ALLOWED_CLIENTS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.AllowedClients,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-auth-token",
+			Usage:       "If set, management API requests must carry this bearer token",
+			Aliases:     []string{"msat"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_AUTH_TOKEN"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.AuthToken,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "management-server-proxy-protocol",
+			Usage:       "Require a PROXY protocol (v1 or v2) header on connections from trusted proxies",
+			Aliases:     []string{"mspp"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_PROXY_PROTOCOL"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Listener.ProxyProtocol,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-trusted-proxies",
+			Usage:       "Comma separated CIDRs / IPs of proxies trusted to report the client address",
+			Aliases:     []string{"mstp"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_TRUSTED_PROXIES"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Listener.TrustedProxies,
+			Required:    false,
+		},
 		// End-point related
 		&cli.StringFlag{
 			Name:        "management-server-endpoint-prefix",
@@ -67,9 +306,540 @@ func GetManagementCLIFlags(args *ManagementCLIArgs) []cli.Flag {
 			Destination: &args.Endpoints.PathPrefix,
 			Required:    false,
 		},
+		&cli.StringFlag{
+			Name:        "management-server-v1-deprecated",
+			Usage:       "When the v1 management APIs were deprecated, in RFC 3339. v1 responses then carry deprecation headers.",
+			Aliases:     []string{"msvd"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_V1_DEPRECATED"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Endpoints.V1Deprecated,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-v1-sunset",
+			Usage:       "When the deprecated v1 management APIs stop being served, in RFC 3339",
+			Aliases:     []string{"msvs"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_V1_SUNSET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Endpoints.V1Sunset,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-server-dataplane-url",
+			Usage:       "URL of the dataplane server, which hypermedia (HAL) responses link to for the messages of streams and consumers (empty: no such links)",
+			Aliases:     []string{"msdu"},
+			EnvVars:     []string{"MANAGEMENT_SERVER_DATAPLANE_URL"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Endpoints.DataplaneURL,
+			Required:    false,
+		},
+		// Alert related
+		&cli.StringFlag{
+			Name:        "management-alert-webhook-url",
+			Usage:       "Webhook URL to POST alerts to",
+			Aliases:     []string{"maww"},
+			EnvVars:     []string{"MANAGEMENT_ALERT_WEBHOOK_URL"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Alerts.WebhookURL,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-alert-webhook-timeout",
+			Usage:       "Timeout when POSTing alerts to the webhook",
+			Aliases:     []string{"mawt"},
+			EnvVars:     []string{"MANAGEMENT_ALERT_WEBHOOK_TIMEOUT"},
+			Value:       time.Second * 5,
+			DefaultText: "5s",
+			Destination: &args.Alerts.WebhookTimeout,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-alert-nats-subject",
+			Usage:       "NATS subject to publish alerts on",
+			Aliases:     []string{"mans"},
+			EnvVars:     []string{"MANAGEMENT_ALERT_NATS_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Alerts.NATSSubject,
+			Required:    false,
+		},
+		// Consumer monitoring related
+		&cli.DurationFlag{
+			Name:        "management-consumer-monitor-interval",
+			Usage:       "Interval between consumer activity checks",
+			Aliases:     []string{"mcmi"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_MONITOR_INTERVAL"},
+			Value:       time.Second * 30,
+			DefaultText: "30s",
+			Destination: &args.ConsumerMonitor.Interval,
+			Required:    false,
+		},
+		&cli.Uint64Flag{
+			Name:        "management-consumer-max-lag",
+			Usage:       "Alert when a consumer has more undelivered messages than this (0: disabled)",
+			Aliases:     []string{"mcml"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_MAX_LAG"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.ConsumerMonitor.MaxLag,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-consumer-max-ack-silence",
+			Usage:       "Alert when a consumer with pending ACKs has not ACKed for this long (0: disabled)",
+			Aliases:     []string{"mcmas"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_MAX_ACK_SILENCE"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.ConsumerMonitor.MaxAckSilence,
+			Required:    false,
+		},
+		// Stream monitoring related
+		&cli.DurationFlag{
+			Name:        "management-stream-monitor-interval",
+			Usage:       "Interval between stream storage utilization checks",
+			Aliases:     []string{"msmi"},
+			EnvVars:     []string{"MANAGEMENT_STREAM_MONITOR_INTERVAL"},
+			Value:       time.Minute,
+			DefaultText: "1m",
+			Destination: &args.StreamMonitor.Interval,
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "management-stream-usage-warn-ratio",
+			Usage:       "Warn when a stream's messages or bytes exceed this ratio of its limit (0: disabled)",
+			Aliases:     []string{"msuwr"},
+			EnvVars:     []string{"MANAGEMENT_STREAM_USAGE_WARN_RATIO"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.StreamMonitor.WarnRatio,
+			Required:    false,
+		},
+		// Stream retention guardrails
+		&cli.Int64Flag{
+			Name:        "management-retention-max-msgs",
+			Usage:       "Highest max_msgs permitted for a stream (0: no bound)",
+			Aliases:     []string{"mrmm"},
+			EnvVars:     []string{"MANAGEMENT_RETENTION_MAX_MSGS"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.Retention.MaxMsgs,
+			Required:    false,
+		},
+		&cli.Int64Flag{
+			Name:        "management-retention-max-bytes",
+			Usage:       "Highest max_bytes permitted for a stream (0: no bound)",
+			Aliases:     []string{"mrmb"},
+			EnvVars:     []string{"MANAGEMENT_RETENTION_MAX_BYTES"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.Retention.MaxBytes,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-retention-max-age",
+			Usage:       "Highest max_age permitted for a stream (0: no bound)",
+			Aliases:     []string{"mrma"},
+			EnvVars:     []string{"MANAGEMENT_RETENTION_MAX_AGE"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.Retention.MaxAge,
+			Required:    false,
+		},
+		// Consumer defaults
+		&cli.IntFlag{
+			Name:        "management-consumer-default-max-inflight",
+			Usage:       "max_inflight of a new consumer which does not specify it (0: no default)",
+			Aliases:     []string{"mcdi"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_DEFAULT_MAX_INFLIGHT"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.ConsumerDefault.MaxInflight,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "management-consumer-default-max-retry",
+			Usage:       "max_retry of a new consumer which does not specify it (-1: infinite, 0: no default)",
+			Aliases:     []string{"mcdr"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_DEFAULT_MAX_RETRY"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.ConsumerDefault.MaxRetry,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-consumer-default-ack-wait",
+			Usage:       "ack_wait of a new consumer which does not specify it (0: no default)",
+			Aliases:     []string{"mcda"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_DEFAULT_ACK_WAIT"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.ConsumerDefault.AckWait,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-consumer-default-replay-policy",
+			Usage:       "replay_policy of a new consumer which does not specify it [instant, original] (empty: no default)",
+			Aliases:     []string{"mcdp"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_DEFAULT_REPLAY_POLICY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.ConsumerDefault.ReplayPolicy,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-consumer-default-mode",
+			Usage:       "mode of a new consumer which does not specify it [push, pull] (empty: no default)",
+			Aliases:     []string{"mcdm"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_DEFAULT_MODE"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.ConsumerDefault.Mode,
+			Required:    false,
+		},
+		// Subject validation related
+		&cli.IntFlag{
+			Name:        "management-subject-max-depth",
+			Usage:       "Max number of tokens in a stream or consumer subject (0: no limit)",
+			Aliases:     []string{"msmx"},
+			EnvVars:     []string{"MANAGEMENT_SUBJECT_MAX_DEPTH"},
+			Value:       16,
+			DefaultText: "16",
+			Destination: &args.Subjects.MaxDepth,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-subject-reserved-prefixes",
+			Usage:       "Comma separated subject prefixes streams and consumers may not use",
+			Aliases:     []string{"msrv"},
+			EnvVars:     []string{"MANAGEMENT_SUBJECT_RESERVED_PREFIXES"},
+			Value:       "$JS,$KV,$O,$SYS",
+			DefaultText: "$JS,$KV,$O,$SYS",
+			Destination: &args.Subjects.ReservedPrefixes,
+			Required:    false,
+		},
+		// Consumer filter related
+		&cli.StringFlag{
+			Name:        "management-filter-bucket",
+			Usage:       "JetStream KV bucket storing consumer WASM filter modules (empty: disabled)",
+			Aliases:     []string{"mfb"},
+			EnvVars:     []string{"MANAGEMENT_FILTER_BUCKET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.FilterBucket,
+			Required:    false,
+		},
+		// Consumer lease related
+		&cli.StringFlag{
+			Name:        "management-consumer-lease-bucket",
+			Usage:       "JetStream KV bucket holding the leases of consumers pinned by the dataplane (empty: disabled)",
+			Aliases:     []string{"mclb"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_LEASE_BUCKET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.LeaseBucket,
+			Required:    false,
+		},
+		// Stream archival related
+		&cli.StringFlag{
+			Name:        "management-archive-bucket",
+			Usage:       "JetStream KV bucket storing stream archive definitions (empty: disabled)",
+			Aliases:     []string{"marb"},
+			EnvVars:     []string{"MANAGEMENT_ARCHIVE_BUCKET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Archive.Bucket,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-archive-s3-endpoint",
+			Usage:       "Base URL of the S3-compatible API archives are written to",
+			Aliases:     []string{"mase"},
+			EnvVars:     []string{"MANAGEMENT_ARCHIVE_S3_ENDPOINT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Archive.S3Endpoint,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-archive-s3-region",
+			Usage:       "Region S3 requests are signed for",
+			Aliases:     []string{"masr"},
+			EnvVars:     []string{"MANAGEMENT_ARCHIVE_S3_REGION"},
+			Value:       "us-east-1",
+			DefaultText: "us-east-1",
+			Destination: &args.Archive.S3Region,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-archive-s3-bucket",
+			Usage:       "S3 bucket archives are written to",
+			Aliases:     []string{"masb"},
+			EnvVars:     []string{"MANAGEMENT_ARCHIVE_S3_BUCKET"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Archive.S3Bucket,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-archive-s3-access-key",
+			Usage:       "Access key ID of the S3 requests",
+			Aliases:     []string{"masa"},
+			EnvVars:     []string{"MANAGEMENT_ARCHIVE_S3_ACCESS_KEY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Archive.S3AccessKey,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-archive-s3-secret-key",
+			Usage:       "Secret access key of the S3 requests",
+			Aliases:     []string{"mask"},
+			EnvVars:     []string{"MANAGEMENT_ARCHIVE_S3_SECRET_KEY"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Archive.S3SecretKey,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-archive-s3-timeout",
+			Usage:       "Timeout of one S3 request",
+			Aliases:     []string{"mast"},
+			EnvVars:     []string{"MANAGEMENT_ARCHIVE_S3_TIMEOUT"},
+			Value:       time.Minute,
+			DefaultText: "1m",
+			Destination: &args.Archive.S3Timeout,
+			Required:    false,
+		},
+		// Consumer latency related
+		&cli.StringFlag{
+			Name:        "management-latency-report-subject",
+			Usage:       "NATS subject the dataplane publishes consumer latency reports under (empty: disabled)",
+			Aliases:     []string{"mlrs"},
+			EnvVars:     []string{"MANAGEMENT_LATENCY_REPORT_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Latency.ReportSubject,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-latency-report-expiry",
+			Usage:       "Duration after which a consumer latency report not refreshed is dropped",
+			Aliases:     []string{"mlre"},
+			EnvVars:     []string{"MANAGEMENT_LATENCY_REPORT_EXPIRY"},
+			Value:       time.Minute * 2,
+			DefaultText: "2m",
+			Destination: &args.Latency.ReportExpiry,
+			Required:    false,
+		},
+		// Topology event feed related
+		&cli.IntFlag{
+			Name:        "management-event-feed-retain",
+			Usage:       "Number of stream and consumer events retained for the event feed (0: disabled)",
+			Aliases:     []string{"mefr"},
+			EnvVars:     []string{"MANAGEMENT_EVENT_FEED_RETAIN"},
+			Value:       0,
+			DefaultText: "0",
+			Destination: &args.EventRetain,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "management-advisory-monitor",
+			Usage:       "Count the JetStream advisories at /metrics, and raise alerts for deletions, lost quorums, and failed API calls",
+			Aliases:     []string{"mam"},
+			EnvVars:     []string{"MANAGEMENT_ADVISORY_MONITOR"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.AdvisoryMonitor,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "management-consumer-recovery",
+			Usage:       "Periodically delete the ephemeral consumers created through httpmq which stayed without a session bound for the grace period, and report them and the unbound durable ones at /v1/admin/orphans",
+			Aliases:     []string{"mcr"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_RECOVERY"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.ConsumerRecovery.Enabled,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-consumer-recovery-grace",
+			Usage:       "How long an ephemeral consumer stays without a session bound before it is deleted, and the interval between consumer recoveries",
+			Aliases:     []string{"mcrg"},
+			EnvVars:     []string{"MANAGEMENT_CONSUMER_RECOVERY_GRACE"},
+			Value:       time.Minute * 2,
+			DefaultText: "2m",
+			Destination: &args.ConsumerRecovery.Grace,
+			Required:    false,
+		},
+		// Session gossip related
+		&cli.StringFlag{
+			Name:        "management-session-gossip-subject",
+			Usage:       "NATS subject the dataplane replicas share their push subscribe sessions on (empty: disabled)",
+			Aliases:     []string{"msgs"},
+			EnvVars:     []string{"MANAGEMENT_SESSION_GOSSIP_SUBJECT"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.SessionGossip.Subject,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-session-gossip-interval",
+			Usage:       "Interval between shares of the push subscribe sessions of each dataplane replica",
+			Aliases:     []string{"msgi"},
+			EnvVars:     []string{"MANAGEMENT_SESSION_GOSSIP_INTERVAL"},
+			Value:       time.Second * 10,
+			DefaultText: "10s",
+			Destination: &args.SessionGossip.Interval,
+			Required:    false,
+		},
+		// Admin UI related
+		&cli.BoolFlag{
+			Name:        "management-ui",
+			Usage:       "Serve the admin UI under /ui/",
+			Aliases:     []string{"mui"},
+			EnvVars:     []string{"MANAGEMENT_UI"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.UI.Enabled,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-ui-openapi-spec",
+			Usage:       "OpenAPI spec JSON of the management API, which the admin UI builds its forms from",
+			Aliases:     []string{"muos"},
+			EnvVars:     []string{"MANAGEMENT_UI_OPENAPI_SPEC"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.UI.SpecFile,
+			Required:    false,
+		},
+		// Kubernetes operator related
+		&cli.BoolFlag{
+			Name:        "management-operator",
+			Usage:       "Reconcile the Stream and Consumer custom resources of the Kubernetes cluster",
+			Aliases:     []string{"mop"},
+			EnvVars:     []string{"MANAGEMENT_OPERATOR"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Operator.Enabled,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-operator-namespace",
+			Usage:       "Namespace of the custom resources to reconcile (empty: all namespaces)",
+			Aliases:     []string{"mopn"},
+			EnvVars:     []string{"MANAGEMENT_OPERATOR_NAMESPACE"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Operator.Namespace,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-operator-resync",
+			Usage:       "Interval at which every custom resource is reconciled again",
+			Aliases:     []string{"mopr"},
+			EnvVars:     []string{"MANAGEMENT_OPERATOR_RESYNC"},
+			Value:       time.Minute * 5,
+			DefaultText: "5m",
+			Destination: &args.Operator.Resync,
+			Required:    false,
+		},
+		// Preflight related
+		&cli.BoolFlag{
+			Name:        "check",
+			Usage:       "Run only the preflight checks of the management server, and exit",
+			EnvVars:     []string{"MANAGEMENT_CHECK"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Preflight.CheckOnly,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-preflight-requirements",
+			Usage:       "JSON file of the streams and consumers which must exist before starting",
+			Aliases:     []string{"mpr"},
+			EnvVars:     []string{"MANAGEMENT_PREFLIGHT_REQUIREMENTS"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.Preflight.RequirementsFile,
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "management-preflight-create-missing",
+			Usage:       "Create the required streams and consumers which do not exist",
+			Aliases:     []string{"mpcm"},
+			EnvVars:     []string{"MANAGEMENT_PREFLIGHT_CREATE_MISSING"},
+			Value:       false,
+			DefaultText: "false",
+			Destination: &args.Preflight.CreateMissing,
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "management-preflight-timeout",
+			Usage:       "Timeout of each preflight check against JetStream",
+			Aliases:     []string{"mpt"},
+			EnvVars:     []string{"MANAGEMENT_PREFLIGHT_TIMEOUT"},
+			Value:       time.Second * 10,
+			DefaultText: "10s",
+			Destination: &args.Preflight.Timeout,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-access-log-encrypt-dir",
+			Usage:       "Directory to write the access log of each tenant to, encrypted with the tenant's key, instead of the server log",
+			Aliases:     []string{"maled"},
+			EnvVars:     []string{"MANAGEMENT_ACCESS_LOG_ENCRYPT_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.AccessLog.EncryptDir,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "management-access-log-key-dir",
+			Usage:       "Directory of the hex encoded access log key of each tenant, in the file <tenant>.key",
+			Aliases:     []string{"malkd"},
+			EnvVars:     []string{"MANAGEMENT_ACCESS_LOG_KEY_DIR"},
+			Value:       "",
+			DefaultText: "",
+			Destination: &args.AccessLog.KeyDir,
+			Required:    false,
+		},
 	}
 }
 
+// defineAlertSink helper function to define the alert sink based on the CMD args
+//
+// Returns nil if no alert destination is configured.
+func defineAlertSink(
+	params AlertSinkArgs, instance string, natsClient *core.NatsClient,
+) (alerts.AlertSink, error) {
+	sinks := []alerts.AlertSink{}
+	if params.WebhookURL != "" {
+		sink, err := alerts.GetWebhookAlertSink(params.WebhookURL, params.WebhookTimeout, instance)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if params.NATSSubject != "" {
+		sink, err := alerts.GetNATSAlertSink(natsClient, params.NATSSubject, instance)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return alerts.GetMultiAlertSink(sinks...), nil
+}
+
 // RunManagementServer run the management server
 func RunManagementServer(
 	params ManagementCLIArgs,
@@ -89,59 +859,571 @@ func RunManagementServer(
 		return err
 	}
 
+	if err := runPreflight(
+		params.Preflight, params.Listener, natsClient, instance, logTags, runtimeContext,
+	); err != nil {
+		return err
+	}
+	if params.Preflight.CheckOnly {
+		log.WithFields(logTags).Info("Preflight checks passed")
+		return nil
+	}
+
 	controller, err := management.GetJetStreamController(natsClient, instance)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf("Unable to define JetStream controller")
 		return err
 	}
 
-	httpHandler, err := apis.GetAPIRestJetStreamManagementHandler(controller)
+	// Consumer filters are opt-in
+	var filterRegistry filters.Registry
+	if params.FilterBucket != "" {
+		store, err := storage.GetKeyValueStore(storage.KeyValueStoreParam{
+			Backend: storage.BackendJetStream, Bucket: params.FilterBucket,
+		}, natsClient)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define filter module store")
+			return err
+		}
+		defer func() {
+			if err := store.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close filter module store")
+			}
+		}()
+		// Uploaded modules are only verified here, so the execution limits do not apply
+		filterRegistry, err = filters.GetRegistry(store, filters.Limits{}, instance, runtimeContext)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define filter registry")
+			return err
+		}
+		defer func() {
+			if err := filterRegistry.Close(context.Background()); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close filter registry")
+			}
+		}()
+	}
+
+	// Stream archival is opt-in
+	var archives archive.Archiver
+	var archiveObjects archive.ObjectStore
+	if params.Archive.Bucket != "" {
+		objects, err := archive.GetS3ObjectStore(archive.S3Param{
+			Endpoint:  params.Archive.S3Endpoint,
+			Region:    params.Archive.S3Region,
+			Bucket:    params.Archive.S3Bucket,
+			AccessKey: params.Archive.S3AccessKey,
+			SecretKey: params.Archive.S3SecretKey,
+			Timeout:   params.Archive.S3Timeout,
+		}, instance)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define archive object store")
+			return err
+		}
+		archiveObjects = objects
+		store, err := storage.GetKeyValueStore(storage.KeyValueStoreParam{
+			Backend: storage.BackendJetStream, Bucket: params.Archive.Bucket,
+		}, natsClient)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define archive definition store")
+			return err
+		}
+		defer func() {
+			if err := store.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close archive definition store")
+			}
+		}()
+		archives, err = archive.GetArchiver(natsClient, store, objects, instance, runtimeContext)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define archiver")
+			return err
+		}
+		defer func() {
+			if err := archives.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to stop archiver")
+			}
+		}()
+	}
+
+	// Consumer latency reports are opt-in
+	var latency metrics.ConsumerLatencyCollector
+	if params.Latency.ReportSubject != "" {
+		latency, err = metrics.GetConsumerLatencyCollector(
+			natsClient, params.Latency.ReportSubject, params.Latency.ReportExpiry, instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define latency collector")
+			return err
+		}
+		defer func() {
+			if err := latency.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close latency collector")
+			}
+		}()
+	}
+
+	// The topology event feed is opt-in
+	var events management.TopologyEventFeed
+	if params.EventRetain > 0 {
+		events, err = management.GetTopologyEventFeed(natsClient, params.EventRetain, instance)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define topology event feed")
+			return err
+		}
+		defer func() {
+			if err := events.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close topology event feed")
+			}
+		}()
+	}
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	// Following the sessions of the dataplane replicas is opt-in
+	var sessions dataplane.ClusterSessionRegistry
+	if params.SessionGossip.Subject != "" {
+		// The management server only sends gossip to share the consumers it found without a
+		// session
+		replica := ""
+		if params.ConsumerRecovery.Enabled {
+			replica = "management/" + instance
+		}
+		sessions, err = dataplane.GetClusterSessionRegistry(
+			natsClient,
+			params.SessionGossip.Subject,
+			replica,
+			params.SessionGossip.Interval,
+			instance,
+			runtimeContext,
+			&wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define cluster session registry")
+			return err
+		}
+	}
+
+	// Archives can be replayed wherever archival is enabled
+	var replays archive.Replayer
+	if archiveObjects != nil {
+		publisher, err := dataplane.GetJetStreamPublisher(natsClient, instance)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define replay publisher")
+			return err
+		}
+		replays, err = archive.GetReplayer(archiveObjects, publisher, instance, runtimeContext, &wg)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define archive replayer")
+			return err
+		}
+	}
+
+	// The management server only reads and breaks leases, so their TTL is not used
+	var leases dataplane.ConsumerLeaseManager
+	if params.LeaseBucket != "" {
+		leases, err = dataplane.GetConsumerLeaseManager(
+			natsClient, params.LeaseBucket, time.Minute, instance,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define consumer lease manager")
+			return err
+		}
+	}
+
+	deliveries, err := management.GetConsumerDeliveryMonitor(natsClient, instance)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define consumer delivery monitor")
+		return err
+	}
+
+	// Recovering the consumers left without a session is opt-in
+	var recovery management.ConsumerRecovery
+	if params.ConsumerRecovery.Enabled {
+		recovery, err = management.GetConsumerRecovery(
+			controller, sessions, params.ConsumerRecovery.Grace, instance, runtimeContext, &wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define consumer recovery")
+			return err
+		}
+		ctxt, cancel := context.WithTimeout(runtimeContext, time.Second*30)
+		orphans, err := recovery.Reconcile(ctxt)
+		cancel()
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to recover orphaned consumers")
+			return err
+		}
+		log.WithFields(logTags).Infof("Found %d orphaned consumers", len(orphans))
+		if err := recovery.Start(params.ConsumerRecovery.Grace); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to start consumer recovery")
+			return err
+		}
+	}
+
+	httpHandler, err := apis.GetAPIRestJetStreamManagementHandler(
+		controller,
+		management.StreamRetentionGuardrails{
+			MaxMsgs:  params.Retention.MaxMsgs,
+			MaxBytes: params.Retention.MaxBytes,
+			MaxAge:   params.Retention.MaxAge,
+		},
+		management.ConsumerDefaults{
+			MaxInflight:  params.ConsumerDefault.MaxInflight,
+			MaxRetry:     params.ConsumerDefault.MaxRetry,
+			AckWait:      params.ConsumerDefault.AckWait,
+			ReplayPolicy: params.ConsumerDefault.ReplayPolicy,
+			Mode:         params.ConsumerDefault.Mode,
+		},
+		defineSubjectRules(params.Subjects),
+		filterRegistry,
+		latency,
+		events,
+		sessions,
+		archives,
+		replays,
+		leases,
+		deliveries,
+		recovery,
+		params.Endpoints.DataplaneURL,
+	)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf("Unable to define HTTP handler")
 		return err
 	}
 
+	alertSink, err := defineAlertSink(params.Alerts, instance, natsClient)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define alert sink")
+		return err
+	}
+	// Metrics are served once a monitor reporting them is enabled
+	var metricsRegistry *prometheus.Registry
+	if params.AdvisoryMonitor || params.StreamMonitor.WarnRatio > 0 {
+		metricsRegistry = prometheus.NewRegistry()
+		metricsRegistry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+	// The advisory monitor is opt-in. Its alerts only go to the alert sink, as the event feed
+	// already carries the advisories.
+	if params.AdvisoryMonitor {
+		advisories, err := management.GetJetStreamAdvisoryMonitor(
+			natsClient, alertSink, metricsRegistry, instance, runtimeContext,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define advisory monitor")
+			return err
+		}
+		defer func() {
+			if err := advisories.Close(); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Failed to close advisory monitor")
+			}
+		}()
+	}
+
+	// Consumer errors detected by the monitors are also reported on the event feed
+	if events != nil {
+		if alertSink == nil {
+			alertSink = events
+		} else {
+			alertSink = alerts.GetMultiAlertSink(alertSink, events)
+		}
+	}
+
+	// -------------------------------------------------------------------
+	// Start consumer activity monitoring
+
+	if params.ConsumerMonitor.MaxLag > 0 || params.ConsumerMonitor.MaxAckSilence > 0 {
+		if alertSink == nil {
+			log.WithFields(logTags).Warn("Consumer monitoring enabled, but no alert sink defined")
+		} else {
+			monitor, err := management.GetConsumerActivityMonitor(
+				controller,
+				alertSink,
+				management.ConsumerMonitorParam{
+					MaxLag:        params.ConsumerMonitor.MaxLag,
+					MaxAckSilence: params.ConsumerMonitor.MaxAckSilence,
+				},
+				instance,
+				runtimeContext,
+				&wg,
+			)
+			if err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Unable to define consumer monitor")
+				return err
+			}
+			if err := monitor.Start(params.ConsumerMonitor.Interval); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Unable to start consumer monitor")
+				return err
+			}
+		}
+	}
+
+	// -------------------------------------------------------------------
+	// Start stream storage utilization monitoring
+
+	if params.StreamMonitor.WarnRatio > 0 {
+		monitor, err := management.GetStreamUsageMonitor(
+			controller,
+			alertSink,
+			metricsRegistry,
+			params.StreamMonitor.WarnRatio,
+			instance,
+			runtimeContext,
+			&wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define stream usage monitor")
+			return err
+		}
+		if err := monitor.Start(params.StreamMonitor.Interval); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to start stream usage monitor")
+			return err
+		}
+	}
+
+	// -------------------------------------------------------------------
+	// Start reconciling Kubernetes custom resources
+
+	if params.Operator.Enabled {
+		kubeConfig, err := operator.GetInClusterKubeConfig()
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define Kubernetes config")
+			return err
+		}
+		kube, err := operator.GetKubeClient(kubeConfig, instance)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define Kubernetes client")
+			return err
+		}
+		topologyOperator, err := operator.GetTopologyOperator(
+			kube,
+			controller,
+			operator.OperatorParam{
+				Namespace:  params.Operator.Namespace,
+				Resync:     params.Operator.Resync,
+				RetryDelay: time.Second * 5,
+			},
+			instance,
+			runtimeContext,
+			&wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define topology operator")
+			return err
+		}
+		if err := topologyOperator.Start(); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to start topology operator")
+			return err
+		}
+	}
+
 	// -------------------------------------------------------------------
 	// Start the HTTP server
 
 	router := mux.NewRouter()
 	mainRouter := apis.RegisterPathPrefix(router, params.Endpoints.PathPrefix, nil)
 
-	// All stream routes
-	streamAPIRouter := apis.RegisterPathPrefix(
-		mainRouter, "/v1/admin/stream", map[string]http.HandlerFunc{
-			"post": httpHandler.CreateStreamHandler(),
-			"get":  httpHandler.GetAllStreamsHandler(),
-		},
-	)
+	apiVersions, err := defineAPIVersions(params.Endpoints.V1Deprecated, params.Endpoints.V1Sunset)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define API versions")
+		return err
+	}
+	// The API versions currently share the same handlers
+	apis.RegisterAPIVersions(
+		mainRouter, apiVersions, func(_ apis.APIVersion, versionRouter *mux.Router) {
+			adminAPIRouter := apis.RegisterPathPrefix(versionRouter, "/admin", nil)
+			defineAPIAuth(adminAPIRouter, httpHandler.APIRestHandler, params.Listener)
 
-	// Per stream routes
-	perStreamAPIRounter := apis.RegisterPathPrefix(
-		streamAPIRouter, "/{streamName}", map[string]http.HandlerFunc{
-			"get":    httpHandler.GetStreamHandler(),
-			"delete": httpHandler.DeleteStreamHandler(),
-		},
-	)
-	_ = apis.RegisterPathPrefix(perStreamAPIRounter, "/subject", map[string]http.HandlerFunc{
-		"put": httpHandler.ChangeStreamSubjectsHandler(),
-	})
-	_ = apis.RegisterPathPrefix(perStreamAPIRounter, "/limit", map[string]http.HandlerFunc{
-		"put": httpHandler.UpdateStreamLimitsHandler(),
-	})
+			// Account usage
+			_ = apis.RegisterPathPrefix(adminAPIRouter, "/account", map[string]http.HandlerFunc{
+				"get": httpHandler.GetAccountUsageHandler(),
+			})
+
+			// Push subscribe sessions of the dataplane replicas
+			_ = apis.RegisterPathPrefix(adminAPIRouter, "/sessions", map[string]http.HandlerFunc{
+				"get": httpHandler.GetActiveSessionsHandler(),
+			})
+
+			// GraphQL queries of streams and consumers
+			_ = apis.RegisterPathPrefix(adminAPIRouter, "/graphql", map[string]http.HandlerFunc{
+				"post": httpHandler.GraphQLQueryHandler(),
+			})
+
+			// Consumers left without a session
+			_ = apis.RegisterPathPrefix(adminAPIRouter, "/orphans", map[string]http.HandlerFunc{
+				"get": httpHandler.GetOrphanedConsumersHandler(),
+			})
+
+			// Leases pinning consumers to sessions
+			_ = apis.RegisterPathPrefix(adminAPIRouter, "/lease", map[string]http.HandlerFunc{
+				"get": httpHandler.GetAllConsumerLeasesHandler(),
+			})
+
+			// Stream archives
+			archiveAPIRouter := apis.RegisterPathPrefix(
+				adminAPIRouter, "/archive", map[string]http.HandlerFunc{
+					"get": httpHandler.GetAllArchivesHandler(),
+				},
+			)
+			perArchiveAPIRouter := apis.RegisterPathPrefix(
+				archiveAPIRouter, "/{archiveName}", map[string]http.HandlerFunc{
+					"put":    httpHandler.PutArchiveHandler(),
+					"get":    httpHandler.GetArchiveHandler(),
+					"delete": httpHandler.DeleteArchiveHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perArchiveAPIRouter, "/manifest", map[string]http.HandlerFunc{
+					"get": httpHandler.GetArchiveManifestHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perArchiveAPIRouter, "/replay", map[string]http.HandlerFunc{
+					"post": httpHandler.StartArchiveReplayHandler(),
+				},
+			)
 
-	// All consumer routes
-	consumerAPIRouter := apis.RegisterPathPrefix(
-		perStreamAPIRounter, "/consumer", map[string]http.HandlerFunc{
-			"post": httpHandler.CreateConsumerHandler(),
-			"get":  httpHandler.GetAllConsumersHandler(),
+			// Archive replays
+			replayAPIRouter := apis.RegisterPathPrefix(
+				adminAPIRouter, "/replay", map[string]http.HandlerFunc{
+					"get": httpHandler.GetAllReplaysHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				replayAPIRouter, "/{replayID}", map[string]http.HandlerFunc{
+					"get":    httpHandler.GetReplayHandler(),
+					"delete": httpHandler.CancelReplayHandler(),
+				},
+			)
+
+			// Stream and consumer event feed
+			_ = apis.RegisterPathPrefix(adminAPIRouter, "/events", map[string]http.HandlerFunc{
+				"get": httpHandler.StreamTopologyEventsHandler(),
+			})
+
+			// All stream routes
+			streamAPIRouter := apis.RegisterPathPrefix(
+				adminAPIRouter, "/stream", map[string]http.HandlerFunc{
+					"post": httpHandler.CreateStreamHandler(),
+					"get":  httpHandler.GetAllStreamsHandler(),
+				},
+			)
+
+			// Per stream routes
+			perStreamAPIRounter := apis.RegisterPathPrefix(
+				streamAPIRouter, "/{streamName}", map[string]http.HandlerFunc{
+					"get":    httpHandler.GetStreamHandler(),
+					"delete": httpHandler.DeleteStreamHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perStreamAPIRounter, "/subject", map[string]http.HandlerFunc{
+					"put": httpHandler.ChangeStreamSubjectsHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(perStreamAPIRounter, "/limit", map[string]http.HandlerFunc{
+				"put": httpHandler.UpdateStreamLimitsHandler(),
+			})
+			_ = apis.RegisterPathPrefix(
+				perStreamAPIRounter, "/retention", map[string]http.HandlerFunc{
+					"put": httpHandler.UpdateStreamRetentionHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perStreamAPIRounter, "/compact", map[string]http.HandlerFunc{
+					"post": httpHandler.CompactStreamHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perStreamAPIRounter, "/purge/preview", map[string]http.HandlerFunc{
+					"get": httpHandler.PreviewStreamPurgeHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perStreamAPIRounter, "/utilization", map[string]http.HandlerFunc{
+					"get": httpHandler.GetStreamUtilizationHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perStreamAPIRounter, "/latency", map[string]http.HandlerFunc{
+					"get": httpHandler.GetConsumerLatencyHandler(),
+				},
+			)
+
+			// All consumer routes
+			consumerAPIRouter := apis.RegisterPathPrefix(
+				perStreamAPIRounter, "/consumer", map[string]http.HandlerFunc{
+					"post": httpHandler.CreateConsumerHandler(),
+					"get":  httpHandler.GetAllConsumersHandler(),
+				},
+			)
+			perConsumerAPIRouter := apis.RegisterPathPrefix(
+				consumerAPIRouter, "/{consumerName}", map[string]http.HandlerFunc{
+					"get":    httpHandler.GetConsumerHandler(),
+					"delete": httpHandler.DeleteConsumerHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(perConsumerAPIRouter, "/clone", map[string]http.HandlerFunc{
+				"post": httpHandler.CloneConsumerHandler(),
+			})
+			_ = apis.RegisterPathPrefix(
+				perConsumerAPIRouter, "/redeliver", map[string]http.HandlerFunc{
+					"post": httpHandler.RedeliverConsumerPendingHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perConsumerAPIRouter, "/diff/{otherConsumer}", map[string]http.HandlerFunc{
+					"get": httpHandler.DiffConsumersHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perConsumerAPIRouter, "/filter", map[string]http.HandlerFunc{
+					"put":    httpHandler.PutConsumerFilterHandler(),
+					"get":    httpHandler.GetConsumerFilterHandler(),
+					"delete": httpHandler.DeleteConsumerFilterHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perConsumerAPIRouter, "/events", map[string]http.HandlerFunc{
+					"get": httpHandler.StreamConsumerDeliveryEventsHandler(),
+				},
+			)
+			_ = apis.RegisterPathPrefix(
+				perConsumerAPIRouter, "/lease", map[string]http.HandlerFunc{
+					"get":    httpHandler.GetConsumerLeaseHandler(),
+					"delete": httpHandler.BreakConsumerLeaseHandler(),
+				},
+			)
 		},
 	)
-	_ = apis.RegisterPathPrefix(consumerAPIRouter, "/{consumerName}", map[string]http.HandlerFunc{
-		"get":    httpHandler.GetConsumerHandler(),
-		"delete": httpHandler.DeleteConsumerHandler(),
-	})
 
 	// Health check
+	// Admin UI
+	if params.UI.Enabled {
+		var spec []byte
+		if params.UI.SpecFile != "" {
+			if spec, err = os.ReadFile(params.UI.SpecFile); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Unable to read OpenAPI spec")
+				return err
+			}
+		}
+		uiPath := strings.TrimRight(params.Endpoints.PathPrefix, "/") + "/ui/"
+		uiHandler, err := ui.GetHandler(uiPath, spec)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define admin UI handler")
+			return err
+		}
+		mainRouter.PathPrefix("/ui/").Handler(uiHandler)
+		mainRouter.Path("/ui").Handler(http.RedirectHandler(uiPath, http.StatusMovedPermanently))
+	}
+
+	if metricsRegistry != nil {
+		_ = apis.RegisterPathPrefix(mainRouter, "/metrics", map[string]http.HandlerFunc{
+			"get": promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP,
+		})
+	}
 	_ = apis.RegisterPathPrefix(mainRouter, "/alive", map[string]http.HandlerFunc{
 		"get": httpHandler.AliveHandler(),
 	})
@@ -150,26 +1432,25 @@ func RunManagementServer(
 	})
 
 	// Add logging
-	router.Use(func(next http.Handler) http.Handler {
-		return handlers.CombinedLoggingHandler(httpHandler, next)
-	})
+	accessLog, err := defineAccessLog(params.AccessLog, httpHandler.APIRestHandler)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define access log")
+		return err
+	}
+	router.Use(accessLog)
 
-	serverListen := fmt.Sprintf(":%d", params.ServerPort)
 	httpSrv := &http.Server{
-		Addr:         serverListen,
 		WriteTimeout: time.Second * 60,
 		ReadTimeout:  time.Second * 60,
-		Handler:      h2c.NewHandler(router, &http2.Server{}),
 	}
 
 	// Start the server
-	go func() {
-		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.WithError(err).Error("HTTP Server Failure")
-		}
-	}()
-
-	log.WithFields(logTags).Infof("Started HTTP server on http://%s", serverListen)
+	if err := startHTTPServer(
+		httpSrv, router, &http2.Server{}, params.ServerPort, params.Listener, logTags, runtimeContext, &wg,
+	); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to start HTTP server")
+		return err
+	}
 
 	// ============================================================================
 
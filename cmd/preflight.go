@@ -0,0 +1,100 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+)
+
+// PreflightArgs settings for the checks run before the server binds its listeners
+type PreflightArgs struct {
+	// CheckOnly run only the preflight checks, and exit
+	CheckOnly bool
+	// RequirementsFile is the JSON file of the streams and consumers the server needs
+	RequirementsFile string
+	// CreateMissing create the required streams and consumers which do not exist
+	CreateMissing bool
+	// Timeout bounds each check against JetStream
+	Timeout time.Duration `validate:"gt=0"`
+}
+
+// runPreflight helper function to verify, before binding the listeners, that the server
+// is able to operate: its TLS material loads, NATS is connected, JetStream is available,
+// and the required streams and consumers exist. The config is already validated.
+func runPreflight(
+	args PreflightArgs,
+	listener ServerListenerArgs,
+	natsClient *core.NatsClient,
+	instance string,
+	logTags log.Fields,
+	ctxt context.Context,
+) error {
+	if err := checkTLSMaterial(listener); err != nil {
+		log.WithError(err).WithFields(logTags).Error("Preflight: TLS material check failed")
+		return err
+	}
+	log.WithFields(logTags).Info("Preflight: TLS material OK")
+
+	if !natsClient.NATs().IsConnected() {
+		err := fmt.Errorf("not connected to NATS")
+		log.WithError(err).WithFields(logTags).Error("Preflight: NATS connectivity check failed")
+		return err
+	}
+	log.WithFields(logTags).Infof(
+		"Preflight: connected to NATS at %s", natsClient.NATs().ConnectedUrl(),
+	)
+
+	controller, err := management.GetJetStreamController(natsClient, instance)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to define JetStream controller")
+		return err
+	}
+	{
+		callCtxt, cancel := context.WithTimeout(ctxt, args.Timeout)
+		defer cancel()
+		if _, err := controller.GetAccountInfo(callCtxt); err != nil {
+			log.WithError(err).WithFields(logTags).Error("Preflight: JetStream check failed")
+			return err
+		}
+	}
+	log.WithFields(logTags).Info("Preflight: JetStream available")
+
+	if args.RequirementsFile == "" {
+		return nil
+	}
+	required, err := management.LoadTopologyRequirements(args.RequirementsFile)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to read topology requirements")
+		return err
+	}
+	callCtxt, cancel := context.WithTimeout(ctxt, args.Timeout)
+	defer cancel()
+	if err := management.EnsureTopology(
+		controller, required, args.CreateMissing, callCtxt,
+	); err != nil {
+		log.WithError(err).WithFields(logTags).Error("Preflight: topology check failed")
+		return err
+	}
+	log.WithFields(logTags).Infof(
+		"Preflight: %d required streams and their consumers OK", len(required.Streams),
+	)
+	return nil
+}
@@ -0,0 +1,304 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/apis"
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServerListenerArgs listener settings for an API server
+type ServerListenerArgs struct {
+	// Address is the address to bind to. Empty binds to all interfaces.
+	Address string
+	// TLSCertFile is the server certificate PEM file. TLS is enabled if set.
+	TLSCertFile string `validate:"required_with=TLSKeyFile,excluded_with=ACMEDomains"`
+	// TLSKeyFile is the server private key PEM file
+	TLSKeyFile string `validate:"required_with=TLSCertFile"`
+	// TLSReloadInterval is the interval between checks of the certificate files for changes
+	TLSReloadInterval time.Duration `validate:"gt=0"`
+	// ACMEDomains is a comma separated list of domains to obtain certificates for with ACME.
+	// TLS is enabled if set.
+	ACMEDomains string
+	// ACMECacheDir is the directory for caching ACME certificates
+	ACMECacheDir string `validate:"required_with=ACMEDomains"`
+	// ACMEEmail is the optional contact email for the ACME account
+	ACMEEmail string
+	// ClientCAFile is the PEM file of CAs for verifying client certificates. If set, API
+	// requests must present a client certificate signed by one of these CAs.
+	ClientCAFile string `validate:"excluded_without_all=TLSCertFile ACMEDomains"`
+	// AllowedClients is a comma separated list of principals permitted to call the APIs. A
+	// client certificate identifies its subject common name, and DNS, email, and URI SANs as
+	// principals. If empty, any verified client certificate is permitted.
+	AllowedClients string
+	// AuthToken if set, API requests must carry it as a bearer token
+	AuthToken string
+	// ProxyProtocol whether connections from trusted proxies carry a PROXY protocol header
+	ProxyProtocol bool
+	// TrustedProxies is a comma separated list of CIDRs and IPs of the load balancers in
+	// front of the server. Connections from these give the client address with a PROXY
+	// protocol header, or the X-Forwarded-For header.
+	TrustedProxies string
+}
+
+// SubjectRuleArgs settings for validating the subjects given by clients
+type SubjectRuleArgs struct {
+	// MaxDepth is the max number of tokens in a subject. 0 for no limit.
+	MaxDepth int `validate:"gte=0"`
+	// ReservedPrefixes is a comma separated list of subject prefixes clients may not use
+	ReservedPrefixes string
+}
+
+// AccessLogArgs settings for the access log of an API server
+type AccessLogArgs struct {
+	// EncryptDir if set, the access log of each tenant is written to this directory,
+	// encrypted with the tenant's key, instead of the server log
+	EncryptDir string
+	// KeyDir is the directory of the tenants' access log keys
+	KeyDir string `validate:"required_with=EncryptDir"`
+}
+
+// defineAccessLog helper function to define the access log middleware from the CLI settings
+func defineAccessLog(args AccessLogArgs, handler apis.APIRestHandler) (mux.MiddlewareFunc, error) {
+	if args.EncryptDir == "" {
+		return func(next http.Handler) http.Handler {
+			return handlers.CombinedLoggingHandler(handler, next)
+		}, nil
+	}
+	keys, err := common.GetFileKeyProvider(args.KeyDir)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := common.GetEncryptedLogWriter(args.EncryptDir, keys)
+	if err != nil {
+		return nil, err
+	}
+	return handler.EncryptedAccessLog(writer), nil
+}
+
+// defineSubjectRules helper function to define the subject rules from the CLI settings
+func defineSubjectRules(args SubjectRuleArgs) common.SubjectRules {
+	return common.SubjectRules{
+		MaxDepth:         args.MaxDepth,
+		ReservedPrefixes: splitCommaList(args.ReservedPrefixes),
+	}
+}
+
+// splitCommaList helper function to split a comma separated list, dropping empty entries
+func splitCommaList(list string) []string {
+	result := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// defineTLSConfig helper function to define the TLS config of a listener. Returns nil if
+// TLS is not enabled.
+func defineTLSConfig(
+	listener ServerListenerArgs, ctxt context.Context, wg *sync.WaitGroup,
+) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if listener.ACMEDomains != "" {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(splitCommaList(listener.ACMEDomains)...),
+			Cache:      autocert.DirCache(listener.ACMECacheDir),
+			Email:      listener.ACMEEmail,
+		}
+		tlsConfig = manager.TLSConfig()
+	} else if listener.TLSCertFile != "" {
+		reloader, err := common.GetCertificateReloader(
+			listener.TLSCertFile, listener.TLSKeyFile, listener.TLSReloadInterval, ctxt, wg,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12,
+		}
+	} else {
+		return nil, nil
+	}
+	if listener.ClientCAFile != "" {
+		clientCAs, err := loadClientCAs(listener.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = clientCAs
+		// Client certificates are required by the API routes, so health checks stay open
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// loadClientCAs helper function to read the CAs for verifying client certificates
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return clientCAs, nil
+}
+
+// checkTLSMaterial helper function to verify the TLS files of a listener are usable,
+// without starting to watch them
+func checkTLSMaterial(listener ServerListenerArgs) error {
+	if listener.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(listener.TLSCertFile, listener.TLSKeyFile); err != nil {
+			return fmt.Errorf("unable to load TLS certificate %s: %w", listener.TLSCertFile, err)
+		}
+	}
+	if listener.ACMEDomains != "" {
+		if err := os.MkdirAll(listener.ACMECacheDir, 0700); err != nil {
+			return fmt.Errorf("unable to prepare ACME cache %s: %w", listener.ACMECacheDir, err)
+		}
+	}
+	if listener.ClientCAFile != "" {
+		if _, err := loadClientCAs(listener.ClientCAFile); err != nil {
+			return fmt.Errorf("unable to load client CAs %s: %w", listener.ClientCAFile, err)
+		}
+	}
+	return nil
+}
+
+// defineAPIVersions helper function to define the served API versions. v1 and v2 are served
+// side by side; v1 is marked deprecated if a deprecation time is given.
+func defineAPIVersions(v1Deprecated, v1Sunset string) ([]apis.APIVersion, error) {
+	v1 := apis.APIVersion{Name: "v1"}
+	if v1Deprecated != "" {
+		deprecated, err := time.Parse(time.RFC3339, v1Deprecated)
+		if err != nil {
+			return nil, err
+		}
+		v1.Deprecated = deprecated
+		v1.Successor = "v2"
+	}
+	if v1Sunset != "" {
+		sunset, err := time.Parse(time.RFC3339, v1Sunset)
+		if err != nil {
+			return nil, err
+		}
+		v1.Sunset = sunset
+	}
+	return []apis.APIVersion{v1, {Name: "v2"}}, nil
+}
+
+// defineAPIAuth helper function to attach the API authentication middleware to the router
+// of the API routes
+func defineAPIAuth(
+	apiRouter *mux.Router, handler apis.APIRestHandler, listener ServerListenerArgs,
+) {
+	if listener.ClientCAFile != "" {
+		apiRouter.Use(handler.RequireClientCertificate(splitCommaList(listener.AllowedClients)))
+	}
+	if listener.AuthToken != "" {
+		apiRouter.Use(handler.RequireBearerToken(listener.AuthToken))
+	}
+}
+
+// startHTTPServer helper function to start serving HTTP/2 on a server
+//
+// The server is served over TLS if the listener has a certificate or uses ACME, and with
+// cleartext h2c otherwise.
+func startHTTPServer(
+	httpSrv *http.Server,
+	router http.Handler,
+	h2Srv *http2.Server,
+	port int,
+	listener ServerListenerArgs,
+	logTags log.Fields,
+	ctxt context.Context,
+	wg *sync.WaitGroup,
+) error {
+	httpSrv.Addr = fmt.Sprintf("%s:%d", listener.Address, port)
+	trustedProxies, err := common.ParseIPNetList(listener.TrustedProxies)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to parse trusted proxies")
+		return err
+	}
+	if len(trustedProxies) > 0 {
+		router = apis.TrustForwardedFor(trustedProxies)(router)
+	}
+	tlsConfig, err := defineTLSConfig(listener, ctxt, wg)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define TLS config")
+		return err
+	}
+	useTLS := tlsConfig != nil
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+		httpSrv.TLSConfig = tlsConfig
+		httpSrv.Handler = router
+		if err := http2.ConfigureServer(httpSrv, h2Srv); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to configure HTTP/2")
+			return err
+		}
+	} else {
+		httpSrv.Handler = h2c.NewHandler(router, h2Srv)
+	}
+
+	netListener, err := net.Listen("tcp", httpSrv.Addr)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to listen on %s", httpSrv.Addr)
+		return err
+	}
+	if listener.ProxyProtocol {
+		// An empty trusted proxies list requires all connections carry the header
+		netListener = common.GetProxyProtocolListener(
+			netListener, trustedProxies, time.Second*5,
+		)
+	}
+
+	go func() {
+		var err error
+		if useTLS {
+			// Certificates are provided through the TLS config
+			err = httpSrv.ServeTLS(netListener, "", "")
+		} else {
+			err = httpSrv.Serve(netListener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("HTTP Server Failure")
+		}
+	}()
+
+	log.WithFields(logTags).Infof("Started HTTP server on %s://%s", scheme, httpSrv.Addr)
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// BufferPoolStats are the usage counters of a BufferPool
+type BufferPoolStats struct {
+	// Gets is the number of buffers handed out
+	Gets uint64 `json:"gets"`
+	// Allocations is the number of buffers allocated because the pool was empty
+	Allocations uint64 `json:"allocations"`
+	// Discards is the number of returned buffers dropped for being over the retained size
+	Discards uint64 `json:"discards"`
+	// InUse is the number of buffers handed out and not yet returned
+	InUse int64 `json:"in_use"`
+}
+
+// BufferPool is a pool of reusable byte buffers
+type BufferPool interface {
+	// Get fetch an empty buffer from the pool
+	Get() *bytes.Buffer
+	// Put return a buffer to the pool. The buffer must not be used afterwards.
+	Put(buf *bytes.Buffer)
+	// Stats return the pool usage counters
+	Stats() BufferPoolStats
+}
+
+// bufferPoolImpl implements BufferPool
+type bufferPoolImpl struct {
+	pool        sync.Pool
+	maxRetained int
+	gets        uint64
+	allocations uint64
+	discards    uint64
+	inUse       int64
+}
+
+// GetBufferPool define a new BufferPool
+//
+// Buffers which grew beyond maxRetained bytes are dropped when returned, so one large
+// request does not pin its memory in the pool.
+func GetBufferPool(maxRetained int) (BufferPool, error) {
+	if maxRetained <= 0 {
+		return nil, fmt.Errorf("buffer pool max retained size must be positive")
+	}
+	instance := &bufferPoolImpl{maxRetained: maxRetained}
+	instance.pool.New = func() interface{} {
+		atomic.AddUint64(&instance.allocations, 1)
+		return new(bytes.Buffer)
+	}
+	return instance, nil
+}
+
+// Get fetch an empty buffer from the pool
+func (p *bufferPoolImpl) Get() *bytes.Buffer {
+	atomic.AddUint64(&p.gets, 1)
+	atomic.AddInt64(&p.inUse, 1)
+	return p.pool.Get().(*bytes.Buffer)
+}
+
+// Put return a buffer to the pool. The buffer must not be used afterwards.
+func (p *bufferPoolImpl) Put(buf *bytes.Buffer) {
+	atomic.AddInt64(&p.inUse, -1)
+	if buf.Cap() > p.maxRetained {
+		atomic.AddUint64(&p.discards, 1)
+		return
+	}
+	buf.Reset()
+	p.pool.Put(buf)
+}
+
+// Stats return the pool usage counters
+func (p *bufferPoolImpl) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Gets:        atomic.LoadUint64(&p.gets),
+		Allocations: atomic.LoadUint64(&p.allocations),
+		Discards:    atomic.LoadUint64(&p.discards),
+		InUse:       atomic.LoadInt64(&p.inUse),
+	}
+}
+
+// DecodeBase64Into helper function to base64 decode a stream into a buffer
+//
+// If the stream length is known, the buffer is grown once to the decoded size up front.
+func DecodeBase64Into(dst *bytes.Buffer, src io.Reader, encodedLen int64) (int64, error) {
+	if encodedLen > 0 {
+		// ReadFrom always wants MinRead of free space before reading
+		dst.Grow(base64.StdEncoding.DecodedLen(int(encodedLen)) + bytes.MinRead)
+	}
+	return dst.ReadFrom(base64.NewDecoder(base64.StdEncoding, src))
+}
@@ -0,0 +1,136 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid settings
+	{
+		_, err := GetBufferPool(0)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetBufferPool(1024)
+	assert.Nil(err)
+
+	// Case 1: buffers are handed out empty, and reused once returned
+	{
+		buf := uut.Get()
+		assert.Equal(0, buf.Len())
+		buf.WriteString("hello world")
+		stats := uut.Stats()
+		assert.Equal(uint64(1), stats.Gets)
+		assert.Equal(int64(1), stats.InUse)
+		uut.Put(buf)
+		buf = uut.Get()
+		assert.Equal(0, buf.Len())
+		uut.Put(buf)
+		stats = uut.Stats()
+		assert.Equal(uint64(2), stats.Gets)
+		assert.Equal(int64(0), stats.InUse)
+		assert.LessOrEqual(stats.Allocations, stats.Gets)
+	}
+
+	// Case 2: buffers grown over the retained size are dropped
+	{
+		buf := uut.Get()
+		buf.Grow(4096)
+		uut.Put(buf)
+		stats := uut.Stats()
+		assert.Equal(uint64(1), stats.Discards)
+		assert.Equal(int64(0), stats.InUse)
+	}
+}
+
+func TestDecodeBase64Into(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := []byte(strings.Repeat("hello world ", 1000))
+	encoded := base64.StdEncoding.EncodeToString(msg)
+
+	// Case 0: known length
+	{
+		buf := new(bytes.Buffer)
+		n, err := DecodeBase64Into(buf, strings.NewReader(encoded), int64(len(encoded)))
+		assert.Nil(err)
+		assert.Equal(int64(len(msg)), n)
+		assert.Equal(msg, buf.Bytes())
+	}
+
+	// Case 1: unknown length
+	{
+		buf := new(bytes.Buffer)
+		n, err := DecodeBase64Into(buf, strings.NewReader(encoded), -1)
+		assert.Nil(err)
+		assert.Equal(int64(len(msg)), n)
+		assert.Equal(msg, buf.Bytes())
+	}
+
+	// Case 2: not base64
+	{
+		buf := new(bytes.Buffer)
+		_, err := DecodeBase64Into(buf, strings.NewReader("not base64!"), 11)
+		assert.NotNil(err)
+	}
+}
+
+func BenchmarkDecodeBase64Into(b *testing.B) {
+	for _, size := range []int{1024, 65536, 1 << 20} {
+		encoded := []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xa5}, size)))
+		b.Run(fmt.Sprintf("alloc-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for itr := 0; itr < b.N; itr++ {
+				buf := new(bytes.Buffer)
+				if _, err := DecodeBase64Into(
+					buf, bytes.NewReader(encoded), int64(len(encoded)),
+				); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("pooled-%d", size), func(b *testing.B) {
+			pool, err := GetBufferPool(2 << 20)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					buf := pool.Get()
+					if _, err := DecodeBase64Into(
+						buf, bytes.NewReader(encoded), int64(len(encoded)),
+					); err != nil {
+						b.Error(err)
+						return
+					}
+					pool.Put(buf)
+				}
+			})
+		})
+	}
+}
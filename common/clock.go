@@ -0,0 +1,192 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of time dependent components. Components use SystemClock by
+// default; tests can replace it with a FakeClock to control the passing of time.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After returns a channel receiving the current time after duration d
+	After(d time.Duration) <-chan time.Time
+	// NewTimer defines a timer firing once after duration d
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer is a timer defined by a Clock
+type ClockTimer interface {
+	// C returns the channel receiving the time when the timer fires
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. Returns false if the timer already fired or
+	// was stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock reading the system time
+var SystemClock Clock = systemClock{}
+
+// systemClock implements Clock with the time package
+type systemClock struct{}
+
+// Now returns the current time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After returns a channel receiving the current time after duration d
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// NewTimer defines a timer firing once after duration d
+func (systemClock) NewTimer(d time.Duration) ClockTimer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+// systemTimer implements ClockTimer with time.Timer
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// C returns the channel receiving the time when the timer fires
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+// Stop prevents the timer from firing
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// ========================================================================================
+
+// FakeClock is a Clock for tests, whose time only moves when advanced
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// added is closed, and replaced, whenever a timer is defined
+	added chan struct{}
+}
+
+// GetFakeClock define new FakeClock starting at start
+func GetFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start, added: make(chan struct{})}
+}
+
+// Now returns the current time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the clock is advanced by d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// NewTimer defines a timer firing once the clock is advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	close(c.added)
+	c.added = make(chan struct{})
+	return timer
+}
+
+// Advance moves the clock forward by d, firing the timers whose deadline passed in
+// deadline order
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+// PendingTimers returns the number of timers not yet fired or stopped
+func (c *FakeClock) PendingTimers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until at least count timers are pending, or the timeout passes.
+// Returns whether the timers are pending. Tests use this to wait for a component to be
+// waiting on the clock before advancing it.
+func (c *FakeClock) WaitForTimers(count int, timeout time.Duration) bool {
+	expire := time.After(timeout)
+	for {
+		c.lock.Lock()
+		pending, added := len(c.timers), c.added
+		c.lock.Unlock()
+		if pending >= count {
+			return true
+		}
+		select {
+		case <-added:
+		case <-expire:
+			return false
+		}
+	}
+}
+
+// fakeTimer implements ClockTimer for FakeClock
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+// C returns the channel receiving the time when the timer fires
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop prevents the timer from firing
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for idx, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:idx], t.clock.timers[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
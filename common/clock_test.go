@@ -0,0 +1,78 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Unix(1000, 0)
+	uut := GetFakeClock(start)
+	assert.Equal(start, uut.Now())
+
+	fired := func(c <-chan time.Time) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Case 1: timers fire once the clock reaches their deadline
+	{
+		short := uut.NewTimer(time.Second)
+		long := uut.After(time.Second * 3)
+		assert.Equal(2, uut.PendingTimers())
+		uut.Advance(time.Millisecond * 500)
+		assert.False(fired(short.C()))
+		uut.Advance(time.Millisecond * 500)
+		assert.True(fired(short.C()))
+		assert.False(fired(long))
+		assert.Equal(1, uut.PendingTimers())
+		uut.Advance(time.Second * 5)
+		assert.True(fired(long))
+		assert.Equal(start.Add(time.Second*6), uut.Now())
+		assert.Equal(0, uut.PendingTimers())
+	}
+
+	// Case 2: stopped timers do not fire
+	{
+		timer := uut.NewTimer(time.Second)
+		assert.True(timer.Stop())
+		assert.False(timer.Stop())
+		uut.Advance(time.Second * 2)
+		assert.False(fired(timer.C()))
+	}
+
+	// Case 3: timers without a duration fire immediately
+	{
+		assert.True(fired(uut.After(0)))
+		assert.Equal(0, uut.PendingTimers())
+	}
+
+	// Case 4: wait for a timer defined by another goroutine
+	{
+		assert.False(uut.WaitForTimers(1, time.Millisecond*10))
+		go uut.NewTimer(time.Second)
+		assert.True(uut.WaitForTimers(1, time.Second))
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"strings"
+	"time"
+)
+
+// GatewayConsumerTag marks the description of the JetStream consumers httpmq created, so
+// they can be told apart from consumers defined by other clients
+const GatewayConsumerTag = "[httpmq]"
+
+// TagGatewayConsumer returns the consumer description with notes, marked as created by
+// httpmq
+func TagGatewayConsumer(notes string) string {
+	if notes == "" {
+		return GatewayConsumerTag
+	}
+	return notes + " " + GatewayConsumerTag
+}
+
+// IsGatewayConsumer whether the consumer description is marked as created by httpmq
+func IsGatewayConsumer(description string) bool {
+	return strings.HasSuffix(description, GatewayConsumerTag)
+}
+
+// GatewayConsumerNotes returns the notes of the consumer description, without the httpmq
+// mark
+func GatewayConsumerNotes(description string) string {
+	if !IsGatewayConsumer(description) {
+		return description
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(description, GatewayConsumerTag), " ")
+}
+
+// UnboundConsumer is a durable push consumer httpmq created, which no session was bound to
+type UnboundConsumer struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Since is when the consumer was first found without a session
+	Since time.Time `json:"since"`
+	// Reporter is the replica which found the consumer without a session
+	Reporter string `json:"reporter"`
+}
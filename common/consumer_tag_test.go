@@ -0,0 +1,47 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatewayConsumerTag(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 1: tag a consumer with notes
+	{
+		description := TagGatewayConsumer("order processing")
+		assert.Equal("order processing [httpmq]", description)
+		assert.True(IsGatewayConsumer(description))
+		assert.Equal("order processing", GatewayConsumerNotes(description))
+	}
+
+	// Case 2: tag a consumer without notes
+	{
+		description := TagGatewayConsumer("")
+		assert.True(IsGatewayConsumer(description))
+		assert.Equal("", GatewayConsumerNotes(description))
+	}
+
+	// Case 3: consumers defined by other clients are left alone
+	{
+		assert.False(IsGatewayConsumer("order processing"))
+		assert.False(IsGatewayConsumer(""))
+		assert.Equal("order processing", GatewayConsumerNotes("order processing"))
+	}
+}
@@ -18,7 +18,9 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apex/log"
@@ -27,10 +29,30 @@ import (
 // TaskHandler is the function signature of callback used to process an user task
 type TaskHandler func(taskParam interface{}) error
 
+// TaskPanicHandler is the function signature of callback notified of a panic recovered from
+// the handler of a task
+type TaskPanicHandler func(taskParam interface{}, recovered interface{})
+
+// taskPanics number of panics recovered from task handlers by all task processors
+var taskPanics uint64
+
+// TaskPanics returns the number of panics recovered from task handlers by all task
+// processors
+func TaskPanics() uint64 {
+	return atomic.LoadUint64(&taskPanics)
+}
+
 // TaskProcessor implements an event loop model where tasks are processed by a daemon thread
 type TaskProcessor interface {
 	// Submit submits a task-parameter to be processed
 	Submit(newTaskParam interface{}, ctx context.Context) error
+	// SubmitAndWait submits a task-parameter to be processed, and waits for the result of its
+	// handler
+	SubmitAndWait(newTaskParam interface{}, ctx context.Context) error
+	// SubmitBatch submits task-parameters to be processed with a single channel operation.
+	// If atomic, the task-parameters are processed in order, with no other task-parameter in
+	// between. Otherwise, a processor with multiple workers may spread them across workers.
+	SubmitBatch(newTaskParams []interface{}, atomic bool, ctx context.Context) error
 	// ProcessNewTaskParam execute a submitted task-parameter
 	ProcessNewTaskParam(newTaskParam interface{}) error
 	// SetTaskExecutionMap update the mapping between task-parameter object and its associated
@@ -42,12 +64,78 @@ type TaskProcessor interface {
 	SetTaskExecutionMap(newMap map[reflect.Type]TaskHandler) error
 	// AddToTaskExecutionMap add new (task-parameter, handler function) mapping to the existing set.
 	AddToTaskExecutionMap(theType reflect.Type, handler TaskHandler) error
+	// SetPanicHandler set the callback notified of each panic recovered from a task handler.
+	// A panic in a task handler fails the task, without stopping the daemon thread.
+	SetPanicHandler(handler TaskPanicHandler) error
 	// StartEventLoop starts the daemon thread for processing the submitted task-parameters
 	StartEventLoop(wg *sync.WaitGroup) error
 	// StopEventLoop stops the daemon thread
 	StopEventLoop() error
 }
 
+// TaskSubmitter submits task-parameters of type T to a TaskProcessor, to be processed by
+// the handler it was registered with. Unlike the execution map, the handler is found
+// without reflection.
+type TaskSubmitter[T any] struct {
+	tp      TaskProcessor
+	handler func(taskParam T) error
+}
+
+// RegisterTaskHandler define a TaskSubmitter submitting task-parameters of type T to tp, to
+// be processed by handler
+func RegisterTaskHandler[T any](
+	tp TaskProcessor, handler func(taskParam T) error,
+) (TaskSubmitter[T], error) {
+	if tp == nil || handler == nil {
+		return TaskSubmitter[T]{}, fmt.Errorf("task handler needs a task processor and a handler")
+	}
+	return TaskSubmitter[T]{tp: tp, handler: handler}, nil
+}
+
+// Submit submits a task-parameter to be processed
+func (s TaskSubmitter[T]) Submit(taskParam T, ctx context.Context) error {
+	return s.tp.Submit(typedTask[T]{param: taskParam, handler: s.handler}, ctx)
+}
+
+// SubmitAndWait submits a task-parameter to be processed, and waits for the result of its
+// handler
+func (s TaskSubmitter[T]) SubmitAndWait(taskParam T, ctx context.Context) error {
+	return s.tp.SubmitAndWait(typedTask[T]{param: taskParam, handler: s.handler}, ctx)
+}
+
+// SubmitBatch submits task-parameters to be processed with a single channel operation
+func (s TaskSubmitter[T]) SubmitBatch(taskParams []T, atomic bool, ctx context.Context) error {
+	batch := make([]interface{}, len(taskParams))
+	for idx, taskParam := range taskParams {
+		batch[idx] = typedTask[T]{param: taskParam, handler: s.handler}
+	}
+	return s.tp.SubmitBatch(batch, atomic, ctx)
+}
+
+// runnableTask a task-parameter carrying its own handler
+type runnableTask interface {
+	// run call the handler with the task-parameter
+	run() error
+	// taskParam returns the task-parameter
+	taskParam() interface{}
+}
+
+// typedTask a task-parameter submitted through a TaskSubmitter
+type typedTask[T any] struct {
+	param   T
+	handler func(taskParam T) error
+}
+
+// run call the handler with the task-parameter
+func (t typedTask[T]) run() error {
+	return t.handler(t.param)
+}
+
+// taskParam returns the task-parameter
+func (t typedTask[T]) taskParam() interface{} {
+	return t.param
+}
+
 // taskProcessorImpl implements TaskProcessor which uses only one daemon thread
 type taskProcessorImpl struct {
 	Component
@@ -56,6 +144,9 @@ type taskProcessorImpl struct {
 	contextCancel    context.CancelFunc
 	newTasks         chan interface{}
 	executionMap     map[reflect.Type]TaskHandler
+	panicHandler     TaskPanicHandler
+	// route if set, is given every task-parameter in place of the execution map
+	route TaskHandler
 }
 
 // GetNewTaskProcessorInstance get instance of taskProcessorImpl
@@ -94,6 +185,54 @@ func (p *taskProcessorImpl) Submit(newTaskParam interface{}, ctx context.Context
 	}
 }
 
+// SubmitAndWait submits a task to be processed, and waits for the result of its handler
+func (p *taskProcessorImpl) SubmitAndWait(newTaskParam interface{}, ctx context.Context) error {
+	return submitAndWait(p, newTaskParam, ctx, p.operationContext)
+}
+
+// SubmitBatch submits task-parameters to be processed with a single channel operation
+func (p *taskProcessorImpl) SubmitBatch(
+	newTaskParams []interface{}, atomic bool, ctx context.Context,
+) error {
+	if len(newTaskParams) == 0 {
+		return nil
+	}
+	return p.Submit(taskBatch{params: newTaskParams, atomic: atomic}, ctx)
+}
+
+// taskBatch task-parameters submitted with SubmitBatch
+type taskBatch struct {
+	params []interface{}
+	atomic bool
+}
+
+// waitedTask a task-parameter submitted with SubmitAndWait, and where to report the result
+// of its handler
+type waitedTask struct {
+	param  interface{}
+	result chan error
+}
+
+// submitAndWait helper function to submit a task-parameter to tp, and wait for the result
+// of its handler. Waiting ends early if either ctx or operationContext is done.
+func submitAndWait(
+	tp TaskProcessor, newTaskParam interface{}, ctx, operationContext context.Context,
+) error {
+	// Buffered, so the event loop never blocks reporting to a caller no longer waiting
+	task := &waitedTask{param: newTaskParam, result: make(chan error, 1)}
+	if err := tp.Submit(task, ctx); err != nil {
+		return err
+	}
+	select {
+	case err := <-task.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-operationContext.Done():
+		return operationContext.Err()
+	}
+}
+
 // SetTaskExecutionMap update the mapping between task-parameter object and it associated
 // handler function.
 //
@@ -113,8 +252,64 @@ func (p *taskProcessorImpl) AddToTaskExecutionMap(theType reflect.Type, handler
 	return nil
 }
 
-// StartEventLoop starts the daemon thread for processing the submitted task-parameters
+// ProcessNewTaskParam execute a submitted task-parameter
 func (p *taskProcessorImpl) ProcessNewTaskParam(newTaskParam interface{}) error {
+	task, waited := newTaskParam.(*waitedTask)
+	if p.route != nil {
+		// Waited tasks are forwarded as is, for the processor forwarded to to report the result
+		err := p.route(newTaskParam)
+		if waited && err != nil {
+			task.result <- err
+		}
+		return err
+	}
+	if batch, ok := newTaskParam.(taskBatch); ok {
+		return p.processBatch(batch)
+	}
+	if !waited {
+		return p.processTaskParam(newTaskParam)
+	}
+	err := p.processTaskParam(task.param)
+	task.result <- err
+	return err
+}
+
+// processBatch execute the task-parameters of a batch in order
+func (p *taskProcessorImpl) processBatch(batch taskBatch) error {
+	var firstErr error
+	failed := 0
+	for _, newTaskParam := range batch.params {
+		if err := p.ProcessNewTaskParam(newTaskParam); err != nil {
+			log.WithError(err).WithFields(p.LogTags).Error("Failed to process batched task param")
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf(
+			"[TP %s] %d of %d batched tasks failed, first: %w",
+			p.name,
+			failed,
+			len(batch.params),
+			firstErr,
+		)
+	}
+	return nil
+}
+
+// processTaskParam execute a task-parameter with its associated handler. A panic of the
+// handler is recovered, and returned as an error.
+func (p *taskProcessorImpl) processTaskParam(newTaskParam interface{}) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = p.handlePanic(newTaskParam, recovered)
+		}
+	}()
+	if task, ok := newTaskParam.(runnableTask); ok {
+		return task.run()
+	}
 	if p.executionMap != nil && len(p.executionMap) > 0 {
 		log.WithFields(p.LogTags).Debugf("Processing new %s", reflect.TypeOf(newTaskParam))
 		// Process task based on the parameter type
@@ -128,6 +323,28 @@ func (p *taskProcessorImpl) ProcessNewTaskParam(newTaskParam interface{}) error
 	return fmt.Errorf("[TP %s] No task execution mapping set", p.name)
 }
 
+// handlePanic record a panic recovered from the handler of a task-parameter
+func (p *taskProcessorImpl) handlePanic(newTaskParam interface{}, recovered interface{}) error {
+	atomic.AddUint64(&taskPanics, 1)
+	if task, ok := newTaskParam.(runnableTask); ok {
+		newTaskParam = task.taskParam()
+	}
+	err := fmt.Errorf(
+		"[TP %s] Handler for %s panicked: %v", p.name, reflect.TypeOf(newTaskParam), recovered,
+	)
+	log.WithError(err).WithFields(p.LogTags).Errorf("Recovered from panic\n%s", debug.Stack())
+	if p.panicHandler != nil {
+		p.panicHandler(newTaskParam, recovered)
+	}
+	return err
+}
+
+// SetPanicHandler set the callback notified of each panic recovered from a task handler
+func (p *taskProcessorImpl) SetPanicHandler(handler TaskPanicHandler) error {
+	p.panicHandler = handler
+	return nil
+}
+
 // StartEventLoop starts the daemon thread for processing the submitted task-parameters
 func (p *taskProcessorImpl) StartEventLoop(wg *sync.WaitGroup) error {
 	log.WithFields(p.LogTags).Info("Starting event loop")
@@ -210,7 +427,7 @@ func GetNewTaskDemuxProcessorInstance(
 			v.UpdateLogTags(logTags)
 		}
 	}
-	return &taskDemuxProcessorImpl{
+	instance := &taskDemuxProcessorImpl{
 		name:             name,
 		input:            inputTP,
 		workers:          workers,
@@ -218,7 +435,10 @@ func GetNewTaskDemuxProcessorInstance(
 		operationContext: optCtxt,
 		contextCancel:    cancel,
 		Component:        Component{LogTags: logTags},
-	}, nil
+	}
+	// The input routes every task-parameter to the workers
+	inputTP.(*taskProcessorImpl).route = instance.ProcessNewTaskParam
+	return instance, nil
 }
 
 // Submit submits a task-parameter to be processed
@@ -226,8 +446,25 @@ func (p *taskDemuxProcessorImpl) Submit(newTaskParam interface{}, ctx context.Co
 	return p.input.Submit(newTaskParam, ctx)
 }
 
+// SubmitBatch submits task-parameters to be processed with a single channel operation. If
+// not atomic, the task-parameters are spread across the workers.
+func (p *taskDemuxProcessorImpl) SubmitBatch(
+	newTaskParams []interface{}, atomic bool, ctx context.Context,
+) error {
+	return p.input.SubmitBatch(newTaskParams, atomic, ctx)
+}
+
+// SubmitAndWait submits a task-parameter to be processed, and waits for the result of its
+// handler
+func (p *taskDemuxProcessorImpl) SubmitAndWait(newTaskParam interface{}, ctx context.Context) error {
+	return submitAndWait(p.input, newTaskParam, ctx, p.operationContext)
+}
+
 // ProcessNewTaskParam execute a submitted task-parameter
 func (p *taskDemuxProcessorImpl) ProcessNewTaskParam(newTaskParam interface{}) error {
+	if batch, ok := newTaskParam.(taskBatch); ok && !batch.atomic && len(p.workers) > 1 {
+		return p.spreadBatch(batch)
+	}
 	if p.workers != nil && len(p.workers) > 0 {
 		log.WithFields(p.LogTags).Debugf("Processing new %s", reflect.TypeOf(newTaskParam))
 		defer func() { p.routeIdx = (p.routeIdx + 1) % len(p.workers) }()
@@ -236,6 +473,21 @@ func (p *taskDemuxProcessorImpl) ProcessNewTaskParam(newTaskParam interface{}) e
 	return fmt.Errorf("[TDP %s] No workers defined", p.name)
 }
 
+// spreadBatch split a batch across the workers, with one batch per worker
+func (p *taskDemuxProcessorImpl) spreadBatch(batch taskBatch) error {
+	perWorker := make([][]interface{}, len(p.workers))
+	for _, newTaskParam := range batch.params {
+		perWorker[p.routeIdx] = append(perWorker[p.routeIdx], newTaskParam)
+		p.routeIdx = (p.routeIdx + 1) % len(p.workers)
+	}
+	for idx, params := range perWorker {
+		if err := p.workers[idx].SubmitBatch(params, true, p.operationContext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // SetTaskExecutionMap update the mapping between task-parameter object and its associated
 // handler function.
 //
@@ -246,12 +498,7 @@ func (p *taskDemuxProcessorImpl) SetTaskExecutionMap(newMap map[reflect.Type]Tas
 	for _, worker := range p.workers {
 		_ = worker.SetTaskExecutionMap(newMap)
 	}
-	// Create a different version of the input to route to worker
-	inputMap := map[reflect.Type]TaskHandler{}
-	for msgType := range newMap {
-		inputMap[msgType] = p.ProcessNewTaskParam
-	}
-	return p.input.SetTaskExecutionMap(inputMap)
+	return nil
 }
 
 // AddToTaskExecutionMap add new (task-parameter, handler function) mapping to the existing set.
@@ -261,8 +508,15 @@ func (p *taskDemuxProcessorImpl) AddToTaskExecutionMap(
 	for _, worker := range p.workers {
 		_ = worker.AddToTaskExecutionMap(theType, handler)
 	}
-	// Do the same for input
-	return p.input.AddToTaskExecutionMap(theType, p.ProcessNewTaskParam)
+	return nil
+}
+
+// SetPanicHandler set the callback notified of each panic recovered from a task handler
+func (p *taskDemuxProcessorImpl) SetPanicHandler(handler TaskPanicHandler) error {
+	for _, worker := range p.workers {
+		_ = worker.SetPanicHandler(handler)
+	}
+	return p.input.SetPanicHandler(handler)
 }
 
 // StartEventLoop starts the daemon thread for processing the submitted task-parameters
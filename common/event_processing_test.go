@@ -175,3 +175,412 @@ func TestTaskDemuxProcessing(t *testing.T) {
 		assert.Equal(1, uutc.routeIdx)
 	}
 }
+
+func TestTaskSubmitAndWait(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type okTask struct{}
+	type errTask struct{}
+	type panicTask struct{}
+	type blockTask struct{}
+
+	release := make(chan bool)
+	executorMap := map[reflect.Type]TaskHandler{
+		reflect.TypeOf(okTask{}):    func(p interface{}) error { return nil },
+		reflect.TypeOf(errTask{}):   func(p interface{}) error { return fmt.Errorf("Dummy error") },
+		reflect.TypeOf(panicTask{}): func(p interface{}) error { panic("Dummy panic") },
+		reflect.TypeOf(blockTask{}): func(p interface{}) error {
+			<-release
+			return nil
+		},
+	}
+
+	single, err := GetNewTaskProcessorInstance("testing", 4, ctxt)
+	assert.Nil(err)
+	demux, err := GetNewTaskDemuxProcessorInstance("testing", 4, 2, time.Second, ctxt)
+	assert.Nil(err)
+
+	for _, uut := range []TaskProcessor{single, demux} {
+		assert.Nil(uut.SetTaskExecutionMap(executorMap))
+		assert.Nil(uut.StartEventLoop(&wg))
+
+		// Case 1: the result of the handler is returned
+		{
+			useContext, cancel := context.WithTimeout(ctxt, time.Second)
+			assert.Nil(uut.SubmitAndWait(okTask{}, useContext))
+			assert.EqualError(uut.SubmitAndWait(errTask{}, useContext), "Dummy error")
+			cancel()
+		}
+
+		// Case 2: a panic in the handler is returned, and the event loop keeps running
+		{
+			useContext, cancel := context.WithTimeout(ctxt, time.Second)
+			err := uut.SubmitAndWait(panicTask{}, useContext)
+			assert.NotNil(err)
+			assert.Contains(err.Error(), "Dummy panic")
+			assert.Nil(uut.SubmitAndWait(okTask{}, useContext))
+			cancel()
+		}
+
+		// Case 3: a task without handler fails
+		{
+			useContext, cancel := context.WithTimeout(ctxt, time.Second)
+			assert.NotNil(uut.SubmitAndWait("hello", useContext))
+			cancel()
+		}
+
+		// Case 4: waiting stops once the context is done
+		{
+			useContext, cancel := context.WithTimeout(ctxt, time.Millisecond*50)
+			assert.Equal(context.DeadlineExceeded, uut.SubmitAndWait(blockTask{}, useContext))
+			cancel()
+			// The event loop is not blocked by the abandoned result
+			release <- true
+			useContext, cancel = context.WithTimeout(ctxt, time.Second)
+			assert.Nil(uut.SubmitAndWait(okTask{}, useContext))
+			cancel()
+		}
+
+		assert.Nil(uut.StopEventLoop())
+	}
+}
+
+func TestTaskPanicRecovery(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type panicTask struct{}
+	type okTask struct{}
+
+	processed := make(chan bool, 1)
+	executorMap := map[reflect.Type]TaskHandler{
+		reflect.TypeOf(panicTask{}): func(p interface{}) error { panic("Dummy panic") },
+		reflect.TypeOf(okTask{}): func(p interface{}) error {
+			processed <- true
+			return nil
+		},
+	}
+
+	single, err := GetNewTaskProcessorInstance("testing", 4, ctxt)
+	assert.Nil(err)
+	demux, err := GetNewTaskDemuxProcessorInstance("testing", 4, 2, time.Second, ctxt)
+	assert.Nil(err)
+
+	for _, uut := range []TaskProcessor{single, demux} {
+		panics := make(chan interface{}, 1)
+		assert.Nil(uut.SetTaskExecutionMap(executorMap))
+		assert.Nil(uut.SetPanicHandler(func(taskParam interface{}, recovered interface{}) {
+			assert.Equal(panicTask{}, taskParam)
+			panics <- recovered
+		}))
+		assert.Nil(uut.StartEventLoop(&wg))
+
+		// Case 1: a panic in a handler is recovered, and the event loop keeps running
+		{
+			before := TaskPanics()
+			useContext, cancel := context.WithTimeout(ctxt, time.Second)
+			assert.Nil(uut.Submit(panicTask{}, useContext))
+			select {
+			case recovered := <-panics:
+				assert.Equal("Dummy panic", recovered)
+			case <-useContext.Done():
+				assert.Fail("panic not reported")
+			}
+			assert.Equal(before+1, TaskPanics())
+			assert.Nil(uut.Submit(okTask{}, useContext))
+			select {
+			case <-processed:
+			case <-useContext.Done():
+				assert.Fail("event loop stopped")
+			}
+			cancel()
+		}
+
+		assert.Nil(uut.StopEventLoop())
+	}
+}
+
+func TestTaskSubmitter(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type testTask struct {
+		value int
+	}
+
+	single, err := GetNewTaskProcessorInstance("testing", 4, ctxt)
+	assert.Nil(err)
+	demux, err := GetNewTaskDemuxProcessorInstance("testing", 4, 2, time.Second, ctxt)
+	assert.Nil(err)
+
+	// Case 0: a handler is required
+	{
+		_, err := RegisterTaskHandler[testTask](single, nil)
+		assert.NotNil(err)
+	}
+
+	for _, uut := range []TaskProcessor{single, demux} {
+		processed := make(chan int, 1)
+		panics := make(chan interface{}, 1)
+		submitter, err := RegisterTaskHandler(uut, func(task testTask) error {
+			if task.value < 0 {
+				panic("Dummy panic")
+			}
+			if task.value == 0 {
+				return fmt.Errorf("Dummy error")
+			}
+			processed <- task.value
+			return nil
+		})
+		assert.Nil(err)
+		assert.Nil(uut.SetPanicHandler(func(taskParam interface{}, recovered interface{}) {
+			panics <- taskParam
+		}))
+		assert.Nil(uut.StartEventLoop(&wg))
+
+		// Case 1: submitted tasks are processed without an execution map
+		{
+			useContext, cancel := context.WithTimeout(ctxt, time.Second)
+			assert.Nil(submitter.Submit(testTask{value: 1}, useContext))
+			select {
+			case value := <-processed:
+				assert.Equal(1, value)
+			case <-useContext.Done():
+				assert.Fail("task not processed")
+			}
+			cancel()
+		}
+
+		// Case 2: the result of the handler is returned
+		{
+			useContext, cancel := context.WithTimeout(ctxt, time.Second)
+			assert.Nil(submitter.SubmitAndWait(testTask{value: 2}, useContext))
+			assert.Equal(2, <-processed)
+			assert.EqualError(submitter.SubmitAndWait(testTask{}, useContext), "Dummy error")
+			cancel()
+		}
+
+		// Case 3: a panic reports the task-parameter
+		{
+			useContext, cancel := context.WithTimeout(ctxt, time.Second)
+			assert.NotNil(submitter.SubmitAndWait(testTask{value: -1}, useContext))
+			assert.Equal(testTask{value: -1}, <-panics)
+			cancel()
+		}
+
+		assert.Nil(uut.StopEventLoop())
+	}
+}
+
+func TestTaskSubmitBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type testTask struct {
+		value int
+	}
+
+	// Case 1: a batch is processed in order, and failures are reported together
+	{
+		uut, err := GetNewTaskProcessorInstance("testing", 4, ctxt)
+		assert.Nil(err)
+		processed := make(chan int, 8)
+		submitter, err := RegisterTaskHandler(uut, func(task testTask) error {
+			processed <- task.value
+			if task.value%2 == 0 {
+				return fmt.Errorf("Dummy error %d", task.value)
+			}
+			return nil
+		})
+		assert.Nil(err)
+
+		tasks := []testTask{{value: 1}, {value: 2}, {value: 3}, {value: 4}}
+		batch := make([]interface{}, len(tasks))
+		for idx, task := range tasks {
+			batch[idx] = typedTask[testTask]{param: task, handler: submitter.handler}
+		}
+		err = uut.ProcessNewTaskParam(taskBatch{params: batch, atomic: true})
+		assert.NotNil(err)
+		assert.Contains(err.Error(), "2 of 4 batched tasks failed")
+		assert.Contains(err.Error(), "Dummy error 2")
+		for _, expected := range []int{1, 2, 3, 4} {
+			assert.Equal(expected, <-processed)
+		}
+
+		// An empty batch is not submitted
+		assert.Nil(submitter.SubmitBatch(nil, true, ctxt))
+		assert.Equal(0, len(uut.(*taskProcessorImpl).newTasks))
+		assert.Nil(uut.StopEventLoop())
+	}
+
+	// Case 2: a demux processor spreads a batch across workers, unless atomic
+	{
+		uut, err := GetNewTaskDemuxProcessorInstance("testing", 4, 2, time.Second, ctxt)
+		assert.Nil(err)
+		testWG := sync.WaitGroup{}
+		submitter, err := RegisterTaskHandler(uut, func(task testTask) error {
+			testWG.Done()
+			return nil
+		})
+		assert.Nil(err)
+		assert.Nil(uut.StartEventLoop(&wg))
+
+		uutc := uut.(*taskDemuxProcessorImpl)
+		useContext, cancel := context.WithTimeout(ctxt, time.Second)
+		testWG.Add(4)
+		assert.Nil(submitter.SubmitBatch(
+			[]testTask{{value: 0}, {value: 1}, {value: 2}, {value: 3}}, false, useContext,
+		))
+		testWG.Wait()
+		// Each task advanced the route
+		assert.Equal(0, uutc.routeIdx)
+
+		testWG.Add(3)
+		assert.Nil(submitter.SubmitBatch(
+			[]testTask{{value: 0}, {value: 1}, {value: 2}}, true, useContext,
+		))
+		testWG.Wait()
+		// The whole batch went to one worker
+		assert.Equal(1, uutc.routeIdx)
+		cancel()
+		assert.Nil(uut.StopEventLoop())
+	}
+}
+
+func BenchmarkTaskProcessor(b *testing.B) {
+	log.SetLevel(log.ErrorLevel)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uut, err := GetNewTaskProcessorInstance("benchmark", 64, ctxt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = uut.StopEventLoop()
+	}()
+
+	type benchTask struct{}
+	done := make(chan bool, 1)
+	processed := 0
+	if err := uut.AddToTaskExecutionMap(reflect.TypeOf(benchTask{}), func(p interface{}) error {
+		processed++
+		if processed == b.N {
+			done <- true
+		}
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+	if err := uut.StartEventLoop(&wg); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for itr := 0; itr < b.N; itr++ {
+		if err := uut.Submit(benchTask{}, ctxt); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkTaskSubmitter(b *testing.B) {
+	log.SetLevel(log.ErrorLevel)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uut, err := GetNewTaskProcessorInstance("benchmark", 64, ctxt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = uut.StopEventLoop()
+	}()
+
+	type benchTask struct{}
+	done := make(chan bool, 1)
+	processed := 0
+	submitter, err := RegisterTaskHandler(uut, func(benchTask) error {
+		processed++
+		if processed == b.N {
+			done <- true
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := uut.StartEventLoop(&wg); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for itr := 0; itr < b.N; itr++ {
+		if err := submitter.Submit(benchTask{}, ctxt); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkTaskDemuxProcessor(b *testing.B) {
+	log.SetLevel(log.ErrorLevel)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uut, err := GetNewTaskDemuxProcessorInstance("benchmark", 64, 4, time.Second, ctxt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = uut.StopEventLoop()
+	}()
+
+	type benchTask struct{}
+	processed := sync.WaitGroup{}
+	processed.Add(b.N)
+	if err := uut.AddToTaskExecutionMap(reflect.TypeOf(benchTask{}), func(p interface{}) error {
+		processed.Done()
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+	if err := uut.StartEventLoop(&wg); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for itr := 0; itr < b.N; itr++ {
+		if err := uut.Submit(benchTask{}, ctxt); err != nil {
+			b.Fatal(err)
+		}
+	}
+	processed.Wait()
+}
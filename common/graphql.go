@@ -0,0 +1,620 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GraphQLVariable is a reference to an operation variable within a GraphQL argument
+type GraphQLVariable string
+
+// GraphQLField is a field selected by a GraphQL operation
+type GraphQLField struct {
+	// Alias is the key of the field in the response, if not its name
+	Alias string
+	// Name is the field name
+	Name string
+	// Arguments are the field arguments. References to variables are GraphQLVariable.
+	Arguments map[string]interface{}
+	// Selections are the fields selected of an object field
+	Selections []GraphQLField
+}
+
+// ResponseKey is the key of the field in the response
+func (f GraphQLField) ResponseKey() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// GraphQLOperation is an operation of a GraphQL document
+type GraphQLOperation struct {
+	// Type is one of query, mutation, or subscription
+	Type string
+	// Name is the operation name, which may be empty
+	Name string
+	// Defaults are the default values of the operation variables
+	Defaults map[string]interface{}
+	// Selections are the root fields selected
+	Selections []GraphQLField
+}
+
+// SelectGraphQLOperation pick the operation named name from the operations of a document.
+// name can be empty if the document has only one operation.
+func SelectGraphQLOperation(ops []GraphQLOperation, name string) (GraphQLOperation, error) {
+	if name == "" {
+		if len(ops) != 1 {
+			return GraphQLOperation{}, fmt.Errorf("operation name required")
+		}
+		return ops[0], nil
+	}
+	for _, op := range ops {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return GraphQLOperation{}, fmt.Errorf("unknown operation %s", name)
+}
+
+// ==============================================================================
+// Parsing
+
+// graphQLPunctuators are the single character punctuators of GraphQL
+const graphQLPunctuators = "!$():=@[]{}|"
+
+// graphQLToken is a lexical token of a GraphQL document
+type graphQLToken struct {
+	// kind is one of punct, name, int, float, or string
+	kind  string
+	value string
+}
+
+// lexGraphQL split a GraphQL document into tokens
+func lexGraphQL(document string) ([]graphQLToken, error) {
+	tokens := []graphQLToken{}
+	src := []rune(document)
+	isNameStart := func(c rune) bool {
+		return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+	isDigit := func(c rune) bool { return c >= '0' && c <= '9' }
+	for idx := 0; idx < len(src); {
+		c := src[idx]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' || c == '\uFEFF':
+			idx++
+		case c == '#':
+			for idx < len(src) && src[idx] != '\n' && src[idx] != '\r' {
+				idx++
+			}
+		case c == '.':
+			if idx+2 >= len(src) || src[idx+1] != '.' || src[idx+2] != '.' {
+				return nil, fmt.Errorf("unexpected character '.'")
+			}
+			tokens = append(tokens, graphQLToken{kind: "punct", value: "..."})
+			idx += 3
+		case strings.ContainsRune(graphQLPunctuators, c):
+			tokens = append(tokens, graphQLToken{kind: "punct", value: string(c)})
+			idx++
+		case isNameStart(c):
+			start := idx
+			for idx < len(src) && (isNameStart(src[idx]) || isDigit(src[idx])) {
+				idx++
+			}
+			tokens = append(tokens, graphQLToken{kind: "name", value: string(src[start:idx])})
+		case c == '-' || isDigit(c):
+			start := idx
+			kind := "int"
+			if c == '-' {
+				idx++
+			}
+			for idx < len(src) && isDigit(src[idx]) {
+				idx++
+			}
+			if idx < len(src) && src[idx] == '.' {
+				kind = "float"
+				for idx++; idx < len(src) && isDigit(src[idx]); idx++ {
+				}
+			}
+			if idx < len(src) && (src[idx] == 'e' || src[idx] == 'E') {
+				kind = "float"
+				idx++
+				if idx < len(src) && (src[idx] == '+' || src[idx] == '-') {
+					idx++
+				}
+				for idx < len(src) && isDigit(src[idx]) {
+					idx++
+				}
+			}
+			tokens = append(tokens, graphQLToken{kind: kind, value: string(src[start:idx])})
+		case c == '"':
+			if idx+2 < len(src) && src[idx+1] == '"' && src[idx+2] == '"' {
+				return nil, fmt.Errorf("block strings are not supported")
+			}
+			start := idx
+			for idx++; idx < len(src) && src[idx] != '"'; idx++ {
+				if src[idx] == '\\' {
+					idx++
+				} else if src[idx] == '\n' || src[idx] == '\r' {
+					return nil, fmt.Errorf("unterminated string")
+				}
+			}
+			if idx >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			idx++
+			value, err := strconv.Unquote(string(src[start:idx]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %w", string(src[start:idx]), err)
+			}
+			tokens = append(tokens, graphQLToken{kind: "string", value: value})
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// graphQLParser parses the tokens of a GraphQL document
+type graphQLParser struct {
+	tokens []graphQLToken
+	pos    int
+}
+
+// peek whether the next token is the punctuator or name given
+func (p *graphQLParser) peek(value string) bool {
+	return p.pos < len(p.tokens) &&
+		p.tokens[p.pos].value == value &&
+		(p.tokens[p.pos].kind == "punct" || p.tokens[p.pos].kind == "name")
+}
+
+// next consume the next token
+func (p *graphQLParser) next() (graphQLToken, error) {
+	if p.pos >= len(p.tokens) {
+		return graphQLToken{}, fmt.Errorf("unexpected end of document")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+// expect consume the next token, which must be the punctuator given
+func (p *graphQLParser) expect(value string) error {
+	token, err := p.next()
+	if err != nil {
+		return err
+	}
+	if token.kind != "punct" || token.value != value {
+		return fmt.Errorf("expected %s, found %s", value, token.value)
+	}
+	return nil
+}
+
+// name consume the next token, which must be a name
+func (p *graphQLParser) name() (string, error) {
+	token, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if token.kind != "name" {
+		return "", fmt.Errorf("expected a name, found %s", token.value)
+	}
+	return token.value, nil
+}
+
+// ParseGraphQL parse the operations of a GraphQL document. Fragments and directives are not
+// supported.
+func ParseGraphQL(document string) ([]GraphQLOperation, error) {
+	tokens, err := lexGraphQL(document)
+	if err != nil {
+		return nil, err
+	}
+	p := &graphQLParser{tokens: tokens}
+	ops := []GraphQLOperation{}
+	for p.pos < len(p.tokens) {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("document has no operation")
+	}
+	return ops, nil
+}
+
+// operation parse an operation definition
+func (p *graphQLParser) operation() (GraphQLOperation, error) {
+	op := GraphQLOperation{Type: "query", Defaults: map[string]interface{}{}}
+	if !p.peek("{") {
+		opType, err := p.name()
+		if err != nil {
+			return op, err
+		}
+		switch opType {
+		case "query", "mutation", "subscription":
+			op.Type = opType
+		case "fragment":
+			return op, fmt.Errorf("fragments are not supported")
+		default:
+			return op, fmt.Errorf("unknown operation type %s", opType)
+		}
+		if !p.peek("{") && !p.peek("(") && !p.peek("@") {
+			if op.Name, err = p.name(); err != nil {
+				return op, err
+			}
+		}
+		if p.peek("(") {
+			if err := p.variableDefinitions(op.Defaults); err != nil {
+				return op, err
+			}
+		}
+		if p.peek("@") {
+			return op, fmt.Errorf("directives are not supported")
+		}
+	}
+	var err error
+	op.Selections, err = p.selectionSet()
+	return op, err
+}
+
+// variableDefinitions parse the variable definitions of an operation, recording the
+// default values
+func (p *graphQLParser) variableDefinitions(defaults map[string]interface{}) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.peek(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if p.peek("=") {
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return err
+			}
+			defaults[name] = value
+		}
+	}
+	return p.expect(")")
+}
+
+// typeRef parse a type reference. Types are not checked.
+func (p *graphQLParser) typeRef() error {
+	if p.peek("[") {
+		p.pos++
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peek("!") {
+		p.pos++
+	}
+	return nil
+}
+
+// selectionSet parse a selection set
+func (p *graphQLParser) selectionSet() ([]GraphQLField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	fields := []GraphQLField{}
+	for !p.peek("}") {
+		if p.peek("...") {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	p.pos++
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return fields, nil
+}
+
+// field parse a field selection
+func (p *graphQLParser) field() (GraphQLField, error) {
+	field := GraphQLField{}
+	name, err := p.name()
+	if err != nil {
+		return field, err
+	}
+	field.Name = name
+	if p.peek(":") {
+		p.pos++
+		field.Alias = name
+		if field.Name, err = p.name(); err != nil {
+			return field, err
+		}
+	}
+	if p.peek("(") {
+		p.pos++
+		field.Arguments = map[string]interface{}{}
+		for !p.peek(")") {
+			argName, err := p.name()
+			if err != nil {
+				return field, err
+			}
+			if err := p.expect(":"); err != nil {
+				return field, err
+			}
+			if field.Arguments[argName], err = p.value(); err != nil {
+				return field, err
+			}
+		}
+		p.pos++
+	}
+	if p.peek("@") {
+		return field, fmt.Errorf("directives are not supported")
+	}
+	if p.peek("{") {
+		if field.Selections, err = p.selectionSet(); err != nil {
+			return field, err
+		}
+	}
+	return field, nil
+}
+
+// value parse an argument value
+func (p *graphQLParser) value() (interface{}, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch token.kind {
+	case "int":
+		return strconv.ParseInt(token.value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(token.value, 64)
+	case "string":
+		return token.value, nil
+	case "name":
+		switch token.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// Enum values are passed as strings
+		return token.value, nil
+	}
+	switch token.value {
+	case "$":
+		name, err := p.name()
+		return GraphQLVariable(name), err
+	case "[":
+		list := []interface{}{}
+		for !p.peek("]") {
+			item, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		p.pos++
+		return list, nil
+	case "{":
+		object := map[string]interface{}{}
+		for !p.peek("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+		return object, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", token.value)
+}
+
+// ==============================================================================
+// Execution
+
+// GraphQLFieldFunc resolves a field of a GraphQLObject given the field arguments, only
+// when the field is selected
+type GraphQLFieldFunc func(args map[string]interface{}) (interface{}, error)
+
+// GraphQLObject is a GraphQL object to resolve selections on
+type GraphQLObject struct {
+	// TypeName is the name of the object type
+	TypeName string
+	// Fields are the values of the object fields, by field name. A field is either a value,
+	// or a GraphQLFieldFunc. A value is either a GraphQLObject, a list of them, or a leaf
+	// value which is serialized as JSON.
+	Fields map[string]interface{}
+}
+
+// graphQLResultEntry is a field of a GraphQLResult
+type graphQLResultEntry struct {
+	key   string
+	value interface{}
+}
+
+// GraphQLResult is a resolved GraphQL object, which keeps the order of the selections when
+// serialized as JSON
+type GraphQLResult []graphQLResultEntry
+
+// MarshalJSON serialize the result as a JSON object
+func (r GraphQLResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for idx, entry := range r {
+		if idx > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(entry.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// graphQLExecution is the execution of an operation
+type graphQLExecution struct {
+	op        GraphQLOperation
+	variables map[string]interface{}
+}
+
+// ExecuteGraphQL resolve the selections of an operation on the root object, given the
+// values of the operation variables
+func ExecuteGraphQL(
+	op GraphQLOperation, root GraphQLObject, variables map[string]interface{},
+) (GraphQLResult, error) {
+	exec := graphQLExecution{op: op, variables: variables}
+	return exec.selections(op.Selections, root)
+}
+
+// selections resolve selections on an object
+func (e graphQLExecution) selections(
+	fields []GraphQLField, object GraphQLObject,
+) (GraphQLResult, error) {
+	result := GraphQLResult{}
+	for _, field := range fields {
+		if field.Name == "__typename" {
+			result = append(
+				result, graphQLResultEntry{key: field.ResponseKey(), value: object.TypeName},
+			)
+			continue
+		}
+		value, ok := object.Fields[field.Name]
+		if !ok {
+			return nil, fmt.Errorf("cannot query field %s on type %s", field.Name, object.TypeName)
+		}
+		if resolve, ok := value.(GraphQLFieldFunc); ok {
+			var err error
+			if value, err = resolve(e.op.FieldArguments(field, e.variables)); err != nil {
+				return nil, fmt.Errorf("%s: %w", field.ResponseKey(), err)
+			}
+		} else if len(field.Arguments) > 0 {
+			return nil, fmt.Errorf("field %s of type %s takes no arguments", field.Name, object.TypeName)
+		}
+		completed, err := e.complete(field, value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, graphQLResultEntry{key: field.ResponseKey(), value: completed})
+	}
+	return result, nil
+}
+
+// complete resolve the selections of a field on its value
+func (e graphQLExecution) complete(field GraphQLField, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case GraphQLObject:
+		if len(field.Selections) == 0 {
+			return nil, fmt.Errorf(
+				"field %s of type %s must have a selection of subfields", field.Name, v.TypeName,
+			)
+		}
+		return e.selections(field.Selections, v)
+	case *GraphQLObject:
+		if v == nil {
+			return nil, nil
+		}
+		return e.complete(field, *v)
+	case []GraphQLObject:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			completed, err := e.complete(field, item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, completed)
+		}
+		return list, nil
+	}
+	if len(field.Selections) > 0 && value != nil {
+		return nil, fmt.Errorf("field %s can not have a selection of subfields", field.Name)
+	}
+	return value, nil
+}
+
+// FieldArguments the arguments of a field of the operation, with the variables referenced
+// substituted by their values
+func (op GraphQLOperation) FieldArguments(
+	field GraphQLField, variables map[string]interface{},
+) map[string]interface{} {
+	args := make(map[string]interface{}, len(field.Arguments))
+	for name, arg := range field.Arguments {
+		args[name] = op.argument(arg, variables)
+	}
+	return args
+}
+
+// argument substitute the variables referenced in an argument value
+func (op GraphQLOperation) argument(value interface{}, variables map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case GraphQLVariable:
+		if variable, ok := variables[string(v)]; ok {
+			return variable
+		}
+		return op.Defaults[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for idx, item := range v {
+			list[idx] = op.argument(item, variables)
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			object[name] = op.argument(item, variables)
+		}
+		return object
+	}
+	return value
+}
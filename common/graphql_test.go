@@ -0,0 +1,164 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid documents
+	for _, document := range []string{
+		"",
+		"{}",
+		"{ streams { name }",
+		"query { ...StreamFields }",
+		"fragment StreamFields on Stream { name }",
+		"{ streams @skip(if: true) { name } }",
+		`{ stream(name: "unterminated) { name } }`,
+		"{ stream(name: .) { name } }",
+	} {
+		_, err := ParseGraphQL(document)
+		assert.NotNil(err, document)
+	}
+
+	// Case 1: query shorthand
+	{
+		ops, err := ParseGraphQL("{ streams { name, subjects } }")
+		assert.Nil(err)
+		assert.Len(ops, 1)
+		assert.Equal("query", ops[0].Type)
+		assert.Equal("", ops[0].Name)
+		assert.Equal("streams", ops[0].Selections[0].Name)
+		assert.Equal(
+			[]GraphQLField{{Name: "name"}, {Name: "subjects"}}, ops[0].Selections[0].Selections,
+		)
+	}
+
+	// Case 2: named operations with variables, aliases, and arguments
+	{
+		ops, err := ParseGraphQL(`
+# Stream lookup
+query Lookup($name: String!, $limit: Int = 10, $tags: [String!]) {
+  orders: stream(name: $name, limit: $limit, tags: ["a", "b"], deep: {x: 1.5, y: null}) {
+    name
+  }
+}
+subscription Feed { messages(stream: "orders", enabled: true, order: ASC) { subject } }
+`)
+		assert.Nil(err)
+		assert.Len(ops, 2)
+		assert.Equal("Lookup", ops[0].Name)
+		assert.Equal(map[string]interface{}{"limit": int64(10)}, ops[0].Defaults)
+		field := ops[0].Selections[0]
+		assert.Equal("orders", field.Alias)
+		assert.Equal("stream", field.Name)
+		assert.Equal("orders", field.ResponseKey())
+		assert.Equal(map[string]interface{}{
+			"name":  GraphQLVariable("name"),
+			"limit": GraphQLVariable("limit"),
+			"tags":  []interface{}{"a", "b"},
+			"deep":  map[string]interface{}{"x": 1.5, "y": nil},
+		}, field.Arguments)
+		assert.Equal("subscription", ops[1].Type)
+		assert.Equal(map[string]interface{}{
+			"stream": "orders", "enabled": true, "order": "ASC",
+		}, ops[1].Selections[0].Arguments)
+
+		_, err = SelectGraphQLOperation(ops, "")
+		assert.NotNil(err)
+		_, err = SelectGraphQLOperation(ops, "Unknown")
+		assert.NotNil(err)
+		op, err := SelectGraphQLOperation(ops, "Feed")
+		assert.Nil(err)
+		assert.Equal("subscription", op.Type)
+	}
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	assert := assert.New(t)
+
+	streams := map[string]GraphQLObject{
+		"orders": {TypeName: "Stream", Fields: map[string]interface{}{
+			"name":     "orders",
+			"subjects": []string{"orders.*"},
+			"messages": 12,
+			"consumers": []GraphQLObject{
+				{TypeName: "Consumer", Fields: map[string]interface{}{"name": "billing"}},
+			},
+		}},
+	}
+	root := GraphQLObject{TypeName: "Query", Fields: map[string]interface{}{
+		"stream": GraphQLFieldFunc(func(args map[string]interface{}) (interface{}, error) {
+			name, _ := args["name"].(string)
+			if stream, ok := streams[name]; ok {
+				return stream, nil
+			}
+			return nil, fmt.Errorf("stream %s not found", name)
+		}),
+	}}
+	execute := func(document string, variables map[string]interface{}) (string, error) {
+		ops, err := ParseGraphQL(document)
+		assert.Nil(err)
+		op, err := SelectGraphQLOperation(ops, "")
+		assert.Nil(err)
+		result, err := ExecuteGraphQL(op, root, variables)
+		if err != nil {
+			return "", err
+		}
+		serialized, err := json.Marshal(result)
+		assert.Nil(err)
+		return string(serialized), nil
+	}
+
+	// Case 0: selections are resolved in order, with aliases and type names
+	{
+		result, err := execute(
+			`{ s: stream(name: "orders") { subjects, name, __typename, consumers { name } } }`, nil,
+		)
+		assert.Nil(err)
+		assert.Equal(
+			`{"s":{"subjects":["orders.*"],"name":"orders","__typename":"Stream","consumers":[{"name":"billing"}]}}`,
+			result,
+		)
+	}
+
+	// Case 1: variables, and their defaults
+	{
+		document := `query ($name: String = "orders") { stream(name: $name) { messages } }`
+		result, err := execute(document, nil)
+		assert.Nil(err)
+		assert.Equal(`{"stream":{"messages":12}}`, result)
+		_, err = execute(document, map[string]interface{}{"name": "audit"})
+		assert.NotNil(err)
+	}
+
+	// Case 2: invalid selections
+	for _, document := range []string{
+		`{ stream(name: "orders") { unknown } }`,
+		`{ stream(name: "orders") }`,
+		`{ stream(name: "orders") { name { first } } }`,
+		`{ stream(name: "orders") { name(full: true) } }`,
+	} {
+		_, err := execute(document, nil)
+		assert.NotNil(err, document)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// StdJSONCodecName is the name of the encoding/json based JSONCodec
+const StdJSONCodecName = "std"
+
+// JSONDecoder reads JSON values from a stream
+type JSONDecoder interface {
+	// Decode read the next JSON value from the stream into v
+	Decode(v interface{}) error
+}
+
+// JSONCodec is a JSON serialization engine. Implementations must produce and accept the same
+// documents as encoding/json, including honoring the struct field tags.
+type JSONCodec interface {
+	// Marshal encode v as JSON
+	Marshal(v interface{}) ([]byte, error)
+	// MarshalIndent encode v as indented JSON
+	MarshalIndent(v interface{}, prefix, indent string) ([]byte, error)
+	// Unmarshal decode the JSON in data into v
+	Unmarshal(data []byte, v interface{}) error
+	// NewDecoder define a decoder reading from r
+	NewDecoder(r io.Reader) JSONDecoder
+}
+
+// stdJSONCodec implements JSONCodec with encoding/json
+type stdJSONCodec struct{}
+
+// Marshal encode v as JSON
+func (stdJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// MarshalIndent encode v as indented JSON
+func (stdJSONCodec) MarshalIndent(v interface{}, prefix, indent string) ([]byte, error) {
+	return json.MarshalIndent(v, prefix, indent)
+}
+
+// Unmarshal decode the JSON in data into v
+func (stdJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// NewDecoder define a decoder reading from r
+func (stdJSONCodec) NewDecoder(r io.Reader) JSONDecoder {
+	return json.NewDecoder(r)
+}
+
+// jsonCodecHolder wraps the codec in use, as atomic.Value only stores one concrete type
+type jsonCodecHolder struct {
+	codec JSONCodec
+}
+
+// jsonCodecs the registered JSON codecs, and the one in use
+var jsonCodecs = struct {
+	lock    sync.Mutex
+	byName  map[string]JSONCodec
+	current atomic.Value
+}{byName: map[string]JSONCodec{StdJSONCodecName: stdJSONCodec{}}}
+
+func init() {
+	jsonCodecs.current.Store(jsonCodecHolder{codec: stdJSONCodec{}})
+}
+
+// RegisterJSONCodec registers a JSON codec under a unique name
+//
+// Alternative engines register themselves from the init() of a package compiled into the
+// binary, typically behind a build tag, or from a Go plugin. A package may also call
+// UseJSONCodec from its init() to make its engine the default of the build.
+func RegisterJSONCodec(name string, codec JSONCodec) error {
+	if codec == nil {
+		return fmt.Errorf("JSON codec %s is nil", name)
+	}
+	jsonCodecs.lock.Lock()
+	defer jsonCodecs.lock.Unlock()
+	if _, ok := jsonCodecs.byName[name]; ok {
+		return fmt.Errorf("JSON codec %s already registered", name)
+	}
+	jsonCodecs.byName[name] = codec
+	return nil
+}
+
+// UseJSONCodec select the registered JSON codec to use
+func UseJSONCodec(name string) error {
+	jsonCodecs.lock.Lock()
+	defer jsonCodecs.lock.Unlock()
+	codec, ok := jsonCodecs.byName[name]
+	if !ok {
+		return fmt.Errorf("JSON codec %s is not registered", name)
+	}
+	jsonCodecs.current.Store(jsonCodecHolder{codec: codec})
+	return nil
+}
+
+// RegisteredJSONCodecs returns the names of the registered JSON codecs
+func RegisteredJSONCodecs() []string {
+	jsonCodecs.lock.Lock()
+	defer jsonCodecs.lock.Unlock()
+	names := make([]string, 0, len(jsonCodecs.byName))
+	for name := range jsonCodecs.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JSON returns the JSON codec in use
+func JSON() JSONCodec {
+	return jsonCodecs.current.Load().(jsonCodecHolder).codec
+}
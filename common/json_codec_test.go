@@ -0,0 +1,74 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingJSONCodec wraps the standard codec, counting Marshal calls
+type countingJSONCodec struct {
+	stdJSONCodec
+	marshals int
+}
+
+func (c *countingJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	c.marshals++
+	return c.stdJSONCodec.Marshal(v)
+}
+
+func TestJSONCodec(t *testing.T) {
+	assert := assert.New(t)
+
+	type sample struct {
+		Name  string `json:"name"`
+		Count int    `json:"count,omitempty"`
+	}
+
+	// Case 0: the standard codec is in use by default
+	{
+		output, err := JSON().Marshal(sample{Name: "<a>"})
+		assert.Nil(err)
+		assert.Equal(`{"name":"\u003ca\u003e"}`, string(output))
+		var parsed sample
+		assert.Nil(JSON().NewDecoder(strings.NewReader(`{"name":"b","count":2}`)).Decode(&parsed))
+		assert.Equal(sample{Name: "b", Count: 2}, parsed)
+	}
+
+	// Case 1: invalid registrations
+	{
+		assert.NotNil(RegisterJSONCodec("nil", nil))
+		assert.NotNil(RegisterJSONCodec(StdJSONCodecName, stdJSONCodec{}))
+		assert.NotNil(UseJSONCodec("unknown"))
+	}
+
+	// Case 2: switch to an alternative codec, and back
+	{
+		alt := &countingJSONCodec{}
+		assert.Nil(RegisterJSONCodec("counting", alt))
+		assert.Equal([]string{"counting", StdJSONCodecName}, RegisteredJSONCodecs())
+		assert.Nil(UseJSONCodec("counting"))
+		_, err := JSON().Marshal(sample{Name: "c"})
+		assert.Nil(err)
+		assert.Equal(1, alt.marshals)
+		assert.Nil(UseJSONCodec(StdJSONCodecName))
+		_, err = JSON().Marshal(sample{Name: "c"})
+		assert.Nil(err)
+		assert.Equal(1, alt.marshals)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+)
+
+// LogKeySize is the size of the keys encrypting logs, for AES-256
+const LogKeySize = 32
+
+// EncryptedLogSuffix is the file name suffix of encrypted log files
+const EncryptedLogSuffix = ".log.enc"
+
+// ErrUnknownTenantKey is reported when a key provider has no key for a tenant
+var ErrUnknownTenantKey = errors.New("no key for tenant")
+
+// KeyProvider resolves the keys encrypting the data of each tenant
+type KeyProvider interface {
+	// Key resolves the LogKeySize byte key of a tenant. Returns ErrUnknownTenantKey if the
+	// provider has no key for the tenant.
+	Key(tenant string, ctxt context.Context) ([]byte, error)
+}
+
+// fileKeyProvider implements KeyProvider with a key file per tenant
+type fileKeyProvider struct {
+	dir string
+}
+
+// GetFileKeyProvider define KeyProvider which reads the key of each tenant, hex encoded,
+// from the file "<dir>/<tenant>.key". The tenant name is path escaped, as with the NATS
+// credentials files of tenants.
+func GetFileKeyProvider(dir string) (KeyProvider, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &fileKeyProvider{dir: dir}, nil
+}
+
+// Key resolves the key of a tenant
+func (p *fileKeyProvider) Key(tenant string, ctxt context.Context) ([]byte, error) {
+	content, err := os.ReadFile(filepath.Join(p.dir, url.PathEscape(tenant)+".key"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w %s", ErrUnknownTenantKey, tenant)
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("key of tenant %s is not hex encoded: %w", tenant, err)
+	}
+	if len(key) != LogKeySize {
+		return nil, fmt.Errorf("key of tenant %s is not %d bytes", tenant, LogKeySize)
+	}
+	return key, nil
+}
+
+// ==============================================================================
+
+// logCipher helper function to define the AES-GCM cipher of a log key
+func logCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != LogKeySize {
+		return nil, fmt.Errorf("log key must be %d bytes", LogKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptLogLine encrypt a log line of a tenant. The result is one line of text: the
+// Base64 encoded nonce and AES-GCM sealed line, bound to the tenant.
+func EncryptLogLine(key []byte, tenant string, line []byte) ([]byte, error) {
+	aead, err := logCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(line)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, err
+	}
+	sealed = aead.Seal(sealed, sealed, line, []byte(tenant))
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed))+1)
+	base64.StdEncoding.Encode(encoded, sealed)
+	encoded[len(encoded)-1] = '\n'
+	return encoded, nil
+}
+
+// DecryptLog decrypt the encrypted log lines of a tenant read from in, writing the lines to
+// out. Fails on the first line not encrypted with the key for the tenant.
+func DecryptLog(key []byte, tenant string, in io.Reader, out io.Writer) error {
+	aead, err := logCipher(key)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(in)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return fmt.Errorf("line %d is not an encrypted log line", lineNum)
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		line, err := aead.Open(nil, nonce, ciphertext, []byte(tenant))
+		if err != nil {
+			return fmt.Errorf("unable to decrypt line %d: %w", lineNum, err)
+		}
+		if _, err := out.Write(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// EncryptedLogFile is the path of the encrypted log file of a tenant in a directory
+func EncryptedLogFile(dir, tenant string) string {
+	return filepath.Join(dir, url.PathEscape(tenant)+EncryptedLogSuffix)
+}
+
+// ==============================================================================
+
+// EncryptedLogWriter appends log lines to a file per tenant, encrypted with each tenant's
+// key
+type EncryptedLogWriter interface {
+	// WriteLine encrypt a log line with the key of a tenant, and append it to the tenant's
+	// log file
+	WriteLine(tenant string, line []byte, ctxt context.Context) error
+	// Close closes the log files
+	Close() error
+}
+
+// tenantLogFile the open log file of a tenant
+type tenantLogFile struct {
+	key  []byte
+	file *os.File
+}
+
+// encryptedLogWriterImpl implements EncryptedLogWriter
+type encryptedLogWriterImpl struct {
+	Component
+	dir   string
+	keys  KeyProvider
+	lock  sync.Mutex
+	files map[string]*tenantLogFile
+}
+
+// GetEncryptedLogWriter define new EncryptedLogWriter writing the log of each tenant to
+// EncryptedLogFile in dir, with the keys resolved by keys. A tenant's key is resolved when
+// its log file is first written, and used until the writer is closed.
+func GetEncryptedLogWriter(dir string, keys KeyProvider) (EncryptedLogWriter, error) {
+	logTags := log.Fields{
+		"module": "common", "component": "encrypted-log-writer", "instance": dir,
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define log directory")
+		return nil, err
+	}
+	return &encryptedLogWriterImpl{
+		Component: Component{LogTags: logTags},
+		dir:       dir,
+		keys:      keys,
+		files:     map[string]*tenantLogFile{},
+	}, nil
+}
+
+// WriteLine encrypt a log line with the key of a tenant, and append it to the tenant's log
+func (w *encryptedLogWriterImpl) WriteLine(
+	tenant string, line []byte, ctxt context.Context,
+) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	entry, ok := w.files[tenant]
+	if !ok {
+		key, err := w.keys.Key(tenant, ctxt)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(
+			EncryptedLogFile(w.dir, tenant), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600,
+		)
+		if err != nil {
+			return err
+		}
+		entry = &tenantLogFile{key: key, file: file}
+		w.files[tenant] = entry
+	}
+	encrypted, err := EncryptLogLine(entry.key, tenant, line)
+	if err != nil {
+		return err
+	}
+	_, err = entry.file.Write(encrypted)
+	return err
+}
+
+// Close closes the log files
+func (w *encryptedLogWriterImpl) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var firstErr error
+	for tenant, entry := range w.files {
+		if err := entry.file.Close(); err != nil {
+			log.WithError(err).WithFields(w.LogTags).Errorf("Unable to close log of %s", tenant)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(w.files, tenant)
+	}
+	return firstErr
+}
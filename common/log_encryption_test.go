@@ -0,0 +1,107 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedLogWriter(t *testing.T) {
+	assert := assert.New(t)
+	utCtxt := context.Background()
+
+	keyDir := t.TempDir()
+	logDir := filepath.Join(t.TempDir(), "logs")
+	keyA := bytes.Repeat([]byte{0x01}, LogKeySize)
+	keyB := bytes.Repeat([]byte{0x02}, LogKeySize)
+	assert.Nil(os.WriteFile(
+		filepath.Join(keyDir, "tenant-a.key"), []byte(hex.EncodeToString(keyA)+"\n"), 0600,
+	))
+	assert.Nil(os.WriteFile(
+		filepath.Join(keyDir, "tenant%2Fb.key"), []byte(hex.EncodeToString(keyB)), 0600,
+	))
+	assert.Nil(os.WriteFile(filepath.Join(keyDir, "short.key"), []byte("0102"), 0600))
+
+	keys, err := GetFileKeyProvider(keyDir)
+	assert.Nil(err)
+
+	// Case 0: key resolution
+	{
+		key, err := keys.Key("tenant-a", utCtxt)
+		assert.Nil(err)
+		assert.Equal(keyA, key)
+		key, err = keys.Key("tenant/b", utCtxt)
+		assert.Nil(err)
+		assert.Equal(keyB, key)
+		_, err = keys.Key("tenant-c", utCtxt)
+		assert.True(errors.Is(err, ErrUnknownTenantKey))
+		_, err = keys.Key("short", utCtxt)
+		assert.NotNil(err)
+	}
+
+	writer, err := GetEncryptedLogWriter(logDir, keys)
+	assert.Nil(err)
+
+	// Case 1: lines are written per tenant, encrypted
+	{
+		assert.Nil(writer.WriteLine("tenant-a", []byte("line 0 of a\n"), utCtxt))
+		assert.Nil(writer.WriteLine("tenant/b", []byte("line 0 of b\n"), utCtxt))
+		assert.Nil(writer.WriteLine("tenant-a", []byte("line 1 of a\n"), utCtxt))
+		assert.NotNil(writer.WriteLine("tenant-c", []byte("line 0 of c\n"), utCtxt))
+		assert.Nil(writer.Close())
+
+		content, err := os.ReadFile(EncryptedLogFile(logDir, "tenant-a"))
+		assert.Nil(err)
+		assert.NotContains(string(content), "line 0 of a")
+		_, err = os.Stat(EncryptedLogFile(logDir, "tenant-c"))
+		assert.True(errors.Is(err, os.ErrNotExist))
+
+		var out bytes.Buffer
+		assert.Nil(DecryptLog(keyA, "tenant-a", bytes.NewReader(content), &out))
+		assert.Equal("line 0 of a\nline 1 of a\n", out.String())
+	}
+
+	// Case 2: a log can not be decrypted with the key or name of another tenant
+	{
+		content, err := os.ReadFile(EncryptedLogFile(logDir, "tenant/b"))
+		assert.Nil(err)
+		var out bytes.Buffer
+		assert.NotNil(DecryptLog(keyA, "tenant/b", bytes.NewReader(content), &out))
+		assert.NotNil(DecryptLog(keyB, "tenant-a", bytes.NewReader(content), &out))
+		assert.Nil(DecryptLog(keyB, "tenant/b", bytes.NewReader(content), &out))
+		assert.Equal("line 0 of b\n", out.String())
+	}
+
+	// Case 3: lines are appended after the writer is reopened
+	{
+		writer, err := GetEncryptedLogWriter(logDir, keys)
+		assert.Nil(err)
+		assert.Nil(writer.WriteLine("tenant-a", []byte("line 2 of a\n"), utCtxt))
+		assert.Nil(writer.Close())
+		content, err := os.ReadFile(EncryptedLogFile(logDir, "tenant-a"))
+		assert.Nil(err)
+		var out bytes.Buffer
+		assert.Nil(DecryptLog(keyA, "tenant-a", bytes.NewReader(content), &out))
+		assert.Equal("line 0 of a\nline 1 of a\nline 2 of a\n", out.String())
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// LogThrottleParam settings of a LogThrottle
+type LogThrottleParam struct {
+	// Burst is the most lines sharing a key written within one period
+	Burst int `validate:"gte=1"`
+	// Period is the length of a throttling period
+	Period time.Duration `validate:"gt=0"`
+}
+
+// LogThrottle limits how many log lines sharing a key are written within a period. Lines
+// above the limit are suppressed, and counted for a summary logged at the end of the period.
+type LogThrottle interface {
+	// Allow whether a line with the key can be written now. A line not allowed is counted as
+	// suppressed.
+	Allow(key string) bool
+	// Flush log a summary of the lines suppressed, and begin a new period
+	Flush()
+}
+
+// logThrottleKey the lines of one key within the current period
+type logThrottleKey struct {
+	written    int
+	suppressed int
+}
+
+// logThrottleImpl implements LogThrottle
+type logThrottleImpl struct {
+	Component
+	burst int
+	lock  sync.Mutex
+	keys  map[string]*logThrottleKey
+}
+
+// GetLogThrottle define a new LogThrottle, which begins a new period every param.Period
+// until ctxt ends
+func GetLogThrottle(
+	param LogThrottleParam, ctxt context.Context, wg *sync.WaitGroup,
+) (LogThrottle, error) {
+	if param.Burst < 1 {
+		return nil, fmt.Errorf("log throttle burst must be at least 1")
+	}
+	if param.Period <= 0 {
+		return nil, fmt.Errorf("log throttle period must be positive")
+	}
+	throttle := &logThrottleImpl{
+		Component: Component{LogTags: log.Fields{"module": "common", "component": "log-throttle"}},
+		burst:     param.Burst,
+		keys:      make(map[string]*logThrottleKey),
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(param.Period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				throttle.Flush()
+			case <-ctxt.Done():
+				throttle.Flush()
+				return
+			}
+		}
+	}()
+	return throttle, nil
+}
+
+// Allow whether a line with the key can be written now
+func (t *logThrottleImpl) Allow(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, ok := t.keys[key]
+	if !ok {
+		entry = &logThrottleKey{}
+		t.keys[key] = entry
+	}
+	if entry.written >= t.burst {
+		entry.suppressed++
+		return false
+	}
+	entry.written++
+	return true
+}
+
+// Flush log a summary of the lines suppressed, and begin a new period
+func (t *logThrottleImpl) Flush() {
+	t.lock.Lock()
+	suppressed := map[string]int{}
+	for key, entry := range t.keys {
+		if entry.suppressed > 0 {
+			suppressed[key] = entry.suppressed
+		}
+	}
+	// Keys are only kept while active
+	t.keys = make(map[string]*logThrottleKey)
+	t.lock.Unlock()
+
+	keys := make([]string, 0, len(suppressed))
+	for key := range suppressed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		log.WithFields(t.LogTags).Infof("Suppressed %d log lines of %q", suppressed[key], key)
+	}
+}
+
+// ==============================================================================
+
+// logThrottleHolder wraps the throttle in use, as atomic.Value only stores one concrete type
+type logThrottleHolder struct {
+	throttle LogThrottle
+}
+
+// logThrottleInUse the process wide throttle of per message logs
+var logThrottleInUse atomic.Value
+
+// UseLogThrottle set the throttle of the per message logs written with ThrottledDebugf. If
+// throttle is nil, the logs are not throttled.
+func UseLogThrottle(throttle LogThrottle) {
+	logThrottleInUse.Store(logThrottleHolder{throttle: throttle})
+}
+
+// ThrottledDebugf write a per message debug log line, throttled by the throttle set with
+// UseLogThrottle. Lines are throttled by their format.
+func ThrottledDebugf(entry log.Interface, format string, args ...interface{}) {
+	// Skip the throttle when the line would not be written anyway
+	if logger, ok := log.Log.(*log.Logger); ok && logger.Level > log.DebugLevel {
+		return
+	}
+	if holder, ok := logThrottleInUse.Load().(logThrottleHolder); ok && holder.throttle != nil {
+		if !holder.throttle.Allow(format) {
+			return
+		}
+	}
+	entry.Debugf(format, args...)
+}
@@ -0,0 +1,93 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	utCtxt, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	// Case 0: invalid settings
+	{
+		_, err := GetLogThrottle(LogThrottleParam{Burst: 0, Period: time.Second}, utCtxt, &wg)
+		assert.NotNil(err)
+		_, err = GetLogThrottle(LogThrottleParam{Burst: 1}, utCtxt, &wg)
+		assert.NotNil(err)
+	}
+
+	logger := log.Log.(*log.Logger)
+	defer log.SetHandler(logger.Handler)
+	defer log.SetLevel(logger.Level)
+
+	uut, err := GetLogThrottle(LogThrottleParam{Burst: 2, Period: time.Hour}, utCtxt, &wg)
+	assert.Nil(err)
+
+	// Case 1: keys are throttled separately
+	{
+		assert.True(uut.Allow("a"))
+		assert.True(uut.Allow("a"))
+		assert.False(uut.Allow("a"))
+		assert.False(uut.Allow("a"))
+		assert.True(uut.Allow("b"))
+	}
+
+	// Case 2: the suppressed lines are summarized, and a new period begins
+	{
+		handler := memory.New()
+		log.SetHandler(handler)
+		uut.Flush()
+		assert.Len(handler.Entries, 1)
+		assert.Equal(`Suppressed 2 log lines of "a"`, handler.Entries[0].Message)
+		assert.True(uut.Allow("a"))
+	}
+
+	// Case 3: per message debug logs through the throttle
+	{
+		handler := memory.New()
+		log.SetHandler(handler)
+		log.SetLevel(log.DebugLevel)
+		UseLogThrottle(uut)
+		defer UseLogThrottle(nil)
+		for i := 0; i < 5; i++ {
+			ThrottledDebugf(log.WithFields(log.Fields{}), "Processing message %d", i)
+		}
+		assert.Len(handler.Entries, 2)
+		assert.Equal("Processing message 1", handler.Entries[1].Message)
+
+		// Not throttled
+		UseLogThrottle(nil)
+		ThrottledDebugf(log.WithFields(log.Fields{}), "Processing message %d", 5)
+		assert.Len(handler.Entries, 3)
+
+		// Not written at all
+		log.SetLevel(log.InfoLevel)
+		ThrottledDebugf(log.WithFields(log.Fields{}), "Processing message %d", 6)
+		assert.Len(handler.Entries, 3)
+	}
+}
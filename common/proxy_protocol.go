@@ -0,0 +1,247 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolV2Signature the signature starting a PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseIPNetList parse a comma separated list of CIDRs and IP addresses
+func ParseIPNetList(list string) ([]*net.IPNet, error) {
+	result := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// IPInNets helper function to check whether an IP is in any of the networks
+func IPInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ========================================================================================
+
+// proxyProtocolListener wraps a net.Listener to accept connections prefixed with a PROXY
+// protocol header
+type proxyProtocolListener struct {
+	net.Listener
+	trusted       []*net.IPNet
+	headerTimeout time.Duration
+}
+
+// GetProxyProtocolListener wrap a listener to accept PROXY protocol v1 and v2 headers, so
+// the remote address of a connection is the original client address reported by the proxy.
+//
+// If trusted is not empty, only connections from those networks are expected to carry a
+// header; other connections are used as is. Otherwise, all connections must carry a
+// header.
+func GetProxyProtocolListener(
+	inner net.Listener, trusted []*net.IPNet, headerTimeout time.Duration,
+) net.Listener {
+	return &proxyProtocolListener{Listener: inner, trusted: trusted, headerTimeout: headerTimeout}
+}
+
+// Accept waits for and returns the next connection
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trusted) > 0 {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !IPInNets(tcpAddr.IP, l.trusted) {
+			return conn, nil
+		}
+	}
+	// The header is read on first use, so a slow client does not block Accept
+	return &proxyProtocolConn{
+		Conn: conn, reader: bufio.NewReader(conn), headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+// proxyProtocolConn a connection prefixed with a PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+	once          sync.Once
+	remoteAddr    net.Addr
+	headerErr     error
+}
+
+// readHeader read the PROXY protocol header once
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		if c.headerTimeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+			defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+		}
+		c.remoteAddr, c.headerErr = readProxyProtocolHeader(c.reader)
+		if c.headerErr != nil {
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+// Read reads data from the connection, after the PROXY protocol header
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address reported by the proxy. This is the proxy address
+// if the proxy did not report one.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader read a PROXY protocol v1 or v2 header, and return the source
+// address it reports. Returns nil address for LOCAL / UNKNOWN headers.
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	sig, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PROXY protocol header: %w", err)
+	}
+	if bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(reader)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyProtocolV1Header(reader)
+	}
+	return nil, fmt.Errorf("connection did not start with a PROXY protocol header")
+}
+
+// readProxyProtocolV1Header read a PROXY protocol v1 header
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	// v1 header is at most 107 bytes, including the CRLF
+	line := make([]byte, 0, 107)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read PROXY protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("PROXY protocol v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY protocol v1 header not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtocolV2Header read a PROXY protocol v2 header
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("unable to read PROXY protocol v2 header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("unable to read PROXY protocol v2 addresses: %w", err)
+	}
+	// LOCAL command: connection from the proxy itself, e.g. health checks
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", command)
+	}
+	switch family {
+	case 1:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{
+			IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{
+			IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// Other address families do not have a usable client IP
+		return nil, nil
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPNetList(t *testing.T) {
+	assert := assert.New(t)
+
+	nets, err := ParseIPNetList("10.0.0.0/8, 192.168.1.5,,fd00::/8")
+	assert.Nil(err)
+	assert.Len(nets, 3)
+	assert.True(IPInNets(net.ParseIP("10.1.2.3"), nets))
+	assert.True(IPInNets(net.ParseIP("192.168.1.5"), nets))
+	assert.False(IPInNets(net.ParseIP("192.168.1.6"), nets))
+	assert.True(IPInNets(net.ParseIP("fd00::1"), nets))
+
+	_, err = ParseIPNetList("10.0.0.0/33")
+	assert.NotNil(err)
+	_, err = ParseIPNetList("not-an-ip")
+	assert.NotNil(err)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer inner.Close()
+
+	// sendAndAccept helper function to send raw bytes over a new connection, and accept it
+	sendAndAccept := func(uut net.Listener, raw []byte) net.Conn {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		assert.Nil(err)
+		go func() {
+			_, _ = client.Write(raw)
+		}()
+		conn, err := uut.Accept()
+		assert.Nil(err)
+		return conn
+	}
+
+	uut := GetProxyProtocolListener(inner, nil, time.Second)
+
+	// Case 0: v1 header
+	{
+		conn := sendAndAccept(uut, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\nhello"))
+		assert.Equal("203.0.113.7:51000", conn.RemoteAddr().String())
+		data := make([]byte, 5)
+		_, err := io.ReadFull(conn, data)
+		assert.Nil(err)
+		assert.Equal("hello", string(data))
+		assert.Nil(conn.Close())
+	}
+
+	// Case 1: v2 header
+	{
+		raw := append([]byte{}, proxyProtocolV2Signature...)
+		raw = append(raw, 0x21, 0x11, 0, 12)
+		raw = append(raw, 198, 51, 100, 9, 10, 0, 0, 1)
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports[0:2], 40000)
+		binary.BigEndian.PutUint16(ports[2:4], 443)
+		raw = append(raw, ports...)
+		raw = append(raw, []byte("world")...)
+		conn := sendAndAccept(uut, raw)
+		assert.Equal("198.51.100.9:40000", conn.RemoteAddr().String())
+		data := make([]byte, 5)
+		_, err := io.ReadFull(conn, data)
+		assert.Nil(err)
+		assert.Equal("world", string(data))
+		assert.Nil(conn.Close())
+	}
+
+	// Case 2: v2 LOCAL header keeps the proxy address
+	{
+		raw := append([]byte{}, proxyProtocolV2Signature...)
+		raw = append(raw, 0x20, 0x00, 0, 0)
+		raw = append(raw, []byte("local")...)
+		conn := sendAndAccept(uut, raw)
+		assert.Contains(conn.RemoteAddr().String(), "127.0.0.1:")
+		data := make([]byte, 5)
+		_, err := io.ReadFull(conn, data)
+		assert.Nil(err)
+		assert.Equal("local", string(data))
+		assert.Nil(conn.Close())
+	}
+
+	// Case 3: missing header
+	{
+		conn := sendAndAccept(uut, []byte("GET / HTTP/1.1\r\n\r\n"))
+		_, err := conn.Read(make([]byte, 5))
+		assert.NotNil(err)
+	}
+
+	// Case 4: connections from untrusted networks are used as is
+	{
+		trusted, err := ParseIPNetList("10.0.0.0/8")
+		assert.Nil(err)
+		uut := GetProxyProtocolListener(inner, trusted, time.Second)
+		conn := sendAndAccept(uut, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n"))
+		assert.Contains(conn.RemoteAddr().String(), "127.0.0.1:")
+		data := make([]byte, 6)
+		_, err = io.ReadFull(conn, data)
+		assert.Nil(err)
+		assert.Equal("PROXY ", string(data))
+		assert.Nil(conn.Close())
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RequestQuotaParam settings of a RequestQuota
+type RequestQuotaParam struct {
+	// Limit is the most requests a client makes within one window
+	Limit int `validate:"gte=1"`
+	// Window is the length of a quota window
+	Window time.Duration `validate:"gt=0"`
+}
+
+// QuotaState is the state of a client's quota after a request
+type QuotaState struct {
+	// Allowed is whether the request is within the quota
+	Allowed bool
+	// Limit is the most requests a client makes within one window
+	Limit int
+	// Remaining is the number of requests the client can still make in the current window
+	Remaining int
+	// Reset is when the current window ends, and the quota is replenished
+	Reset time.Time
+}
+
+// RequestQuota limits how many requests each client makes within fixed windows
+type RequestQuota interface {
+	// Take counts a request of a client against its quota. A request not allowed is not
+	// counted.
+	Take(client string) QuotaState
+}
+
+// requestQuotaImpl implements RequestQuota
+type requestQuotaImpl struct {
+	param RequestQuotaParam
+	clock Clock
+	lock  sync.Mutex
+	// windowStart is the start of the current window
+	windowStart time.Time
+	// counts are the requests of each client in the current window
+	counts map[string]int
+}
+
+// GetRequestQuota define a new RequestQuota. Windows are aligned to multiples of
+// param.Window since the Unix epoch, so all clients share the same windows.
+func GetRequestQuota(param RequestQuotaParam) (RequestQuota, error) {
+	if param.Limit < 1 {
+		return nil, fmt.Errorf("request quota limit must be at least 1")
+	}
+	if param.Window <= 0 {
+		return nil, fmt.Errorf("request quota window must be positive")
+	}
+	return &requestQuotaImpl{
+		param:  param,
+		clock:  SystemClock,
+		counts: make(map[string]int),
+	}, nil
+}
+
+// Take counts a request of a client against its quota
+func (q *requestQuotaImpl) Take(client string) QuotaState {
+	now := q.clock.Now()
+	windowStart := now.Truncate(q.param.Window)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// Clients are only kept while active in the current window
+	if windowStart.After(q.windowStart) {
+		q.windowStart = windowStart
+		q.counts = make(map[string]int)
+	}
+	state := QuotaState{Limit: q.param.Limit, Reset: q.windowStart.Add(q.param.Window)}
+	count := q.counts[client]
+	if count < q.param.Limit {
+		count++
+		q.counts[client] = count
+		state.Allowed = true
+	}
+	state.Remaining = q.param.Limit - count
+	return state
+}
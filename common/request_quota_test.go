@@ -0,0 +1,69 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid parameters
+	{
+		_, err := GetRequestQuota(RequestQuotaParam{Limit: 0, Window: time.Second})
+		assert.NotNil(err)
+		_, err = GetRequestQuota(RequestQuotaParam{Limit: 1})
+		assert.NotNil(err)
+	}
+
+	quota, err := GetRequestQuota(RequestQuotaParam{Limit: 2, Window: time.Minute})
+	assert.Nil(err)
+	clock := GetFakeClock(time.Date(2022, 1, 1, 10, 0, 30, 0, time.UTC))
+	quota.(*requestQuotaImpl).clock = clock
+	windowEnd := time.Date(2022, 1, 1, 10, 1, 0, 0, time.UTC)
+
+	// Case 1: requests within the quota
+	{
+		state := quota.Take("client-0")
+		assert.Equal(QuotaState{Allowed: true, Limit: 2, Remaining: 1, Reset: windowEnd}, state)
+		state = quota.Take("client-0")
+		assert.True(state.Allowed)
+		assert.Equal(0, state.Remaining)
+	}
+
+	// Case 2: requests over the quota, which do not affect other clients
+	{
+		state := quota.Take("client-0")
+		assert.False(state.Allowed)
+		assert.Equal(0, state.Remaining)
+		assert.Equal(windowEnd, state.Reset)
+		state = quota.Take("client-1")
+		assert.True(state.Allowed)
+		assert.Equal(1, state.Remaining)
+	}
+
+	// Case 3: the quota is replenished in the next window
+	{
+		clock.Advance(time.Second * 30)
+		state := quota.Take("client-0")
+		assert.True(state.Allowed)
+		assert.Equal(1, state.Remaining)
+		assert.Equal(windowEnd.Add(time.Minute), state.Reset)
+	}
+}
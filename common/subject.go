@@ -0,0 +1,165 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidSubject a subject failed validation
+var ErrInvalidSubject = errors.New("invalid subject")
+
+// DefaultReservedSubjectPrefixes are the subject prefixes NATS reserves for its own APIs
+var DefaultReservedSubjectPrefixes = []string{"$JS", "$KV", "$O", "$SYS"}
+
+// SubjectError describes why a subject failed validation
+type SubjectError struct {
+	// Subject is the subject validated
+	Subject string
+	// Position is the 1-based position of the offending token. 0 if the problem is with the
+	// subject as a whole.
+	Position int
+	// Token is the offending token
+	Token string
+	// Reason describes the problem
+	Reason string
+}
+
+// Error support error
+func (e *SubjectError) Error() string {
+	if e.Position == 0 {
+		return fmt.Sprintf("%s '%s': %s", ErrInvalidSubject, e.Subject, e.Reason)
+	}
+	return fmt.Sprintf(
+		"%s '%s': token %d '%s' %s", ErrInvalidSubject, e.Subject, e.Position, e.Token, e.Reason,
+	)
+}
+
+// Unwrap support errors.Is against ErrInvalidSubject
+func (e *SubjectError) Unwrap() error {
+	return ErrInvalidSubject
+}
+
+// SubjectRules are the rules subjects given by clients must follow
+type SubjectRules struct {
+	// MaxDepth is the max number of tokens in a subject. 0 for no limit.
+	MaxDepth int `validate:"gte=0"`
+	// ReservedPrefixes are the subject prefixes clients can not use, e.g. "$JS". A prefix
+	// matches whole tokens, so "$JS" matches "$JS.API.INFO", but not "$JSON".
+	ReservedPrefixes []string `validate:"dive,required"`
+}
+
+// NormalizeSubject removes the whitespace surrounding a subject
+func NormalizeSubject(subject string) string {
+	return strings.TrimSpace(subject)
+}
+
+// ValidateSubject normalizes a subject messages are published to, and verifies it is valid.
+// Wildcards are not permitted.
+func (r SubjectRules) ValidateSubject(subject string) (string, error) {
+	return r.validate(NormalizeSubject(subject), false)
+}
+
+// ValidateSubjectFilter normalizes a subject filter, such as the subject of a subscription
+// or a stream, and verifies it is valid. "*" may replace any token, and ">" the last token.
+func (r SubjectRules) ValidateSubjectFilter(subject string) (string, error) {
+	return r.validate(NormalizeSubject(subject), true)
+}
+
+// validate helper function to verify a normalized subject
+func (r SubjectRules) validate(subject string, wildcards bool) (string, error) {
+	if subject == "" {
+		return "", &SubjectError{Subject: subject, Reason: "is empty"}
+	}
+	tokens := strings.Split(subject, ".")
+	if r.MaxDepth > 0 && len(tokens) > r.MaxDepth {
+		return "", &SubjectError{
+			Subject: subject,
+			Reason:  fmt.Sprintf("has %d tokens, more than the max of %d", len(tokens), r.MaxDepth),
+		}
+	}
+	for idx, token := range tokens {
+		tokenError := func(reason string) error {
+			return &SubjectError{Subject: subject, Position: idx + 1, Token: token, Reason: reason}
+		}
+		if token == "" {
+			return "", tokenError("is empty")
+		}
+		for _, char := range token {
+			if unicode.IsSpace(char) || unicode.IsControl(char) {
+				return "", tokenError(fmt.Sprintf("has invalid character %q", char))
+			}
+		}
+		switch {
+		case token == "*" || token == ">":
+			if !wildcards {
+				return "", tokenError("is a wildcard, which is not permitted here")
+			}
+			if token == ">" && idx != len(tokens)-1 {
+				return "", tokenError("is a '>' wildcard, which must be the last token")
+			}
+		case strings.ContainsAny(token, "*>"):
+			return "", tokenError("mixes a wildcard with other characters")
+		}
+	}
+	for _, prefix := range r.ReservedPrefixes {
+		if subjectHasPrefix(tokens, strings.Split(prefix, ".")) {
+			return "", &SubjectError{
+				Subject:  subject,
+				Position: 1,
+				Token:    tokens[0],
+				Reason:   fmt.Sprintf("starts the reserved prefix '%s'", prefix),
+			}
+		}
+	}
+	return subject, nil
+}
+
+// subjectHasPrefix helper function to check whether the leading tokens of a subject are the
+// tokens of a prefix
+func subjectHasPrefix(tokens, prefix []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+	for idx, token := range prefix {
+		if tokens[idx] != token {
+			return false
+		}
+	}
+	return true
+}
+
+// SubjectMatches checks whether a subject matches a subject filter
+//
+// "*" matches a single token, and ">" matches one or more trailing tokens.
+func SubjectMatches(filter, subject string) bool {
+	filterTokens := strings.Split(filter, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for idx, token := range filterTokens {
+		if token == ">" {
+			return len(subjectTokens) > idx
+		}
+		if idx >= len(subjectTokens) {
+			return false
+		}
+		if token != "*" && token != subjectTokens[idx] {
+			return false
+		}
+	}
+	return len(filterTokens) == len(subjectTokens)
+}
@@ -0,0 +1,108 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectRules(t *testing.T) {
+	assert := assert.New(t)
+
+	uut := SubjectRules{MaxDepth: 4, ReservedPrefixes: []string{"$JS", "internal.audit"}}
+
+	type testCase struct {
+		subject   string
+		wildcards bool
+		expected  string
+		position  int
+	}
+	testCases := []testCase{
+		{subject: "orders.created", expected: "orders.created"},
+		{subject: " orders.created\n", expected: "orders.created"},
+		{subject: "orders.*", wildcards: true, expected: "orders.*"},
+		{subject: "orders.>", wildcards: true, expected: "orders.>"},
+		{subject: "$JSON.data", expected: "$JSON.data"},
+		{subject: "internal.orders", expected: "internal.orders"},
+		// Problems with the whole subject
+		{subject: "  ", position: 0},
+		{subject: "a.b.c.d.e", position: 0},
+		// Problems with one token
+		{subject: "orders..created", position: 2},
+		{subject: ".orders", position: 1},
+		{subject: "orders.", position: 2},
+		{subject: "orders.new item", position: 2},
+		{subject: "orders.*", position: 2},
+		{subject: "orders.>", position: 2},
+		{subject: "orders.>.eu", wildcards: true, position: 2},
+		{subject: "orders.new*", wildcards: true, position: 2},
+		{subject: "$JS.API.INFO", position: 1},
+		{subject: "internal.audit.login", position: 1},
+	}
+	for idx, oneCase := range testCases {
+		var normalized string
+		var err error
+		if oneCase.wildcards {
+			normalized, err = uut.ValidateSubjectFilter(oneCase.subject)
+		} else {
+			normalized, err = uut.ValidateSubject(oneCase.subject)
+		}
+		if oneCase.expected != "" {
+			assert.Nilf(err, "Case %d", idx)
+			assert.Equalf(oneCase.expected, normalized, "Case %d", idx)
+			continue
+		}
+		assert.NotNilf(err, "Case %d", idx)
+		assert.Truef(errors.Is(err, ErrInvalidSubject), "Case %d", idx)
+		var subjectErr *SubjectError
+		assert.Truef(errors.As(err, &subjectErr), "Case %d", idx)
+		assert.Equalf(oneCase.position, subjectErr.Position, "Case %d", idx)
+	}
+
+	// No limits
+	{
+		normalized, err := SubjectRules{}.ValidateSubject("a.b.c.d.e.$JS")
+		assert.Nil(err)
+		assert.Equal("a.b.c.d.e.$JS", normalized)
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	type testCase struct {
+		filter  string
+		subject string
+		match   bool
+	}
+	testCases := []testCase{
+		{filter: "orders.created", subject: "orders.created", match: true},
+		{filter: "orders.created", subject: "orders.deleted", match: false},
+		{filter: "orders.*", subject: "orders.created", match: true},
+		{filter: "orders.*", subject: "orders.created.eu", match: false},
+		{filter: "orders.>", subject: "orders.created.eu", match: true},
+		{filter: "orders.>", subject: "orders", match: false},
+		{filter: "*.created", subject: "orders.created", match: true},
+		{filter: "orders.created.eu", subject: "orders.created", match: false},
+	}
+	for idx, oneCase := range testCases {
+		assert.Equalf(
+			oneCase.match, SubjectMatches(oneCase.filter, oneCase.subject), "Case %d", idx,
+		)
+	}
+}
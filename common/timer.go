@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apex/log"
@@ -26,11 +27,32 @@ import (
 // TimeoutHandler callback function signature called timer timeout
 type TimeoutHandler func() error
 
+// TimerMode decides how an IntervalTimer schedules the next timeout after calling its handler
+type TimerMode int
+
+const (
+	// FixedDelay waits the full interval after the handler returns. The time the handler takes
+	// adds to the interval, so the timeouts drift.
+	FixedDelay TimerMode = iota
+	// FixedRate times out at whole intervals from the start, compensating for the time the
+	// handler takes. Timeouts passed while the handler runs are skipped.
+	FixedRate
+)
+
 // IntervalTimer is a support interface for triggering events at specific intervals
 type IntervalTimer interface {
 	// Start starts timer with a specific timeout interval, and the callback to trigger on timeout.
 	// If oneShort, cancel after first timeout.
 	Start(interval time.Duration, handler TimeoutHandler, oneShort bool) error
+	// SetMode sets how the timer schedules the next timeout. Must be called before Start.
+	// FixedDelay by default.
+	SetMode(mode TimerMode) error
+	// SetClock sets the clock driving the timer. Must be called before Start. SystemClock
+	// by default.
+	SetClock(clock Clock) error
+	// MissedTicks returns the number of timeouts missed because the handler ran longer than
+	// the interval
+	MissedTicks() uint64
 	// Stop stops the timer
 	Stop() error
 }
@@ -42,6 +64,9 @@ type intervalTimerImpl struct {
 	operationContext context.Context
 	contextCancel    context.CancelFunc
 	wg               *sync.WaitGroup
+	mode             TimerMode
+	clock            Clock
+	missedTicks      uint64
 }
 
 // GetIntervalTimerInstance create new interval timer instance
@@ -63,6 +88,7 @@ func GetIntervalTimerInstance(
 		operationContext: nil,
 		contextCancel:    nil,
 		wg:               wg,
+		clock:            SystemClock,
 	}, nil
 }
 
@@ -76,28 +102,79 @@ func (t *intervalTimerImpl) Start(
 	ctxt, cancel := context.WithCancel(t.rootContext)
 	t.operationContext = ctxt
 	t.contextCancel = cancel
+	mode, clock := t.mode, t.clock
 	go func() {
 		defer t.wg.Done()
 		defer log.WithFields(t.LogTags).Info("Timer loop exiting")
-		finished := false
-		for !finished {
+		deadline := clock.Now().Add(interval)
+		for {
+			timeout := clock.NewTimer(deadline.Sub(clock.Now()))
 			select {
 			case <-t.operationContext.Done():
-				finished = true
-			case <-time.After(interval):
-				log.WithFields(t.LogTags).Debug("Calling handler")
-				if err := handler(); err != nil {
-					log.WithError(err).WithFields(t.LogTags).Error("Handler failed")
-				}
-				if oneShot {
-					return
-				}
+				timeout.Stop()
+				return
+			case <-timeout.C():
+			}
+			log.WithFields(t.LogTags).Debug("Calling handler")
+			called := clock.Now()
+			if err := handler(); err != nil {
+				log.WithError(err).WithFields(t.LogTags).Error("Handler failed")
+			}
+			if oneShot {
+				return
+			}
+			var missed uint64
+			deadline, missed = nextTimerDeadline(mode, interval, deadline, called, clock.Now())
+			if missed > 0 {
+				atomic.AddUint64(&t.missedTicks, missed)
+				log.WithFields(t.LogTags).Warnf("Handler overran the interval, missed %d ticks", missed)
 			}
 		}
 	}()
 	return nil
 }
 
+// nextTimerDeadline helper function to schedule the next timeout of a timer, after the
+// handler called at called for the timeout at deadline returned at now. Also returns the
+// number of timeouts missed while the handler ran.
+func nextTimerDeadline(
+	mode TimerMode, interval time.Duration, deadline, called, now time.Time,
+) (time.Time, uint64) {
+	if mode == FixedRate {
+		next := deadline.Add(interval)
+		if !now.After(next) {
+			return next, 0
+		}
+		missed := now.Sub(next)/interval + 1
+		return next.Add(missed * interval), uint64(missed)
+	}
+	return now.Add(interval), uint64(now.Sub(called) / interval)
+}
+
+// SetMode sets how the timer schedules the next timeout
+func (t *intervalTimerImpl) SetMode(mode TimerMode) error {
+	if mode != FixedDelay && mode != FixedRate {
+		return fmt.Errorf("unknown timer mode %d", mode)
+	}
+	t.mode = mode
+	return nil
+}
+
+// SetClock sets the clock driving the timer
+func (t *intervalTimerImpl) SetClock(clock Clock) error {
+	if clock == nil {
+		return fmt.Errorf("timer clock must not be nil")
+	}
+	t.clock = clock
+	return nil
+}
+
+// MissedTicks returns the number of timeouts missed because the handler ran longer than
+// the interval
+func (t *intervalTimerImpl) MissedTicks() uint64 {
+	return atomic.LoadUint64(&t.missedTicks)
+}
+
 // Stop stops the timer
 func (t *intervalTimerImpl) Stop() error {
 	if t.contextCancel != nil {
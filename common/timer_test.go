@@ -51,6 +51,106 @@ func TestIntervalTimerOneShot(t *testing.T) {
 	assert.Equal(2, value)
 }
 
+func TestNextTimerDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := time.Second
+	deadline := time.Unix(100, 0)
+	called := deadline.Add(time.Millisecond)
+
+	// Case 1: fixed delay waits the interval after the handler returns
+	{
+		now := called.Add(time.Millisecond * 300)
+		next, missed := nextTimerDeadline(FixedDelay, interval, deadline, called, now)
+		assert.Equal(now.Add(interval), next)
+		assert.Equal(uint64(0), missed)
+	}
+
+	// Case 2: fixed delay counts the intervals the handler overran
+	{
+		now := called.Add(time.Millisecond * 2500)
+		next, missed := nextTimerDeadline(FixedDelay, interval, deadline, called, now)
+		assert.Equal(now.Add(interval), next)
+		assert.Equal(uint64(2), missed)
+	}
+
+	// Case 3: fixed rate compensates for the time the handler takes
+	{
+		now := called.Add(time.Millisecond * 300)
+		next, missed := nextTimerDeadline(FixedRate, interval, deadline, called, now)
+		assert.Equal(deadline.Add(interval), next)
+		assert.Equal(uint64(0), missed)
+	}
+
+	// Case 4: fixed rate skips the timeouts passed while the handler ran
+	{
+		now := deadline.Add(time.Millisecond * 2500)
+		next, missed := nextTimerDeadline(FixedRate, interval, deadline, called, now)
+		assert.Equal(deadline.Add(interval*3), next)
+		assert.Equal(uint64(2), missed)
+	}
+}
+
+func TestIntervalTimerFixedRate(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uut, err := GetIntervalTimerInstance("testing", ctxt, &wg)
+	assert.Nil(err)
+
+	assert.NotNil(uut.SetMode(TimerMode(5)))
+	assert.Nil(uut.SetMode(FixedRate))
+	assert.NotNil(uut.SetClock(nil))
+	clock := GetFakeClock(time.Unix(100, 0))
+	assert.Nil(uut.SetClock(clock))
+
+	interval := time.Second
+	calls := make(chan time.Time, 4)
+	overrun := time.Duration(0)
+	callback := func() error {
+		handlerTakes := overrun
+		calls <- clock.Now()
+		clock.Advance(handlerTakes)
+		return nil
+	}
+	assert.Nil(uut.Start(interval, callback, false))
+
+	// Case 1: timeout only when the clock reaches the interval
+	{
+		assert.True(clock.WaitForTimers(1, time.Second))
+		clock.Advance(interval - time.Millisecond)
+		select {
+		case <-calls:
+			assert.False(true, "handler called before the interval")
+		default:
+		}
+		clock.Advance(time.Millisecond)
+		assert.Equal(time.Unix(101, 0), <-calls)
+	}
+
+	// Case 2: handler overruns two intervals, those timeouts are skipped
+	{
+		overrun = interval*2 + interval/2
+		assert.True(clock.WaitForTimers(1, time.Second))
+		clock.Advance(interval)
+		assert.Equal(time.Unix(102, 0), <-calls)
+		overrun = 0
+		assert.True(clock.WaitForTimers(1, time.Second))
+		assert.Equal(uint64(2), uut.MissedTicks())
+	}
+
+	// Case 3: the schedule is kept on whole intervals from the start
+	{
+		clock.Advance(interval / 2)
+		assert.Equal(time.Unix(105, 0), <-calls)
+	}
+
+	assert.Nil(uut.Stop())
+}
+
 func TestExponentialSeq(t *testing.T) {
 	assert := assert.New(t)
 
@@ -0,0 +1,127 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// CertificateReloader serves a TLS certificate loaded from files, and reloads it when the
+// files change
+type CertificateReloader interface {
+	// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Stop stops watching the certificate files
+	Stop() error
+}
+
+// certificateReloaderImpl implements CertificateReloader
+type certificateReloaderImpl struct {
+	Component
+	certFile, keyFile string
+	lock              sync.RWMutex
+	cert              *tls.Certificate
+	certModTime       time.Time
+	keyModTime        time.Time
+	timer             IntervalTimer
+}
+
+// GetCertificateReloader define a new CertificateReloader, which checks the certificate and
+// key files for changes every checkInterval
+func GetCertificateReloader(
+	certFile, keyFile string,
+	checkInterval time.Duration,
+	ctxt context.Context,
+	wg *sync.WaitGroup,
+) (CertificateReloader, error) {
+	logTags := log.Fields{
+		"module": "common", "component": "cert-reloader", "instance": certFile,
+	}
+	timer, err := GetIntervalTimerInstance(fmt.Sprintf("cert-reloader.%s", certFile), ctxt, wg)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		return nil, err
+	}
+	instance := &certificateReloaderImpl{
+		Component: Component{LogTags: logTags},
+		certFile:  certFile,
+		keyFile:   keyFile,
+		timer:     timer,
+	}
+	if err := instance.reload(); err != nil {
+		return nil, err
+	}
+	if err := timer.Start(checkInterval, instance.reload, false); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to start timer")
+		return nil, err
+	}
+	return instance, nil
+}
+
+// GetCertificate returns the current certificate
+func (r *certificateReloaderImpl) GetCertificate(
+	_ *tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// Stop stops watching the certificate files
+func (r *certificateReloaderImpl) Stop() error {
+	return r.timer.Stop()
+}
+
+// reload support IntervalTimer, load the certificate if either file has changed
+//
+// A certificate which fails to load does not replace the current one.
+func (r *certificateReloaderImpl) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Unable to stat %s", r.certFile)
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Unable to stat %s", r.keyFile)
+		return err
+	}
+	r.lock.RLock()
+	unchanged := r.cert != nil &&
+		certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime)
+	r.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Unable to load certificate")
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	log.WithFields(r.LogTags).Infof("Loaded certificate from %s", r.certFile)
+	return nil
+}
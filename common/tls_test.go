@@ -0,0 +1,113 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate helper function to write a self-signed certificate and its key
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64) []byte {
+	assert := assert.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(err)
+	assert.Nil(os.WriteFile(
+		certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600,
+	))
+	assert.Nil(os.WriteFile(
+		keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600,
+	))
+	return der
+}
+
+func TestCertificateReloader(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	testDir := t.TempDir()
+	certFile := filepath.Join(testDir, "cert.pem")
+	keyFile := filepath.Join(testDir, "key.pem")
+
+	// Case 0: files do not exist
+	{
+		_, err := GetCertificateReloader(certFile, keyFile, time.Millisecond*20, utCtxt, &wg)
+		assert.NotNil(err)
+	}
+
+	// Case 1: initial certificate
+	cert1 := writeTestCertificate(t, certFile, keyFile, 1)
+	uut, err := GetCertificateReloader(certFile, keyFile, time.Millisecond*20, utCtxt, &wg)
+	assert.Nil(err)
+	{
+		cert, err := uut.GetCertificate(nil)
+		assert.Nil(err)
+		assert.Equal(cert1, cert.Certificate[0])
+	}
+
+	// Case 2: certificate replaced
+	cert2 := writeTestCertificate(t, certFile, keyFile, 2)
+	{
+		future := time.Now().Add(time.Second)
+		assert.Nil(os.Chtimes(certFile, future, future))
+		assert.Nil(os.Chtimes(keyFile, future, future))
+		time.Sleep(time.Millisecond * 100)
+		cert, err := uut.GetCertificate(nil)
+		assert.Nil(err)
+		assert.Equal(cert2, cert.Certificate[0])
+	}
+
+	// Case 3: invalid certificate does not replace the current one
+	{
+		assert.Nil(os.WriteFile(certFile, []byte("invalid"), 0600))
+		future := time.Now().Add(time.Second * 2)
+		assert.Nil(os.Chtimes(certFile, future, future))
+		time.Sleep(time.Millisecond * 100)
+		cert, err := uut.GetCertificate(nil)
+		assert.Nil(err)
+		assert.Equal(cert2, cert.Certificate[0])
+	}
+
+	assert.Nil(uut.Stop())
+}
@@ -0,0 +1,284 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// NatsClientPool maintains NATS clients connected with the credentials of each tenant.
+// Tenants with the same credentials share a client.
+type NatsClientPool interface {
+	// Acquire fetches a client connected with the credentials of a tenant, connecting a new
+	// client if needed. Call release once done with the client.
+	Acquire(tenant string, ctxt context.Context) (*NatsClient, func(), error)
+	// Close closes all clients
+	Close(ctxt context.Context)
+}
+
+// pooledClient a client in the pool
+type pooledClient struct {
+	client *NatsClient
+	// users is the number of acquired references to the client
+	users    int
+	lastUsed time.Time
+}
+
+// pendingDial a client being connected. done is closed once connected, or once the
+// connect failed with err.
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
+
+// resolvedTenant the credentials last resolved for a tenant
+type resolvedTenant struct {
+	credsKey string
+	creds    NATSCredentials
+	resolved time.Time
+}
+
+// natsClientPoolImpl implements NatsClientPool
+type natsClientPoolImpl struct {
+	common.Component
+	base        NATSConnectParams
+	provider    CredentialProvider
+	idleTimeout time.Duration
+	timer       common.IntervalTimer
+	lock        sync.Mutex
+	tenants     map[string]resolvedTenant
+	// clients by the key of their credentials
+	clients map[string]*pooledClient
+	// dialing are the clients being connected, by the key of their credentials
+	dialing map[string]*pendingDial
+	closed  bool
+}
+
+// GetNatsClientPool define new NatsClientPool
+//
+// Clients connect with the settings of base, with the credentials resolved by provider. A
+// tenant's credentials are resolved again once they are older than idleTimeout, and a client
+// is closed once no one has used it for idleTimeout.
+func GetNatsClientPool(
+	base NATSConnectParams,
+	provider CredentialProvider,
+	idleTimeout time.Duration,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (NatsClientPool, error) {
+	logTags := log.Fields{
+		"module":    "core",
+		"component": "nats-client-pool",
+		"instance":  base.ServerURI,
+	}
+	if idleTimeout <= 0 {
+		return nil, fmt.Errorf("client idle timeout must be positive")
+	}
+	timer, err := common.GetIntervalTimerInstance("nats-client-pool", rootCtxt, wg)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		return nil, err
+	}
+	// Tenant clients only log connection events; the callbacks of base may act on the
+	// process' own connection
+	base.OnDisconnectCallback = func(_ *nats.Conn, e error) {
+		log.WithError(e).WithFields(logTags).Warn("Tenant client disconnected")
+	}
+	base.OnReconnectCallback = func(_ *nats.Conn) {
+		log.WithFields(logTags).Info("Tenant client reconnected")
+	}
+	base.OnCloseCallback = func(_ *nats.Conn) {
+		log.WithFields(logTags).Debug("Tenant client closed")
+	}
+	instance := &natsClientPoolImpl{
+		Component:   common.Component{LogTags: logTags},
+		base:        base,
+		provider:    provider,
+		idleTimeout: idleTimeout,
+		timer:       timer,
+		tenants:     make(map[string]resolvedTenant),
+		clients:     make(map[string]*pooledClient),
+		dialing:     make(map[string]*pendingDial),
+	}
+	if err := timer.Start(idleTimeout/2, instance.evictIdle, false); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to start timer")
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Acquire fetches a client connected with the credentials of a tenant
+func (p *natsClientPoolImpl) Acquire(
+	tenant string, ctxt context.Context,
+) (*NatsClient, func(), error) {
+	localLogTags, err := common.UpdateLogTags(p.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(p.LogTags).Errorf("Failed to update logtags")
+		return nil, nil, err
+	}
+
+	// Resolve the tenant's credentials, unless recently resolved
+	p.lock.Lock()
+	resolved, ok := p.tenants[tenant]
+	p.lock.Unlock()
+	if !ok || time.Since(resolved.resolved) > p.idleTimeout {
+		creds, err := p.provider.Credentials(tenant, ctxt)
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf(
+				"Unable to resolve credentials of tenant %s", tenant,
+			)
+			return nil, nil, err
+		}
+		resolved = resolvedTenant{credsKey: creds.key(), creds: creds, resolved: time.Now()}
+		p.lock.Lock()
+		p.tenants[tenant] = resolved
+		p.lock.Unlock()
+	}
+
+	// Connecting can take a while, so it is done outside the lock, and only once for
+	// concurrent requests with the same credentials
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, nil, fmt.Errorf("client pool closed")
+		}
+		if entry, ok := p.clients[resolved.credsKey]; ok {
+			client, release := p.use(entry)
+			p.lock.Unlock()
+			return client, release, nil
+		}
+		pending, dialing := p.dialing[resolved.credsKey]
+		if !dialing {
+			pending = &pendingDial{done: make(chan struct{})}
+			p.dialing[resolved.credsKey] = pending
+		}
+		p.lock.Unlock()
+
+		if dialing {
+			select {
+			case <-pending.done:
+			case <-ctxt.Done():
+				return nil, nil, ctxt.Err()
+			}
+			if pending.err != nil {
+				return nil, nil, pending.err
+			}
+			continue
+		}
+
+		client, err := p.connect(resolved.creds)
+		p.lock.Lock()
+		delete(p.dialing, resolved.credsKey)
+		pending.err = err
+		close(pending.done)
+		if err != nil {
+			p.lock.Unlock()
+			log.WithError(err).WithFields(localLogTags).Errorf(
+				"Unable to connect client for tenant %s", tenant,
+			)
+			return nil, nil, err
+		}
+		if p.closed {
+			p.lock.Unlock()
+			client.nc.Close()
+			return nil, nil, fmt.Errorf("client pool closed")
+		}
+		entry, ok := p.clients[resolved.credsKey]
+		if ok {
+			// Lost the race to another connect
+			client.nc.Close()
+		} else {
+			log.WithFields(localLogTags).Infof("Connected client for tenant %s", tenant)
+			entry = &pooledClient{client: client}
+			p.clients[resolved.credsKey] = entry
+		}
+		pooled, release := p.use(entry)
+		p.lock.Unlock()
+		return pooled, release, nil
+	}
+}
+
+// connect helper function to connect a new client with the credentials
+func (p *natsClientPoolImpl) connect(creds NATSCredentials) (*NatsClient, error) {
+	param := p.base
+	param.Credentials = creds
+	client, err := GetJetStream(param)
+	if err != nil {
+		if client.nc != nil {
+			client.nc.Close()
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// use helper function to take a reference to a client, returning the function to release
+// it. Must be called with the lock held.
+func (p *natsClientPoolImpl) use(entry *pooledClient) (*NatsClient, func()) {
+	entry.users++
+	entry.lastUsed = time.Now()
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			entry.users--
+			entry.lastUsed = time.Now()
+		})
+	}
+	return entry.client, release
+}
+
+// evictIdle support IntervalTimer, close clients which have been idle for idleTimeout
+func (p *natsClientPoolImpl) evictIdle() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for credsKey, entry := range p.clients {
+		if entry.users == 0 && now.Sub(entry.lastUsed) > p.idleTimeout {
+			log.WithFields(p.LogTags).Debugf("Closing idle tenant client")
+			entry.client.nc.Close()
+			delete(p.clients, credsKey)
+		}
+	}
+	for tenant, resolved := range p.tenants {
+		if now.Sub(resolved.resolved) > p.idleTimeout {
+			delete(p.tenants, tenant)
+		}
+	}
+	return nil
+}
+
+// Close closes all clients
+func (p *natsClientPoolImpl) Close(ctxt context.Context) {
+	if err := p.timer.Stop(); err != nil {
+		log.WithError(err).WithFields(p.LogTags).Errorf("Failed to stop timer")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for credsKey, entry := range p.clients {
+		entry.client.Close(ctxt)
+		delete(p.clients, credsKey)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// ErrUnknownTenant returned when a credential provider has no credentials for a tenant
+var ErrUnknownTenant = errors.New("no credentials for tenant")
+
+// NATSCredentials credentials for connecting with NATS. Set one of: CredsFile; JWT and
+// Seed; Token; or User and Password. If none are set, the connection is anonymous.
+type NATSCredentials struct {
+	// CredsFile is the path of a NATS credentials file
+	CredsFile string `json:"creds_file,omitempty"`
+	// JWT is the user JWT
+	JWT string `json:"jwt,omitempty"`
+	// Seed is the user NKey seed, which signs the server nonce
+	Seed string `json:"seed,omitempty"`
+	// Token is the authentication token
+	Token string `json:"token,omitempty"`
+	// User is the user name
+	User string `json:"user,omitempty"`
+	// Password is the user password
+	Password string `json:"password,omitempty"`
+}
+
+// connectOptions helper function to define the NATS connect options for the credentials
+func (c NATSCredentials) connectOptions() ([]nats.Option, error) {
+	switch {
+	case c.CredsFile != "":
+		return []nats.Option{nats.UserCredentials(c.CredsFile)}, nil
+	case c.JWT != "" || c.Seed != "":
+		if c.JWT == "" || c.Seed == "" {
+			return nil, fmt.Errorf("user JWT and seed must be set together")
+		}
+		keyPair, err := nkeys.FromSeed([]byte(c.Seed))
+		if err != nil {
+			return nil, err
+		}
+		return []nats.Option{nats.UserJWT(
+			func() (string, error) { return c.JWT, nil },
+			func(nonce []byte) ([]byte, error) { return keyPair.Sign(nonce) },
+		)}, nil
+	case c.Token != "":
+		return []nats.Option{nats.Token(c.Token)}, nil
+	case c.User != "":
+		return []nats.Option{nats.UserInfo(c.User, c.Password)}, nil
+	}
+	return nil, nil
+}
+
+// key returns a digest identifying the credentials, without exposing them
+func (c NATSCredentials) key() string {
+	serialized, _ := json.Marshal(&c)
+	digest := sha256.Sum256(serialized)
+	return hex.EncodeToString(digest[:])
+}
+
+// CredentialProvider resolves the NATS credentials a tenant's requests are served with
+type CredentialProvider interface {
+	// Credentials resolves the NATS credentials of a tenant. Returns ErrUnknownTenant if the
+	// provider has no credentials for the tenant.
+	Credentials(tenant string, ctxt context.Context) (NATSCredentials, error)
+}
+
+// ==============================================================================
+
+// fileCredentialProvider implements CredentialProvider with a credentials file per tenant
+type fileCredentialProvider struct {
+	common.Component
+	dir string
+}
+
+// GetFileCredentialProvider define CredentialProvider which reads the credentials of each
+// tenant from the NATS credentials file "<dir>/<tenant>.creds". The tenant name is path
+// escaped, e.g. "spiffe://cluster/app" is read from "spiffe:%2F%2Fcluster%2Fapp.creds".
+func GetFileCredentialProvider(dir string) (CredentialProvider, error) {
+	logTags := log.Fields{
+		"module":    "core",
+		"component": "file-credential-provider",
+		"instance":  dir,
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to read credentials directory")
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &fileCredentialProvider{Component: common.Component{LogTags: logTags}, dir: dir}, nil
+}
+
+// Credentials resolves the NATS credentials of a tenant
+func (p *fileCredentialProvider) Credentials(
+	tenant string, ctxt context.Context,
+) (NATSCredentials, error) {
+	localLogTags, err := common.UpdateLogTags(p.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(p.LogTags).Errorf("Failed to update logtags")
+		return NATSCredentials{}, err
+	}
+	credsFile := filepath.Join(p.dir, url.PathEscape(tenant)+".creds")
+	if _, err := os.Stat(credsFile); errors.Is(err, os.ErrNotExist) {
+		return NATSCredentials{}, fmt.Errorf("%w %s", ErrUnknownTenant, tenant)
+	} else if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to read %s", credsFile)
+		return NATSCredentials{}, err
+	}
+	return NATSCredentials{CredsFile: credsFile}, nil
+}
+
+// ==============================================================================
+
+// httpCredentialProvider implements CredentialProvider by calling out to an HTTP service
+type httpCredentialProvider struct {
+	common.Component
+	client  *http.Client
+	headers map[string]string
+	// requestURL defines the URL to request the credentials of a tenant from
+	requestURL func(tenant string) string
+	// readData extracts the credentials from the response body
+	readData func(body []byte) (NATSCredentials, error)
+}
+
+// GetHTTPCredentialProvider define CredentialProvider which calls out to an external service
+// for the credentials of each tenant.
+//
+// The credentials are requested with "GET <endpoint>?tenant=<tenant>", and the service
+// should reply with NATSCredentials as JSON, or 404 if it has no credentials for the tenant.
+// If token is not empty, requests carry "Authorization: Bearer <token>".
+func GetHTTPCredentialProvider(
+	endpoint, token string, timeout time.Duration,
+) (CredentialProvider, error) {
+	logTags := log.Fields{
+		"module":    "core",
+		"component": "http-credential-provider",
+		"instance":  endpoint,
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid credential service URL")
+		return nil, err
+	}
+	headers := map[string]string{}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return &httpCredentialProvider{
+		Component: common.Component{LogTags: logTags},
+		client:    &http.Client{Timeout: timeout},
+		headers:   headers,
+		requestURL: func(tenant string) string {
+			return fmt.Sprintf("%s?tenant=%s", endpoint, url.QueryEscape(tenant))
+		},
+		readData: func(body []byte) (NATSCredentials, error) {
+			var creds NATSCredentials
+			err := json.Unmarshal(body, &creds)
+			return creds, err
+		},
+	}, nil
+}
+
+// GetVaultCredentialProvider define CredentialProvider which reads the credentials of each
+// tenant from HashiCorp Vault.
+//
+// The credentials of a tenant are the fields of the secret "<path>/<tenant>", e.g. with a KV
+// version 2 engine mounted at "secret", path "secret/data/httpmq" reads the secret written
+// with "vault kv put secret/httpmq/<tenant> creds_file=... ". The fields are those of
+// NATSCredentials as JSON.
+func GetVaultCredentialProvider(
+	address, token, path string, timeout time.Duration,
+) (CredentialProvider, error) {
+	logTags := log.Fields{
+		"module":    "core",
+		"component": "vault-credential-provider",
+		"instance":  address,
+	}
+	if _, err := url.ParseRequestURI(address); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid Vault address")
+		return nil, err
+	}
+	if path == "" {
+		return nil, fmt.Errorf("vault secret path must be set")
+	}
+	return &httpCredentialProvider{
+		Component: common.Component{LogTags: logTags},
+		client:    &http.Client{Timeout: timeout},
+		headers:   map[string]string{"X-Vault-Token": token},
+		requestURL: func(tenant string) string {
+			return fmt.Sprintf(
+				"%s/v1/%s/%s",
+				strings.TrimSuffix(address, "/"),
+				strings.Trim(path, "/"),
+				url.PathEscape(tenant),
+			)
+		},
+		readData: func(body []byte) (NATSCredentials, error) {
+			// KV version 2 nests the secret fields one level deeper than version 1
+			var secret struct {
+				Data struct {
+					NATSCredentials
+					Data *NATSCredentials `json:"data"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &secret); err != nil {
+				return NATSCredentials{}, err
+			}
+			if secret.Data.Data != nil {
+				return *secret.Data.Data, nil
+			}
+			return secret.Data.NATSCredentials, nil
+		},
+	}, nil
+}
+
+// Credentials resolves the NATS credentials of a tenant
+func (p *httpCredentialProvider) Credentials(
+	tenant string, ctxt context.Context,
+) (NATSCredentials, error) {
+	localLogTags, err := common.UpdateLogTags(p.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(p.LogTags).Errorf("Failed to update logtags")
+		return NATSCredentials{}, err
+	}
+	req, err := http.NewRequestWithContext(ctxt, http.MethodGet, p.requestURL(tenant), nil)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to define request")
+		return NATSCredentials{}, err
+	}
+	for header, value := range p.headers {
+		req.Header.Set(header, value)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Credentials request failed")
+		return NATSCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return NATSCredentials{}, fmt.Errorf("%w %s", ErrUnknownTenant, tenant)
+	}
+	body := bytes.Buffer{}
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to read credentials response")
+		return NATSCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("credentials request returned %d", resp.StatusCode)
+		log.WithError(err).WithFields(localLogTags).Errorf("Credentials request failed")
+		return NATSCredentials{}, err
+	}
+	creds, err := p.readData(body.Bytes())
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to parse credentials response")
+		return NATSCredentials{}, err
+	}
+	return creds, nil
+}
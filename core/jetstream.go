@@ -16,6 +16,8 @@ package core
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/alwitt/httpmq/common"
@@ -33,6 +35,15 @@ type NATSConnectParams struct {
 	MaxReconnectAttempt int `validate:"gte=-1"`
 	// wait duration between reconnect attempts
 	ReconnectWait time.Duration
+	// max number of publishes awaiting JetStream ACK. "0" means no limit
+	PublishAsyncMaxPending int `validate:"gte=0"`
+	// JetStream domain to operate in, e.g. of a leafnode connected cluster. Optional.
+	JetStreamDomain string
+	// prefix of the JetStream API subjects, e.g. when imported from another account.
+	// Optional, and can not be used with JetStreamDomain.
+	JetStreamAPIPrefix string
+	// credentials to connect with. Optional.
+	Credentials NATSCredentials
 	// callback on client disconnect
 	OnDisconnectCallback func(*nats.Conn, error)
 	// callback on client reconnect
@@ -44,8 +55,10 @@ type NATSConnectParams struct {
 // NatsClient is a wrapper around NATS client handle objects
 type NatsClient struct {
 	common.Component
-	nc *nats.Conn
-	js nats.JetStreamContext
+	nc        *nats.Conn
+	js        nats.JetStreamContext
+	domain    string
+	apiPrefix string
 }
 
 // Close closes a JetStream client
@@ -67,6 +80,30 @@ func (js *NatsClient) JetStream() nats.JetStreamContext {
 	return js.js
 }
 
+// JetStreamDomain fetches the JetStream domain the client operates in. Empty if the client
+// uses the default domain.
+func (js *NatsClient) JetStreamDomain() string {
+	return js.domain
+}
+
+// JetStreamAPIPrefix fetches the prefix of the JetStream API subjects. Empty if the client
+// uses the default prefix.
+func (js *NatsClient) JetStreamAPIPrefix() string {
+	return js.apiPrefix
+}
+
+// JetStreamAPISubject builds the subject of a JetStream API call, e.g. "STREAM.PURGE.<name>",
+// for requests not covered by the JetStream client handle
+func (js *NatsClient) JetStreamAPISubject(api string) string {
+	if js.domain != "" {
+		return fmt.Sprintf("$JS.%s.API.%s", js.domain, api)
+	}
+	if js.apiPrefix != "" {
+		return fmt.Sprintf("%s.%s", strings.TrimSuffix(js.apiPrefix, "."), api)
+	}
+	return fmt.Sprintf("$JS.API.%s", api)
+}
+
 // GetJetStream defines a new NATS client object wrapper
 //
 // NOTE: Function will also attempt to connect with NATs server
@@ -76,16 +113,28 @@ func GetJetStream(param NATSConnectParams) (*NatsClient, error) {
 		"component": "jetstream-backend",
 		"instance":  param.ServerURI,
 	}
+	if param.JetStreamDomain != "" && param.JetStreamAPIPrefix != "" {
+		err := fmt.Errorf("JetStream domain and API prefix are mutually exclusive")
+		log.WithError(err).WithFields(logTags).Errorf("Invalid JetStream settings")
+		return &NatsClient{}, err
+	}
+	credsOpts, err := param.Credentials.connectOptions()
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid NATS credentials")
+		return &NatsClient{}, err
+	}
 	// Create the NATS transport
 	nc, err := nats.Connect(
 		param.ServerURI,
-		nats.Timeout(param.ConnectTimeout),
-		nats.RetryOnFailedConnect(true),
-		nats.MaxReconnects(param.MaxReconnectAttempt),
-		nats.ReconnectWait(param.ReconnectWait),
-		nats.DisconnectErrHandler(param.OnDisconnectCallback),
-		nats.ReconnectHandler(param.OnReconnectCallback),
-		nats.ClosedHandler(param.OnCloseCallback),
+		append([]nats.Option{
+			nats.Timeout(param.ConnectTimeout),
+			nats.RetryOnFailedConnect(true),
+			nats.MaxReconnects(param.MaxReconnectAttempt),
+			nats.ReconnectWait(param.ReconnectWait),
+			nats.DisconnectErrHandler(param.OnDisconnectCallback),
+			nats.ReconnectHandler(param.OnReconnectCallback),
+			nats.ClosedHandler(param.OnCloseCallback),
+		}, credsOpts...)...,
 	)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf("NATS client connect failed")
@@ -93,7 +142,18 @@ func GetJetStream(param NATSConnectParams) (*NatsClient, error) {
 	}
 
 	// Define the JetStream client
-	js, err := nc.JetStream()
+	jsOpts := []nats.JSOpt{}
+	if param.PublishAsyncMaxPending > 0 {
+		jsOpts = append(jsOpts, nats.PublishAsyncMaxPending(param.PublishAsyncMaxPending))
+	}
+	if param.JetStreamDomain != "" {
+		logTags["js_domain"] = param.JetStreamDomain
+		jsOpts = append(jsOpts, nats.Domain(param.JetStreamDomain))
+	} else if param.JetStreamAPIPrefix != "" {
+		logTags["js_api_prefix"] = param.JetStreamAPIPrefix
+		jsOpts = append(jsOpts, nats.APIPrefix(param.JetStreamAPIPrefix))
+	}
+	js, err := nc.JetStream(jsOpts...)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Error(
 			"Failed to define JetStream client",
@@ -106,5 +166,7 @@ func GetJetStream(param NATSConnectParams) (*NatsClient, error) {
 		Component: common.Component{LogTags: logTags},
 		nc:        nc,
 		js:        js,
+		domain:    param.JetStreamDomain,
+		apiPrefix: param.JetStreamAPIPrefix,
 	}, err
 }
@@ -18,7 +18,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
@@ -35,6 +38,49 @@ type AckSeqNum struct {
 	Consumer uint64 `json:"consumer" validate:"required"`
 }
 
+// AckType is the kind of acknowledgement given for a NATs JetStream message
+type AckType string
+
+const (
+	// AckTypeAck the message was processed
+	AckTypeAck AckType = "ack"
+	// AckTypeNak the message was not processed, and should be delivered again
+	AckTypeNak AckType = "nak"
+	// AckTypeTerm the message should not be delivered again, though it was not processed
+	AckTypeTerm AckType = "term"
+	// AckTypeProgress the message is still being processed; it remains inflight, and its
+	// ACK deadline is restarted
+	AckTypeProgress AckType = "progress"
+)
+
+// replyPayload the payload sent on a message's ACK reply subject for this kind of ACK
+func (t AckType) replyPayload() []byte {
+	switch t {
+	case AckTypeNak:
+		return []byte("-NAK")
+	case AckTypeTerm:
+		return []byte("+TERM")
+	case AckTypeProgress:
+		return []byte("+WPI")
+	default:
+		return []byte("+ACK")
+	}
+}
+
+// ackMessage send the ACK of a kind for a message
+func ackMessage(msg *nats.Msg, ackType AckType) error {
+	switch ackType {
+	case AckTypeNak:
+		return msg.Nak()
+	case AckTypeTerm:
+		return msg.Term()
+	case AckTypeProgress:
+		return msg.InProgress()
+	default:
+		return msg.AckSync()
+	}
+}
+
 // AckIndication is the ACK of a NATs JetStream message which contains its key parameters
 type AckIndication struct {
 	// Stream is the name of the stream
@@ -43,20 +89,122 @@ type AckIndication struct {
 	Consumer string `json:"consumer" validate:"required"`
 	// SeqNum is the sequence number of the JetStream message
 	SeqNum AckSeqNum `json:"seq_num" validate:"required,dive"`
+	// Type is the kind of ACK. Empty is the same as AckTypeAck.
+	Type AckType `json:"type,omitempty" validate:"omitempty,oneof=ack nak term progress"`
+	// Domain is the JetStream domain of the stream, if any
+	Domain string `json:"domain,omitempty"`
+	// NumDelivered is the number of times the message was delivered
+	NumDelivered uint64 `json:"num_delivered,omitempty"`
+	// NumPending is the number of messages pending for the consumer when it was delivered
+	NumPending uint64 `json:"num_pending,omitempty"`
+	// Timestamp is when the message was published
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// Kind the kind of ACK, defaulting to AckTypeAck
+func (m AckIndication) Kind() AckType {
+	if m.Type == "" {
+		return AckTypeAck
+	}
+	return m.Type
 }
 
 // String toString for ackIndication
 func (m AckIndication) String() string {
 	return fmt.Sprintf(
-		"%s@%s:ACK[S:%d, C:%d]", m.Consumer, m.Stream, m.SeqNum.Stream, m.SeqNum.Consumer,
+		"%s@%s:%s[S:%d, C:%d]",
+		m.Consumer,
+		m.Stream,
+		strings.ToUpper(string(m.Kind())),
+		m.SeqNum.Stream,
+		m.SeqNum.Consumer,
 	)
 }
 
+// withReplyFields fill in the fields of the ACK not yet set from the ACK reply subject of
+// the message. The ACK is unchanged if the subject can not be parsed.
+func (m AckIndication) withReplyFields(reply string) AckIndication {
+	parsed, err := ParseAckReplySubject(reply)
+	if err != nil {
+		return m
+	}
+	if m.Domain == "" {
+		m.Domain = parsed.Domain
+	}
+	if m.NumDelivered == 0 {
+		m.NumDelivered = parsed.NumDelivered
+	}
+	if m.NumPending == 0 {
+		m.NumPending = parsed.NumPending
+	}
+	if m.Timestamp == nil {
+		m.Timestamp = parsed.Timestamp
+	}
+	return m
+}
+
+// ParseAckReplySubject parse the ACK reply subject of a NATs JetStream message into the
+// ACK of the message. Both the subject format with, and without, a JetStream domain are
+// supported.
+//
+//	$JS.ACK.<stream>.<consumer>.<delivered>.<stream seq>.<consumer seq>.<timestamp>.<pending>
+//	$JS.ACK.<domain>.<account hash>.<stream>.<consumer>.<delivered>.<stream seq>...
+func ParseAckReplySubject(reply string) (AckIndication, error) {
+	tokens := strings.Split(reply, ".")
+	if len(tokens) < 9 || tokens[0] != "$JS" || tokens[1] != "ACK" {
+		return AckIndication{}, fmt.Errorf("not a JetStream ACK reply subject: %s", reply)
+	}
+	// Position of the stream name, after the domain and account hash if present
+	offset := 2
+	var domain string
+	if len(tokens) >= 11 {
+		offset = 4
+		if tokens[2] != "_" {
+			domain = tokens[2]
+		}
+	} else if len(tokens) != 9 {
+		return AckIndication{}, fmt.Errorf("not a JetStream ACK reply subject: %s", reply)
+	}
+	numbers := make([]uint64, 5)
+	for itr := range numbers {
+		value, err := strconv.ParseUint(tokens[offset+2+itr], 10, 64)
+		if err != nil {
+			return AckIndication{}, fmt.Errorf("invalid JetStream ACK reply subject %s: %w", reply, err)
+		}
+		numbers[itr] = value
+	}
+	timestamp := time.Unix(0, int64(numbers[3]))
+	return AckIndication{
+		Stream:       tokens[offset],
+		Consumer:     tokens[offset+1],
+		SeqNum:       AckSeqNum{Stream: numbers[1], Consumer: numbers[2]},
+		Domain:       domain,
+		NumDelivered: numbers[0],
+		NumPending:   numbers[4],
+		Timestamp:    &timestamp,
+	}, nil
+}
+
 // defineACKBroadcastSubject helper function to define a NATs subject based on stream and consumer
 func defineACKBroadcastSubject(stream, consumer string) string {
 	return fmt.Sprintf("ack-rx.%s.%s", stream, consumer)
 }
 
+// DefineExternalACKSubject define the NATs subject external workers send the ACKs of a
+// consumer's messages to, given the configured subject prefix
+func DefineExternalACKSubject(prefix, stream, consumer string) string {
+	return fmt.Sprintf("%s.%s.%s", prefix, stream, consumer)
+}
+
+// ExternalACKReply is the reply to an ACK received on the external ACK subject, if the
+// sender asked for one
+type ExternalACKReply struct {
+	// Success indicates whether the ACK was accepted for processing
+	Success bool `json:"success"`
+	// Error describes why the ACK was rejected
+	Error string `json:"error,omitempty"`
+}
+
 // JetStreamAckHandler is the function signature for callback processing a JetStream ACK
 type JetStreamAckHandler func(AckIndication, context.Context)
 
@@ -71,17 +219,23 @@ type JetStreamACKReceiver interface {
 // jetStreamACKReceiverImpl implements JetStreamACKReceiver
 type jetStreamACKReceiverImpl struct {
 	common.Component
-	ackSubject      string
-	nats            *core.NatsClient
-	subscribed      bool
-	ackSubscription *nats.Subscription
-	lock            *sync.Mutex
-	validate        *validator.Validate
+	stream, consumer string
+	ackSubject       string
+	// externalACKSubject is the subject external workers send ACKs to, if enabled
+	externalACKSubject string
+	nats               *core.NatsClient
+	subscribed         bool
+	ackSubscriptions   []*nats.Subscription
+	lock               *sync.Mutex
+	validate           *validator.Validate
 }
 
 // getJetStreamACKReceiver define JetStreamACKReceiver
+//
+// Besides the ACKs broadcast by the dataplane servers, if externalACKPrefix is not empty,
+// ACKs sent by external workers on the subject DefineExternalACKSubject are also received.
 func getJetStreamACKReceiver(
-	natsClient *core.NatsClient, stream, subject, consumer string,
+	natsClient *core.NatsClient, stream, subject, consumer, externalACKPrefix string,
 ) (JetStreamACKReceiver, error) {
 	ackSubject := defineACKBroadcastSubject(stream, consumer)
 	logTags := log.Fields{
@@ -91,14 +245,24 @@ func getJetStreamACKReceiver(
 		"subject":   subject,
 		"consumer":  consumer,
 	}
+	externalACKSubject := ""
+	if externalACKPrefix != "" {
+		externalACKSubject = DefineExternalACKSubject(externalACKPrefix, stream, consumer)
+		if externalACKSubject == ackSubject {
+			return nil, fmt.Errorf("external ACK subject prefix %s is reserved", externalACKPrefix)
+		}
+	}
 	return &jetStreamACKReceiverImpl{
-		Component:       common.Component{LogTags: logTags},
-		ackSubject:      ackSubject,
-		nats:            natsClient,
-		subscribed:      false,
-		ackSubscription: nil,
-		lock:            new(sync.Mutex),
-		validate:        validator.New(),
+		Component:          common.Component{LogTags: logTags},
+		stream:             stream,
+		consumer:           consumer,
+		ackSubject:         ackSubject,
+		externalACKSubject: externalACKSubject,
+		nats:               natsClient,
+		subscribed:         false,
+		ackSubscriptions:   nil,
+		lock:               new(sync.Mutex),
+		validate:           validator.New(),
 	}, nil
 }
 
@@ -118,50 +282,92 @@ func (r *jetStreamACKReceiverImpl) SubscribeForACKs(
 		return err
 	}
 	r.subscribed = true
-	// Subscribe to the ACK channel for updates
-	ackSub, err := r.nats.NATs().Subscribe(r.ackSubject, func(msg *nats.Msg) {
-		// Process the message
-		var ackInfo AckIndication
-		if err := json.Unmarshal(msg.Data, &ackInfo); err != nil {
-			log.WithError(err).WithFields(localLogTags).Errorf(
-				"Failed to read ACK message: %s", msg.Data,
-			)
-			return
-		}
-		// Validate the message
-		if err := r.validate.Struct(&ackInfo); err != nil {
+	// Subscribe to the ACK channels for updates
+	subjects := []string{r.ackSubject}
+	if r.externalACKSubject != "" {
+		subjects = append(subjects, r.externalACKSubject)
+	}
+	for _, ackSubject := range subjects {
+		external := ackSubject == r.externalACKSubject
+		ackSub, err := r.nats.NATs().Subscribe(ackSubject, func(msg *nats.Msg) {
+			r.receiveACK(msg, external, handler, opContext, localLogTags)
+		})
+		if err != nil {
 			log.WithError(err).WithFields(localLogTags).Errorf(
-				"Failed to validate ACK message: %s", msg.Data,
+				"Failed to subscribe to ACK channel %s", ackSubject,
 			)
-			return
+			r.unsubscribe(localLogTags)
+			return err
 		}
-		// Forward the message
-		log.WithFields(localLogTags).Debugf("Received %s", ackInfo.String())
-		handler(ackInfo, opContext)
-	})
-	if err != nil {
-		log.WithError(err).WithFields(localLogTags).Errorf(
-			"Failed to subscribe to ACK channel %s", r.ackSubject,
-		)
-		return err
+		r.ackSubscriptions = append(r.ackSubscriptions, ackSub)
 	}
-	r.ackSubscription = ackSub
 	// Handler to automatically un-subscribe once the context is over
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		<-opContext.Done()
-		log.WithFields(localLogTags).Debugf("Unsubscribing from ACK channel %s", r.ackSubject)
-		if err := r.ackSubscription.Unsubscribe(); err != nil {
-			log.WithError(err).WithFields(localLogTags).Errorf(
-				"Error occurred when unsubscribing from ACK channel %s", r.ackSubject,
-			)
-		}
-		log.WithFields(localLogTags).Infof("Unsubscribed from ACK channel %s", r.ackSubject)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.unsubscribe(localLogTags)
 	}()
 	return nil
 }
 
+// receiveACK process a message received on an ACK channel, and forward the ACK to handler.
+// ACKs from external workers must be for this receiver's consumer, and are replied to if
+// the sender asked for a reply.
+func (r *jetStreamACKReceiverImpl) receiveACK(
+	msg *nats.Msg,
+	external bool,
+	handler JetStreamAckHandler,
+	opContext context.Context,
+	logTags log.Fields,
+) {
+	var ackInfo AckIndication
+	err := json.Unmarshal(msg.Data, &ackInfo)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Failed to read ACK message: %s", msg.Data)
+	} else if err = r.validate.Struct(&ackInfo); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Failed to validate ACK message: %s", msg.Data)
+	} else if external && (ackInfo.Stream != r.stream || ackInfo.Consumer != r.consumer) {
+		err = fmt.Errorf("ACK is not for %s@%s", r.consumer, r.stream)
+		log.WithError(err).WithFields(logTags).Errorf("Rejecting external %s", ackInfo.String())
+	}
+	if external && msg.Reply != "" {
+		reply := ExternalACKReply{Success: err == nil}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		if payload, err := json.Marshal(&reply); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to serialize external ACK reply")
+		} else if err := msg.Respond(payload); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Failed to reply to external ACK")
+		}
+	}
+	if err != nil {
+		return
+	}
+	// Forward the message
+	common.ThrottledDebugf(log.WithFields(logTags), "Received %s", ackInfo.String())
+	handler(ackInfo, opContext)
+}
+
+// unsubscribe helper function to stop receiving on the ACK channels. The caller must hold
+// the lock.
+func (r *jetStreamACKReceiverImpl) unsubscribe(logTags log.Fields) {
+	for _, ackSub := range r.ackSubscriptions {
+		log.WithFields(logTags).Debugf("Unsubscribing from ACK channel %s", ackSub.Subject)
+		if err := ackSub.Unsubscribe(); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf(
+				"Error occurred when unsubscribing from ACK channel %s", ackSub.Subject,
+			)
+			continue
+		}
+		log.WithFields(logTags).Infof("Unsubscribed from ACK channel %s", ackSub.Subject)
+	}
+	r.ackSubscriptions = nil
+}
+
 // ==============================================================================
 
 // JetStreamACKBroadcaster broadcasts JetStream message ACK through NATs subjects
@@ -210,11 +416,11 @@ func (t *jetStreamACKBroadcasterImpl) BroadcastACK(ack AckIndication, ctxt conte
 		log.WithError(err).WithFields(localLogTags).Errorf("Unable to serialize ACK %s", ack)
 		return err
 	}
-	log.WithFields(localLogTags).Debugf("Sending %s on %s", ack, subject)
+	common.ThrottledDebugf(log.WithFields(localLogTags), "Sending %s on %s", ack, subject)
 	if err := t.nats.NATs().Publish(subject, msg); err != nil {
 		log.WithError(err).WithFields(localLogTags).Errorf("Failed to send ACK %s on %s", ack, subject)
 		return err
 	}
-	log.WithFields(localLogTags).Debugf("Sent %s on %s", ack, subject)
+	common.ThrottledDebugf(log.WithFields(localLogTags), "Sent %s on %s", ack, subject)
 	return nil
 }
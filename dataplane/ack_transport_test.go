@@ -16,6 +16,7 @@ package dataplane
 
 import (
 	"context"
+	"encoding/json"
 	"sync"
 	"testing"
 	"time"
@@ -76,7 +77,7 @@ func TestAckTransport(t *testing.T) {
 
 	uutTX, err := GetJetStreamACKBroadcaster(js, testName)
 	assert.Nil(err)
-	uutRX1, err := getJetStreamACKReceiver(js, testStream, dummySubject, testConsumer1)
+	uutRX1, err := getJetStreamACKReceiver(js, testStream, dummySubject, testConsumer1, "")
 	assert.Nil(err)
 
 	// Case 0: start subscription on uutRX1
@@ -112,7 +113,7 @@ func TestAckTransport(t *testing.T) {
 		}
 	}
 
-	uutRX2, err := getJetStreamACKReceiver(js, testStream, dummySubject, testConsumer1)
+	uutRX2, err := getJetStreamACKReceiver(js, testStream, dummySubject, testConsumer1, "")
 	assert.Nil(err)
 	rxChan2 := make(chan AckIndication, 1)
 	ackHandler2 := func(ack AckIndication, _ context.Context) {
@@ -150,7 +151,7 @@ func TestAckTransport(t *testing.T) {
 		}
 	}
 
-	uutRX3, err := getJetStreamACKReceiver(js, testStream, dummySubject, testConsumer2)
+	uutRX3, err := getJetStreamACKReceiver(js, testStream, dummySubject, testConsumer2, "")
 	assert.Nil(err)
 	rxChan3 := make(chan AckIndication, 1)
 	ackHandler3 := func(ack AckIndication, _ context.Context) {
@@ -192,4 +193,199 @@ func TestAckTransport(t *testing.T) {
 			assert.False(true)
 		}
 	}
+
+	externalPrefix := "ut-external-ack"
+	uutRX4, err := getJetStreamACKReceiver(
+		js, testStream, dummySubject, testConsumer2, externalPrefix,
+	)
+	assert.Nil(err)
+	rxChan4 := make(chan AckIndication, 2)
+	ackHandler4 := func(ack AckIndication, _ context.Context) {
+		rxChan4 <- ack
+	}
+	err = uutRX4.SubscribeForACKs(&wg, utCtxt, ackHandler4)
+	assert.Nil(err)
+
+	// Case 4: ACK from an external worker, with a reply
+	ack4 := AckIndication{
+		Stream:   testStream,
+		Consumer: testConsumer2,
+		SeqNum: AckSeqNum{
+			Stream:   4,
+			Consumer: 33,
+		},
+	}
+	{
+		payload, err := json.Marshal(&ack4)
+		assert.Nil(err)
+		resp, err := js.NATs().Request(
+			DefineExternalACKSubject(externalPrefix, testStream, testConsumer2), payload, time.Second,
+		)
+		assert.Nil(err)
+		var reply ExternalACKReply
+		assert.Nil(json.Unmarshal(resp.Data, &reply))
+		assert.True(reply.Success)
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		select {
+		case ackMsg, ok := <-rxChan4:
+			assert.True(ok)
+			assert.EqualValues(ack4, ackMsg)
+		case <-ctxt.Done():
+			assert.False(true)
+		}
+	}
+
+	// Case 5: broadcast ACKs are still received with external ACKs enabled
+	ack5 := ack4
+	ack5.SeqNum = AckSeqNum{Stream: 5, Consumer: 34}
+	assert.Nil(uutTX.BroadcastACK(ack5, utCtxt))
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		select {
+		case ackMsg, ok := <-rxChan4:
+			assert.True(ok)
+			assert.EqualValues(ack5, ackMsg)
+		case <-ctxt.Done():
+			assert.False(true)
+		}
+	}
+}
+
+func TestExternalACKValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: the external ACK subject can not be the broadcast subject
+	{
+		_, err := getJetStreamACKReceiver(nil, "stream", "subject", "consumer", "ack-rx")
+		assert.NotNil(err)
+	}
+
+	uut, err := getJetStreamACKReceiver(nil, "stream", "subject", "consumer", "external-ack")
+	assert.Nil(err)
+	uutCast, ok := uut.(*jetStreamACKReceiverImpl)
+	assert.True(ok)
+	assert.Equal("external-ack.stream.consumer", uutCast.externalACKSubject)
+
+	received := []AckIndication{}
+	handler := func(ack AckIndication, _ context.Context) {
+		received = append(received, ack)
+	}
+	ack := AckIndication{
+		Stream: "stream", Consumer: "consumer", SeqNum: AckSeqNum{Stream: 1, Consumer: 1},
+	}
+	ackMsg := func(ack AckIndication) *nats.Msg {
+		payload, err := json.Marshal(&ack)
+		assert.Nil(err)
+		return &nats.Msg{Data: payload}
+	}
+
+	// Case 1: valid external ACK is forwarded
+	{
+		uutCast.receiveACK(ackMsg(ack), true, handler, context.Background(), uutCast.LogTags)
+		assert.Equal([]AckIndication{ack}, received)
+	}
+
+	// Case 2: external ACK for another consumer is rejected
+	{
+		other := ack
+		other.Consumer = "other"
+		uutCast.receiveACK(ackMsg(other), true, handler, context.Background(), uutCast.LogTags)
+		assert.Len(received, 1)
+	}
+
+	// Case 3: external ACK missing sequence numbers is rejected
+	{
+		invalid := ack
+		invalid.SeqNum = AckSeqNum{}
+		uutCast.receiveACK(ackMsg(invalid), true, handler, context.Background(), uutCast.LogTags)
+		assert.Len(received, 1)
+	}
+
+	// Case 4: malformed external ACK is rejected
+	{
+		msg := &nats.Msg{Data: []byte("not JSON")}
+		uutCast.receiveACK(msg, true, handler, context.Background(), uutCast.LogTags)
+		assert.Len(received, 1)
+	}
+
+	// Case 5: external ACK of a known type is forwarded
+	{
+		nak := ack
+		nak.Type = AckTypeNak
+		uutCast.receiveACK(ackMsg(nak), true, handler, context.Background(), uutCast.LogTags)
+		assert.Equal([]AckIndication{ack, nak}, received)
+		assert.Equal("consumer@stream:NAK[S:1, C:1]", nak.String())
+	}
+
+	// Case 6: external ACK of an unknown type is rejected
+	{
+		invalid := ack
+		invalid.Type = "maybe"
+		uutCast.receiveACK(ackMsg(invalid), true, handler, context.Background(), uutCast.LogTags)
+		assert.Len(received, 2)
+	}
+}
+
+func TestParseAckReplySubject(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: subject without a domain
+	{
+		ack, err := ParseAckReplySubject("$JS.ACK.s.c.2.27.14.1634000000000000000.3")
+		assert.Nil(err)
+		assert.Equal("s", ack.Stream)
+		assert.Equal("c", ack.Consumer)
+		assert.Equal(AckSeqNum{Stream: 27, Consumer: 14}, ack.SeqNum)
+		assert.Equal(uint64(2), ack.NumDelivered)
+		assert.Equal(uint64(3), ack.NumPending)
+		assert.Equal("", ack.Domain)
+		assert.Equal(AckTypeAck, ack.Kind())
+		assert.NotNil(ack.Timestamp)
+		assert.Equal(int64(1634000000000000000), ack.Timestamp.UnixNano())
+	}
+
+	// Case 1: subject with a domain and account hash
+	{
+		ack, err := ParseAckReplySubject("$JS.ACK.hub.acc.s.c.1.5.4.1634000000000000000.0.rand")
+		assert.Nil(err)
+		assert.Equal("hub", ack.Domain)
+		assert.Equal("s", ack.Stream)
+		assert.Equal("c", ack.Consumer)
+		assert.Equal(AckSeqNum{Stream: 5, Consumer: 4}, ack.SeqNum)
+	}
+
+	// Case 2: "_" stands for no domain
+	{
+		ack, err := ParseAckReplySubject("$JS.ACK._.acc.s.c.1.5.4.1634000000000000000.0")
+		assert.Nil(err)
+		assert.Equal("", ack.Domain)
+		assert.Equal("s", ack.Stream)
+	}
+
+	// Case 3: invalid subjects
+	{
+		for _, reply := range []string{
+			"",
+			"reply.inbox",
+			"$JS.ACK.s.c.2.27.14",
+			"$JS.ACK.s.c.2.27.14.1634000000000000000.3.x",
+			"$JS.ACK.s.c.two.27.14.1634000000000000000.3",
+		} {
+			_, err := ParseAckReplySubject(reply)
+			assert.NotNil(err, reply)
+		}
+	}
+
+	// Case 4: fields already set are kept when filling in from the reply subject
+	{
+		ack := AckIndication{
+			Stream: "s", Consumer: "c", SeqNum: AckSeqNum{Stream: 5, Consumer: 4}, Domain: "edge",
+		}
+		filled := ack.withReplyFields("$JS.ACK.hub.acc.s.c.3.5.4.1634000000000000000.0")
+		assert.Equal("edge", filled.Domain)
+		assert.Equal(uint64(3), filled.NumDelivered)
+		assert.Equal(ack, ack.withReplyFields("reply.inbox"))
+	}
 }
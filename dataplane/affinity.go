@@ -0,0 +1,102 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// affinityVirtualNodes is the number of points of each replica on the hash ring
+const affinityVirtualNodes = 128
+
+// ConsumerAffinity assigns each durable consumer to one of a set of dataplane replicas with
+// consistent hashing, so all push subscribe sessions of a consumer are served by the replica
+// holding its dispatcher. Adding or removing a replica only moves the consumers assigned
+// to it.
+type ConsumerAffinity interface {
+	// Owner returns the base URL of the replica assigned a consumer
+	Owner(stream, consumer string) string
+	// Self returns the base URL of this replica
+	Self() string
+}
+
+// ringPoint is one point of a replica on the hash ring
+type ringPoint struct {
+	hash    uint64
+	replica string
+}
+
+// consumerAffinityImpl implements ConsumerAffinity
+type consumerAffinityImpl struct {
+	self string
+	ring []ringPoint
+}
+
+// GetConsumerAffinity define a new ConsumerAffinity
+//
+// Each replica is identified by its base URL, e.g. "http://httpmq-1.httpmq:3001". self must be
+// one of replicas. Every replica must be given the same set of replicas.
+func GetConsumerAffinity(self string, replicas []string) (ConsumerAffinity, error) {
+	seen := map[string]bool{}
+	ring := make([]ringPoint, 0, len(replicas)*affinityVirtualNodes)
+	for _, replica := range replicas {
+		parsed, err := url.Parse(replica)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Scheme == "" || parsed.Host == "" || (parsed.Path != "" && parsed.Path != "/") {
+			return nil, fmt.Errorf("replica %s is not a base URL", replica)
+		}
+		if seen[replica] {
+			return nil, fmt.Errorf("replica %s is listed more than once", replica)
+		}
+		seen[replica] = true
+		for idx := 0; idx < affinityVirtualNodes; idx++ {
+			ring = append(ring, ringPoint{
+				hash: affinityHash(fmt.Sprintf("%s#%d", replica, idx)), replica: replica,
+			})
+		}
+	}
+	if !seen[self] {
+		return nil, fmt.Errorf("replica %s is not one of the replicas", self)
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return &consumerAffinityImpl{self: self, ring: ring}, nil
+}
+
+// affinityHash helper function to place a key on the hash ring
+func affinityHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Owner returns the base URL of the replica assigned a consumer
+func (a *consumerAffinityImpl) Owner(stream, consumer string) string {
+	hash := affinityHash(stream + "/" + consumer)
+	idx := sort.Search(len(a.ring), func(i int) bool { return a.ring[i].hash >= hash })
+	if idx == len(a.ring) {
+		idx = 0
+	}
+	return a.ring[idx].replica
+}
+
+// Self returns the base URL of this replica
+func (a *consumerAffinityImpl) Self() string {
+	return a.self
+}
@@ -0,0 +1,74 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerAffinity(t *testing.T) {
+	assert := assert.New(t)
+
+	replicas := []string{"http://httpmq-0:3001", "http://httpmq-1:3001", "http://httpmq-2:3001"}
+
+	// Case 0: invalid replica sets
+	{
+		_, err := GetConsumerAffinity("http://httpmq-3:3001", replicas)
+		assert.NotNil(err)
+		_, err = GetConsumerAffinity("httpmq-0", []string{"httpmq-0"})
+		assert.NotNil(err)
+		_, err = GetConsumerAffinity("http://httpmq-0:3001/data", []string{"http://httpmq-0:3001/data"})
+		assert.NotNil(err)
+		_, err = GetConsumerAffinity(replicas[0], append(replicas, replicas[0]))
+		assert.NotNil(err)
+	}
+
+	// Case 1: every replica agrees on the owners, and consumers are spread out
+	owners := map[string]string{}
+	{
+		uut0, err := GetConsumerAffinity(replicas[0], replicas)
+		assert.Nil(err)
+		assert.Equal(replicas[0], uut0.Self())
+		uut2, err := GetConsumerAffinity(replicas[2], []string{replicas[2], replicas[0], replicas[1]})
+		assert.Nil(err)
+		perReplica := map[string]int{}
+		for idx := 0; idx < 300; idx++ {
+			consumer := fmt.Sprintf("consumer-%d", idx)
+			owner := uut0.Owner("stream", consumer)
+			assert.Equal(owner, uut2.Owner("stream", consumer))
+			owners[consumer] = owner
+			perReplica[owner]++
+		}
+		for _, replica := range replicas {
+			assert.Greater(perReplica[replica], 50)
+		}
+	}
+
+	// Case 2: removing a replica only moves its consumers
+	{
+		uut, err := GetConsumerAffinity(replicas[0], replicas[:2])
+		assert.Nil(err)
+		for consumer, owner := range owners {
+			if owner != replicas[2] {
+				assert.Equal(owner, uut.Owner("stream", consumer))
+			} else {
+				assert.NotEqual(replicas[2], uut.Owner("stream", consumer))
+			}
+		}
+	}
+}
@@ -20,23 +20,6 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-// msgToString helper function for standardizing the printing of nats.Msg
-func msgToString(msg *nats.Msg) string {
-	if meta, err := msg.Metadata(); err == nil {
-		msgName := fmt.Sprintf(
-			"%s@%s:MSG[S:%d C:%d]",
-			meta.Consumer,
-			meta.Stream,
-			meta.Sequence.Stream,
-			meta.Sequence.Consumer,
-		)
-		return msgName
-	}
-	return msg.Subject
-}
-
-// ==============================================================================
-
 // MsgToDeliverSeq sequence numbers for a JetStream message
 type MsgToDeliverSeq struct {
 	// Stream is the message sequence number within the stream
@@ -55,25 +38,21 @@ type MsgToDeliver struct {
 	Consumer string `json:"consumer" validate:"required"`
 	// Sequence is the sequence numbers for this JetStream message
 	Sequence MsgToDeliverSeq `json:"sequence" validate:"required,dive"`
+	// Headers are the message headers, if any
+	Headers map[string][]string `json:"headers,omitempty"`
 	// Message is the message body
 	Message []byte `json:"b64_msg" validate:"required"`
+	// Source is the source tag of the message, if delivered by a multi-source subscription
+	Source string `json:"source,omitempty"`
+	// ResumeToken is the token for resuming the subscription session, if resumable
+	ResumeToken string `json:"resume_token,omitempty"`
+	// Metadata is the computed metadata of the message, if requested by the subscription
+	Metadata *DeliveryMetadata `json:"metadata,omitempty"`
 }
 
 // ConvertJSMessageDeliver convert a JetStream message for delivery
 func ConvertJSMessageDeliver(subject string, msg *nats.Msg) (MsgToDeliver, error) {
-	meta, err := msg.Metadata()
-	if err == nil {
-		return MsgToDeliver{
-			Stream:   meta.Stream,
-			Subject:  subject,
-			Consumer: meta.Consumer,
-			Sequence: MsgToDeliverSeq{
-				Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer,
-			},
-			Message: msg.Data,
-		}, nil
-	}
-	return MsgToDeliver{}, err
+	return NewMsgEnvelope(msg).ToDeliver(subject)
 }
 
 // String toString function for MsgToDeliver
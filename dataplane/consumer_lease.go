@@ -0,0 +1,330 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrLeaseHeld is wrapped by errors of a consumer pinned to another session
+var ErrLeaseHeld = errors.New("consumer pinned by another session")
+
+// ErrNoLease returned when a consumer is not pinned
+var ErrNoLease = errors.New("consumer not pinned")
+
+// leaseAcquireAttempts how many times acquiring a lease is tried when racing other sessions
+const leaseAcquireAttempts = 3
+
+// ConsumerLease pins a durable consumer to one push subscribe session
+type ConsumerLease struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Holder is the ID of the session holding the lease
+	Holder string `json:"holder"`
+	// Principal is the authenticated client of the session, if any
+	Principal string `json:"principal,omitempty"`
+	// ClientAddr is the address of the client
+	ClientAddr string `json:"client_addr,omitempty"`
+	// Replica is the dataplane instance running the session
+	Replica string `json:"replica"`
+	// Acquired is when the session acquired the lease
+	Acquired time.Time `json:"acquired"`
+	// Expires is when the lease expires, unless renewed
+	Expires time.Time `json:"expires"`
+}
+
+// String toString function for ConsumerLease
+func (l ConsumerLease) String() string {
+	return fmt.Sprintf("LEASE[%s@%s] %s", l.Consumer, l.Stream, l.Holder)
+}
+
+// LeaseHeldError is the error of a consumer pinned to another session
+type LeaseHeldError struct {
+	// Lease is the lease held by the other session
+	Lease ConsumerLease
+}
+
+// Error implements error
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf(
+		"%s: held by %s until %s", ErrLeaseHeld, e.Lease.Holder, e.Lease.Expires.Format(time.RFC3339),
+	)
+}
+
+// Unwrap returns ErrLeaseHeld
+func (e *LeaseHeldError) Unwrap() error {
+	return ErrLeaseHeld
+}
+
+// ConsumerLeaseManager pins durable consumers to push subscribe sessions with leases held in
+// a JetStream KV bucket shared by the dataplane and management instances. A lease is renewed
+// by its session while the session runs, and expires if the session is gone without
+// releasing it.
+type ConsumerLeaseManager interface {
+	// Acquire pins a consumer to a session until ctxt ends. Returns a LeaseHeldError if
+	// another session holds the lease. The returned channel is closed if the lease is lost,
+	// e.g. broken by an admin, at which point the session must stop reading the consumer.
+	Acquire(
+		lease ConsumerLease, wg *sync.WaitGroup, ctxt context.Context,
+	) (<-chan struct{}, error)
+	// Check returns a LeaseHeldError if a session other than holder holds the lease of a
+	// consumer
+	Check(stream, consumer, holder string) error
+	// GetLease returns the lease of a consumer, or ErrNoLease
+	GetLease(stream, consumer string) (ConsumerLease, error)
+	// ListLeases returns the leases held
+	ListLeases() ([]ConsumerLease, error)
+	// BreakLease removes the lease of a consumer, so the session holding it ends, and other
+	// sessions can bind to the consumer. Returns ErrNoLease if none is held.
+	BreakLease(stream, consumer string) error
+}
+
+// consumerLeaseManagerImpl implements ConsumerLeaseManager
+type consumerLeaseManagerImpl struct {
+	common.Component
+	kv       nats.KeyValue
+	ttl      time.Duration
+	instance string
+}
+
+// GetConsumerLeaseManager define a new ConsumerLeaseManager. The leases are held in the
+// JetStream KV bucket, which is created if it does not exist. Leases last for ttl unless
+// renewed.
+func GetConsumerLeaseManager(
+	natsClient *core.NatsClient, bucket string, ttl time.Duration, instance string,
+) (ConsumerLeaseManager, error) {
+	kv, err := natsClient.JetStream().KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = natsClient.JetStream().CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return defineConsumerLeaseManager(kv, ttl, instance)
+}
+
+// defineConsumerLeaseManager define a new ConsumerLeaseManager around a KV bucket
+func defineConsumerLeaseManager(
+	kv nats.KeyValue, ttl time.Duration, instance string,
+) (ConsumerLeaseManager, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "consumer-lease", "instance": instance,
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("consumer lease TTL must be positive")
+	}
+	return &consumerLeaseManagerImpl{
+		Component: common.Component{LogTags: logTags},
+		kv:        kv,
+		ttl:       ttl,
+		instance:  instance,
+	}, nil
+}
+
+// leaseKey helper function to define the KV key of the lease of a consumer. Stream and
+// consumer names can not contain ".".
+func leaseKey(stream, consumer string) string {
+	return fmt.Sprintf("%s.%s", stream, consumer)
+}
+
+// read helper function to read the current lease of a consumer. Returns ErrNoLease if none
+// is held, or it expired.
+func (m *consumerLeaseManagerImpl) read(key string) (ConsumerLease, uint64, error) {
+	entry, err := m.kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return ConsumerLease{}, 0, ErrNoLease
+	} else if err != nil {
+		return ConsumerLease{}, 0, err
+	}
+	var lease ConsumerLease
+	if err := json.Unmarshal(entry.Value(), &lease); err != nil {
+		return ConsumerLease{}, 0, fmt.Errorf("unable to parse lease %s: %w", key, err)
+	}
+	if !lease.Expires.After(time.Now()) {
+		return lease, entry.Revision(), ErrNoLease
+	}
+	return lease, entry.Revision(), nil
+}
+
+// Acquire pins a consumer to a session until ctxt ends
+func (m *consumerLeaseManagerImpl) Acquire(
+	lease ConsumerLease, wg *sync.WaitGroup, ctxt context.Context,
+) (<-chan struct{}, error) {
+	localLogTags, err := common.UpdateLogTags(m.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(m.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	key := leaseKey(lease.Stream, lease.Consumer)
+	lease.Replica = m.instance
+	lease.Acquired = time.Now()
+	var revision uint64
+	for attempt := 0; ; attempt++ {
+		current, currentRev, err := m.read(key)
+		if err == nil && current.Holder != lease.Holder {
+			return nil, &LeaseHeldError{Lease: current}
+		} else if err != nil && !errors.Is(err, ErrNoLease) {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unable to read %s", lease)
+			return nil, err
+		} else if err == nil {
+			// A resumed session keeps its lease
+			lease.Acquired = current.Acquired
+		}
+		lease.Expires = time.Now().Add(m.ttl)
+		payload, err := json.Marshal(&lease)
+		if err != nil {
+			return nil, err
+		}
+		if currentRev == 0 {
+			revision, err = m.kv.Create(key, payload)
+		} else {
+			revision, err = m.kv.Update(key, payload, currentRev)
+		}
+		if err == nil {
+			break
+		}
+		// Another session wrote the lease first
+		if attempt+1 >= leaseAcquireAttempts {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unable to write %s", lease)
+			return nil, err
+		}
+	}
+	log.WithFields(localLogTags).Infof("Acquired %s", lease)
+
+	lost := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(m.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctxt.Done():
+				m.release(key, lease, revision, localLogTags)
+				return
+			case <-ticker.C:
+			}
+			lease.Expires = time.Now().Add(m.ttl)
+			payload, err := json.Marshal(&lease)
+			if err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Unable to renew %s", lease)
+				continue
+			}
+			renewed, err := m.kv.Update(key, payload, revision)
+			if err == nil {
+				revision = renewed
+				continue
+			}
+			// The lease is lost if it was written since, i.e. broken or taken over
+			_, currentRev, readErr := m.read(key)
+			if currentRev == revision || (readErr != nil && !errors.Is(readErr, ErrNoLease)) {
+				log.WithError(err).WithFields(localLogTags).Warnf("Failed to renew %s", lease)
+				continue
+			}
+			log.WithError(err).WithFields(localLogTags).Warnf("Lost %s", lease)
+			close(lost)
+			return
+		}
+	}()
+	return lost, nil
+}
+
+// release helper function to remove a lease on its session ending, unless it was written
+// since by another session
+func (m *consumerLeaseManagerImpl) release(
+	key string, lease ConsumerLease, revision uint64, logTags log.Fields,
+) {
+	if _, currentRev, err := m.read(key); err != nil || currentRev != revision {
+		return
+	}
+	if err := m.kv.Delete(key); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to release %s", lease)
+		return
+	}
+	log.WithFields(logTags).Infof("Released %s", lease)
+}
+
+// Check returns a LeaseHeldError if a session other than holder holds the lease of a consumer
+func (m *consumerLeaseManagerImpl) Check(stream, consumer, holder string) error {
+	lease, _, err := m.read(leaseKey(stream, consumer))
+	if errors.Is(err, ErrNoLease) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if lease.Holder != holder {
+		return &LeaseHeldError{Lease: lease}
+	}
+	return nil
+}
+
+// GetLease returns the lease of a consumer, or ErrNoLease
+func (m *consumerLeaseManagerImpl) GetLease(stream, consumer string) (ConsumerLease, error) {
+	lease, _, err := m.read(leaseKey(stream, consumer))
+	if err != nil {
+		return ConsumerLease{}, err
+	}
+	return lease, nil
+}
+
+// ListLeases returns the leases held
+func (m *consumerLeaseManagerImpl) ListLeases() ([]ConsumerLease, error) {
+	keys, err := m.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return []ConsumerLease{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	leases := make([]ConsumerLease, 0, len(keys))
+	for _, key := range keys {
+		lease, _, err := m.read(key)
+		if errors.Is(err, ErrNoLease) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// BreakLease removes the lease of a consumer
+func (m *consumerLeaseManagerImpl) BreakLease(stream, consumer string) error {
+	key := leaseKey(stream, consumer)
+	lease, _, err := m.read(key)
+	if err != nil {
+		return err
+	}
+	if err := m.kv.Delete(key); err != nil {
+		log.WithError(err).WithFields(m.LogTags).Errorf("Unable to break %s", lease)
+		return err
+	}
+	log.WithFields(m.LogTags).Infof("Broke %s", lease)
+	return nil
+}
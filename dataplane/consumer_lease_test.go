@@ -0,0 +1,201 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryKVEntry is a nats.KeyValueEntry of memoryKV
+type memoryKVEntry struct {
+	nats.KeyValueEntry
+	value    []byte
+	revision uint64
+}
+
+func (e memoryKVEntry) Value() []byte {
+	return e.value
+}
+
+func (e memoryKVEntry) Revision() uint64 {
+	return e.revision
+}
+
+// memoryKV is an in-memory nats.KeyValue, with revisions shared by all keys as in JetStream
+type memoryKV struct {
+	nats.KeyValue
+	lock     sync.Mutex
+	revision uint64
+	entries  map[string]memoryKVEntry
+}
+
+func (kv *memoryKV) Get(key string) (nats.KeyValueEntry, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	entry, ok := kv.entries[key]
+	if !ok {
+		return nil, nats.ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+func (kv *memoryKV) Create(key string, value []byte) (uint64, error) {
+	return kv.Update(key, value, 0)
+}
+
+func (kv *memoryKV) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if kv.entries[key].revision != last {
+		return 0, fmt.Errorf("wrong last sequence")
+	}
+	kv.revision++
+	kv.entries[key] = memoryKVEntry{value: value, revision: kv.revision}
+	return kv.revision, nil
+}
+
+func (kv *memoryKV) Delete(key string) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	delete(kv.entries, key)
+	return nil
+}
+
+func (kv *memoryKV) Keys(...nats.WatchOpt) ([]string, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if len(kv.entries) == 0 {
+		return nil, nats.ErrNoKeysFound
+	}
+	keys := make([]string, 0, len(kv.entries))
+	for key := range kv.entries {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func TestConsumerLeaseManager(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	kv := &memoryKV{entries: map[string]memoryKVEntry{}}
+	_, err := defineConsumerLeaseManager(kv, 0, "ut-replica")
+	assert.NotNil(err)
+	uut, err := defineConsumerLeaseManager(kv, time.Millisecond*150, "ut-replica")
+	assert.Nil(err)
+
+	// Case 0: no leases held
+	{
+		leases, err := uut.ListLeases()
+		assert.Nil(err)
+		assert.Empty(leases)
+		_, err = uut.GetLease("orders", "billing")
+		assert.Equal(ErrNoLease, err)
+		assert.Nil(uut.Check("orders", "billing", "anyone"))
+		assert.Equal(ErrNoLease, uut.BreakLease("orders", "billing"))
+	}
+
+	// Case 1: a session pins a consumer
+	session1Ctxt, session1Cancel := context.WithCancel(utCtxt)
+	lost1, err := uut.Acquire(
+		ConsumerLease{Stream: "orders", Consumer: "billing", Holder: "session-1"}, &wg, session1Ctxt,
+	)
+	assert.Nil(err)
+	{
+		lease, err := uut.GetLease("orders", "billing")
+		assert.Nil(err)
+		assert.Equal("session-1", lease.Holder)
+		assert.Equal("ut-replica", lease.Replica)
+		assert.Nil(uut.Check("orders", "billing", "session-1"))
+		var held *LeaseHeldError
+		err = uut.Check("orders", "billing", "session-2")
+		assert.True(errors.As(err, &held))
+		assert.True(errors.Is(err, ErrLeaseHeld))
+		assert.Equal("session-1", held.Lease.Holder)
+		leases, err := uut.ListLeases()
+		assert.Nil(err)
+		assert.Len(leases, 1)
+	}
+
+	// Case 2: another session can not pin the consumer, even after the first TTL, as the
+	// lease is renewed
+	{
+		time.Sleep(time.Millisecond * 300)
+		_, err := uut.Acquire(
+			ConsumerLease{Stream: "orders", Consumer: "billing", Holder: "session-2"}, &wg, utCtxt,
+		)
+		var held *LeaseHeldError
+		assert.True(errors.As(err, &held))
+		assert.Equal("session-1", held.Lease.Holder)
+		assert.True(held.Lease.Expires.After(time.Now()))
+	}
+
+	// Case 3: the lease is released once its session ends
+	{
+		session1Cancel()
+		time.Sleep(time.Millisecond * 20)
+		_, err := uut.GetLease("orders", "billing")
+		assert.Equal(ErrNoLease, err)
+		select {
+		case <-lost1:
+			assert.False(true, "released lease reported lost")
+		default:
+		}
+	}
+
+	// Case 4: breaking a lease ends its session
+	{
+		lost2, err := uut.Acquire(
+			ConsumerLease{Stream: "orders", Consumer: "billing", Holder: "session-2"}, &wg, utCtxt,
+		)
+		assert.Nil(err)
+		assert.Nil(uut.BreakLease("orders", "billing"))
+		select {
+		case <-lost2:
+		case <-time.After(time.Second):
+			assert.False(true, "broken lease not reported lost")
+		}
+		assert.Nil(uut.Check("orders", "billing", "session-3"))
+	}
+
+	// Case 5: an expired lease can be taken over
+	{
+		payload := []byte(
+			`{"stream":"orders","consumer":"audit","holder":"gone","expires":"2020-01-01T00:00:00Z"}`,
+		)
+		_, err := kv.Create(leaseKey("orders", "audit"), payload)
+		assert.Nil(err)
+		assert.Nil(uut.Check("orders", "audit", "session-4"))
+		_, err = uut.Acquire(
+			ConsumerLease{Stream: "orders", Consumer: "audit", Holder: "session-4"}, &wg, utCtxt,
+		)
+		assert.Nil(err)
+		lease, err := uut.GetLease("orders", "audit")
+		assert.Nil(err)
+		assert.Equal("session-4", lease.Holder)
+	}
+}
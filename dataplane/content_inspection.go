@@ -0,0 +1,227 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alwitt/httpmq/core"
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrContentRejected is reported for a message failing the content inspection of its stream
+var ErrContentRejected = errors.New("message content rejected")
+
+// maxCachedSubjectStreams bounds the number of subjects whose stream is cached
+const maxCachedSubjectStreams = 4096
+
+// ContentInspectionRule describes the checks applied to messages published to a stream
+type ContentInspectionRule struct {
+	// JSON requires messages to be well-formed JSON
+	JSON bool `json:"json,omitempty"`
+	// MaxDepth is the max nesting depth of objects and arrays in a JSON message. "0" for no
+	// limit. A max depth requires messages to be JSON.
+	MaxDepth int `json:"max_depth,omitempty" validate:"gte=0"`
+	// UTF8 requires messages to be valid UTF-8
+	UTF8 bool `json:"utf8,omitempty"`
+}
+
+// Check verifies a message against the rule
+func (r ContentInspectionRule) Check(msg []byte) error {
+	if r.UTF8 && !utf8.Valid(msg) {
+		return fmt.Errorf("%w: not valid UTF-8", ErrContentRejected)
+	}
+	if !r.JSON && r.MaxDepth == 0 {
+		return nil
+	}
+	if !json.Valid(msg) {
+		return fmt.Errorf("%w: not well-formed JSON", ErrContentRejected)
+	}
+	if r.MaxDepth > 0 {
+		if depth := jsonDepth(msg); depth > r.MaxDepth {
+			return fmt.Errorf(
+				"%w: JSON nested %d deep, more than the max of %d", ErrContentRejected, depth, r.MaxDepth,
+			)
+		}
+	}
+	return nil
+}
+
+// jsonDepth helper function to find the max nesting depth of a well-formed JSON value
+func jsonDepth(msg []byte) int {
+	depth := 0
+	maxDepth := 0
+	inString := false
+	escaped := false
+	for _, char := range msg {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if char == '\\' {
+				escaped = true
+			} else if char == '"' {
+				inString = false
+			}
+		case char == '"':
+			inString = true
+		case char == '{' || char == '[':
+			if depth++; depth > maxDepth {
+				maxDepth = depth
+			}
+		case char == '}' || char == ']':
+			depth--
+		}
+	}
+	return maxDepth
+}
+
+// LoadContentInspectionRules read the content inspection rule of each stream from a JSON file
+//
+// The file is a JSON object mapping stream names to the rule for that stream.
+func LoadContentInspectionRules(path string) (map[string]ContentInspectionRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules map[string]ContentInspectionRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse content inspection rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// ContentInspector checks the content of messages before they are published
+type ContentInspector interface {
+	// Inspect checks a message published to a subject against the rule of the stream storing
+	// the subject. Returns an error wrapping ErrContentRejected if the message fails the rule.
+	Inspect(subject string, msg []byte, ctxt context.Context) error
+}
+
+// cachedSubjectStream is the stream found storing a subject
+type cachedSubjectStream struct {
+	stream  string
+	expires time.Time
+}
+
+// subjectStreamCache caches the stream found storing each subject
+type subjectStreamCache struct {
+	ttl time.Duration
+	// lookup finds the stream storing a subject
+	lookup func(subject string, ctxt context.Context) (string, error)
+	lock   sync.Mutex
+	cache  map[string]cachedSubjectStream
+}
+
+// newSubjectStreamCache define a new subjectStreamCache, which looks up the stream storing a
+// subject through natsClient, and caches it for ttl
+func newSubjectStreamCache(natsClient *core.NatsClient, ttl time.Duration) *subjectStreamCache {
+	return &subjectStreamCache{
+		ttl: ttl,
+		lookup: func(subject string, ctxt context.Context) (string, error) {
+			return lookupSubjectStream(natsClient, subject, ctxt)
+		},
+		cache: map[string]cachedSubjectStream{},
+	}
+}
+
+// contentInspectorImpl implements ContentInspector
+type contentInspectorImpl struct {
+	rules   map[string]ContentInspectionRule
+	streams *subjectStreamCache
+}
+
+// GetContentInspector define new ContentInspector given the content inspection rule of each
+// stream. The stream storing a subject is looked up through natsClient, and cached for
+// cacheTTL.
+func GetContentInspector(
+	natsClient *core.NatsClient, rules map[string]ContentInspectionRule, cacheTTL time.Duration,
+) (ContentInspector, error) {
+	validate := validator.New()
+	for stream, rule := range rules {
+		rule := rule
+		if err := validate.Struct(&rule); err != nil {
+			return nil, fmt.Errorf("stream %s content inspection rule invalid: %w", stream, err)
+		}
+	}
+	if cacheTTL <= 0 {
+		return nil, fmt.Errorf("content inspection stream cache TTL must be positive")
+	}
+	return &contentInspectorImpl{
+		rules: rules, streams: newSubjectStreamCache(natsClient, cacheTTL),
+	}, nil
+}
+
+// get find the stream storing a subject, through the cache. Returns an empty stream if no
+// stream stores the subject.
+func (c *subjectStreamCache) get(subject string, ctxt context.Context) (string, error) {
+	now := time.Now()
+	c.lock.Lock()
+	cached, ok := c.cache[subject]
+	c.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.stream, nil
+	}
+	stream, err := c.lookup(subject, ctxt)
+	if errors.Is(err, ErrNoStreamForSubject) {
+		// Cache the absence of a stream as well, so unknown subjects are not looked up on
+		// every publish
+		stream, err = "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.cache) >= maxCachedSubjectStreams {
+		for cachedSubject, entry := range c.cache {
+			if !now.Before(entry.expires) {
+				delete(c.cache, cachedSubject)
+			}
+		}
+		if len(c.cache) >= maxCachedSubjectStreams {
+			c.cache = map[string]cachedSubjectStream{}
+		}
+	}
+	c.cache[subject] = cachedSubjectStream{stream: stream, expires: now.Add(c.ttl)}
+	return stream, nil
+}
+
+// Inspect checks a message published to a subject against the rule of the stream storing
+// the subject. Returns an error wrapping ErrContentRejected if the message fails the rule.
+func (i *contentInspectorImpl) Inspect(subject string, msg []byte, ctxt context.Context) error {
+	if len(i.rules) == 0 {
+		return nil
+	}
+	stream, err := i.streams.get(subject, ctxt)
+	if err != nil {
+		return fmt.Errorf("unable to find the stream of %s: %w", subject, err)
+	}
+	rule, ok := i.rules[stream]
+	if !ok {
+		return nil
+	}
+	if err := rule.Check(msg); err != nil {
+		return fmt.Errorf("stream %s: %w", stream, err)
+	}
+	return nil
+}
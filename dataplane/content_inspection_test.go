@@ -0,0 +1,132 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentInspectionRule(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: no checks
+	{
+		assert.Nil(ContentInspectionRule{}.Check([]byte{0xff, '{'}))
+	}
+
+	// Case 1: UTF-8 validation
+	{
+		uut := ContentInspectionRule{UTF8: true}
+		assert.Nil(uut.Check([]byte("héllo")))
+		assert.ErrorIs(uut.Check([]byte{'a', 0xff}), ErrContentRejected)
+	}
+
+	// Case 2: JSON well-formedness
+	{
+		uut := ContentInspectionRule{JSON: true}
+		assert.Nil(uut.Check([]byte(`{"a": [1, 2]}`)))
+		assert.ErrorIs(uut.Check([]byte(`{"a": [1, 2}`)), ErrContentRejected)
+		assert.ErrorIs(uut.Check([]byte(`{"a": 1} {"b": 2}`)), ErrContentRejected)
+	}
+
+	// Case 3: JSON nesting depth; brackets within strings do not count
+	{
+		uut := ContentInspectionRule{MaxDepth: 2}
+		assert.Nil(uut.Check([]byte(`{"a": [1, "[[[{{\"]]"]}`)))
+		assert.Nil(uut.Check([]byte(`"plain"`)))
+		assert.ErrorIs(uut.Check([]byte(`{"a": [{"b": 1}]}`)), ErrContentRejected)
+		assert.ErrorIs(uut.Check([]byte(`not json`)), ErrContentRejected)
+	}
+}
+
+func TestContentInspector(t *testing.T) {
+	assert := assert.New(t)
+
+	lookups := 0
+	lookupErr := errors.New("lookup failed")
+	uut := &contentInspectorImpl{
+		rules: map[string]ContentInspectionRule{"orders": {JSON: true}},
+		streams: &subjectStreamCache{
+			ttl: time.Minute,
+			lookup: func(subject string, ctxt context.Context) (string, error) {
+				lookups++
+				switch subject {
+				case "orders.new":
+					return "orders", nil
+				case "logs.new":
+					return "logs", nil
+				case "broken":
+					return "", lookupErr
+				}
+				return "", ErrNoStreamForSubject
+			},
+			cache: map[string]cachedSubjectStream{},
+		},
+	}
+	ctxt := context.Background()
+
+	// Case 0: rule of the stream applied
+	{
+		assert.Nil(uut.Inspect("orders.new", []byte(`{}`), ctxt))
+		assert.ErrorIs(uut.Inspect("orders.new", []byte(`{`), ctxt), ErrContentRejected)
+		assert.Equal(1, lookups)
+	}
+
+	// Case 1: streams without a rule, and subjects without a stream, are not checked
+	{
+		assert.Nil(uut.Inspect("logs.new", []byte(`{`), ctxt))
+		assert.Nil(uut.Inspect("unknown", []byte(`{`), ctxt))
+		assert.Nil(uut.Inspect("unknown", []byte(`{`), ctxt))
+		assert.Equal(3, lookups)
+	}
+
+	// Case 2: lookup failure
+	{
+		err := uut.Inspect("broken", []byte(`{}`), ctxt)
+		assert.ErrorIs(err, lookupErr)
+		assert.False(errors.Is(err, ErrContentRejected))
+	}
+
+	// Case 3: cached stream expired
+	{
+		uut.streams.cache["orders.new"] = cachedSubjectStream{stream: "orders", expires: time.Now()}
+		assert.Nil(uut.Inspect("orders.new", []byte(`{}`), ctxt))
+		assert.Equal(5, lookups)
+	}
+}
+
+func TestLoadContentInspectionRules(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	assert.Nil(os.WriteFile(path, []byte(`{"orders": {"json": true, "max_depth": 8}}`), 0600))
+	rules, err := LoadContentInspectionRules(path)
+	assert.Nil(err)
+	assert.Equal(ContentInspectionRule{JSON: true, MaxDepth: 8}, rules["orders"])
+
+	assert.Nil(os.WriteFile(path, []byte(`not json`), 0600))
+	_, err = LoadContentInspectionRules(path)
+	assert.NotNil(err)
+
+	_, err = GetContentInspector(nil, map[string]ContentInspectionRule{"orders": {MaxDepth: -1}}, time.Minute)
+	assert.NotNil(err)
+}
@@ -0,0 +1,190 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"encoding/base64"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/nats-io/nats.go"
+)
+
+// maxPooledDeliveryBuffer buffers which grew above this size are not returned to the pool,
+// so a burst of large messages does not pin memory
+const maxPooledDeliveryBuffer = 1 << 20
+
+// deliveryBufferPool pool of buffers for framing messages for delivery
+var deliveryBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// DeliveryFields are the optional fields of a message in the delivery format. Each is only
+// included if not empty.
+type DeliveryFields struct {
+	// Source is the source tag of a message delivered by a multi-source subscription
+	Source string
+	// ResumeToken is the token for resuming the subscription session
+	ResumeToken string
+	// Metadata selects the computed metadata fields to annotate the message with
+	Metadata DeliveryMetadataMask
+}
+
+// WriteJSMessageDeliver write a JetStream message to w in the delivery format, followed by
+// a newline. The output is the same as JSON encoding the MsgToDeliver of the message, but
+// the message body is Base64 encoded straight into a pooled buffer, which is then written
+// to w in one call.
+//
+// The number of bytes written is returned.
+func WriteJSMessageDeliver(
+	w io.Writer, subject string, msg *nats.Msg, fields DeliveryFields,
+) (int64, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return 0, err
+	}
+	pooled := deliveryBufferPool.Get().(*[]byte)
+	defer func() {
+		if cap(*pooled) <= maxPooledDeliveryBuffer {
+			deliveryBufferPool.Put(pooled)
+		}
+	}()
+
+	frame := (*pooled)[:0]
+	frame = append(frame, `{"stream":`...)
+	frame = appendJSONString(frame, meta.Stream)
+	frame = append(frame, `,"subject":`...)
+	frame = appendJSONString(frame, subject)
+	frame = append(frame, `,"consumer":`...)
+	frame = appendJSONString(frame, meta.Consumer)
+	frame = append(frame, `,"sequence":{"stream":`...)
+	frame = strconv.AppendUint(frame, meta.Sequence.Stream, 10)
+	frame = append(frame, `,"consumer":`...)
+	frame = strconv.AppendUint(frame, meta.Sequence.Consumer, 10)
+	frame = append(frame, '}')
+	if len(msg.Header) > 0 {
+		// Headers are uncommon enough to leave to the JSON codec
+		headers, err := common.JSON().Marshal(msg.Header)
+		if err != nil {
+			return 0, err
+		}
+		frame = append(frame, `,"headers":`...)
+		frame = append(frame, headers...)
+	}
+	frame = append(frame, `,"b64_msg":"`...)
+	frame = appendBase64(frame, msg.Data)
+	frame = append(frame, '"')
+	if fields.Source != "" {
+		frame = append(frame, `,"source":`...)
+		frame = appendJSONString(frame, fields.Source)
+	}
+	if fields.ResumeToken != "" {
+		frame = append(frame, `,"resume_token":`...)
+		frame = appendJSONString(frame, fields.ResumeToken)
+	}
+	if fields.Metadata != 0 {
+		// Like headers, metadata is opt-in, so left to the JSON codec
+		metadata, err := common.JSON().Marshal(GetDeliveryMetadata(meta, fields.Metadata, time.Now()))
+		if err != nil {
+			return 0, err
+		}
+		frame = append(frame, `,"metadata":`...)
+		frame = append(frame, metadata...)
+	}
+	frame = append(frame, "}\n"...)
+	*pooled = frame
+
+	written, err := w.Write(frame)
+	return int64(written), err
+}
+
+// appendBase64 helper function to Base64 encode data onto the end of buf
+func appendBase64(buf []byte, data []byte) []byte {
+	encodedLen := base64.StdEncoding.EncodedLen(len(data))
+	if cap(buf)-len(buf) < encodedLen {
+		grown := make([]byte, len(buf), len(buf)+encodedLen+len(buf)/2)
+		copy(grown, buf)
+		buf = grown
+	}
+	end := len(buf) + encodedLen
+	base64.StdEncoding.Encode(buf[len(buf):end], data)
+	return buf[:end]
+}
+
+// hexDigits for writing \u escapes
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString helper function to append a JSON string onto the end of buf, escaped the
+// same way as encoding/json, including HTML characters
+func appendJSONString(buf []byte, value string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for idx := 0; idx < len(value); {
+		if c := value[idx]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				idx++
+				continue
+			}
+			buf = append(buf, value[start:idx]...)
+			switch c {
+			case '"', '\\':
+				buf = append(buf, '\\', c)
+			case '\n':
+				buf = append(buf, `\n`...)
+			case '\r':
+				buf = append(buf, `\r`...)
+			case '\t':
+				buf = append(buf, `\t`...)
+			case '\b':
+				buf = append(buf, `\b`...)
+			case '\f':
+				buf = append(buf, `\f`...)
+			default:
+				buf = append(buf, `\u00`...)
+				buf = append(buf, hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			idx++
+			start = idx
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(value[idx:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, value[start:idx]...)
+			buf = append(buf, "\ufffd"...)
+			idx += size
+			start = idx
+			continue
+		}
+		// U+2028 and U+2029 are escaped, as encoding/json does for JSONP
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, value[start:idx]...)
+			buf = append(buf, `\u202`...)
+			buf = append(buf, hexDigits[r&0xf])
+			idx += size
+			start = idx
+			continue
+		}
+		idx += size
+	}
+	buf = append(buf, value[start:]...)
+	return append(buf, '"')
+}
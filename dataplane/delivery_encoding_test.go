@@ -0,0 +1,153 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// benchDeliveryMsg helper function to define a JetStream message without a server
+func benchDeliveryMsg(stream, consumer string, data []byte, header nats.Header) *nats.Msg {
+	return &nats.Msg{
+		Subject: "test-subject",
+		Reply:   fmt.Sprintf("$JS.ACK.%s.%s.1.27.14.1634000000000000000.3", stream, consumer),
+		Data:    data,
+		Header:  header,
+		Sub:     &nats.Subscription{},
+	}
+}
+
+func TestWriteJSMessageDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	type testCase struct {
+		subject     string
+		msg         *nats.Msg
+		source      string
+		resumeToken string
+		metadata    DeliveryMetadataMask
+	}
+	testCases := []testCase{
+		{
+			subject: "orders.>",
+			msg:     benchDeliveryMsg("stream-1", "consumer-1", []byte("hello"), nil),
+		},
+		{
+			subject:     "orders.eu",
+			msg:         benchDeliveryMsg("stream-1", "consumer-1", []byte{}, nil),
+			resumeToken: "token.abc-=",
+		},
+		{
+			subject:     "orders.us",
+			msg:         benchDeliveryMsg("stream-1", "consumer-1", []byte("hi"), nil),
+			source:      "stream-1/consumer-1",
+			resumeToken: "token.abc-=",
+		},
+		{
+			subject:     "orders.ca",
+			msg:         benchDeliveryMsg("stream-1", "consumer-1", []byte("hey"), nil),
+			resumeToken: "token.abc-=",
+			metadata:    DeliveryMetaAttempt | DeliveryMetaPublished | DeliveryMetaLag,
+		},
+		{
+			subject: "a\"b\\c<d>&e\u2028\u2029\x01\b\f\t\n\r\x7f\xffé",
+			msg: benchDeliveryMsg(
+				"stream-1",
+				"consumer-1",
+				bytes.Repeat([]byte{0x00, 0xff, 0x10}, 700),
+				nats.Header{"Content-Type": []string{"application/json"}, "B": []string{"1", "2"}},
+			),
+			resumeToken: "<token>",
+		},
+	}
+
+	for idx, oneCase := range testCases {
+		expected, err := ConvertJSMessageDeliver(oneCase.subject, oneCase.msg)
+		assert.Nil(err)
+		expected.Source = oneCase.source
+		expected.ResumeToken = oneCase.resumeToken
+		if oneCase.metadata != 0 {
+			meta, err := oneCase.msg.Metadata()
+			assert.Nil(err)
+			expected.Metadata = GetDeliveryMetadata(meta, oneCase.metadata, time.Now())
+		}
+		expectedJSON, err := json.Marshal(&expected)
+		assert.Nil(err)
+
+		var output bytes.Buffer
+		written, err := WriteJSMessageDeliver(
+			&output,
+			oneCase.subject,
+			oneCase.msg,
+			DeliveryFields{
+				Source: oneCase.source, ResumeToken: oneCase.resumeToken, Metadata: oneCase.metadata,
+			},
+		)
+		assert.Nil(err, "Case %d", idx)
+		assert.Equal(string(expectedJSON)+"\n", output.String(), "Case %d", idx)
+		assert.Equal(int64(output.Len()), written)
+	}
+
+	// A message without JetStream metadata is rejected
+	{
+		var output bytes.Buffer
+		_, err := WriteJSMessageDeliver(
+			&output, "subject", &nats.Msg{Data: []byte("a")}, DeliveryFields{},
+		)
+		assert.NotNil(err)
+		assert.Equal(0, output.Len())
+	}
+}
+
+func BenchmarkJSMessageDeliver(b *testing.B) {
+	for _, size := range []int{256, 4096, 65536} {
+		msg := benchDeliveryMsg("stream-1", "consumer-1", bytes.Repeat([]byte("x"), size), nil)
+
+		// The encoding used before WriteJSMessageDeliver
+		b.Run(fmt.Sprintf("marshal-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for itr := 0; itr < b.N; itr++ {
+				converted, err := ConvertJSMessageDeliver("subject", msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				serialize, err := json.Marshal(&converted)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := fmt.Fprintf(io.Discard, "%s\n", serialize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("stream-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for itr := 0; itr < b.N; itr++ {
+				if _, err := WriteJSMessageDeliver(io.Discard, "subject", msg, DeliveryFields{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
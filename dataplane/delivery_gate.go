@@ -0,0 +1,261 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+)
+
+// DeliveryConcurrency bounds the messages a subscription forwards to its client while
+// awaiting ACK. It is enforced in addition to the max inflight messages of the consumer.
+type DeliveryConcurrency struct {
+	// MaxUnacked is the max number of messages forwarded awaiting ACK. Zero means no limit
+	// beyond the consumer's own.
+	MaxUnacked int `json:"max_unacked,omitempty" validate:"gte=0"`
+	// Ordered requires strict ordering: a message is only forwarded once every earlier
+	// message is ACKed. This implies MaxUnacked of 1.
+	Ordered bool `json:"ordered,omitempty"`
+	// AckDeadline if not zero, a message forwarded but not ACKed within AckDeadline is NAKed,
+	// so it is redelivered without waiting for the consumer's AckWait.
+	AckDeadline time.Duration `json:"ack_deadline,omitempty" validate:"gte=0"`
+	// WarmUpRate if not zero, delivery starts at WarmUpRate messages per second, and ramps
+	// up until the backlog of the consumer is drained. This keeps a consumer recovering from
+	// downtime from being flooded with its backlog.
+	WarmUpRate float64 `json:"warmup_rate,omitempty" validate:"gte=0"`
+	// WarmUpDoubling is how often the warm-up delivery rate doubles. Defaults to 10s.
+	WarmUpDoubling time.Duration `json:"warmup_doubling,omitempty" validate:"gte=0"`
+	// MaxTrackingPanics if not zero, the subscription fails once the tracking of its inflight
+	// messages has recovered from MaxTrackingPanics panics. Set by the server.
+	MaxTrackingPanics int `json:"-" validate:"gte=0"`
+	// Drainable tracks the messages forwarded awaiting ACK even without a limit, so the
+	// subscription can wait for them to be ACKed before it ends. Set by the server.
+	Drainable bool `json:"-"`
+}
+
+// limit returns the max number of messages forwarded awaiting ACK, or zero if unbounded
+func (c DeliveryConcurrency) limit() int {
+	if c.Ordered {
+		return 1
+	}
+	return c.MaxUnacked
+}
+
+// deliveryGate gates forwarding messages on the number forwarded awaiting ACK. It also
+// tracks those messages, so a draining subscription knows when they are all ACKed.
+//
+// A message not ACKed within the consumer's AckWait is redelivered by JetStream, possibly
+// to another session, so it stops counting as awaiting ACK once AckWait passes.
+type deliveryGate struct {
+	// limit is the max number of messages awaiting ACK, or zero if unbounded
+	limit int
+	// tracked is whether messages awaiting ACK are tracked at all. An unbounded gate only
+	// tracks them if the subscription can drain.
+	tracked bool
+	// expiry is how long a message counts as awaiting ACK, or zero if until it is ACKed
+	expiry time.Duration
+	clock  common.Clock
+	lock   sync.Mutex
+	// unacked the entries of the messages forwarded awaiting ACK, by stream sequence number
+	unacked map[uint64]*list.Element
+	// order the *gateEntry of the messages forwarded awaiting ACK, oldest first
+	order *list.List
+	// released is closed, and replaced, whenever a message is ACKed or expires
+	released chan struct{}
+}
+
+// gateEntry a message forwarded awaiting ACK, and when it stops counting as such
+type gateEntry struct {
+	streamSeq uint64
+	expire    time.Time
+}
+
+// defineDeliveryGate define a new deliveryGate. Messages stop counting as awaiting ACK
+// after ackWait, unless it is zero.
+func defineDeliveryGate(
+	concurrency DeliveryConcurrency, ackWait time.Duration,
+) (*deliveryGate, error) {
+	if concurrency.MaxUnacked < 0 {
+		return nil, fmt.Errorf("max unacked messages can not be negative")
+	}
+	if concurrency.AckDeadline < 0 {
+		return nil, fmt.Errorf("ACK deadline can not be negative")
+	}
+	if concurrency.MaxTrackingPanics < 0 {
+		return nil, fmt.Errorf("max tracking panics can not be negative")
+	}
+	if ackWait < 0 {
+		return nil, fmt.Errorf("ACK wait can not be negative")
+	}
+	return &deliveryGate{
+		limit:    concurrency.limit(),
+		tracked:  concurrency.limit() > 0 || concurrency.Drainable,
+		expiry:   ackWait,
+		clock:    common.SystemClock,
+		unacked:  make(map[uint64]*list.Element),
+		order:    list.New(),
+		released: make(chan struct{}),
+	}, nil
+}
+
+// acquire wait until a message can be forwarded, and mark it as awaiting ACK. A message
+// already awaiting ACK, i.e. a redelivery, passes immediately.
+func (g *deliveryGate) acquire(streamSeq uint64, ctxt context.Context) error {
+	if !g.tracked {
+		return nil
+	}
+	for {
+		g.lock.Lock()
+		g.expireEntries()
+		if entry, ok := g.unacked[streamSeq]; ok {
+			// A redelivery restarts the AckWait of the message
+			g.restartExpiry(entry)
+			g.lock.Unlock()
+			return nil
+		}
+		if g.limit == 0 || len(g.unacked) < g.limit {
+			g.unacked[streamSeq] = g.order.PushBack(
+				&gateEntry{streamSeq: streamSeq, expire: g.clock.Now().Add(g.expiry)},
+			)
+			g.lock.Unlock()
+			return nil
+		}
+		released := g.released
+		timer := g.nextExpiry()
+		g.lock.Unlock()
+		if err := g.wait(released, timer, ctxt); err != nil {
+			return err
+		}
+	}
+}
+
+// release mark a message as ACKed, or NAKed
+func (g *deliveryGate) release(streamSeq uint64) {
+	if !g.tracked {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	entry, ok := g.unacked[streamSeq]
+	if !ok {
+		return
+	}
+	g.order.Remove(entry)
+	delete(g.unacked, streamSeq)
+	g.signalReleased()
+}
+
+// extend restart the AckWait of a message in progress
+func (g *deliveryGate) extend(streamSeq uint64) {
+	if !g.tracked {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if entry, ok := g.unacked[streamSeq]; ok {
+		g.restartExpiry(entry)
+	}
+}
+
+// waitIdle wait until no message is awaiting ACK. Returns the number of messages still
+// awaiting ACK if ctxt ends first.
+func (g *deliveryGate) waitIdle(ctxt context.Context) (int, error) {
+	if !g.tracked {
+		return 0, nil
+	}
+	for {
+		g.lock.Lock()
+		g.expireEntries()
+		unacked := len(g.unacked)
+		released := g.released
+		timer := g.nextExpiry()
+		g.lock.Unlock()
+		if unacked == 0 {
+			return 0, nil
+		}
+		if err := g.wait(released, timer, ctxt); err != nil {
+			return unacked, err
+		}
+	}
+}
+
+// wait helper function to wait until a message is released, the timer fires, or ctxt ends.
+// The timer is optional.
+func (g *deliveryGate) wait(
+	released chan struct{}, timer common.ClockTimer, ctxt context.Context,
+) error {
+	var expired <-chan time.Time
+	if timer != nil {
+		defer timer.Stop()
+		expired = timer.C()
+	}
+	select {
+	case <-released:
+	case <-expired:
+	case <-ctxt.Done():
+		return ctxt.Err()
+	}
+	return nil
+}
+
+// expireEntries helper function to stop counting the messages past their AckWait. The lock
+// must be held.
+func (g *deliveryGate) expireEntries() {
+	if g.expiry == 0 {
+		return
+	}
+	now := g.clock.Now()
+	expired := false
+	for oldest := g.order.Front(); oldest != nil; oldest = g.order.Front() {
+		entry := oldest.Value.(*gateEntry)
+		if now.Before(entry.expire) {
+			break
+		}
+		g.order.Remove(oldest)
+		delete(g.unacked, entry.streamSeq)
+		expired = true
+	}
+	if expired {
+		g.signalReleased()
+	}
+}
+
+// restartExpiry helper function to restart the AckWait of a message. The lock must be held.
+func (g *deliveryGate) restartExpiry(entry *list.Element) {
+	entry.Value.(*gateEntry).expire = g.clock.Now().Add(g.expiry)
+	g.order.MoveToBack(entry)
+}
+
+// nextExpiry helper function to define a timer firing once the oldest message passes its
+// AckWait. Returns nil if no message will. The lock must be held.
+func (g *deliveryGate) nextExpiry() common.ClockTimer {
+	oldest := g.order.Front()
+	if g.expiry == 0 || oldest == nil {
+		return nil
+	}
+	return g.clock.NewTimer(oldest.Value.(*gateEntry).expire.Sub(g.clock.Now()))
+}
+
+// signalReleased helper function to wake the callers waiting for a message to be released.
+// The lock must be held.
+func (g *deliveryGate) signalReleased() {
+	close(g.released)
+	g.released = make(chan struct{})
+}
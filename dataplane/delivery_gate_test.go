@@ -0,0 +1,148 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryGate(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: an unbounded gate never holds messages back
+	{
+		_, err := defineDeliveryGate(DeliveryConcurrency{}, -time.Second)
+		assert.NotNil(err)
+		uut, err := defineDeliveryGate(DeliveryConcurrency{Drainable: true}, 0)
+		assert.Nil(err)
+		for seq := uint64(1); seq <= 100; seq++ {
+			assert.Nil(uut.acquire(seq, context.Background()))
+		}
+		for seq := uint64(1); seq <= 100; seq++ {
+			uut.release(seq)
+		}
+		unacked, err := uut.waitIdle(context.Background())
+		assert.Nil(err)
+		assert.Equal(0, unacked)
+		// Without draining, nothing is tracked
+		uut, err = defineDeliveryGate(DeliveryConcurrency{}, 0)
+		assert.Nil(err)
+		for seq := uint64(1); seq <= 100; seq++ {
+			assert.Nil(uut.acquire(seq, context.Background()))
+		}
+		assert.Empty(uut.unacked)
+		unacked, err = uut.waitIdle(context.Background())
+		assert.Nil(err)
+		assert.Equal(0, unacked)
+	}
+
+	uut, err := defineDeliveryGate(DeliveryConcurrency{MaxUnacked: 2}, 0)
+	assert.Nil(err)
+
+	// Case 1: messages beyond the limit wait for an ACK
+	{
+		assert.Nil(uut.acquire(1, context.Background()))
+		assert.Nil(uut.acquire(2, context.Background()))
+		// Redelivery of a message awaiting ACK
+		assert.Nil(uut.acquire(1, context.Background()))
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		assert.NotNil(uut.acquire(3, ctxt))
+		cancel()
+	}
+
+	// Case 2: draining times out with messages awaiting ACK
+	{
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		unacked, err := uut.waitIdle(ctxt)
+		cancel()
+		assert.NotNil(err)
+		assert.Equal(2, unacked)
+	}
+
+	// Case 3: draining completes once every message is ACKed
+	{
+		go func() {
+			uut.release(1)
+			time.Sleep(time.Millisecond * 10)
+			uut.release(2)
+		}()
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Second)
+		unacked, err := uut.waitIdle(ctxt)
+		cancel()
+		assert.Nil(err)
+		assert.Equal(0, unacked)
+	}
+
+	// Case 4: messages not ACKed within the AckWait stop holding others back
+	{
+		clock := common.GetFakeClock(time.Now())
+		uut, err := defineDeliveryGate(DeliveryConcurrency{Ordered: true}, time.Second*30)
+		assert.Nil(err)
+		uut.clock = clock
+		assert.Nil(uut.acquire(1, context.Background()))
+		clock.Advance(time.Second * 10)
+		// Redelivery restarts the AckWait
+		assert.Nil(uut.acquire(1, context.Background()))
+		clock.Advance(time.Second * 10)
+		// So does a progress ACK
+		uut.extend(1)
+		acquired := make(chan error, 1)
+		go func() {
+			acquired <- uut.acquire(2, context.Background())
+		}()
+		assert.True(clock.WaitForTimers(1, time.Second))
+		clock.Advance(time.Second * 20)
+		select {
+		case <-acquired:
+			assert.Fail("acquired before the AckWait passed")
+		case <-time.After(time.Millisecond * 20):
+		}
+		assert.True(clock.WaitForTimers(1, time.Second))
+		clock.Advance(time.Second * 10)
+		select {
+		case err := <-acquired:
+			assert.Nil(err)
+		case <-time.After(time.Second):
+			assert.Fail("not acquired after the AckWait passed")
+		}
+	}
+
+	// Case 5: draining completes once the messages not ACKed pass the AckWait
+	{
+		clock := common.GetFakeClock(time.Now())
+		uut, err := defineDeliveryGate(DeliveryConcurrency{Drainable: true}, time.Second*30)
+		assert.Nil(err)
+		uut.clock = clock
+		assert.Nil(uut.acquire(1, context.Background()))
+		drained := make(chan int, 1)
+		go func() {
+			unacked, _ := uut.waitIdle(context.Background())
+			drained <- unacked
+		}()
+		assert.True(clock.WaitForTimers(1, time.Second))
+		clock.Advance(time.Second * 30)
+		select {
+		case unacked := <-drained:
+			assert.Equal(0, unacked)
+		case <-time.After(time.Second):
+			assert.Fail("drain did not complete")
+		}
+	}
+}
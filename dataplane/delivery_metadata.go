@@ -0,0 +1,121 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DeliveryMetadataMask selects the computed metadata fields which annotate the messages
+// delivered by a subscription session. By default, no metadata is included.
+type DeliveryMetadataMask uint8
+
+const (
+	// DeliveryMetaAttempt is the delivery attempt number of the message, starting at 1
+	DeliveryMetaAttempt DeliveryMetadataMask = 1 << iota
+	// DeliveryMetaPublished is when the message was published to the stream
+	DeliveryMetaPublished
+	// DeliveryMetaTimeInQueue is how long the message was in the stream before delivery
+	DeliveryMetaTimeInQueue
+	// DeliveryMetaLag is the number of messages pending for the consumer at delivery
+	DeliveryMetaLag
+)
+
+// deliveryMetadataFieldNames the names of the delivery metadata fields
+var deliveryMetadataFieldNames = []struct {
+	name  string
+	field DeliveryMetadataMask
+}{
+	{name: "attempt", field: DeliveryMetaAttempt},
+	{name: "published", field: DeliveryMetaPublished},
+	{name: "time_in_queue", field: DeliveryMetaTimeInQueue},
+	{name: "lag", field: DeliveryMetaLag},
+}
+
+// ParseDeliveryMetadataMask parse a list of delivery metadata field names. Each entry may
+// hold several comma separated names; "all" selects every field.
+func ParseDeliveryMetadataMask(entries []string) (DeliveryMetadataMask, error) {
+	var mask DeliveryMetadataMask
+	for _, entry := range entries {
+		for _, name := range strings.Split(entry, ",") {
+			name = strings.TrimSpace(name)
+			if name == "all" {
+				for _, known := range deliveryMetadataFieldNames {
+					mask |= known.field
+				}
+				continue
+			}
+			found := false
+			for _, known := range deliveryMetadataFieldNames {
+				if known.name == name {
+					mask |= known.field
+					found = true
+					break
+				}
+			}
+			if !found {
+				return 0, fmt.Errorf("unknown delivery metadata field '%s'", name)
+			}
+		}
+	}
+	return mask, nil
+}
+
+// DeliveryMetadata is the computed metadata of a delivered message
+type DeliveryMetadata struct {
+	// Attempt is the delivery attempt number of the message, starting at 1
+	Attempt uint64 `json:"attempt,omitempty"`
+	// Published is when the message was published to the stream
+	Published *time.Time `json:"published,omitempty"`
+	// TimeInQueue is how long the message was in the stream before delivery, in nanoseconds
+	TimeInQueue *time.Duration `json:"time_in_queue,omitempty" swaggertype:"integer"`
+	// Lag is the number of messages pending for the consumer at delivery
+	Lag *uint64 `json:"lag,omitempty"`
+}
+
+// GetDeliveryMetadata compute the metadata fields of mask for a message delivered at now.
+// Returns nil if mask is empty.
+func GetDeliveryMetadata(
+	meta *nats.MsgMetadata, mask DeliveryMetadataMask, now time.Time,
+) *DeliveryMetadata {
+	if mask == 0 {
+		return nil
+	}
+	result := &DeliveryMetadata{}
+	if mask&DeliveryMetaAttempt != 0 {
+		result.Attempt = meta.NumDelivered
+	}
+	if mask&DeliveryMetaPublished != 0 {
+		published := meta.Timestamp.UTC()
+		result.Published = &published
+	}
+	if mask&DeliveryMetaTimeInQueue != 0 {
+		inQueue := now.Sub(meta.Timestamp)
+		// Clocks of the server and this instance may disagree
+		if inQueue < 0 {
+			inQueue = 0
+		}
+		result.TimeInQueue = &inQueue
+	}
+	if mask&DeliveryMetaLag != 0 {
+		lag := meta.NumPending
+		result.Lag = &lag
+	}
+	return result
+}
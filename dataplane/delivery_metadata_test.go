@@ -0,0 +1,83 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: parse field masks
+	{
+		mask, err := ParseDeliveryMetadataMask(nil)
+		assert.Nil(err)
+		assert.Equal(DeliveryMetadataMask(0), mask)
+		mask, err = ParseDeliveryMetadataMask([]string{"attempt,lag", "published"})
+		assert.Nil(err)
+		assert.Equal(DeliveryMetaAttempt|DeliveryMetaLag|DeliveryMetaPublished, mask)
+		mask, err = ParseDeliveryMetadataMask([]string{"all"})
+		assert.Nil(err)
+		assert.Equal(
+			DeliveryMetaAttempt|DeliveryMetaPublished|DeliveryMetaTimeInQueue|DeliveryMetaLag, mask,
+		)
+		_, err = ParseDeliveryMetadataMask([]string{"attempt,unknown"})
+		assert.NotNil(err)
+		_, err = ParseDeliveryMetadataMask([]string{""})
+		assert.NotNil(err)
+	}
+
+	published := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	meta := &nats.MsgMetadata{
+		NumDelivered: 3,
+		NumPending:   0,
+		Timestamp:    published,
+	}
+
+	// Case 1: no fields requested
+	{
+		assert.Nil(GetDeliveryMetadata(meta, 0, published))
+	}
+
+	// Case 2: only the requested fields are computed
+	{
+		result := GetDeliveryMetadata(meta, DeliveryMetaAttempt|DeliveryMetaLag, published)
+		assert.NotNil(result)
+		encoded, err := json.Marshal(result)
+		assert.Nil(err)
+		assert.Equal(`{"attempt":3,"lag":0}`, string(encoded))
+	}
+
+	// Case 3: time in queue
+	{
+		result := GetDeliveryMetadata(
+			meta, DeliveryMetaPublished|DeliveryMetaTimeInQueue, published.Add(time.Second*5),
+		)
+		encoded, err := json.Marshal(result)
+		assert.Nil(err)
+		assert.Equal(
+			`{"published":"2022-03-01T10:00:00Z","time_in_queue":5000000000}`, string(encoded),
+		)
+		// A server clock ahead of this instance does not give a negative time
+		result = GetDeliveryMetadata(meta, DeliveryMetaTimeInQueue, published.Add(-time.Second))
+		assert.Equal(time.Duration(0), *result.TimeInQueue)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// primaryBeaconTimeout is how many beacon intervals a primary session is considered
+// connected after its last beacon
+const primaryBeaconTimeout = 3
+
+// defineDeliveryTierSubject helper function to define the NATs subject of the beacons of
+// the primary sessions of a delivery group
+func defineDeliveryTierSubject(stream, consumer, group string) string {
+	return fmt.Sprintf("delivery-tier.%s.%s.%s", stream, consumer, group)
+}
+
+// deliveryTierBeacon is sent periodically by a primary session of a delivery group
+type deliveryTierBeacon struct {
+	// Session identifies the primary session
+	Session string `json:"session"`
+	// Connected is false once the session has ended
+	Connected bool `json:"connected"`
+}
+
+// DeliveryTierCoordinator coordinates the primary and standby subscription sessions of
+// delivery groups across dataplane instances. Primary sessions send beacons over NATs, and
+// standby sessions only join their delivery group while they hear none.
+type DeliveryTierCoordinator interface {
+	// AnnouncePrimary announces a primary session of a delivery group until ctxt ends
+	AnnouncePrimary(
+		stream, consumer, group string, wg *sync.WaitGroup, ctxt context.Context,
+	) error
+	// WatchPrimaries watches for the primary sessions of a delivery group until ctxt ends.
+	// The channel receives whether any primary session is connected, first once that is
+	// known, and then on every change.
+	WatchPrimaries(
+		stream, consumer, group string, wg *sync.WaitGroup, ctxt context.Context,
+	) (<-chan bool, error)
+}
+
+// deliveryTierCoordinatorImpl implements DeliveryTierCoordinator
+type deliveryTierCoordinatorImpl struct {
+	common.Component
+	nats     *core.NatsClient
+	interval time.Duration
+}
+
+// GetDeliveryTierCoordinator define new DeliveryTierCoordinator
+//
+// Primary sessions send a beacon every interval. A primary session is considered gone once
+// it has sent none for three intervals, or right away if it ends cleanly.
+func GetDeliveryTierCoordinator(
+	natsClient *core.NatsClient, interval time.Duration, instance string,
+) (DeliveryTierCoordinator, error) {
+	logTags := log.Fields{
+		"module":    "dataplane",
+		"component": "delivery-tier-coordinator",
+		"instance":  instance,
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("delivery tier beacon interval must be positive")
+	}
+	return &deliveryTierCoordinatorImpl{
+		Component: common.Component{LogTags: logTags},
+		nats:      natsClient,
+		interval:  interval,
+	}, nil
+}
+
+// AnnouncePrimary announces a primary session of a delivery group until ctxt ends
+func (c *deliveryTierCoordinatorImpl) AnnouncePrimary(
+	stream, consumer, group string, wg *sync.WaitGroup, ctxt context.Context,
+) error {
+	localLogTags, err := common.UpdateLogTags(c.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(c.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	subject := defineDeliveryTierSubject(stream, consumer, group)
+	beacon := deliveryTierBeacon{Session: uuid.New().String(), Connected: true}
+	send := func() error {
+		payload, err := common.JSON().Marshal(&beacon)
+		if err != nil {
+			return err
+		}
+		return c.nats.NATs().Publish(subject, payload)
+	}
+	if err := send(); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to send primary beacon")
+		return err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := send(); err != nil {
+					log.WithError(err).WithFields(localLogTags).Errorf("Failed to send primary beacon")
+				}
+			case <-ctxt.Done():
+				// Let the standby sessions take over right away
+				beacon.Connected = false
+				if err := send(); err != nil {
+					log.WithError(err).WithFields(localLogTags).Errorf("Failed to send final beacon")
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// WatchPrimaries watches for the primary sessions of a delivery group until ctxt ends
+func (c *deliveryTierCoordinatorImpl) WatchPrimaries(
+	stream, consumer, group string, wg *sync.WaitGroup, ctxt context.Context,
+) (<-chan bool, error) {
+	localLogTags, err := common.UpdateLogTags(c.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(c.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	beacons := make(chan deliveryTierBeacon, 16)
+	sub, err := c.nats.NATs().Subscribe(
+		defineDeliveryTierSubject(stream, consumer, group), func(msg *nats.Msg) {
+			var beacon deliveryTierBeacon
+			if err := common.JSON().Unmarshal(msg.Data, &beacon); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf("Failed to read beacon: %s", msg.Data)
+				return
+			}
+			select {
+			case beacons <- beacon:
+			case <-ctxt.Done():
+			}
+		},
+	)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to subscribe for beacons")
+		return nil, err
+	}
+
+	changes := make(chan bool, 1)
+	tracker := definePrimaryTracker(c.interval * primaryBeaconTimeout)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if err := sub.Unsubscribe(); err != nil {
+				log.WithError(err).WithFields(localLogTags).Error("Unsubscribe failed")
+			}
+		}()
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		// Absence of primaries is only known once they had time to send a beacon
+		decided := false
+		undecided := time.NewTimer(c.interval * primaryBeaconTimeout)
+		defer undecided.Stop()
+		connected := false
+		report := func(now time.Time) bool {
+			current := tracker.connected(now)
+			if decided && current == connected {
+				return true
+			}
+			decided = true
+			connected = current
+			select {
+			case changes <- current:
+				return true
+			case <-ctxt.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case beacon := <-beacons:
+				now := time.Now()
+				tracker.observe(beacon, now)
+				// Presence is reported at once, but absence waits for the decision
+				if decided || tracker.connected(now) {
+					if !report(now) {
+						return
+					}
+				}
+			case <-undecided.C:
+				if !report(time.Now()) {
+					return
+				}
+			case <-ticker.C:
+				if decided && !report(time.Now()) {
+					return
+				}
+			case <-ctxt.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// primaryTracker tracks when each primary session of a delivery group was last heard from
+type primaryTracker struct {
+	timeout  time.Duration
+	lastSeen map[string]time.Time
+}
+
+// definePrimaryTracker define a new primaryTracker
+func definePrimaryTracker(timeout time.Duration) *primaryTracker {
+	return &primaryTracker{timeout: timeout, lastSeen: map[string]time.Time{}}
+}
+
+// observe record a beacon
+func (t *primaryTracker) observe(beacon deliveryTierBeacon, now time.Time) {
+	if beacon.Connected {
+		t.lastSeen[beacon.Session] = now
+	} else {
+		delete(t.lastSeen, beacon.Session)
+	}
+}
+
+// connected returns whether any primary session is connected, forgetting the sessions
+// which have gone silent
+func (t *primaryTracker) connected(now time.Time) bool {
+	for session, seen := range t.lastSeen {
+		if now.Sub(seen) > t.timeout {
+			delete(t.lastSeen, session)
+		}
+	}
+	return len(t.lastSeen) > 0
+}
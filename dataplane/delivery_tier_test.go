@@ -0,0 +1,64 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrimaryTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid beacon interval
+	{
+		_, err := GetDeliveryTierCoordinator(nil, 0, "ut-delivery-tier")
+		assert.NotNil(err)
+	}
+
+	uut := definePrimaryTracker(time.Second * 3)
+	start := time.Now()
+
+	// Case 1: no primary heard from
+	assert.False(uut.connected(start))
+
+	// Case 2: primaries sending beacons
+	{
+		uut.observe(deliveryTierBeacon{Session: "a", Connected: true}, start)
+		uut.observe(deliveryTierBeacon{Session: "b", Connected: true}, start.Add(time.Second))
+		assert.True(uut.connected(start.Add(time.Second * 2)))
+	}
+
+	// Case 3: one primary goes silent
+	{
+		assert.True(uut.connected(start.Add(time.Second * 4)))
+		assert.Len(uut.lastSeen, 1)
+	}
+
+	// Case 4: the other primary ends cleanly
+	{
+		uut.observe(deliveryTierBeacon{Session: "b", Connected: false}, start.Add(time.Second*4))
+		assert.False(uut.connected(start.Add(time.Second * 4)))
+	}
+
+	// Case 5: all primaries go silent
+	{
+		uut.observe(deliveryTierBeacon{Session: "c", Connected: true}, start.Add(time.Second*5))
+		assert.True(uut.connected(start.Add(time.Second * 8)))
+		assert.False(uut.connected(start.Add(time.Second * 9)))
+	}
+}
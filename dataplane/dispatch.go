@@ -16,20 +16,62 @@ package dataplane
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/filters"
+	"github.com/alwitt/httpmq/hooks"
+	"github.com/alwitt/httpmq/metrics"
 	"github.com/apex/log"
 	"github.com/nats-io/nats.go"
 )
 
+// pendingACKTTL how long an ACK which arrived ahead of its message is held before dropping
+//
+// A client can ACK a message after it is forwarded, but before it is recorded as inflight.
+const pendingACKTTL = time.Second * 10
+
+// msgTrackingShards number of shards, each with its own task processor, the inflight
+// messages of a dispatcher are split into
+const msgTrackingShards = 4
+
+// ackDeadlineChecks number of times per ACK deadline the inflight messages are checked for
+// messages which missed the deadline
+const ackDeadlineChecks = 4
+
+// maxACKBatch max number of ACKs passed to the message tracker as one batch
+const maxACKBatch = 64
+
 // MessageDispatcher process a consumer subscription request from a client and dispatch
 // messages to that client
 type MessageDispatcher interface {
 	// Start starts operations
 	Start(msgOutput ForwardMessageHandlerCB, errorCB AlertOnErrorCB) error
+	// Consumer returns the name of the consumer messages are dispatched for
+	Consumer() string
+	// Redeliver forwards again messages delivered by an earlier subscription through the
+	// consumer, which are still awaiting ACK, instead of waiting for JetStream to redeliver
+	// them. Must be called after Start.
+	Redeliver(msgs []*nats.Msg) error
+	// Nak gives back a forwarded message which never reached the client, so it is
+	// redelivered, and frees the client capacity it held
+	Nak(msg *nats.Msg) error
+	// WarmUp returns the progress of the delivery warm-up, and false if warm-up is disabled
+	WarmUp() (WarmUpProgress, bool)
+	// Stop tears down the dispatcher immediately. Messages awaiting ACK are redelivered by
+	// JetStream once their ACK wait expires. Waits until ctxt ends for the dispatcher to stop
+	// reading from JetStream.
+	Stop(ctxt context.Context) error
+	// Drain stops reading new messages, and waits until ctxt ends for the messages already
+	// forwarded to be ACKed. The dispatcher must still be stopped afterwards.
+	Drain(ctxt context.Context) error
+	// Inflight lists the messages forwarded, and awaiting ACK, oldest first
+	Inflight(ctxt context.Context) ([]InflightMessage, error)
 }
 
 // pushMessageDispatcher implements MessageDispatcher for a push consumer
@@ -37,28 +79,187 @@ type pushMessageDispatcher struct {
 	common.Component
 	nats       *core.NatsClient
 	optContext context.Context
-	wg         *sync.WaitGroup
-	lock       *sync.Mutex
-	started    bool
+	stop       context.CancelFunc
+	// readContext ends once the dispatcher stops reading new messages
+	readContext context.Context
+	stopReading context.CancelFunc
+	wg          *sync.WaitGroup
+	// readers waits for the subscriber to stop reading
+	readers   *sync.WaitGroup
+	lock      *sync.Mutex
+	started   bool
+	msgOutput ForwardMessageHandlerCB
+	errorCB   AlertOnErrorCB
+	stream    string
+	consumer  string
+	// redactor is applied to messages before they are forwarded
+	redactor MessageRedactor
+	// selector decides which messages are forwarded, if set
+	selector MessageSelector
+	// filter decides whether messages are forwarded, if the consumer has one
+	filter filters.Filter
+	// latency tracks the ACK latency of the consumer, and paces it if it is slow
+	latency metrics.ConsumerLatencyTracker
+	// gate tracks the messages forwarded awaiting ACK, and bounds them if limited
+	gate *deliveryGate
+	// warmUp ramps up the delivery rate while the backlog drains, if set
+	warmUp *warmUpLimiter
+	// fairness deflects messages away from the session while it is slow to ACK compared
+	// to the other sessions of its delivery group, if set
+	fairness GroupMember
+	// ackDeadline if not zero, messages not ACKed within it are NAKed
+	ackDeadline time.Duration
+	// maxTrackingPanics if not zero, the dispatcher fails once the message tracking has
+	// recovered from this many panics
+	maxTrackingPanics int
+	trackingPanics    int64
 	// msgTracking monitors the set of inflight messages
-	msgTracking   JetStreamInflightMsgProcessor
-	msgTrackingTP common.TaskProcessor
+	msgTracking    JetStreamInflightMsgProcessor
+	msgTrackingTPs []common.TaskProcessor
 	// ackWatcher monitors for ACK being received
 	ackWatcher JetStreamACKReceiver
 	// subscriber connected to JetStream to receive messages
 	subscriber JetStreamPushSubscriber
 }
 
+// PushDispatcherOptions are the optional features of a push MessageDispatcher. The zero
+// value disables all of them.
+type PushDispatcherOptions struct {
+	// ExternalACKPrefix if set, ACKs are also received from external workers on the subject
+	// DefineExternalACKSubject
+	ExternalACKPrefix string
+	// Persistence if set, persists the records of inflight messages
+	Persistence InflightMsgPersistence
+	// Redactor if set, is applied to messages before they are forwarded
+	Redactor MessageRedactor
+	// Selector if set, only messages it matches are forwarded
+	Selector MessageSelector
+	// FilterRegistry if set, and the consumer has a filter in the registry, the filter
+	// decides whether each message is forwarded, dropped, or transformed
+	FilterRegistry filters.Registry
+	// Latency if set, records the ACK latency of the consumer, and throttles delivery to the
+	// consumer while it is slow
+	Latency metrics.ConsumerLatencyTracker
+	// Fairness if set, messages are NAKed for redelivery to another session of the delivery
+	// group while this session is slow to ACK compared to the others
+	Fairness GroupMember
+}
+
 // GetPushMessageDispatcher get a new push MessageDispatcher
+//
+// concurrency bounds the messages forwarded to the client awaiting ACK, and how long the
+// client has to ACK each.
 func GetPushMessageDispatcher(
 	natsClient *core.NatsClient,
 	stream, subject, consumer string,
 	deliveryGroup *string,
 	maxInflightMsgs int,
+	concurrency DeliveryConcurrency,
+	opts PushDispatcherOptions,
 	wg *sync.WaitGroup,
 	ctxt context.Context,
 ) (MessageDispatcher, error) {
-	instance := fmt.Sprintf("%s@%s/%s", consumer, stream, subject)
+	logTags := dispatcherLogTags(stream, subject, consumer, ctxt)
+	info, err := natsClient.JetStream().ConsumerInfo(stream, consumer)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to read consumer info")
+		return nil, err
+	}
+	gate, err := defineDeliveryGate(concurrency, info.Config.AckWait)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid delivery concurrency")
+		return nil, err
+	}
+	warmUp, err := defineWarmUpLimiter(concurrency)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid delivery warm-up")
+		return nil, err
+	}
+	subscriber, err := getJetStreamPushSubscriber(
+		natsClient, stream, subject, consumer, deliveryGroup,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define MSG subscriber")
+		return nil, err
+	}
+	return definePushMessageDispatcher(
+		natsClient,
+		subscriber,
+		stream,
+		subject,
+		consumer,
+		maxInflightMsgs,
+		gate,
+		warmUp,
+		concurrency.AckDeadline,
+		concurrency.MaxTrackingPanics,
+		opts,
+		wg,
+		ctxt,
+	)
+}
+
+// GetEphemeralPushMessageDispatcher get a new push MessageDispatcher which reads through an
+// ephemeral consumer. The consumer only exists for the lifetime of ctxt, and its name is
+// given by Consumer() of the dispatcher.
+//
+// If deliverNew, the consumer only receives messages published after it is created.
+// concurrency bounds the messages forwarded to the client awaiting ACK, and how long the
+// client has to ACK each. The consumer does not out live the session, and belongs to no
+// delivery group, so opts can not set Persistence, FilterRegistry, Latency, or Fairness.
+func GetEphemeralPushMessageDispatcher(
+	natsClient *core.NatsClient,
+	stream, subject string,
+	deliverNew bool,
+	maxInflightMsgs int,
+	concurrency DeliveryConcurrency,
+	opts PushDispatcherOptions,
+	wg *sync.WaitGroup,
+	ctxt context.Context,
+) (MessageDispatcher, error) {
+	logTags := dispatcherLogTags(stream, subject, "", ctxt)
+	if opts.Persistence != nil || opts.FilterRegistry != nil || opts.Latency != nil ||
+		opts.Fairness != nil {
+		err := fmt.Errorf("ephemeral dispatchers only support external ACKs, redaction, and selectors")
+		log.WithError(err).WithFields(logTags).Errorf("Invalid dispatcher options")
+		return nil, err
+	}
+	gate, err := defineDeliveryGate(concurrency, ephemeralAckWait)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid delivery concurrency")
+		return nil, err
+	}
+	warmUp, err := defineWarmUpLimiter(concurrency)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid delivery warm-up")
+		return nil, err
+	}
+	subscriber, consumer, err := getJetStreamEphemeralPushSubscriber(
+		natsClient, stream, subject, deliverNew, maxInflightMsgs,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define MSG subscriber")
+		return nil, err
+	}
+	return definePushMessageDispatcher(
+		natsClient,
+		subscriber,
+		stream,
+		subject,
+		consumer,
+		maxInflightMsgs,
+		gate,
+		warmUp,
+		concurrency.AckDeadline,
+		concurrency.MaxTrackingPanics,
+		opts,
+		wg,
+		ctxt,
+	)
+}
+
+// dispatcherLogTags helper function to define the log tags of a dispatcher
+func dispatcherLogTags(stream, subject, consumer string, ctxt context.Context) log.Fields {
 	logTags := log.Fields{
 		"module":    "dataplane",
 		"component": "push-msg-dispatcher",
@@ -72,47 +273,114 @@ func GetPushMessageDispatcher(
 			v.UpdateLogTags(logTags)
 		}
 	}
+	return logTags
+}
+
+// definePushMessageDispatcher helper function to define a push MessageDispatcher around
+// a subscriber
+func definePushMessageDispatcher(
+	natsClient *core.NatsClient,
+	subscriber JetStreamPushSubscriber,
+	stream, subject, consumer string,
+	maxInflightMsgs int,
+	gate *deliveryGate,
+	warmUp *warmUpLimiter,
+	ackDeadline time.Duration,
+	maxTrackingPanics int,
+	opts PushDispatcherOptions,
+	wg *sync.WaitGroup,
+	ctxt context.Context,
+) (MessageDispatcher, error) {
+	instance := fmt.Sprintf("%s@%s/%s", consumer, stream, subject)
+	logTags := dispatcherLogTags(stream, subject, consumer, ctxt)
+	// The dispatcher can be stopped ahead of ctxt
+	ctxt, stop := context.WithCancel(ctxt)
 
 	// Define components
-	ackReceiver, err := getJetStreamACKReceiver(natsClient, stream, subject, consumer)
+	ackReceiver, err := getJetStreamACKReceiver(
+		natsClient, stream, subject, consumer, opts.ExternalACKPrefix,
+	)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf("Unable to define ACK receiver")
+		stop()
 		return nil, err
 	}
-	msgTrackingTP, err := common.GetNewTaskProcessorInstance(instance, maxInflightMsgs*4, ctxt)
-	if err != nil {
-		log.WithError(err).WithFields(logTags).Errorf("Unable to define task processor")
-		return nil, err
+	msgTrackingTPs := make([]common.TaskProcessor, msgTrackingShards)
+	for itr := range msgTrackingTPs {
+		msgTrackingTPs[itr], err = common.GetNewTaskProcessorInstance(
+			fmt.Sprintf("%s.shard.%d", instance, itr), maxInflightMsgs*4, ctxt,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define task processor")
+			stop()
+			return nil, err
+		}
 	}
 	msgTracking, err := getJetStreamInflightMsgProcessor(
-		msgTrackingTP, stream, subject, consumer, ctxt,
+		msgTrackingTPs, stream, subject, consumer, pendingACKTTL, opts.Persistence, opts.Latency, ctxt,
 	)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf("Unable to define MSG tracker")
+		stop()
 		return nil, err
 	}
-	subscriber, err := getJetStreamPushSubscriber(
-		natsClient, stream, subject, consumer, deliveryGroup,
-	)
-	if err != nil {
-		log.WithError(err).WithFields(logTags).Errorf("Unable to define MSG subscriber")
-		return nil, err
+	var filter filters.Filter
+	if opts.FilterRegistry != nil {
+		filter, err = opts.FilterRegistry.LoadFilter(stream, consumer, ctxt)
+		if errors.Is(err, filters.ErrNoFilter) {
+			filter = nil
+		} else if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to load MSG filter")
+			stop()
+			return nil, err
+		} else {
+			// The filter instance lives as long as the dispatcher
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-ctxt.Done()
+				if err := filter.Close(context.Background()); err != nil {
+					log.WithError(err).WithFields(logTags).Errorf("Failed to close MSG filter")
+				}
+			}()
+		}
 	}
 
+	readContext, stopReading := context.WithCancel(ctxt)
 	return &pushMessageDispatcher{
-		Component:     common.Component{LogTags: logTags},
-		nats:          natsClient,
-		optContext:    ctxt,
-		wg:            wg,
-		lock:          &sync.Mutex{},
-		started:       false,
-		msgTracking:   msgTracking,
-		msgTrackingTP: msgTrackingTP,
-		ackWatcher:    ackReceiver,
-		subscriber:    subscriber,
+		Component:         common.Component{LogTags: logTags},
+		nats:              natsClient,
+		optContext:        ctxt,
+		stop:              stop,
+		readContext:       readContext,
+		stopReading:       stopReading,
+		wg:                wg,
+		readers:           &sync.WaitGroup{},
+		lock:              &sync.Mutex{},
+		started:           false,
+		stream:            stream,
+		consumer:          consumer,
+		redactor:          opts.Redactor,
+		selector:          opts.Selector,
+		filter:            filter,
+		latency:           opts.Latency,
+		fairness:          opts.Fairness,
+		gate:              gate,
+		warmUp:            warmUp,
+		ackDeadline:       ackDeadline,
+		maxTrackingPanics: maxTrackingPanics,
+		msgTracking:       msgTracking,
+		msgTrackingTPs:    msgTrackingTPs,
+		ackWatcher:        ackReceiver,
+		subscriber:        subscriber,
 	}, nil
 }
 
+// Consumer returns the name of the consumer messages are dispatched for
+func (d *pushMessageDispatcher) Consumer() string {
+	return d.consumer
+}
+
 // Start starts the push message dispatcher operation
 func (d *pushMessageDispatcher) Start(
 	msgOutput ForwardMessageHandlerCB, errorCB AlertOnErrorCB,
@@ -123,19 +391,64 @@ func (d *pushMessageDispatcher) Start(
 		return fmt.Errorf("already started")
 	}
 
-	// Start message tracking TP
-	if err := d.msgTrackingTP.StartEventLoop(d.wg); err != nil {
-		log.WithError(err).WithFields(d.LogTags).Errorf("Failed to start MSG tracker task processor")
-		return err
+	// Start message tracking TPs
+	for _, tp := range d.msgTrackingTPs {
+		if d.maxTrackingPanics > 0 {
+			_ = tp.SetPanicHandler(func(_ interface{}, _ interface{}) {
+				d.onTrackingPanic(errorCB)
+			})
+		}
+		if err := tp.StartEventLoop(d.wg); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Failed to start MSG tracker task processor")
+			return err
+		}
+	}
+
+	// NAK messages the client does not ACK in time
+	if d.ackDeadline > 0 {
+		timer, err := common.GetIntervalTimerInstance(
+			fmt.Sprintf("%s@%s.ack-deadline", d.consumer, d.stream), d.optContext, d.wg,
+		)
+		if err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to define ACK deadline timer")
+			return err
+		}
+		// Slow sweeps must not push back the checks, or messages overstay the deadline
+		if err := timer.SetMode(common.FixedRate); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to define ACK deadline timer")
+			return err
+		}
+		if err := timer.Start(d.ackDeadline/ackDeadlineChecks, func() error {
+			return d.msgTracking.NAKOverdueMessages(d.ackDeadline, d.releaseNAKed, d.optContext)
+		}, false); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Failed to start ACK deadline timer")
+			return err
+		}
 	}
 
+	// ACKs received together are passed to the message tracker as one batch
+	ackQueue := make(chan AckIndication, maxACKBatch)
+	d.wg.Add(1)
+	go d.batchACKs(ackQueue)
+
 	// Start ACK receiver
 	if err := d.ackWatcher.SubscribeForACKs(
 		d.wg, d.optContext, func(ai AckIndication, ctxt context.Context) {
-			log.WithFields(d.LogTags).Debugf("Processing %s", ai.String())
-			// Pass to message tracker in non-blocking mode
-			if err := d.msgTracking.HandlerMsgACK(ai, false, ctxt); err != nil {
-				log.WithError(err).WithFields(d.LogTags).Errorf("Failed to submit %s", ai.String())
+			common.ThrottledDebugf(log.WithFields(d.LogTags), "Processing %s", ai.String())
+			// A message in progress still holds the client capacity
+			if ai.Stream == d.stream && ai.Consumer == d.consumer {
+				if ai.Kind() == AckTypeProgress {
+					d.gate.extend(ai.SeqNum.Stream)
+				} else {
+					d.gate.release(ai.SeqNum.Stream)
+					if d.fairness != nil {
+						d.fairness.Release(ai.SeqNum.Stream)
+					}
+				}
+			}
+			select {
+			case ackQueue <- ai:
+			case <-ctxt.Done():
 			}
 		},
 	); err != nil {
@@ -145,24 +458,309 @@ func (d *pushMessageDispatcher) Start(
 
 	// Start subscriber
 	if err := d.subscriber.StartReading(func(msg *nats.Msg, ctxt context.Context) error {
-		msgName := msgToString(msg)
-		log.WithFields(d.LogTags).Debugf("Processing %s", msgName)
-		// Forward the message toward consumer
-		if err := msgOutput(msg, ctxt); err != nil {
-			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to forward %s", msgName)
-			return err
+		return d.forward(msg, msgOutput, ctxt)
+	}, errorCB, d.readers, d.readContext); err != nil {
+		log.WithError(err).WithFields(d.LogTags).Errorf("Failed to start MSG subscriber")
+		return err
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.readers.Wait()
+	}()
+
+	d.msgOutput = msgOutput
+	d.errorCB = errorCB
+	d.started = true
+	return nil
+}
+
+// batchACKs pass the ACKs received to the message tracker, in batches of the ACKs received
+// while the previous batch was being submitted
+func (d *pushMessageDispatcher) batchACKs(ackQueue chan AckIndication) {
+	defer d.wg.Done()
+	for {
+		var batch []AckIndication
+		select {
+		case <-d.optContext.Done():
+			return
+		case ack := <-ackQueue:
+			batch = append(batch, ack)
+		}
+		// Take the ACKs already waiting, without waiting for more
+		for draining := true; draining && len(batch) < maxACKBatch; {
+			select {
+			case ack := <-ackQueue:
+				batch = append(batch, ack)
+			default:
+				draining = false
+			}
 		}
 		// Pass to message tracker in non-blocking mode
-		if err := d.msgTracking.RecordInflightMessage(msg, false, ctxt); err != nil {
-			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to record %s", msgName)
+		if err := d.msgTracking.HandlerMsgACKs(batch, d.optContext); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf(
+				"Failed to submit batch of %d ACKs", len(batch),
+			)
+		}
+	}
+}
+
+// onTrackingPanic helper function to fail the dispatcher once the message tracking has
+// recovered from maxTrackingPanics panics
+func (d *pushMessageDispatcher) onTrackingPanic(errorCB AlertOnErrorCB) {
+	if atomic.AddInt64(&d.trackingPanics, 1) == int64(d.maxTrackingPanics) {
+		err := fmt.Errorf("message tracking recovered from %d panics", d.maxTrackingPanics)
+		log.WithError(err).WithFields(d.LogTags).Errorf("Failing dispatcher")
+		errorCB(err)
+	}
+}
+
+// forward helper function to pass a message read from JetStream through the selector,
+// filter, pacing, and redaction of the dispatcher, and forward it toward the client
+func (d *pushMessageDispatcher) forward(
+	msg *nats.Msg, msgOutput ForwardMessageHandlerCB, ctxt context.Context,
+) error {
+	msgName := NewMsgEnvelope(msg).String()
+	common.ThrottledDebugf(log.WithFields(d.LogTags), "Processing %s", msgName)
+	// Skip unselected messages before they take up client capacity
+	if d.selector != nil && !d.selector.Matches(msg) {
+		common.ThrottledDebugf(log.WithFields(d.LogTags), "Selector skipped %s", msgName)
+		return d.settleSkipped(msg, msgName, AckTypeAck)
+	}
+	// Apply the consumer's filter before the message takes up client capacity. The original
+	// message is still tracked, as it is needed to ACK the message.
+	toForward := msg
+	if d.filter != nil {
+		filtered, err := ApplyMessageFilter(d.filter, msg, ctxt)
+		if err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to filter %s", msgName)
+			return err
+		}
+		if filtered == nil {
+			common.ThrottledDebugf(log.WithFields(d.LogTags), "Filter dropped %s", msgName)
+			return d.settleSkipped(msg, msgName, AckTypeTerm)
+		}
+		toForward = filtered
+	}
+	// Pace delivery to a consumer which is slow to ACK
+	if d.latency != nil {
+		if err := d.latency.Throttle(d.stream, d.consumer, ctxt); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Gave up forwarding %s", msgName)
+			return err
+		}
+	}
+	meta, err := msg.Metadata()
+	if err != nil {
+		log.WithError(err).WithFields(d.LogTags).Errorf("Unable to parse %s", msgName)
+		return err
+	}
+	// Ramp up delivery while the backlog drains
+	if d.warmUp != nil {
+		if err := d.warmUp.wait(meta.NumPending, ctxt); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Gave up forwarding %s", msgName)
+			return err
+		}
+	}
+	// Leave the message to a less loaded session of the delivery group
+	if d.fairness != nil && !d.fairness.Admit(meta.Sequence.Stream, meta.NumDelivered) {
+		common.ThrottledDebugf(log.WithFields(d.LogTags), "Deflecting %s", msgName)
+		if err := msg.Nak(); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to NAK deflected %s", msgName)
 			return err
 		}
 		return nil
-	}, errorCB, d.wg, d.optContext); err != nil {
-		log.WithError(err).WithFields(d.LogTags).Errorf("Failed to start MSG subscriber")
+	}
+	// A message which is not forwarded gives back its admission and its slot, and is NAKed,
+	// so it is redelivered without waiting out the AckWait
+	gated, forwarded := false, false
+	defer func() {
+		if forwarded {
+			return
+		}
+		if gated {
+			d.gate.release(meta.Sequence.Stream)
+		}
+		if d.fairness != nil {
+			d.fairness.Release(meta.Sequence.Stream)
+		}
+		if err := msg.Nak(); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to NAK unforwarded %s", msgName)
+		}
+	}()
+	// Hold the message until the client has capacity for it
+	if err := d.gate.acquire(meta.Sequence.Stream, ctxt); err != nil {
+		log.WithError(err).WithFields(d.LogTags).Errorf("Gave up forwarding %s", msgName)
+		return err
+	}
+	gated = true
+	// Remove sensitive content before the message leaves the gateway
+	if d.redactor != nil {
+		redacted, err := d.redactor.Redact(d.stream, d.consumer, toForward)
+		if err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Unable to redact %s", msgName)
+			return err
+		}
+		toForward = redacted
+	}
+	event := hooks.DeliverEvent{Stream: d.stream, Consumer: d.consumer, Message: toForward}
+	hooks.OnDeliver(&event, ctxt)
+	toForward = event.Message
+	// Forward the message toward consumer
+	if err := msgOutput(toForward, ctxt); err != nil {
+		log.WithError(err).WithFields(d.LogTags).Errorf("Unable to forward %s", msgName)
 		return err
 	}
+	forwarded = true
+	// Pass to message tracker in non-blocking mode
+	if err := d.msgTracking.RecordInflightMessage(msg, false, ctxt); err != nil {
+		log.WithError(err).WithFields(d.LogTags).Errorf("Unable to record %s", msgName)
+		return err
+	}
+	return nil
+}
 
-	d.started = true
+// Redeliver forwards again messages delivered by an earlier subscription through the consumer
+func (d *pushMessageDispatcher) Redeliver(msgs []*nats.Msg) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.started {
+		return fmt.Errorf("not started")
+	}
+	msgOutput, errorCB := d.msgOutput, d.errorCB
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for _, msg := range msgs {
+			if d.optContext.Err() != nil {
+				return
+			}
+			// Hold off JetStream redelivering the message while the client works on this copy
+			if err := msg.InProgress(); err != nil {
+				log.WithError(err).WithFields(d.LogTags).Warnf(
+					"Unable to reset ACK wait of %s", NewMsgEnvelope(msg).String(),
+				)
+			}
+			if err := d.forward(msg, msgOutput, d.optContext); err != nil {
+				errorCB(err)
+				return
+			}
+		}
+		log.WithFields(d.LogTags).Debugf("Redelivered %d messages", len(msgs))
+	}()
 	return nil
 }
+
+// Nak gives back a forwarded message which never reached the client, so it is redelivered,
+// and frees the client capacity it held
+func (d *pushMessageDispatcher) Nak(msg *nats.Msg) error {
+	meta, err := msg.Metadata()
+	if err != nil {
+		log.WithError(err).WithFields(d.LogTags).Errorf("Unable to read message metadata")
+		return err
+	}
+	d.gate.release(meta.Sequence.Stream)
+	if d.fairness != nil {
+		d.fairness.Release(meta.Sequence.Stream)
+	}
+	// The message tracker NAKs the message, and drops its record
+	return d.msgTracking.HandlerMsgACK(AckIndication{
+		Stream:   d.stream,
+		Consumer: d.consumer,
+		SeqNum:   AckSeqNum{Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer},
+		Type:     AckTypeNak,
+	}, false, d.optContext)
+}
+
+// WarmUp returns the progress of the delivery warm-up, and false if warm-up is disabled
+func (d *pushMessageDispatcher) WarmUp() (WarmUpProgress, bool) {
+	if d.warmUp == nil {
+		return WarmUpProgress{}, false
+	}
+	return d.warmUp.report(), true
+}
+
+// Stop tears down the dispatcher immediately
+func (d *pushMessageDispatcher) Stop(ctxt context.Context) error {
+	d.stop()
+	stopped := make(chan struct{})
+	go func() {
+		d.readers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.WithFields(d.LogTags).Info("Stopped dispatcher")
+		return nil
+	case <-ctxt.Done():
+		log.WithError(ctxt.Err()).WithFields(d.LogTags).Warn("Gave up waiting for dispatcher to stop")
+		return ctxt.Err()
+	}
+}
+
+// Drain stops reading new messages, and waits for the messages already forwarded to be ACKed
+func (d *pushMessageDispatcher) Drain(ctxt context.Context) error {
+	d.stopReading()
+	unacked, err := d.gate.waitIdle(ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(d.LogTags).Warnf(
+			"Gave up draining dispatcher with %d messages awaiting ACK", unacked,
+		)
+		return err
+	}
+	log.WithFields(d.LogTags).Info("Drained dispatcher")
+	return nil
+}
+
+// Inflight lists the messages forwarded, and awaiting ACK, oldest first
+func (d *pushMessageDispatcher) Inflight(ctxt context.Context) ([]InflightMessage, error) {
+	return d.msgTracking.ListInflightMessages(ctxt)
+}
+
+// releaseNAKed helper function to free the client capacity held by a message NAKed for
+// missing its ACK deadline
+func (d *pushMessageDispatcher) releaseNAKed(msg *nats.Msg) {
+	if meta, err := msg.Metadata(); err == nil && meta.Stream == d.stream {
+		d.gate.release(meta.Sequence.Stream)
+		if d.fairness != nil {
+			d.fairness.Release(meta.Sequence.Stream)
+		}
+	}
+}
+
+// settleSkipped helper function to settle a message which is not forwarded, so it is not
+// delivered again.
+//
+// Messages skipped by the selector are ACKed. Selectors are only allowed on subscriptions
+// outside of delivery groups, so no other session of the consumer is waiting for them.
+// Messages dropped by the consumer's filter are terminated instead, as they are dropped for
+// every session of the consumer, and were never processed.
+func (d *pushMessageDispatcher) settleSkipped(
+	msg *nats.Msg, msgName string, kind AckType,
+) error {
+	if err := ackMessage(msg, kind); err != nil {
+		log.WithError(err).WithFields(d.LogTags).Errorf("Unable to settle skipped %s", msgName)
+		return err
+	}
+	return nil
+}
+
+// ApplyMessageFilter run a filter on a message. Returns the message to
+// forward, or nil if the filter dropped the message.
+func ApplyMessageFilter(
+	filter filters.Filter, msg *nats.Msg, ctxt context.Context,
+) (*nats.Msg, error) {
+	action, data, err := filter.Apply(msg.Data, ctxt)
+	if err != nil {
+		return nil, err
+	}
+	switch action {
+	case filters.ActionDrop:
+		return nil, nil
+	case filters.ActionTransform:
+		return &nats.Msg{
+			Subject: msg.Subject, Reply: msg.Reply, Header: msg.Header, Data: data, Sub: msg.Sub,
+		}, nil
+	default:
+		return msg, nil
+	}
+}
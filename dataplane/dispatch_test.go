@@ -23,7 +23,9 @@ import (
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/filters"
 	"github.com/alwitt/httpmq/management"
+	"github.com/alwitt/httpmq/storage"
 	"github.com/apex/log"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
@@ -110,7 +112,16 @@ func TestPushMessageDispatcher(t *testing.T) {
 
 	// Case 0: start a new dispatcher
 	uut, err := GetPushMessageDispatcher(
-		js, stream1, subject1, consumer1, nil, maxInflight, &wg, utCtxt,
+		js,
+		stream1,
+		subject1,
+		consumer1,
+		nil,
+		maxInflight,
+		DeliveryConcurrency{},
+		PushDispatcherOptions{},
+		&wg,
+		utCtxt,
 	)
 	assert.Nil(err)
 	assert.Nil(uut.Start(msgHandler, internalErrorHandler))
@@ -210,3 +221,901 @@ func TestPushMessageDispatcher(t *testing.T) {
 	}
 	log.Debug("============================= 10 =============================")
 }
+
+func TestPushMessageDispatcherDeliveryConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-push-dispatcher-concurrency"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "MessageDispatcher",
+		"instance":  "deliveryConcurrency",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream and consumers for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.primary", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	consumer1 := uuid.New().String()
+	maxInflight := 4
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: maxInflight, Mode: "push", FilterSubject: &subject1,
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+	}
+	log.Debug("============================= 1 =============================")
+
+	msgRxChan := make(chan *nats.Msg, maxInflight)
+	msgHandler := func(msg *nats.Msg, _ context.Context) error {
+		msgRxChan <- msg
+		return nil
+	}
+
+	internalErrorHandler := func(err error) {
+		assert.Equal("nats: connection closed", err.Error())
+	}
+
+	// Case 0: invalid delivery concurrency
+	{
+		_, err := GetPushMessageDispatcher(
+			js,
+			stream1,
+			subject1,
+			consumer1,
+			nil,
+			maxInflight,
+			DeliveryConcurrency{MaxUnacked: -1},
+			PushDispatcherOptions{},
+			&wg,
+			utCtxt,
+		)
+		assert.NotNil(err)
+	}
+
+	// Case 1: start a new dispatcher with strict ordering
+	uut, err := GetPushMessageDispatcher(
+		js,
+		stream1,
+		subject1,
+		consumer1,
+		nil,
+		maxInflight,
+		DeliveryConcurrency{Ordered: true},
+		PushDispatcherOptions{},
+		&wg,
+		utCtxt,
+	)
+	assert.Nil(err)
+	assert.Nil(uut.Start(msgHandler, internalErrorHandler))
+	log.Debug("============================= 2 =============================")
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+	ackSend, err := GetJetStreamACKBroadcaster(js, testName)
+	assert.Nil(err)
+
+	// Case 2: send messages, though the consumer permits more inflight, only one is forwarded
+	// at a time
+	msgs := [][]byte{}
+	for itr := 0; itr < 3; itr++ {
+		msg := []byte(uuid.New().String())
+		msgs = append(msgs, msg)
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		assert.Nil(publisher.Publish(subject1, msg, ctxt))
+		cancel()
+	}
+	log.Debug("============================= 3 =============================")
+	for itr, expected := range msgs {
+		msgSeqNum := AckSeqNum{}
+		// verify reception
+		{
+			ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+			select {
+			case rxMsg, ok := <-msgRxChan:
+				assert.True(ok)
+				assert.Equal(expected, rxMsg.Data)
+				meta, err := rxMsg.Metadata()
+				assert.Nil(err)
+				msgSeqNum.Consumer = meta.Sequence.Consumer
+				msgSeqNum.Stream = meta.Sequence.Stream
+			case <-ctxt.Done():
+				assert.False(true)
+			}
+			cancel()
+		}
+		// verify nothing else came before the ACK
+		{
+			ctxt, cancel := context.WithTimeout(utCtxt, time.Millisecond*300)
+			select {
+			case <-msgRxChan:
+				assert.True(false)
+			case <-ctxt.Done():
+			}
+			cancel()
+		}
+		log.Debugf("============================= 4.%d =============================", itr)
+
+		// Case 3: ACK the message to let the next one through
+		assert.Nil(ackSend.BroadcastACK(
+			AckIndication{Stream: stream1, Consumer: consumer1, SeqNum: msgSeqNum}, utCtxt,
+		))
+	}
+	log.Debug("============================= 5 =============================")
+}
+
+func TestEphemeralPushMessageDispatcher(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-ephemeral-push-dispatcher"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "MessageDispatcher",
+		"instance":  "ephemeralPushMessageDispatcher",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.primary", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+	ackSend, err := GetJetStreamACKBroadcaster(js, testName)
+	assert.Nil(err)
+
+	// Publish a message before the dispatcher starts
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		assert.Nil(publisher.Publish(subject1, []byte(uuid.New().String()), ctxt))
+	}
+	log.Debug("============================= 1 =============================")
+
+	maxInflight := 1
+	msgRxChan := make(chan *nats.Msg, maxInflight)
+	msgHandler := func(msg *nats.Msg, _ context.Context) error {
+		msgRxChan <- msg
+		return nil
+	}
+	internalErrorHandler := func(err error) {
+		assert.Equal("context canceled", err.Error())
+	}
+
+	redactor, err := GetMessageRedactor(map[string][]RedactionRule{
+		stream1: {{JSONFields: []string{"secret"}}},
+	})
+	assert.Nil(err)
+
+	// Case 0: start a new dispatcher only reading new messages
+	dispatchCtxt, dispatchCancel := context.WithCancel(utCtxt)
+	defer dispatchCancel()
+	uut, err := GetEphemeralPushMessageDispatcher(
+		js,
+		stream1,
+		subject1,
+		true,
+		maxInflight,
+		DeliveryConcurrency{},
+		PushDispatcherOptions{Redactor: redactor},
+		&wg,
+		dispatchCtxt,
+	)
+	assert.Nil(err)
+	assert.Nil(uut.Start(msgHandler, internalErrorHandler))
+	consumer := uut.Consumer()
+	assert.NotEmpty(consumer)
+	{
+		info, err := jsCtrl.GetConsumerForStream(stream1, consumer, utCtxt)
+		assert.Nil(err)
+		assert.Equal(maxInflight, info.Config.MaxAckPending)
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 1: only messages published after the start are received
+	msg1 := []byte(uuid.New().String())
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		assert.Nil(publisher.Publish(subject1, msg1, ctxt))
+	}
+	msg1SeqNum := AckSeqNum{}
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		select {
+		case rxMsg, ok := <-msgRxChan:
+			assert.True(ok)
+			assert.Equal(msg1, rxMsg.Data)
+			meta, err := rxMsg.Metadata()
+			assert.Nil(err)
+			assert.Equal(consumer, meta.Consumer)
+			msg1SeqNum.Consumer = meta.Sequence.Consumer
+			msg1SeqNum.Stream = meta.Sequence.Stream
+		case <-ctxt.Done():
+			assert.False(true)
+		}
+	}
+	log.Debug("============================= 3 =============================")
+
+	// Case 2: ACK the message, the next message should come redacted
+	msg2 := []byte(`{"secret":"abc","value":1}`)
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		assert.Nil(publisher.Publish(subject1, msg2, ctxt))
+	}
+	assert.Nil(ackSend.BroadcastACK(
+		AckIndication{Stream: stream1, Consumer: consumer, SeqNum: msg1SeqNum}, utCtxt,
+	))
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		select {
+		case rxMsg, ok := <-msgRxChan:
+			assert.True(ok)
+			assert.Equal(`{"secret":"[REDACTED]","value":1}`, string(rxMsg.Data))
+		case <-ctxt.Done():
+			assert.False(true)
+		}
+	}
+	log.Debug("============================= 4 =============================")
+
+	// Case 3: the consumer is deleted once the dispatcher stops
+	dispatchCancel()
+	{
+		deleted := false
+		for itr := 0; itr < 20 && !deleted; itr++ {
+			time.Sleep(time.Millisecond * 100)
+			_, err := jsCtrl.GetConsumerForStream(stream1, consumer, utCtxt)
+			deleted = err != nil
+		}
+		assert.True(deleted)
+	}
+	assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+}
+
+func TestPushMessageDispatcherFilter(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-push-dispatcher-filter"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "MessageDispatcher",
+		"instance":  "pushMessageDispatcherFilter",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream and consumers for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.primary", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+	consumer1 := uuid.New().String()
+	maxInflight := 4
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: maxInflight, Mode: "push", FilterSubject: &subject1,
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+	}
+
+	// Define the filter of the consumer
+	store, err := storage.GetMemoryKeyValueStore(testName, 0)
+	assert.Nil(err)
+	registry, err := filters.GetRegistry(store, filters.Limits{}, testName, utCtxt)
+	assert.Nil(err)
+	defer func() {
+		assert.Nil(registry.Close(utCtxt))
+	}()
+	_, err = registry.PutFilter(stream1, consumer1, filters.UnitTestFilterModule, utCtxt)
+	assert.Nil(err)
+	log.Debug("============================= 1 =============================")
+
+	msgRxChan := make(chan *nats.Msg, maxInflight)
+	msgHandler := func(msg *nats.Msg, _ context.Context) error {
+		msgRxChan <- msg
+		return nil
+	}
+
+	dispatcherCtxt, dispatcherCancel := context.WithCancel(utCtxt)
+	defer dispatcherCancel()
+	uut, err := GetPushMessageDispatcher(
+		js,
+		stream1,
+		subject1,
+		consumer1,
+		nil,
+		maxInflight,
+		DeliveryConcurrency{},
+		PushDispatcherOptions{FilterRegistry: registry},
+		&wg,
+		dispatcherCtxt,
+	)
+	assert.Nil(err)
+	assert.Nil(uut.Start(msgHandler, func(err error) {}))
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+	ackSend, err := GetJetStreamACKBroadcaster(js, testName)
+	assert.Nil(err)
+
+	// Case 1: messages are forwarded, dropped, and transformed by the filter
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		for _, msg := range []string{"keep-1", "drop-2", "transform-3"} {
+			assert.Nil(publisher.Publish(subject1, []byte(msg), ctxt))
+		}
+		received := []string{}
+		for itr := 0; itr < 2; itr++ {
+			select {
+			case rxMsg, ok := <-msgRxChan:
+				assert.True(ok)
+				received = append(received, string(rxMsg.Data))
+				meta, err := rxMsg.Metadata()
+				assert.Nil(err)
+				// ACK the message
+				assert.Nil(ackSend.BroadcastACK(AckIndication{
+					Stream:   stream1,
+					Consumer: consumer1,
+					SeqNum: AckSeqNum{
+						Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer,
+					},
+				}, ctxt))
+			case <-ctxt.Done():
+				assert.False(true)
+			}
+		}
+		assert.Equal([]string{"keep-1", "ransform-3"}, received)
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 2: dropped and forwarded messages are all ACKed
+	assert.Eventually(func() bool {
+		info, err := js.JetStream().ConsumerInfo(stream1, consumer1)
+		return err == nil && info.AckFloor.Stream == 3 && info.NumAckPending == 0
+	}, time.Second*2, time.Millisecond*50)
+
+	dispatcherCancel()
+}
+
+func TestPushMessageDispatcherSelector(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-push-dispatcher-selector"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "MessageDispatcher",
+		"instance":  "pushMessageDispatcherSelector",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream and consumers for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.primary", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+	consumer1 := uuid.New().String()
+	maxInflight := 4
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: maxInflight, Mode: "push", FilterSubject: &subject1,
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+	}
+
+	selector, err := CompileMessageSelector("json.type = 'order' AND json.amount > 100")
+	assert.Nil(err)
+	log.Debug("============================= 1 =============================")
+
+	msgRxChan := make(chan *nats.Msg, maxInflight)
+	msgHandler := func(msg *nats.Msg, _ context.Context) error {
+		msgRxChan <- msg
+		return nil
+	}
+
+	dispatcherCtxt, dispatcherCancel := context.WithCancel(utCtxt)
+	defer dispatcherCancel()
+	uut, err := GetPushMessageDispatcher(
+		js,
+		stream1,
+		subject1,
+		consumer1,
+		nil,
+		maxInflight,
+		DeliveryConcurrency{},
+		PushDispatcherOptions{Selector: selector},
+		&wg,
+		dispatcherCtxt,
+	)
+	assert.Nil(err)
+	assert.Nil(uut.Start(msgHandler, func(err error) {}))
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+	ackSend, err := GetJetStreamACKBroadcaster(js, testName)
+	assert.Nil(err)
+
+	// Case 1: only selected messages are forwarded
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		for _, msg := range []string{
+			`{"type":"order","amount":150}`,
+			`{"type":"order","amount":50}`,
+			`{"type":"refund","amount":150}`,
+			`not json`,
+			`{"type":"order","amount":101}`,
+		} {
+			assert.Nil(publisher.Publish(subject1, []byte(msg), ctxt))
+		}
+		received := []string{}
+		for itr := 0; itr < 2; itr++ {
+			select {
+			case rxMsg, ok := <-msgRxChan:
+				assert.True(ok)
+				received = append(received, string(rxMsg.Data))
+				meta, err := rxMsg.Metadata()
+				assert.Nil(err)
+				// ACK the message
+				assert.Nil(ackSend.BroadcastACK(AckIndication{
+					Stream:   stream1,
+					Consumer: consumer1,
+					SeqNum: AckSeqNum{
+						Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer,
+					},
+				}, ctxt))
+			case <-ctxt.Done():
+				assert.False(true)
+			}
+		}
+		assert.Equal(
+			[]string{`{"type":"order","amount":150}`, `{"type":"order","amount":101}`}, received,
+		)
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 2: skipped and forwarded messages are all ACKed
+	assert.Eventually(func() bool {
+		info, err := js.JetStream().ConsumerInfo(stream1, consumer1)
+		return err == nil && info.AckFloor.Stream == 5 && info.NumAckPending == 0
+	}, time.Second*2, time.Millisecond*50)
+
+	dispatcherCancel()
+}
+
+func BenchmarkPushMessageDispatcher(b *testing.B) {
+	log.SetLevel(log.ErrorLevel)
+	testName := "bench-push-dispatcher"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+	}
+	js, err := core.GetJetStream(natsParam)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.primary", uuid.New().String())
+	{
+		maxAge := time.Minute
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		if err := jsCtrl.CreateStream(streamParam, utCtxt); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer func() {
+		_ = jsCtrl.DeleteStream(stream1, context.Background())
+	}()
+	consumer1 := uuid.New().String()
+	maxInflight := 64
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: maxInflight, Mode: "push", FilterSubject: &subject1,
+		}
+		if err := jsCtrl.CreateConsumerForStream(stream1, param, utCtxt); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	ackSend, err := GetJetStreamACKBroadcaster(js, testName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Every forwarded message is ACKed at once
+	received := sync.WaitGroup{}
+	msgHandler := func(msg *nats.Msg, ctxt context.Context) error {
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+		received.Done()
+		return ackSend.BroadcastACK(AckIndication{
+			Stream:   stream1,
+			Consumer: consumer1,
+			SeqNum:   AckSeqNum{Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer},
+		}, ctxt)
+	}
+
+	dispatcherCtxt, dispatcherCancel := context.WithCancel(utCtxt)
+	defer dispatcherCancel()
+	uut, err := GetPushMessageDispatcher(
+		js,
+		stream1,
+		subject1,
+		consumer1,
+		nil,
+		maxInflight,
+		DeliveryConcurrency{},
+		PushDispatcherOptions{},
+		&wg,
+		dispatcherCtxt,
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := uut.Start(msgHandler, func(err error) {}); err != nil {
+		b.Fatal(err)
+	}
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := []byte(uuid.New().String())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	received.Add(b.N)
+	for itr := 0; itr < b.N; itr++ {
+		if err := publisher.Publish(subject1, msg, utCtxt); err != nil {
+			b.Fatal(err)
+		}
+	}
+	received.Wait()
+}
+
+// stubFailingRedactor implements MessageRedactor, failing while fail is set
+type stubFailingRedactor struct {
+	fail bool
+}
+
+func (r *stubFailingRedactor) Redact(stream, consumer string, msg *nats.Msg) (*nats.Msg, error) {
+	if r.fail {
+		return nil, fmt.Errorf("unable to parse payload")
+	}
+	return msg, nil
+}
+
+// stubGroupMember implements GroupMember, admitting every message
+type stubGroupMember struct {
+	admitted map[uint64]bool
+}
+
+func (m *stubGroupMember) Admit(streamSeq, numDelivered uint64) bool {
+	m.admitted[streamSeq] = true
+	return true
+}
+
+func (m *stubGroupMember) Release(streamSeq uint64) {
+	delete(m.admitted, streamSeq)
+}
+
+func (m *stubGroupMember) Leave() {}
+
+// stubInflightRecorder implements the part of JetStreamInflightMsgProcessor forward uses
+type stubInflightRecorder struct {
+	JetStreamInflightMsgProcessor
+	recorded []*nats.Msg
+	acks     []AckIndication
+}
+
+func (r *stubInflightRecorder) RecordInflightMessage(
+	msg *nats.Msg, blocking bool, callCtxt context.Context,
+) error {
+	r.recorded = append(r.recorded, msg)
+	return nil
+}
+
+func (r *stubInflightRecorder) HandlerMsgACK(
+	ack AckIndication, blocking bool, callCtxt context.Context,
+) error {
+	r.acks = append(r.acks, ack)
+	return nil
+}
+
+func TestPushMessageDispatcherForwardFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	testMsg := func(seq uint64) *nats.Msg {
+		return &nats.Msg{
+			Subject: "test-subject",
+			Reply:   fmt.Sprintf("$JS.ACK.stream-1.consumer-1.1.%d.%d.1634000000000000000.0", seq, seq),
+			Sub:     &nats.Subscription{},
+		}
+	}
+	gate, err := defineDeliveryGate(DeliveryConcurrency{MaxUnacked: 1}, time.Minute)
+	assert.Nil(err)
+	redactor := &stubFailingRedactor{fail: true}
+	tracking := &stubInflightRecorder{}
+	uut := &pushMessageDispatcher{
+		Component:   common.Component{LogTags: log.Fields{"module": "ut"}},
+		stream:      "stream-1",
+		consumer:    "consumer-1",
+		redactor:    redactor,
+		gate:        gate,
+		msgTracking: tracking,
+	}
+	forwarded := []*nats.Msg{}
+	msgOutput := func(msg *nats.Msg, ctxt context.Context) error {
+		forwarded = append(forwarded, msg)
+		return nil
+	}
+
+	// Case 1: messages which fail redaction do not keep their slot
+	for seq := uint64(1); seq <= 3; seq++ {
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		assert.NotNil(uut.forward(testMsg(seq), msgOutput, ctxt))
+		cancel()
+	}
+	assert.Empty(forwarded)
+
+	// Case 2: delivery continues once redaction works again
+	{
+		redactor.fail = false
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		assert.Nil(uut.forward(testMsg(4), msgOutput, ctxt))
+		cancel()
+		assert.Len(forwarded, 1)
+		assert.Len(tracking.recorded, 1)
+	}
+
+	// Case 3: messages the client could not take do not keep their slot
+	{
+		gate.release(4)
+		failOutput := func(msg *nats.Msg, ctxt context.Context) error {
+			return fmt.Errorf("client gone")
+		}
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		assert.NotNil(uut.forward(testMsg(5), failOutput, ctxt))
+		assert.Nil(uut.forward(testMsg(6), msgOutput, ctxt))
+		cancel()
+		assert.Len(forwarded, 2)
+	}
+
+	// Case 4: messages which are not forwarded give back their admission to the group
+	{
+		gate.release(6)
+		member := &stubGroupMember{admitted: map[uint64]bool{}}
+		uut.fairness = member
+		redactor.fail = true
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		assert.NotNil(uut.forward(testMsg(7), msgOutput, ctxt))
+		assert.Empty(member.admitted)
+		redactor.fail = false
+		assert.Nil(uut.forward(testMsg(8), msgOutput, ctxt))
+		cancel()
+		assert.Equal(map[uint64]bool{8: true}, member.admitted)
+		assert.Len(forwarded, 3)
+	}
+
+	// Case 5: a forwarded message given back is NAKed, and frees its slot and admission
+	{
+		member := uut.fairness.(*stubGroupMember)
+		assert.Nil(uut.Nak(testMsg(8)))
+		assert.Empty(member.admitted)
+		assert.Equal(
+			[]AckIndication{{
+				Stream:   "stream-1",
+				Consumer: "consumer-1",
+				SeqNum:   AckSeqNum{Stream: 8, Consumer: 8},
+				Type:     AckTypeNak,
+			}},
+			tracking.acks,
+		)
+		ctxt, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		assert.Nil(uut.forward(testMsg(9), msgOutput, ctxt))
+		cancel()
+		assert.Len(forwarded, 4)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SessionInflightMessage a message awaiting ACK, and the session it was delivered through
+type SessionInflightMessage struct {
+	InflightMessage
+	// Session is the ID of the session
+	Session string `json:"session"`
+}
+
+// DispatcherRegistry tracks the dispatchers of the sessions running on this replica, so
+// the messages they hold can be queried
+type DispatcherRegistry interface {
+	// Register adds the dispatcher of a session. Returns the function removing it.
+	Register(session string, dispatcher MessageDispatcher) func()
+	// ListInflight lists the messages of a consumer awaiting ACK on every session, oldest
+	// first
+	ListInflight(stream, consumer string, ctxt context.Context) ([]SessionInflightMessage, error)
+	// Summary counts the sessions, and the messages awaiting ACK across them
+	Summary(ctxt context.Context) (sessions int, inflight int, err error)
+}
+
+// dispatcherRegistryImpl implements DispatcherRegistry
+type dispatcherRegistryImpl struct {
+	lock        sync.Mutex
+	dispatchers map[string]MessageDispatcher
+}
+
+// GetDispatcherRegistry define a new DispatcherRegistry
+func GetDispatcherRegistry() DispatcherRegistry {
+	return &dispatcherRegistryImpl{dispatchers: map[string]MessageDispatcher{}}
+}
+
+// Register adds the dispatcher of a session
+func (r *dispatcherRegistryImpl) Register(session string, dispatcher MessageDispatcher) func() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dispatchers[session] = dispatcher
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		// A resumed session may have registered its new dispatcher since
+		if r.dispatchers[session] == dispatcher {
+			delete(r.dispatchers, session)
+		}
+	}
+}
+
+// snapshot helper function to copy the registered dispatchers, so they can be queried
+// without holding the lock
+func (r *dispatcherRegistryImpl) snapshot() map[string]MessageDispatcher {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	dispatchers := make(map[string]MessageDispatcher, len(r.dispatchers))
+	for session, dispatcher := range r.dispatchers {
+		dispatchers[session] = dispatcher
+	}
+	return dispatchers
+}
+
+// ListInflight lists the messages of a consumer awaiting ACK on every session
+func (r *dispatcherRegistryImpl) ListInflight(
+	stream, consumer string, ctxt context.Context,
+) ([]SessionInflightMessage, error) {
+	dispatchers := r.snapshot()
+	listed := []SessionInflightMessage{}
+	for session, dispatcher := range dispatchers {
+		msgs, err := dispatcher.Inflight(ctxt)
+		if err != nil {
+			return nil, fmt.Errorf("session %s: %w", session, err)
+		}
+		for _, msg := range msgs {
+			if msg.Stream == stream && msg.Consumer == consumer {
+				listed = append(listed, SessionInflightMessage{InflightMessage: msg, Session: session})
+			}
+		}
+	}
+	sort.SliceStable(listed, func(i, j int) bool {
+		return listed[i].Received.Before(listed[j].Received)
+	})
+	return listed, nil
+}
+
+// Summary counts the sessions, and the messages awaiting ACK across them
+func (r *dispatcherRegistryImpl) Summary(ctxt context.Context) (int, int, error) {
+	dispatchers := r.snapshot()
+	inflight := 0
+	for session, dispatcher := range dispatchers {
+		msgs, err := dispatcher.Inflight(ctxt)
+		if err != nil {
+			return 0, 0, fmt.Errorf("session %s: %w", session, err)
+		}
+		inflight += len(msgs)
+	}
+	return len(dispatchers), inflight, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Unix(1000, 0)
+	first := &recordingDispatcher{inflight: []InflightMessage{
+		{Stream: "s1", Consumer: "c1", StreamSeq: 4, Received: start.Add(time.Second)},
+		{Stream: "s2", Consumer: "c2", StreamSeq: 9, Received: start},
+	}}
+	second := &recordingDispatcher{inflight: []InflightMessage{
+		{Stream: "s1", Consumer: "c1", StreamSeq: 2, Received: start},
+	}}
+	uut := GetDispatcherRegistry()
+	unregisterFirst := uut.Register("session-1", first)
+	unregisterSecond := uut.Register("session-2", second)
+
+	// Case 1: list the messages of a consumer across sessions, oldest first
+	{
+		listed, err := uut.ListInflight("s1", "c1", context.Background())
+		assert.Nil(err)
+		assert.Equal([]SessionInflightMessage{
+			{InflightMessage: second.inflight[0], Session: "session-2"},
+			{InflightMessage: first.inflight[0], Session: "session-1"},
+		}, listed)
+	}
+
+	// Case 2: count the sessions and their messages
+	{
+		sessions, inflight, err := uut.Summary(context.Background())
+		assert.Nil(err)
+		assert.Equal(2, sessions)
+		assert.Equal(3, inflight)
+	}
+
+	// Case 3: a resumed session replaced its dispatcher before the old one unregisters
+	{
+		resumed := &recordingDispatcher{}
+		unregisterResumed := uut.Register("session-1", resumed)
+		unregisterFirst()
+		listed, err := uut.ListInflight("s1", "c1", context.Background())
+		assert.Nil(err)
+		assert.Len(listed, 1)
+		unregisterResumed()
+	}
+
+	// Case 4: nothing listed once the sessions end
+	{
+		unregisterSecond()
+		listed, err := uut.ListInflight("s1", "c1", context.Background())
+		assert.Nil(err)
+		assert.Empty(listed)
+		sessions, inflight, err := uut.Summary(context.Background())
+		assert.Nil(err)
+		assert.Zero(sessions)
+		assert.Zero(inflight)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+)
+
+// DrainStatus is the progress of draining the sessions of the server on shutdown
+type DrainStatus struct {
+	// Draining is whether the server is shutting down
+	Draining bool `json:"draining"`
+	// Started is when the drain started
+	Started *time.Time `json:"started,omitempty"`
+	// Deadline is when the server stops waiting for the sessions to end
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Sessions is the number of sessions still running
+	Sessions int `json:"sessions"`
+	// InflightMessages is the number of messages delivered on the sessions awaiting ACK
+	InflightMessages int `json:"inflight_messages"`
+	// EstimatedCompletion is when the drain is estimated to complete, based on how fast
+	// the sessions and messages drained so far
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+}
+
+// Done whether nothing is left to drain
+func (s DrainStatus) Done() bool {
+	return s.Sessions == 0 && s.InflightMessages == 0
+}
+
+// DrainMonitor tracks the progress of draining the sessions on shutdown
+type DrainMonitor interface {
+	// Start marks the start of the drain, which is given timeout to complete. Only the
+	// first call has an effect.
+	Start(timeout time.Duration, ctxt context.Context) error
+	// Draining whether the drain started
+	Draining() bool
+	// Status reports the progress of the drain
+	Status(ctxt context.Context) (DrainStatus, error)
+}
+
+// drainMonitorImpl implements DrainMonitor
+type drainMonitorImpl struct {
+	lock        sync.Mutex
+	dispatchers DispatcherRegistry
+	clock       common.Clock
+	draining    bool
+	started     time.Time
+	deadline    time.Time
+	// outstanding is the number of sessions and messages when the drain started
+	outstanding int
+}
+
+// GetDrainMonitor define a new DrainMonitor over the sessions in dispatchers
+func GetDrainMonitor(dispatchers DispatcherRegistry) DrainMonitor {
+	return &drainMonitorImpl{dispatchers: dispatchers, clock: common.SystemClock}
+}
+
+// Start marks the start of the drain
+func (m *drainMonitorImpl) Start(timeout time.Duration, ctxt context.Context) error {
+	sessions, inflight, err := m.dispatchers.Summary(ctxt)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.draining {
+		return nil
+	}
+	m.draining = true
+	m.started = m.clock.Now()
+	m.deadline = m.started.Add(timeout)
+	m.outstanding = sessions + inflight
+	return nil
+}
+
+// Draining whether the drain started
+func (m *drainMonitorImpl) Draining() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.draining
+}
+
+// Status reports the progress of the drain
+func (m *drainMonitorImpl) Status(ctxt context.Context) (DrainStatus, error) {
+	sessions, inflight, err := m.dispatchers.Summary(ctxt)
+	if err != nil {
+		return DrainStatus{}, err
+	}
+	status := DrainStatus{Sessions: sessions, InflightMessages: inflight}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.draining {
+		return status, nil
+	}
+	started, deadline := m.started, m.deadline
+	status.Draining = true
+	status.Started = &started
+	status.Deadline = &deadline
+
+	// Extrapolate the rate things drained at so far, but the server waits no longer than
+	// the deadline
+	now := m.clock.Now()
+	remaining := sessions + inflight
+	estimate := deadline
+	if remaining == 0 {
+		estimate = now
+	} else if drained := m.outstanding - remaining; drained > 0 {
+		rate := now.Sub(started) / time.Duration(drained)
+		if projected := now.Add(rate * time.Duration(remaining)); projected.Before(deadline) {
+			estimate = projected
+		}
+	}
+	status.EstimatedCompletion = &estimate
+	return status, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainMonitor(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Unix(1000, 0)
+	clock := common.GetFakeClock(start)
+	registry := GetDispatcherRegistry()
+	first := &recordingDispatcher{inflight: []InflightMessage{{StreamSeq: 1}, {StreamSeq: 2}}}
+	second := &recordingDispatcher{inflight: []InflightMessage{{StreamSeq: 3}}}
+	unregisterFirst := registry.Register("session-1", first)
+	unregisterSecond := registry.Register("session-2", second)
+	uut := GetDrainMonitor(registry)
+	uut.(*drainMonitorImpl).clock = clock
+
+	// Case 1: not draining before shutdown
+	{
+		status, err := uut.Status(context.Background())
+		assert.Nil(err)
+		assert.False(status.Draining)
+		assert.False(uut.Draining())
+		assert.Equal(2, status.Sessions)
+		assert.Equal(3, status.InflightMessages)
+		assert.Nil(status.EstimatedCompletion)
+	}
+
+	assert.Nil(uut.Start(time.Minute, context.Background()))
+
+	// Case 2: nothing drained yet, so the estimate is the deadline
+	{
+		clock.Advance(time.Second)
+		status, err := uut.Status(context.Background())
+		assert.Nil(err)
+		assert.True(status.Draining)
+		assert.True(uut.Draining())
+		assert.Equal(start, *status.Started)
+		assert.Equal(start.Add(time.Minute), *status.Deadline)
+		assert.Equal(start.Add(time.Minute), *status.EstimatedCompletion)
+	}
+
+	// Case 3: one of the five drained in two seconds, so the remaining four need eight more
+	{
+		second.inflight = nil
+		clock.Advance(time.Second)
+		status, err := uut.Status(context.Background())
+		assert.Nil(err)
+		assert.Equal(2, status.InflightMessages)
+		assert.Equal(start.Add(time.Second*10), *status.EstimatedCompletion)
+	}
+
+	// Case 4: the estimate never passes the deadline
+	{
+		clock.Advance(time.Second * 30)
+		status, err := uut.Status(context.Background())
+		assert.Nil(err)
+		assert.Equal(start.Add(time.Minute), *status.EstimatedCompletion)
+	}
+
+	// Case 5: starting again does not move the deadline
+	{
+		assert.Nil(uut.Start(time.Hour, context.Background()))
+		status, err := uut.Status(context.Background())
+		assert.Nil(err)
+		assert.Equal(start.Add(time.Minute), *status.Deadline)
+	}
+
+	// Case 6: done once every session ended
+	{
+		unregisterFirst()
+		unregisterSecond()
+		status, err := uut.Status(context.Background())
+		assert.Nil(err)
+		assert.True(status.Done())
+		assert.Equal(clock.Now(), *status.EstimatedCompletion)
+	}
+}
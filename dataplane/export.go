@@ -0,0 +1,208 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ExportMessage is an exported message, with its metadata
+type ExportMessage struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Subject is the subject the message was published to
+	Subject string `json:"subject"`
+	// Sequence is the message sequence number within the stream
+	Sequence uint64 `json:"sequence"`
+	// Timestamp is when the message was stored by the stream
+	Timestamp time.Time `json:"timestamp"`
+	// Headers are the message headers
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Message is the message body. Absent if withheld from the viewer.
+	Message []byte `json:"b64_msg,omitempty"`
+	// PayloadWithheld is set if the message body is withheld from the viewer
+	PayloadWithheld bool `json:"payload_withheld,omitempty"`
+}
+
+// ConvertExportMessage convert a JetStream message for export
+func ConvertExportMessage(msg *nats.Msg) (ExportMessage, error) {
+	return NewMsgEnvelope(msg).ToExport()
+}
+
+// ExportRange selects the messages of a stream to export
+type ExportRange struct {
+	// StartSequence is the sequence number of the first message. Exclusive with StartTime.
+	StartSequence uint64
+	// StartTime is the earliest store time of the first message. Exclusive with
+	// StartSequence. If neither is set, the export starts from the first message.
+	StartTime time.Time
+	// EndSequence is the sequence number of the last message. If zero, the export ends with
+	// the last message stored when the export started.
+	EndSequence uint64
+	// EndTime is the latest store time of the last message. No limit if zero.
+	EndTime time.Time
+}
+
+// Validate verify the range is consistent
+func (r ExportRange) Validate() error {
+	if r.StartSequence > 0 && !r.StartTime.IsZero() {
+		return fmt.Errorf("start sequence and start time are exclusive")
+	}
+	if r.EndSequence > 0 && r.StartSequence > r.EndSequence {
+		return fmt.Errorf("start sequence %d is after end sequence %d", r.StartSequence, r.EndSequence)
+	}
+	if !r.StartTime.IsZero() && !r.EndTime.IsZero() && r.StartTime.After(r.EndTime) {
+		return fmt.Errorf("start time is after end time")
+	}
+	return nil
+}
+
+// exportEnded helper function to decide whether a message is past the end of the range,
+// and whether it is the last message of the range
+func (r ExportRange) exportEnded(
+	meta *nats.MsgMetadata, lastSequence uint64,
+) (pastEnd bool, last bool) {
+	if meta.Sequence.Stream > lastSequence {
+		return true, true
+	}
+	if !r.EndTime.IsZero() && meta.Timestamp.After(r.EndTime) {
+		return true, true
+	}
+	return false, meta.Sequence.Stream == lastSequence || meta.NumPending == 0
+}
+
+// ==============================================================================
+
+// JetStreamExporter reads a range of the messages of a stream, in order
+type JetStreamExporter interface {
+	// NextMsg wait for the next message. Returns io.EOF once the range is exported.
+	NextMsg(ctxt context.Context) (*nats.Msg, error)
+	// Close stop reading, and delete the underlying consumer
+	Close() error
+}
+
+// jetStreamExporterImpl implements JetStreamExporter
+type jetStreamExporterImpl struct {
+	common.Component
+	sub          *nats.Subscription
+	exportRange  ExportRange
+	lastSequence uint64
+	done         bool
+}
+
+// GetJetStreamExporter define new JetStreamExporter
+//
+// The exporter reads through an ordered ephemeral consumer, which is flow controlled, so
+// the stream is read no faster than the messages are exported. If subject is not empty,
+// only messages of matching subjects are read.
+func GetJetStreamExporter(
+	natsClient *core.NatsClient, stream, subject string, exportRange ExportRange,
+) (JetStreamExporter, error) {
+	logTags := log.Fields{
+		"module":    "dataplane",
+		"component": "js-exporter",
+		"stream":    stream,
+		"subject":   subject,
+	}
+	if err := exportRange.Validate(); err != nil {
+		return nil, err
+	}
+	info, err := natsClient.JetStream().StreamInfo(stream)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to read stream info")
+		return nil, err
+	}
+	lastSequence := info.State.LastSeq
+	if exportRange.EndSequence > 0 && exportRange.EndSequence < lastSequence {
+		lastSequence = exportRange.EndSequence
+	}
+	exporter := &jetStreamExporterImpl{
+		Component:    common.Component{LogTags: logTags},
+		exportRange:  exportRange,
+		lastSequence: lastSequence,
+	}
+	// Nothing to read
+	if info.State.Msgs == 0 ||
+		exportRange.StartSequence > lastSequence ||
+		(!exportRange.StartTime.IsZero() && exportRange.StartTime.After(info.State.LastTime)) {
+		exporter.done = true
+		return exporter, nil
+	}
+
+	opts := []nats.SubOpt{
+		nats.OrderedConsumer(),
+		nats.BindStream(stream),
+		nats.Description(common.TagGatewayConsumer("httpmq stream export")),
+	}
+	if exportRange.StartSequence > 0 {
+		opts = append(opts, nats.StartSequence(exportRange.StartSequence))
+	} else if !exportRange.StartTime.IsZero() {
+		opts = append(opts, nats.StartTime(exportRange.StartTime))
+	} else {
+		opts = append(opts, nats.DeliverAll())
+	}
+	sub, err := natsClient.JetStream().SubscribeSync(subject, opts...)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to define export consumer")
+		return nil, err
+	}
+	exporter.sub = sub
+	// No message of the subject in the range
+	if consumer, err := sub.ConsumerInfo(); err == nil && consumer.NumPending == 0 {
+		exporter.done = true
+	}
+	return exporter, nil
+}
+
+// NextMsg wait for the next message. Returns io.EOF once the range is exported.
+func (e *jetStreamExporterImpl) NextMsg(ctxt context.Context) (*nats.Msg, error) {
+	if e.done {
+		return nil, io.EOF
+	}
+	msg, err := e.sub.NextMsgWithContext(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := msg.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	pastEnd, last := e.exportRange.exportEnded(meta, e.lastSequence)
+	e.done = last
+	if pastEnd {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+// Close stop reading, and delete the underlying consumer
+func (e *jetStreamExporterImpl) Close() error {
+	if e.sub == nil {
+		return nil
+	}
+	if err := e.sub.Unsubscribe(); err != nil {
+		log.WithError(err).WithFields(e.LogTags).Error("Unable to delete export consumer")
+		return err
+	}
+	return nil
+}
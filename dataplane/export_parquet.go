@@ -0,0 +1,477 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/alwitt/httpmq/common"
+)
+
+// Parquet format constants, as defined by the Apache Parquet format specification
+const (
+	parquetMagic = "PAR1"
+
+	parquetTypeBoolean   = 0
+	parquetTypeInt64     = 2
+	parquetTypeByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetConvertedNone            = -1
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMicros = 10
+	parquetConvertedUint64          = 14
+	parquetConvertedJSON            = 19
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+
+	parquetCodecUncompressed = 0
+	parquetPageTypeData      = 0
+)
+
+// ExportParquetWriter writes exported messages as a Parquet file
+//
+// The file has one row per message, with the columns stream, subject, sequence, timestamp
+// (in microseconds), headers (as JSON), message (the raw body, null if withheld), and
+// payload_withheld. Messages are buffered into row groups, and each row group is written out
+// once full, so the file can be streamed. The file is only readable once closed.
+type ExportParquetWriter interface {
+	// Write add a message to the file
+	Write(msg ExportMessage) error
+	// Close write out the buffered messages, and the file footer
+	Close() error
+}
+
+// parquetColumn a column of the file, and the values buffered for the current row group
+type parquetColumn struct {
+	name      string
+	physical  int32
+	converted int32
+	optional  bool
+	// values are the PLAIN encoded values which are not null
+	values bytes.Buffer
+	// booleans are the values of a boolean column, which are bit packed once written out
+	booleans []bool
+	// defined are the definition levels of an optional column, false for a null
+	defined []bool
+}
+
+// parquetChunk the location of a column chunk written out
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+// parquetRowGroup the location of a row group written out
+type parquetRowGroup struct {
+	chunks []parquetChunk
+	rows   int64
+	size   int64
+}
+
+// exportParquetWriterImpl implements ExportParquetWriter
+type exportParquetWriterImpl struct {
+	output       io.Writer
+	offset       int64
+	rowGroupSize int
+	columns      []*parquetColumn
+	rows         int
+	rowGroups    []parquetRowGroup
+	closed       bool
+}
+
+// GetExportParquetWriter define new ExportParquetWriter writing to output, with at most
+// rowGroupSize messages per row group
+func GetExportParquetWriter(output io.Writer, rowGroupSize int) (ExportParquetWriter, error) {
+	if rowGroupSize <= 0 {
+		return nil, fmt.Errorf("parquet row group size must be positive")
+	}
+	writer := &exportParquetWriterImpl{
+		output:       output,
+		rowGroupSize: rowGroupSize,
+		columns: []*parquetColumn{
+			{name: "stream", physical: parquetTypeByteArray, converted: parquetConvertedUTF8},
+			{name: "subject", physical: parquetTypeByteArray, converted: parquetConvertedUTF8},
+			{name: "sequence", physical: parquetTypeInt64, converted: parquetConvertedUint64},
+			{
+				name:      "timestamp",
+				physical:  parquetTypeInt64,
+				converted: parquetConvertedTimestampMicros,
+			},
+			{
+				name:      "headers",
+				physical:  parquetTypeByteArray,
+				converted: parquetConvertedJSON,
+				optional:  true,
+			},
+			{
+				name:      "message",
+				physical:  parquetTypeByteArray,
+				converted: parquetConvertedNone,
+				optional:  true,
+			},
+			{name: "payload_withheld", physical: parquetTypeBoolean, converted: parquetConvertedNone},
+		},
+	}
+	if err := writer.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// write helper function to write to the output, tracking the file offset
+func (w *exportParquetWriterImpl) write(data []byte) error {
+	written, err := w.output.Write(data)
+	w.offset += int64(written)
+	return err
+}
+
+// Write add a message to the file
+func (w *exportParquetWriterImpl) Write(msg ExportMessage) error {
+	if w.closed {
+		return fmt.Errorf("parquet writer is closed")
+	}
+	var headers []byte
+	if len(msg.Headers) > 0 {
+		var err error
+		if headers, err = common.JSON().Marshal(msg.Headers); err != nil {
+			return err
+		}
+	}
+	w.columns[0].appendBytes([]byte(msg.Stream))
+	w.columns[1].appendBytes([]byte(msg.Subject))
+	w.columns[2].appendInt64(int64(msg.Sequence))
+	w.columns[3].appendInt64(msg.Timestamp.UnixNano() / 1000)
+	if headers != nil {
+		w.columns[4].appendBytes(headers)
+	} else {
+		w.columns[4].appendNull()
+	}
+	if !msg.PayloadWithheld {
+		w.columns[5].appendBytes(msg.Message)
+	} else {
+		w.columns[5].appendNull()
+	}
+	w.columns[6].booleans = append(w.columns[6].booleans, msg.PayloadWithheld)
+	w.rows++
+	if w.rows >= w.rowGroupSize {
+		return w.flushRowGroup()
+	}
+	return nil
+}
+
+// Close write out the buffered messages, and the file footer
+func (w *exportParquetWriterImpl) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.rows > 0 {
+		if err := w.flushRowGroup(); err != nil {
+			return err
+		}
+	}
+	footer := w.fileMetadata()
+	if err := w.write(footer); err != nil {
+		return err
+	}
+	trailer := make([]byte, 4, 4+len(parquetMagic))
+	binary.LittleEndian.PutUint32(trailer, uint32(len(footer)))
+	return w.write(append(trailer, parquetMagic...))
+}
+
+// flushRowGroup write out the buffered rows as a row group, with one data page per column
+func (w *exportParquetWriterImpl) flushRowGroup() error {
+	group := parquetRowGroup{rows: int64(w.rows)}
+	for _, column := range w.columns {
+		page := column.page()
+		header := encodeParquetPageHeader(w.rows, len(page))
+		chunk := parquetChunk{
+			offset: w.offset, size: int64(len(header) + len(page)), values: int64(w.rows),
+		}
+		if err := w.write(header); err != nil {
+			return err
+		}
+		if err := w.write(page); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.size
+		column.reset()
+	}
+	w.rowGroups = append(w.rowGroups, group)
+	w.rows = 0
+	return nil
+}
+
+// appendBytes add a BYTE_ARRAY value
+func (c *parquetColumn) appendBytes(value []byte) {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(value)))
+	c.values.Write(length[:])
+	c.values.Write(value)
+	if c.optional {
+		c.defined = append(c.defined, true)
+	}
+}
+
+// appendInt64 add an INT64 value
+func (c *parquetColumn) appendInt64(value int64) {
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], uint64(value))
+	c.values.Write(encoded[:])
+}
+
+// appendNull add a null to an optional column
+func (c *parquetColumn) appendNull() {
+	c.defined = append(c.defined, false)
+}
+
+// reset drop the values written out
+func (c *parquetColumn) reset() {
+	c.values.Reset()
+	c.booleans = c.booleans[:0]
+	c.defined = c.defined[:0]
+}
+
+// page returns the content of a data page holding the buffered values: the definition
+// levels of an optional column, followed by the PLAIN encoded values
+func (c *parquetColumn) page() []byte {
+	var page bytes.Buffer
+	if c.optional {
+		levels := encodeParquetLevels(c.defined)
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(levels)))
+		page.Write(length[:])
+		page.Write(levels)
+	}
+	if c.physical == parquetTypeBoolean {
+		packed := make([]byte, (len(c.booleans)+7)/8)
+		for idx, value := range c.booleans {
+			if value {
+				packed[idx/8] |= 1 << (idx % 8)
+			}
+		}
+		page.Write(packed)
+	} else {
+		page.Write(c.values.Bytes())
+	}
+	return page.Bytes()
+}
+
+// encodeParquetLevels encode definition levels of bit width 1 as runs of the RLE / bit
+// packed hybrid encoding
+func encodeParquetLevels(defined []bool) []byte {
+	var encoded bytes.Buffer
+	var header [binary.MaxVarintLen64]byte
+	for start := 0; start < len(defined); {
+		end := start
+		for end < len(defined) && defined[end] == defined[start] {
+			end++
+		}
+		encoded.Write(header[:binary.PutUvarint(header[:], uint64(end-start)<<1)])
+		if defined[start] {
+			encoded.WriteByte(1)
+		} else {
+			encoded.WriteByte(0)
+		}
+		start = end
+	}
+	return encoded.Bytes()
+}
+
+// encodeParquetPageHeader encode the header of an uncompressed data page
+func encodeParquetPageHeader(numValues, pageSize int) []byte {
+	var t thriftCompactWriter
+	t.i32Field(1, parquetPageTypeData)
+	t.i32Field(2, int32(pageSize))
+	t.i32Field(3, int32(pageSize))
+	t.structField(5)
+	t.i32Field(1, int32(numValues))
+	t.i32Field(2, parquetEncodingPlain)
+	t.i32Field(3, parquetEncodingRLE)
+	t.i32Field(4, parquetEncodingRLE)
+	t.structEnd()
+	t.structEnd()
+	return t.buf.Bytes()
+}
+
+// fileMetadata encode the file footer
+func (w *exportParquetWriterImpl) fileMetadata() []byte {
+	var t thriftCompactWriter
+	var totalRows int64
+	for _, group := range w.rowGroups {
+		totalRows += group.rows
+	}
+	t.i32Field(1, 1)
+	// The schema is a root, followed by the columns
+	t.listField(2, thriftCompactStruct, len(w.columns)+1)
+	t.listStruct()
+	t.binaryField(4, []byte("schema"))
+	t.i32Field(5, int32(len(w.columns)))
+	t.structEnd()
+	for _, column := range w.columns {
+		t.listStruct()
+		t.i32Field(1, column.physical)
+		repetition := int32(parquetRequired)
+		if column.optional {
+			repetition = parquetOptional
+		}
+		t.i32Field(3, repetition)
+		t.binaryField(4, []byte(column.name))
+		if column.converted != parquetConvertedNone {
+			t.i32Field(6, column.converted)
+		}
+		t.structEnd()
+	}
+	t.i64Field(3, totalRows)
+	t.listField(4, thriftCompactStruct, len(w.rowGroups))
+	for _, group := range w.rowGroups {
+		t.listStruct()
+		t.listField(1, thriftCompactStruct, len(group.chunks))
+		for idx, chunk := range group.chunks {
+			column := w.columns[idx]
+			t.listStruct()
+			t.i64Field(2, chunk.offset)
+			t.structField(3)
+			t.i32Field(1, column.physical)
+			t.listField(2, thriftCompactI32, 2)
+			t.varint(zigzag(parquetEncodingPlain))
+			t.varint(zigzag(parquetEncodingRLE))
+			t.listField(3, thriftCompactBinary, 1)
+			t.binary([]byte(column.name))
+			t.i32Field(4, parquetCodecUncompressed)
+			t.i64Field(5, chunk.values)
+			t.i64Field(6, chunk.size)
+			t.i64Field(7, chunk.size)
+			t.i64Field(9, chunk.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64Field(2, group.size)
+		t.i64Field(3, group.rows)
+		t.structEnd()
+	}
+	t.binaryField(6, []byte("httpmq"))
+	t.structEnd()
+	return t.buf.Bytes()
+}
+
+// ==============================================================================
+
+// Thrift compact protocol type IDs
+const (
+	thriftCompactI32    = 5
+	thriftCompactI64    = 6
+	thriftCompactBinary = 8
+	thriftCompactList   = 9
+	thriftCompactStruct = 12
+)
+
+// thriftCompactWriter encodes Thrift structs with the compact protocol, as used by the
+// Parquet file metadata. Structs are written field by field, and ended with structEnd.
+type thriftCompactWriter struct {
+	buf bytes.Buffer
+	// lastField are the IDs of the last fields written in each struct being written
+	lastField []int16
+}
+
+// zigzag helper function to zigzag encode a signed integer
+func zigzag(value int64) uint64 {
+	return uint64(value<<1) ^ uint64(value>>63)
+}
+
+// varint write an unsigned varint
+func (t *thriftCompactWriter) varint(value uint64) {
+	var encoded [binary.MaxVarintLen64]byte
+	t.buf.Write(encoded[:binary.PutUvarint(encoded[:], value)])
+}
+
+// binary write a length prefixed byte string
+func (t *thriftCompactWriter) binary(value []byte) {
+	t.varint(uint64(len(value)))
+	t.buf.Write(value)
+}
+
+// fieldHeader write the header of a field of the current struct
+func (t *thriftCompactWriter) fieldHeader(id int16, fieldType byte) {
+	// The first field of the outermost struct starts its struct
+	if len(t.lastField) == 0 {
+		t.lastField = append(t.lastField, 0)
+	}
+	last := t.lastField[len(t.lastField)-1]
+	t.lastField[len(t.lastField)-1] = id
+	if delta := id - last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | fieldType)
+		return
+	}
+	t.buf.WriteByte(fieldType)
+	t.varint(zigzag(int64(id)))
+}
+
+// i32Field write an i32 field
+func (t *thriftCompactWriter) i32Field(id int16, value int32) {
+	t.fieldHeader(id, thriftCompactI32)
+	t.varint(zigzag(int64(value)))
+}
+
+// i64Field write an i64 field
+func (t *thriftCompactWriter) i64Field(id int16, value int64) {
+	t.fieldHeader(id, thriftCompactI64)
+	t.varint(zigzag(value))
+}
+
+// binaryField write a binary or string field
+func (t *thriftCompactWriter) binaryField(id int16, value []byte) {
+	t.fieldHeader(id, thriftCompactBinary)
+	t.binary(value)
+}
+
+// listField write the header of a list field, to be followed by its elements
+func (t *thriftCompactWriter) listField(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftCompactList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elemType)
+	t.varint(uint64(size))
+}
+
+// structField start a struct field, to be ended with structEnd
+func (t *thriftCompactWriter) structField(id int16) {
+	t.fieldHeader(id, thriftCompactStruct)
+	t.lastField = append(t.lastField, 0)
+}
+
+// listStruct start a struct element of a list, to be ended with structEnd
+func (t *thriftCompactWriter) listStruct() {
+	t.lastField = append(t.lastField, 0)
+}
+
+// structEnd end the current struct
+func (t *thriftCompactWriter) structEnd() {
+	t.buf.WriteByte(0)
+	if len(t.lastField) > 0 {
+		t.lastField = t.lastField[:len(t.lastField)-1]
+	}
+}
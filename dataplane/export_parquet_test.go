@@ -0,0 +1,231 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// thriftCompactReader decodes the compact protocol. Structs decode to maps of field ID to
+// value, lists to slices, integers to int64, and binaries to []byte.
+type thriftCompactReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftCompactReader) uvarint() uint64 {
+	value, size := binary.Uvarint(r.data[r.pos:])
+	r.pos += size
+	return value
+}
+
+func (r *thriftCompactReader) value(valueType byte) interface{} {
+	switch valueType {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 3:
+		r.pos++
+		return int64(r.data[r.pos-1])
+	case 4, 5, 6:
+		encoded := r.uvarint()
+		return int64(encoded>>1) ^ -int64(encoded&1)
+	case 8:
+		size := int(r.uvarint())
+		r.pos += size
+		return r.data[r.pos-size : r.pos]
+	case 9:
+		header := r.data[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := []interface{}{}
+		for idx := 0; idx < size; idx++ {
+			list = append(list, r.value(header&0x0f))
+		}
+		return list
+	case 12:
+		return r.readStruct()
+	}
+	panic("unsupported thrift type")
+}
+
+func (r *thriftCompactReader) readStruct() map[int16]interface{} {
+	result := map[int16]interface{}{}
+	last := int16(0)
+	for {
+		header := r.data[r.pos]
+		r.pos++
+		if header == 0 {
+			return result
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.value(4).(int64))
+		}
+		last = id
+		result[id] = r.value(header & 0x0f)
+	}
+}
+
+func TestExportParquetWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid row group size
+	{
+		_, err := GetExportParquetWriter(&bytes.Buffer{}, 0)
+		assert.NotNil(err)
+	}
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 123456000, time.UTC)
+	var output bytes.Buffer
+	uut, err := GetExportParquetWriter(&output, 2)
+	assert.Nil(err)
+	assert.Nil(uut.Write(ExportMessage{
+		Stream: "orders", Subject: "orders.new", Sequence: 27, Timestamp: now,
+		Headers: map[string][]string{"Trace": {"1"}}, Message: []byte("hello"),
+	}))
+	assert.Nil(uut.Write(ExportMessage{
+		Stream: "orders", Subject: "orders.old", Sequence: 28, Timestamp: now.Add(time.Second),
+		PayloadWithheld: true,
+	}))
+	assert.Nil(uut.Write(ExportMessage{
+		Stream: "orders", Subject: "orders.new", Sequence: 29, Timestamp: now,
+	}))
+	assert.Nil(uut.Close())
+	assert.NotNil(uut.Write(ExportMessage{}))
+	file := output.Bytes()
+
+	// Case 1: the file is framed by the magic, with the footer before its length
+	assert.Equal("PAR1", string(file[:4]))
+	assert.Equal("PAR1", string(file[len(file)-4:]))
+	footerSize := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footerStart := len(file) - 8 - footerSize
+	reader := thriftCompactReader{data: file[footerStart : len(file)-8]}
+	footer := reader.readStruct()
+	assert.Equal(footerSize, reader.pos)
+
+	// Case 2: the schema and row groups
+	assert.Equal(int64(1), footer[1])
+	schema := footer[2].([]interface{})
+	assert.Len(schema, 8)
+	assert.Equal("schema", string(schema[0].(map[int16]interface{})[4].([]byte)))
+	assert.Equal(int64(7), schema[0].(map[int16]interface{})[5])
+	names := []string{}
+	for _, element := range schema[1:] {
+		names = append(names, string(element.(map[int16]interface{})[4].([]byte)))
+	}
+	assert.Equal(
+		[]string{
+			"stream", "subject", "sequence", "timestamp", "headers", "message", "payload_withheld",
+		},
+		names,
+	)
+	assert.Equal(int64(1), schema[5].(map[int16]interface{})[3])
+	assert.Equal(int64(19), schema[5].(map[int16]interface{})[6])
+	assert.Equal(int64(3), footer[3])
+	rowGroups := footer[4].([]interface{})
+	assert.Len(rowGroups, 2)
+	assert.Equal(int64(2), rowGroups[0].(map[int16]interface{})[3])
+	assert.Equal(int64(1), rowGroups[1].(map[int16]interface{})[3])
+
+	// readPage returns the page of a column chunk of a row group, after checking the chunk
+	readPage := func(group, column int) []byte {
+		chunks := rowGroups[group].(map[int16]interface{})[1].([]interface{})
+		meta := chunks[column].(map[int16]interface{})[3].(map[int16]interface{})
+		assert.Equal(names[column], string(meta[3].([]interface{})[0].([]byte)))
+		offset := int(meta[9].(int64))
+		pageReader := thriftCompactReader{data: file[offset:]}
+		header := pageReader.readStruct()
+		assert.Equal(int64(0), header[1])
+		pageSize := int(header[3].(int64))
+		assert.Equal(meta[7], int64(pageReader.pos+pageSize))
+		assert.Equal(meta[5], header[5].(map[int16]interface{})[1])
+		return file[offset+pageReader.pos : offset+pageReader.pos+pageSize]
+	}
+
+	// Case 3: required columns are PLAIN encoded
+	{
+		page := readPage(0, 2)
+		assert.Len(page, 16)
+		assert.Equal(uint64(27), binary.LittleEndian.Uint64(page[0:]))
+		assert.Equal(uint64(28), binary.LittleEndian.Uint64(page[8:]))
+		page = readPage(0, 3)
+		assert.Equal(uint64(now.UnixNano()/1000), binary.LittleEndian.Uint64(page[0:]))
+		page = readPage(0, 1)
+		assert.Equal(uint32(10), binary.LittleEndian.Uint32(page[0:]))
+		assert.Equal("orders.new", string(page[4:14]))
+		assert.Equal("orders.old", string(page[18:28]))
+		assert.Equal([]byte{0x02}, readPage(0, 6))
+		assert.Equal([]byte{0x00}, readPage(1, 6))
+	}
+
+	// Case 4: optional columns carry their definition levels ahead of the values
+	{
+		// One run of one defined value, then one run of one null
+		page := readPage(0, 5)
+		assert.Equal(uint32(4), binary.LittleEndian.Uint32(page[0:]))
+		assert.Equal([]byte{0x02, 0x01, 0x02, 0x00}, page[4:8])
+		assert.Equal(uint32(5), binary.LittleEndian.Uint32(page[8:]))
+		assert.Equal("hello", string(page[12:]))
+		page = readPage(0, 4)
+		assert.Equal(`{"Trace":["1"]}`, string(page[12:]))
+		// An empty body is not withheld, so it is an empty value rather than a null
+		page = readPage(1, 5)
+		assert.Equal([]byte{0x02, 0x01}, page[4:6])
+		assert.Equal(uint32(0), binary.LittleEndian.Uint32(page[6:]))
+		page = readPage(1, 4)
+		assert.Equal([]byte{0x02, 0x00}, page[4:6])
+		assert.Len(page, 6)
+	}
+
+	// Case 5: the column chunks are laid out back to back, up to the footer
+	{
+		end := int64(4)
+		for _, group := range rowGroups {
+			var size int64
+			for _, chunk := range group.(map[int16]interface{})[1].([]interface{}) {
+				meta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+				assert.Equal(end, meta[9])
+				end += meta[7].(int64)
+				size += meta[7].(int64)
+			}
+			assert.Equal(size, group.(map[int16]interface{})[2])
+		}
+		assert.Equal(int64(footerStart), end)
+	}
+
+	// Case 6: an export of nothing is a file without row groups
+	{
+		var empty bytes.Buffer
+		uut, err := GetExportParquetWriter(&empty, 2)
+		assert.Nil(err)
+		assert.Nil(uut.Close())
+		file := empty.Bytes()
+		footerSize := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+		reader := thriftCompactReader{data: file[4 : 4+footerSize]}
+		footer := reader.readStruct()
+		assert.Equal(int64(0), footer[3])
+		assert.Empty(footer[4])
+	}
+}
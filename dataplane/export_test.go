@@ -0,0 +1,104 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertExportMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := nats.NewMsg("orders.new")
+	msg.Reply = "$JS.ACK.orders.c.1.27.14.1634000000000000000.3"
+	msg.Header.Set("Trace-ID", "abc")
+	msg.Data = []byte{0xff, 0x00}
+	msg.Sub = &nats.Subscription{}
+
+	converted, err := ConvertExportMessage(msg)
+	assert.Nil(err)
+	assert.Equal("orders", converted.Stream)
+	assert.Equal("orders.new", converted.Subject)
+	assert.Equal(uint64(27), converted.Sequence)
+	assert.Equal(time.Unix(0, 1634000000000000000).UTC(), converted.Timestamp.UTC())
+	assert.Equal("abc", nats.Header(converted.Headers).Get("Trace-ID"))
+	assert.Equal([]byte{0xff, 0x00}, converted.Message)
+
+	// Case 1: not a JetStream message
+	_, err = ConvertExportMessage(nats.NewMsg("orders.new"))
+	assert.NotNil(err)
+}
+
+func TestExportRange(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+
+	// Case 0: validation
+	{
+		assert.Nil(ExportRange{}.Validate())
+		assert.Nil(ExportRange{StartSequence: 5, EndSequence: 5}.Validate())
+		assert.NotNil(ExportRange{StartSequence: 5, StartTime: now}.Validate())
+		assert.NotNil(ExportRange{StartSequence: 6, EndSequence: 5}.Validate())
+		assert.NotNil(ExportRange{StartTime: now, EndTime: now.Add(-time.Second)}.Validate())
+	}
+
+	meta := func(seq uint64, timestamp time.Time, pending uint64) *nats.MsgMetadata {
+		msg := nats.NewMsg("orders.new")
+		msg.Reply = fmt.Sprintf(
+			"$JS.ACK.orders.c.1.%d.%d.%d.%d", seq, seq, timestamp.UnixNano(), pending,
+		)
+		msg.Sub = &nats.Subscription{}
+		parsed, err := msg.Metadata()
+		assert.Nil(err)
+		return parsed
+	}
+
+	// Case 1: end of the range by sequence
+	{
+		uut := ExportRange{}
+		pastEnd, last := uut.exportEnded(meta(3, now, 10), 5)
+		assert.False(pastEnd)
+		assert.False(last)
+		pastEnd, last = uut.exportEnded(meta(5, now, 10), 5)
+		assert.False(pastEnd)
+		assert.True(last)
+		pastEnd, last = uut.exportEnded(meta(6, now, 10), 5)
+		assert.True(pastEnd)
+		assert.True(last)
+	}
+
+	// Case 2: no more messages of the subject
+	{
+		pastEnd, last := ExportRange{}.exportEnded(meta(3, now, 0), 5)
+		assert.False(pastEnd)
+		assert.True(last)
+	}
+
+	// Case 3: end of the range by time
+	{
+		uut := ExportRange{EndTime: now}
+		pastEnd, _ := uut.exportEnded(meta(3, now, 10), 5)
+		assert.False(pastEnd)
+		pastEnd, last := uut.exportEnded(meta(4, now.Add(time.Second), 10), 5)
+		assert.True(pastEnd)
+		assert.True(last)
+	}
+}
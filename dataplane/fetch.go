@@ -0,0 +1,303 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/hooks"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrInvalidCommitToken returned when a commit token can not be used
+var ErrInvalidCommitToken = errors.New("invalid commit token")
+
+// CommitToken marks the position in a pull consumer up to which fetched messages are ACKed
+type CommitToken struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Sequence is the highest consumer sequence number covered by the token
+	Sequence uint64 `json:"seq"`
+	// Issued is when the token was issued, in Unix nanoseconds
+	Issued int64 `json:"issued"`
+}
+
+// encodeCommitToken sign and encode a commit token as "<payload>.<signature>"
+func encodeCommitToken(token CommitToken, key []byte) (string, error) {
+	return encodeSignedToken(&token, key)
+}
+
+// decodeCommitToken decode a commit token, and verify its signature
+func decodeCommitToken(encoded string, key []byte) (CommitToken, error) {
+	var token CommitToken
+	if err := decodeSignedToken(encoded, key, &token); err != nil {
+		return CommitToken{}, fmt.Errorf("%w: %s", ErrInvalidCommitToken, err)
+	}
+	return token, nil
+}
+
+// ==============================================================================
+
+// JetStreamBatchFetcher reads batches of messages from JetStream pull consumers. Each batch
+// comes with a commit token; committing the token ACKs every message fetched through the
+// consumer up to the end of that batch.
+type JetStreamBatchFetcher interface {
+	// Fetch reads up to batchSize messages of a subject through a pull consumer, waiting
+	// until ctxt ends for at least one message. Returns the messages, and the commit token
+	// for them; no token is returned if there are no messages. batchSize is capped by the
+	// consumer's max inflight messages.
+	Fetch(
+		stream, consumer, subject string, batchSize int, ctxt context.Context,
+	) ([]*nats.Msg, string, error)
+	// Commit ACKs the messages fetched through a consumer up to a commit token. Returns the
+	// number of messages ACKed.
+	Commit(stream, consumer, token string, ctxt context.Context) (int, error)
+}
+
+// fetchedMsgKey identifies the messages fetched through a consumer
+type fetchedMsgKey struct {
+	stream, consumer string
+}
+
+// fetchedMsgRecord the record of a fetched message awaiting commit
+type fetchedMsgRecord struct {
+	consumerSeq uint64
+	reply       string
+	fetched     time.Time
+}
+
+// jetStreamBatchFetcherImpl implements JetStreamBatchFetcher
+type jetStreamBatchFetcherImpl struct {
+	common.Component
+	nats       *core.NatsClient
+	key        []byte
+	commitTTL  time.Duration
+	ackTimeout time.Duration
+	lock       sync.Mutex
+	// fetched the messages awaiting commit, by stream sequence number, for each consumer
+	fetched map[fetchedMsgKey]map[uint64]fetchedMsgRecord
+}
+
+// GetJetStreamBatchFetcher define new JetStreamBatchFetcher
+//
+// A commit token is only valid on the instance which issued it, and only for commitTTL.
+// Fetched messages not committed within commitTTL are forgotten, and will be redelivered by
+// JetStream once their ACK wait expires.
+func GetJetStreamBatchFetcher(
+	natsClient *core.NatsClient, commitTTL time.Duration, instance string,
+) (JetStreamBatchFetcher, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "js-batch-fetcher", "instance": instance,
+	}
+	if commitTTL <= 0 {
+		return nil, fmt.Errorf("commit token TTL must be positive")
+	}
+	key, err := newSigningKey()
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define commit token key")
+		return nil, err
+	}
+	return &jetStreamBatchFetcherImpl{
+		Component:  common.Component{LogTags: logTags},
+		nats:       natsClient,
+		key:        key,
+		commitTTL:  commitTTL,
+		ackTimeout: time.Second * 5,
+		fetched:    make(map[fetchedMsgKey]map[uint64]fetchedMsgRecord),
+	}, nil
+}
+
+// Fetch reads up to batchSize messages of a subject through a pull consumer, waiting
+// until ctxt ends for at least one message. Returns the messages, and the commit token
+// for them; no token is returned if there are no messages.
+func (f *jetStreamBatchFetcherImpl) Fetch(
+	stream, consumer, subject string, batchSize int, ctxt context.Context,
+) ([]*nats.Msg, string, error) {
+	localLogTags, err := common.UpdateLogTags(f.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(f.LogTags).Errorf("Failed to update logtags")
+		return nil, "", err
+	}
+	if batchSize <= 0 {
+		return nil, "", fmt.Errorf("batch size must be positive")
+	}
+
+	sub, err := f.nats.JetStream().PullSubscribe(subject, consumer, nats.Bind(stream, consumer))
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to pull subscribe with %s@%s", consumer, stream,
+		)
+		return nil, "", err
+	}
+	// Bound subscriptions do not delete the consumer when unsubscribing
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unsubscribe failed")
+		}
+	}()
+
+	// JetStream rejects pull requests for more messages than the consumer allows inflight
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to read consumer info of %s@%s", consumer, stream,
+		)
+		return nil, "", err
+	}
+	if info.Config.MaxAckPending > 0 && batchSize > info.Config.MaxAckPending {
+		batchSize = info.Config.MaxAckPending
+	}
+
+	msgs, err := sub.Fetch(batchSize, nats.Context(ctxt))
+	if err != nil {
+		if ctxt.Err() != nil {
+			// No messages before the wait ended
+			return []*nats.Msg{}, "", nil
+		}
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to fetch from %s@%s", consumer, stream,
+		)
+		return nil, "", err
+	}
+
+	now := time.Now()
+	token := CommitToken{Stream: stream, Consumer: consumer, Issued: now.UnixNano()}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dropExpired(now)
+	key := fetchedMsgKey{stream: stream, consumer: consumer}
+	records, ok := f.fetched[key]
+	if !ok {
+		records = make(map[uint64]fetchedMsgRecord)
+		f.fetched[key] = records
+	}
+	for idx, msg := range msgs {
+		meta, err := msg.Metadata()
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unable to record %s", NewMsgEnvelope(msg).String())
+			return nil, "", err
+		}
+		// A redelivered message replaces the record of its earlier delivery
+		records[meta.Sequence.Stream] = fetchedMsgRecord{
+			consumerSeq: meta.Sequence.Consumer, reply: msg.Reply, fetched: now,
+		}
+		if meta.Sequence.Consumer > token.Sequence {
+			token.Sequence = meta.Sequence.Consumer
+		}
+		event := hooks.DeliverEvent{Stream: stream, Consumer: consumer, Message: msg}
+		hooks.OnDeliver(&event, ctxt)
+		msgs[idx] = event.Message
+	}
+	encoded, err := encodeCommitToken(token, f.key)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to define commit token")
+		return nil, "", err
+	}
+	log.WithFields(localLogTags).Debugf(
+		"Fetched %d messages from %s@%s up to [%d]", len(msgs), consumer, stream, token.Sequence,
+	)
+	return msgs, encoded, nil
+}
+
+// Commit ACKs the messages fetched through a consumer up to a commit token. Returns the
+// number of messages ACKed.
+func (f *jetStreamBatchFetcherImpl) Commit(
+	stream, consumer, encoded string, ctxt context.Context,
+) (int, error) {
+	localLogTags, err := common.UpdateLogTags(f.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(f.LogTags).Errorf("Failed to update logtags")
+		return 0, err
+	}
+	token, err := decodeCommitToken(encoded, f.key)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Invalid commit token")
+		return 0, err
+	}
+	if token.Stream != stream || token.Consumer != consumer {
+		err := fmt.Errorf(
+			"%w: issued for %s@%s", ErrInvalidCommitToken, token.Consumer, token.Stream,
+		)
+		log.WithError(err).WithFields(localLogTags).Errorf("Invalid commit token")
+		return 0, err
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(0, token.Issued)) > f.commitTTL {
+		err := fmt.Errorf("%w: expired", ErrInvalidCommitToken)
+		log.WithError(err).WithFields(localLogTags).Errorf("Invalid commit token")
+		return 0, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dropExpired(now)
+	key := fetchedMsgKey{stream: stream, consumer: consumer}
+	records := f.fetched[key]
+	committed := 0
+	for streamSeq, record := range records {
+		if record.consumerSeq > token.Sequence {
+			continue
+		}
+		// Same as nats.Msg.AckSync, but without the original subscription
+		if _, err := f.nats.NATs().Request(
+			record.reply, AckTypeAck.replyPayload(), f.ackTimeout,
+		); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf(
+				"Unable to ACK [%d] for %s@%s", streamSeq, consumer, stream,
+			)
+			return committed, err
+		}
+		delete(records, streamSeq)
+		committed++
+		hooks.OnAck(hooks.AckEvent{
+			Stream:      stream,
+			Consumer:    consumer,
+			StreamSeq:   streamSeq,
+			ConsumerSeq: record.consumerSeq,
+			Type:        string(AckTypeAck),
+		}, ctxt)
+	}
+	if len(records) == 0 {
+		delete(f.fetched, key)
+	}
+	log.WithFields(localLogTags).Debugf(
+		"Committed %d messages for %s@%s up to [%d]", committed, consumer, stream, token.Sequence,
+	)
+	return committed, nil
+}
+
+// dropExpired forget fetched messages which can no longer be committed. Caller must hold
+// the lock.
+func (f *jetStreamBatchFetcherImpl) dropExpired(now time.Time) {
+	for key, records := range f.fetched {
+		for streamSeq, record := range records {
+			if now.Sub(record.fetched) > f.commitTTL {
+				delete(records, streamSeq)
+			}
+		}
+		if len(records) == 0 {
+			delete(f.fetched, key)
+		}
+	}
+}
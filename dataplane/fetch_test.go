@@ -0,0 +1,210 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJetStreamBatchFetcher(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-batch-fetcher"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamBatchFetcher",
+		"instance":  "basic",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.fetch", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+
+	// Define pull consumers for testing
+	consumer1 := uuid.New().String()
+	consumer2 := uuid.New().String()
+	for _, consumer := range []string{consumer1, consumer2} {
+		param := management.JetStreamConsumerParam{
+			Name: consumer, MaxInflight: 10, Mode: "pull", FilterSubject: &subject1,
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+	}
+
+	// Case 0: invalid commit TTL
+	{
+		_, err := GetJetStreamBatchFetcher(js, 0, testName)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetJetStreamBatchFetcher(js, time.Minute, testName)
+	assert.Nil(err)
+
+	// Case 1: fetch with no messages
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Millisecond*200)
+		defer cancel()
+		msgs, token, err := uut.Fetch(stream1, consumer1, subject1, 3, ctxt)
+		assert.Nil(err)
+		assert.Empty(msgs)
+		assert.Empty(token)
+	}
+
+	for itr := 0; itr < 5; itr++ {
+		_, err := js.JetStream().Publish(subject1, []byte(fmt.Sprintf("msg-%d", itr)))
+		assert.Nil(err)
+	}
+
+	// Case 2: fetch in batches
+	var token1, token2 string
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		msgs, token, err := uut.Fetch(stream1, consumer1, subject1, 3, ctxt)
+		assert.Nil(err)
+		assert.Len(msgs, 3)
+		assert.NotEmpty(token)
+		token1 = token
+		msgs, token, err = uut.Fetch(stream1, consumer1, subject1, 3, ctxt)
+		assert.Nil(err)
+		assert.Len(msgs, 2)
+		assert.NotEmpty(token)
+		token2 = token
+		assert.Equal("msg-4", string(msgs[1].Data))
+	}
+
+	// Case 3: invalid commits
+	{
+		_, err := uut.Commit(stream1, consumer2, token1, utCtxt)
+		assert.True(errors.Is(err, ErrInvalidCommitToken))
+		_, err = uut.Commit(stream1, consumer1, "garbage", utCtxt)
+		assert.NotNil(err)
+		// Tamper with the token payload
+		parts := strings.Split(token1, ".")
+		tampered, err := base64.RawURLEncoding.DecodeString(parts[0])
+		assert.Nil(err)
+		tampered = []byte(strings.Replace(string(tampered), `"seq":3`, `"seq":5`, 1))
+		_, err = uut.Commit(
+			stream1, consumer1,
+			fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(tampered), parts[1]),
+			utCtxt,
+		)
+		assert.NotNil(err)
+		// Token from another instance
+		other, err := GetJetStreamBatchFetcher(js, time.Minute, testName)
+		assert.Nil(err)
+		_, err = other.Commit(stream1, consumer1, token1, utCtxt)
+		assert.NotNil(err)
+	}
+
+	// Case 4: commit the first batch
+	{
+		committed, err := uut.Commit(stream1, consumer1, token1, utCtxt)
+		assert.Nil(err)
+		assert.Equal(3, committed)
+		// Committing again has no effect
+		committed, err = uut.Commit(stream1, consumer1, token1, utCtxt)
+		assert.Nil(err)
+		assert.Equal(0, committed)
+		info, err := js.JetStream().ConsumerInfo(stream1, consumer1)
+		assert.Nil(err)
+		assert.Equal(uint64(3), info.AckFloor.Stream)
+	}
+
+	// Case 5: commit the second batch
+	{
+		committed, err := uut.Commit(stream1, consumer1, token2, utCtxt)
+		assert.Nil(err)
+		assert.Equal(2, committed)
+		info, err := js.JetStream().ConsumerInfo(stream1, consumer1)
+		assert.Nil(err)
+		assert.Equal(uint64(5), info.AckFloor.Stream)
+		assert.Equal(0, info.NumAckPending)
+	}
+
+	// Case 6: expired commit token
+	{
+		shortTTL, err := GetJetStreamBatchFetcher(js, time.Millisecond*100, testName)
+		assert.Nil(err)
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		// Batch size is capped by the consumer's max inflight
+		msgs, token, err := shortTTL.Fetch(stream1, consumer2, subject1, 50, ctxt)
+		assert.Nil(err)
+		assert.Len(msgs, 5)
+		time.Sleep(time.Millisecond * 200)
+		_, err = shortTTL.Commit(stream1, consumer2, token, utCtxt)
+		assert.NotNil(err)
+	}
+}
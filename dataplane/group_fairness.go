@@ -0,0 +1,164 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+)
+
+// GroupFairnessParam settings for balancing delivery between the sessions of a delivery group
+type GroupFairnessParam struct {
+	// SkewFactor a session is passed over while it has more than SkewFactor times the
+	// messages awaiting ACK of the least loaded other session of its group
+	SkewFactor float64 `validate:"gt=1"`
+	// MinUnacked a session with fewer messages awaiting ACK is never passed over
+	MinUnacked int `validate:"gte=1"`
+	// MaxDeflections a message already delivered this many times is forwarded regardless,
+	// so passing it over does not use up the consumer's max deliveries
+	MaxDeflections int `validate:"gte=1"`
+}
+
+// DeliveryGroupBalancer tracks the messages awaiting ACK of each push subscribe session of
+// the delivery groups on this replica, so messages are deflected away from sessions which
+// are slow to ACK, toward the other sessions of the group.
+type DeliveryGroupBalancer interface {
+	// Join registers a session of a delivery group. The session must Leave once it ends.
+	Join(stream, consumer, group string) GroupMember
+}
+
+// GroupMember is a session of a delivery group registered with a DeliveryGroupBalancer
+type GroupMember interface {
+	// Admit decides whether a message is forwarded to the session, or deflected toward
+	// another session of the group. An admitted message is counted as awaiting ACK; a
+	// message already awaiting ACK, i.e. a redelivery, is always admitted.
+	Admit(streamSeq, numDelivered uint64) bool
+	// Release marks a message as ACKed, or NAKed
+	Release(streamSeq uint64)
+	// Leave removes the session from its group
+	Leave()
+}
+
+// deliveryGroupKey identifies a delivery group
+type deliveryGroupKey struct {
+	stream   string
+	consumer string
+	group    string
+}
+
+// deliveryGroupBalancerImpl implements DeliveryGroupBalancer
+type deliveryGroupBalancerImpl struct {
+	common.Component
+	param  GroupFairnessParam
+	lock   sync.Mutex
+	groups map[deliveryGroupKey]map[*groupMemberImpl]bool
+}
+
+// groupMemberImpl implements GroupMember
+type groupMemberImpl struct {
+	balancer *deliveryGroupBalancerImpl
+	key      deliveryGroupKey
+	// unacked stream sequence numbers of the messages awaiting ACK. Guarded by the lock of
+	// the balancer, as admitting a message compares the sessions of the group.
+	unacked map[uint64]bool
+}
+
+// GetDeliveryGroupBalancer define a new DeliveryGroupBalancer
+func GetDeliveryGroupBalancer(
+	param GroupFairnessParam, instance string,
+) (DeliveryGroupBalancer, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "delivery-group-balancer", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		return nil, err
+	}
+	return &deliveryGroupBalancerImpl{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		groups:    make(map[deliveryGroupKey]map[*groupMemberImpl]bool),
+	}, nil
+}
+
+// Join registers a session of a delivery group
+func (b *deliveryGroupBalancerImpl) Join(stream, consumer, group string) GroupMember {
+	key := deliveryGroupKey{stream: stream, consumer: consumer, group: group}
+	member := &groupMemberImpl{balancer: b, key: key, unacked: make(map[uint64]bool)}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	members, ok := b.groups[key]
+	if !ok {
+		members = make(map[*groupMemberImpl]bool)
+		b.groups[key] = members
+	}
+	members[member] = true
+	log.WithFields(b.LogTags).Debugf(
+		"Session joined %s, now %d sessions", member, len(members),
+	)
+	return member
+}
+
+// String toString function for groupMemberImpl
+func (m *groupMemberImpl) String() string {
+	return fmt.Sprintf("%s@%s/%s", m.key.consumer, m.key.stream, m.key.group)
+}
+
+// Admit decides whether a message is forwarded to the session
+func (m *groupMemberImpl) Admit(streamSeq, numDelivered uint64) bool {
+	b := m.balancer
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !m.unacked[streamSeq] &&
+		numDelivered <= uint64(b.param.MaxDeflections) &&
+		len(m.unacked) >= b.param.MinUnacked {
+		// Compare with the least loaded other session of the group
+		leastUnacked := math.MaxInt
+		for peer := range b.groups[m.key] {
+			if peer != m && len(peer.unacked) < leastUnacked {
+				leastUnacked = len(peer.unacked)
+			}
+		}
+		if leastUnacked != math.MaxInt &&
+			float64(len(m.unacked)) > b.param.SkewFactor*math.Max(1, float64(leastUnacked)) {
+			return false
+		}
+	}
+	m.unacked[streamSeq] = true
+	return true
+}
+
+// Release marks a message as ACKed, or NAKed
+func (m *groupMemberImpl) Release(streamSeq uint64) {
+	m.balancer.lock.Lock()
+	defer m.balancer.lock.Unlock()
+	delete(m.unacked, streamSeq)
+}
+
+// Leave removes the session from its group
+func (m *groupMemberImpl) Leave() {
+	b := m.balancer
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	members := b.groups[m.key]
+	delete(members, m)
+	if len(members) == 0 {
+		delete(b.groups, m.key)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryGroupBalancer(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid parameters
+	{
+		_, err := GetDeliveryGroupBalancer(
+			GroupFairnessParam{SkewFactor: 1, MinUnacked: 1, MaxDeflections: 1}, "ut",
+		)
+		assert.NotNil(err)
+		_, err = GetDeliveryGroupBalancer(
+			GroupFairnessParam{SkewFactor: 2, MinUnacked: 0, MaxDeflections: 1}, "ut",
+		)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetDeliveryGroupBalancer(
+		GroupFairnessParam{SkewFactor: 2, MinUnacked: 2, MaxDeflections: 2}, "ut",
+	)
+	assert.Nil(err)
+
+	// Case 1: a session alone in its group is never passed over
+	slow := uut.Join("stream", "consumer", "group")
+	for seq := uint64(1); seq <= 5; seq++ {
+		assert.True(slow.Admit(seq, 1))
+	}
+
+	// Case 2: a session with many messages awaiting ACK is passed over once another session
+	// of the group joins
+	fast := uut.Join("stream", "consumer", "group")
+	other := uut.Join("stream", "consumer", "other-group")
+	assert.False(slow.Admit(6, 1))
+	assert.True(fast.Admit(6, 2))
+	// Sessions of other groups are not compared
+	for seq := uint64(1); seq <= 5; seq++ {
+		assert.True(other.Admit(seq, 1))
+	}
+	// A redelivery of a message awaiting ACK is admitted
+	assert.True(slow.Admit(3, 2))
+	// A message deflected too many times is admitted
+	assert.True(slow.Admit(7, 3))
+	slow.Release(7)
+
+	// Case 3: the session is admitted again as the other session takes on messages
+	{
+		assert.False(slow.Admit(8, 1))
+		assert.True(fast.Admit(8, 1))
+		assert.True(fast.Admit(9, 1))
+		// 5 awaiting ACK, against 3 on the other session
+		assert.True(slow.Admit(10, 1))
+		assert.True(slow.Admit(11, 1))
+		assert.False(slow.Admit(12, 1))
+		for seq := uint64(1); seq <= 3; seq++ {
+			slow.Release(seq)
+		}
+		assert.True(slow.Admit(12, 1))
+	}
+
+	// Case 4: the session is admitted once the other session leaves
+	{
+		for seq := uint64(12); seq <= 20; seq++ {
+			_ = slow.Admit(seq, 1)
+		}
+		assert.False(slow.Admit(21, 1))
+		fast.Leave()
+		assert.True(slow.Admit(21, 1))
+		slow.Leave()
+		other.Leave()
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrInvalidImportToken returned when an import resume token can not be used
+var ErrInvalidImportToken = errors.New("invalid import token")
+
+// ErrImportRunning returned when resuming an import which is still running
+var ErrImportRunning = errors.New("import is still running")
+
+// ImportMessage is one line of an NDJSON import upload. The lines of an export are
+// accepted as well; their other fields are ignored.
+type ImportMessage struct {
+	// Subject is the subject to publish the message to
+	Subject string `json:"subject"`
+	// Headers are the message headers
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Message is the message body, Base64 encoded
+	Message []byte `json:"b64_msg"`
+}
+
+// ImportProgress is the progress of an import
+type ImportProgress struct {
+	// ID identifies the import across resumed uploads
+	ID string `json:"id"`
+	// Read is the number of lines read from the current upload
+	Read uint64 `json:"read"`
+	// Published is the number of messages of the current upload published
+	Published uint64 `json:"published"`
+	// Committed is the number of lines, counted from the start of the first upload of the
+	// import, whose messages are all published. A resumed upload starts after these lines.
+	Committed uint64 `json:"committed"`
+	// Running indicates the current upload is still being imported
+	Running bool `json:"running"`
+	// Error describes the failure which stopped the import, if any
+	Error string `json:"error,omitempty"`
+	// Token resumes the import after the committed lines
+	Token string `json:"token,omitempty"`
+}
+
+// importToken the signed content of an import resume token
+type importToken struct {
+	// ID is the import ID
+	ID string `json:"id"`
+	// Committed is the number of lines committed
+	Committed uint64 `json:"committed"`
+	// Issued is when the token was issued, in Unix nanoseconds
+	Issued int64 `json:"issued"`
+}
+
+// BulkImportParam settings for bulk importing messages
+type BulkImportParam struct {
+	// Concurrency is the max number of messages of an upload awaiting their publish ACK
+	Concurrency int `validate:"gte=1"`
+	// MaxLineBytes is the longest line of an upload accepted
+	MaxLineBytes int `validate:"gte=1"`
+	// TokenTTL is how long an import can be resumed for after its last upload
+	TokenTTL time.Duration `validate:"gt=0"`
+	// AckWait is how long a publish waits for the JetStream ACK. Zero means until the
+	// upload ends.
+	AckWait time.Duration `validate:"gte=0"`
+	// Subjects are the rules the subjects of the imported messages must follow
+	Subjects common.SubjectRules
+}
+
+// BulkImporter publishes the messages of NDJSON uploads with bounded concurrency.
+//
+// Each message is published with a message ID derived from the import ID and its line, so
+// messages published again when an import is resumed are dropped by JetStream as
+// duplicates, within the duplicate window of the stream.
+type BulkImporter interface {
+	// Import publishes the messages of an upload through publisher. If token is not empty,
+	// the import it was issued for is resumed; the upload must then start after the lines
+	// the import committed. The import stops at the first message not published.
+	//
+	// Returns the progress of the import once the upload ends, with the token to resume it.
+	Import(
+		upload io.Reader, token string, publisher JetStreamPublisher, ctxt context.Context,
+	) (ImportProgress, error)
+	// Progress reports the progress of an import run recently on this instance
+	Progress(id string) (ImportProgress, bool)
+}
+
+// importEntry the state of an import known to this instance
+type importEntry struct {
+	progress   ImportProgress
+	lastActive time.Time
+}
+
+// bulkImporterImpl implements BulkImporter
+type bulkImporterImpl struct {
+	common.Component
+	param     BulkImportParam
+	inspector ContentInspector
+	key       []byte
+	lock      sync.Mutex
+	imports   map[string]*importEntry
+}
+
+// GetBulkImporter define new BulkImporter
+//
+// Resume tokens are signed with key; if key is empty, a random key is used, and the tokens
+// are only valid on this instance. If inspector is not nil, it checks each message before
+// it is published.
+func GetBulkImporter(
+	param BulkImportParam, key []byte, inspector ContentInspector, instance string,
+) (BulkImporter, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "bulk-importer", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Bulk import parameters invalid")
+		return nil, err
+	}
+	if len(key) == 0 {
+		var err error
+		if key, err = newSigningKey(); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define import token key")
+			return nil, err
+		}
+	}
+	return &bulkImporterImpl{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		inspector: inspector,
+		key:       key,
+		imports:   map[string]*importEntry{},
+	}, nil
+}
+
+// parseImportLine helper function to parse one line of an upload into the message to publish
+func (i *bulkImporterImpl) parseImportLine(line []byte) (*nats.Msg, error) {
+	var parsed ImportMessage
+	if err := json.Unmarshal(line, &parsed); err != nil {
+		return nil, fmt.Errorf("not an import message: %w", err)
+	}
+	subject, err := i.param.Subjects.ValidateSubject(parsed.Subject)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(subject)
+	for name, values := range parsed.Headers {
+		for _, value := range values {
+			msg.Header.Add(name, value)
+		}
+	}
+	msg.Data = parsed.Message
+	return msg, nil
+}
+
+// begin helper function to register the start of an upload
+func (i *bulkImporterImpl) begin(token string) (*importEntry, error) {
+	id := uuid.New().String()
+	var committed uint64
+	if token != "" {
+		var decoded importToken
+		if err := decodeSignedToken(token, i.key, &decoded); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidImportToken, err)
+		}
+		if time.Since(time.Unix(0, decoded.Issued)) > i.param.TokenTTL {
+			return nil, fmt.Errorf("%w: expired", ErrInvalidImportToken)
+		}
+		id, committed = decoded.ID, decoded.Committed
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	for importID, entry := range i.imports {
+		if !entry.progress.Running && now.Sub(entry.lastActive) > i.param.TokenTTL {
+			delete(i.imports, importID)
+		}
+	}
+	if entry, ok := i.imports[id]; ok && entry.progress.Running {
+		return nil, ErrImportRunning
+	}
+	entry := &importEntry{
+		progress:   ImportProgress{ID: id, Committed: committed, Running: true},
+		lastActive: now,
+	}
+	i.imports[id] = entry
+	return entry, nil
+}
+
+// Import publishes the messages of an upload through publisher
+func (i *bulkImporterImpl) Import(
+	upload io.Reader, token string, publisher JetStreamPublisher, ctxt context.Context,
+) (ImportProgress, error) {
+	localLogTags, err := common.UpdateLogTags(i.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(i.LogTags).Errorf("Failed to update logtags")
+		return ImportProgress{}, err
+	}
+	entry, err := i.begin(token)
+	if err != nil {
+		return ImportProgress{}, err
+	}
+	id := entry.progress.ID
+
+	importCtxt, cancel := context.WithCancel(ctxt)
+	defer cancel()
+	// Lines past the committed lines which are published
+	published := map[uint64]bool{}
+	complete := func(line uint64, isMsg bool, err error) {
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		entry.lastActive = time.Now()
+		if err != nil {
+			if entry.progress.Error == "" {
+				entry.progress.Error = fmt.Sprintf("line %d: %s", line+1, err)
+			}
+			cancel()
+			return
+		}
+		if isMsg {
+			entry.progress.Published++
+		}
+		published[line] = true
+		for published[entry.progress.Committed] {
+			delete(published, entry.progress.Committed)
+			entry.progress.Committed++
+		}
+	}
+
+	scanner := bufio.NewScanner(upload)
+	// The longest line accepted is the larger of the buffer capacity and the max
+	bufferSize := bufio.MaxScanTokenSize
+	if bufferSize > i.param.MaxLineBytes {
+		bufferSize = i.param.MaxLineBytes
+	}
+	scanner.Buffer(make([]byte, 0, bufferSize), i.param.MaxLineBytes)
+	slots := make(chan struct{}, i.param.Concurrency)
+	wg := sync.WaitGroup{}
+	line := entry.progress.Committed
+	for ; importCtxt.Err() == nil && scanner.Scan(); line++ {
+		i.lock.Lock()
+		entry.progress.Read++
+		i.lock.Unlock()
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			complete(line, false, nil)
+			continue
+		}
+		msg, err := i.parseImportLine(raw)
+		if err == nil && i.inspector != nil {
+			err = i.inspector.Inspect(msg.Subject, msg.Data, importCtxt)
+		}
+		if err != nil {
+			complete(line, true, err)
+			break
+		}
+		msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s-%d", id, line))
+		select {
+		case slots <- struct{}{}:
+		case <-importCtxt.Done():
+			continue
+		}
+		wg.Add(1)
+		go func(line uint64, msg *nats.Msg) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			publishCtxt, cancel := importCtxt, context.CancelFunc(func() {})
+			if i.param.AckWait > 0 {
+				publishCtxt, cancel = context.WithTimeout(importCtxt, i.param.AckWait)
+			}
+			defer cancel()
+			complete(line, true, publisher.PublishMsg(msg, publishCtxt).Err)
+		}(line, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		complete(line, false, fmt.Errorf("unable to read upload: %w", err))
+	}
+	wg.Wait()
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if entry.progress.Error == "" && ctxt.Err() != nil {
+		entry.progress.Error = fmt.Sprintf("upload interrupted: %s", ctxt.Err())
+	}
+	entry.progress.Running = false
+	entry.lastActive = time.Now()
+	entry.progress.Token, err = encodeSignedToken(
+		&importToken{ID: id, Committed: entry.progress.Committed, Issued: time.Now().UnixNano()},
+		i.key,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to issue import token")
+	}
+	log.WithFields(localLogTags).Infof(
+		"Import %s upload ended: %d read, %d published, %d committed",
+		id, entry.progress.Read, entry.progress.Published, entry.progress.Committed,
+	)
+	return entry.progress, nil
+}
+
+// Progress reports the progress of an import run recently on this instance
+func (i *bulkImporterImpl) Progress(id string) (ImportProgress, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	entry, ok := i.imports[id]
+	if !ok {
+		return ImportProgress{}, false
+	}
+	return entry.progress, true
+}
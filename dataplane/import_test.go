@@ -0,0 +1,143 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeImportPublisher records the messages published, failing the ones on failSubject
+type fakeImportPublisher struct {
+	JetStreamPublisher
+	lock        sync.Mutex
+	failSubject string
+	published   map[string]*nats.Msg
+}
+
+func (p *fakeImportPublisher) PublishMsg(msg *nats.Msg, ctxt context.Context) PublishResult {
+	if msg.Subject == p.failSubject {
+		return PublishResult{Subject: msg.Subject, Err: fmt.Errorf("publish failed")}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// Same as JetStream, drop messages with a duplicate message ID
+	p.published[msg.Header.Get(nats.MsgIdHdr)] = msg
+	return PublishResult{Subject: msg.Subject}
+}
+
+func TestBulkImport(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-bulk-import"
+
+	param := BulkImportParam{
+		Concurrency: 2, MaxLineBytes: 256, TokenTTL: time.Minute, Subjects: common.SubjectRules{},
+	}
+
+	// Case 0: invalid parameters
+	{
+		_, err := GetBulkImporter(BulkImportParam{}, nil, nil, testName)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetBulkImporter(param, nil, nil, testName)
+	assert.Nil(err)
+	publisher := &fakeImportPublisher{failSubject: "fail", published: map[string]*nats.Msg{}}
+	ctxt := context.Background()
+
+	// Case 1: upload stops at a failed publish
+	upload := strings.Join([]string{
+		`{"subject":"a.1","headers":{"Trace":["1"]},"b64_msg":"aGVsbG8="}`,
+		``,
+		`{"subject":"a.2","b64_msg":"d29ybGQ="}`,
+		`{"subject":"fail","b64_msg":"d29ybGQ="}`,
+		`{"subject":"a.3","b64_msg":"d29ybGQ="}`,
+	}, "\n")
+	progress, err := uut.Import(strings.NewReader(upload), "", publisher, ctxt)
+	assert.Nil(err)
+	assert.False(progress.Running)
+	assert.Equal(uint64(3), progress.Committed)
+	assert.Contains(progress.Error, "line 4")
+	assert.NotEmpty(progress.Token)
+	{
+		msg, ok := publisher.published[fmt.Sprintf("%s-0", progress.ID)]
+		assert.True(ok)
+		assert.Equal("a.1", msg.Subject)
+		assert.Equal("1", msg.Header.Get("Trace"))
+		assert.Equal([]byte("hello"), msg.Data)
+	}
+	reported, ok := uut.Progress(progress.ID)
+	assert.True(ok)
+	assert.Equal(progress, reported)
+
+	// Case 2: resume after the committed lines
+	{
+		resumed := strings.Join([]string{
+			`{"subject":"a.4","b64_msg":"d29ybGQ="}`,
+			`{"subject":"a.5","b64_msg":"d29ybGQ="}`,
+		}, "\n")
+		next, err := uut.Import(strings.NewReader(resumed), progress.Token, publisher, ctxt)
+		assert.Nil(err)
+		assert.Equal(progress.ID, next.ID)
+		assert.Empty(next.Error)
+		assert.Equal(uint64(2), next.Read)
+		assert.Equal(uint64(2), next.Published)
+		assert.Equal(uint64(5), next.Committed)
+		msg, ok := publisher.published[fmt.Sprintf("%s-3", progress.ID)]
+		assert.True(ok)
+		assert.Equal("a.4", msg.Subject)
+	}
+
+	// Case 3: invalid token
+	{
+		_, err := uut.Import(strings.NewReader(""), "not-a-token", publisher, ctxt)
+		assert.ErrorIs(err, ErrInvalidImportToken)
+	}
+
+	// Case 4: invalid line and subject
+	{
+		for _, line := range []string{`{"subject":"a.1"`, `{"subject":"a..1"}`} {
+			progress, err := uut.Import(strings.NewReader(line), "", publisher, ctxt)
+			assert.Nil(err)
+			assert.Equal(uint64(0), progress.Committed)
+			assert.Contains(progress.Error, "line 1")
+		}
+	}
+
+	// Case 5: line too long
+	{
+		line := fmt.Sprintf(`{"subject":"a.1","b64_msg":"%s"}`, strings.Repeat("A", 512))
+		progress, err := uut.Import(strings.NewReader(line), "", publisher, ctxt)
+		assert.Nil(err)
+		assert.Equal(uint64(0), progress.Committed)
+		assert.Contains(progress.Error, "unable to read upload")
+	}
+
+	// Case 6: unknown import
+	{
+		_, ok := uut.Progress("unknown")
+		assert.False(ok)
+	}
+}
@@ -15,13 +15,18 @@
 package dataplane
 
 import (
+	"container/heap"
 	"context"
 	"fmt"
-	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/hooks"
+	"github.com/alwitt/httpmq/metrics"
 	"github.com/apex/log"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 )
 
@@ -31,29 +36,187 @@ type JetStreamInflightMsgProcessor interface {
 	RecordInflightMessage(msg *nats.Msg, blocking bool, callCtxt context.Context) error
 	// HandlerMsgACK processes a new message ACK
 	HandlerMsgACK(ack AckIndication, blocking bool, callCtxt context.Context) error
+	// HandlerMsgACKs processes a batch of message ACKs, without waiting for the results
+	HandlerMsgACKs(acks []AckIndication, callCtxt context.Context) error
+	// NAKOverdueMessages NAK the inflight messages recorded more than deadline ago, so they
+	// are redelivered without waiting for the consumer's AckWait. onNAK is called with each
+	// message NAKed.
+	NAKOverdueMessages(
+		deadline time.Duration, onNAK func(msg *nats.Msg), callCtxt context.Context,
+	) error
+	// ListInflightMessages lists the messages currently awaiting ACK, oldest first
+	ListInflightMessages(callCtxt context.Context) ([]InflightMessage, error)
 }
 
+// InflightMessage describes a message delivered, and awaiting ACK
+type InflightMessage struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Subject is the subject of the message
+	Subject string `json:"subject"`
+	// StreamSeq is the stream sequence number of the message
+	StreamSeq uint64 `json:"stream_seq"`
+	// ConsumerSeq is the consumer sequence number of the message
+	ConsumerSeq uint64 `json:"consumer_seq"`
+	// NumDelivered is how many times the message was delivered
+	NumDelivered uint64 `json:"num_delivered"`
+	// Published is when the message was published
+	Published time.Time `json:"published"`
+	// Received is when the message was delivered, and began awaiting ACK
+	Received time.Time `json:"received"`
+	// Age is how long the message has been awaiting ACK
+	Age time.Duration `json:"age" swaggertype:"primitive,integer"`
+}
+
+// inflightShardSeqRange is the number of consecutive stream sequence numbers held by the
+// same inflight message shard
+const inflightShardSeqRange = 16
+
 // perConsumerInflightMessages set of messages awaiting ACK for a consumer
+//
+// The messages are sharded by stream sequence range. A shard is only accessed from the
+// task processor of that shard, so messages in different shards are processed concurrently.
 type perConsumerInflightMessages struct {
-	inflight map[uint64]*nats.Msg
+	shards []map[uint64]inflightRecord
+}
+
+// inflightRecord a message awaiting ACK, and when it was recorded
+type inflightRecord struct {
+	msg      *nats.Msg
+	recorded time.Time
 }
 
 // perStreamInflightMessages set of perConsumerInflightMessages for each consumer
 type perStreamInflightMessages struct {
-	consumers map[string]*perConsumerInflightMessages
+	// consumers maps consumer name to *perConsumerInflightMessages
+	consumers sync.Map
+}
+
+// getConsumerRecords fetch the records of a consumer. If create, the records are defined
+// with shardCount shards if the consumer has none.
+func (s *perStreamInflightMessages) getConsumerRecords(
+	consumer string, shardCount int, create bool,
+) *perConsumerInflightMessages {
+	if records, ok := s.consumers.Load(consumer); ok {
+		return records.(*perConsumerInflightMessages)
+	}
+	if !create {
+		return nil
+	}
+	newRecords := &perConsumerInflightMessages{
+		shards: make([]map[uint64]inflightRecord, shardCount),
+	}
+	for itr := range newRecords.shards {
+		newRecords.shards[itr] = make(map[uint64]inflightRecord)
+	}
+	records, _ := s.consumers.LoadOrStore(consumer, newRecords)
+	return records.(*perConsumerInflightMessages)
+}
+
+// maxPendingACKsPerShard is the max number of ACKs buffered by each shard. Once full, the
+// ACK buffered the longest is dropped.
+const maxPendingACKsPerShard = 1024
+
+// maxPersistedACKLookups is the max number of ACKs being applied using the persisted
+// records at once. Once reached, ACKs for messages not held are treated as if there is no
+// persistence.
+const maxPersistedACKLookups = 64
+
+// inflightShard the task processor, and the buffered ACKs, of one inflight message shard
+type inflightShard struct {
+	records     common.TaskSubmitter[jsInflightCtrlRecordNewMsg]
+	acks        common.TaskSubmitter[jsInflightCtrlRecordACK]
+	overdueNAKs common.TaskSubmitter[jsInflightCtrlNAKOverdue]
+	listings    common.TaskSubmitter[jsInflightCtrlList]
+	// pendingACKs ACKs received for messages not yet recorded
+	pendingACKs map[pendingACKKey]pendingACK
+	// pendingExpiry orders the buffered ACKs by expiry. Entries of ACKs since applied, or
+	// buffered again, are skipped once they reach the top.
+	pendingExpiry pendingACKExpiry
+}
+
+// pendingACK an ACK received before its message was recorded, and when it expires
+type pendingACK struct {
+	ack    AckIndication
+	expire time.Time
+}
+
+// pendingACKKey identifies a message whose ACK arrived before the message was recorded
+type pendingACKKey struct {
+	stream, consumer string
+	sequence         uint64
+}
+
+// pendingACKDeadline when a buffered ACK expires
+type pendingACKDeadline struct {
+	key    pendingACKKey
+	expire time.Time
+}
+
+// pendingACKExpiry min-heap of pendingACKDeadline by expiry, supporting container/heap
+type pendingACKExpiry []pendingACKDeadline
+
+func (h pendingACKExpiry) Len() int           { return len(h) }
+func (h pendingACKExpiry) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+func (h pendingACKExpiry) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// Push support container/heap
+func (h *pendingACKExpiry) Push(x interface{}) {
+	*h = append(*h, x.(pendingACKDeadline))
+}
+
+// Pop support container/heap
+func (h *pendingACKExpiry) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
 }
 
 // jetStreamInflightMsgProcessorImpl implements JetStreamInflightMsgProcessor
 type jetStreamInflightMsgProcessorImpl struct {
 	common.Component
 	subject, consumer string
-	tp                common.TaskProcessor
-	inflightPerStream map[string]*perStreamInflightMessages
+	shards            []inflightShard
+	// inflightPerStream maps stream name to *perStreamInflightMessages
+	inflightPerStream sync.Map
+	pendingACKTTL     time.Duration
+	// persistence optionally persists the inflight messages records
+	persistence InflightMsgPersistence
+	// run identifies this processor in the persisted records
+	run string
+	// persistedLookups bounds the number of ACKs being applied using the persisted records
+	persistedLookups chan struct{}
+	// latency optionally tracks the time from publish to ACK of the messages
+	latency metrics.ConsumerLatencyTracker
+	// clock is the source of time for the pending ACK TTL and the overdue sweeps
+	clock      common.Clock
+	optContext context.Context
 }
 
 // getJetStreamInflightMsgProcessor define new JetStreamInflightMsgProcessor
+//
+// The inflight messages are sharded by stream sequence range, with one shard for each of
+// tps. Records and ACKs of messages in different shards are processed concurrently.
+//
+// An ACK may be received before the message it refers to is recorded. If pendingACKTTL is
+// not zero, such an ACK is buffered for up to pendingACKTTL, and applied once the message
+// is recorded. Otherwise, the ACK is rejected.
+//
+// If persistence is not nil, records of inflight messages are also persisted, and ACKs for
+// messages this instance has no record of are applied using the persisted records. The
+// persisted records are consulted outside of the task processors.
+//
+// If latency is not nil, the time from publish to ACK of each message ACKed is recorded.
 func getJetStreamInflightMsgProcessor(
-	tp common.TaskProcessor, stream, subject, consumer string, ctxt context.Context,
+	tps []common.TaskProcessor,
+	stream, subject, consumer string,
+	pendingACKTTL time.Duration,
+	persistence InflightMsgPersistence,
+	latency metrics.ConsumerLatencyTracker,
+	ctxt context.Context,
 ) (JetStreamInflightMsgProcessor, error) {
 	logTags := log.Fields{
 		"module":    "dataplane",
@@ -68,105 +231,118 @@ func getJetStreamInflightMsgProcessor(
 			v.UpdateLogTags(logTags)
 		}
 	}
-	instance := jetStreamInflightMsgProcessorImpl{
-		Component:         common.Component{LogTags: logTags},
-		subject:           subject,
-		consumer:          consumer,
-		tp:                tp,
-		inflightPerStream: make(map[string]*perStreamInflightMessages),
+	if len(tps) == 0 {
+		return nil, fmt.Errorf("inflight message processor needs at least one task processor")
 	}
-	// Add handlers
-	if err := tp.AddToTaskExecutionMap(
-		reflect.TypeOf(jsInflightCtrlRecordNewMsg{}),
-		instance.processInflightMessage,
-	); err != nil {
-		return nil, err
+	instance := &jetStreamInflightMsgProcessorImpl{
+		Component:        common.Component{LogTags: logTags},
+		subject:          subject,
+		consumer:         consumer,
+		shards:           make([]inflightShard, len(tps)),
+		pendingACKTTL:    pendingACKTTL,
+		persistence:      persistence,
+		run:              uuid.New().String(),
+		persistedLookups: make(chan struct{}, maxPersistedACKLookups),
+		latency:          latency,
+		clock:            common.SystemClock,
+		optContext:       ctxt,
+	}
+	for itr, tp := range tps {
+		shard := &instance.shards[itr]
+		shard.pendingACKs = make(map[pendingACKKey]pendingACK)
+		// Add handlers
+		var err error
+		if shard.records, err = common.RegisterTaskHandler(
+			tp, instance.processInflightMessage,
+		); err != nil {
+			return nil, err
+		}
+		if shard.acks, err = common.RegisterTaskHandler(tp, instance.processMsgACK); err != nil {
+			return nil, err
+		}
+		if shard.overdueNAKs, err = common.RegisterTaskHandler(
+			tp, instance.processNAKOverdue,
+		); err != nil {
+			return nil, err
+		}
+		if shard.listings, err = common.RegisterTaskHandler(
+			tp, instance.processListInflight,
+		); err != nil {
+			return nil, err
+		}
+	}
+	return instance, nil
+}
+
+// shardIndex helper function to select the shard holding a stream sequence number
+func (c *jetStreamInflightMsgProcessorImpl) shardIndex(streamSeq uint64) int {
+	return int((streamSeq / inflightShardSeqRange) % uint64(len(c.shards)))
+}
+
+// getStreamRecords fetch the records of a stream. If create, the records are defined if
+// the stream has none.
+func (c *jetStreamInflightMsgProcessorImpl) getStreamRecords(
+	stream string, create bool,
+) *perStreamInflightMessages {
+	if records, ok := c.inflightPerStream.Load(stream); ok {
+		return records.(*perStreamInflightMessages)
 	}
-	if err := tp.AddToTaskExecutionMap(
-		reflect.TypeOf(jsInflightCtrlRecordACK{}),
-		instance.processMsgACK,
-	); err != nil {
-		return nil, err
+	if !create {
+		return nil
 	}
-	return &instance, nil
+	records, _ := c.inflightPerStream.LoadOrStore(stream, &perStreamInflightMessages{})
+	return records.(*perStreamInflightMessages)
 }
 
 // =========================================================================
 
 type jsInflightCtrlRecordNewMsg struct {
 	timestamp time.Time
-	blocking  bool
 	message   *nats.Msg
-	resultCB  func(err error)
 }
 
 // RecordInflightMessage records a new JetStream message inflight awaiting ACK
 func (c *jetStreamInflightMsgProcessorImpl) RecordInflightMessage(
 	msg *nats.Msg, blocking bool, callCtxt context.Context,
 ) error {
-	resultChan := make(chan error)
-	handler := func(err error) {
-		resultChan <- err
-	}
-
-	request := jsInflightCtrlRecordNewMsg{
-		timestamp: time.Now(),
-		blocking:  blocking,
-		message:   msg,
-		resultCB:  handler,
-	}
+	request := jsInflightCtrlRecordNewMsg{timestamp: c.clock.Now(), message: msg}
 
-	if err := c.tp.Submit(request, callCtxt); err != nil {
-		log.WithError(err).WithFields(c.LogTags).Errorf("Failed to submit %s", msgToString(msg))
-		return err
+	// A message without metadata is rejected when processed, so any shard will do
+	shard := 0
+	if meta, err := msg.Metadata(); err == nil {
+		shard = c.shardIndex(meta.Sequence.Stream)
 	}
 
 	// Don't wait for a response
 	if !blocking {
-		return nil
-	}
-
-	var err error
-	// Wait for the response or timeout
-	select {
-	case result, ok := <-resultChan:
-		if !ok {
-			err = fmt.Errorf("response to new inflight message is invalid")
-		} else {
-			err = result
+		if err := c.shards[shard].records.Submit(request, callCtxt); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf("Failed to submit %s", NewMsgEnvelope(msg).String())
+			return err
 		}
-	case <-callCtxt.Done():
-		err = callCtxt.Err()
+		return nil
 	}
 
+	err := c.shards[shard].records.SubmitAndWait(request, callCtxt)
 	if err != nil {
-		log.WithError(err).WithFields(c.LogTags).Errorf("Processing %s failed", msgToString(msg))
+		log.WithError(err).WithFields(c.LogTags).Errorf("Processing %s failed", NewMsgEnvelope(msg).String())
 	}
 	return err
 }
 
 // processInflightMessage support TaskProcessor, handle jsInflightCtrlRecordNewMsg
-func (c *jetStreamInflightMsgProcessorImpl) processInflightMessage(param interface{}) error {
-	request, ok := param.(jsInflightCtrlRecordNewMsg)
-	if !ok {
-		return fmt.Errorf(
-			"can not process unknown type %s for record inflight message",
-			reflect.TypeOf(param),
-		)
-	}
-	err := c.ProcessInflightMessage(request.message)
-	if request.blocking {
-		request.resultCB(err)
-	}
-	return err
+func (c *jetStreamInflightMsgProcessorImpl) processInflightMessage(
+	request jsInflightCtrlRecordNewMsg,
+) error {
+	return c.ProcessInflightMessage(request.message)
 }
 
-// ProcessInflightMessage records a new JetStream message inflight awaiting ACK
+// ProcessInflightMessage records a new JetStream message inflight awaiting ACK. This must
+// be called from the task processor of the message's shard.
 func (c *jetStreamInflightMsgProcessorImpl) ProcessInflightMessage(msg *nats.Msg) error {
-	// Store the message based on per-consumer sequence number of the JetStream message
+	// Store the message based on the stream sequence number of the JetStream message
 	meta, err := msg.Metadata()
 	if err != nil {
-		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to record %s", msgToString(msg))
+		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to record %s", NewMsgEnvelope(msg).String())
 		return err
 	}
 	// Sanity check the consumer name match
@@ -174,29 +350,38 @@ func (c *jetStreamInflightMsgProcessorImpl) ProcessInflightMessage(msg *nats.Msg
 		err := fmt.Errorf(
 			"message expected for %s, but meta says %s", c.consumer, meta.Consumer,
 		)
-		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to record %s", msgToString(msg))
+		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to record %s", NewMsgEnvelope(msg).String())
 		return err
 	}
 
-	// Fetch the per stream records
-	perStreamRecords, ok := c.inflightPerStream[meta.Stream]
-	if !ok {
-		c.inflightPerStream[meta.Stream] = &perStreamInflightMessages{
-			consumers: make(map[string]*perConsumerInflightMessages),
-		}
-		perStreamRecords = c.inflightPerStream[meta.Stream]
+	// Fetch the per stream, and then per consumer, records
+	perConsumerRecords := c.getStreamRecords(meta.Stream, true).getConsumerRecords(
+		c.consumer, len(c.shards), true,
+	)
+
+	shard := c.shardIndex(meta.Sequence.Stream)
+	perConsumerRecords.shards[shard][meta.Sequence.Stream] = inflightRecord{
+		msg: msg, recorded: c.clock.Now(),
 	}
-	// Fetch the per consumer records
-	perConsumerRecords, ok := perStreamRecords.consumers[c.consumer]
-	if !ok {
-		perStreamRecords.consumers[c.consumer] = &perConsumerInflightMessages{
-			inflight: make(map[uint64]*nats.Msg),
+	common.ThrottledDebugf(log.WithFields(c.LogTags), "Recorded %s", NewMsgEnvelope(msg).String())
+	if c.persistence != nil {
+		if err := c.persistence.RecordMessage(msg, c.run, c.optContext); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf("Unable to persist %s", NewMsgEnvelope(msg).String())
 		}
-		perConsumerRecords = perStreamRecords.consumers[c.consumer]
 	}
 
-	perConsumerRecords.inflight[meta.Sequence.Stream] = msg
-	log.WithFields(c.LogTags).Debugf("Recorded %s", msgToString(msg))
+	// Apply any ACK which arrived ahead of the message
+	c.expirePendingACKs(&c.shards[shard], c.clock.Now())
+	key := pendingACKKey{stream: meta.Stream, consumer: c.consumer, sequence: meta.Sequence.Stream}
+	if pending, ok := c.shards[shard].pendingACKs[key]; ok {
+		delete(c.shards[shard].pendingACKs, key)
+		if c.clock.Now().Before(pending.expire) {
+			ack := pending.ack
+			ack.SeqNum.Consumer = meta.Sequence.Consumer
+			common.ThrottledDebugf(log.WithFields(c.LogTags), "Applying buffered %s", ack.String())
+			return c.ackInflightMessage(ack, perConsumerRecords)
+		}
+	}
 	return nil
 }
 
@@ -204,103 +389,415 @@ func (c *jetStreamInflightMsgProcessorImpl) ProcessInflightMessage(msg *nats.Msg
 
 type jsInflightCtrlRecordACK struct {
 	timestamp time.Time
-	blocking  bool
 	ack       AckIndication
-	resultCB  func(err error)
+	// persistenceChecked whether the persisted records were already consulted for the ACK
+	persistenceChecked bool
+	// result optionally receives the outcome of the ACK once it is resolved
+	result chan error
 }
 
 // HandlerMsgACK processes a new message ACK
 func (c *jetStreamInflightMsgProcessorImpl) HandlerMsgACK(
 	ack AckIndication, blocking bool, callCtxt context.Context,
 ) error {
-	resultChan := make(chan error)
-	handler := func(err error) {
-		resultChan <- err
-	}
+	request := jsInflightCtrlRecordACK{timestamp: c.clock.Now(), ack: ack}
 
-	request := jsInflightCtrlRecordACK{
-		timestamp: time.Now(),
-		blocking:  blocking,
-		ack:       ack,
-		resultCB:  handler,
-	}
-
-	if err := c.tp.Submit(request, callCtxt); err != nil {
-		log.WithError(err).WithFields(c.LogTags).Errorf("Failed to submit %s", ack.String())
-		return err
-	}
+	shard := c.shardIndex(ack.SeqNum.Stream)
 
 	// Don't wait for a response
 	if !blocking {
+		if err := c.shards[shard].acks.Submit(request, callCtxt); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf("Failed to submit %s", ack.String())
+			return err
+		}
 		return nil
 	}
 
+	// The ACK may be resolved outside of the task processor, so wait for the result instead
+	request.result = make(chan error, 1)
+	if err := c.shards[shard].acks.Submit(request, callCtxt); err != nil {
+		log.WithError(err).WithFields(c.LogTags).Errorf("Failed to submit %s", ack.String())
+		return err
+	}
 	var err error
-	// Wait for the response or timeout
 	select {
-	case result, ok := <-resultChan:
-		if !ok {
-			err = fmt.Errorf("response to msg ACK is invalid")
-		} else {
-			err = result
-		}
+	case err = <-request.result:
 	case <-callCtxt.Done():
 		err = callCtxt.Err()
 	}
-
 	if err != nil {
 		log.WithError(err).WithFields(c.LogTags).Errorf("Processing %s failed", ack.String())
 	}
 	return err
 }
 
+// HandlerMsgACKs processes a batch of message ACKs, without waiting for the results. The
+// ACKs are submitted to each shard as one batch.
+func (c *jetStreamInflightMsgProcessorImpl) HandlerMsgACKs(
+	acks []AckIndication, callCtxt context.Context,
+) error {
+	now := c.clock.Now()
+	perShard := make([][]jsInflightCtrlRecordACK, len(c.shards))
+	for _, ack := range acks {
+		shard := c.shardIndex(ack.SeqNum.Stream)
+		perShard[shard] = append(perShard[shard], jsInflightCtrlRecordACK{timestamp: now, ack: ack})
+	}
+	for shard, requests := range perShard {
+		if len(requests) == 0 {
+			continue
+		}
+		if err := c.shards[shard].acks.SubmitBatch(requests, true, callCtxt); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf(
+				"Failed to submit batch of %d ACKs", len(requests),
+			)
+			return err
+		}
+	}
+	return nil
+}
+
 // processMsgACK support TaskProcessor, handle jsInflightCtrlRecordACK
-func (c *jetStreamInflightMsgProcessorImpl) processMsgACK(param interface{}) error {
-	request, ok := param.(jsInflightCtrlRecordACK)
-	if !ok {
-		return fmt.Errorf(
-			"can not process unknown type %s for handle new ACK message",
-			reflect.TypeOf(param),
-		)
+func (c *jetStreamInflightMsgProcessorImpl) processMsgACK(request jsInflightCtrlRecordACK) error {
+	if c.persistence != nil && !request.persistenceChecked && !c.holdsMessage(request.ack) {
+		// The message may have been delivered by an earlier instance
+		if c.ackPersistedMessage(request) {
+			return nil
+		}
 	}
 	err := c.ProcessMsgACK(request.ack)
-	if request.blocking {
-		request.resultCB(err)
+	if request.result != nil {
+		request.result <- err
 	}
 	return err
 }
 
-// ProcessMsgACK processes a new message ACK
+// holdsMessage helper function to check whether the ACKed message is recorded
+func (c *jetStreamInflightMsgProcessorImpl) holdsMessage(ack AckIndication) bool {
+	perStreamRecords := c.getStreamRecords(ack.Stream, false)
+	if perStreamRecords == nil {
+		return false
+	}
+	perConsumerRecords := perStreamRecords.getConsumerRecords(ack.Consumer, 0, false)
+	if perConsumerRecords == nil {
+		return false
+	}
+	_, ok := perConsumerRecords.shards[c.shardIndex(ack.SeqNum.Stream)][ack.SeqNum.Stream]
+	return ok
+}
+
+// ackPersistedMessage apply an ACK using the persisted records in the background, as that
+// involves blocking I/O. If no record is found, the ACK is submitted to the task processor
+// again. Returns false if too many ACKs are already being applied this way.
+func (c *jetStreamInflightMsgProcessorImpl) ackPersistedMessage(
+	request jsInflightCtrlRecordACK,
+) bool {
+	select {
+	case c.persistedLookups <- struct{}{}:
+	default:
+		common.ThrottledDebugf(
+			log.WithFields(c.LogTags), "Too many persisted record lookups, skipping for %s",
+			request.ack.String(),
+		)
+		return false
+	}
+	go func() {
+		defer func() { <-c.persistedLookups }()
+		ack := request.ack
+		found, err := c.persistence.ACKPersistedMessage(ack, c.optContext)
+		if found {
+			if err == nil && ack.Kind() != AckTypeProgress {
+				hooks.OnAck(ackHookEvent(ack), c.optContext)
+			}
+			if request.result != nil {
+				request.result <- err
+			}
+			return
+		}
+		// Resolve the ACK against the records held by this instance
+		request.persistenceChecked = true
+		if err := c.shards[c.shardIndex(ack.SeqNum.Stream)].acks.Submit(
+			request, c.optContext,
+		); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf("Failed to submit %s", ack.String())
+			if request.result != nil {
+				request.result <- err
+			}
+		}
+	}()
+	return true
+}
+
+// ProcessMsgACK processes a new message ACK, without consulting the persisted records. This
+// must be called from the task processor of the ACKed message's shard.
 func (c *jetStreamInflightMsgProcessorImpl) ProcessMsgACK(ack AckIndication) error {
+	var perConsumerRecords *perConsumerInflightMessages
+	ok := false
 	// Fetch the per stream records
-	perStreamRecords, ok := c.inflightPerStream[ack.Stream]
+	perStreamRecords := c.getStreamRecords(ack.Stream, false)
+	if perStreamRecords != nil {
+		// Fetch the per consumer records
+		perConsumerRecords = perStreamRecords.getConsumerRecords(ack.Consumer, 0, false)
+	}
+	if perConsumerRecords != nil {
+		_, ok = perConsumerRecords.shards[c.shardIndex(ack.SeqNum.Stream)][ack.SeqNum.Stream]
+	}
 	if !ok {
-		err := fmt.Errorf("no records related to stream %s", ack.Stream)
+		if c.pendingACKTTL > 0 && ack.Consumer == c.consumer {
+			c.bufferACK(ack)
+			return nil
+		}
+		var err error
+		if perStreamRecords == nil {
+			err = fmt.Errorf("no records related to stream %s", ack.Stream)
+		} else if perConsumerRecords == nil {
+			err = fmt.Errorf("no records related to consumer %s on stream %s", ack.Consumer, ack.Stream)
+		} else {
+			err = fmt.Errorf(
+				"no records related message [%d] for %s@%s", ack.SeqNum.Stream, ack.Consumer, ack.Stream,
+			)
+		}
 		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to process %s", ack.String())
 		return err
 	}
-	// Fetch the per consumer records
-	perConsumerRecords, ok := perStreamRecords.consumers[ack.Consumer]
-	if !ok {
-		err := fmt.Errorf("no records related to consumer %s on stream %s", ack.Consumer, ack.Stream)
+	return c.ackInflightMessage(ack, perConsumerRecords)
+}
+
+// ackInflightMessage ACK a recorded message, and stop tracking it. A progress ACK keeps
+// the message tracked, restarting its ACK deadline.
+func (c *jetStreamInflightMsgProcessorImpl) ackInflightMessage(
+	ack AckIndication, perConsumerRecords *perConsumerInflightMessages,
+) error {
+	inflight := perConsumerRecords.shards[c.shardIndex(ack.SeqNum.Stream)]
+	record := inflight[ack.SeqNum.Stream]
+	msg := record.msg
+	if err := ackMessage(msg, ack.Kind()); err != nil {
 		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to process %s", ack.String())
 		return err
 	}
+	ack = ack.withReplyFields(msg.Reply)
+	if ack.Kind() == AckTypeProgress {
+		record.recorded = c.clock.Now()
+		inflight[ack.SeqNum.Stream] = record
+		common.ThrottledDebugf(log.WithFields(c.LogTags), "Extended based on %s", ack.String())
+		return nil
+	}
+	delete(inflight, ack.SeqNum.Stream)
+	common.ThrottledDebugf(log.WithFields(c.LogTags), "Cleaned up based on %s", ack.String())
+	hooks.OnAck(ackHookEvent(ack), c.optContext)
+	if c.latency != nil {
+		if meta, err := msg.Metadata(); err == nil {
+			c.latency.RecordACK(ack.Stream, ack.Consumer, meta.Timestamp)
+		}
+	}
+	if c.persistence != nil {
+		if err := c.persistence.ClearMessage(
+			ack.Stream, ack.Consumer, ack.SeqNum.Stream, c.optContext,
+		); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf("Unable to clear record of %s", ack.String())
+		}
+	}
+	return nil
+}
 
-	// ACK the stored message
-	msg, ok := perConsumerRecords.inflight[ack.SeqNum.Stream]
-	if !ok {
-		err := fmt.Errorf(
-			"no records related message [%d] for %s@%s", ack.SeqNum.Stream, ack.Consumer, ack.Stream,
+// ackHookEvent helper function to describe an ACK for the plugin OnAck hooks
+func ackHookEvent(ack AckIndication) hooks.AckEvent {
+	return hooks.AckEvent{
+		Stream:      ack.Stream,
+		Consumer:    ack.Consumer,
+		StreamSeq:   ack.SeqNum.Stream,
+		ConsumerSeq: ack.SeqNum.Consumer,
+		Type:        string(ack.Kind()),
+		Domain:      ack.Domain,
+	}
+}
+
+// bufferACK hold an ACK for a message not yet recorded, and drop buffered ACKs of the same
+// shard which have expired
+//
+// Sessions of a delivery group receive the ACKs of messages delivered by their peers too,
+// which are buffered until they expire; so expiry is expected, and only logged at debug.
+func (c *jetStreamInflightMsgProcessorImpl) bufferACK(ack AckIndication) {
+	now := c.clock.Now()
+	shard := &c.shards[c.shardIndex(ack.SeqNum.Stream)]
+	c.expirePendingACKs(shard, now)
+	key := pendingACKKey{stream: ack.Stream, consumer: ack.Consumer, sequence: ack.SeqNum.Stream}
+	if _, ok := shard.pendingACKs[key]; !ok {
+		for len(shard.pendingACKs) >= maxPendingACKsPerShard {
+			oldest := heap.Pop(&shard.pendingExpiry).(pendingACKDeadline)
+			if pending, ok := shard.pendingACKs[oldest.key]; ok && pending.expire.Equal(oldest.expire) {
+				delete(shard.pendingACKs, oldest.key)
+				common.ThrottledDebugf(
+					log.WithFields(c.LogTags), "Buffered ACKs full, dropped %s", pending.ack.String(),
+				)
+			}
+		}
+	}
+	expire := now.Add(c.pendingACKTTL)
+	shard.pendingACKs[key] = pendingACK{ack: ack, expire: expire}
+	heap.Push(&shard.pendingExpiry, pendingACKDeadline{key: key, expire: expire})
+	common.ThrottledDebugf(
+		log.WithFields(c.LogTags), "Buffered %s until message is recorded", ack.String(),
+	)
+}
+
+// expirePendingACKs drop the buffered ACKs of a shard which have expired
+func (c *jetStreamInflightMsgProcessorImpl) expirePendingACKs(shard *inflightShard, now time.Time) {
+	for shard.pendingExpiry.Len() > 0 && !now.Before(shard.pendingExpiry[0].expire) {
+		deadline := heap.Pop(&shard.pendingExpiry).(pendingACKDeadline)
+		pending, ok := shard.pendingACKs[deadline.key]
+		if !ok || !pending.expire.Equal(deadline.expire) {
+			continue
+		}
+		delete(shard.pendingACKs, deadline.key)
+		common.ThrottledDebugf(
+			log.WithFields(c.LogTags), "Dropping expired buffered %s", pending.ack.String(),
 		)
-		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to process %s", ack.String())
-		return err
 	}
-	if err := msg.AckSync(); err != nil {
-		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to process %s", ack.String())
-		return err
+}
+
+// =========================================================================
+
+type jsInflightCtrlNAKOverdue struct {
+	shard    int
+	deadline time.Duration
+	onNAK    func(msg *nats.Msg)
+}
+
+// NAKOverdueMessages NAK the inflight messages recorded more than deadline ago, so they
+// are redelivered without waiting for the consumer's AckWait. onNAK is called with each
+// message NAKed.
+func (c *jetStreamInflightMsgProcessorImpl) NAKOverdueMessages(
+	deadline time.Duration, onNAK func(msg *nats.Msg), callCtxt context.Context,
+) error {
+	for shard := range c.shards {
+		request := jsInflightCtrlNAKOverdue{shard: shard, deadline: deadline, onNAK: onNAK}
+		if err := c.shards[shard].overdueNAKs.Submit(request, callCtxt); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf("Failed to submit overdue NAK")
+			return err
+		}
 	}
-	delete(perConsumerRecords.inflight, ack.SeqNum.Stream)
-	log.WithFields(c.LogTags).Debugf("Cleaned up based on %s", ack.String())
 	return nil
 }
+
+// processNAKOverdue support TaskProcessor, handle jsInflightCtrlNAKOverdue
+func (c *jetStreamInflightMsgProcessorImpl) processNAKOverdue(
+	request jsInflightCtrlNAKOverdue,
+) error {
+	c.ProcessNAKOverdue(request.shard, request.deadline, request.onNAK)
+	return nil
+}
+
+// ProcessNAKOverdue NAK the messages of a shard recorded more than deadline ago, and stop
+// tracking them. This must be called from the task processor of the shard.
+func (c *jetStreamInflightMsgProcessorImpl) ProcessNAKOverdue(
+	shard int, deadline time.Duration, onNAK func(msg *nats.Msg),
+) {
+	cutoff := c.clock.Now().Add(-deadline)
+	c.inflightPerStream.Range(func(key, value interface{}) bool {
+		stream := key.(string)
+		perConsumerRecords := value.(*perStreamInflightMessages).getConsumerRecords(
+			c.consumer, 0, false,
+		)
+		if perConsumerRecords == nil {
+			return true
+		}
+		inflight := perConsumerRecords.shards[shard]
+		for seq, record := range inflight {
+			if record.recorded.After(cutoff) {
+				continue
+			}
+			msgName := NewMsgEnvelope(record.msg).String()
+			if err := record.msg.Nak(); err != nil {
+				log.WithError(err).WithFields(c.LogTags).Errorf("Unable to NAK overdue %s", msgName)
+				continue
+			}
+			delete(inflight, seq)
+			common.ThrottledDebugf(
+				log.WithFields(c.LogTags), "NAKed %s not ACKed within %s", msgName, deadline,
+			)
+			if c.persistence != nil {
+				if err := c.persistence.ClearMessage(
+					stream, c.consumer, seq, c.optContext,
+				); err != nil {
+					log.WithError(err).WithFields(c.LogTags).Errorf("Unable to clear record of %s", msgName)
+				}
+			}
+			if onNAK != nil {
+				onNAK(record.msg)
+			}
+		}
+		return true
+	})
+}
+
+// =========================================================================
+
+type jsInflightCtrlList struct {
+	shard int
+	// result is where the messages of the shard are listed
+	result *[]InflightMessage
+}
+
+// ListInflightMessages lists the messages currently awaiting ACK, oldest first
+func (c *jetStreamInflightMsgProcessorImpl) ListInflightMessages(
+	callCtxt context.Context,
+) ([]InflightMessage, error) {
+	perShard := make([][]InflightMessage, len(c.shards))
+	for shard := range c.shards {
+		request := jsInflightCtrlList{shard: shard, result: &perShard[shard]}
+		if err := c.shards[shard].listings.SubmitAndWait(request, callCtxt); err != nil {
+			log.WithError(err).WithFields(c.LogTags).Errorf("Failed to list inflight messages")
+			return nil, err
+		}
+	}
+	listed := []InflightMessage{}
+	for _, msgs := range perShard {
+		listed = append(listed, msgs...)
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		if !listed[i].Received.Equal(listed[j].Received) {
+			return listed[i].Received.Before(listed[j].Received)
+		}
+		return listed[i].StreamSeq < listed[j].StreamSeq
+	})
+	return listed, nil
+}
+
+// processListInflight support TaskProcessor, handle jsInflightCtrlList
+func (c *jetStreamInflightMsgProcessorImpl) processListInflight(request jsInflightCtrlList) error {
+	*request.result = c.ProcessListInflight(request.shard)
+	return nil
+}
+
+// ProcessListInflight lists the messages of a shard awaiting ACK. This must be called from
+// the task processor of the shard.
+func (c *jetStreamInflightMsgProcessorImpl) ProcessListInflight(shard int) []InflightMessage {
+	now := c.clock.Now()
+	listed := []InflightMessage{}
+	c.inflightPerStream.Range(func(key, value interface{}) bool {
+		perConsumerRecords := value.(*perStreamInflightMessages).getConsumerRecords(
+			c.consumer, 0, false,
+		)
+		if perConsumerRecords == nil {
+			return true
+		}
+		for seq, record := range perConsumerRecords.shards[shard] {
+			entry := InflightMessage{
+				Stream:    key.(string),
+				Consumer:  c.consumer,
+				Subject:   record.msg.Subject,
+				StreamSeq: seq,
+				Received:  record.recorded,
+				Age:       now.Sub(record.recorded),
+			}
+			if meta, err := record.msg.Metadata(); err == nil {
+				entry.ConsumerSeq = meta.Sequence.Consumer
+				entry.NumDelivered = meta.NumDelivered
+				entry.Published = meta.Timestamp
+			}
+			listed = append(listed, entry)
+		}
+		return true
+	})
+	return listed
+}
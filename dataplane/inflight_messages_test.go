@@ -24,6 +24,7 @@ import (
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
 	"github.com/alwitt/httpmq/management"
+	"github.com/alwitt/httpmq/metrics"
 	"github.com/apex/log"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
@@ -119,7 +120,13 @@ func TestInflightMessageHandling(t *testing.T) {
 	}
 	log.Debug("============================= 1 =============================")
 
-	uut, err := getJetStreamInflightMsgProcessor(tp, stream1, subjects1, consumer1, utCtxt)
+	latency, err := metrics.GetConsumerLatencyTracker(
+		metrics.ConsumerLatencyParam{Window: time.Minute, MinSamples: 1}, nil, testName,
+	)
+	assert.Nil(err)
+	uut, err := getJetStreamInflightMsgProcessor(
+		[]common.TaskProcessor{tp}, stream1, subjects1, consumer1, 0, nil, latency, utCtxt,
+	)
 	assert.Nil(err)
 
 	// Start the task processor
@@ -176,6 +183,12 @@ func TestInflightMessageHandling(t *testing.T) {
 				}, true, ctxt,
 			),
 		)
+		// The ACK latency is recorded
+		reports := latency.Reports()
+		assert.Len(reports, 1)
+		assert.Equal(stream1, reports[0].Stream)
+		assert.Equal(consumer1, reports[0].Consumer)
+		assert.Equal(uint64(1), reports[0].Samples)
 	}
 	log.Debug("============================= 4 =============================")
 
@@ -249,3 +262,528 @@ func TestInflightMessageHandling(t *testing.T) {
 	}
 	log.Debug("============================= 8 =============================")
 }
+
+func TestInflightMessageEarlyACK(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-inflight-early-ack"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamInflightHandling",
+		"instance":  "early-ack",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	tp, err := common.GetNewTaskProcessorInstance(testName, 4, utCtxt)
+	assert.Nil(err)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream and consumer for testing
+	stream1 := uuid.New().String()
+	subjects1 := uuid.New().String()
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subjects1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	consumer1 := uuid.New().String()
+	var consumer1Sub1 *nats.Subscription
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: 2, Mode: "push",
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+		s, err := js.JetStream().SubscribeSync(subjects1, nats.Durable(consumer1))
+		assert.Nil(err)
+		consumer1Sub1 = s
+	}
+	log.Debug("============================= 1 =============================")
+
+	uut, err := getJetStreamInflightMsgProcessor(
+		[]common.TaskProcessor{tp}, stream1, subjects1, consumer1, time.Second*5, nil, nil, utCtxt,
+	)
+	assert.Nil(err)
+
+	// Start the task processor
+	assert.Nil(tp.StartEventLoop(&wg))
+
+	// Case 0: ACK for another consumer is not buffered
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		assert.NotNil(
+			uut.HandlerMsgACK(
+				AckIndication{
+					Stream:   stream1,
+					Consumer: uuid.New().String(),
+					SeqNum:   AckSeqNum{Stream: 1, Consumer: 1},
+				}, true, ctxt,
+			),
+		)
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 1: ACK arrives before the message is recorded
+	testMsg1 := []byte(fmt.Sprintf("Hello %s", uuid.New().String()))
+	{
+		ack, err := js.JetStream().Publish(subjects1, testMsg1)
+		assert.Nil(err)
+		assert.Equal(stream1, ack.Stream)
+	}
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		rxMsg, err := consumer1Sub1.NextMsgWithContext(ctxt)
+		assert.Nil(err)
+		assert.NotNil(rxMsg)
+		meta, err := rxMsg.Metadata()
+		assert.Nil(err)
+		assert.Nil(
+			uut.HandlerMsgACK(
+				AckIndication{
+					Stream:   stream1,
+					Consumer: consumer1,
+					SeqNum:   AckSeqNum{Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer},
+				}, true, ctxt,
+			),
+		)
+		// Recording the message applies the buffered ACK
+		assert.Nil(uut.RecordInflightMessage(rxMsg, true, ctxt))
+	}
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		info, err := jsCtrl.GetConsumerForStream(stream1, consumer1, ctxt)
+		assert.Nil(err)
+		assert.Equal(0, info.NumAckPending)
+	}
+	log.Debug("============================= 3 =============================")
+}
+
+func TestInflightMessageSharding(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.InfoLevel)
+	testName := "ut-js-inflight-sharding"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+	}
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	tps := make([]common.TaskProcessor, 4)
+	for itr := range tps {
+		tps[itr], err = common.GetNewTaskProcessorInstance(
+			fmt.Sprintf("%s.%d", testName, itr), 16, utCtxt,
+		)
+		assert.Nil(err)
+	}
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream and consumer for testing
+	stream1 := uuid.New().String()
+	subjects1 := uuid.New().String()
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subjects1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+	consumer1 := uuid.New().String()
+	var consumer1Sub1 *nats.Subscription
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: 200, Mode: "push",
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+		s, err := js.JetStream().SubscribeSync(subjects1, nats.Durable(consumer1))
+		assert.Nil(err)
+		consumer1Sub1 = s
+	}
+
+	// Case 0: at least one task processor is needed
+	{
+		_, err := getJetStreamInflightMsgProcessor(
+			nil, stream1, subjects1, consumer1, 0, nil, nil, utCtxt,
+		)
+		assert.NotNil(err)
+	}
+
+	uut, err := getJetStreamInflightMsgProcessor(
+		tps, stream1, subjects1, consumer1, 0, nil, nil, utCtxt,
+	)
+	assert.Nil(err)
+	for _, tp := range tps {
+		assert.Nil(tp.StartEventLoop(&wg))
+	}
+
+	// Case 1: sequence ranges map to shards in turn
+	{
+		impl, ok := uut.(*jetStreamInflightMsgProcessorImpl)
+		assert.True(ok)
+		assert.Equal(0, impl.shardIndex(0))
+		assert.Equal(0, impl.shardIndex(inflightShardSeqRange-1))
+		assert.Equal(1, impl.shardIndex(inflightShardSeqRange))
+		assert.Equal(3, impl.shardIndex(inflightShardSeqRange*4-1))
+		assert.Equal(0, impl.shardIndex(inflightShardSeqRange*4))
+	}
+
+	// Case 2: record and ACK messages spanning all shards concurrently
+	msgCount := inflightShardSeqRange * 6
+	for itr := 0; itr < msgCount; itr++ {
+		_, err := js.JetStream().Publish(subjects1, []byte(fmt.Sprintf("Hello %d", itr)))
+		assert.Nil(err)
+	}
+	received := make([]*nats.Msg, msgCount)
+	for itr := range received {
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		rxMsg, err := consumer1Sub1.NextMsgWithContext(ctxt)
+		cancel()
+		assert.Nil(err)
+		received[itr] = rxMsg
+	}
+	{
+		testWG := sync.WaitGroup{}
+		errs := make(chan error, msgCount*2)
+		for _, rxMsg := range received {
+			testWG.Add(1)
+			go func(rxMsg *nats.Msg) {
+				defer testWG.Done()
+				ctxt, cancel := context.WithTimeout(utCtxt, time.Second*5)
+				defer cancel()
+				meta, err := rxMsg.Metadata()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if err := uut.RecordInflightMessage(rxMsg, true, ctxt); err != nil {
+					errs <- err
+					return
+				}
+				errs <- uut.HandlerMsgACK(AckIndication{
+					Stream:   stream1,
+					Consumer: consumer1,
+					SeqNum:   AckSeqNum{Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer},
+				}, true, ctxt)
+			}(rxMsg)
+		}
+		testWG.Wait()
+		close(errs)
+		for err := range errs {
+			assert.Nil(err)
+		}
+	}
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		info, err := jsCtrl.GetConsumerForStream(stream1, consumer1, ctxt)
+		assert.Nil(err)
+		assert.Equal(0, info.NumAckPending)
+	}
+}
+
+func TestInflightMessageAckDeadline(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.InfoLevel)
+	testName := "ut-js-inflight-ack-deadline"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+	}
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	tp, err := common.GetNewTaskProcessorInstance(testName, 4, utCtxt)
+	assert.Nil(err)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream and consumer for testing
+	stream1 := uuid.New().String()
+	subjects1 := uuid.New().String()
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subjects1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+	consumer1 := uuid.New().String()
+	var consumer1Sub1 *nats.Subscription
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: 2, Mode: "push",
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+		s, err := js.JetStream().SubscribeSync(subjects1, nats.Durable(consumer1))
+		assert.Nil(err)
+		consumer1Sub1 = s
+	}
+
+	uut, err := getJetStreamInflightMsgProcessor(
+		[]common.TaskProcessor{tp}, stream1, subjects1, consumer1, 0, nil, nil, utCtxt,
+	)
+	assert.Nil(err)
+	clock := common.GetFakeClock(time.Now())
+	uut.(*jetStreamInflightMsgProcessorImpl).clock = clock
+	assert.Nil(tp.StartEventLoop(&wg))
+
+	nakedMsgs := make(chan *nats.Msg, 4)
+	onNAK := func(msg *nats.Msg) {
+		nakedMsgs <- msg
+	}
+
+	_, err = js.JetStream().Publish(subjects1, []byte(fmt.Sprintf("Hello %s", uuid.New().String())))
+	assert.Nil(err)
+	var meta *nats.MsgMetadata
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		rxMsg, err := consumer1Sub1.NextMsgWithContext(ctxt)
+		assert.Nil(err)
+		meta, err = rxMsg.Metadata()
+		assert.Nil(err)
+		assert.Nil(uut.RecordInflightMessage(rxMsg, true, ctxt))
+	}
+
+	// Case 1: message within the deadline is not NAKed
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		clock.Advance(time.Minute)
+		assert.Nil(uut.NAKOverdueMessages(time.Hour, onNAK, ctxt))
+		select {
+		case <-nakedMsgs:
+			assert.False(true, "message NAKed before its deadline")
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	// Case 2: message past the deadline is NAKed, and redelivered
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		clock.Advance(time.Hour)
+		assert.Nil(uut.NAKOverdueMessages(time.Hour, onNAK, ctxt))
+		select {
+		case msg := <-nakedMsgs:
+			nakedMeta, err := msg.Metadata()
+			assert.Nil(err)
+			assert.Equal(meta.Sequence.Stream, nakedMeta.Sequence.Stream)
+		case <-ctxt.Done():
+			assert.False(true, "overdue message not NAKed")
+		}
+		rxMsg, err := consumer1Sub1.NextMsgWithContext(ctxt)
+		assert.Nil(err)
+		rxMeta, err := rxMsg.Metadata()
+		assert.Nil(err)
+		assert.Equal(meta.Sequence.Stream, rxMeta.Sequence.Stream)
+		assert.Equal(uint64(2), rxMeta.NumDelivered)
+	}
+
+	// Case 3: the NAKed message is no longer tracked
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		assert.NotNil(uut.HandlerMsgACK(AckIndication{
+			Stream:   stream1,
+			Consumer: consumer1,
+			SeqNum:   AckSeqNum{Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer},
+		}, true, ctxt))
+	}
+}
+
+func TestInflightMessageBufferedACKExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	tp, err := common.GetNewTaskProcessorInstance("testing", 4, utCtxt)
+	assert.Nil(err)
+	uut, err := getJetStreamInflightMsgProcessor(
+		[]common.TaskProcessor{tp}, "stream", "subject", "consumer", time.Minute, nil, nil, utCtxt,
+	)
+	assert.Nil(err)
+	clock := common.GetFakeClock(time.Unix(1000, 0))
+	uutCast := uut.(*jetStreamInflightMsgProcessorImpl)
+	uutCast.clock = clock
+
+	// Message without a connection, so applying an ACK to it fails
+	msg := benchDeliveryMsg("stream", "consumer", []byte("hello"), nil)
+	ack := AckIndication{
+		Stream: "stream", Consumer: "consumer", SeqNum: AckSeqNum{Stream: 27, Consumer: 14},
+	}
+
+	// Case 1: ACK buffered within the TTL is applied once the message is recorded
+	{
+		assert.Nil(uutCast.ProcessMsgACK(ack))
+		clock.Advance(time.Second * 59)
+		assert.NotNil(uutCast.ProcessInflightMessage(msg))
+	}
+
+	// Case 2: ACK buffered past the TTL is dropped, the message stays inflight
+	{
+		ack.SeqNum = AckSeqNum{Stream: 28, Consumer: 15}
+		msg.Reply = "$JS.ACK.stream.consumer.1.28.15.1634000000000000000.3"
+		assert.Nil(uutCast.ProcessMsgACK(ack))
+		clock.Advance(time.Minute)
+		assert.Nil(uutCast.ProcessInflightMessage(msg))
+		records := uutCast.getStreamRecords("stream", false).getConsumerRecords("consumer", 0, false)
+		assert.Contains(records.shards[uutCast.shardIndex(28)], uint64(28))
+	}
+
+	// Case 3: once the buffer is full, the ACK buffered the longest is dropped
+	{
+		for seq := uint64(1000); seq < 1000+maxPendingACKsPerShard+1; seq++ {
+			ack.SeqNum = AckSeqNum{Stream: seq, Consumer: seq}
+			assert.Nil(uutCast.ProcessMsgACK(ack))
+			clock.Advance(time.Millisecond)
+		}
+		pendingACKs := uutCast.shards[0].pendingACKs
+		assert.Len(pendingACKs, maxPendingACKsPerShard)
+		assert.NotContains(pendingACKs, pendingACKKey{"stream", "consumer", 1000})
+		assert.Contains(pendingACKs, pendingACKKey{"stream", "consumer", 1001})
+	}
+
+	// Case 4: expired ACKs are dropped as new ones are buffered
+	{
+		clock.Advance(time.Minute)
+		ack.SeqNum = AckSeqNum{Stream: 5000, Consumer: 5000}
+		assert.Nil(uutCast.ProcessMsgACK(ack))
+		assert.Len(uutCast.shards[0].pendingACKs, 1)
+		assert.Equal(1, uutCast.shards[0].pendingExpiry.Len())
+	}
+}
+
+func TestInflightMessageListing(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	tps := make([]common.TaskProcessor, 2)
+	for itr := range tps {
+		tp, err := common.GetNewTaskProcessorInstance(fmt.Sprintf("testing-%d", itr), 4, utCtxt)
+		assert.Nil(err)
+		tps[itr] = tp
+	}
+	uut, err := getJetStreamInflightMsgProcessor(
+		tps, "stream", "subject", "consumer", 0, nil, nil, utCtxt,
+	)
+	assert.Nil(err)
+	clock := common.GetFakeClock(time.Unix(1000, 0))
+	uut.(*jetStreamInflightMsgProcessorImpl).clock = clock
+	for _, tp := range tps {
+		assert.Nil(tp.StartEventLoop(&wg))
+	}
+
+	// Case 0: nothing inflight
+	{
+		listed, err := uut.ListInflightMessages(utCtxt)
+		assert.Nil(err)
+		assert.Empty(listed)
+	}
+
+	// Case 1: messages of different shards are listed oldest first, with their age
+	{
+		later := benchDeliveryMsg("stream", "consumer", []byte("later"), nil)
+		later.Reply = "$JS.ACK.stream.consumer.2.5.15.1634000000000000000.1"
+		earlier := benchDeliveryMsg("stream", "consumer", []byte("earlier"), nil)
+		assert.Nil(uut.RecordInflightMessage(earlier, true, utCtxt))
+		clock.Advance(time.Second * 10)
+		assert.Nil(uut.RecordInflightMessage(later, true, utCtxt))
+		clock.Advance(time.Second * 5)
+
+		listed, err := uut.ListInflightMessages(utCtxt)
+		assert.Nil(err)
+		assert.Len(listed, 2)
+		assert.Equal(uint64(27), listed[0].StreamSeq)
+		assert.Equal(uint64(14), listed[0].ConsumerSeq)
+		assert.Equal(uint64(1), listed[0].NumDelivered)
+		assert.Equal(time.Second*15, listed[0].Age)
+		assert.Equal(time.Unix(1000, 0), listed[0].Received)
+		assert.Equal(uint64(5), listed[1].StreamSeq)
+		assert.Equal(uint64(2), listed[1].NumDelivered)
+		assert.Equal(time.Second*5, listed[1].Age)
+		assert.Equal("stream", listed[1].Stream)
+		assert.Equal("consumer", listed[1].Consumer)
+		assert.Equal("test-subject", listed[1].Subject)
+	}
+}
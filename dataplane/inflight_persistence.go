@@ -0,0 +1,203 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/storage"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// InflightMsgRecord the persisted record of a message inflight awaiting ACK
+type InflightMsgRecord struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Sequence is the sequence numbers of the message
+	Sequence MsgToDeliverSeq `json:"sequence"`
+	// Reply is the JetStream reply subject used to ACK the message
+	Reply string `json:"reply"`
+	// Run identifies the inflight message processor which delivered the message
+	Run string `json:"run,omitempty"`
+}
+
+// InflightMsgPersistence persists records of inflight messages, so messages delivered by one
+// gateway instance can still be ACKed after that instance restarts.
+type InflightMsgPersistence interface {
+	// RecordMessage persists the record of a new inflight message delivered by run. The run
+	// is live until ctxt ends.
+	RecordMessage(msg *nats.Msg, run string, ctxt context.Context) error
+	// ClearMessage removes the record of a message once it is ACKed
+	ClearMessage(stream, consumer string, sequence uint64, ctxt context.Context) error
+	// ACKPersistedMessage ACK a message using its persisted record. Returns false if no record
+	// for the message exists, or if the message was delivered by a run still live on this
+	// instance, as that run will process the ACK itself.
+	//
+	// This involves blocking I/O, so it must not be called from a task processor.
+	ACKPersistedMessage(ack AckIndication, ctxt context.Context) (bool, error)
+}
+
+// kvInflightPersistence implements InflightMsgPersistence with a KeyValueStore
+type kvInflightPersistence struct {
+	common.Component
+	nats       *core.NatsClient
+	store      storage.KeyValueStore
+	ackTimeout time.Duration
+	// liveRuns the runs on this instance which are still live
+	liveRuns sync.Map
+}
+
+// GetInflightPersistence define InflightMsgPersistence which persists records in a
+// KeyValueStore
+func GetInflightPersistence(
+	natsClient *core.NatsClient, store storage.KeyValueStore, instance string,
+) (InflightMsgPersistence, error) {
+	logTags := log.Fields{
+		"module":    "dataplane",
+		"component": "js-inflight-persistence",
+		"instance":  instance,
+	}
+	return &kvInflightPersistence{
+		Component:  common.Component{LogTags: logTags},
+		nats:       natsClient,
+		store:      store,
+		ackTimeout: time.Second * 5,
+	}, nil
+}
+
+// inflightRecordKey helper function for the KV key of an inflight message record
+func inflightRecordKey(stream, consumer string, sequence uint64) string {
+	return fmt.Sprintf("%s.%s.%d", stream, consumer, sequence)
+}
+
+// RecordMessage persists the record of a new inflight message delivered by run. The run
+// is live until ctxt ends.
+func (p *kvInflightPersistence) RecordMessage(
+	msg *nats.Msg, run string, ctxt context.Context,
+) error {
+	localLogTags, err := common.UpdateLogTags(p.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(p.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	meta, err := msg.Metadata()
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to persist %s", NewMsgEnvelope(msg).String())
+		return err
+	}
+	record := InflightMsgRecord{
+		Stream:   meta.Stream,
+		Consumer: meta.Consumer,
+		Sequence: MsgToDeliverSeq{Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer},
+		Reply:    msg.Reply,
+		Run:      run,
+	}
+	payload, err := json.Marshal(&record)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to persist %s", NewMsgEnvelope(msg).String())
+		return err
+	}
+	key := inflightRecordKey(meta.Stream, meta.Consumer, meta.Sequence.Stream)
+	if err := p.store.Put(key, payload, ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to persist %s", NewMsgEnvelope(msg).String())
+		return err
+	}
+	if _, loaded := p.liveRuns.LoadOrStore(run, true); !loaded {
+		go func() {
+			<-ctxt.Done()
+			p.liveRuns.Delete(run)
+		}()
+	}
+	common.ThrottledDebugf(log.WithFields(localLogTags), "Persisted %s", NewMsgEnvelope(msg).String())
+	return nil
+}
+
+// ClearMessage removes the record of a message once it is ACKed
+func (p *kvInflightPersistence) ClearMessage(
+	stream, consumer string, sequence uint64, ctxt context.Context,
+) error {
+	localLogTags, err := common.UpdateLogTags(p.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(p.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	if err := p.store.Delete(inflightRecordKey(stream, consumer, sequence), ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to clear record of [%d] for %s@%s", sequence, consumer, stream,
+		)
+		return err
+	}
+	return nil
+}
+
+// ACKPersistedMessage ACK a message using its persisted record. Returns false if no record
+// for the message exists, or if the message was delivered by a run still live on this
+// instance.
+func (p *kvInflightPersistence) ACKPersistedMessage(
+	ack AckIndication, ctxt context.Context,
+) (bool, error) {
+	localLogTags, err := common.UpdateLogTags(p.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(p.LogTags).Errorf("Failed to update logtags")
+		return false, err
+	}
+	key := inflightRecordKey(ack.Stream, ack.Consumer, ack.SeqNum.Stream)
+	value, err := p.store.Get(key, ctxt)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return false, nil
+	} else if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to read record for %s", ack.String())
+		return false, err
+	}
+	var record InflightMsgRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to parse record for %s", ack.String())
+		return false, err
+	}
+	if _, live := p.liveRuns.Load(record.Run); live {
+		// The ACK is also received by the run holding the message, most likely a delivery group
+		// peer of the caller.
+		return false, nil
+	}
+	// Same as nats.Msg.AckSync, but without the original subscription
+	if _, err := p.nats.NATs().Request(
+		record.Reply, ack.Kind().replyPayload(), p.ackTimeout,
+	); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to process %s", ack.String())
+		return true, err
+	}
+	if ack.Kind() == AckTypeProgress {
+		// The message remains inflight
+		return true, nil
+	}
+	if err := p.store.Delete(key, ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to clear record for %s", ack.String())
+		return true, err
+	}
+	common.ThrottledDebugf(
+		log.WithFields(localLogTags), "Processed %s with persisted record", ack.String(),
+	)
+	return true, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/management"
+	"github.com/alwitt/httpmq/storage"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflightMessagePersistence(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-inflight-persistence"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamInflightPersistence",
+		"instance":  "basic",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	store, err := storage.GetJetStreamKeyValueStore(js, uuid.New().String(), time.Minute)
+	assert.Nil(err)
+	persistence, err := GetInflightPersistence(js, store, testName)
+	assert.Nil(err)
+
+	// Define stream and consumer for testing
+	stream1 := uuid.New().String()
+	subjects1 := uuid.New().String()
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subjects1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	consumer1 := uuid.New().String()
+	var consumer1Sub1 *nats.Subscription
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: 2, Mode: "push",
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+		s, err := js.JetStream().SubscribeSync(subjects1, nats.Durable(consumer1))
+		assert.Nil(err)
+		consumer1Sub1 = s
+	}
+	log.Debug("============================= 1 =============================")
+
+	// Case 0: ACK message with no persisted record
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		found, err := persistence.ACKPersistedMessage(
+			AckIndication{
+				Stream:   stream1,
+				Consumer: consumer1,
+				SeqNum:   AckSeqNum{Stream: 12, Consumer: 2},
+			}, ctxt,
+		)
+		assert.Nil(err)
+		assert.False(found)
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 1: record an inflight message with the first instance
+	testMsg1 := []byte(fmt.Sprintf("Hello %s", uuid.New().String()))
+	var testMsg1Seq nats.SequencePair
+	{
+		ack, err := js.JetStream().Publish(subjects1, testMsg1)
+		assert.Nil(err)
+		assert.Equal(stream1, ack.Stream)
+	}
+	{
+		tp, err := common.GetNewTaskProcessorInstance(testName, 4, utCtxt)
+		assert.Nil(err)
+		uut, err := getJetStreamInflightMsgProcessor(
+			[]common.TaskProcessor{tp}, stream1, subjects1, consumer1, 0, persistence, nil, utCtxt,
+		)
+		assert.Nil(err)
+		assert.Nil(tp.StartEventLoop(&wg))
+
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		rxMsg, err := consumer1Sub1.NextMsgWithContext(ctxt)
+		assert.Nil(err)
+		assert.NotNil(rxMsg)
+		meta, err := rxMsg.Metadata()
+		assert.Nil(err)
+		testMsg1Seq = meta.Sequence
+		assert.Nil(uut.RecordInflightMessage(rxMsg, true, ctxt))
+		assert.Nil(tp.StopEventLoop())
+	}
+	log.Debug("============================= 3 =============================")
+
+	// Case 2: records of a run still live are not used to ACK
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		found, err := persistence.ACKPersistedMessage(
+			AckIndication{
+				Stream:   stream1,
+				Consumer: consumer1,
+				SeqNum:   AckSeqNum{Stream: testMsg1Seq.Stream, Consumer: testMsg1Seq.Consumer},
+			}, ctxt,
+		)
+		assert.Nil(err)
+		assert.False(found)
+	}
+	log.Debug("============================= 4 =============================")
+
+	// Case 3: ACK the message with a second instance
+	{
+		persistence2, err := GetInflightPersistence(js, store, testName)
+		assert.Nil(err)
+		tp, err := common.GetNewTaskProcessorInstance(testName, 4, utCtxt)
+		assert.Nil(err)
+		uut, err := getJetStreamInflightMsgProcessor(
+			[]common.TaskProcessor{tp}, stream1, subjects1, consumer1, 0, persistence2, nil, utCtxt,
+		)
+		assert.Nil(err)
+		assert.Nil(tp.StartEventLoop(&wg))
+
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		assert.Nil(
+			uut.HandlerMsgACK(
+				AckIndication{
+					Stream:   stream1,
+					Consumer: consumer1,
+					SeqNum:   AckSeqNum{Stream: testMsg1Seq.Stream, Consumer: testMsg1Seq.Consumer},
+				}, true, ctxt,
+			),
+		)
+		info, err := jsCtrl.GetConsumerForStream(stream1, consumer1, ctxt)
+		assert.Nil(err)
+		assert.Equal(0, info.NumAckPending)
+
+		// ACK again, the persisted record is gone
+		assert.NotNil(
+			uut.HandlerMsgACK(
+				AckIndication{
+					Stream:   stream1,
+					Consumer: consumer1,
+					SeqNum:   AckSeqNum{Stream: testMsg1Seq.Stream, Consumer: testMsg1Seq.Consumer},
+				}, true, ctxt,
+			),
+		)
+		assert.Nil(tp.StopEventLoop())
+	}
+	log.Debug("============================= 5 =============================")
+}
@@ -16,11 +16,16 @@ package dataplane
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/hooks"
 	"github.com/apex/log"
 	"github.com/nats-io/nats.go"
 )
@@ -89,6 +94,58 @@ func getJetStreamPushSubscriber(
 	}, nil
 }
 
+// ephemeralAckWait is the AckWait of the ephemeral consumers of subscriptions
+const ephemeralAckWait = time.Second * 30
+
+// getJetStreamEphemeralPushSubscriber define new JetStreamPushSubscriber which reads through
+// an ephemeral consumer. Returns the subscriber, and the name JetStream gave the consumer.
+//
+// The consumer is deleted once the subscriber stops reading.
+func getJetStreamEphemeralPushSubscriber(
+	natsClient *core.NatsClient, stream, subject string, deliverNew bool, maxInflightMsgs int,
+) (JetStreamPushSubscriber, string, error) {
+	logTags := log.Fields{
+		"module":    "dataplane",
+		"component": "js-push-reader",
+		"stream":    stream,
+		"subject":   subject,
+	}
+	deliverPolicy := nats.DeliverAll()
+	if deliverNew {
+		deliverPolicy = nats.DeliverNew()
+	}
+	s, err := natsClient.JetStream().SubscribeSync(
+		subject,
+		nats.BindStream(stream),
+		nats.Description(common.TagGatewayConsumer("httpmq ephemeral subscription")),
+		nats.AckExplicit(),
+		nats.AckWait(ephemeralAckWait),
+		nats.MaxAckPending(maxInflightMsgs),
+		deliverPolicy,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to define ephemeral subscription")
+		return nil, "", err
+	}
+	info, err := s.ConsumerInfo()
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to read ephemeral consumer info")
+		if err := s.Unsubscribe(); err != nil {
+			log.WithError(err).WithFields(logTags).Error("Unsubscribe failed")
+		}
+		return nil, "", err
+	}
+	logTags["consumer"] = info.Name
+	return &jetStreamPushSubscriberImpl{
+		Component:  common.Component{LogTags: logTags},
+		nats:       natsClient,
+		sub:        s,
+		forwardMsg: nil,
+		errorCB:    nil,
+		lock:       &sync.Mutex{},
+	}, info.Name, nil
+}
+
 // StartReading begin reading data from JetStream
 func (r *jetStreamPushSubscriberImpl) StartReading(
 	forwardCB ForwardMessageHandlerCB,
@@ -141,7 +198,7 @@ func (r *jetStreamPushSubscriberImpl) StartReading(
 			}
 			// Forward the message
 			if newMsg != nil {
-				log.WithFields(localLogTags).Debugf("Received %s", msgToString(newMsg))
+				common.ThrottledDebugf(log.WithFields(localLogTags), "Received %s", NewMsgEnvelope(newMsg).String())
 				if err := r.forwardMsg(newMsg, ctxt); err != nil {
 					log.WithError(err).WithFields(localLogTags).Errorf("Unable to forward messages")
 					r.errorCB(err)
@@ -154,10 +211,113 @@ func (r *jetStreamPushSubscriberImpl) StartReading(
 
 // ==============================================================================
 
+// IsNoStreamError checks whether a publish failed because no stream matches the subject
+func IsNoStreamError(err error) bool {
+	return errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrNoStreamResponse) ||
+		errors.Is(err, ErrNoStreamForSubject)
+}
+
+// IsPublishBackpressureError checks whether a publish failed because too many publishes are
+// already awaiting JetStream ACK
+func IsPublishBackpressureError(err error) bool {
+	// The NATS client does not define a sentinel error for this
+	return err != nil && strings.Contains(err.Error(), "too many outstanding async published messages")
+}
+
+// PublishResult is the outcome of publishing a message to one subject
+type PublishResult struct {
+	// Subject is the subject the message was published to
+	Subject string
+	// Stream is the stream which stored the message
+	Stream string
+	// Sequence is the message sequence number within the stream
+	Sequence uint64
+	// Err is the error which occurred during publish, if any
+	Err error
+}
+
+// PublishAckPolicy selects whether a publish waits for JetStream to ACK the message
+type PublishAckPolicy string
+
+const (
+	// PublishAckWait waits for JetStream to ACK the message is stored by the stream. For a
+	// replicated stream, the ACK is sent once a quorum of replicas stored the message.
+	PublishAckWait PublishAckPolicy = "wait"
+	// PublishAckNone does not wait for an ACK. The publish completes once the message is
+	// sent to NATS, so failures such as no stream matching the subject are not reported.
+	PublishAckNone PublishAckPolicy = "none"
+)
+
+// PublishExpectations are the conditions JetStream checks before storing a published
+// message, for optimistic concurrency control. Conditions not set are not checked.
+type PublishExpectations struct {
+	// MsgID is the ID of the message, for later publishes to expect as the last message ID
+	MsgID string
+	// Stream is the stream expected to store the message
+	Stream string
+	// LastSequence is the expected sequence number of the last message in the stream
+	LastSequence *uint64
+	// LastMsgID is the expected ID of the last message in the stream
+	LastMsgID string
+}
+
+// Apply sets the expectation headers of a message
+func (e PublishExpectations) Apply(msg *nats.Msg) {
+	if e.MsgID != "" {
+		msg.Header.Set(nats.MsgIdHdr, e.MsgID)
+	}
+	if e.Stream != "" {
+		msg.Header.Set(nats.ExpectedStreamHdr, e.Stream)
+	}
+	// Set directly, as the client option can not expect an empty stream
+	if e.LastSequence != nil {
+		msg.Header.Set(nats.ExpectedLastSeqHdr, strconv.FormatUint(*e.LastSequence, 10))
+	}
+	if e.LastMsgID != "" {
+		msg.Header.Set(nats.ExpectedLastMsgIdHdr, e.LastMsgID)
+	}
+}
+
+// IsPublishExpectationError checks whether a publish failed because the stream did not
+// meet the publish expectations
+func IsPublishExpectationError(err error) bool {
+	// The NATS client only reports the JetStream error description
+	if err == nil {
+		return false
+	}
+	desc := err.Error()
+	return strings.Contains(desc, "wrong last sequence") ||
+		strings.Contains(desc, "wrong last msg ID") ||
+		strings.Contains(desc, "expected stream does not match")
+}
+
 // JetStreamPublisher publishes new messages into JetStream
 type JetStreamPublisher interface {
-	// Publish publishes a new message into JetStream on a subject
+	// Publish publishes a new message into JetStream on a subject, and waits for the ACK
 	Publish(subject string, msg []byte, ctxt context.Context) error
+	// PublishWithPolicy publishes a new message into JetStream on a subject, waiting for the
+	// ACK as selected by policy
+	PublishWithPolicy(
+		subject string, msg []byte, policy PublishAckPolicy, ctxt context.Context,
+	) error
+	// PublishToSubjects publishes the same message into JetStream on multiple subjects.
+	//
+	// The message is sent to all subjects before waiting for any of the ACKs, so one
+	// subject failing does not prevent delivery on the others.
+	PublishToSubjects(subjects []string, msg []byte, ctxt context.Context) []PublishResult
+	// PublishWithExpectations publishes a new message into JetStream on a subject, which is
+	// only stored if the stream meets the expectations. Waits for the ACK.
+	PublishWithExpectations(
+		subject string, msg []byte, expect PublishExpectations, ctxt context.Context,
+	) PublishResult
+	// PublishMsg publishes a new message, with its headers, into JetStream on the message's
+	// subject, and waits for the ACK
+	PublishMsg(msg *nats.Msg, ctxt context.Context) PublishResult
+	// PublishTransaction publishes a set of messages to their subjects, all or nothing on a
+	// best effort basis. If any message is not stored, tombstones are published for those
+	// which were.
+	PublishTransaction(msgs []TransactionMessage, ctxt context.Context) TransactionResult
 }
 
 // jetStreamPublisherImpl implements JetStreamPublisher
@@ -178,40 +338,197 @@ func GetJetStreamPublisher(
 	}, nil
 }
 
-// Publish publishes a new message into JetStream on a subject
+// Publish publishes a new message into JetStream on a subject, and waits for the ACK
 func (s *jetStreamPublisherImpl) Publish(subject string, msg []byte, ctxt context.Context) error {
+	return s.PublishWithPolicy(subject, msg, PublishAckWait, ctxt)
+}
+
+// PublishWithPolicy publishes a new message into JetStream on a subject, waiting for the
+// ACK as selected by policy
+func (s *jetStreamPublisherImpl) PublishWithPolicy(
+	subject string, msg []byte, policy PublishAckPolicy, ctxt context.Context,
+) error {
 	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
 	if err != nil {
 		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
 		return err
 	}
+	if msg, err = s.applyPublishHooks(subject, msg, localLogTags, ctxt); err != nil {
+		return err
+	}
+	switch policy {
+	case PublishAckWait:
+	case PublishAckNone:
+		// Without a reply subject, JetStream stores the message without sending an ACK
+		if err := s.nats.NATs().Publish(subject, msg); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unable to send message")
+			return err
+		}
+		common.ThrottledDebugf(
+			log.WithFields(localLogTags), "Sent to %s without waiting for ACK", subject,
+		)
+		return nil
+	default:
+		return fmt.Errorf("unknown publish ACK policy '%s'", policy)
+	}
 	ack, err := s.nats.JetStream().PublishAsync(subject, msg)
 	if err != nil {
 		log.WithError(err).WithFields(localLogTags).Errorf("Unable to send message")
 		return err
 	}
-	// Wait for success, failure, or timeout
+	_, err = s.waitForPubAck(subject, ack, localLogTags, ctxt)
+	return err
+}
+
+// PublishToSubjects publishes the same message into JetStream on multiple subjects.
+func (s *jetStreamPublisherImpl) PublishToSubjects(
+	subjects []string, msg []byte, ctxt context.Context,
+) []PublishResult {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		localLogTags = s.LogTags
+	}
+	results := make([]PublishResult, len(subjects))
+	acks := make([]nats.PubAckFuture, len(subjects))
+	// Send to all subjects first
+	for idx, subject := range subjects {
+		results[idx].Subject = subject
+		toSend, err := s.applyPublishHooks(subject, msg, localLogTags, ctxt)
+		if err != nil {
+			results[idx].Err = err
+			continue
+		}
+		ack, err := s.nats.JetStream().PublishAsync(subject, toSend)
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unable to send message to %s", subject)
+			results[idx].Err = err
+			continue
+		}
+		acks[idx] = ack
+	}
+	// Then collect the ACKs
+	for idx, ack := range acks {
+		if ack == nil {
+			continue
+		}
+		pubAck, err := s.waitForPubAck(subjects[idx], ack, localLogTags, ctxt)
+		if err != nil {
+			results[idx].Err = err
+			continue
+		}
+		results[idx].Stream = pubAck.Stream
+		results[idx].Sequence = pubAck.Sequence
+	}
+	return results
+}
+
+// PublishWithExpectations publishes a new message into JetStream on a subject, which is
+// only stored if the stream meets the expectations
+func (s *jetStreamPublisherImpl) PublishWithExpectations(
+	subject string, msg []byte, expect PublishExpectations, ctxt context.Context,
+) PublishResult {
+	result := PublishResult{Subject: subject}
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		result.Err = err
+		return result
+	}
+	if msg, err = s.applyPublishHooks(subject, msg, localLogTags, ctxt); err != nil {
+		result.Err = err
+		return result
+	}
+	toSend := nats.NewMsg(subject)
+	toSend.Data = msg
+	expect.Apply(toSend)
+	ack, err := s.nats.JetStream().PublishMsgAsync(toSend)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to send message")
+		result.Err = err
+		return result
+	}
+	pubAck, err := s.waitForPubAck(subject, ack, localLogTags, ctxt)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Stream = pubAck.Stream
+	result.Sequence = pubAck.Sequence
+	return result
+}
+
+// PublishMsg publishes a new message, with its headers, into JetStream on the message's
+// subject, and waits for the ACK
+func (s *jetStreamPublisherImpl) PublishMsg(msg *nats.Msg, ctxt context.Context) PublishResult {
+	result := PublishResult{Subject: msg.Subject}
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		result.Err = err
+		return result
+	}
+	body, err := s.applyPublishHooks(msg.Subject, msg.Data, localLogTags, ctxt)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	toSend := &nats.Msg{Subject: msg.Subject, Header: msg.Header, Data: body}
+	ack, err := s.nats.JetStream().PublishMsgAsync(toSend)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to send message")
+		result.Err = err
+		return result
+	}
+	pubAck, err := s.waitForPubAck(msg.Subject, ack, localLogTags, ctxt)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Stream = pubAck.Stream
+	result.Sequence = pubAck.Sequence
+	return result
+}
+
+// applyPublishHooks helper function to pass a message through the plugin OnPublish hooks.
+// Returns the message to publish.
+func (s *jetStreamPublisherImpl) applyPublishHooks(
+	subject string, msg []byte, localLogTags log.Fields, ctxt context.Context,
+) ([]byte, error) {
+	event := hooks.PublishEvent{Subject: subject, Message: msg}
+	if err := hooks.OnPublish(&event, ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Plugin stopped publish to %s", subject)
+		return nil, err
+	}
+	return event.Message, nil
+}
+
+// waitForPubAck helper function to wait for success, failure, or timeout of a publish
+func (s *jetStreamPublisherImpl) waitForPubAck(
+	subject string, ack nats.PubAckFuture, localLogTags log.Fields, ctxt context.Context,
+) (*nats.PubAck, error) {
 	select {
 	case goodSig, ok := <-ack.Ok():
 		if !ok {
 			err := fmt.Errorf("reading nats.PubAckFuture OK channel failure")
 			log.WithError(err).WithFields(localLogTags).Errorf("Message send failure")
-			return err
+			return nil, err
 		}
-		log.WithFields(localLogTags).Debugf(
+		common.ThrottledDebugf(
+			log.WithFields(localLogTags),
 			"Sent [%d] to %s/%s", goodSig.Sequence, goodSig.Stream, subject,
 		)
-		return nil
+		return goodSig, nil
 	case txErr, ok := <-ack.Err():
 		if !ok {
 			err := fmt.Errorf("reading nats.PubAckFuture error channel failure")
 			log.WithError(err).WithFields(localLogTags).Errorf("Message send failure")
-			return err
+			return nil, err
 		}
-		return txErr
+		return nil, txErr
 	case <-ctxt.Done():
 		err := ctxt.Err()
 		log.WithError(err).WithFields(localLogTags).Errorf("Message send timed out")
-		return err
+		return nil, err
 	}
 }
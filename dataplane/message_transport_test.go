@@ -17,6 +17,7 @@ package dataplane
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
@@ -24,6 +25,7 @@ import (
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/hooks"
 	"github.com/alwitt/httpmq/management"
 	"github.com/apex/log"
 	"github.com/google/uuid"
@@ -236,6 +238,16 @@ func TestMessageTransportPushSub(t *testing.T) {
 		}
 	}
 	log.Debug("============================= 5 =============================")
+
+	// Case 4: publish to a subject no stream is listening on
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		err := publisher.Publish(uuid.New().String(), []byte(uuid.New().String()), ctxt)
+		assert.NotNil(err)
+		assert.True(IsNoStreamError(err))
+	}
+	log.Debug("============================= 6 =============================")
 }
 
 func TestMessageTransportPushSubGroup(t *testing.T) {
@@ -498,3 +510,490 @@ func TestMessageTranscoding(t *testing.T) {
 		assert.EqualValues(msg2, parsed.Message)
 	}
 }
+
+func TestMessageFanOutPublish(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-msg-fan-out"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamPublisher",
+		"instance":  "fan-out",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define streams for testing
+	stream1 := uuid.New().String()
+	stream2 := uuid.New().String()
+	subject1 := uuid.New().String()
+	subject2 := uuid.New().String()
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:           stream1,
+			Subjects:       []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{MaxAge: &maxAge},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+		streamParam = management.JSStreamParam{
+			Name:           stream2,
+			Subjects:       []string{subject2},
+			JSStreamLimits: management.JSStreamLimits{MaxAge: &maxAge},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	log.Debug("============================= 1 =============================")
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+
+	// Case 0: publish to all known subjects
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		results := publisher.PublishToSubjects(
+			[]string{subject1, subject2}, []byte(uuid.New().String()), ctxt,
+		)
+		assert.Len(results, 2)
+		assert.Nil(results[0].Err)
+		assert.Equal(subject1, results[0].Subject)
+		assert.Equal(stream1, results[0].Stream)
+		assert.Equal(uint64(1), results[0].Sequence)
+		assert.Nil(results[1].Err)
+		assert.Equal(subject2, results[1].Subject)
+		assert.Equal(stream2, results[1].Stream)
+		assert.Equal(uint64(1), results[1].Sequence)
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 1: publish with one unknown subject
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		unknown := uuid.New().String()
+		results := publisher.PublishToSubjects(
+			[]string{subject1, unknown, subject2}, []byte(uuid.New().String()), ctxt,
+		)
+		assert.Len(results, 3)
+		assert.Nil(results[0].Err)
+		assert.Equal(uint64(2), results[0].Sequence)
+		assert.NotNil(results[1].Err)
+		assert.True(IsNoStreamError(results[1].Err))
+		assert.Equal(unknown, results[1].Subject)
+		assert.Nil(results[2].Err)
+		assert.Equal(uint64(2), results[2].Sequence)
+	}
+	log.Debug("============================= 3 =============================")
+}
+
+func TestMessagePublishAckPolicy(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-msg-ack-policy"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamPublisher",
+		"instance":  "ack-policy",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream for testing
+	stream1 := uuid.New().String()
+	subject1 := uuid.New().String()
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:           stream1,
+			Subjects:       []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{MaxAge: &maxAge},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	log.Debug("============================= 1 =============================")
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+
+	// Case 0: unknown policy
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		err := publisher.PublishWithPolicy(subject1, []byte("hello"), "leader", ctxt)
+		assert.NotNil(err)
+	}
+
+	// Case 1: publish without waiting for ACK
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		assert.Nil(publisher.PublishWithPolicy(subject1, []byte("hello"), PublishAckNone, ctxt))
+		// The message is still stored
+		assert.Nil(js.NATs().FlushWithContext(ctxt))
+		assert.Eventually(func() bool {
+			info, err := js.JetStream().StreamInfo(stream1)
+			return err == nil && info.State.Msgs == 1
+		}, time.Second, time.Millisecond*50)
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 2: failures are not reported without waiting for ACK
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		unknown := uuid.New().String()
+		assert.Nil(publisher.PublishWithPolicy(unknown, []byte("hello"), PublishAckNone, ctxt))
+		err := publisher.PublishWithPolicy(unknown, []byte("hello"), PublishAckWait, ctxt)
+		assert.True(IsNoStreamError(err))
+	}
+	log.Debug("============================= 3 =============================")
+
+	assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+}
+
+func TestMessagePublishBackpressure(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-msg-backpressure"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamPublisher",
+		"instance":  "backpressure",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:              common.GetUnitTestNatsURI(),
+		ConnectTimeout:         time.Second,
+		MaxReconnectAttempt:    0,
+		ReconnectWait:          time.Second,
+		PublishAsyncMaxPending: 2,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+
+	// A plain NATS subscriber receives the publish, but never ACKs it, so the publish stays
+	// pending
+	subject1 := uuid.New().String()
+	sub, err := js.NATs().SubscribeSync(subject1)
+	assert.Nil(err)
+	defer func() {
+		assert.Nil(sub.Unsubscribe())
+	}()
+
+	// Case 0: publish times out waiting for ACK
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Millisecond*100)
+		defer cancel()
+		err := publisher.Publish(subject1, []byte("hello"), ctxt)
+		assert.Equal(context.DeadlineExceeded, err)
+		assert.False(IsPublishBackpressureError(err))
+	}
+	log.Debug("============================= 1 =============================")
+
+	// Case 1: publish rejected, as too many publishes are pending
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		err := publisher.Publish(subject1, []byte("hello"), ctxt)
+		assert.True(IsPublishBackpressureError(err))
+	}
+	log.Debug("============================= 2 =============================")
+}
+
+// testHookPlugin enriches published and delivered messages, and records ACKs
+type testHookPlugin struct {
+	hooks.BasePlugin
+	rejectSubject string
+	rejectStream  string
+	acks          chan hooks.AckEvent
+}
+
+func (p testHookPlugin) OnPublish(event *hooks.PublishEvent, ctxt context.Context) error {
+	if event.Subject == p.rejectSubject {
+		return fmt.Errorf("%w: subject %s", hooks.ErrRejected, event.Subject)
+	}
+	event.Message = append([]byte("pub:"), event.Message...)
+	return nil
+}
+
+func (p testHookPlugin) OnDeliver(event *hooks.DeliverEvent, ctxt context.Context) {
+	enriched := nats.NewMsg(event.Message.Subject)
+	enriched.Data = event.Message.Data
+	enriched.Header.Set("Delivered-By", event.Consumer)
+	event.Message = enriched
+}
+
+func (p testHookPlugin) OnAck(event hooks.AckEvent, ctxt context.Context) {
+	p.acks <- event
+}
+
+func (p testHookPlugin) OnStreamCreate(config *nats.StreamConfig, ctxt context.Context) error {
+	if config.Name == p.rejectStream {
+		return fmt.Errorf("%w: stream %s", hooks.ErrRejected, config.Name)
+	}
+	config.Description = "checked"
+	return nil
+}
+
+func TestMessagePluginHooks(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-msg-plugin-hooks"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamPublisher",
+		"instance":  "plugin-hooks",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	stream1 := uuid.New().String()
+	stream2 := uuid.New().String()
+	subject1 := uuid.New().String()
+	subject2 := uuid.New().String()
+	plugin := testHookPlugin{
+		rejectSubject: subject2, rejectStream: stream2, acks: make(chan hooks.AckEvent, 4),
+	}
+	assert.Nil(hooks.Register(testName, plugin))
+	defer hooks.Unregister(testName)
+
+	// Case 0: plugin rejects a stream
+	maxAge := time.Second * 10
+	{
+		streamParam := management.JSStreamParam{
+			Name:           stream2,
+			Subjects:       []string{subject2},
+			JSStreamLimits: management.JSStreamLimits{MaxAge: &maxAge},
+		}
+		err := jsCtrl.CreateStream(streamParam, utCtxt)
+		assert.True(errors.Is(err, hooks.ErrRejected))
+		_, err = js.JetStream().StreamInfo(stream2)
+		assert.NotNil(err)
+	}
+
+	// Case 1: plugin changes the stream config
+	{
+		streamParam := management.JSStreamParam{
+			Name:           stream1,
+			Subjects:       []string{subject1, subject2},
+			JSStreamLimits: management.JSStreamLimits{MaxAge: &maxAge},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+		info, err := js.JetStream().StreamInfo(stream1)
+		assert.Nil(err)
+		assert.Equal("checked", info.Config.Description)
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+	log.Debug("============================= 1 =============================")
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+
+	// Case 2: plugin rejects a message
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		err := publisher.Publish(subject2, []byte("hello"), ctxt)
+		assert.True(errors.Is(err, hooks.ErrRejected))
+		results := publisher.PublishToSubjects([]string{subject1, subject2}, []byte("hello"), ctxt)
+		assert.Nil(results[0].Err)
+		assert.True(errors.Is(results[1].Err, hooks.ErrRejected))
+		info, err := js.JetStream().StreamInfo(stream1)
+		assert.Nil(err)
+		assert.Equal(uint64(1), info.State.Msgs)
+	}
+
+	// Case 3: plugin enriches a message
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		assert.Nil(publisher.Publish(subject1, []byte("world"), ctxt))
+		msg, err := js.JetStream().GetMsg(stream1, 2)
+		assert.Nil(err)
+		assert.Equal("pub:world", string(msg.Data))
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 4: plugin observes delivery and ACK
+	{
+		consumer := uuid.New().String()
+		param := management.JetStreamConsumerParam{
+			Name: consumer, MaxInflight: 10, Mode: "pull", FilterSubject: &subject1,
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+		fetcher, err := GetJetStreamBatchFetcher(js, time.Minute, testName)
+		assert.Nil(err)
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		msgs, token, err := fetcher.Fetch(stream1, consumer, subject1, 2, ctxt)
+		assert.Nil(err)
+		assert.Len(msgs, 2)
+		for _, msg := range msgs {
+			assert.Equal(consumer, msg.Header.Get("Delivered-By"))
+		}
+		committed, err := fetcher.Commit(stream1, consumer, token, ctxt)
+		assert.Nil(err)
+		assert.Equal(2, committed)
+		acked := map[uint64]bool{}
+		for itr := 0; itr < 2; itr++ {
+			select {
+			case ack := <-plugin.acks:
+				assert.Equal(stream1, ack.Stream)
+				assert.Equal(consumer, ack.Consumer)
+				acked[ack.StreamSeq] = true
+			case <-ctxt.Done():
+				assert.False(true, "ACK not observed")
+			}
+		}
+		assert.Equal(map[uint64]bool{1: true, 2: true}, acked)
+	}
+}
+
+func TestPublishExpectations(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: no expectations
+	{
+		msg := nats.NewMsg("subject")
+		PublishExpectations{}.Apply(msg)
+		assert.Empty(msg.Header)
+	}
+
+	// Case 1: all expectations, including an empty stream
+	{
+		msg := nats.NewMsg("subject")
+		lastSeq := uint64(0)
+		PublishExpectations{
+			MsgID: "msg-2", Stream: "stream-1", LastSequence: &lastSeq, LastMsgID: "msg-1",
+		}.Apply(msg)
+		assert.Equal("msg-2", msg.Header.Get(nats.MsgIdHdr))
+		assert.Equal("stream-1", msg.Header.Get(nats.ExpectedStreamHdr))
+		assert.Equal("0", msg.Header.Get(nats.ExpectedLastSeqHdr))
+		assert.Equal("msg-1", msg.Header.Get(nats.ExpectedLastMsgIdHdr))
+	}
+
+	// Case 2: expectation errors
+	{
+		assert.False(IsPublishExpectationError(nil))
+		assert.False(IsPublishExpectationError(nats.ErrNoResponders))
+		assert.True(IsPublishExpectationError(fmt.Errorf("nats: wrong last sequence: 5")))
+		assert.True(IsPublishExpectationError(fmt.Errorf("nats: wrong last msg ID: msg-0")))
+		assert.True(IsPublishExpectationError(fmt.Errorf("nats: expected stream does not match")))
+	}
+}
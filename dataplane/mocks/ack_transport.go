@@ -0,0 +1,78 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alwitt/httpmq/dataplane"
+)
+
+// JetStreamACKReceiver is a mock dataplane.JetStreamACKReceiver
+type JetStreamACKReceiver struct {
+	Recorder
+	lock    sync.Mutex
+	handler dataplane.JetStreamAckHandler
+	// SubscribeForACKsFunc is called by SubscribeForACKs
+	SubscribeForACKsFunc func(
+		wg *sync.WaitGroup, opContext context.Context, handler dataplane.JetStreamAckHandler,
+	) error
+}
+
+// SubscribeForACKs start receiving JetStream message ACKs
+func (m *JetStreamACKReceiver) SubscribeForACKs(
+	wg *sync.WaitGroup, opContext context.Context, handler dataplane.JetStreamAckHandler,
+) error {
+	m.record("SubscribeForACKs", wg, opContext, handler)
+	m.lock.Lock()
+	m.handler = handler
+	m.lock.Unlock()
+	if m.SubscribeForACKsFunc != nil {
+		return m.SubscribeForACKsFunc(wg, opContext, handler)
+	}
+	return nil
+}
+
+// ReceiveACK passes an ACK to the handler given to SubscribeForACKs, as if it was received
+func (m *JetStreamACKReceiver) ReceiveACK(ack dataplane.AckIndication, ctxt context.Context) error {
+	m.lock.Lock()
+	handler := m.handler
+	m.lock.Unlock()
+	if handler == nil {
+		return fmt.Errorf("not subscribed for ACKs")
+	}
+	handler(ack, ctxt)
+	return nil
+}
+
+// JetStreamACKBroadcaster is a mock dataplane.JetStreamACKBroadcaster
+type JetStreamACKBroadcaster struct {
+	Recorder
+	// BroadcastACKFunc is called by BroadcastACK
+	BroadcastACKFunc func(ack dataplane.AckIndication, ctxt context.Context) error
+}
+
+// BroadcastACK broadcast a JetStream message ACK
+func (m *JetStreamACKBroadcaster) BroadcastACK(
+	ack dataplane.AckIndication, ctxt context.Context,
+) error {
+	m.record("BroadcastACK", ack, ctxt)
+	if m.BroadcastACKFunc != nil {
+		return m.BroadcastACKFunc(ack, ctxt)
+	}
+	return nil
+}
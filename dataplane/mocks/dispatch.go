@@ -0,0 +1,146 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/nats-io/nats.go"
+)
+
+// MessageDispatcher is a mock dataplane.MessageDispatcher
+type MessageDispatcher struct {
+	Recorder
+	lock      sync.Mutex
+	msgOutput dataplane.ForwardMessageHandlerCB
+	errorCB   dataplane.AlertOnErrorCB
+	// ConsumerName is returned by Consumer
+	ConsumerName string
+	// StartFunc is called by Start
+	StartFunc func(msgOutput dataplane.ForwardMessageHandlerCB, errorCB dataplane.AlertOnErrorCB) error
+	// RedeliverFunc is called by Redeliver
+	RedeliverFunc func(msgs []*nats.Msg) error
+	// NakFunc is called by Nak
+	NakFunc func(msg *nats.Msg) error
+	// WarmUpFunc is called by WarmUp
+	WarmUpFunc func() (dataplane.WarmUpProgress, bool)
+	// StopFunc is called by Stop
+	StopFunc func(ctxt context.Context) error
+	// DrainFunc is called by Drain
+	DrainFunc func(ctxt context.Context) error
+	// InflightFunc is called by Inflight
+	InflightFunc func(ctxt context.Context) ([]dataplane.InflightMessage, error)
+}
+
+// Start starts operations
+func (m *MessageDispatcher) Start(
+	msgOutput dataplane.ForwardMessageHandlerCB, errorCB dataplane.AlertOnErrorCB,
+) error {
+	m.record("Start", msgOutput, errorCB)
+	m.lock.Lock()
+	m.msgOutput, m.errorCB = msgOutput, errorCB
+	m.lock.Unlock()
+	if m.StartFunc != nil {
+		return m.StartFunc(msgOutput, errorCB)
+	}
+	return nil
+}
+
+// Consumer returns the name of the consumer messages are dispatched for
+func (m *MessageDispatcher) Consumer() string {
+	m.record("Consumer")
+	return m.ConsumerName
+}
+
+// Redeliver forwards again messages delivered by an earlier subscription
+func (m *MessageDispatcher) Redeliver(msgs []*nats.Msg) error {
+	m.record("Redeliver", msgs)
+	if m.RedeliverFunc != nil {
+		return m.RedeliverFunc(msgs)
+	}
+	return nil
+}
+
+// Nak gives back a forwarded message which never reached the client
+func (m *MessageDispatcher) Nak(msg *nats.Msg) error {
+	m.record("Nak", msg)
+	if m.NakFunc != nil {
+		return m.NakFunc(msg)
+	}
+	return nil
+}
+
+// WarmUp returns the progress of the delivery warm-up
+func (m *MessageDispatcher) WarmUp() (dataplane.WarmUpProgress, bool) {
+	m.record("WarmUp")
+	if m.WarmUpFunc != nil {
+		return m.WarmUpFunc()
+	}
+	return dataplane.WarmUpProgress{}, false
+}
+
+// Stop tears down the dispatcher
+func (m *MessageDispatcher) Stop(ctxt context.Context) error {
+	m.record("Stop", ctxt)
+	if m.StopFunc != nil {
+		return m.StopFunc(ctxt)
+	}
+	return nil
+}
+
+// Drain stops reading new messages, and waits for those forwarded to be ACKed
+func (m *MessageDispatcher) Drain(ctxt context.Context) error {
+	m.record("Drain", ctxt)
+	if m.DrainFunc != nil {
+		return m.DrainFunc(ctxt)
+	}
+	return nil
+}
+
+// Inflight lists the messages forwarded, and awaiting ACK
+func (m *MessageDispatcher) Inflight(ctxt context.Context) ([]dataplane.InflightMessage, error) {
+	m.record("Inflight", ctxt)
+	if m.InflightFunc != nil {
+		return m.InflightFunc(ctxt)
+	}
+	return nil, nil
+}
+
+// Dispatch passes a message to the output callback given to Start, as if it was
+// dispatched
+func (m *MessageDispatcher) Dispatch(msg *nats.Msg, ctxt context.Context) error {
+	m.lock.Lock()
+	msgOutput := m.msgOutput
+	m.lock.Unlock()
+	if msgOutput == nil {
+		return fmt.Errorf("dispatcher is not started")
+	}
+	return msgOutput(msg, ctxt)
+}
+
+// Fail passes an error to the error callback given to Start
+func (m *MessageDispatcher) Fail(err error) error {
+	m.lock.Lock()
+	errorCB := m.errorCB
+	m.lock.Unlock()
+	if errorCB == nil {
+		return fmt.Errorf("dispatcher is not started")
+	}
+	errorCB(err)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocks
+
+import (
+	"context"
+	"time"
+
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/nats-io/nats.go"
+)
+
+// JetStreamInflightMsgProcessor is a mock dataplane.JetStreamInflightMsgProcessor
+type JetStreamInflightMsgProcessor struct {
+	Recorder
+	// RecordInflightMessageFunc is called by RecordInflightMessage
+	RecordInflightMessageFunc func(msg *nats.Msg, blocking bool, callCtxt context.Context) error
+	// HandlerMsgACKFunc is called by HandlerMsgACK
+	HandlerMsgACKFunc func(
+		ack dataplane.AckIndication, blocking bool, callCtxt context.Context,
+	) error
+	// HandlerMsgACKsFunc is called by HandlerMsgACKs
+	HandlerMsgACKsFunc func(acks []dataplane.AckIndication, callCtxt context.Context) error
+	// NAKOverdueMessagesFunc is called by NAKOverdueMessages
+	NAKOverdueMessagesFunc func(
+		deadline time.Duration, onNAK func(msg *nats.Msg), callCtxt context.Context,
+	) error
+	// ListInflightMessagesFunc is called by ListInflightMessages
+	ListInflightMessagesFunc func(callCtxt context.Context) ([]dataplane.InflightMessage, error)
+}
+
+// RecordInflightMessage records a new JetStream message inflight awaiting ACK
+func (m *JetStreamInflightMsgProcessor) RecordInflightMessage(
+	msg *nats.Msg, blocking bool, callCtxt context.Context,
+) error {
+	m.record("RecordInflightMessage", msg, blocking, callCtxt)
+	if m.RecordInflightMessageFunc != nil {
+		return m.RecordInflightMessageFunc(msg, blocking, callCtxt)
+	}
+	return nil
+}
+
+// HandlerMsgACK processes a new message ACK
+func (m *JetStreamInflightMsgProcessor) HandlerMsgACK(
+	ack dataplane.AckIndication, blocking bool, callCtxt context.Context,
+) error {
+	m.record("HandlerMsgACK", ack, blocking, callCtxt)
+	if m.HandlerMsgACKFunc != nil {
+		return m.HandlerMsgACKFunc(ack, blocking, callCtxt)
+	}
+	return nil
+}
+
+// HandlerMsgACKs processes a batch of message ACKs
+func (m *JetStreamInflightMsgProcessor) HandlerMsgACKs(
+	acks []dataplane.AckIndication, callCtxt context.Context,
+) error {
+	m.record("HandlerMsgACKs", acks, callCtxt)
+	if m.HandlerMsgACKsFunc != nil {
+		return m.HandlerMsgACKsFunc(acks, callCtxt)
+	}
+	return nil
+}
+
+// NAKOverdueMessages NAK the inflight messages recorded more than deadline ago
+func (m *JetStreamInflightMsgProcessor) NAKOverdueMessages(
+	deadline time.Duration, onNAK func(msg *nats.Msg), callCtxt context.Context,
+) error {
+	m.record("NAKOverdueMessages", deadline, onNAK, callCtxt)
+	if m.NAKOverdueMessagesFunc != nil {
+		return m.NAKOverdueMessagesFunc(deadline, onNAK, callCtxt)
+	}
+	return nil
+}
+
+// ListInflightMessages lists the messages currently awaiting ACK
+func (m *JetStreamInflightMsgProcessor) ListInflightMessages(
+	callCtxt context.Context,
+) ([]dataplane.InflightMessage, error) {
+	m.record("ListInflightMessages", callCtxt)
+	if m.ListInflightMessagesFunc != nil {
+		return m.ListInflightMessagesFunc(callCtxt)
+	}
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/nats-io/nats.go"
+)
+
+// JetStreamPushSubscriber is a mock dataplane.JetStreamPushSubscriber
+type JetStreamPushSubscriber struct {
+	Recorder
+	lock      sync.Mutex
+	forwardCB dataplane.ForwardMessageHandlerCB
+	errorCB   dataplane.AlertOnErrorCB
+	// StartReadingFunc is called by StartReading
+	StartReadingFunc func(
+		forwardCB dataplane.ForwardMessageHandlerCB,
+		errorCB dataplane.AlertOnErrorCB,
+		wg *sync.WaitGroup,
+		ctxt context.Context,
+	) error
+}
+
+// StartReading begin reading data from JetStream
+func (m *JetStreamPushSubscriber) StartReading(
+	forwardCB dataplane.ForwardMessageHandlerCB,
+	errorCB dataplane.AlertOnErrorCB,
+	wg *sync.WaitGroup,
+	ctxt context.Context,
+) error {
+	m.record("StartReading", forwardCB, errorCB, wg, ctxt)
+	m.lock.Lock()
+	m.forwardCB, m.errorCB = forwardCB, errorCB
+	m.lock.Unlock()
+	if m.StartReadingFunc != nil {
+		return m.StartReadingFunc(forwardCB, errorCB, wg, ctxt)
+	}
+	return nil
+}
+
+// Deliver passes a message to the forward callback given to StartReading, as if it was
+// read from JetStream
+func (m *JetStreamPushSubscriber) Deliver(msg *nats.Msg, ctxt context.Context) error {
+	m.lock.Lock()
+	forwardCB := m.forwardCB
+	m.lock.Unlock()
+	if forwardCB == nil {
+		return fmt.Errorf("subscriber is not reading")
+	}
+	return forwardCB(msg, ctxt)
+}
+
+// Fail passes an error to the error callback given to StartReading
+func (m *JetStreamPushSubscriber) Fail(err error) error {
+	m.lock.Lock()
+	errorCB := m.errorCB
+	m.lock.Unlock()
+	if errorCB == nil {
+		return fmt.Errorf("subscriber is not reading")
+	}
+	errorCB(err)
+	return nil
+}
+
+// JetStreamPublisher is a mock dataplane.JetStreamPublisher
+type JetStreamPublisher struct {
+	Recorder
+	// PublishFunc is called by Publish
+	PublishFunc func(subject string, msg []byte, ctxt context.Context) error
+	// PublishWithPolicyFunc is called by PublishWithPolicy
+	PublishWithPolicyFunc func(
+		subject string, msg []byte, policy dataplane.PublishAckPolicy, ctxt context.Context,
+	) error
+	// PublishToSubjectsFunc is called by PublishToSubjects. Without it, each subject is
+	// reported published.
+	PublishToSubjectsFunc func(
+		subjects []string, msg []byte, ctxt context.Context,
+	) []dataplane.PublishResult
+	// PublishWithExpectationsFunc is called by PublishWithExpectations. Without it, the
+	// message is reported published to the expected stream.
+	PublishWithExpectationsFunc func(
+		subject string, msg []byte, expect dataplane.PublishExpectations, ctxt context.Context,
+	) dataplane.PublishResult
+	// PublishMsgFunc is called by PublishMsg. Without it, the message is reported published.
+	PublishMsgFunc func(msg *nats.Msg, ctxt context.Context) dataplane.PublishResult
+	// PublishTransactionFunc is called by PublishTransaction. Without it, the transaction
+	// is reported committed.
+	PublishTransactionFunc func(
+		msgs []dataplane.TransactionMessage, ctxt context.Context,
+	) dataplane.TransactionResult
+}
+
+// Publish publishes a new message into JetStream on a subject, and waits for the ACK
+func (m *JetStreamPublisher) Publish(subject string, msg []byte, ctxt context.Context) error {
+	m.record("Publish", subject, msg, ctxt)
+	if m.PublishFunc != nil {
+		return m.PublishFunc(subject, msg, ctxt)
+	}
+	return nil
+}
+
+// PublishWithPolicy publishes a new message into JetStream on a subject, waiting for the
+// ACK as selected by policy
+func (m *JetStreamPublisher) PublishWithPolicy(
+	subject string, msg []byte, policy dataplane.PublishAckPolicy, ctxt context.Context,
+) error {
+	m.record("PublishWithPolicy", subject, msg, policy, ctxt)
+	if m.PublishWithPolicyFunc != nil {
+		return m.PublishWithPolicyFunc(subject, msg, policy, ctxt)
+	}
+	return nil
+}
+
+// PublishToSubjects publishes the same message into JetStream on multiple subjects
+func (m *JetStreamPublisher) PublishToSubjects(
+	subjects []string, msg []byte, ctxt context.Context,
+) []dataplane.PublishResult {
+	m.record("PublishToSubjects", subjects, msg, ctxt)
+	if m.PublishToSubjectsFunc != nil {
+		return m.PublishToSubjectsFunc(subjects, msg, ctxt)
+	}
+	results := make([]dataplane.PublishResult, len(subjects))
+	for idx, subject := range subjects {
+		results[idx].Subject = subject
+	}
+	return results
+}
+
+// PublishWithExpectations publishes a new message into JetStream on a subject, which is
+// only stored if the stream meets the expectations
+func (m *JetStreamPublisher) PublishWithExpectations(
+	subject string, msg []byte, expect dataplane.PublishExpectations, ctxt context.Context,
+) dataplane.PublishResult {
+	m.record("PublishWithExpectations", subject, msg, expect, ctxt)
+	if m.PublishWithExpectationsFunc != nil {
+		return m.PublishWithExpectationsFunc(subject, msg, expect, ctxt)
+	}
+	return dataplane.PublishResult{Subject: subject, Stream: expect.Stream}
+}
+
+// PublishMsg publishes a new message, with its headers, into JetStream on the message's
+// subject, and waits for the ACK
+func (m *JetStreamPublisher) PublishMsg(
+	msg *nats.Msg, ctxt context.Context,
+) dataplane.PublishResult {
+	m.record("PublishMsg", msg, ctxt)
+	if m.PublishMsgFunc != nil {
+		return m.PublishMsgFunc(msg, ctxt)
+	}
+	return dataplane.PublishResult{Subject: msg.Subject}
+}
+
+// PublishTransaction publishes a set of messages to their subjects, all or nothing on a
+// best effort basis
+func (m *JetStreamPublisher) PublishTransaction(
+	msgs []dataplane.TransactionMessage, ctxt context.Context,
+) dataplane.TransactionResult {
+	m.record("PublishTransaction", msgs, ctxt)
+	if m.PublishTransactionFunc != nil {
+		return m.PublishTransactionFunc(msgs, ctxt)
+	}
+	result := dataplane.TransactionResult{
+		Committed: true, Results: make([]dataplane.TransactionMessageResult, len(msgs)),
+	}
+	for idx, msg := range msgs {
+		result.Results[idx].Subject = msg.Subject
+	}
+	return result
+}
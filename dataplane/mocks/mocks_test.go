@@ -0,0 +1,147 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/dataplane"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ dataplane.JetStreamACKReceiver          = &JetStreamACKReceiver{}
+	_ dataplane.JetStreamACKBroadcaster       = &JetStreamACKBroadcaster{}
+	_ dataplane.JetStreamPushSubscriber       = &JetStreamPushSubscriber{}
+	_ dataplane.JetStreamPublisher            = &JetStreamPublisher{}
+	_ dataplane.JetStreamInflightMsgProcessor = &JetStreamInflightMsgProcessor{}
+	_ dataplane.MessageDispatcher             = &MessageDispatcher{}
+)
+
+func TestMockPublisher(t *testing.T) {
+	assert := assert.New(t)
+	ctxt := context.Background()
+
+	uut := &JetStreamPublisher{}
+
+	// Case 1: without funcs, publishes succeed and are recorded
+	{
+		assert.Nil(uut.Publish("subject-1", []byte("hello"), ctxt))
+		results := uut.PublishToSubjects([]string{"subject-2", "subject-3"}, []byte("hello"), ctxt)
+		assert.Len(results, 2)
+		assert.Equal("subject-3", results[1].Subject)
+		assert.Nil(results[1].Err)
+		assert.Equal(2, uut.CallCount(""))
+		calls := uut.Calls("Publish")
+		assert.Len(calls, 1)
+		assert.Equal("subject-1", calls[0].Args[0])
+	}
+
+	// Case 2: funcs decide the result
+	{
+		uut.PublishFunc = func(subject string, msg []byte, ctxt context.Context) error {
+			return fmt.Errorf("no stream for %s", subject)
+		}
+		assert.NotNil(uut.Publish("subject-1", []byte("hello"), ctxt))
+		assert.Equal(2, uut.CallCount("Publish"))
+	}
+
+	// Case 3: reset the recorded calls
+	{
+		uut.Reset()
+		assert.Equal(0, uut.CallCount(""))
+	}
+}
+
+func TestMockCallbackDriving(t *testing.T) {
+	assert := assert.New(t)
+	ctxt := context.Background()
+	wg := sync.WaitGroup{}
+
+	// Case 1: deliver messages through a subscriber
+	{
+		uut := &JetStreamPushSubscriber{}
+		msg := &nats.Msg{Subject: "subject"}
+		assert.NotNil(uut.Deliver(msg, ctxt))
+		forwarded := []*nats.Msg{}
+		var failure error
+		assert.Nil(uut.StartReading(
+			func(msg *nats.Msg, _ context.Context) error {
+				forwarded = append(forwarded, msg)
+				return nil
+			},
+			func(err error) { failure = err },
+			&wg,
+			ctxt,
+		))
+		assert.Nil(uut.Deliver(msg, ctxt))
+		assert.Equal([]*nats.Msg{msg}, forwarded)
+		assert.Nil(uut.Fail(fmt.Errorf("dummy error")))
+		assert.NotNil(failure)
+	}
+
+	// Case 2: receive ACKs
+	{
+		uut := &JetStreamACKReceiver{}
+		ack := dataplane.AckIndication{Stream: "stream", Consumer: "consumer"}
+		assert.NotNil(uut.ReceiveACK(ack, ctxt))
+		received := []dataplane.AckIndication{}
+		assert.Nil(uut.SubscribeForACKs(&wg, ctxt, func(ack dataplane.AckIndication, _ context.Context) {
+			received = append(received, ack)
+		}))
+		assert.Nil(uut.ReceiveACK(ack, ctxt))
+		assert.Equal([]dataplane.AckIndication{ack}, received)
+	}
+
+	// Case 3: dispatch messages, and report the consumer
+	{
+		uut := &MessageDispatcher{ConsumerName: "consumer"}
+		assert.Equal("consumer", uut.Consumer())
+		msg := &nats.Msg{Subject: "subject"}
+		assert.NotNil(uut.Dispatch(msg, ctxt))
+		dispatched := 0
+		assert.Nil(uut.Start(
+			func(*nats.Msg, context.Context) error {
+				dispatched++
+				return nil
+			},
+			func(error) {},
+		))
+		assert.Nil(uut.Dispatch(msg, ctxt))
+		assert.Equal(1, dispatched)
+	}
+
+	// Case 4: inflight processor NAKs through the given callback
+	{
+		msg := &nats.Msg{Subject: "subject"}
+		uut := &JetStreamInflightMsgProcessor{
+			NAKOverdueMessagesFunc: func(
+				_ time.Duration, onNAK func(msg *nats.Msg), _ context.Context,
+			) error {
+				onNAK(msg)
+				return nil
+			},
+		}
+		naked := 0
+		assert.Nil(uut.NAKOverdueMessages(time.Second, func(*nats.Msg) { naked++ }, ctxt))
+		assert.Equal(1, naked)
+		assert.Equal(time.Second, uut.Calls("NAKOverdueMessages")[0].Args[0])
+	}
+}
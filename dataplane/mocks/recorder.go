@@ -0,0 +1,70 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mocks provides mocks of the dataplane components, for unit testing code using
+// the dataplane without a NATS server.
+//
+// Each mock method records the call, then calls the matching Func field of the mock if set.
+// Without a Func, the method succeeds with zero results. Mocks of components taking
+// callbacks keep the latest callbacks, so tests can drive them.
+package mocks
+
+import "sync"
+
+// Call is a recorded call of a mock method
+type Call struct {
+	// Method is the name of the method called
+	Method string
+	// Args are the parameters of the call
+	Args []interface{}
+}
+
+// Recorder records the calls of a mock
+type Recorder struct {
+	lock  sync.Mutex
+	calls []Call
+}
+
+// record helper function to record a call
+func (r *Recorder) record(method string, args ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = append(r.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the recorded calls of a method in call order, or of all methods if method
+// is empty
+func (r *Recorder) Calls(method string) []Call {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	calls := []Call{}
+	for _, call := range r.calls {
+		if method == "" || call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// CallCount returns the number of recorded calls of a method
+func (r *Recorder) CallCount(method string) int {
+	return len(r.Calls(method))
+}
+
+// Reset clears the recorded calls
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = nil
+}
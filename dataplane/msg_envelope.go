@@ -0,0 +1,281 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+)
+
+// PayloadEncoding is how the payload of a message is encoded in its envelope
+type PayloadEncoding string
+
+const (
+	// PayloadEncodingBase64 the payload is a Base64 encoded string
+	PayloadEncodingBase64 PayloadEncoding = "base64"
+	// PayloadEncodingText the payload is a UTF-8 string
+	PayloadEncodingText PayloadEncoding = "text"
+	// PayloadEncodingJSON the payload is embedded as is, being JSON
+	PayloadEncodingJSON PayloadEncoding = "json"
+)
+
+// MsgEnvelopeJetStream is the JetStream metadata of a message in its envelope
+type MsgEnvelopeJetStream struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer which delivered the message
+	Consumer string `json:"consumer"`
+	// Domain is the JetStream domain of the stream, if any
+	Domain string `json:"domain,omitempty"`
+	// StreamSeq is the message sequence number within the stream
+	StreamSeq uint64 `json:"stream_seq"`
+	// ConsumerSeq is the message sequence number for the consumer
+	ConsumerSeq uint64 `json:"consumer_seq"`
+	// NumDelivered is the number of times the message was delivered
+	NumDelivered uint64 `json:"num_delivered"`
+	// NumPending is the number of messages pending for the consumer when it was delivered
+	NumPending uint64 `json:"num_pending"`
+	// Timestamp is when the message was stored by the stream
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MsgEnvelope is the stable JSON representation of a NATs message. The legacy message
+// formats of the APIs are derived from it.
+type MsgEnvelope struct {
+	// Subject is the subject the message was published to
+	Subject string `json:"subject"`
+	// Headers are the message headers, if any
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Encoding is how Payload is encoded
+	Encoding PayloadEncoding `json:"encoding"`
+	// Payload is the message body, encoded as given by Encoding
+	Payload json.RawMessage `json:"payload,omitempty" swaggertype:"object"`
+	// PayloadWithheld is set if the message body is withheld from the viewer
+	PayloadWithheld bool `json:"payload_withheld,omitempty"`
+	// JetStream is the JetStream metadata of the message, if it was read from a stream
+	JetStream *MsgEnvelopeJetStream `json:"jetstream,omitempty"`
+
+	// data is the message body
+	data []byte
+}
+
+// NewMsgEnvelope define the envelope of a message, with the payload Base64 encoded. The
+// message body is not copied.
+func NewMsgEnvelope(msg *nats.Msg) MsgEnvelope {
+	envelope := MsgEnvelope{
+		Subject: msg.Subject, Encoding: PayloadEncodingBase64, data: msg.Data,
+	}
+	if len(msg.Header) > 0 {
+		envelope.Headers = msg.Header
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		envelope.JetStream = &MsgEnvelopeJetStream{
+			Stream:       meta.Stream,
+			Consumer:     meta.Consumer,
+			Domain:       meta.Domain,
+			StreamSeq:    meta.Sequence.Stream,
+			ConsumerSeq:  meta.Sequence.Consumer,
+			NumDelivered: meta.NumDelivered,
+			NumPending:   meta.NumPending,
+			Timestamp:    meta.Timestamp.UTC(),
+		}
+	}
+	return envelope
+}
+
+// WithEncoding change how the payload is encoded. An empty encoding picks the most readable
+// encoding of the payload: JSON, then text, then Base64.
+func (e MsgEnvelope) WithEncoding(encoding PayloadEncoding) (MsgEnvelope, error) {
+	switch encoding {
+	case "":
+		if json.Valid(e.data) {
+			encoding = PayloadEncodingJSON
+		} else if utf8.Valid(e.data) {
+			encoding = PayloadEncodingText
+		} else {
+			encoding = PayloadEncodingBase64
+		}
+	case PayloadEncodingJSON:
+		if !json.Valid(e.data) {
+			return e, fmt.Errorf("payload of %s is not JSON", e.String())
+		}
+	case PayloadEncodingText:
+		if !utf8.Valid(e.data) {
+			return e, fmt.Errorf("payload of %s is not UTF-8 text", e.String())
+		}
+	case PayloadEncodingBase64:
+	default:
+		return e, fmt.Errorf("unknown payload encoding '%s'", encoding)
+	}
+	e.Encoding = encoding
+	return e, nil
+}
+
+// WithholdPayload remove the message body, leaving only its metadata
+func (e MsgEnvelope) WithholdPayload() MsgEnvelope {
+	e.data = nil
+	e.Payload = nil
+	e.PayloadWithheld = true
+	return e
+}
+
+// Data returns the message body
+func (e MsgEnvelope) Data() []byte {
+	return e.data
+}
+
+// String toString function for MsgEnvelope
+func (e MsgEnvelope) String() string {
+	if e.JetStream == nil {
+		return e.Subject
+	}
+	return fmt.Sprintf(
+		"%s@%s:MSG[S:%d C:%d]",
+		e.JetStream.Consumer,
+		e.JetStream.Stream,
+		e.JetStream.StreamSeq,
+		e.JetStream.ConsumerSeq,
+	)
+}
+
+// msgEnvelopeJSON the JSON fields of MsgEnvelope, without its methods
+type msgEnvelopeJSON MsgEnvelope
+
+// MarshalJSON encode the envelope, encoding the payload as given by Encoding
+func (e MsgEnvelope) MarshalJSON() ([]byte, error) {
+	encoded := msgEnvelopeJSON(e)
+	encoded.Payload = nil
+	if !e.PayloadWithheld && e.data != nil {
+		var err error
+		switch e.Encoding {
+		case PayloadEncodingJSON:
+			encoded.Payload = e.data
+		case PayloadEncodingText:
+			encoded.Payload, err = json.Marshal(string(e.data))
+		default:
+			encoded.Encoding = PayloadEncodingBase64
+			encoded.Payload, err = json.Marshal(base64.StdEncoding.EncodeToString(e.data))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&encoded)
+}
+
+// UnmarshalJSON decode the envelope, decoding the payload as given by Encoding
+func (e *MsgEnvelope) UnmarshalJSON(data []byte) error {
+	var decoded msgEnvelopeJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*e = MsgEnvelope(decoded)
+	e.data = nil
+	if len(e.Payload) == 0 {
+		return nil
+	}
+	switch e.Encoding {
+	case PayloadEncodingJSON:
+		e.data = []byte(e.Payload)
+	case PayloadEncodingText:
+		var text string
+		if err := json.Unmarshal(e.Payload, &text); err != nil {
+			return err
+		}
+		e.data = []byte(text)
+	case PayloadEncodingBase64:
+		var encoded string
+		if err := json.Unmarshal(e.Payload, &encoded); err != nil {
+			return err
+		}
+		payload, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		e.data = payload
+	default:
+		return fmt.Errorf("unknown payload encoding '%s'", e.Encoding)
+	}
+	return nil
+}
+
+// ==============================================================================
+// Adapters to the legacy message formats
+
+// ToDeliver convert the envelope of a JetStream message into the delivery format of
+// subscriptions on subject
+func (e MsgEnvelope) ToDeliver(subject string) (MsgToDeliver, error) {
+	if e.JetStream == nil {
+		return MsgToDeliver{}, nats.ErrNotJSMessage
+	}
+	return MsgToDeliver{
+		Stream:   e.JetStream.Stream,
+		Subject:  subject,
+		Consumer: e.JetStream.Consumer,
+		Sequence: MsgToDeliverSeq{Stream: e.JetStream.StreamSeq, Consumer: e.JetStream.ConsumerSeq},
+		Headers:  e.Headers,
+		Message:  e.data,
+	}, nil
+}
+
+// ToExport convert the envelope of a JetStream message into the export format
+func (e MsgEnvelope) ToExport() (ExportMessage, error) {
+	if e.JetStream == nil {
+		return ExportMessage{}, nats.ErrNotJSMessage
+	}
+	return ExportMessage{
+		Stream:          e.JetStream.Stream,
+		Subject:         e.Subject,
+		Sequence:        e.JetStream.StreamSeq,
+		Timestamp:       e.JetStream.Timestamp,
+		Headers:         e.Headers,
+		Message:         e.data,
+		PayloadWithheld: e.PayloadWithheld,
+	}, nil
+}
+
+// ToTail convert the envelope of a JetStream message into the human readable tail format
+func (e MsgEnvelope) ToTail() (TailMessage, error) {
+	if e.JetStream == nil {
+		return TailMessage{}, nats.ErrNotJSMessage
+	}
+	result := TailMessage{
+		Stream:          e.JetStream.Stream,
+		Subject:         e.Subject,
+		Sequence:        e.JetStream.StreamSeq,
+		Timestamp:       e.JetStream.Timestamp,
+		Headers:         e.Headers,
+		Size:            len(e.data),
+		PayloadWithheld: e.PayloadWithheld,
+	}
+	if e.PayloadWithheld {
+		return result, nil
+	}
+	readable, _ := e.WithEncoding("")
+	switch readable.Encoding {
+	case PayloadEncodingJSON:
+		result.JSON = e.data
+	case PayloadEncodingText:
+		result.Text = string(e.data)
+	default:
+		result.Message = e.data
+	}
+	return result, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+func TestMsgEnvelopeGolden(t *testing.T) {
+	assert := assert.New(t)
+
+	headers := nats.Header{"Content-Type": []string{"application/json"}}
+	type testCase struct {
+		golden   string
+		msg      *nats.Msg
+		encoding PayloadEncoding
+		readable bool
+		withhold bool
+	}
+	testCases := []testCase{
+		// Case 0: JetStream message, Base64 encoded
+		{
+			golden: "jetstream_base64.json",
+			msg:    benchDeliveryMsg("stream-1", "consumer-1", []byte{0xde, 0xad, 0xbe, 0xef}, nil),
+		},
+		// Case 1: JetStream message embedded as JSON, with headers
+		{
+			golden:   "jetstream_json.json",
+			msg:      benchDeliveryMsg("stream-1", "consumer-1", []byte(`{"id":7}`), headers),
+			encoding: PayloadEncodingJSON,
+		},
+		// Case 2: JetStream message as text, picked as the most readable encoding
+		{
+			golden:   "jetstream_text.json",
+			msg:      benchDeliveryMsg("stream-1", "consumer-1", []byte("hello\nworld"), nil),
+			readable: true,
+		},
+		// Case 3: payload withheld
+		{
+			golden:   "jetstream_withheld.json",
+			msg:      benchDeliveryMsg("stream-1", "consumer-1", []byte("secret"), headers),
+			withhold: true,
+		},
+		// Case 4: core NATS message with a JetStream domain in its ACK reply subject
+		{
+			golden: "jetstream_domain.json",
+			msg: &nats.Msg{
+				Subject: "test-subject",
+				Reply:   "$JS.ACK.hub.acc.stream-1.consumer-1.2.27.14.1634000000000000000.3.rand",
+				Data:    []byte("hello"),
+				Sub:     &nats.Subscription{},
+			},
+			encoding: PayloadEncodingBase64,
+		},
+		// Case 5: core NATS message
+		{
+			golden:   "core.json",
+			msg:      &nats.Msg{Subject: "test-subject", Data: []byte("hello")},
+			encoding: PayloadEncodingText,
+		},
+	}
+	for idx, oneCase := range testCases {
+		envelope := NewMsgEnvelope(oneCase.msg)
+		if oneCase.encoding != "" || oneCase.readable {
+			var err error
+			envelope, err = envelope.WithEncoding(oneCase.encoding)
+			assert.Nil(err, "Case %d", idx)
+		}
+		if oneCase.withhold {
+			envelope = envelope.WithholdPayload()
+		}
+		encoded, err := json.Marshal(&envelope)
+		assert.Nil(err, "Case %d", idx)
+		encoded = append(encoded, '\n')
+
+		golden := filepath.Join("testdata", "msg_envelope", oneCase.golden)
+		if *updateGolden {
+			assert.Nil(os.WriteFile(golden, encoded, 0644), "Case %d", idx)
+		}
+		expected, err := os.ReadFile(golden)
+		assert.Nil(err, "Case %d", idx)
+		assert.Equal(string(expected), string(encoded), "Case %d", idx)
+
+		// The envelope decodes back to the same message
+		var decoded MsgEnvelope
+		assert.Nil(json.Unmarshal(expected, &decoded), "Case %d", idx)
+		assert.Equal(envelope.Subject, decoded.Subject, "Case %d", idx)
+		assert.Equal(envelope.Headers, decoded.Headers, "Case %d", idx)
+		assert.Equal(envelope.JetStream, decoded.JetStream, "Case %d", idx)
+		if oneCase.withhold {
+			assert.True(decoded.PayloadWithheld, "Case %d", idx)
+			assert.Nil(decoded.Data(), "Case %d", idx)
+		} else {
+			assert.Equal(oneCase.msg.Data, decoded.Data(), "Case %d", idx)
+		}
+	}
+}
+
+func TestMsgEnvelopeAdapters(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := benchDeliveryMsg("stream-1", "consumer-1", []byte(`{"id":7}`), nil)
+	envelope := NewMsgEnvelope(msg)
+	assert.Equal("consumer-1@stream-1:MSG[S:27 C:14]", envelope.String())
+
+	// Case 0: legacy formats
+	{
+		deliver, err := envelope.ToDeliver("orders.>")
+		assert.Nil(err)
+		assert.Equal(MsgToDeliver{
+			Stream:   "stream-1",
+			Subject:  "orders.>",
+			Consumer: "consumer-1",
+			Sequence: MsgToDeliverSeq{Stream: 27, Consumer: 14},
+			Message:  msg.Data,
+		}, deliver)
+
+		export, err := envelope.ToExport()
+		assert.Nil(err)
+		assert.Equal(uint64(27), export.Sequence)
+		assert.Equal(envelope.JetStream.Timestamp, export.Timestamp)
+
+		tail, err := envelope.ToTail()
+		assert.Nil(err)
+		assert.Equal(json.RawMessage(msg.Data), tail.JSON)
+		assert.Equal(8, tail.Size)
+	}
+
+	// Case 1: core NATS messages have no legacy formats
+	{
+		core := NewMsgEnvelope(nats.NewMsg("test-subject"))
+		assert.Nil(core.JetStream)
+		assert.Equal("test-subject", core.String())
+		_, err := core.ToDeliver("test-subject")
+		assert.NotNil(err)
+		_, err = core.ToExport()
+		assert.NotNil(err)
+		_, err = core.ToTail()
+		assert.NotNil(err)
+	}
+
+	// Case 2: payload encodings the payload does not fit
+	{
+		binary := NewMsgEnvelope(benchDeliveryMsg("s", "c", []byte{0xff}, nil))
+		_, err := binary.WithEncoding(PayloadEncodingJSON)
+		assert.NotNil(err)
+		_, err = binary.WithEncoding(PayloadEncodingText)
+		assert.NotNil(err)
+		_, err = binary.WithEncoding("yaml")
+		assert.NotNil(err)
+		readable, err := binary.WithEncoding("")
+		assert.Nil(err)
+		assert.Equal(PayloadEncodingBase64, readable.Encoding)
+	}
+
+	// Case 3: unknown payload encoding is rejected when decoding
+	{
+		var decoded MsgEnvelope
+		err := json.Unmarshal([]byte(`{"subject":"s","encoding":"yaml","payload":"a: 1"}`), &decoded)
+		assert.NotNil(err)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DispatchSource is one (stream, consumer) pair read by a multi-source subscription
+type DispatchSource struct {
+	// Stream is the name of the stream
+	Stream string
+	// Consumer is the name of the consumer
+	Consumer string
+	// Subject is the subject filter of the subscription through the consumer
+	Subject string
+	// Dispatcher reads the messages through the consumer
+	Dispatcher MessageDispatcher
+}
+
+// Tag returns the tag identifying the source in the messages delivered from it
+func (s DispatchSource) Tag() string {
+	return DispatchSourceTag(s.Stream, s.Consumer)
+}
+
+// DispatchSourceTag returns the source tag of a (stream, consumer) pair
+func DispatchSourceTag(stream, consumer string) string {
+	return fmt.Sprintf("%s/%s", stream, consumer)
+}
+
+// MultiSourceDispatcher is a MessageDispatcher which reads from several (stream, consumer)
+// pairs, and forwards their messages through one output
+type MultiSourceDispatcher interface {
+	MessageDispatcher
+	// Source returns the source a message was read from
+	Source(msg *nats.Msg) (DispatchSource, error)
+}
+
+// multiSourceDispatcher implements MultiSourceDispatcher
+type multiSourceDispatcher struct {
+	sources map[string]DispatchSource
+	// order the source tags in the order given
+	order []string
+}
+
+// GetMultiSourceDispatcher define a new MultiSourceDispatcher
+//
+// Each source must be a different (stream, consumer) pair. The ACKs of a message are
+// routed to its own source as usual, as the message records its stream and consumer.
+func GetMultiSourceDispatcher(sources []DispatchSource) (MultiSourceDispatcher, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no dispatch sources given")
+	}
+	instance := &multiSourceDispatcher{
+		sources: map[string]DispatchSource{}, order: make([]string, 0, len(sources)),
+	}
+	for _, source := range sources {
+		if source.Dispatcher == nil {
+			return nil, fmt.Errorf("dispatch source %s has no dispatcher", source.Tag())
+		}
+		if _, ok := instance.sources[source.Tag()]; ok {
+			return nil, fmt.Errorf("dispatch source %s given multiple times", source.Tag())
+		}
+		instance.sources[source.Tag()] = source
+		instance.order = append(instance.order, source.Tag())
+	}
+	return instance, nil
+}
+
+// Start starts reading from every source. The sources started before a failure keep
+// running until the context of their dispatcher ends.
+func (d *multiSourceDispatcher) Start(
+	msgOutput ForwardMessageHandlerCB, errorCB AlertOnErrorCB,
+) error {
+	for _, tag := range d.order {
+		if err := d.sources[tag].Dispatcher.Start(msgOutput, errorCB); err != nil {
+			return fmt.Errorf("source %s: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+// Consumer returns the names of the consumers messages are dispatched for
+func (d *multiSourceDispatcher) Consumer() string {
+	consumers := make([]string, 0, len(d.order))
+	for _, tag := range d.order {
+		consumers = append(consumers, d.sources[tag].Dispatcher.Consumer())
+	}
+	return strings.Join(consumers, ",")
+}
+
+// Redeliver forwards again messages delivered earlier, each through its own source
+func (d *multiSourceDispatcher) Redeliver(msgs []*nats.Msg) error {
+	bySource := map[string][]*nats.Msg{}
+	for _, msg := range msgs {
+		source, err := d.Source(msg)
+		if err != nil {
+			return err
+		}
+		bySource[source.Tag()] = append(bySource[source.Tag()], msg)
+	}
+	for _, tag := range d.order {
+		if len(bySource[tag]) == 0 {
+			continue
+		}
+		if err := d.sources[tag].Dispatcher.Redeliver(bySource[tag]); err != nil {
+			return fmt.Errorf("source %s: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+// Nak gives back a forwarded message through its own source
+func (d *multiSourceDispatcher) Nak(msg *nats.Msg) error {
+	source, err := d.Source(msg)
+	if err != nil {
+		return err
+	}
+	return source.Dispatcher.Nak(msg)
+}
+
+// WarmUp returns the combined delivery warm-up progress of the sources. Warm-up is active
+// while any source is still warming up.
+func (d *multiSourceDispatcher) WarmUp() (WarmUpProgress, bool) {
+	var combined WarmUpProgress
+	enabled := false
+	for _, tag := range d.order {
+		progress, ok := d.sources[tag].Dispatcher.WarmUp()
+		if !ok {
+			continue
+		}
+		enabled = true
+		combined.Active = combined.Active || progress.Active
+		combined.Rate += progress.Rate
+		combined.Backlog += progress.Backlog
+		combined.Delivered += progress.Delivered
+		combined.Pending += progress.Pending
+	}
+	return combined, enabled
+}
+
+// Stop tears down every source immediately
+func (d *multiSourceDispatcher) Stop(ctxt context.Context) error {
+	return d.eachSource(func(dispatcher MessageDispatcher) error {
+		return dispatcher.Stop(ctxt)
+	})
+}
+
+// Drain drains every source together, so no source reads new messages while another
+// is still draining
+func (d *multiSourceDispatcher) Drain(ctxt context.Context) error {
+	return d.eachSource(func(dispatcher MessageDispatcher) error {
+		return dispatcher.Drain(ctxt)
+	})
+}
+
+// Inflight lists the messages of every source awaiting ACK, oldest first
+func (d *multiSourceDispatcher) Inflight(ctxt context.Context) ([]InflightMessage, error) {
+	listed := []InflightMessage{}
+	for _, tag := range d.order {
+		msgs, err := d.sources[tag].Dispatcher.Inflight(ctxt)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", tag, err)
+		}
+		listed = append(listed, msgs...)
+	}
+	sort.SliceStable(listed, func(i, j int) bool {
+		return listed[i].Received.Before(listed[j].Received)
+	})
+	return listed, nil
+}
+
+// eachSource helper function to call op on the dispatcher of every source concurrently.
+// Returns the error of the first source in order which failed.
+func (d *multiSourceDispatcher) eachSource(op func(dispatcher MessageDispatcher) error) error {
+	errs := make([]error, len(d.order))
+	wg := sync.WaitGroup{}
+	for idx, tag := range d.order {
+		wg.Add(1)
+		go func(idx int, dispatcher MessageDispatcher) {
+			defer wg.Done()
+			errs[idx] = op(dispatcher)
+		}(idx, d.sources[tag].Dispatcher)
+	}
+	wg.Wait()
+	for idx, err := range errs {
+		if err != nil {
+			return fmt.Errorf("source %s: %w", d.order[idx], err)
+		}
+	}
+	return nil
+}
+
+// Source returns the source a message was read from
+func (d *multiSourceDispatcher) Source(msg *nats.Msg) (DispatchSource, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return DispatchSource{}, err
+	}
+	source, ok := d.sources[DispatchSourceTag(meta.Stream, meta.Consumer)]
+	if !ok {
+		return DispatchSource{}, fmt.Errorf(
+			"message of %s is not from a dispatch source", DispatchSourceTag(meta.Stream, meta.Consumer),
+		)
+	}
+	return source, nil
+}
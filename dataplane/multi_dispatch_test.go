@@ -0,0 +1,205 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingDispatcher is a MessageDispatcher recording the calls made to it
+type recordingDispatcher struct {
+	consumer    string
+	startErr    error
+	started     bool
+	redelivered []*nats.Msg
+	naked       []*nats.Msg
+	warmUp      WarmUpProgress
+	stopped     bool
+	drainErr    error
+	drained     bool
+	inflight    []InflightMessage
+}
+
+func (d *recordingDispatcher) Start(ForwardMessageHandlerCB, AlertOnErrorCB) error {
+	d.started = d.startErr == nil
+	return d.startErr
+}
+
+func (d *recordingDispatcher) Consumer() string {
+	return d.consumer
+}
+
+func (d *recordingDispatcher) Redeliver(msgs []*nats.Msg) error {
+	d.redelivered = append(d.redelivered, msgs...)
+	return nil
+}
+
+func (d *recordingDispatcher) Nak(msg *nats.Msg) error {
+	d.naked = append(d.naked, msg)
+	return nil
+}
+
+func (d *recordingDispatcher) WarmUp() (WarmUpProgress, bool) {
+	return d.warmUp, d.warmUp.Backlog > 0
+}
+
+func (d *recordingDispatcher) Stop(context.Context) error {
+	d.stopped = true
+	return nil
+}
+
+func (d *recordingDispatcher) Drain(context.Context) error {
+	d.drained = d.drainErr == nil
+	return d.drainErr
+}
+
+func (d *recordingDispatcher) Inflight(context.Context) ([]InflightMessage, error) {
+	return d.inflight, nil
+}
+
+func TestMultiSourceDispatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	sourceMsg := func(stream, consumer string, seq int) *nats.Msg {
+		return &nats.Msg{
+			Subject: "subject",
+			Reply: fmt.Sprintf(
+				"$JS.ACK.%s.%s.1.%d.%d.1634000000000000000.0", stream, consumer, seq, seq,
+			),
+			Sub: &nats.Subscription{},
+		}
+	}
+	noop := func(*nats.Msg, context.Context) error { return nil }
+
+	// Case 0: invalid sources
+	{
+		_, err := GetMultiSourceDispatcher(nil)
+		assert.NotNil(err)
+		_, err = GetMultiSourceDispatcher([]DispatchSource{{Stream: "s1", Consumer: "c1"}})
+		assert.NotNil(err)
+		_, err = GetMultiSourceDispatcher([]DispatchSource{
+			{Stream: "s1", Consumer: "c1", Dispatcher: &recordingDispatcher{}},
+			{Stream: "s1", Consumer: "c1", Dispatcher: &recordingDispatcher{}},
+		})
+		assert.NotNil(err)
+	}
+
+	first := &recordingDispatcher{consumer: "c1"}
+	second := &recordingDispatcher{consumer: "c2"}
+	uut, err := GetMultiSourceDispatcher([]DispatchSource{
+		{Stream: "s1", Consumer: "c1", Subject: "a.>", Dispatcher: first},
+		{Stream: "s2", Consumer: "c2", Subject: "b.*", Dispatcher: second},
+	})
+	assert.Nil(err)
+
+	// Case 1: start every source
+	{
+		assert.Nil(uut.Start(noop, func(error) {}))
+		assert.True(first.started)
+		assert.True(second.started)
+		assert.Equal("c1,c2", uut.Consumer())
+	}
+
+	// Case 2: find the source of messages
+	{
+		source, err := uut.Source(sourceMsg("s2", "c2", 3))
+		assert.Nil(err)
+		assert.Equal("s2/c2", source.Tag())
+		assert.Equal("b.*", source.Subject)
+		_, err = uut.Source(sourceMsg("s2", "c1", 3))
+		assert.NotNil(err)
+		_, err = uut.Source(&nats.Msg{Subject: "subject"})
+		assert.NotNil(err)
+	}
+
+	// Case 3: redeliver through each message's source
+	{
+		msgs := []*nats.Msg{sourceMsg("s1", "c1", 1), sourceMsg("s2", "c2", 2), sourceMsg("s1", "c1", 4)}
+		assert.Nil(uut.Redeliver(msgs))
+		assert.Equal([]*nats.Msg{msgs[0], msgs[2]}, first.redelivered)
+		assert.Equal([]*nats.Msg{msgs[1]}, second.redelivered)
+	}
+
+	// Case 4: combine the warm-up progress of the sources warming up
+	{
+		_, ok := uut.WarmUp()
+		assert.False(ok)
+		first.warmUp = WarmUpProgress{Rate: 40, Backlog: 10, Delivered: 10}
+		second.warmUp = WarmUpProgress{Active: true, Rate: 20, Backlog: 30, Delivered: 5, Pending: 25}
+		progress, ok := uut.WarmUp()
+		assert.True(ok)
+		assert.Equal(
+			WarmUpProgress{Active: true, Rate: 60, Backlog: 40, Delivered: 15, Pending: 25}, progress,
+		)
+	}
+
+	// Case 5: a source failing to start
+	{
+		failing, err := GetMultiSourceDispatcher([]DispatchSource{
+			{Stream: "s1", Consumer: "c1", Dispatcher: &recordingDispatcher{}},
+			{
+				Stream: "s2", Consumer: "c2",
+				Dispatcher: &recordingDispatcher{startErr: fmt.Errorf("no consumer")},
+			},
+		})
+		assert.Nil(err)
+		assert.NotNil(failing.Start(noop, func(error) {}))
+	}
+
+	// Case 6: drain and stop every source, reporting the source failing to drain
+	{
+		second.drainErr = fmt.Errorf("ACK timeout")
+		err := uut.Drain(context.Background())
+		assert.NotNil(err)
+		assert.ErrorIs(err, second.drainErr)
+		assert.True(first.drained)
+		assert.False(second.drained)
+		assert.Nil(uut.Stop(context.Background()))
+		assert.True(first.stopped)
+		assert.True(second.stopped)
+	}
+
+	// Case 7: list the inflight messages of every source, oldest first
+	{
+		start := time.Unix(1000, 0)
+		first.inflight = []InflightMessage{
+			{Stream: "s1", Consumer: "c1", StreamSeq: 3, Received: start.Add(time.Second * 2)},
+		}
+		second.inflight = []InflightMessage{
+			{Stream: "s2", Consumer: "c2", StreamSeq: 7, Received: start},
+			{Stream: "s2", Consumer: "c2", StreamSeq: 8, Received: start.Add(time.Second * 3)},
+		}
+		listed, err := uut.Inflight(context.Background())
+		assert.Nil(err)
+		assert.Equal(
+			[]InflightMessage{second.inflight[0], first.inflight[0], second.inflight[1]}, listed,
+		)
+	}
+
+	// Case 8: NAK through each message's source
+	{
+		msg := sourceMsg("s2", "c2", 9)
+		assert.Nil(uut.Nak(msg))
+		assert.Empty(first.naked)
+		assert.Equal([]*nats.Msg{msg}, second.naked)
+		assert.NotNil(uut.Nak(&nats.Msg{Subject: "subject"}))
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// PayloadAccess is what of a message a principal can see when browsing a stream
+type PayloadAccess string
+
+const (
+	// PayloadAccessFull the message payload, and its metadata
+	PayloadAccessFull PayloadAccess = "full"
+	// PayloadAccessMetadata only the subject, headers, size, and sequence of the message
+	PayloadAccessMetadata PayloadAccess = "metadata"
+)
+
+// PayloadAccessRule grants principals an access to the messages of streams
+type PayloadAccessRule struct {
+	// Principals are the authenticated principals the rule applies to
+	Principals []string `json:"principals" validate:"min=1,dive,required"`
+	// Streams are the streams the rule applies to. If empty, the rule applies to all streams.
+	Streams []string `json:"streams,omitempty" validate:"dive,required"`
+	// Access is the access granted
+	Access PayloadAccess `json:"access" validate:"oneof=full metadata"`
+}
+
+// appliesTo whether the rule applies to a principal browsing a stream
+func (r PayloadAccessRule) appliesTo(principal, stream string) bool {
+	matched := false
+	for _, name := range r.Principals {
+		if name == principal {
+			matched = true
+			break
+		}
+	}
+	if !matched || len(r.Streams) == 0 {
+		return matched
+	}
+	for _, name := range r.Streams {
+		if name == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// PayloadAccessPolicy decides the access of principals to the messages browsed
+type PayloadAccessPolicy struct {
+	// DefaultAccess is the access of principals no rule applies to, including requests
+	// without an authenticated principal
+	DefaultAccess PayloadAccess `json:"default_access" validate:"oneof=full metadata"`
+	// Rules are checked in order; the first rule applying to a principal and stream decides
+	Rules []PayloadAccessRule `json:"rules,omitempty" validate:"dive"`
+}
+
+// LoadPayloadAccessPolicy read a payload access policy from a JSON file
+func LoadPayloadAccessPolicy(path string) (PayloadAccessPolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return PayloadAccessPolicy{}, err
+	}
+	var policy PayloadAccessPolicy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return PayloadAccessPolicy{}, fmt.Errorf(
+			"unable to parse payload access policy %s: %w", path, err,
+		)
+	}
+	return policy, nil
+}
+
+// PayloadAccessControl decides whether a principal browsing a stream sees message payloads
+type PayloadAccessControl interface {
+	// Access returns the access of a principal to the messages of a stream. principal is
+	// empty for requests without an authenticated principal.
+	Access(principal, stream string) PayloadAccess
+}
+
+// payloadAccessControlImpl implements PayloadAccessControl
+type payloadAccessControlImpl struct {
+	policy PayloadAccessPolicy
+}
+
+// GetPayloadAccessControl define new PayloadAccessControl given the policy
+func GetPayloadAccessControl(policy PayloadAccessPolicy) (PayloadAccessControl, error) {
+	if err := validator.New().Struct(&policy); err != nil {
+		return nil, fmt.Errorf("payload access policy invalid: %w", err)
+	}
+	return &payloadAccessControlImpl{policy: policy}, nil
+}
+
+// Access returns the access of a principal to the messages of a stream
+func (c *payloadAccessControlImpl) Access(principal, stream string) PayloadAccess {
+	if principal != "" {
+		for _, rule := range c.policy.Rules {
+			if rule.appliesTo(principal, stream) {
+				return rule.Access
+			}
+		}
+	}
+	return c.policy.DefaultAccess
+}
@@ -0,0 +1,76 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadAccessControl(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid policies
+	{
+		_, err := GetPayloadAccessControl(PayloadAccessPolicy{DefaultAccess: "none"})
+		assert.NotNil(err)
+		_, err = GetPayloadAccessControl(PayloadAccessPolicy{
+			DefaultAccess: PayloadAccessFull,
+			Rules:         []PayloadAccessRule{{Access: PayloadAccessMetadata}},
+		})
+		assert.NotNil(err)
+	}
+
+	uut, err := GetPayloadAccessControl(PayloadAccessPolicy{
+		DefaultAccess: PayloadAccessMetadata,
+		Rules: []PayloadAccessRule{
+			{Principals: []string{"support"}, Streams: []string{"orders"}, Access: PayloadAccessMetadata},
+			{Principals: []string{"support", "oncall"}, Access: PayloadAccessFull},
+		},
+	})
+	assert.Nil(err)
+
+	// Case 1: principal without a rule, or no principal
+	assert.Equal(PayloadAccessMetadata, uut.Access("guest", "orders"))
+	assert.Equal(PayloadAccessMetadata, uut.Access("", "orders"))
+
+	// Case 2: first rule applying decides
+	assert.Equal(PayloadAccessMetadata, uut.Access("support", "orders"))
+	assert.Equal(PayloadAccessFull, uut.Access("support", "audit"))
+	assert.Equal(PayloadAccessFull, uut.Access("oncall", "orders"))
+}
+
+func TestLoadPayloadAccessPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	assert.Nil(os.WriteFile(
+		path,
+		[]byte(`{"default_access": "full", "rules": [{"principals": ["support"], "access": "metadata"}]}`),
+		0600,
+	))
+	policy, err := LoadPayloadAccessPolicy(path)
+	assert.Nil(err)
+	assert.Equal(PayloadAccessFull, policy.DefaultAccess)
+	assert.Len(policy.Rules, 1)
+	assert.Equal(PayloadAccessMetadata, policy.Rules[0].Access)
+
+	assert.Nil(os.WriteFile(path, []byte(`not json`), 0600))
+	_, err = LoadPayloadAccessPolicy(path)
+	assert.NotNil(err)
+}
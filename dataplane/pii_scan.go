@@ -0,0 +1,330 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/metrics"
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrPIIRejected is reported for a message containing PII published to a stream which
+// rejects such messages
+var ErrPIIRejected = errors.New("message contains PII")
+
+// PIIDetectedHeader lists the detectors which found PII in a message tagged by its stream
+const PIIDetectedHeader = "Httpmq-PII-Detected"
+
+// PIIAction is what is done with a message in which PII was found
+type PIIAction string
+
+const (
+	// PIIActionReject rejects the publish
+	PIIActionReject PIIAction = "reject"
+	// PIIActionRedact replaces the PII with RedactedValue before publishing
+	PIIActionRedact PIIAction = "redact"
+	// PIIActionTag publishes the message with PIIDetectedHeader
+	PIIActionTag PIIAction = "tag"
+)
+
+// Built-in PII detectors
+const (
+	// PIIDetectorEmail finds email addresses
+	PIIDetectorEmail = "email"
+	// PIIDetectorCreditCard finds payment card numbers, which pass the Luhn check
+	PIIDetectorCreditCard = "credit_card"
+)
+
+// PIIDetector describes how to find one kind of PII in a message
+type PIIDetector struct {
+	// Pattern is a regular expression matching the PII
+	Pattern string `json:"pattern,omitempty" validate:"required_without=Words"`
+	// Words is a dictionary of words and phrases which are PII, matched case-insensitively
+	// as whole words
+	Words []string `json:"words,omitempty" validate:"dive,required"`
+}
+
+// PIIPolicy decides what is done with messages containing PII published to a stream
+type PIIPolicy struct {
+	// Detectors are the names of the detectors applied, built-in or defined by the rules
+	Detectors []string `json:"detectors" validate:"required,min=1,dive,required"`
+	// Action is what is done with a message in which any of the detectors found PII
+	Action PIIAction `json:"action" validate:"required,oneof=reject redact tag"`
+}
+
+// PIIScanRules are the PII detectors, and the PII policy of each stream
+type PIIScanRules struct {
+	// Detectors are detectors in addition to the built-in ones, by name. A detector named
+	// after a built-in one replaces it.
+	Detectors map[string]PIIDetector `json:"detectors,omitempty" validate:"dive"`
+	// Streams are the PII policies of each stream. Messages to other streams are not scanned.
+	Streams map[string]PIIPolicy `json:"streams" validate:"dive"`
+}
+
+// LoadPIIScanRules read the PII scan rules from a JSON file
+func LoadPIIScanRules(path string) (PIIScanRules, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return PIIScanRules{}, err
+	}
+	var rules PIIScanRules
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return PIIScanRules{}, fmt.Errorf("unable to parse PII scan rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// PIIScanResult is the outcome of scanning a message for PII
+type PIIScanResult struct {
+	// Stream is the stream storing the message's subject, if any
+	Stream string
+	// Action is the action taken for the stream, if PII was found
+	Action PIIAction
+	// Detected are the names of the detectors which found PII, sorted
+	Detected []string
+	// Message is the message to publish, which is redacted if Action is PIIActionRedact
+	Message []byte
+}
+
+// PIIScanner checks messages for PII before they are published
+type PIIScanner interface {
+	// Scan checks a message published to a subject for PII, with the policy of the stream
+	// storing the subject. Returns an error wrapping ErrPIIRejected if the message is
+	// rejected.
+	Scan(subject string, msg []byte, ctxt context.Context) (PIIScanResult, error)
+}
+
+// piiDetectorImpl is a compiled PIIDetector
+type piiDetectorImpl struct {
+	name    string
+	pattern *regexp.Regexp
+	// check optionally confirms a match is PII
+	check func(match []byte) bool
+}
+
+// builtinPIIDetectors the built-in detectors, by name
+var builtinPIIDetectors = map[string]piiDetectorImpl{
+	PIIDetectorEmail: {
+		name:    PIIDetectorEmail,
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	},
+	PIIDetectorCreditCard: {
+		name:    PIIDetectorCreditCard,
+		pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		check:   luhnValid,
+	},
+}
+
+// luhnValid helper function to check the digits of a card number with the Luhn algorithm.
+// Separators are ignored.
+func luhnValid(number []byte) bool {
+	sum := 0
+	double := false
+	for idx := len(number) - 1; idx >= 0; idx-- {
+		if number[idx] < '0' || number[idx] > '9' {
+			continue
+		}
+		digit := int(number[idx] - '0')
+		if double {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// compilePIIDetector helper function to compile a detector defined by the rules
+func compilePIIDetector(name string, detector PIIDetector) (piiDetectorImpl, error) {
+	patterns := []string{}
+	if detector.Pattern != "" {
+		patterns = append(patterns, detector.Pattern)
+	}
+	if len(detector.Words) > 0 {
+		words := make([]string, len(detector.Words))
+		for idx, word := range detector.Words {
+			words[idx] = regexp.QuoteMeta(word)
+		}
+		patterns = append(patterns, `(?i)\b(?:`+strings.Join(words, "|")+`)\b`)
+	}
+	pattern, err := regexp.Compile(strings.Join(patterns, "|"))
+	if err != nil {
+		return piiDetectorImpl{}, fmt.Errorf("PII detector %s pattern invalid: %w", name, err)
+	}
+	return piiDetectorImpl{name: name, pattern: pattern}, nil
+}
+
+// find the byte ranges of msg the detector finds PII in
+func (d piiDetectorImpl) find(msg []byte) [][]int {
+	var found [][]int
+	for _, loc := range d.pattern.FindAllIndex(msg, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		if d.check == nil || d.check(msg[loc[0]:loc[1]]) {
+			found = append(found, loc)
+		}
+	}
+	return found
+}
+
+// piiStreamPolicy the compiled PII policy of a stream
+type piiStreamPolicy struct {
+	action    PIIAction
+	detectors []piiDetectorImpl
+}
+
+// piiScannerImpl implements PIIScanner
+type piiScannerImpl struct {
+	policies map[string]piiStreamPolicy
+	streams  *subjectStreamCache
+	metrics  metrics.PIIDetectionMetrics
+}
+
+// GetPIIScanner define new PIIScanner given the scan rules. The stream storing a subject is
+// looked up through natsClient, and cached for cacheTTL. Detections are recorded with
+// detectionMetrics, if not nil.
+func GetPIIScanner(
+	natsClient *core.NatsClient,
+	rules PIIScanRules,
+	cacheTTL time.Duration,
+	detectionMetrics metrics.PIIDetectionMetrics,
+) (PIIScanner, error) {
+	if err := validator.New().Struct(&rules); err != nil {
+		return nil, fmt.Errorf("PII scan rules invalid: %w", err)
+	}
+	if cacheTTL <= 0 {
+		return nil, fmt.Errorf("PII scan stream cache TTL must be positive")
+	}
+	detectors := map[string]piiDetectorImpl{}
+	for name, detector := range builtinPIIDetectors {
+		detectors[name] = detector
+	}
+	for name, detector := range rules.Detectors {
+		compiled, err := compilePIIDetector(name, detector)
+		if err != nil {
+			return nil, err
+		}
+		detectors[name] = compiled
+	}
+	policies := map[string]piiStreamPolicy{}
+	for stream, policy := range rules.Streams {
+		names := append([]string{}, policy.Detectors...)
+		sort.Strings(names)
+		compiled := piiStreamPolicy{action: policy.Action}
+		for _, name := range names {
+			detector, ok := detectors[name]
+			if !ok {
+				return nil, fmt.Errorf("stream %s PII policy uses unknown detector %s", stream, name)
+			}
+			compiled.detectors = append(compiled.detectors, detector)
+		}
+		policies[stream] = compiled
+	}
+	return &piiScannerImpl{
+		policies: policies,
+		streams:  newSubjectStreamCache(natsClient, cacheTTL),
+		metrics:  detectionMetrics,
+	}, nil
+}
+
+// Scan checks a message published to a subject for PII, with the policy of the stream
+// storing the subject. Returns an error wrapping ErrPIIRejected if the message is rejected.
+func (s *piiScannerImpl) Scan(
+	subject string, msg []byte, ctxt context.Context,
+) (PIIScanResult, error) {
+	result := PIIScanResult{Message: msg}
+	if len(s.policies) == 0 {
+		return result, nil
+	}
+	stream, err := s.streams.get(subject, ctxt)
+	if err != nil {
+		return result, fmt.Errorf("unable to find the stream of %s: %w", subject, err)
+	}
+	result.Stream = stream
+	policy, ok := s.policies[stream]
+	if !ok {
+		return result, nil
+	}
+
+	var found [][]int
+	for _, detector := range policy.detectors {
+		locs := detector.find(msg)
+		if len(locs) == 0 {
+			continue
+		}
+		result.Detected = append(result.Detected, detector.name)
+		found = append(found, locs...)
+		if s.metrics != nil {
+			s.metrics.RecordDetection(stream, detector.name, string(policy.action))
+		}
+	}
+	if len(result.Detected) == 0 {
+		return result, nil
+	}
+	result.Action = policy.action
+
+	switch policy.action {
+	case PIIActionReject:
+		return result, fmt.Errorf(
+			"stream %s: %w: %s", stream, ErrPIIRejected, strings.Join(result.Detected, ", "),
+		)
+	case PIIActionRedact:
+		result.Message = redactRanges(msg, found)
+		// Redacting a JSON number or literal leaves the message malformed
+		if json.Valid(msg) && !json.Valid(result.Message) {
+			return result, fmt.Errorf(
+				"stream %s: %w: unable to redact %s without breaking the JSON message",
+				stream,
+				ErrPIIRejected,
+				strings.Join(result.Detected, ", "),
+			)
+		}
+	}
+	return result, nil
+}
+
+// redactRanges helper function to replace the byte ranges of msg with RedactedValue.
+// Overlapping ranges are merged.
+func redactRanges(msg []byte, ranges [][]int) []byte {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var redacted bytes.Buffer
+	next := 0
+	for _, loc := range ranges {
+		if loc[1] <= next {
+			continue
+		}
+		if loc[0] >= next {
+			redacted.Write(msg[next:loc[0]])
+			redacted.WriteString(RedactedValue)
+		}
+		next = loc[1]
+	}
+	redacted.Write(msg[next:])
+	return redacted.Bytes()
+}
@@ -0,0 +1,181 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePIIMetrics records the PII detections
+type fakePIIMetrics struct {
+	detections []string
+}
+
+func (m *fakePIIMetrics) RecordDetection(stream, detector, action string) {
+	m.detections = append(m.detections, stream+"/"+detector+"/"+action)
+}
+
+func TestPIIScanner(t *testing.T) {
+	assert := assert.New(t)
+	ctxt := context.Background()
+
+	// Case 0: invalid rules
+	{
+		_, err := GetPIIScanner(nil, PIIScanRules{
+			Streams: map[string]PIIPolicy{"orders": {Detectors: []string{"email"}, Action: "drop"}},
+		}, time.Minute, nil)
+		assert.NotNil(err)
+		_, err = GetPIIScanner(nil, PIIScanRules{
+			Streams: map[string]PIIPolicy{"orders": {Detectors: []string{"ssn"}, Action: "tag"}},
+		}, time.Minute, nil)
+		assert.NotNil(err)
+		_, err = GetPIIScanner(nil, PIIScanRules{
+			Detectors: map[string]PIIDetector{"ssn": {}},
+		}, time.Minute, nil)
+		assert.NotNil(err)
+		_, err = GetPIIScanner(nil, PIIScanRules{
+			Detectors: map[string]PIIDetector{"ssn": {Pattern: `(`}},
+		}, time.Minute, nil)
+		assert.NotNil(err)
+	}
+
+	recorded := &fakePIIMetrics{}
+	scanner, err := GetPIIScanner(nil, PIIScanRules{
+		Detectors: map[string]PIIDetector{
+			"ssn":       {Pattern: `\b\d{3}-\d{2}-\d{4}\b`},
+			"diagnosis": {Words: []string{"diabetes", "heart disease"}},
+		},
+		Streams: map[string]PIIPolicy{
+			"payments": {Detectors: []string{"credit_card", "email"}, Action: PIIActionReject},
+			"orders": {
+				Detectors: []string{"email", "ssn", "credit_card"}, Action: PIIActionRedact,
+			},
+			"health": {Detectors: []string{"diagnosis"}, Action: PIIActionTag},
+		},
+	}, time.Minute, recorded)
+	assert.Nil(err)
+	scanner.(*piiScannerImpl).streams.lookup = func(
+		subject string, ctxt context.Context,
+	) (string, error) {
+		switch subject {
+		case "payments.new", "orders.new", "health.new":
+			return subject[:len(subject)-4], nil
+		}
+		return "", ErrNoStreamForSubject
+	}
+
+	// Case 1: rejected publishes; card numbers must pass the Luhn check
+	{
+		result, err := scanner.Scan("payments.new", []byte(`card 4111 1111 1111 1111`), ctxt)
+		assert.ErrorIs(err, ErrPIIRejected)
+		assert.Equal(PIIActionReject, result.Action)
+		assert.Equal([]string{"credit_card"}, result.Detected)
+		_, err = scanner.Scan("payments.new", []byte(`from a.b@example.com`), ctxt)
+		assert.ErrorIs(err, ErrPIIRejected)
+		result, err = scanner.Scan("payments.new", []byte(`order 4111111111111112`), ctxt)
+		assert.Nil(err)
+		assert.Empty(result.Action)
+		assert.Equal("payments", result.Stream)
+	}
+
+	// Case 2: redacted publishes
+	{
+		result, err := scanner.Scan(
+			"orders.new", []byte(`{"to":"x@example.org","ssn":"123-45-6789","n":1}`), ctxt,
+		)
+		assert.Nil(err)
+		assert.Equal(PIIActionRedact, result.Action)
+		assert.Equal([]string{"email", "ssn"}, result.Detected)
+		assert.Equal(`{"to":"[REDACTED]","ssn":"[REDACTED]","n":1}`, string(result.Message))
+		// Redacting a JSON number would leave malformed JSON
+		_, err = scanner.Scan("orders.new", []byte(`{"card":4111111111111111}`), ctxt)
+		assert.ErrorIs(err, ErrPIIRejected)
+	}
+
+	// Case 3: tagged publishes, with dictionary words matched case-insensitively
+	{
+		msg := []byte(`patient has Heart Disease`)
+		result, err := scanner.Scan("health.new", msg, ctxt)
+		assert.Nil(err)
+		assert.Equal(PIIActionTag, result.Action)
+		assert.Equal([]string{"diagnosis"}, result.Detected)
+		assert.Equal(msg, result.Message)
+		result, err = scanner.Scan("health.new", []byte(`prediabetes screening`), ctxt)
+		assert.Nil(err)
+		assert.Empty(result.Detected)
+	}
+
+	// Case 4: subjects without a policy are not scanned
+	{
+		msg := []byte(`x@example.org`)
+		result, err := scanner.Scan("other", msg, ctxt)
+		assert.Nil(err)
+		assert.Empty(result.Action)
+		assert.Equal(msg, result.Message)
+	}
+
+	assert.Equal(
+		[]string{
+			"payments/credit_card/reject",
+			"payments/email/reject",
+			"orders/email/redact",
+			"orders/ssn/redact",
+			"orders/credit_card/redact",
+			"health/diagnosis/tag",
+		},
+		recorded.detections,
+	)
+}
+
+func TestRedactRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("a [REDACTED] b", string(redactRanges([]byte("a xyz b"), [][]int{{2, 5}})))
+	// Overlapping ranges are merged
+	assert.Equal(
+		"[REDACTED]!", string(redactRanges([]byte("abcdef!"), [][]int{{2, 6}, {0, 4}})),
+	)
+	assert.Equal("x", string(redactRanges([]byte("x"), nil)))
+}
+
+func TestLoadPIIScanRules(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "pii.json")
+	assert.Nil(os.WriteFile(path, []byte(`{
+		"detectors": {"ssn": {"pattern": "\\d{3}-\\d{2}-\\d{4}"}},
+		"streams": {"orders": {"detectors": ["email", "ssn"], "action": "redact"}}
+	}`), 0600))
+	rules, err := LoadPIIScanRules(path)
+	assert.Nil(err)
+	assert.Equal(`\d{3}-\d{2}-\d{4}`, rules.Detectors["ssn"].Pattern)
+	assert.Equal(
+		PIIPolicy{Detectors: []string{"email", "ssn"}, Action: PIIActionRedact},
+		rules.Streams["orders"],
+	)
+
+	assert.Nil(os.WriteFile(path, []byte(`{`), 0600))
+	_, err = LoadPIIScanRules(path)
+	assert.NotNil(err)
+	_, err = LoadPIIScanRules(filepath.Join(t.TempDir(), "missing.json"))
+	assert.True(errors.Is(err, os.ErrNotExist))
+}
@@ -0,0 +1,109 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrNotPublicStream the stream is not open to anonymous subscribers
+var ErrNotPublicStream = fmt.Errorf("stream is not public")
+
+// ErrPublicConnectionLimit the client address has too many connections to a public stream
+var ErrPublicConnectionLimit = fmt.Errorf("too many connections to public stream")
+
+// PublicStream settings of a stream open to anonymous, read-only subscribers
+type PublicStream struct {
+	// MaxConnectionsPerIP is the most concurrent connections to the stream from one client
+	// address
+	MaxConnectionsPerIP int `json:"max_connections_per_ip" validate:"gt=0"`
+}
+
+// LoadPublicStreams read the public streams, by stream name, from a JSON file
+func LoadPublicStreams(path string) (map[string]PublicStream, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var streams map[string]PublicStream
+	if err := json.Unmarshal(content, &streams); err != nil {
+		return nil, fmt.Errorf("unable to parse public streams %s: %w", path, err)
+	}
+	return streams, nil
+}
+
+// PublicStreamGate admits anonymous subscribers to the public streams
+type PublicStreamGate interface {
+	// Admit admits a connection from a client address to a stream. The returned function
+	// must be called once the connection ends.
+	Admit(stream, clientAddr string) (func(), error)
+}
+
+// publicStreamKey identifies the connections of a client address to a stream
+type publicStreamKey struct {
+	stream     string
+	clientAddr string
+}
+
+// publicStreamGateImpl implements PublicStreamGate
+type publicStreamGateImpl struct {
+	streams     map[string]PublicStream
+	lock        sync.Mutex
+	connections map[publicStreamKey]int
+}
+
+// GetPublicStreamGate define new PublicStreamGate given the public streams
+func GetPublicStreamGate(streams map[string]PublicStream) (PublicStreamGate, error) {
+	validate := validator.New()
+	for name, stream := range streams {
+		stream := stream
+		if err := validate.Struct(&stream); err != nil {
+			return nil, fmt.Errorf("public stream %s invalid: %w", name, err)
+		}
+	}
+	return &publicStreamGateImpl{
+		streams: streams, connections: make(map[publicStreamKey]int),
+	}, nil
+}
+
+// Admit admits a connection from a client address to a stream
+func (g *publicStreamGateImpl) Admit(stream, clientAddr string) (func(), error) {
+	settings, ok := g.streams[stream]
+	if !ok {
+		return nil, ErrNotPublicStream
+	}
+	key := publicStreamKey{stream: stream, clientAddr: clientAddr}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.connections[key] >= settings.MaxConnectionsPerIP {
+		return nil, ErrPublicConnectionLimit
+	}
+	g.connections[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.lock.Lock()
+			defer g.lock.Unlock()
+			if g.connections[key]--; g.connections[key] <= 0 {
+				delete(g.connections, key)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicStreamGate(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid public streams
+	{
+		_, err := GetPublicStreamGate(map[string]PublicStream{"status": {}})
+		assert.NotNil(err)
+	}
+
+	uut, err := GetPublicStreamGate(map[string]PublicStream{
+		"status": {MaxConnectionsPerIP: 2},
+	})
+	assert.Nil(err)
+
+	// Case 1: stream not public
+	{
+		_, err := uut.Admit("orders", "10.0.0.1")
+		assert.Equal(ErrNotPublicStream, err)
+	}
+
+	// Case 2: connections up to the cap of each client address
+	release1, err := uut.Admit("status", "10.0.0.1")
+	assert.Nil(err)
+	release2, err := uut.Admit("status", "10.0.0.1")
+	assert.Nil(err)
+	_, err = uut.Admit("status", "10.0.0.1")
+	assert.Equal(ErrPublicConnectionLimit, err)
+	release3, err := uut.Admit("status", "10.0.0.2")
+	assert.Nil(err)
+
+	// Case 3: ended connections free their place, once
+	release1()
+	release1()
+	release4, err := uut.Admit("status", "10.0.0.1")
+	assert.Nil(err)
+	_, err = uut.Admit("status", "10.0.0.1")
+	assert.Equal(ErrPublicConnectionLimit, err)
+	release2()
+	release3()
+	release4()
+}
+
+func TestLoadPublicStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "public.json")
+	assert.Nil(os.WriteFile(path, []byte(`{"status": {"max_connections_per_ip": 4}}`), 0600))
+	streams, err := LoadPublicStreams(path)
+	assert.Nil(err)
+	assert.Equal(map[string]PublicStream{"status": {MaxConnectionsPerIP: 4}}, streams)
+
+	assert.Nil(os.WriteFile(path, []byte(`not json`), 0600))
+	_, err = LoadPublicStreams(path)
+	assert.NotNil(err)
+}
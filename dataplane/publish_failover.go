@@ -0,0 +1,263 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// Targets of publish failover
+const (
+	// FailoverTargetPrimary is the server's own NATS cluster
+	FailoverTargetPrimary = "primary"
+	// FailoverTargetSecondary is the NATS cluster publishes fail over to
+	FailoverTargetSecondary = "secondary"
+)
+
+// PublishFailoverParam settings for failing publishes over from the primary NATS cluster to
+// a secondary one
+type PublishFailoverParam struct {
+	// ProbeInterval is how often the health of both clusters is probed
+	ProbeInterval time.Duration `validate:"gt=0"`
+	// FailureThreshold is the number of consecutive failed probes of the primary before
+	// failing over to the secondary
+	FailureThreshold int `validate:"gte=1"`
+	// RecoveryThreshold is the number of consecutive successful probes of the primary before
+	// failing back to it
+	RecoveryThreshold int `validate:"gte=1"`
+}
+
+// PublishFailoverStatus is the state of publish failover
+type PublishFailoverStatus struct {
+	// Active is the target publishes go to
+	Active string `json:"active"`
+	// ActiveSince is when the active target was last changed
+	ActiveSince time.Time `json:"active_since"`
+	// PrimaryHealthy is whether the last probe of the primary succeeded
+	PrimaryHealthy bool `json:"primary_healthy"`
+	// SecondaryHealthy is whether the last probe of the secondary succeeded
+	SecondaryHealthy bool `json:"secondary_healthy"`
+	// PrimaryFailures is the number of consecutive failed probes of the primary
+	PrimaryFailures int `json:"primary_failures"`
+	// PrimarySuccesses is the number of consecutive successful probes of the primary
+	PrimarySuccesses int `json:"primary_successes"`
+	// Failovers is the number of times publishes failed over to the secondary
+	Failovers uint64 `json:"failovers"`
+}
+
+// PublishFailover keeps connections to a primary and a secondary NATS cluster, publishing to
+// the primary while healthy, and to the secondary on sustained failure of the primary
+type PublishFailover interface {
+	// Active fetches the client and publisher of the active target, and whether it is the
+	// secondary
+	Active() (*core.NatsClient, JetStreamPublisher, bool)
+	// Status fetches the state of publish failover
+	Status() PublishFailoverStatus
+	// Close stops the health probes, and closes the connection to the secondary
+	Close(ctxt context.Context)
+}
+
+// failoverTarget a cluster publishes can go to
+type failoverTarget struct {
+	client    *core.NatsClient
+	publisher JetStreamPublisher
+	probe     func(ctxt context.Context) error
+}
+
+// publishFailoverImpl implements PublishFailover
+type publishFailoverImpl struct {
+	common.Component
+	param     PublishFailoverParam
+	primary   failoverTarget
+	secondary failoverTarget
+	timer     common.IntervalTimer
+	lock      sync.RWMutex
+	status    PublishFailoverStatus
+}
+
+// GetPublishFailover define new PublishFailover
+//
+// Publishes go to primaryClient, the server's own connection, until it fails param's
+// FailureThreshold consecutive probes while the secondary, connected with secondaryParam,
+// is healthy.
+func GetPublishFailover(
+	param PublishFailoverParam,
+	primaryClient *core.NatsClient,
+	secondaryParam core.NATSConnectParams,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (PublishFailover, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "publish-failover", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Publish failover parameters invalid")
+		return nil, err
+	}
+	primaryPublisher, err := GetJetStreamPublisher(
+		primaryClient, fmt.Sprintf("%s.%s", instance, FailoverTargetPrimary),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// The secondary's client only logs connection events; the callbacks of the primary's
+	// parameters may act on the process' own connection
+	secondaryParam.OnDisconnectCallback = func(_ *nats.Conn, e error) {
+		log.WithError(e).WithFields(logTags).Warn("Secondary cluster disconnected")
+	}
+	secondaryParam.OnReconnectCallback = func(_ *nats.Conn) {
+		log.WithFields(logTags).Info("Secondary cluster reconnected")
+	}
+	secondaryParam.OnCloseCallback = func(_ *nats.Conn) {
+		log.WithFields(logTags).Debug("Secondary cluster closed")
+	}
+	secondaryClient, err := core.GetJetStream(secondaryParam)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to connect secondary cluster")
+		if secondaryClient.NATs() != nil {
+			secondaryClient.NATs().Close()
+		}
+		return nil, err
+	}
+	secondaryPublisher, err := GetJetStreamPublisher(
+		secondaryClient, fmt.Sprintf("%s.%s", instance, FailoverTargetSecondary),
+	)
+	if err != nil {
+		secondaryClient.NATs().Close()
+		return nil, err
+	}
+	instanceObj := &publishFailoverImpl{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		primary: failoverTarget{
+			client: primaryClient, publisher: primaryPublisher, probe: probeJetStream(primaryClient),
+		},
+		secondary: failoverTarget{
+			client:    secondaryClient,
+			publisher: secondaryPublisher,
+			probe:     probeJetStream(secondaryClient),
+		},
+		status: PublishFailoverStatus{
+			Active:           FailoverTargetPrimary,
+			ActiveSince:      time.Now(),
+			PrimaryHealthy:   true,
+			SecondaryHealthy: true,
+		},
+	}
+	timer, err := common.GetIntervalTimerInstance("publish-failover", rootCtxt, wg)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		instanceObj.Close(rootCtxt)
+		return nil, err
+	}
+	instanceObj.timer = timer
+	if err := timer.Start(param.ProbeInterval, instanceObj.checkHealth, false); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to start timer")
+		instanceObj.Close(rootCtxt)
+		return nil, err
+	}
+	return instanceObj, nil
+}
+
+// Active fetches the client and publisher of the active target
+func (f *publishFailoverImpl) Active() (*core.NatsClient, JetStreamPublisher, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.status.Active == FailoverTargetSecondary {
+		return f.secondary.client, f.secondary.publisher, true
+	}
+	return f.primary.client, f.primary.publisher, false
+}
+
+// Status fetches the state of publish failover
+func (f *publishFailoverImpl) Status() PublishFailoverStatus {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.status
+}
+
+// checkHealth support IntervalTimer, probe both clusters, and fail over or back as needed
+func (f *publishFailoverImpl) checkHealth() error {
+	probe := func(target failoverTarget) error {
+		ctxt, cancel := context.WithTimeout(context.Background(), f.param.ProbeInterval)
+		defer cancel()
+		return target.probe(ctxt)
+	}
+	primaryErr := probe(f.primary)
+	secondaryErr := probe(f.secondary)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := &f.status
+	status.PrimaryHealthy = primaryErr == nil
+	status.SecondaryHealthy = secondaryErr == nil
+	if primaryErr != nil {
+		status.PrimaryFailures++
+		status.PrimarySuccesses = 0
+	} else {
+		status.PrimarySuccesses++
+		status.PrimaryFailures = 0
+	}
+	switch status.Active {
+	case FailoverTargetPrimary:
+		if status.PrimaryFailures < f.param.FailureThreshold {
+			break
+		}
+		if secondaryErr != nil {
+			if status.PrimaryFailures == f.param.FailureThreshold {
+				log.WithError(secondaryErr).WithFields(f.LogTags).Errorf(
+					"Primary cluster failing, but secondary cluster is unhealthy as well",
+				)
+			}
+			break
+		}
+		log.WithError(primaryErr).WithFields(f.LogTags).Warnf(
+			"Primary cluster failed %d probes, failing over to secondary", status.PrimaryFailures,
+		)
+		status.Active = FailoverTargetSecondary
+		status.ActiveSince = time.Now()
+		status.Failovers++
+	case FailoverTargetSecondary:
+		if status.PrimarySuccesses < f.param.RecoveryThreshold {
+			break
+		}
+		log.WithFields(f.LogTags).Infof(
+			"Primary cluster passed %d probes, failing back to primary", status.PrimarySuccesses,
+		)
+		status.Active = FailoverTargetPrimary
+		status.ActiveSince = time.Now()
+	}
+	return nil
+}
+
+// Close stops the health probes, and closes the connection to the secondary
+func (f *publishFailoverImpl) Close(ctxt context.Context) {
+	if f.timer != nil {
+		if err := f.timer.Stop(); err != nil {
+			log.WithError(err).WithFields(f.LogTags).Errorf("Failed to stop timer")
+		}
+	}
+	f.secondary.client.Close(ctxt)
+}
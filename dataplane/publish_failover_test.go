@@ -0,0 +1,101 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishFailover(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	var primaryErr, secondaryErr error
+	primary := &fakeRoutedPublisher{}
+	secondary := &fakeRoutedPublisher{}
+	uut := &publishFailoverImpl{
+		Component: common.Component{LogTags: log.Fields{"instance": "ut-publish-failover"}},
+		param:     PublishFailoverParam{FailureThreshold: 2, RecoveryThreshold: 3},
+		primary: failoverTarget{
+			publisher: primary,
+			probe:     func(ctxt context.Context) error { return primaryErr },
+		},
+		secondary: failoverTarget{
+			publisher: secondary,
+			probe:     func(ctxt context.Context) error { return secondaryErr },
+		},
+		status: PublishFailoverStatus{Active: FailoverTargetPrimary},
+	}
+	probes := func(count int) {
+		for itr := 0; itr < count; itr++ {
+			assert.Nil(uut.checkHealth())
+		}
+	}
+	assertActive := func(onSecondary bool) {
+		_, publisher, secondaryActive := uut.Active()
+		assert.Equal(onSecondary, secondaryActive)
+		if onSecondary {
+			assert.Equal(secondary, publisher)
+			assert.Equal(FailoverTargetSecondary, uut.Status().Active)
+		} else {
+			assert.Equal(primary, publisher)
+			assert.Equal(FailoverTargetPrimary, uut.Status().Active)
+		}
+	}
+
+	// Case 0: healthy primary stays active
+	probes(3)
+	assertActive(false)
+	assert.True(uut.Status().PrimaryHealthy)
+
+	// Case 1: a single failure does not fail over
+	primaryErr = nats.ErrDisconnected
+	probes(1)
+	assertActive(false)
+	assert.False(uut.Status().PrimaryHealthy)
+	assert.Equal(1, uut.Status().PrimaryFailures)
+
+	// Case 2: no failover while the secondary is unhealthy as well
+	secondaryErr = nats.ErrNoServers
+	probes(2)
+	assertActive(false)
+	assert.Equal(uint64(0), uut.Status().Failovers)
+
+	// Case 3: sustained failure fails over
+	secondaryErr = nil
+	probes(1)
+	assertActive(true)
+	assert.Equal(uint64(1), uut.Status().Failovers)
+
+	// Case 4: failing back waits for the primary to recover
+	primaryErr = nil
+	probes(2)
+	assertActive(true)
+	primaryErr = nats.ErrDisconnected
+	probes(1)
+	primaryErr = nil
+	probes(2)
+	assertActive(true)
+	probes(1)
+	assertActive(false)
+	assert.Equal(3, uut.Status().PrimarySuccesses)
+	assert.Equal(uint64(1), uut.Status().Failovers)
+}
@@ -0,0 +1,167 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidPublishGrant is reported for a publish grant token which is not valid for the
+// publish
+var ErrInvalidPublishGrant = errors.New("invalid publish grant")
+
+// ErrPublishGrantUsedUp is reported for a publish grant token whose messages were all
+// published
+var ErrPublishGrantUsedUp = errors.New("publish grant used up")
+
+// PublishGrant is pre-authorized access to publish a number of messages to one subject,
+// until it expires
+type PublishGrant struct {
+	// ID is the unique ID of the grant
+	ID string `json:"id"`
+	// Subject is the subject the grant allows publishing to
+	Subject string `json:"subject"`
+	// MaxMessages is the number of messages the grant allows publishing
+	MaxMessages int `json:"max_msgs"`
+	// Expires is when the grant stops being valid
+	Expires time.Time `json:"expires"`
+}
+
+// PublishGrantIssuer issues signed publish grant tokens, and counts the messages published
+// with them
+type PublishGrantIssuer interface {
+	// Issue issues a token granting publishing up to maxMessages messages to subject,
+	// within ttl
+	Issue(subject string, maxMessages int, ttl time.Duration) (string, PublishGrant, error)
+	// Use verifies a token grants publishing to subject, and counts one message against it.
+	// Returns the grant and the number of messages it still allows.
+	Use(token, subject string) (PublishGrant, int, error)
+}
+
+// publishGrantIssuerImpl implements PublishGrantIssuer
+type publishGrantIssuerImpl struct {
+	common.Component
+	key    []byte
+	maxTTL time.Duration
+	clock  common.Clock
+	lock   sync.Mutex
+	// used the number of messages published with each unexpired grant, by ID
+	used map[string]int
+	// expires when each grant counted in used expires, by ID
+	expires map[string]time.Time
+}
+
+// GetPublishGrantIssuer define new PublishGrantIssuer, issuing grants valid for at most
+// maxTTL
+//
+// Tokens are signed with key; if key is empty, a random key is used, and the tokens are only
+// valid on this instance. The messages published with a grant are counted by each instance
+// separately.
+func GetPublishGrantIssuer(
+	key []byte, maxTTL time.Duration, instance string,
+) (PublishGrantIssuer, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "publish-grant-issuer", "instance": instance,
+	}
+	if maxTTL <= 0 {
+		return nil, fmt.Errorf("publish grant max TTL must be positive")
+	}
+	if len(key) == 0 {
+		var err error
+		if key, err = newSigningKey(); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define publish grant key")
+			return nil, err
+		}
+	}
+	return &publishGrantIssuerImpl{
+		Component: common.Component{LogTags: logTags},
+		key:       key,
+		maxTTL:    maxTTL,
+		clock:     common.SystemClock,
+		used:      map[string]int{},
+		expires:   map[string]time.Time{},
+	}, nil
+}
+
+// Issue issues a token granting publishing up to maxMessages messages to subject, within ttl
+func (i *publishGrantIssuerImpl) Issue(
+	subject string, maxMessages int, ttl time.Duration,
+) (string, PublishGrant, error) {
+	if subject == "" {
+		return "", PublishGrant{}, fmt.Errorf("publish grant needs a subject")
+	}
+	if maxMessages <= 0 {
+		return "", PublishGrant{}, fmt.Errorf("publish grant must allow at least one message")
+	}
+	if ttl <= 0 || ttl > i.maxTTL {
+		return "", PublishGrant{}, fmt.Errorf(
+			"publish grant TTL must be positive, and at most %s", i.maxTTL,
+		)
+	}
+	grant := PublishGrant{
+		ID:          uuid.New().String(),
+		Subject:     subject,
+		MaxMessages: maxMessages,
+		Expires:     i.clock.Now().Add(ttl).Truncate(time.Second),
+	}
+	token, err := encodeSignedToken(&grant, i.key)
+	if err != nil {
+		return "", PublishGrant{}, err
+	}
+	return token, grant, nil
+}
+
+// Use verifies a token grants publishing to subject, and counts one message against it
+func (i *publishGrantIssuerImpl) Use(token, subject string) (PublishGrant, int, error) {
+	var grant PublishGrant
+	if err := decodeSignedToken(token, i.key, &grant); err != nil {
+		return PublishGrant{}, 0, fmt.Errorf("%w: %s", ErrInvalidPublishGrant, err)
+	}
+	now := i.clock.Now()
+	if !now.Before(grant.Expires) {
+		return grant, 0, fmt.Errorf("%w: expired", ErrInvalidPublishGrant)
+	}
+	if grant.Subject != subject {
+		return grant, 0, fmt.Errorf("%w: not for subject %s", ErrInvalidPublishGrant, subject)
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.dropExpired(now)
+	used := i.used[grant.ID]
+	if used >= grant.MaxMessages {
+		return grant, 0, ErrPublishGrantUsedUp
+	}
+	i.used[grant.ID] = used + 1
+	i.expires[grant.ID] = grant.Expires
+	return grant, grant.MaxMessages - used - 1, nil
+}
+
+// dropExpired helper function to stop counting the messages of expired grants
+func (i *publishGrantIssuerImpl) dropExpired(now time.Time) {
+	for id, expires := range i.expires {
+		if !now.Before(expires) {
+			delete(i.used, id)
+			delete(i.expires, id)
+		}
+	}
+}
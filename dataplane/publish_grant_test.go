@@ -0,0 +1,91 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishGrantIssuer(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := GetPublishGrantIssuer(nil, 0, "testing")
+	assert.NotNil(err)
+
+	uut, err := GetPublishGrantIssuer([]byte("grant-key"), time.Hour, "testing")
+	assert.Nil(err)
+	clock := common.GetFakeClock(time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC))
+	uut.(*publishGrantIssuerImpl).clock = clock
+
+	// Case 0: invalid grants
+	{
+		_, _, err := uut.Issue("", 1, time.Minute)
+		assert.NotNil(err)
+		_, _, err = uut.Issue("sensor.01", 0, time.Minute)
+		assert.NotNil(err)
+		_, _, err = uut.Issue("sensor.01", 1, time.Hour*2)
+		assert.NotNil(err)
+	}
+
+	token, grant, err := uut.Issue("sensor.01", 2, time.Minute*10)
+	assert.Nil(err)
+	assert.Equal("sensor.01", grant.Subject)
+	assert.Equal(2, grant.MaxMessages)
+	assert.Equal(time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC), grant.Expires)
+
+	// Case 1: the grant only covers its subject, and tokens must be signed with the key
+	{
+		_, _, err := uut.Use(token, "sensor.02")
+		assert.ErrorIs(err, ErrInvalidPublishGrant)
+		_, _, err = uut.Use(token+"x", "sensor.01")
+		assert.ErrorIs(err, ErrInvalidPublishGrant)
+		other, err := GetPublishGrantIssuer([]byte("other-key"), time.Hour, "testing")
+		assert.Nil(err)
+		_, _, err = other.Use(token, "sensor.01")
+		assert.ErrorIs(err, ErrInvalidPublishGrant)
+	}
+
+	// Case 2: the grant allows its number of messages
+	{
+		used, remaining, err := uut.Use(token, "sensor.01")
+		assert.Nil(err)
+		assert.Equal(grant, used)
+		assert.Equal(1, remaining)
+		_, remaining, err = uut.Use(token, "sensor.01")
+		assert.Nil(err)
+		assert.Equal(0, remaining)
+		_, _, err = uut.Use(token, "sensor.01")
+		assert.ErrorIs(err, ErrPublishGrantUsedUp)
+	}
+
+	// Case 3: the grant expires, and is no longer counted
+	{
+		token, _, err := uut.Issue("sensor.02", 5, time.Minute)
+		assert.Nil(err)
+		_, _, err = uut.Use(token, "sensor.02")
+		assert.Nil(err)
+		clock.Advance(time.Minute)
+		_, _, err = uut.Use(token, "sensor.02")
+		assert.ErrorIs(err, ErrInvalidPublishGrant)
+		clock.Advance(time.Minute * 10)
+		impl := uut.(*publishGrantIssuerImpl)
+		impl.dropExpired(clock.Now())
+		assert.Empty(impl.used)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultPublishDestination names the server's own NATS connection in a publish routing table
+const DefaultPublishDestination = "default"
+
+// ErrNoHealthyDestination is reported when no destination of a publish route is healthy
+var ErrNoHealthyDestination = errors.New("no healthy publish destination")
+
+// PublishDestination is a NATS connection publishes can be routed to
+type PublishDestination struct {
+	// ServerURI is the NATS server to connect to. Defaults to the server's own.
+	ServerURI string `json:"server_uri,omitempty" validate:"omitempty,uri"`
+	// JetStreamDomain is the JetStream domain to publish into. Optional.
+	JetStreamDomain string `json:"js_domain,omitempty"`
+	// JetStreamAPIPrefix is the prefix of the JetStream API subjects. Optional, and can not
+	// be used with JetStreamDomain.
+	JetStreamAPIPrefix string `json:"js_api_prefix,omitempty"`
+}
+
+// PublishRoute selects the destinations of the publishes matching it
+type PublishRoute struct {
+	// Name identifies the route in logs
+	Name string `json:"name" validate:"required"`
+	// SubjectPrefix matches publishes to subjects starting with the prefix
+	SubjectPrefix string `json:"subject_prefix,omitempty"`
+	// Header matches publishes with the request header set
+	Header string `json:"header,omitempty" validate:"required_without=SubjectPrefix"`
+	// HeaderValue matches publishes with Header set to this value. Any value if empty.
+	HeaderValue string `json:"header_value,omitempty"`
+	// Destinations are the destinations of the route in order of preference. A publish goes
+	// to the first healthy destination.
+	Destinations []string `json:"destinations" validate:"required,min=1,dive,required"`
+}
+
+// Matches checks whether a publish to a subject, with the request headers, matches the route
+func (r PublishRoute) Matches(subject string, headers http.Header) bool {
+	if r.SubjectPrefix != "" && !strings.HasPrefix(subject, r.SubjectPrefix) {
+		return false
+	}
+	if r.Header == "" {
+		return true
+	}
+	values := headers.Values(r.Header)
+	if r.HeaderValue == "" {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		if value == r.HeaderValue {
+			return true
+		}
+	}
+	return false
+}
+
+// PublishRoutingTable routes publishes to NATS connections other than the server's own
+type PublishRoutingTable struct {
+	// Destinations are the NATS connections by name. DefaultPublishDestination can not be
+	// redefined.
+	Destinations map[string]PublishDestination `json:"destinations" validate:"dive"`
+	// Routes are checked in order; a publish follows the first route it matches. Publishes
+	// matching no route go through the server's own connection.
+	Routes []PublishRoute `json:"routes" validate:"dive"`
+}
+
+// validate helper function to check the routing table is consistent
+func (t PublishRoutingTable) validate() error {
+	if err := validator.New().Struct(&t); err != nil {
+		return err
+	}
+	if _, ok := t.Destinations[DefaultPublishDestination]; ok {
+		return fmt.Errorf("destination %s is reserved", DefaultPublishDestination)
+	}
+	for name, dest := range t.Destinations {
+		if dest.JetStreamDomain != "" && dest.JetStreamAPIPrefix != "" {
+			return fmt.Errorf(
+				"destination %s: JetStream domain and API prefix are mutually exclusive", name,
+			)
+		}
+	}
+	routeNames := map[string]bool{}
+	for _, route := range t.Routes {
+		if routeNames[route.Name] {
+			return fmt.Errorf("route %s defined more than once", route.Name)
+		}
+		routeNames[route.Name] = true
+		for _, dest := range route.Destinations {
+			if _, ok := t.Destinations[dest]; !ok && dest != DefaultPublishDestination {
+				return fmt.Errorf("route %s: unknown destination %s", route.Name, dest)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadPublishRoutingTable read a publish routing table from a JSON file
+func LoadPublishRoutingTable(path string) (PublishRoutingTable, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return PublishRoutingTable{}, err
+	}
+	var table PublishRoutingTable
+	if err := json.Unmarshal(content, &table); err != nil {
+		return PublishRoutingTable{}, fmt.Errorf(
+			"unable to parse publish routing table %s: %w", path, err,
+		)
+	}
+	return table, nil
+}
+
+// PublishRouter routes publishes to the destinations of a routing table, failing over
+// between the destinations of a route based on their health
+type PublishRouter interface {
+	// Match finds the route of a publish to a subject with the request headers. Returns nil
+	// if the publish matches no route.
+	Match(subject string, headers http.Header) *PublishRoute
+	// Publish calls publish with the publisher of the first healthy destination of a route,
+	// failing over to the next healthy destination if the message could not reach the
+	// destination's JetStream. Returns the destination the message was last sent to.
+	Publish(
+		route *PublishRoute, publish func(JetStreamPublisher) error, ctxt context.Context,
+	) (string, error)
+	// Close stops the health checks, and closes the connections of the destinations
+	Close(ctxt context.Context)
+}
+
+// routedDestination a destination of the routing table
+type routedDestination struct {
+	name      string
+	publisher JetStreamPublisher
+	// client is the connection to the destination. Closed with the router if owned.
+	client *core.NatsClient
+	owned  bool
+	// probe checks whether the destination's JetStream is reachable
+	probe   func(ctxt context.Context) error
+	healthy bool
+}
+
+// publishRouterImpl implements PublishRouter
+type publishRouterImpl struct {
+	common.Component
+	routes       []PublishRoute
+	destinations map[string]*routedDestination
+	probeTimeout time.Duration
+	timer        common.IntervalTimer
+	lock         sync.RWMutex
+}
+
+// GetPublishRouter define new PublishRouter
+//
+// Each destination of table is connected with the settings of base, and the server's own
+// connection defaultClient serves DefaultPublishDestination. The destinations are checked
+// every healthInterval.
+func GetPublishRouter(
+	table PublishRoutingTable,
+	base core.NATSConnectParams,
+	defaultClient *core.NatsClient,
+	healthInterval time.Duration,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (PublishRouter, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "publish-router", "instance": instance,
+	}
+	if err := table.validate(); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Publish routing table invalid")
+		return nil, err
+	}
+	if healthInterval <= 0 {
+		return nil, fmt.Errorf("publish destination health check interval must be positive")
+	}
+	// Destination clients only log connection events; the callbacks of base may act on the
+	// process' own connection
+	base.OnDisconnectCallback = func(_ *nats.Conn, e error) {
+		log.WithError(e).WithFields(logTags).Warn("Publish destination disconnected")
+	}
+	base.OnReconnectCallback = func(_ *nats.Conn) {
+		log.WithFields(logTags).Info("Publish destination reconnected")
+	}
+	base.OnCloseCallback = func(_ *nats.Conn) {
+		log.WithFields(logTags).Debug("Publish destination closed")
+	}
+	router := &publishRouterImpl{
+		Component:    common.Component{LogTags: logTags},
+		routes:       table.Routes,
+		destinations: map[string]*routedDestination{},
+		probeTimeout: healthInterval,
+	}
+	addDestination := func(name string, client *core.NatsClient, owned bool) error {
+		publisher, err := GetJetStreamPublisher(client, fmt.Sprintf("%s.%s", instance, name))
+		if err != nil {
+			return err
+		}
+		router.destinations[name] = &routedDestination{
+			name:      name,
+			publisher: publisher,
+			client:    client,
+			owned:     owned,
+			probe:     probeJetStream(client),
+			healthy:   true,
+		}
+		return nil
+	}
+	if err := addDestination(DefaultPublishDestination, defaultClient, false); err != nil {
+		return nil, err
+	}
+	for name, dest := range table.Destinations {
+		param := base
+		if dest.ServerURI != "" {
+			param.ServerURI = dest.ServerURI
+		}
+		if dest.JetStreamDomain != "" || dest.JetStreamAPIPrefix != "" {
+			param.JetStreamDomain = dest.JetStreamDomain
+			param.JetStreamAPIPrefix = dest.JetStreamAPIPrefix
+		}
+		client, err := core.GetJetStream(param)
+		if err == nil {
+			err = addDestination(name, client, true)
+		}
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to connect publish destination %s", name)
+			if client.NATs() != nil {
+				client.NATs().Close()
+			}
+			router.Close(rootCtxt)
+			return nil, err
+		}
+		log.WithFields(logTags).Infof("Connected publish destination %s", name)
+	}
+	timer, err := common.GetIntervalTimerInstance("publish-router", rootCtxt, wg)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		router.Close(rootCtxt)
+		return nil, err
+	}
+	router.timer = timer
+	if err := timer.Start(healthInterval, router.checkHealth, false); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to start timer")
+		router.Close(rootCtxt)
+		return nil, err
+	}
+	return router, nil
+}
+
+// probeJetStream helper function to define the health probe of a destination, which checks
+// its JetStream responds
+func probeJetStream(client *core.NatsClient) func(ctxt context.Context) error {
+	return func(ctxt context.Context) error {
+		if !client.NATs().IsConnected() {
+			return nats.ErrDisconnected
+		}
+		_, err := client.JetStream().AccountInfo(nats.Context(ctxt))
+		return err
+	}
+}
+
+// isDestinationDownError helper function to check whether a publish failed because the
+// destination's connection is down
+func isDestinationDownError(err error) bool {
+	return errors.Is(err, nats.ErrConnectionClosed) ||
+		errors.Is(err, nats.ErrConnectionReconnecting) ||
+		errors.Is(err, nats.ErrDisconnected) ||
+		errors.Is(err, nats.ErrNoServers) ||
+		errors.Is(err, nats.ErrJetStreamNotEnabled)
+}
+
+// Match finds the route of a publish to a subject with the request headers
+func (r *publishRouterImpl) Match(subject string, headers http.Header) *PublishRoute {
+	for idx := range r.routes {
+		if r.routes[idx].Matches(subject, headers) {
+			return &r.routes[idx]
+		}
+	}
+	return nil
+}
+
+// isHealthy helper function to check whether a destination can be published to
+func (r *publishRouterImpl) isHealthy(dest *routedDestination) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if !dest.healthy {
+		return false
+	}
+	return dest.client == nil || dest.client.NATs() == nil || dest.client.NATs().IsConnected()
+}
+
+// setHealth helper function to record the health of a destination
+func (r *publishRouterImpl) setHealth(dest *routedDestination, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	healthy := err == nil
+	if healthy == dest.healthy {
+		return
+	}
+	dest.healthy = healthy
+	if healthy {
+		log.WithFields(r.LogTags).Infof("Publish destination %s is healthy", dest.name)
+	} else {
+		log.WithError(err).WithFields(r.LogTags).Warnf("Publish destination %s is unhealthy", dest.name)
+	}
+}
+
+// Publish calls publish with the publisher of the first healthy destination of a route
+func (r *publishRouterImpl) Publish(
+	route *PublishRoute, publish func(JetStreamPublisher) error, ctxt context.Context,
+) (string, error) {
+	localLogTags, err := common.UpdateLogTags(r.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to update logtags")
+		return "", err
+	}
+	lastDest := ""
+	var lastErr error
+	for _, name := range route.Destinations {
+		dest, ok := r.destinations[name]
+		if !ok || !r.isHealthy(dest) {
+			continue
+		}
+		lastDest = name
+		lastErr = publish(dest.publisher)
+		// Only fail over if the message was surely not stored
+		if isDestinationDownError(lastErr) {
+			r.setHealth(dest, lastErr)
+		} else if !IsNoStreamError(lastErr) {
+			return name, lastErr
+		}
+		log.WithError(lastErr).WithFields(localLogTags).Warnf(
+			"Route %s unable to publish to destination %s", route.Name, name,
+		)
+	}
+	if lastErr != nil {
+		return lastDest, lastErr
+	}
+	return "", fmt.Errorf("%w for route %s", ErrNoHealthyDestination, route.Name)
+}
+
+// checkHealth support IntervalTimer, probe the health of each destination
+func (r *publishRouterImpl) checkHealth() error {
+	for _, dest := range r.destinations {
+		ctxt, cancel := context.WithTimeout(context.Background(), r.probeTimeout)
+		err := dest.probe(ctxt)
+		cancel()
+		r.setHealth(dest, err)
+	}
+	return nil
+}
+
+// Close stops the health checks, and closes the connections of the destinations
+func (r *publishRouterImpl) Close(ctxt context.Context) {
+	if r.timer != nil {
+		if err := r.timer.Stop(); err != nil {
+			log.WithError(err).WithFields(r.LogTags).Errorf("Failed to stop timer")
+		}
+	}
+	for _, dest := range r.destinations {
+		if dest.owned {
+			dest.client.Close(ctxt)
+		}
+	}
+}
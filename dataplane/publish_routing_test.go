@@ -0,0 +1,200 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRoutedPublisher records the subjects published, failing with err if set
+type fakeRoutedPublisher struct {
+	JetStreamPublisher
+	err       error
+	published []string
+}
+
+func (p *fakeRoutedPublisher) PublishWithPolicy(
+	subject string, msg []byte, policy PublishAckPolicy, ctxt context.Context,
+) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, subject)
+	return nil
+}
+
+func TestPublishRoutingTable(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid tables
+	{
+		invalid := []PublishRoutingTable{
+			{Routes: []PublishRoute{{Name: "r", Header: "H"}}},
+			{Routes: []PublishRoute{{Name: "r", Destinations: []string{"default"}}}},
+			{Routes: []PublishRoute{{Name: "r", Header: "H", Destinations: []string{"eu"}}}},
+			{Destinations: map[string]PublishDestination{"default": {}}},
+			{Destinations: map[string]PublishDestination{
+				"eu": {JetStreamDomain: "hub", JetStreamAPIPrefix: "$JS.hub.API"},
+			}},
+			{Routes: []PublishRoute{
+				{Name: "r", Header: "H", Destinations: []string{"default"}},
+				{Name: "r", SubjectPrefix: "a.", Destinations: []string{"default"}},
+			}},
+		}
+		for idx, table := range invalid {
+			assert.NotNil(table.validate(), "table %d", idx)
+		}
+	}
+
+	// Case 1: load a table
+	table := PublishRoutingTable{
+		Destinations: map[string]PublishDestination{"eu": {JetStreamDomain: "eu"}},
+		Routes: []PublishRoute{
+			{
+				Name: "eu-orders", SubjectPrefix: "orders.", Header: "Httpmq-Region",
+				HeaderValue: "eu", Destinations: []string{"eu", "default"},
+			},
+			{Name: "audit", SubjectPrefix: "audit.", Destinations: []string{"eu"}},
+			{Name: "pinned", Header: "Httpmq-Pin", Destinations: []string{"eu"}},
+		},
+	}
+	{
+		path := filepath.Join(t.TempDir(), "routes.json")
+		content := `{
+			"destinations": {"eu": {"js_domain": "eu"}},
+			"routes": [
+				{
+					"name": "eu-orders", "subject_prefix": "orders.", "header": "Httpmq-Region",
+					"header_value": "eu", "destinations": ["eu", "default"]
+				},
+				{"name": "audit", "subject_prefix": "audit.", "destinations": ["eu"]},
+				{"name": "pinned", "header": "Httpmq-Pin", "destinations": ["eu"]}
+			]
+		}`
+		assert.Nil(os.WriteFile(path, []byte(content), 0600))
+		loaded, err := LoadPublishRoutingTable(path)
+		assert.Nil(err)
+		assert.Equal(table, loaded)
+		assert.Nil(loaded.validate())
+	}
+
+	// Case 2: match routes
+	{
+		router := &publishRouterImpl{routes: table.Routes}
+		headers := http.Header{}
+		headers.Set("Httpmq-Region", "eu")
+		assert.Equal("eu-orders", router.Match("orders.1", headers).Name)
+		assert.Nil(router.Match("orders.1", http.Header{}))
+		headers.Set("Httpmq-Region", "us")
+		assert.Nil(router.Match("orders.1", headers))
+		assert.Equal("audit", router.Match("audit.1", headers).Name)
+		headers.Set("Httpmq-Pin", "")
+		assert.Equal("pinned", router.Match("orders.1", headers).Name)
+	}
+}
+
+func TestPublishRouterFailover(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	primary := &fakeRoutedPublisher{}
+	backup := &fakeRoutedPublisher{}
+	var primaryProbe error
+	uut := &publishRouterImpl{
+		Component: common.Component{LogTags: log.Fields{"instance": "ut-publish-router"}},
+		destinations: map[string]*routedDestination{
+			"primary": {
+				name: "primary", publisher: primary, healthy: true,
+				probe: func(ctxt context.Context) error { return primaryProbe },
+			},
+			"backup": {
+				name: "backup", publisher: backup, healthy: true,
+				probe: func(ctxt context.Context) error { return nil },
+			},
+		},
+	}
+	route := &PublishRoute{Name: "r", Header: "H", Destinations: []string{"primary", "backup"}}
+	publish := func(subject string) func(JetStreamPublisher) error {
+		return func(p JetStreamPublisher) error {
+			return p.PublishWithPolicy(subject, []byte("msg"), PublishAckWait, context.Background())
+		}
+	}
+	ctxt := context.Background()
+
+	// Case 0: publish to the preferred destination
+	{
+		dest, err := uut.Publish(route, publish("a.1"), ctxt)
+		assert.Nil(err)
+		assert.Equal("primary", dest)
+		assert.Equal([]string{"a.1"}, primary.published)
+	}
+
+	// Case 1: other failures are not failed over
+	{
+		primary.err = fmt.Errorf("rejected")
+		dest, err := uut.Publish(route, publish("a.2"), ctxt)
+		assert.Equal(primary.err, err)
+		assert.Equal("primary", dest)
+		assert.Empty(backup.published)
+	}
+
+	// Case 2: fail over a destination which is down
+	{
+		primary.err = nats.ErrConnectionClosed
+		primaryProbe = nats.ErrConnectionClosed
+		dest, err := uut.Publish(route, publish("a.3"), ctxt)
+		assert.Nil(err)
+		assert.Equal("backup", dest)
+		assert.Equal([]string{"a.3"}, backup.published)
+		assert.False(uut.destinations["primary"].healthy)
+	}
+
+	// Case 3: the unhealthy destination is skipped until its probe succeeds
+	{
+		primary.err = nil
+		assert.Nil(uut.checkHealth())
+		dest, err := uut.Publish(route, publish("a.4"), ctxt)
+		assert.Nil(err)
+		assert.Equal("backup", dest)
+
+		primaryProbe = nil
+		assert.Nil(uut.checkHealth())
+		dest, err = uut.Publish(route, publish("a.5"), ctxt)
+		assert.Nil(err)
+		assert.Equal("primary", dest)
+		assert.Equal([]string{"a.1", "a.5"}, primary.published)
+	}
+
+	// Case 4: no healthy destination
+	{
+		primaryProbe = nats.ErrConnectionClosed
+		uut.destinations["backup"].probe = func(ctxt context.Context) error {
+			return nats.ErrNoServers
+		}
+		assert.Nil(uut.checkHealth())
+		_, err := uut.Publish(route, publish("a.6"), ctxt)
+		assert.ErrorIs(err, ErrNoHealthyDestination)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// RedactedValue is the value which replaces a masked JSON field
+const RedactedValue = "[REDACTED]"
+
+// RedactionRule describes the parts of a message removed before delivery
+type RedactionRule struct {
+	// JSONFields are the dot separated paths of JSON fields whose values are masked, e.g.
+	// "customer.email". Arrays along a path are traversed, so the field is masked in every
+	// element. Message bodies which are not JSON are not changed.
+	JSONFields []string `json:"json_fields,omitempty" validate:"dive,required"`
+	// DropHeaders are the message headers removed. Names are matched case-insensitively.
+	DropHeaders []string `json:"drop_headers,omitempty" validate:"dive,required"`
+	// ExemptConsumers are the names of the durable consumers this rule does not apply to
+	ExemptConsumers []string `json:"exempt_consumers,omitempty"`
+}
+
+// appliesTo whether the rule applies to a consumer
+func (r RedactionRule) appliesTo(consumer string) bool {
+	for _, exempt := range r.ExemptConsumers {
+		if exempt == consumer {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadRedactionRules read the redaction rules of each stream from a JSON file
+//
+// The file is a JSON object mapping stream names to the list of rules for that stream.
+func LoadRedactionRules(path string) (map[string][]RedactionRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules map[string][]RedactionRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse redaction rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// MessageRedactor removes sensitive content from messages before they are delivered
+type MessageRedactor interface {
+	// Redact returns the message with the redaction rules for the stream and consumer applied.
+	// The original message is not changed.
+	Redact(stream, consumer string, msg *nats.Msg) (*nats.Msg, error)
+}
+
+// messageRedactorImpl implements MessageRedactor
+type messageRedactorImpl struct {
+	rules map[string][]RedactionRule
+}
+
+// GetMessageRedactor define new MessageRedactor given the redaction rules of each stream
+func GetMessageRedactor(rules map[string][]RedactionRule) (MessageRedactor, error) {
+	validate := validator.New()
+	for stream, streamRules := range rules {
+		for idx := range streamRules {
+			if err := validate.Struct(&streamRules[idx]); err != nil {
+				return nil, fmt.Errorf("stream %s redaction rule %d invalid: %w", stream, idx, err)
+			}
+		}
+	}
+	return &messageRedactorImpl{rules: rules}, nil
+}
+
+// Redact returns the message with the redaction rules for the stream and consumer applied.
+// The original message is not changed.
+func (r *messageRedactorImpl) Redact(stream, consumer string, msg *nats.Msg) (*nats.Msg, error) {
+	var jsonFields [][]string
+	var dropHeaders []string
+	for _, rule := range r.rules[stream] {
+		if !rule.appliesTo(consumer) {
+			continue
+		}
+		for _, field := range rule.JSONFields {
+			jsonFields = append(jsonFields, strings.Split(field, "."))
+		}
+		dropHeaders = append(dropHeaders, rule.DropHeaders...)
+	}
+	if len(jsonFields) == 0 && len(dropHeaders) == 0 {
+		return msg, nil
+	}
+
+	redacted := &nats.Msg{Subject: msg.Subject, Reply: msg.Reply, Data: msg.Data, Sub: msg.Sub}
+	if msg.Header != nil {
+		redacted.Header = nats.Header{}
+		for name, values := range msg.Header {
+			dropped := false
+			for _, drop := range dropHeaders {
+				if strings.EqualFold(name, drop) {
+					dropped = true
+					break
+				}
+			}
+			if !dropped {
+				redacted.Header[name] = values
+			}
+		}
+	}
+	if len(jsonFields) > 0 && json.Valid(msg.Data) {
+		decoder := json.NewDecoder(bytes.NewReader(msg.Data))
+		// Preserve numbers as they were published
+		decoder.UseNumber()
+		var body interface{}
+		if err := decoder.Decode(&body); err != nil {
+			return nil, err
+		}
+		for _, path := range jsonFields {
+			maskJSONField(body, path)
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		redacted.Data = data
+	}
+	return redacted, nil
+}
+
+// maskJSONField helper function to mask the field at path within a decoded JSON value
+func maskJSONField(value interface{}, path []string) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		child, ok := typed[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			typed[path[0]] = RedactedValue
+		} else {
+			maskJSONField(child, path[1:])
+		}
+	case []interface{}:
+		for _, element := range typed {
+			maskJSONField(element, path)
+		}
+	}
+}
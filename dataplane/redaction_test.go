@@ -0,0 +1,114 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRedactor(t *testing.T) {
+	assert := assert.New(t)
+
+	uut, err := GetMessageRedactor(map[string][]RedactionRule{
+		"orders": {
+			{
+				JSONFields:      []string{"customer.email", "items.card", "ssn"},
+				DropHeaders:     []string{"authorization"},
+				ExemptConsumers: []string{"billing"},
+			},
+		},
+	})
+	assert.Nil(err)
+
+	original := nats.NewMsg("orders.new")
+	original.Reply = "$JS.ACK.orders.c.1.1.1.0.0"
+	original.Header.Set("Authorization", "secret")
+	original.Header.Set("Trace-ID", "abc")
+	original.Data = []byte(
+		`{"id":12345678901234567890,"customer":{"email":"a@b.c","name":"A"},` +
+			`"items":[{"card":"4111","qty":1},{"qty":2}]}`,
+	)
+
+	// Case 0: rules applied
+	{
+		redacted, err := uut.Redact("orders", "analytics", original)
+		assert.Nil(err)
+		assert.Equal(original.Reply, redacted.Reply)
+		assert.Equal(
+			`{"customer":{"email":"[REDACTED]","name":"A"},"id":12345678901234567890,`+
+				`"items":[{"card":"[REDACTED]","qty":1},{"qty":2}]}`,
+			string(redacted.Data),
+		)
+		assert.Equal("", redacted.Header.Get("Authorization"))
+		assert.Equal("abc", redacted.Header.Get("Trace-ID"))
+		// Original is not changed
+		assert.Equal("secret", original.Header.Get("Authorization"))
+		assert.Contains(string(original.Data), "a@b.c")
+	}
+
+	// Case 1: exempt consumer
+	{
+		redacted, err := uut.Redact("orders", "billing", original)
+		assert.Nil(err)
+		assert.Equal(original, redacted)
+	}
+
+	// Case 2: stream without rules
+	{
+		redacted, err := uut.Redact("payments", "analytics", original)
+		assert.Nil(err)
+		assert.Equal(original, redacted)
+	}
+
+	// Case 3: body which is not JSON
+	{
+		msg := nats.NewMsg("orders.new")
+		msg.Data = []byte("plain text")
+		redacted, err := uut.Redact("orders", "analytics", msg)
+		assert.Nil(err)
+		assert.Equal("plain text", string(redacted.Data))
+	}
+
+	// Case 4: invalid rules
+	{
+		_, err := GetMessageRedactor(map[string][]RedactionRule{
+			"orders": {{JSONFields: []string{""}}},
+		})
+		assert.NotNil(err)
+	}
+}
+
+func TestLoadRedactionRules(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	assert.Nil(os.WriteFile(
+		path, []byte(`{"orders": [{"json_fields": ["customer.email"], "drop_headers": ["X-User"]}]}`), 0600,
+	))
+	rules, err := LoadRedactionRules(path)
+	assert.Nil(err)
+	assert.Len(rules["orders"], 1)
+	assert.Equal([]string{"customer.email"}, rules["orders"][0].JSONFields)
+	assert.Equal([]string{"X-User"}, rules["orders"][0].DropHeaders)
+
+	assert.Nil(os.WriteFile(path, []byte(`not json`), 0600))
+	_, err = LoadRedactionRules(path)
+	assert.NotNil(err)
+}
@@ -0,0 +1,354 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrInvalidResumeToken returned when a resume token can not be used
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// SubscriptionSession the parameters of a push subscription session through a durable
+// consumer, which a client can resume after reconnecting
+type SubscriptionSession struct {
+	// ID identifies the session across reconnects
+	ID string `json:"id"`
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Subject is the subject / subject filter subscribed to
+	Subject string `json:"subject"`
+	// Consumer is the name of the durable consumer
+	Consumer string `json:"consumer"`
+	// DeliveryGroup is the delivery group of the consumer, if any
+	DeliveryGroup *string `json:"delivery_group,omitempty"`
+	// MaxInflight is the max number of inflight messages
+	MaxInflight int `json:"max_inflight"`
+	// Concurrency bounds the messages forwarded awaiting ACK
+	Concurrency DeliveryConcurrency `json:"concurrency"`
+	// Selector is the selector expression choosing the messages delivered, if any
+	Selector string `json:"selector,omitempty"`
+	// Standby marks a session which only joins its delivery group while the group has no
+	// primary session
+	Standby bool `json:"standby,omitempty"`
+	// Metadata selects the computed metadata fields to annotate delivered messages with
+	Metadata DeliveryMetadataMask `json:"metadata,omitempty"`
+	// Pinned marks a session holding the lease of its consumer
+	Pinned bool `json:"pinned,omitempty"`
+	// Tenant is the tenant whose credentials the session is served with, if any
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// resumeToken the signed content of a resume token
+type resumeToken struct {
+	// Session is the session to resume
+	Session SubscriptionSession `json:"session"`
+	// Issued is when the token was issued, in Unix nanoseconds
+	Issued int64 `json:"issued"`
+}
+
+// SubscriptionSessionRegistry issues resume tokens for push subscription sessions, and
+// tracks the sessions running on this instance, so a client can reconnect to its session
+// by presenting its last resume token.
+type SubscriptionSessionRegistry interface {
+	// IssueToken issues a resume token for a session
+	IssueToken(session SubscriptionSession) (string, error)
+	// ReadToken verifies a resume token, and returns the session it resumes
+	ReadToken(token string) (SubscriptionSession, error)
+	// Attach marks a session as running on this instance. If the session is already running
+	// here, e.g. over a connection the client abandoned, stop of that run is called, and
+	// Attach waits until that run detaches.
+	//
+	// Returns the inflight message persistence for the run, which holds the records of
+	// messages delivered, but not yet ACKed, by earlier runs of the session; and the function
+	// to call to detach once the run ends.
+	Attach(
+		sessionID string, stop func(), ctxt context.Context,
+	) (InflightMsgPersistence, func(), error)
+	// InflightMessages returns the messages delivered by runs of a session on this instance
+	// which are still awaiting ACK, in stream sequence order
+	InflightMessages(sessionID string) []*nats.Msg
+}
+
+// subscriptionSessionEntry the state of a session known to this instance
+type subscriptionSessionEntry struct {
+	// stop ends the current run of the session; nil if not running
+	stop func()
+	// detached is closed once the current run ends
+	detached chan struct{}
+	// lastActive is when the session last ran
+	lastActive time.Time
+	// inflight the records of messages delivered awaiting ACK
+	inflight *sessionInflightRecords
+}
+
+// subscriptionSessionRegistryImpl implements SubscriptionSessionRegistry
+type subscriptionSessionRegistryImpl struct {
+	common.Component
+	nats     *core.NatsClient
+	key      []byte
+	tokenTTL time.Duration
+	persist  InflightMsgPersistence
+	lock     sync.Mutex
+	sessions map[string]*subscriptionSessionEntry
+}
+
+// GetSubscriptionSessionRegistry define new SubscriptionSessionRegistry
+//
+// A resume token is valid for tokenTTL after it is issued. Tokens are signed with key; if
+// key is empty, a random key is used, and the tokens are only valid on this instance.
+// persistence is optional, and is used to persist the records of inflight messages.
+func GetSubscriptionSessionRegistry(
+	natsClient *core.NatsClient,
+	key []byte,
+	tokenTTL time.Duration,
+	persistence InflightMsgPersistence,
+	instance string,
+) (SubscriptionSessionRegistry, error) {
+	logTags := log.Fields{
+		"module":    "dataplane",
+		"component": "subscription-session-registry",
+		"instance":  instance,
+	}
+	if tokenTTL <= 0 {
+		return nil, fmt.Errorf("resume token TTL must be positive")
+	}
+	if len(key) == 0 {
+		var err error
+		if key, err = newSigningKey(); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to define resume token key")
+			return nil, err
+		}
+	}
+	return &subscriptionSessionRegistryImpl{
+		Component: common.Component{LogTags: logTags},
+		nats:      natsClient,
+		key:       key,
+		tokenTTL:  tokenTTL,
+		persist:   persistence,
+		sessions:  make(map[string]*subscriptionSessionEntry),
+	}, nil
+}
+
+// IssueToken issues a resume token for a session
+func (r *subscriptionSessionRegistryImpl) IssueToken(
+	session SubscriptionSession,
+) (string, error) {
+	return encodeSignedToken(
+		&resumeToken{Session: session, Issued: time.Now().UnixNano()}, r.key,
+	)
+}
+
+// ReadToken verifies a resume token, and returns the session it resumes
+func (r *subscriptionSessionRegistryImpl) ReadToken(token string) (SubscriptionSession, error) {
+	var decoded resumeToken
+	if err := decodeSignedToken(token, r.key, &decoded); err != nil {
+		return SubscriptionSession{}, fmt.Errorf("%w: %s", ErrInvalidResumeToken, err)
+	}
+	if time.Since(time.Unix(0, decoded.Issued)) > r.tokenTTL {
+		return SubscriptionSession{}, fmt.Errorf("%w: expired", ErrInvalidResumeToken)
+	}
+	return decoded.Session, nil
+}
+
+// Attach marks a session as running on this instance, taking over from any earlier run
+func (r *subscriptionSessionRegistryImpl) Attach(
+	sessionID string, stop func(), ctxt context.Context,
+) (InflightMsgPersistence, func(), error) {
+	localLogTags, err := common.UpdateLogTags(r.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to update logtags")
+		return nil, nil, err
+	}
+	for {
+		r.lock.Lock()
+		r.dropExpired(time.Now())
+		entry, ok := r.sessions[sessionID]
+		if !ok {
+			entry = &subscriptionSessionEntry{
+				inflight: &sessionInflightRecords{
+					nats:       r.nats,
+					next:       r.persist,
+					ackTimeout: time.Second * 5,
+					records:    make(map[string]InflightMsgRecord),
+					messages:   make(map[string]*nats.Msg),
+				},
+			}
+			r.sessions[sessionID] = entry
+		}
+		if entry.stop == nil {
+			detached := make(chan struct{})
+			entry.stop = stop
+			entry.detached = detached
+			r.lock.Unlock()
+			detach := func() {
+				r.lock.Lock()
+				defer r.lock.Unlock()
+				if entry.detached == detached {
+					entry.stop = nil
+					entry.lastActive = time.Now()
+				}
+				close(detached)
+			}
+			return entry.inflight, detach, nil
+		}
+		// Take over from the current run
+		priorStop, priorDetached := entry.stop, entry.detached
+		r.lock.Unlock()
+		log.WithFields(localLogTags).Infof("Stopping earlier run of session %s", sessionID)
+		priorStop()
+		select {
+		case <-priorDetached:
+		case <-ctxt.Done():
+			log.WithError(ctxt.Err()).WithFields(localLogTags).Errorf(
+				"Earlier run of session %s did not stop", sessionID,
+			)
+			return nil, nil, ctxt.Err()
+		}
+	}
+}
+
+// InflightMessages returns the messages of a session still awaiting ACK
+func (r *subscriptionSessionRegistryImpl) InflightMessages(sessionID string) []*nats.Msg {
+	r.lock.Lock()
+	entry, ok := r.sessions[sessionID]
+	r.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return entry.inflight.inflightMessages()
+}
+
+// dropExpired forget sessions which have not run since before their last resume token
+// expired. Must be called with the lock held.
+func (r *subscriptionSessionRegistryImpl) dropExpired(now time.Time) {
+	for sessionID, entry := range r.sessions {
+		if entry.stop == nil && now.Sub(entry.lastActive) > r.tokenTTL {
+			delete(r.sessions, sessionID)
+		}
+	}
+}
+
+// ==============================================================================
+
+// sessionInflightRecords implements InflightMsgPersistence, holding the records of inflight
+// messages of a session in memory across runs of the session. Records are also passed to
+// the next InflightMsgPersistence, if set.
+type sessionInflightRecords struct {
+	nats       *core.NatsClient
+	next       InflightMsgPersistence
+	ackTimeout time.Duration
+	lock       sync.Mutex
+	records    map[string]InflightMsgRecord
+	// messages the recorded messages, for sending again to a resumed session
+	messages map[string]*nats.Msg
+}
+
+// RecordMessage records a new inflight message
+func (p *sessionInflightRecords) RecordMessage(
+	msg *nats.Msg, run string, ctxt context.Context,
+) error {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return err
+	}
+	key := inflightRecordKey(meta.Stream, meta.Consumer, meta.Sequence.Stream)
+	p.lock.Lock()
+	p.records[key] = InflightMsgRecord{
+		Stream:   meta.Stream,
+		Consumer: meta.Consumer,
+		Sequence: MsgToDeliverSeq{Stream: meta.Sequence.Stream, Consumer: meta.Sequence.Consumer},
+		Reply:    msg.Reply,
+		Run:      run,
+	}
+	p.messages[key] = msg
+	p.lock.Unlock()
+	if p.next != nil {
+		return p.next.RecordMessage(msg, run, ctxt)
+	}
+	return nil
+}
+
+// ClearMessage removes the record of a message once it is ACKed
+func (p *sessionInflightRecords) ClearMessage(
+	stream, consumer string, sequence uint64, ctxt context.Context,
+) error {
+	key := inflightRecordKey(stream, consumer, sequence)
+	p.lock.Lock()
+	delete(p.records, key)
+	delete(p.messages, key)
+	p.lock.Unlock()
+	if p.next != nil {
+		return p.next.ClearMessage(stream, consumer, sequence, ctxt)
+	}
+	return nil
+}
+
+// ACKPersistedMessage ACK a message delivered by an earlier run of the session. Returns
+// false if no record for the message exists.
+func (p *sessionInflightRecords) ACKPersistedMessage(
+	ack AckIndication, ctxt context.Context,
+) (bool, error) {
+	key := inflightRecordKey(ack.Stream, ack.Consumer, ack.SeqNum.Stream)
+	p.lock.Lock()
+	record, ok := p.records[key]
+	p.lock.Unlock()
+	if !ok {
+		if p.next != nil {
+			return p.next.ACKPersistedMessage(ack, ctxt)
+		}
+		return false, nil
+	}
+	// Same as nats.Msg.AckSync, but without the original subscription
+	if _, err := p.nats.NATs().Request(
+		record.Reply, ack.Kind().replyPayload(), p.ackTimeout,
+	); err != nil {
+		return true, err
+	}
+	if ack.Kind() == AckTypeProgress {
+		// The message remains inflight
+		return true, nil
+	}
+	if err := p.ClearMessage(ack.Stream, ack.Consumer, ack.SeqNum.Stream, ctxt); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// inflightMessages returns the recorded messages, in stream sequence order
+func (p *sessionInflightRecords) inflightMessages() []*nats.Msg {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	result := make([]*nats.Msg, 0, len(p.messages))
+	sequences := make(map[*nats.Msg]uint64, len(p.messages))
+	for key, msg := range p.messages {
+		result = append(result, msg)
+		sequences[msg] = p.records[key].Sequence.Stream
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return sequences[result[i]] < sequences[result[j]]
+	})
+	return result
+}
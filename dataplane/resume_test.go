@@ -0,0 +1,370 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeTokens(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-resume-tokens"
+
+	// Case 0: invalid token TTL
+	{
+		_, err := GetSubscriptionSessionRegistry(nil, nil, 0, nil, testName)
+		assert.NotNil(err)
+	}
+
+	group := uuid.New().String()
+	session := SubscriptionSession{
+		ID:            uuid.New().String(),
+		Stream:        uuid.New().String(),
+		Subject:       uuid.New().String(),
+		Consumer:      uuid.New().String(),
+		DeliveryGroup: &group,
+		MaxInflight:   4,
+		Concurrency:   DeliveryConcurrency{MaxUnacked: 2},
+	}
+
+	uut, err := GetSubscriptionSessionRegistry(nil, nil, time.Minute, nil, testName)
+	assert.Nil(err)
+
+	// Case 1: token round trip
+	token, err := uut.IssueToken(session)
+	assert.Nil(err)
+	{
+		resumed, err := uut.ReadToken(token)
+		assert.Nil(err)
+		assert.Equal(session, resumed)
+	}
+
+	// Case 2: malformed token
+	{
+		_, err := uut.ReadToken(uuid.New().String())
+		assert.True(errors.Is(err, ErrInvalidResumeToken))
+	}
+
+	// Case 3: token not signed by the registry
+	{
+		other, err := GetSubscriptionSessionRegistry(nil, nil, time.Minute, nil, testName)
+		assert.Nil(err)
+		_, err = other.ReadToken(token)
+		assert.True(errors.Is(err, ErrInvalidResumeToken))
+	}
+
+	// Case 4: registries sharing a key accept each other's tokens
+	{
+		key := []byte(uuid.New().String())
+		uut1, err := GetSubscriptionSessionRegistry(nil, key, time.Minute, nil, testName)
+		assert.Nil(err)
+		uut2, err := GetSubscriptionSessionRegistry(nil, key, time.Minute, nil, testName)
+		assert.Nil(err)
+		token, err := uut1.IssueToken(session)
+		assert.Nil(err)
+		resumed, err := uut2.ReadToken(token)
+		assert.Nil(err)
+		assert.Equal(session, resumed)
+	}
+
+	// Case 5: expired token
+	{
+		short, err := GetSubscriptionSessionRegistry(
+			nil, nil, time.Millisecond*100, nil, testName,
+		)
+		assert.Nil(err)
+		token, err := short.IssueToken(session)
+		assert.Nil(err)
+		time.Sleep(time.Millisecond * 200)
+		_, err = short.ReadToken(token)
+		assert.True(errors.Is(err, ErrInvalidResumeToken))
+	}
+}
+
+func TestSessionInflightMessages(t *testing.T) {
+	assert := assert.New(t)
+	testName := "ut-session-inflight-messages"
+
+	uut, err := GetSubscriptionSessionRegistry(nil, nil, time.Minute, nil, testName)
+	assert.Nil(err)
+	sessionID := uuid.New().String()
+
+	// Case 0: unknown session
+	assert.Empty(uut.InflightMessages(sessionID))
+
+	persist, detach, err := uut.Attach(sessionID, func() {}, context.Background())
+	assert.Nil(err)
+	defer detach()
+
+	// Case 1: recorded messages are listed in stream order
+	inflightMsg := func(streamSeq int) *nats.Msg {
+		return &nats.Msg{
+			Subject: "test-subject",
+			Reply: fmt.Sprintf(
+				"$JS.ACK.stream-1.consumer-1.1.%d.%d.1634000000000000000.0", streamSeq, streamSeq,
+			),
+			Data: []byte(fmt.Sprintf("msg-%d", streamSeq)),
+			Sub:  &nats.Subscription{},
+		}
+	}
+	for _, streamSeq := range []int{30, 4, 17} {
+		assert.Nil(persist.RecordMessage(inflightMsg(streamSeq), "run-1", context.Background()))
+	}
+	{
+		pending := uut.InflightMessages(sessionID)
+		assert.Len(pending, 3)
+		for idx, expected := range []string{"msg-4", "msg-17", "msg-30"} {
+			assert.Equal(expected, string(pending[idx].Data))
+		}
+	}
+
+	// Case 2: ACKed messages are no longer listed
+	{
+		assert.Nil(persist.ClearMessage("stream-1", "consumer-1", 17, context.Background()))
+		pending := uut.InflightMessages(sessionID)
+		assert.Len(pending, 2)
+		assert.Equal("msg-4", string(pending[0].Data))
+		assert.Equal("msg-30", string(pending[1].Data))
+	}
+}
+
+func TestSubscriptionSessionResume(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-subscription-session-resume"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "SubscriptionSessionRegistry",
+		"instance":  "resume",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream and consumer for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.resume", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+	consumer1 := uuid.New().String()
+	maxInflight := 4
+	{
+		param := management.JetStreamConsumerParam{
+			Name: consumer1, MaxInflight: maxInflight, Mode: "push", FilterSubject: &subject1,
+		}
+		assert.Nil(jsCtrl.CreateConsumerForStream(stream1, param, utCtxt))
+	}
+
+	uut, err := GetSubscriptionSessionRegistry(js, nil, time.Minute, nil, testName)
+	assert.Nil(err)
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+	ackSend, err := GetJetStreamACKBroadcaster(js, testName)
+	assert.Nil(err)
+
+	sessionID := uuid.New().String()
+	msgRxChan := make(chan *nats.Msg, maxInflight)
+	msgHandler := func(msg *nats.Msg, _ context.Context) error {
+		msgRxChan <- msg
+		return nil
+	}
+	internalErrorHandler := func(err error) {
+		log.WithError(err).WithFields(logTags).Debug("Dispatcher stopped")
+	}
+
+	// Case 0: first run of the session
+	wg1 := sync.WaitGroup{}
+	run1Ctxt, run1Cancel := context.WithCancel(utCtxt)
+	defer run1Cancel()
+	run1Stopped := make(chan bool, 1)
+	persist1, detach1, err := uut.Attach(sessionID, func() { run1Stopped <- true }, utCtxt)
+	assert.Nil(err)
+	run1, err := GetPushMessageDispatcher(
+		js,
+		stream1,
+		subject1,
+		consumer1,
+		nil,
+		maxInflight,
+		DeliveryConcurrency{},
+		PushDispatcherOptions{Persistence: persist1},
+		&wg1,
+		run1Ctxt,
+	)
+	assert.Nil(err)
+	assert.Nil(run1.Start(msgHandler, internalErrorHandler))
+
+	msg := []byte(uuid.New().String())
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		assert.Nil(publisher.Publish(subject1, msg, ctxt))
+		cancel()
+	}
+	msgSeqNum := AckSeqNum{}
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		select {
+		case rxMsg, ok := <-msgRxChan:
+			assert.True(ok)
+			assert.Equal(msg, rxMsg.Data)
+			meta, err := rxMsg.Metadata()
+			assert.Nil(err)
+			msgSeqNum.Consumer = meta.Sequence.Consumer
+			msgSeqNum.Stream = meta.Sequence.Stream
+		case <-ctxt.Done():
+			assert.False(true)
+		}
+		cancel()
+	}
+	log.Debug("============================= 1 =============================")
+
+	// Case 1: resuming the session stops the first run, and waits for it to detach
+	type attachResult struct {
+		persist InflightMsgPersistence
+		detach  func()
+		err     error
+	}
+	attached := make(chan attachResult, 1)
+	go func() {
+		persist, detach, err := uut.Attach(sessionID, func() {}, utCtxt)
+		attached <- attachResult{persist: persist, detach: detach, err: err}
+	}()
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		select {
+		case <-run1Stopped:
+		case <-ctxt.Done():
+			assert.False(true)
+		}
+		cancel()
+	}
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Millisecond*200)
+		select {
+		case <-attached:
+			assert.False(true)
+		case <-ctxt.Done():
+		}
+		cancel()
+	}
+	run1Cancel()
+	wg1.Wait()
+	detach1()
+	var run2Attach attachResult
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		select {
+		case run2Attach = <-attached:
+			assert.Nil(run2Attach.err)
+		case <-ctxt.Done():
+			assert.False(true)
+		}
+		cancel()
+	}
+	log.Debug("============================= 2 =============================")
+
+	// Case 2: the second run binds to the same consumer, and can ACK the message delivered by
+	// the first run
+	wg2 := sync.WaitGroup{}
+	defer wg2.Wait()
+	run2Ctxt, run2Cancel := context.WithCancel(utCtxt)
+	defer run2Cancel()
+	run2, err := GetPushMessageDispatcher(
+		js,
+		stream1,
+		subject1,
+		consumer1,
+		nil,
+		maxInflight,
+		DeliveryConcurrency{},
+		PushDispatcherOptions{Persistence: run2Attach.persist},
+		&wg2,
+		run2Ctxt,
+	)
+	assert.Nil(err)
+	assert.Nil(run2.Start(msgHandler, internalErrorHandler))
+	assert.Nil(ackSend.BroadcastACK(
+		AckIndication{Stream: stream1, Consumer: consumer1, SeqNum: msgSeqNum}, utCtxt,
+	))
+	{
+		acked := false
+		for itr := 0; itr < 10 && !acked; itr++ {
+			time.Sleep(time.Millisecond * 100)
+			info, err := js.JetStream().ConsumerInfo(stream1, consumer1)
+			assert.Nil(err)
+			acked = info.NumAckPending == 0
+		}
+		assert.True(acked)
+	}
+	run2Cancel()
+	wg2.Wait()
+	run2Attach.detach()
+	log.Debug("============================= 3 =============================")
+}
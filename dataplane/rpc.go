@@ -0,0 +1,137 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// RPCCorrelationIDHeader is the message header carrying the correlation ID of a request
+const RPCCorrelationIDHeader = "Httpmq-Correlation-ID"
+
+// RPCReplyToHeader is the message header carrying the subject replies to a request are sent to
+const RPCReplyToHeader = "Httpmq-Reply-To"
+
+// RPCReply is a reply to a request
+type RPCReply struct {
+	// Subject is the subject the reply was sent to
+	Subject string `json:"subject"`
+	// Headers are the reply headers, if any
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Message is the reply body
+	Message []byte `json:"b64_msg"`
+}
+
+// IsValidCorrelationID check whether a correlation ID is usable. As the correlation ID is one
+// token of the reply subject, it can not contain '.', '*', '>', or whitespace.
+func IsValidCorrelationID(correlationID string) bool {
+	return correlationID != "" && !strings.ContainsAny(correlationID, ".*> \t\r\n")
+}
+
+// JetStreamRequester implements request / reply over JetStream. A request is published into
+// JetStream, carrying the correlation ID, and the subject responders send replies to.
+type JetStreamRequester interface {
+	// Request publishes a request into JetStream on a subject, and gathers the replies to it
+	// until maxReplies are received, or ctxt ends.
+	Request(
+		subject, correlationID string, msg []byte, maxReplies int, ctxt context.Context,
+	) ([]RPCReply, error)
+}
+
+// jetStreamRequesterImpl implements JetStreamRequester
+type jetStreamRequesterImpl struct {
+	common.Component
+	nats        *core.NatsClient
+	replyPrefix string
+}
+
+// GetJetStreamRequester get new JetStreamRequester
+//
+// The replies to a request are sent to the subject "<replyPrefix>.<correlation ID>".
+func GetJetStreamRequester(
+	natsClient *core.NatsClient, replyPrefix, instance string,
+) (JetStreamRequester, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "js-requester", "instance": instance,
+	}
+	if replyPrefix == "" || strings.ContainsAny(replyPrefix, "*> \t") {
+		return nil, fmt.Errorf("invalid RPC reply subject prefix '%s'", replyPrefix)
+	}
+	return &jetStreamRequesterImpl{
+		Component: common.Component{LogTags: logTags}, nats: natsClient, replyPrefix: replyPrefix,
+	}, nil
+}
+
+// Request publishes a request into JetStream on a subject, and gathers the replies to it
+// until maxReplies are received, or ctxt ends.
+func (s *jetStreamRequesterImpl) Request(
+	subject, correlationID string, msg []byte, maxReplies int, ctxt context.Context,
+) ([]RPCReply, error) {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	if !IsValidCorrelationID(correlationID) {
+		return nil, fmt.Errorf("invalid correlation ID '%s'", correlationID)
+	}
+	replySubject := fmt.Sprintf("%s.%s", s.replyPrefix, correlationID)
+
+	// Listen for replies before sending the request
+	sub, err := s.nats.NATs().SubscribeSync(replySubject)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to subscribe to %s", replySubject)
+		return nil, err
+	}
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unsubscribe failed")
+		}
+	}()
+
+	request := nats.NewMsg(subject)
+	request.Header.Set(RPCCorrelationIDHeader, correlationID)
+	request.Header.Set(RPCReplyToHeader, replySubject)
+	request.Data = msg
+	if _, err := s.nats.JetStream().PublishMsg(request, nats.Context(ctxt)); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to send request to %s", subject)
+		return nil, err
+	}
+
+	replies := []RPCReply{}
+	for len(replies) < maxReplies {
+		reply, err := sub.NextMsgWithContext(ctxt)
+		if err != nil {
+			// Out of time to wait for more replies
+			break
+		}
+		converted := RPCReply{Subject: reply.Subject, Message: reply.Data}
+		if len(reply.Header) > 0 {
+			converted.Headers = reply.Header
+		}
+		replies = append(replies, converted)
+	}
+	log.WithFields(localLogTags).Debugf(
+		"Received %d replies for request %s on %s", len(replies), correlationID, subject,
+	)
+	return replies, nil
+}
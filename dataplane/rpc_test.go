@@ -0,0 +1,157 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJetStreamRequester(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-requester"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamRequester",
+		"instance":  "basic",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.requests", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+
+	// Case 0: invalid reply prefix
+	{
+		_, err := GetJetStreamRequester(js, "rpc.*", testName)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetJetStreamRequester(js, "ut.rpc.reply", testName)
+	assert.Nil(err)
+
+	// Define a responder which replies twice to each request
+	responder, err := js.JetStream().Subscribe(subject1, func(msg *nats.Msg) {
+		replyTo := msg.Header.Get(RPCReplyToHeader)
+		correlationID := msg.Header.Get(RPCCorrelationIDHeader)
+		for itr := 0; itr < 2; itr++ {
+			reply := nats.NewMsg(replyTo)
+			reply.Header.Set(RPCCorrelationIDHeader, correlationID)
+			reply.Data = []byte(fmt.Sprintf("%s-%d", msg.Data, itr))
+			assert.Nil(js.NATs().PublishMsg(reply))
+		}
+		assert.Nil(msg.Ack())
+	}, nats.DeliverNew())
+	assert.Nil(err)
+	defer func() {
+		assert.Nil(responder.Unsubscribe())
+	}()
+
+	// Case 1: invalid correlation ID
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		_, err := uut.Request(subject1, "a.b", []byte("hello"), 1, ctxt)
+		assert.NotNil(err)
+	}
+
+	// Case 2: request with one reply
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		correlationID := uuid.New().String()
+		replies, err := uut.Request(subject1, correlationID, []byte("hello"), 1, ctxt)
+		assert.Nil(err)
+		assert.Len(replies, 1)
+		assert.Equal(fmt.Sprintf("ut.rpc.reply.%s", correlationID), replies[0].Subject)
+		assert.Equal("hello-0", string(replies[0].Message))
+		assert.Equal(correlationID, nats.Header(replies[0].Headers).Get(RPCCorrelationIDHeader))
+	}
+
+	// Case 3: gather replies until the timeout
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Millisecond*300)
+		defer cancel()
+		replies, err := uut.Request(subject1, uuid.New().String(), []byte("world"), 5, ctxt)
+		assert.Nil(err)
+		assert.Len(replies, 2)
+		assert.Equal("world-0", string(replies[0].Message))
+		assert.Equal("world-1", string(replies[1].Message))
+	}
+
+	// Case 4: request to a subject no stream is listening on
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		_, err := uut.Request(uuid.New().String(), uuid.New().String(), []byte("lost"), 1, ctxt)
+		assert.NotNil(err)
+	}
+}
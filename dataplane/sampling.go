@@ -0,0 +1,306 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/hooks"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// SamplingPoint is where in the message lifecycle a message is sampled
+type SamplingPoint string
+
+const (
+	// SamplePublish samples messages as they are published
+	SamplePublish SamplingPoint = "publish"
+	// SampleDeliver samples messages as they are delivered to a client
+	SampleDeliver SamplingPoint = "deliver"
+)
+
+// SamplingRule selects the messages of a subject to copy to an inspection destination
+type SamplingRule struct {
+	// Subject is the subject filter of the sampled messages; wildcards are supported
+	Subject string `json:"subject" validate:"required"`
+	// Point is where the messages are sampled. Defaults to publish.
+	Point SamplingPoint `json:"point,omitempty" validate:"omitempty,oneof=publish deliver"`
+	// Percent is the percentage of messages sampled at random
+	Percent float64 `json:"percent,omitempty" validate:"required_without=OneIn,excluded_with=OneIn,omitempty,gt=0,lte=100"`
+	// OneIn samples every Nth message
+	OneIn uint64 `json:"one_in,omitempty" validate:"required_without=Percent,omitempty,gte=1"`
+	// TargetSubject if set, samples are published as JSON on this NATS subject
+	TargetSubject string `json:"target_subject,omitempty" validate:"required_without=WebhookURL"`
+	// WebhookURL if set, samples are POSTed as JSON to this URL
+	WebhookURL string `json:"webhook_url,omitempty" validate:"omitempty,url"`
+}
+
+// LoadSamplingRules read the message sampling rules from a JSON file
+//
+// The file is a JSON list of rules. A message matching several rules is sampled by each.
+func LoadSamplingRules(path string) ([]SamplingRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []SamplingRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse sampling rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// MessageSample is a copy of a sampled message
+type MessageSample struct {
+	// Point is where the message was sampled
+	Point SamplingPoint `json:"point"`
+	// Rule is the subject filter of the rule which sampled the message
+	Rule string `json:"rule"`
+	// Replica is the dataplane instance which sampled the message
+	Replica string `json:"replica"`
+	// Subject is the subject of the message
+	Subject string `json:"subject"`
+	// Stream is the stream delivering the message, for a delivered message
+	Stream string `json:"stream,omitempty"`
+	// Consumer is the consumer delivering the message, for a delivered message
+	Consumer string `json:"consumer,omitempty"`
+	// Sequence is the stream sequence number, for a delivered message
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Headers are the message headers, for a delivered message
+	Headers nats.Header `json:"headers,omitempty"`
+	// Message is the message body
+	Message []byte `json:"b64_msg"`
+	// Sampled is when the message was sampled
+	Sampled time.Time `json:"sampled"`
+}
+
+// String toString function for MessageSample
+func (s MessageSample) String() string {
+	return fmt.Sprintf("SAMPLE[%s %s] %s", s.Point, s.Rule, s.Subject)
+}
+
+// MessageSamplerParam settings for sampling messages to inspection destinations
+type MessageSamplerParam struct {
+	// Rules are the sampling rules
+	Rules []SamplingRule `validate:"required,min=1,dive"`
+	// WebhookTimeout is the timeout of each webhook call
+	WebhookTimeout time.Duration `validate:"gt=0"`
+	// QueueLength is the max number of samples waiting to be sent. Samples beyond it are
+	// dropped, so a slow destination does not hold up publish or delivery.
+	QueueLength int `validate:"gte=1"`
+}
+
+// queuedSample a sample waiting to be sent to the destination of a rule
+type queuedSample struct {
+	rule   *SamplingRule
+	sample MessageSample
+}
+
+// MessageSampler is a hooks.Plugin copying a share of the published and delivered messages
+// to inspection destinations. Sampling never changes or stops the message itself.
+type MessageSampler struct {
+	hooks.BasePlugin
+	common.Component
+	param    MessageSamplerParam
+	replica  string
+	nats     *core.NatsClient
+	client   *http.Client
+	queue    chan queuedSample
+	counters []uint64
+	random   *rand.Rand
+	lock     sync.Mutex
+}
+
+// GetMessageSampler define a new MessageSampler. Samples are sent, in order, by a goroutine
+// until ctxt ends. natsClient is only needed if samples are sent over NATS.
+func GetMessageSampler(
+	param MessageSamplerParam,
+	natsClient *core.NatsClient,
+	replica string,
+	ctxt context.Context,
+	wg *sync.WaitGroup,
+) (*MessageSampler, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "message-sampler", "instance": replica,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		return nil, err
+	}
+	for idx, rule := range param.Rules {
+		if rule.Point == "" {
+			param.Rules[idx].Point = SamplePublish
+		}
+		if rule.TargetSubject != "" && natsClient == nil {
+			return nil, fmt.Errorf("NATS sampling of %s needs a NATS client", rule.Subject)
+		}
+	}
+	sampler := &MessageSampler{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		replica:   replica,
+		nats:      natsClient,
+		client:    &http.Client{Timeout: param.WebhookTimeout},
+		queue:     make(chan queuedSample, param.QueueLength),
+		counters:  make([]uint64, len(param.Rules)),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctxt.Done():
+				return
+			case queued := <-sampler.queue:
+				sampler.send(queued, ctxt)
+			}
+		}
+	}()
+	return sampler, nil
+}
+
+// OnPublish samples a message about to be published
+func (s *MessageSampler) OnPublish(event *hooks.PublishEvent, ctxt context.Context) error {
+	s.sample(SamplePublish, event.Subject, func() MessageSample {
+		return MessageSample{Subject: event.Subject, Message: copyBytes(event.Message)}
+	})
+	return nil
+}
+
+// OnDeliver samples a message about to be delivered to a client
+func (s *MessageSampler) OnDeliver(event *hooks.DeliverEvent, ctxt context.Context) {
+	msg := event.Message
+	s.sample(SampleDeliver, msg.Subject, func() MessageSample {
+		sample := MessageSample{
+			Subject:  msg.Subject,
+			Stream:   event.Stream,
+			Consumer: event.Consumer,
+			Message:  copyBytes(msg.Data),
+		}
+		if len(msg.Header) > 0 {
+			sample.Headers = make(nats.Header, len(msg.Header))
+			for key, values := range msg.Header {
+				sample.Headers[key] = append([]string(nil), values...)
+			}
+		}
+		// The message may be a modified copy without the JetStream reply subject
+		if meta, err := msg.Metadata(); err == nil {
+			sample.Sequence = meta.Sequence.Stream
+		}
+		return sample
+	})
+}
+
+// sample helper function to queue a sample of a message for each rule selecting it. The
+// sample is only built if a rule selects the message.
+func (s *MessageSampler) sample(
+	point SamplingPoint, subject string, build func() MessageSample,
+) {
+	var sample *MessageSample
+	for idx := range s.param.Rules {
+		rule := &s.param.Rules[idx]
+		if rule.Point != point || !common.SubjectMatches(rule.Subject, subject) {
+			continue
+		}
+		if !s.selected(idx) {
+			continue
+		}
+		if sample == nil {
+			built := build()
+			built.Point = point
+			built.Replica = s.replica
+			built.Sampled = time.Now()
+			sample = &built
+		}
+		queued := queuedSample{rule: rule, sample: *sample}
+		queued.sample.Rule = rule.Subject
+		select {
+		case s.queue <- queued:
+		default:
+			log.WithFields(s.LogTags).Warnf("Sample queue full, dropping %s", queued.sample)
+		}
+	}
+}
+
+// selected helper function to decide whether a rule samples the current message
+func (s *MessageSampler) selected(ruleIdx int) bool {
+	rule := &s.param.Rules[ruleIdx]
+	if rule.OneIn > 0 {
+		return atomic.AddUint64(&s.counters[ruleIdx], 1)%rule.OneIn == 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.random.Float64()*100 < rule.Percent
+}
+
+// send helper function to deliver a sample to the destinations of its rule
+func (s *MessageSampler) send(queued queuedSample, ctxt context.Context) {
+	payload, err := json.Marshal(&queued.sample)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Unable to serialize %s", queued.sample)
+		return
+	}
+	if queued.rule.WebhookURL != "" {
+		if err := s.post(queued.rule.WebhookURL, payload, ctxt); err != nil {
+			log.WithError(err).WithFields(s.LogTags).Errorf("Failed to POST %s", queued.sample)
+		}
+	}
+	if queued.rule.TargetSubject != "" {
+		if err := s.nats.NATs().Publish(queued.rule.TargetSubject, payload); err != nil {
+			log.WithError(err).WithFields(s.LogTags).Errorf(
+				"Failed to publish %s on %s", queued.sample, queued.rule.TargetSubject,
+			)
+		}
+	}
+}
+
+// post helper function to POST a sample to a webhook
+func (s *MessageSampler) post(url string, payload []byte, ctxt context.Context) error {
+	req, err := http.NewRequestWithContext(ctxt, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// copyBytes helper function to copy a buffer which may be reused by its owner
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(data)), data...)
+}
@@ -0,0 +1,140 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/hooks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageSampler(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	received := make(chan MessageSample, 16)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sample MessageSample
+		if err := json.NewDecoder(r.Body).Decode(&sample); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- sample
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer webhook.Close()
+
+	// Case 0: invalid parameters
+	{
+		badRules := [][]SamplingRule{
+			{},
+			{{Subject: "orders.>", WebhookURL: webhook.URL}},
+			{{Subject: "orders.>", OneIn: 2, Percent: 10, WebhookURL: webhook.URL}},
+			{{Subject: "orders.>", Percent: 150, WebhookURL: webhook.URL}},
+			{{Subject: "orders.>", OneIn: 2}},
+			{{Subject: "orders.>", OneIn: 2, Point: "ack", WebhookURL: webhook.URL}},
+			{{Subject: "orders.>", OneIn: 2, TargetSubject: "samples"}},
+		}
+		for _, rules := range badRules {
+			_, err := GetMessageSampler(
+				MessageSamplerParam{Rules: rules, WebhookTimeout: time.Second, QueueLength: 4},
+				nil, "ut-replica", utCtxt, &wg,
+			)
+			assert.NotNil(err)
+		}
+	}
+
+	uut, err := GetMessageSampler(
+		MessageSamplerParam{
+			Rules: []SamplingRule{
+				{Subject: "orders.*", OneIn: 2, WebhookURL: webhook.URL},
+				{Subject: "orders.>", Point: SampleDeliver, Percent: 100, WebhookURL: webhook.URL},
+			},
+			WebhookTimeout: time.Second,
+			QueueLength:    16,
+		},
+		nil, "ut-replica", utCtxt, &wg,
+	)
+	assert.Nil(err)
+
+	// Case 1: every other published message is sampled, without changing the message
+	{
+		for idx := 0; idx < 4; idx++ {
+			body := []byte{'a' + byte(idx)}
+			event := hooks.PublishEvent{Subject: "orders.new", Message: body}
+			assert.Nil(uut.OnPublish(&event, utCtxt))
+			assert.Equal(body, event.Message)
+			// The publish buffer is reused once the hook returns
+			body[0] = 'z'
+		}
+		event := hooks.PublishEvent{Subject: "payments.new", Message: []byte("x")}
+		assert.Nil(uut.OnPublish(&event, utCtxt))
+		for _, expected := range []string{"b", "d"} {
+			select {
+			case sample := <-received:
+				assert.Equal(SamplePublish, sample.Point)
+				assert.Equal("orders.*", sample.Rule)
+				assert.Equal("ut-replica", sample.Replica)
+				assert.Equal("orders.new", sample.Subject)
+				assert.Equal(expected, string(sample.Message))
+			case <-time.After(time.Second * 2):
+				assert.False(true, "sample not sent")
+			}
+		}
+	}
+
+	// Case 2: delivered messages are sampled with their headers and sequence
+	{
+		msg := nats.NewMsg("orders.eu.new")
+		msg.Data = []byte("delivered")
+		msg.Header.Set("Region", "eu")
+		msg.Reply = "$JS.ACK.orders.billing.1.12.3.1645000000000000000.0"
+		msg.Sub = &nats.Subscription{}
+		event := hooks.DeliverEvent{Stream: "orders", Consumer: "billing", Message: msg}
+		uut.OnDeliver(&event, utCtxt)
+		assert.Equal(msg, event.Message)
+		select {
+		case sample := <-received:
+			assert.Equal(SampleDeliver, sample.Point)
+			assert.Equal("orders.>", sample.Rule)
+			assert.Equal("orders", sample.Stream)
+			assert.Equal("billing", sample.Consumer)
+			assert.Equal(uint64(12), sample.Sequence)
+			assert.Equal("eu", sample.Headers.Get("Region"))
+			assert.Equal("delivered", string(sample.Message))
+		case <-time.After(time.Second * 2):
+			assert.False(true, "sample not sent")
+		}
+	}
+
+	// Case 3: nothing else was sampled
+	select {
+	case sample := <-received:
+		assert.False(true, "unexpected sample %s", sample)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
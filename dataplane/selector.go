@@ -0,0 +1,824 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/nats-io/nats.go"
+)
+
+// MaxSelectorLength is the max length of a selector expression
+const MaxSelectorLength = 4096
+
+// maxSelectorDepth is the max nesting depth of a selector expression
+const maxSelectorDepth = 32
+
+// MessageSelector decides which messages of a subscription are delivered, based on an
+// SQL-like expression over the message's subject, headers, and JSON body, e.g.
+//
+//	headers.type = 'order' AND json.amount > 100
+//
+// Fields are "subject", "headers.<name>" (header names are matched case-insensitively),
+// and "json.<path>", a dot separated path into the JSON body, where array elements are
+// numbered from 0. Conditions are comparisons (=, !=, <>, <, <=, >, >=), "[NOT] IN (...)",
+// "[NOT] LIKE '...'" with % and _ wildcards, "IS [NOT] NULL", or a boolean field, combined
+// with AND, OR, NOT, and parentheses. Keywords are case-insensitive. String literals are
+// single quoted, and a quote within a string is written twice.
+//
+// A comparison is false if a field is missing, or the values are of different types.
+// Header values are compared as numbers or booleans when compared with those literals.
+type MessageSelector interface {
+	// Matches whether a message is selected
+	Matches(msg *nats.Msg) bool
+	// String returns the selector expression
+	String() string
+}
+
+// SelectorError describes why a selector expression is invalid
+type SelectorError struct {
+	// Expression is the selector expression
+	Expression string
+	// Pos is the byte offset in the expression where the error was found
+	Pos int
+	// Reason describes the error
+	Reason string
+}
+
+// Error implements error
+func (e *SelectorError) Error() string {
+	if e.Pos >= len(e.Expression) {
+		return fmt.Sprintf("invalid selector at end of expression: %s", e.Reason)
+	}
+	near := e.Expression[e.Pos:]
+	if len(near) > 16 {
+		near = near[:16] + "..."
+	}
+	return fmt.Sprintf("invalid selector at position %d (near %q): %s", e.Pos+1, near, e.Reason)
+}
+
+// CompileMessageSelector compile a selector expression. Returns a *SelectorError if the
+// expression is invalid.
+func CompileMessageSelector(expression string) (MessageSelector, error) {
+	if len(expression) > MaxSelectorLength {
+		return nil, &SelectorError{
+			Expression: expression,
+			Reason:     fmt.Sprintf("longer than %d characters", MaxSelectorLength),
+		}
+	}
+	tokens, err := lexSelector(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{expression: expression, tokens: tokens}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != selTokEnd {
+		return nil, p.errorAt(tok, "expected AND, OR, or end of expression")
+	}
+	return &messageSelectorImpl{expression: expression, root: root}, nil
+}
+
+// messageSelectorImpl implements MessageSelector
+type messageSelectorImpl struct {
+	expression string
+	root       selectorNode
+}
+
+// Matches whether a message is selected
+func (s *messageSelectorImpl) Matches(msg *nats.Msg) bool {
+	return s.root.eval(&selectorMessage{msg: msg})
+}
+
+// String returns the selector expression
+func (s *messageSelectorImpl) String() string {
+	return s.expression
+}
+
+// ==============================================================================
+// Lexer
+
+type selectorTokenKind int
+
+const (
+	selTokEnd selectorTokenKind = iota
+	selTokIdent
+	selTokString
+	selTokNumber
+	selTokOperator
+	selTokLParen
+	selTokRParen
+	selTokComma
+)
+
+// selectorToken one token of a selector expression
+type selectorToken struct {
+	kind selectorTokenKind
+	// text is the token text. For strings, this is the unquoted value.
+	text string
+	pos  int
+}
+
+// keyword returns the upper cased token text if the token could be a keyword
+func (t selectorToken) keyword() string {
+	if t.kind != selTokIdent {
+		return ""
+	}
+	return strings.ToUpper(t.text)
+}
+
+// isSelectorIdentChar whether a character may be part of an identifier. Header names may
+// contain '-', which is not otherwise used by the language.
+func isSelectorIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.' || c == '-'
+}
+
+// lexSelector split a selector expression into tokens
+func lexSelector(expression string) ([]selectorToken, error) {
+	tokens := []selectorToken{}
+	runes := []rune(expression)
+	// byte offsets of each rune, for error positions
+	offsets := make([]int, len(runes)+1)
+	{
+		offset := 0
+		for idx, c := range runes {
+			offsets[idx] = offset
+			offset += len(string(c))
+		}
+		offsets[len(runes)] = offset
+	}
+	for idx := 0; idx < len(runes); {
+		c := runes[idx]
+		start := idx
+		switch {
+		case unicode.IsSpace(c):
+			idx++
+			continue
+		case c == '(':
+			tokens = append(tokens, selectorToken{kind: selTokLParen, text: "(", pos: offsets[start]})
+			idx++
+		case c == ')':
+			tokens = append(tokens, selectorToken{kind: selTokRParen, text: ")", pos: offsets[start]})
+			idx++
+		case c == ',':
+			tokens = append(tokens, selectorToken{kind: selTokComma, text: ",", pos: offsets[start]})
+			idx++
+		case c == '\'':
+			var value strings.Builder
+			idx++
+			closed := false
+			for idx < len(runes) {
+				if runes[idx] == '\'' {
+					if idx+1 < len(runes) && runes[idx+1] == '\'' {
+						value.WriteRune('\'')
+						idx += 2
+						continue
+					}
+					idx++
+					closed = true
+					break
+				}
+				value.WriteRune(runes[idx])
+				idx++
+			}
+			if !closed {
+				return nil, &SelectorError{
+					Expression: expression, Pos: offsets[start], Reason: "unterminated string",
+				}
+			}
+			tokens = append(
+				tokens, selectorToken{kind: selTokString, text: value.String(), pos: offsets[start]},
+			)
+		case c == '=' || c == '<' || c == '>' || c == '!':
+			op := string(c)
+			idx++
+			if idx < len(runes) && (runes[idx] == '=' || (c == '<' && runes[idx] == '>')) {
+				op += string(runes[idx])
+				idx++
+			}
+			if op == "!" {
+				return nil, &SelectorError{
+					Expression: expression, Pos: offsets[start], Reason: "expected != or NOT",
+				}
+			}
+			tokens = append(tokens, selectorToken{kind: selTokOperator, text: op, pos: offsets[start]})
+		case unicode.IsDigit(c) || ((c == '-' || c == '+') &&
+			idx+1 < len(runes) && (unicode.IsDigit(runes[idx+1]) || runes[idx+1] == '.')) ||
+			(c == '.' && idx+1 < len(runes) && unicode.IsDigit(runes[idx+1])):
+			idx++
+			for idx < len(runes) && (isSelectorIdentChar(runes[idx]) || runes[idx] == '+') {
+				idx++
+			}
+			text := string(runes[start:idx])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, &SelectorError{
+					Expression: expression, Pos: offsets[start], Reason: fmt.Sprintf("invalid number %s", text),
+				}
+			}
+			tokens = append(tokens, selectorToken{kind: selTokNumber, text: text, pos: offsets[start]})
+		case isSelectorIdentChar(c):
+			for idx < len(runes) && isSelectorIdentChar(runes[idx]) {
+				idx++
+			}
+			tokens = append(
+				tokens, selectorToken{kind: selTokIdent, text: string(runes[start:idx]), pos: offsets[start]},
+			)
+		default:
+			return nil, &SelectorError{
+				Expression: expression, Pos: offsets[start], Reason: fmt.Sprintf("unexpected %q", c),
+			}
+		}
+	}
+	return append(tokens, selectorToken{kind: selTokEnd, pos: len(expression)}), nil
+}
+
+// ==============================================================================
+// Parser
+
+// selectorParser recursive descent parser of selector expressions
+type selectorParser struct {
+	expression string
+	tokens     []selectorToken
+	next       int
+}
+
+func (p *selectorParser) peek() selectorToken {
+	return p.tokens[p.next]
+}
+
+func (p *selectorParser) advance() selectorToken {
+	tok := p.tokens[p.next]
+	if tok.kind != selTokEnd {
+		p.next++
+	}
+	return tok
+}
+
+// acceptKeyword consume the next token if it is the keyword
+func (p *selectorParser) acceptKeyword(keyword string) bool {
+	if p.peek().keyword() == keyword {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) errorAt(tok selectorToken, reason string) error {
+	return &SelectorError{Expression: p.expression, Pos: tok.pos, Reason: reason}
+}
+
+// parseOr parse: and ("OR" and)*
+func (p *selectorParser) parseOr(depth int) (selectorNode, error) {
+	if depth > maxSelectorDepth {
+		return nil, p.errorAt(p.peek(), "expression nested too deeply")
+	}
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseAnd parse: not ("AND" not)*
+func (p *selectorParser) parseAnd(depth int) (selectorNode, error) {
+	left, err := p.parseNot(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseNot parse: "NOT" not | "(" or ")" | condition
+func (p *selectorParser) parseNot(depth int) (selectorNode, error) {
+	if p.acceptKeyword("NOT") {
+		if depth+1 > maxSelectorDepth {
+			return nil, p.errorAt(p.peek(), "expression nested too deeply")
+		}
+		inner, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner: inner}, nil
+	}
+	if p.peek().kind == selTokLParen {
+		open := p.advance()
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != selTokRParen {
+			return nil, p.errorAt(p.peek(), fmt.Sprintf(
+				"expected ) to close ( at position %d", open.pos+1,
+			))
+		}
+		p.advance()
+		return inner, nil
+	}
+	return p.parseCondition()
+}
+
+// parseCondition parse a comparison, IN, LIKE, IS NULL, or boolean field
+func (p *selectorParser) parseCondition() (selectorNode, error) {
+	leftTok := p.peek()
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.kind == selTokOperator {
+		p.advance()
+		rightTok := p.peek()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		for _, side := range []struct {
+			operand selectorOperand
+			tok     selectorToken
+		}{{left, leftTok}, {right, rightTok}} {
+			lit, ok := side.operand.(literalOperand)
+			if !ok {
+				continue
+			}
+			if lit.value.kind == selValNull {
+				return nil, p.errorAt(side.tok, "use IS NULL or IS NOT NULL to test for NULL")
+			}
+			if lit.value.kind == selValBool && tok.text != "=" && tok.text != "!=" && tok.text != "<>" {
+				return nil, p.errorAt(tok, "booleans can only be compared with =, !=, or <>")
+			}
+		}
+		return compareNode{op: tok.text, left: left, right: right}, nil
+	}
+	switch tok.keyword() {
+	case "IS":
+		p.advance()
+		negate := p.acceptKeyword("NOT")
+		if !p.acceptKeyword("NULL") {
+			return nil, p.errorAt(p.peek(), "expected NULL after IS")
+		}
+		return nullNode{operand: left, negate: negate}, nil
+	case "NOT", "IN", "LIKE":
+		negate := false
+		if tok.keyword() == "NOT" {
+			p.advance()
+			negate = true
+		}
+		switch p.peek().keyword() {
+		case "IN":
+			p.advance()
+			values, err := p.parseList()
+			if err != nil {
+				return nil, err
+			}
+			return inNode{operand: left, values: values, negate: negate}, nil
+		case "LIKE":
+			p.advance()
+			patternTok := p.advance()
+			if patternTok.kind != selTokString {
+				return nil, p.errorAt(patternTok, "expected a quoted pattern after LIKE")
+			}
+			return likeNode{
+				operand: left, pattern: compileLikePattern(patternTok.text), negate: negate,
+			}, nil
+		default:
+			return nil, p.errorAt(p.peek(), "expected IN or LIKE after NOT")
+		}
+	}
+	// A lone operand is a boolean condition
+	if lit, ok := left.(literalOperand); ok && lit.value.kind != selValBool {
+		return nil, p.errorAt(tok, fmt.Sprintf("expected a comparison after %s", leftTok.text))
+	}
+	return truthNode{operand: left}, nil
+}
+
+// parseList parse: "(" literal ("," literal)* ")"
+func (p *selectorParser) parseList() ([]selectorValue, error) {
+	if p.peek().kind != selTokLParen {
+		return nil, p.errorAt(p.peek(), "expected ( after IN")
+	}
+	p.advance()
+	values := []selectorValue{}
+	for {
+		tok := p.peek()
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := operand.(literalOperand)
+		if !ok || lit.value.kind == selValNull {
+			return nil, p.errorAt(tok, "IN lists may only contain strings, numbers, and booleans")
+		}
+		values = append(values, lit.value)
+		switch p.advance().kind {
+		case selTokComma:
+			continue
+		case selTokRParen:
+			return values, nil
+		default:
+			return nil, p.errorAt(p.tokens[p.next-1], "expected , or ) in IN list")
+		}
+	}
+}
+
+// parseOperand parse a field or literal
+func (p *selectorParser) parseOperand() (selectorOperand, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case selTokString:
+		return literalOperand{value: selectorValue{kind: selValString, str: tok.text}}, nil
+	case selTokNumber:
+		num, _ := strconv.ParseFloat(tok.text, 64)
+		return literalOperand{value: selectorValue{kind: selValNumber, num: num}}, nil
+	case selTokIdent:
+		switch tok.keyword() {
+		case "TRUE":
+			return literalOperand{value: selectorValue{kind: selValBool, boolean: true}}, nil
+		case "FALSE":
+			return literalOperand{value: selectorValue{kind: selValBool}}, nil
+		case "NULL":
+			return literalOperand{value: selectorValue{kind: selValNull}}, nil
+		case "AND", "OR", "NOT", "IN", "IS", "LIKE":
+			return nil, p.errorAt(tok, fmt.Sprintf("expected a field or value before %s", tok.text))
+		}
+		return p.parseField(tok)
+	case selTokEnd:
+		return nil, p.errorAt(tok, "expected a field or value")
+	default:
+		return nil, p.errorAt(tok, fmt.Sprintf("expected a field or value, not %s", tok.text))
+	}
+}
+
+// parseField parse a field reference
+func (p *selectorParser) parseField(tok selectorToken) (selectorOperand, error) {
+	root, rest, hasRest := strings.Cut(tok.text, ".")
+	switch strings.ToLower(root) {
+	case "subject":
+		if hasRest {
+			return nil, p.errorAt(tok, "subject has no sub-fields")
+		}
+		return subjectOperand{}, nil
+	case "headers":
+		if !hasRest || rest == "" {
+			return nil, p.errorAt(tok, "expected a header name, e.g. headers.type")
+		}
+		return headerOperand{name: rest}, nil
+	case "json":
+		if !hasRest || rest == "" {
+			return nil, p.errorAt(tok, "expected a JSON field path, e.g. json.amount")
+		}
+		path := strings.Split(rest, ".")
+		for _, segment := range path {
+			if segment == "" {
+				return nil, p.errorAt(tok, "empty segment in JSON field path")
+			}
+		}
+		return jsonOperand{path: path}, nil
+	default:
+		return nil, p.errorAt(tok, fmt.Sprintf(
+			"unknown field %s, expected subject, headers.<name>, or json.<path>", tok.text,
+		))
+	}
+}
+
+// compileLikePattern convert a LIKE pattern to a regular expression
+func compileLikePattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("(?s)^")
+	for _, c := range pattern {
+		switch c {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// ==============================================================================
+// Evaluation
+
+type selectorValueKind int
+
+const (
+	selValMissing selectorValueKind = iota
+	selValNull
+	selValString
+	selValNumber
+	selValBool
+	// selValOther JSON objects and arrays, which can not be compared
+	selValOther
+)
+
+// selectorValue a value compared by a selector
+type selectorValue struct {
+	kind    selectorValueKind
+	str     string
+	num     float64
+	boolean bool
+	// header marks header values, which are strings even if they hold numbers or booleans
+	header bool
+}
+
+// selectorMessage the message a selector is evaluated against. The JSON body is only
+// parsed if needed.
+type selectorMessage struct {
+	msg        *nats.Msg
+	bodyParsed bool
+	body       interface{}
+	bodyValid  bool
+}
+
+// jsonBody returns the parsed JSON body, if the body is JSON
+func (m *selectorMessage) jsonBody() (interface{}, bool) {
+	if !m.bodyParsed {
+		m.bodyParsed = true
+		m.bodyValid = json.Unmarshal(m.msg.Data, &m.body) == nil
+	}
+	return m.body, m.bodyValid
+}
+
+// selectorOperand a field or literal of a selector
+type selectorOperand interface {
+	resolve(m *selectorMessage) selectorValue
+}
+
+// literalOperand a literal value
+type literalOperand struct {
+	value selectorValue
+}
+
+func (o literalOperand) resolve(_ *selectorMessage) selectorValue {
+	return o.value
+}
+
+// subjectOperand the message subject
+type subjectOperand struct{}
+
+func (o subjectOperand) resolve(m *selectorMessage) selectorValue {
+	return selectorValue{kind: selValString, str: m.msg.Subject}
+}
+
+// headerOperand the first value of a message header
+type headerOperand struct {
+	name string
+}
+
+func (o headerOperand) resolve(m *selectorMessage) selectorValue {
+	if values := m.msg.Header[o.name]; len(values) > 0 {
+		return selectorValue{kind: selValString, str: values[0], header: true}
+	}
+	for name, values := range m.msg.Header {
+		if strings.EqualFold(name, o.name) && len(values) > 0 {
+			return selectorValue{kind: selValString, str: values[0], header: true}
+		}
+	}
+	return selectorValue{kind: selValMissing}
+}
+
+// jsonOperand a field of the JSON message body
+type jsonOperand struct {
+	path []string
+}
+
+func (o jsonOperand) resolve(m *selectorMessage) selectorValue {
+	current, ok := m.jsonBody()
+	if !ok {
+		return selectorValue{kind: selValMissing}
+	}
+	for _, segment := range o.path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if current, ok = node[segment]; !ok {
+				return selectorValue{kind: selValMissing}
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return selectorValue{kind: selValMissing}
+			}
+			current = node[idx]
+		default:
+			return selectorValue{kind: selValMissing}
+		}
+	}
+	switch value := current.(type) {
+	case nil:
+		return selectorValue{kind: selValNull}
+	case string:
+		return selectorValue{kind: selValString, str: value}
+	case float64:
+		return selectorValue{kind: selValNumber, num: value}
+	case bool:
+		return selectorValue{kind: selValBool, boolean: value}
+	default:
+		return selectorValue{kind: selValOther}
+	}
+}
+
+// coerce helper function to convert a header value to the kind of the other value, so
+// header values can be compared with numbers and booleans
+func coerce(value selectorValue, other selectorValueKind) selectorValue {
+	if !value.header {
+		return value
+	}
+	switch other {
+	case selValNumber:
+		if num, err := strconv.ParseFloat(value.str, 64); err == nil {
+			return selectorValue{kind: selValNumber, num: num}
+		}
+	case selValBool:
+		if boolean, err := strconv.ParseBool(value.str); err == nil {
+			return selectorValue{kind: selValBool, boolean: boolean}
+		}
+	}
+	return value
+}
+
+// compareValues compare two values. Returns the sign of left - right, and false if the
+// values can not be compared.
+func compareValues(left, right selectorValue) (int, bool) {
+	left, right = coerce(left, right.kind), coerce(right, left.kind)
+	if left.kind != right.kind {
+		return 0, false
+	}
+	switch left.kind {
+	case selValString:
+		return strings.Compare(left.str, right.str), true
+	case selValNumber:
+		switch {
+		case left.num < right.num:
+			return -1, true
+		case left.num > right.num:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case selValBool:
+		if left.boolean == right.boolean {
+			return 0, true
+		}
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+// selectorNode a condition of a selector
+type selectorNode interface {
+	eval(m *selectorMessage) bool
+}
+
+type orNode struct {
+	left, right selectorNode
+}
+
+func (n orNode) eval(m *selectorMessage) bool {
+	return n.left.eval(m) || n.right.eval(m)
+}
+
+type andNode struct {
+	left, right selectorNode
+}
+
+func (n andNode) eval(m *selectorMessage) bool {
+	return n.left.eval(m) && n.right.eval(m)
+}
+
+type notNode struct {
+	inner selectorNode
+}
+
+func (n notNode) eval(m *selectorMessage) bool {
+	return !n.inner.eval(m)
+}
+
+// compareNode a comparison of two operands
+type compareNode struct {
+	op          string
+	left, right selectorOperand
+}
+
+func (n compareNode) eval(m *selectorMessage) bool {
+	left, right := n.left.resolve(m), n.right.resolve(m)
+	result, ok := compareValues(left, right)
+	if !ok {
+		return false
+	}
+	// Booleans are unordered
+	if left.kind == selValBool || right.kind == selValBool {
+		switch n.op {
+		case "=", "!=", "<>":
+		default:
+			return false
+		}
+	}
+	switch n.op {
+	case "=":
+		return result == 0
+	case "!=", "<>":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	default:
+		return false
+	}
+}
+
+// inNode whether an operand equals one of a list of values
+type inNode struct {
+	operand selectorOperand
+	values  []selectorValue
+	negate  bool
+}
+
+func (n inNode) eval(m *selectorMessage) bool {
+	value := n.operand.resolve(m)
+	if value.kind == selValMissing || value.kind == selValNull || value.kind == selValOther {
+		return false
+	}
+	for _, candidate := range n.values {
+		if result, ok := compareValues(value, candidate); ok && result == 0 {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+// likeNode whether a string operand matches a pattern
+type likeNode struct {
+	operand selectorOperand
+	pattern *regexp.Regexp
+	negate  bool
+}
+
+func (n likeNode) eval(m *selectorMessage) bool {
+	value := n.operand.resolve(m)
+	if value.kind != selValString {
+		return false
+	}
+	return n.pattern.MatchString(value.str) != n.negate
+}
+
+// nullNode whether an operand is missing or null
+type nullNode struct {
+	operand selectorOperand
+	negate  bool
+}
+
+func (n nullNode) eval(m *selectorMessage) bool {
+	kind := n.operand.resolve(m).kind
+	return (kind == selValMissing || kind == selValNull) != n.negate
+}
+
+// truthNode whether a boolean operand is true
+type truthNode struct {
+	operand selectorOperand
+}
+
+func (n truthNode) eval(m *selectorMessage) bool {
+	value := coerce(n.operand.resolve(m), selValBool)
+	return value.kind == selValBool && value.boolean
+}
@@ -0,0 +1,142 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	order := nats.NewMsg("orders.new")
+	order.Header.Set("Type", "order")
+	order.Header.Set("Priority", "7")
+	order.Header.Set("Urgent", "true")
+	order.Data = []byte(
+		`{"amount":150.5,"currency":"USD","gift":false,"note":null,` +
+			`"customer":{"name":"O'Brien","tier":"gold"},"items":[{"sku":"A-1"},{"sku":"B-2"}]}`,
+	)
+	plain := nats.NewMsg("orders.old")
+	plain.Data = []byte("not json")
+
+	// Case 0: expressions
+	{
+		type testCase struct {
+			expression string
+			order      bool
+			plain      bool
+		}
+		cases := []testCase{
+			{"headers.type = 'order' AND json.amount > 100", true, false},
+			{"headers.TYPE = 'order'", true, false},
+			{"subject = 'orders.old'", false, true},
+			{"subject LIKE 'orders.%'", true, true},
+			{"subject LIKE 'orders.__w'", true, false},
+			{"json.customer.name = 'O''Brien'", true, false},
+			{"json.customer.tier IN ('silver', 'gold')", true, false},
+			{"json.customer.tier NOT IN ('silver', 'gold')", false, false},
+			{"json.items.1.sku = 'B-2'", true, false},
+			{"json.items.2.sku IS NULL", true, true},
+			{"json.note IS NULL AND json.currency IS NOT NULL", true, false},
+			{"headers.priority >= 7 AND headers.priority < 8", true, false},
+			{"headers.urgent = TRUE", true, false},
+			{"headers.urgent", true, false},
+			{"json.gift", false, false},
+			{"NOT json.gift", true, true},
+			{"json.gift = FALSE", true, false},
+			{"json.amount != 100", true, false},
+			{"json.amount <> 150.5", false, false},
+			{"json.amount = '150.5'", false, false},
+			{"json.customer > 1", false, false},
+			{"json.amount > -1 and (json.currency = 'EUR' or json.currency = 'USD')", true, false},
+			{"NOT (json.currency = 'EUR') AND subject NOT LIKE '%old'", true, false},
+		}
+		for _, oneCase := range cases {
+			uut, err := CompileMessageSelector(oneCase.expression)
+			assert.Nil(err, oneCase.expression)
+			if err != nil {
+				continue
+			}
+			assert.Equal(oneCase.expression, uut.String())
+			assert.Equal(oneCase.order, uut.Matches(order), oneCase.expression)
+			assert.Equal(oneCase.plain, uut.Matches(plain), oneCase.expression)
+		}
+	}
+
+	// Case 1: invalid expressions
+	{
+		type testCase struct {
+			expression string
+			pos        int
+		}
+		cases := []testCase{
+			{"", 0},
+			{"json.amount >", 13},
+			{"json.amount > 100 AND", 21},
+			{"amount > 100", 0},
+			{"headers = 'a'", 0},
+			{"json.amount = NULL", 14},
+			{"json.gift > TRUE", 10},
+			{"(json.amount > 100", 18},
+			{"json.amount > 100)", 17},
+			{"json.name = 'abc", 12},
+			{"json.amount ! 100", 12},
+			{"json.tier IN 'gold'", 13},
+			{"json.tier IN ('gold', json.other)", 22},
+			{"json.name LIKE 5", 15},
+			{"json.name IS 5", 13},
+			{"100", 3},
+			{"json.amount > 1x", 14},
+			{"json.amount # 1", 12},
+		}
+		for _, oneCase := range cases {
+			_, err := CompileMessageSelector(oneCase.expression)
+			assert.NotNil(err, oneCase.expression)
+			var selectorErr *SelectorError
+			if assert.True(errors.As(err, &selectorErr), oneCase.expression) {
+				assert.Equal(oneCase.pos, selectorErr.Pos, oneCase.expression)
+			}
+		}
+	}
+
+	// Case 2: readable error
+	{
+		_, err := CompileMessageSelector("headers.type = 'order' AND json.amount >> 100")
+		assert.EqualError(
+			err, `invalid selector at position 41 (near "> 100"): expected a field or value, not >`,
+		)
+	}
+
+	// Case 3: limits
+	{
+		deep := ""
+		for itr := 0; itr < 100; itr++ {
+			deep += "("
+		}
+		_, err := CompileMessageSelector(deep + "json.gift")
+		assert.NotNil(err)
+		long := make([]byte, MaxSelectorLength+1)
+		for idx := range long {
+			long[idx] = ' '
+		}
+		_, err = CompileMessageSelector(string(long))
+		assert.NotNil(err)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+)
+
+// SessionEventType is the type of a subscription session lifecycle event
+type SessionEventType string
+
+const (
+	// SessionStarted the session started delivering messages
+	SessionStarted SessionEventType = "session-started"
+	// SessionEnded the session ended normally, e.g. the client disconnected
+	SessionEnded SessionEventType = "session-ended"
+	// SessionErrored the session ended on an error
+	SessionErrored SessionEventType = "session-errored"
+)
+
+// SessionStats counts the activity of a subscription session
+type SessionStats struct {
+	// Delivered is the number of messages sent to the client
+	Delivered uint64 `json:"delivered"`
+	// DeliveredBytes is the number of bytes sent to the client
+	DeliveredBytes uint64 `json:"delivered_bytes"`
+	// Dropped is the number of messages NAKed as the client was not reading
+	Dropped uint64 `json:"dropped"`
+	// Duration is how long the session ran
+	Duration time.Duration `json:"duration"`
+}
+
+// SessionEvent reports a change in the lifecycle of a subscription session
+type SessionEvent struct {
+	// Type is the event type
+	Type SessionEventType `json:"type"`
+	// Replica is the dataplane instance running the session
+	Replica string `json:"replica"`
+	// SessionID is the ID of the session
+	SessionID string `json:"session_id"`
+	// Stream is the stream the session reads from
+	Stream string `json:"stream,omitempty"`
+	// Consumer is the consumer the session reads through
+	Consumer string `json:"consumer,omitempty"`
+	// Subject is the subject the session subscribes to
+	Subject string `json:"subject,omitempty"`
+	// DeliveryGroup is the delivery group of the session, if any
+	DeliveryGroup *string `json:"delivery_group,omitempty"`
+	// Sources are the sources of a multi-source session, as <stream>/<consumer>
+	Sources []string `json:"sources,omitempty"`
+	// Principal is the authenticated client of the session, if any
+	Principal string `json:"principal,omitempty"`
+	// ClientAddr is the address of the client
+	ClientAddr string `json:"client_addr,omitempty"`
+	// Started is when the session started
+	Started time.Time `json:"started"`
+	// Timestamp is when the event occurred
+	Timestamp time.Time `json:"timestamp"`
+	// Reason is why the session ended, for an ended or errored session
+	Reason string `json:"reason,omitempty"`
+	// Stats is the activity of the session, for an ended or errored session
+	Stats *SessionStats `json:"stats,omitempty"`
+}
+
+// String toString function for SessionEvent
+func (e SessionEvent) String() string {
+	return fmt.Sprintf("SESSION-EVENT[%s %s] %s@%s", e.Type, e.SessionID, e.Consumer, e.Stream)
+}
+
+// SessionEventParam settings for notifying external systems of session lifecycle events
+type SessionEventParam struct {
+	// WebhookURL if set, events are POSTed as JSON to this URL
+	WebhookURL string `validate:"required_without=NATSSubject,omitempty,url"`
+	// WebhookTimeout is the timeout of each webhook call
+	WebhookTimeout time.Duration `validate:"gt=0"`
+	// NATSSubject if set, events are published as JSON on this NATS subject
+	NATSSubject string
+	// QueueLength is the max number of events waiting to be sent. Events beyond it are
+	// dropped, so a slow destination does not hold up the sessions.
+	QueueLength int `validate:"gte=1"`
+}
+
+// SessionEventNotifier notifies external systems of subscription session lifecycle events
+type SessionEventNotifier interface {
+	// Notify queues an event for sending. It does not block.
+	Notify(event SessionEvent)
+}
+
+// sessionEventNotifierImpl implements SessionEventNotifier
+type sessionEventNotifierImpl struct {
+	common.Component
+	param   SessionEventParam
+	replica string
+	nats    *core.NatsClient
+	client  *http.Client
+	queue   chan SessionEvent
+}
+
+// GetSessionEventNotifier define a new SessionEventNotifier. Events are sent, in order, by
+// a goroutine until ctxt ends. natsClient is only needed if events are sent over NATS.
+func GetSessionEventNotifier(
+	param SessionEventParam,
+	natsClient *core.NatsClient,
+	replica string,
+	ctxt context.Context,
+	wg *sync.WaitGroup,
+) (SessionEventNotifier, error) {
+	logTags := log.Fields{
+		"module": "dataplane", "component": "session-events", "instance": replica,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		return nil, err
+	}
+	if param.NATSSubject != "" && natsClient == nil {
+		return nil, fmt.Errorf("NATS session events need a NATS client")
+	}
+	notifier := &sessionEventNotifierImpl{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		replica:   replica,
+		nats:      natsClient,
+		client:    &http.Client{Timeout: param.WebhookTimeout},
+		queue:     make(chan SessionEvent, param.QueueLength),
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctxt.Done():
+				return
+			case event := <-notifier.queue:
+				notifier.send(event, ctxt)
+			}
+		}
+	}()
+	return notifier, nil
+}
+
+// Notify queues an event for sending. It does not block.
+func (n *sessionEventNotifierImpl) Notify(event SessionEvent) {
+	event.Replica = n.replica
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	select {
+	case n.queue <- event:
+	default:
+		log.WithFields(n.LogTags).Warnf("Event queue full, dropping %s", event)
+	}
+}
+
+// send helper function to deliver an event to each destination
+func (n *sessionEventNotifierImpl) send(event SessionEvent, ctxt context.Context) {
+	payload, err := json.Marshal(&event)
+	if err != nil {
+		log.WithError(err).WithFields(n.LogTags).Errorf("Unable to serialize %s", event)
+		return
+	}
+	if n.param.WebhookURL != "" {
+		if err := n.post(payload, ctxt); err != nil {
+			log.WithError(err).WithFields(n.LogTags).Errorf("Failed to POST %s", event)
+		}
+	}
+	if n.param.NATSSubject != "" {
+		if err := n.nats.NATs().Publish(n.param.NATSSubject, payload); err != nil {
+			log.WithError(err).WithFields(n.LogTags).Errorf(
+				"Failed to publish %s on %s", event, n.param.NATSSubject,
+			)
+		}
+	}
+	log.WithFields(n.LogTags).Debugf("Sent %s", event)
+}
+
+// post helper function to POST an event to the webhook
+func (n *sessionEventNotifierImpl) post(payload []byte, ctxt context.Context) error {
+	req, err := http.NewRequestWithContext(
+		ctxt, http.MethodPost, n.param.WebhookURL, bytes.NewReader(payload),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionEventNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	received := make(chan SessionEvent, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event SessionEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer webhook.Close()
+
+	// Case 0: invalid parameters
+	{
+		_, err := GetSessionEventNotifier(
+			SessionEventParam{WebhookTimeout: time.Second, QueueLength: 4},
+			nil, "ut-replica", utCtxt, &wg,
+		)
+		assert.NotNil(err)
+		_, err = GetSessionEventNotifier(
+			SessionEventParam{NATSSubject: "events", WebhookTimeout: time.Second, QueueLength: 4},
+			nil, "ut-replica", utCtxt, &wg,
+		)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetSessionEventNotifier(
+		SessionEventParam{WebhookURL: webhook.URL, WebhookTimeout: time.Second, QueueLength: 4},
+		nil, "ut-replica", utCtxt, &wg,
+	)
+	assert.Nil(err)
+
+	// Case 1: events are sent in order, marked with the replica
+	started := time.Now()
+	uut.Notify(SessionEvent{
+		Type: SessionStarted, SessionID: "s1", Stream: "orders", Consumer: "billing", Started: started,
+	})
+	uut.Notify(SessionEvent{
+		Type:      SessionEnded,
+		SessionID: "s1",
+		Stream:    "orders",
+		Consumer:  "billing",
+		Started:   started,
+		Reason:    "client_disconnect",
+		Stats:     &SessionStats{Delivered: 3, DeliveredBytes: 42, Duration: time.Second},
+	})
+	for _, expected := range []SessionEventType{SessionStarted, SessionEnded} {
+		select {
+		case event := <-received:
+			assert.Equal(expected, event.Type)
+			assert.Equal("ut-replica", event.Replica)
+			assert.Equal("billing", event.Consumer)
+			assert.False(event.Timestamp.IsZero())
+			if expected == SessionEnded {
+				assert.Equal("client_disconnect", event.Reason)
+				assert.NotNil(event.Stats)
+				assert.Equal(uint64(3), event.Stats.Delivered)
+			} else {
+				assert.Nil(event.Stats)
+			}
+		case <-time.After(time.Second * 2):
+			assert.False(true, "session event not sent")
+		}
+	}
+}
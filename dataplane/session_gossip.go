@@ -0,0 +1,350 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// sessionGossipTimeout is how many gossip intervals the sessions of a replica are kept
+// after its last gossip
+const sessionGossipTimeout = 3
+
+// ActiveSession is a push subscribe session running on a dataplane replica
+type ActiveSession struct {
+	// ID identifies the session
+	ID string `json:"id"`
+	// Replica is the replica running the session
+	Replica string `json:"replica"`
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Subject is the subject subscribed to
+	Subject string `json:"subject"`
+	// DeliveryGroup is the delivery group of the session, if any
+	DeliveryGroup *string `json:"delivery_group,omitempty"`
+	// Started is when the session started
+	Started time.Time `json:"started"`
+}
+
+// sessionGossip is the state of one replica, sent on the gossip subject
+type sessionGossip struct {
+	// Replica is the replica sending the gossip
+	Replica string `json:"replica"`
+	// Sessions are the sessions running on the replica
+	Sessions []ActiveSession `json:"sessions"`
+	// Unbound are the durable consumers the replica found without a session
+	Unbound []common.UnboundConsumer `json:"unbound,omitempty"`
+	// Leaving is set once the replica stops
+	Leaving bool `json:"leaving,omitempty"`
+}
+
+// ClusterSessionRegistry tracks the push subscribe sessions running on every dataplane
+// replica. Each replica sends its running sessions over a NATS subject every interval, and
+// right away whenever they change. The sessions of a replica are forgotten once it leaves,
+// or once it has sent nothing for three intervals. A replica can share the durable
+// consumers it found without a session the same way.
+type ClusterSessionRegistry interface {
+	// Register records a session starting on this replica. Returns the function to call
+	// once the session ends.
+	Register(session ActiveSession) func()
+	// Sessions returns the sessions running on all replicas
+	Sessions() []ActiveSession
+	// ConsumerReplicas returns the replicas running sessions of a consumer
+	ConsumerReplicas(stream, consumer string) []string
+	// ReportUnbound replaces the durable consumers this replica found without a session
+	ReportUnbound(consumers []common.UnboundConsumer)
+	// UnboundConsumers returns the durable consumers any replica found without a session,
+	// except the ones with sessions running on a replica since
+	UnboundConsumers() []common.UnboundConsumer
+}
+
+// replicaSessions the sessions last heard from a replica
+type replicaSessions struct {
+	sessions []ActiveSession
+	unbound  []common.UnboundConsumer
+	lastSeen time.Time
+}
+
+// sessionGossipState the sessions known to a replica
+type sessionGossipState struct {
+	replica string
+	timeout time.Duration
+	local   map[string]ActiveSession
+	unbound []common.UnboundConsumer
+	remote  map[string]replicaSessions
+}
+
+// defineSessionGossipState define the sessions known to replica, forgetting the other
+// replicas silent for longer than timeout
+func defineSessionGossipState(replica string, timeout time.Duration) sessionGossipState {
+	return sessionGossipState{
+		replica: replica,
+		timeout: timeout,
+		local:   make(map[string]ActiveSession),
+		remote:  make(map[string]replicaSessions),
+	}
+}
+
+// observe record the gossip of another replica
+func (s *sessionGossipState) observe(gossip sessionGossip, now time.Time) {
+	if gossip.Replica == s.replica {
+		return
+	}
+	if gossip.Leaving {
+		delete(s.remote, gossip.Replica)
+		return
+	}
+	s.remote[gossip.Replica] = replicaSessions{
+		sessions: gossip.Sessions, unbound: gossip.Unbound, lastSeen: now,
+	}
+}
+
+// gossip returns the gossip of this replica
+func (s *sessionGossipState) gossip() sessionGossip {
+	result := sessionGossip{
+		Replica:  s.replica,
+		Sessions: make([]ActiveSession, 0, len(s.local)),
+		Unbound:  s.unbound,
+	}
+	for _, session := range s.local {
+		result.Sessions = append(result.Sessions, session)
+	}
+	return result
+}
+
+// all returns the sessions of all replicas, forgetting the replicas which have gone silent
+func (s *sessionGossipState) all(now time.Time) []ActiveSession {
+	result := []ActiveSession{}
+	for _, session := range s.local {
+		result = append(result, session)
+	}
+	for replica, known := range s.remote {
+		if now.Sub(known.lastSeen) > s.timeout {
+			delete(s.remote, replica)
+			continue
+		}
+		result = append(result, known.sessions...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Replica != result[j].Replica {
+			return result[i].Replica < result[j].Replica
+		}
+		return result[i].Started.Before(result[j].Started)
+	})
+	return result
+}
+
+// allUnbound returns the unbound consumers reported by all replicas, without the ones
+// with sessions running. A consumer reported by several replicas is listed once, as
+// first found.
+func (s *sessionGossipState) allUnbound(now time.Time) []common.UnboundConsumer {
+	bound := map[string]bool{}
+	for _, session := range s.all(now) {
+		bound[session.Stream+"/"+session.Consumer] = true
+	}
+	reported := append([]common.UnboundConsumer{}, s.unbound...)
+	for _, known := range s.remote {
+		reported = append(reported, known.unbound...)
+	}
+	unique := map[string]common.UnboundConsumer{}
+	for _, consumer := range reported {
+		key := consumer.Stream + "/" + consumer.Consumer
+		if bound[key] {
+			continue
+		}
+		if seen, ok := unique[key]; !ok || consumer.Since.Before(seen.Since) {
+			unique[key] = consumer
+		}
+	}
+	result := make([]common.UnboundConsumer, 0, len(unique))
+	for _, consumer := range unique {
+		result = append(result, consumer)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Stream != result[j].Stream {
+			return result[i].Stream < result[j].Stream
+		}
+		return result[i].Consumer < result[j].Consumer
+	})
+	return result
+}
+
+// clusterSessionRegistryImpl implements ClusterSessionRegistry
+type clusterSessionRegistryImpl struct {
+	common.Component
+	nats     *core.NatsClient
+	subject  string
+	interval time.Duration
+	lock     sync.Mutex
+	state    sessionGossipState
+	// changed signals the sessions of this replica changed
+	changed chan struct{}
+}
+
+// GetClusterSessionRegistry define a new ClusterSessionRegistry, exchanging sessions on the
+// NATS subject until ctxt ends
+//
+// replica identifies this replica to the others. If replica is empty, the registry only
+// follows the sessions of the other replicas, and sends nothing; consumers it reports
+// unbound are then only known locally.
+func GetClusterSessionRegistry(
+	natsClient *core.NatsClient,
+	subject string,
+	replica string,
+	interval time.Duration,
+	instance string,
+	ctxt context.Context,
+	wg *sync.WaitGroup,
+) (ClusterSessionRegistry, error) {
+	logTags := log.Fields{
+		"module":    "dataplane",
+		"component": "cluster-session-registry",
+		"instance":  instance,
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("session gossip interval must be positive")
+	}
+	registry := &clusterSessionRegistryImpl{
+		Component: common.Component{LogTags: logTags},
+		nats:      natsClient,
+		subject:   subject,
+		interval:  interval,
+		state:     defineSessionGossipState(replica, interval*sessionGossipTimeout),
+		changed:   make(chan struct{}, 1),
+	}
+	sub, err := natsClient.NATs().Subscribe(subject, registry.receive)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Failed to subscribe for session gossip")
+		return nil, err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if err := sub.Unsubscribe(); err != nil {
+				log.WithError(err).WithFields(logTags).Error("Unsubscribe failed")
+			}
+		}()
+		if replica == "" {
+			<-ctxt.Done()
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-registry.changed:
+			case <-ctxt.Done():
+				registry.send(sessionGossip{Replica: replica, Leaving: true})
+				return
+			}
+			registry.lock.Lock()
+			gossip := registry.state.gossip()
+			registry.lock.Unlock()
+			registry.send(gossip)
+		}
+	}()
+	return registry, nil
+}
+
+// send publish a gossip
+func (r *clusterSessionRegistryImpl) send(gossip sessionGossip) {
+	payload, err := common.JSON().Marshal(&gossip)
+	if err == nil {
+		err = r.nats.NATs().Publish(r.subject, payload)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to send session gossip")
+	}
+}
+
+// receive handle the gossip of a replica
+func (r *clusterSessionRegistryImpl) receive(msg *nats.Msg) {
+	var gossip sessionGossip
+	if err := common.JSON().Unmarshal(msg.Data, &gossip); err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to read session gossip")
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.state.observe(gossip, time.Now())
+}
+
+// Register records a session starting on this replica
+func (r *clusterSessionRegistryImpl) Register(session ActiveSession) func() {
+	session.Replica = r.state.replica
+	r.lock.Lock()
+	r.state.local[session.ID] = session
+	r.lock.Unlock()
+	wake(r.changed)
+	return func() {
+		r.lock.Lock()
+		delete(r.state.local, session.ID)
+		r.lock.Unlock()
+		wake(r.changed)
+	}
+}
+
+// Sessions returns the sessions running on all replicas
+func (r *clusterSessionRegistryImpl) Sessions() []ActiveSession {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state.all(time.Now())
+}
+
+// ConsumerReplicas returns the replicas running sessions of a consumer
+func (r *clusterSessionRegistryImpl) ConsumerReplicas(stream, consumer string) []string {
+	replicas := []string{}
+	seen := map[string]bool{}
+	for _, session := range r.Sessions() {
+		if session.Stream == stream && session.Consumer == consumer && !seen[session.Replica] {
+			seen[session.Replica] = true
+			replicas = append(replicas, session.Replica)
+		}
+	}
+	return replicas
+}
+
+// ReportUnbound replaces the durable consumers this replica found without a session
+func (r *clusterSessionRegistryImpl) ReportUnbound(consumers []common.UnboundConsumer) {
+	reported := make([]common.UnboundConsumer, 0, len(consumers))
+	for _, consumer := range consumers {
+		consumer.Reporter = r.state.replica
+		reported = append(reported, consumer)
+	}
+	r.lock.Lock()
+	r.state.unbound = reported
+	r.lock.Unlock()
+	wake(r.changed)
+}
+
+// UnboundConsumers returns the durable consumers any replica found without a session
+func (r *clusterSessionRegistryImpl) UnboundConsumers() []common.UnboundConsumer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state.allUnbound(time.Now())
+}
@@ -0,0 +1,130 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionGossipState(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid gossip interval
+	{
+		wg := sync.WaitGroup{}
+		_, err := GetClusterSessionRegistry(
+			nil, "ut", "a", 0, "ut-session-gossip", context.Background(), &wg,
+		)
+		assert.NotNil(err)
+	}
+
+	uut := defineSessionGossipState("a", time.Second*3)
+	start := time.Now()
+
+	// Case 1: only local sessions
+	{
+		uut.local["s1"] = ActiveSession{ID: "s1", Replica: "a", Stream: "st", Consumer: "c1"}
+		all := uut.all(start)
+		assert.Len(all, 1)
+		gossip := uut.gossip()
+		assert.Equal("a", gossip.Replica)
+		assert.Len(gossip.Sessions, 1)
+		assert.False(gossip.Leaving)
+	}
+
+	// Case 2: gossip from other replicas
+	{
+		uut.observe(sessionGossip{
+			Replica:  "b",
+			Sessions: []ActiveSession{{ID: "s2", Replica: "b", Stream: "st", Consumer: "c2"}},
+		}, start)
+		uut.observe(sessionGossip{
+			Replica: "c",
+			Sessions: []ActiveSession{
+				{ID: "s3", Replica: "c", Stream: "st", Consumer: "c2", Started: start},
+				{ID: "s4", Replica: "c", Stream: "st", Consumer: "c3", Started: start.Add(time.Second)},
+			},
+		}, start.Add(time.Second))
+		all := uut.all(start.Add(time.Second * 2))
+		assert.Len(all, 4)
+		ids := []string{}
+		for _, session := range all {
+			ids = append(ids, session.ID)
+		}
+		assert.Equal([]string{"s1", "s2", "s3", "s4"}, ids)
+	}
+
+	// Case 3: own gossip is ignored
+	{
+		uut.observe(sessionGossip{Replica: "a"}, start.Add(time.Second*2))
+		assert.Len(uut.all(start.Add(time.Second*2)), 4)
+	}
+
+	// Case 4: a replica replaces its sessions
+	{
+		uut.observe(sessionGossip{
+			Replica:  "b",
+			Sessions: []ActiveSession{},
+		}, start.Add(time.Second*2))
+		assert.Len(uut.all(start.Add(time.Second*2)), 3)
+	}
+
+	// Case 5: a replica goes silent
+	{
+		assert.Len(uut.all(start.Add(time.Second*5)), 1)
+		assert.Len(uut.remote, 1)
+	}
+
+	// Case 6: a replica leaves
+	{
+		uut.observe(sessionGossip{Replica: "b", Leaving: true}, start.Add(time.Second*5))
+		assert.Len(uut.remote, 0)
+		assert.Len(uut.all(start.Add(time.Second*5)), 1)
+	}
+
+	// Case 7: unbound consumers are shared, without the ones with sessions running
+	{
+		uut.unbound = []common.UnboundConsumer{
+			{Stream: "st", Consumer: "c4", Since: start.Add(time.Second * 5), Reporter: "a"},
+			{Stream: "st", Consumer: "c1", Since: start, Reporter: "a"},
+		}
+		assert.Len(uut.gossip().Unbound, 2)
+		uut.observe(sessionGossip{
+			Replica: "m",
+			Unbound: []common.UnboundConsumer{
+				{Stream: "st", Consumer: "c4", Since: start.Add(time.Second * 4), Reporter: "m"},
+				{Stream: "other", Consumer: "c5", Since: start, Reporter: "m"},
+			},
+		}, start.Add(time.Second*5))
+		unbound := uut.allUnbound(start.Add(time.Second * 6))
+		assert.Len(unbound, 2)
+		assert.Equal("other", unbound[0].Stream)
+		assert.Equal("c4", unbound[1].Consumer)
+		assert.Equal("m", unbound[1].Reporter)
+	}
+
+	// Case 8: the unbound consumers of a silent replica are forgotten
+	{
+		unbound := uut.allUnbound(start.Add(time.Second * 9))
+		assert.Len(unbound, 1)
+		assert.Equal("a", unbound[0].Reporter)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errSignedTokenMalformed returned when a signed token can not be parsed
+var errSignedTokenMalformed = errors.New("malformed")
+
+// errSignedTokenSignature returned when a signed token was not signed with the expected key
+var errSignedTokenSignature = errors.New("not issued by this instance")
+
+// newSigningKey helper function to generate a random key for signing tokens
+func newSigningKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encodeSignedToken sign and encode a token as "<payload>.<signature>"
+func encodeSignedToken(token interface{}, key []byte) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(payload)
+	return fmt.Sprintf(
+		"%s.%s",
+		base64.RawURLEncoding.EncodeToString(payload),
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+	), nil
+}
+
+// decodeSignedToken decode a token into token, and verify its signature
+func decodeSignedToken(encoded string, key []byte, token interface{}) error {
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return errSignedTokenMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errSignedTokenMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errSignedTokenMalformed
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errSignedTokenSignature
+	}
+	if err := json.Unmarshal(payload, token); err != nil {
+		return errSignedTokenMalformed
+	}
+	return nil
+}
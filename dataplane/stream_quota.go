@@ -0,0 +1,120 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/core"
+	"github.com/nats-io/nats.go"
+)
+
+// StreamQuotaUsage is how much of its limits a stream uses
+type StreamQuotaUsage struct {
+	// Stream is the name of the stream
+	Stream string
+	// Bytes is the size of the messages stored
+	Bytes uint64
+	// MaxBytes is the max size of the messages stored. "-1" for no limit.
+	MaxBytes int64
+	// Msgs is the number of messages stored
+	Msgs uint64
+	// MaxMsgs is the max number of messages stored. "-1" for no limit.
+	MaxMsgs int64
+}
+
+// StreamQuotaReporter reports how much of their limits the streams storing subjects use
+type StreamQuotaReporter interface {
+	// Usage fetches the usage of the stream storing a subject. Returns false if no stream
+	// stores the subject.
+	Usage(subject string, ctxt context.Context) (StreamQuotaUsage, bool, error)
+}
+
+// cachedStreamQuota is the usage last fetched for a stream
+type cachedStreamQuota struct {
+	usage   StreamQuotaUsage
+	expires time.Time
+}
+
+// streamQuotaReporterImpl implements StreamQuotaReporter
+type streamQuotaReporterImpl struct {
+	streams  *subjectStreamCache
+	cacheTTL time.Duration
+	// fetch reads the usage of a stream
+	fetch func(stream string, ctxt context.Context) (StreamQuotaUsage, error)
+	lock  sync.Mutex
+	cache map[string]cachedStreamQuota
+}
+
+// GetStreamQuotaReporter define new StreamQuotaReporter. The stream storing a subject, and
+// its usage, are looked up through natsClient, and cached for cacheTTL.
+func GetStreamQuotaReporter(
+	natsClient *core.NatsClient, cacheTTL time.Duration,
+) (StreamQuotaReporter, error) {
+	if cacheTTL <= 0 {
+		return nil, fmt.Errorf("stream quota cache TTL must be positive")
+	}
+	return &streamQuotaReporterImpl{
+		streams:  newSubjectStreamCache(natsClient, cacheTTL),
+		cacheTTL: cacheTTL,
+		fetch: func(stream string, ctxt context.Context) (StreamQuotaUsage, error) {
+			ctxt, cancel := context.WithTimeout(ctxt, streamLookupTimeout)
+			defer cancel()
+			info, err := natsClient.JetStream().StreamInfo(stream, nats.Context(ctxt))
+			if err != nil {
+				return StreamQuotaUsage{}, err
+			}
+			return StreamQuotaUsage{
+				Stream:   stream,
+				Bytes:    info.State.Bytes,
+				MaxBytes: info.Config.MaxBytes,
+				Msgs:     info.State.Msgs,
+				MaxMsgs:  info.Config.MaxMsgs,
+			}, nil
+		},
+		cache: map[string]cachedStreamQuota{},
+	}, nil
+}
+
+// Usage fetches the usage of the stream storing a subject
+func (q *streamQuotaReporterImpl) Usage(
+	subject string, ctxt context.Context,
+) (StreamQuotaUsage, bool, error) {
+	stream, err := q.streams.get(subject, ctxt)
+	if err != nil || stream == "" {
+		return StreamQuotaUsage{}, false, err
+	}
+	now := time.Now()
+	q.lock.Lock()
+	cached, ok := q.cache[stream]
+	q.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.usage, true, nil
+	}
+	usage, err := q.fetch(stream, ctxt)
+	if err != nil {
+		return StreamQuotaUsage{}, false, err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.cache) >= maxCachedSubjectStreams {
+		q.cache = map[string]cachedStreamQuota{}
+	}
+	q.cache[stream] = cachedStreamQuota{usage: usage, expires: now.Add(q.cacheTTL)}
+	return usage, true, nil
+}
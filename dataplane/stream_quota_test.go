@@ -0,0 +1,80 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamQuotaReporter(t *testing.T) {
+	assert := assert.New(t)
+
+	fetches := 0
+	uut := &streamQuotaReporterImpl{
+		streams: &subjectStreamCache{
+			ttl: time.Minute,
+			lookup: func(subject string, ctxt context.Context) (string, error) {
+				if subject == "orders.new" {
+					return "orders", nil
+				}
+				return "", ErrNoStreamForSubject
+			},
+			cache: map[string]cachedSubjectStream{},
+		},
+		cacheTTL: time.Minute,
+		fetch: func(stream string, ctxt context.Context) (StreamQuotaUsage, error) {
+			fetches++
+			return StreamQuotaUsage{
+				Stream: stream, Bytes: 512, MaxBytes: 1024, Msgs: uint64(fetches), MaxMsgs: -1,
+			}, nil
+		},
+		cache: map[string]cachedStreamQuota{},
+	}
+	ctxt := context.Background()
+
+	// Case 0: subject without a stream
+	{
+		_, ok, err := uut.Usage("unknown", ctxt)
+		assert.Nil(err)
+		assert.False(ok)
+		assert.Equal(0, fetches)
+	}
+
+	// Case 1: usage of the stream is cached
+	{
+		usage, ok, err := uut.Usage("orders.new", ctxt)
+		assert.Nil(err)
+		assert.True(ok)
+		assert.Equal(
+			StreamQuotaUsage{Stream: "orders", Bytes: 512, MaxBytes: 1024, Msgs: 1, MaxMsgs: -1}, usage,
+		)
+		usage, _, _ = uut.Usage("orders.new", ctxt)
+		assert.Equal(uint64(1), usage.Msgs)
+		assert.Equal(1, fetches)
+	}
+
+	// Case 2: cached usage expired
+	{
+		uut.cache["orders"] = cachedStreamQuota{expires: time.Now()}
+		usage, ok, err := uut.Usage("orders.new", ctxt)
+		assert.Nil(err)
+		assert.True(ok)
+		assert.Equal(uint64(2), usage.Msgs)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// TailMessage is a human readable presentation of a message, for live debugging
+type TailMessage struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Subject is the subject the message was published to
+	Subject string `json:"subject"`
+	// Sequence is the message sequence number within the stream
+	Sequence uint64 `json:"sequence"`
+	// Timestamp is when the message was stored by the stream
+	Timestamp time.Time `json:"timestamp"`
+	// Headers are the message headers
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Size is the size of the message body in bytes
+	Size int `json:"size"`
+	// PayloadWithheld is set if the message body is withheld from the viewer
+	PayloadWithheld bool `json:"payload_withheld,omitempty"`
+	// JSON is the message body, if it is JSON
+	JSON json.RawMessage `json:"json,omitempty" swaggertype:"object"`
+	// Text is the message body, if it is UTF-8 text but not JSON
+	Text string `json:"text,omitempty"`
+	// Message is the message body, if it is neither JSON nor UTF-8 text
+	Message []byte `json:"b64_msg,omitempty"`
+}
+
+// ConvertTailMessage convert a JetStream message for presentation
+func ConvertTailMessage(msg *nats.Msg) (TailMessage, error) {
+	return NewMsgEnvelope(msg).ToTail()
+}
+
+// WithholdPayload remove the message body, leaving only its metadata
+func (m *TailMessage) WithholdPayload() {
+	m.JSON = nil
+	m.Text = ""
+	m.Message = nil
+	m.PayloadWithheld = true
+}
+
+// ==============================================================================
+
+// JetStreamTailer reads the messages published to a stream since the tailer was defined
+type JetStreamTailer interface {
+	// NextMsg wait for the next message
+	NextMsg(ctxt context.Context) (*nats.Msg, error)
+	// Close stop reading, and delete the underlying consumer
+	Close() error
+}
+
+// jetStreamTailerImpl implements JetStreamTailer
+type jetStreamTailerImpl struct {
+	common.Component
+	nats     *core.NatsClient
+	stream   string
+	consumer string
+	sub      *nats.Subscription
+}
+
+// GetJetStreamTailer define new JetStreamTailer
+//
+// The tailer reads through an ephemeral consumer, which does not require ACKs. If subject
+// is not empty, only messages of matching subjects are read.
+func GetJetStreamTailer(
+	natsClient *core.NatsClient, stream, subject string,
+) (JetStreamTailer, error) {
+	logTags := log.Fields{
+		"module":    "dataplane",
+		"component": "js-tailer",
+		"stream":    stream,
+		"subject":   subject,
+	}
+	// Listen on the delivery subject before the consumer is defined
+	inbox := nats.NewInbox()
+	sub, err := natsClient.NATs().SubscribeSync(inbox)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to subscribe for delivery")
+		return nil, err
+	}
+	info, err := natsClient.JetStream().AddConsumer(stream, &nats.ConsumerConfig{
+		Description:    common.TagGatewayConsumer("httpmq stream tail"),
+		DeliverSubject: inbox,
+		DeliverPolicy:  nats.DeliverNewPolicy,
+		AckPolicy:      nats.AckNonePolicy,
+		FilterSubject:  subject,
+	})
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to define tail consumer")
+		if err := sub.Unsubscribe(); err != nil {
+			log.WithError(err).WithFields(logTags).Error("Unsubscribe failed")
+		}
+		return nil, err
+	}
+	logTags["consumer"] = info.Name
+	return &jetStreamTailerImpl{
+		Component: common.Component{LogTags: logTags},
+		nats:      natsClient,
+		stream:    stream,
+		consumer:  info.Name,
+		sub:       sub,
+	}, nil
+}
+
+// NextMsg wait for the next message
+func (t *jetStreamTailerImpl) NextMsg(ctxt context.Context) (*nats.Msg, error) {
+	return t.sub.NextMsgWithContext(ctxt)
+}
+
+// Close stop reading, and delete the underlying consumer
+func (t *jetStreamTailerImpl) Close() error {
+	if err := t.sub.Unsubscribe(); err != nil {
+		log.WithError(err).WithFields(t.LogTags).Error("Unsubscribe failed")
+	}
+	if err := t.nats.JetStream().DeleteConsumer(t.stream, t.consumer); err != nil {
+		log.WithError(err).WithFields(t.LogTags).Error("Unable to delete tail consumer")
+		return err
+	}
+	log.WithFields(t.LogTags).Debug("Deleted tail consumer")
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJetStreamTailer(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-tailer"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamTailer",
+		"instance":  "basic",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define stream for testing
+	stream1 := uuid.New().String()
+	subject1 := fmt.Sprintf("%s.primary", uuid.New().String())
+	subject2 := fmt.Sprintf("%s.secondary", uuid.New().String())
+	{
+		maxAge := time.Second * 10
+		streamParam := management.JSStreamParam{
+			Name:     stream1,
+			Subjects: []string{subject1, subject2},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(jsCtrl.DeleteStream(stream1, utCtxt))
+	}()
+
+	// Messages published before the tailer is defined are not read
+	_, err = js.JetStream().Publish(subject1, []byte("old"))
+	assert.Nil(err)
+
+	// Case 0: tail unknown stream
+	{
+		_, err := GetJetStreamTailer(js, uuid.New().String(), "")
+		assert.NotNil(err)
+	}
+
+	// Case 1: tail all subjects
+	uut, err := GetJetStreamTailer(js, stream1, "")
+	assert.Nil(err)
+	{
+		msg := nats.NewMsg(subject1)
+		msg.Header.Set("Trace-ID", "abc")
+		msg.Data = []byte(`{"id": 1}`)
+		_, err := js.JetStream().PublishMsg(msg)
+		assert.Nil(err)
+		_, err = js.JetStream().Publish(subject2, []byte("hello"))
+		assert.Nil(err)
+		_, err = js.JetStream().Publish(subject1, []byte{0xff, 0xfe})
+		assert.Nil(err)
+	}
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		msg, err := uut.NextMsg(ctxt)
+		assert.Nil(err)
+		converted, err := ConvertTailMessage(msg)
+		assert.Nil(err)
+		assert.Equal(stream1, converted.Stream)
+		assert.Equal(subject1, converted.Subject)
+		assert.Equal(uint64(2), converted.Sequence)
+		assert.Equal("abc", nats.Header(converted.Headers).Get("Trace-ID"))
+		assert.Equal(`{"id": 1}`, string(converted.JSON))
+		assert.Empty(converted.Text)
+		assert.Equal(9, converted.Size)
+		converted.WithholdPayload()
+		assert.Nil(converted.JSON)
+		assert.True(converted.PayloadWithheld)
+		assert.Equal(9, converted.Size)
+
+		msg, err = uut.NextMsg(ctxt)
+		assert.Nil(err)
+		converted, err = ConvertTailMessage(msg)
+		assert.Nil(err)
+		assert.Equal(subject2, converted.Subject)
+		assert.Equal("hello", converted.Text)
+		assert.Nil(converted.JSON)
+
+		msg, err = uut.NextMsg(ctxt)
+		assert.Nil(err)
+		converted, err = ConvertTailMessage(msg)
+		assert.Nil(err)
+		assert.Equal([]byte{0xff, 0xfe}, converted.Message)
+		assert.Empty(converted.Text)
+	}
+	assert.Nil(uut.Close())
+	assert.Empty(jsCtrl.GetAllConsumersForStream(stream1, utCtxt))
+
+	// Case 2: tail one subject
+	uut, err = GetJetStreamTailer(js, stream1, subject2)
+	assert.Nil(err)
+	{
+		_, err := js.JetStream().Publish(subject1, []byte("skipped"))
+		assert.Nil(err)
+		_, err = js.JetStream().Publish(subject2, []byte("read"))
+		assert.Nil(err)
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second)
+		defer cancel()
+		msg, err := uut.NextMsg(ctxt)
+		assert.Nil(err)
+		assert.Equal("read", string(msg.Data))
+	}
+	assert.Nil(uut.Close())
+}
@@ -0,0 +1,229 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// TraceOutcome is what happened to a traced message
+type TraceOutcome string
+
+const (
+	// TraceDelivered the message was sent to the client
+	TraceDelivered TraceOutcome = "delivered"
+	// TraceDropped the message was NAKed as the client was not reading
+	TraceDropped TraceOutcome = "dropped"
+	// TraceFailed sending the message to the client failed
+	TraceFailed TraceOutcome = "failed"
+)
+
+// MessageTraceParam settings for tracing the messages sent to clients
+type MessageTraceParam struct {
+	// Subjects are the subjects traced. NATS wildcards are supported.
+	Subjects []string `validate:"dive,required"`
+	// Consumers are the consumers traced, as <stream>/<consumer>
+	Consumers []string `validate:"dive,required"`
+	// WindowSize is the number of recent messages kept for each subject and consumer
+	WindowSize int `validate:"gte=1"`
+	// PayloadBytes is how much of each message payload is kept. 0 to keep none.
+	PayloadBytes int `validate:"gte=0"`
+}
+
+// MessageTraceRecord is the metadata of a traced message
+type MessageTraceRecord struct {
+	// Timestamp is when the message was traced
+	Timestamp time.Time `json:"timestamp"`
+	// Outcome is what happened to the message
+	Outcome TraceOutcome `json:"outcome"`
+	// Subject is the subject of the message
+	Subject string `json:"subject"`
+	// Stream is the stream the message was read from
+	Stream string `json:"stream,omitempty"`
+	// Consumer is the consumer the message was read through
+	Consumer string `json:"consumer,omitempty"`
+	// StreamSeq is the sequence number of the message in the stream
+	StreamSeq uint64 `json:"stream_seq,omitempty"`
+	// ConsumerSeq is the sequence number of the message for the consumer
+	ConsumerSeq uint64 `json:"consumer_seq,omitempty"`
+	// NumDelivered is the number of times the message was delivered
+	NumDelivered uint64 `json:"num_delivered,omitempty"`
+	// Header are the message headers
+	Header nats.Header `json:"header,omitempty"`
+	// Size is the size of the message payload
+	Size int `json:"size"`
+	// Payload is the start of the message payload, if payloads are kept
+	Payload []byte `json:"payload,omitempty"`
+	// Truncated whether Payload is only part of the message payload
+	Truncated bool `json:"truncated,omitempty"`
+	// PayloadWithheld is set if the payload is withheld from the viewer
+	PayloadWithheld bool `json:"payload_withheld,omitempty"`
+}
+
+// WithholdPayload remove the payload, leaving only the message metadata
+func (r *MessageTraceRecord) WithholdPayload() {
+	r.Payload = nil
+	r.Truncated = false
+	r.PayloadWithheld = true
+}
+
+// MessageTrace are the recent messages of a traced subject or consumer
+type MessageTrace struct {
+	// Subject is the traced subject, if tracing a subject
+	Subject string `json:"subject,omitempty"`
+	// Consumer is the traced consumer as <stream>/<consumer>, if tracing a consumer
+	Consumer string `json:"consumer,omitempty"`
+	// Records are the recent messages, oldest first
+	Records []MessageTraceRecord `json:"records"`
+}
+
+// MessageTracer keeps a rolling window of the recent messages sent to clients for a set of
+// subjects and consumers
+type MessageTracer interface {
+	// Record traces a message, if its subject or consumer is traced
+	Record(msg *nats.Msg, outcome TraceOutcome)
+
+	// Report returns the recent messages of each traced subject and consumer
+	Report() []MessageTrace
+}
+
+// traceWindow rolling window of the recent messages of one subject or consumer
+type traceWindow struct {
+	subject  string
+	consumer string
+	records  []MessageTraceRecord
+	// next is where the next record is written once the window is full
+	next int
+}
+
+// add helper function to add a record, replacing the oldest once the window is full
+func (w *traceWindow) add(record MessageTraceRecord, size int) {
+	if len(w.records) < size {
+		w.records = append(w.records, record)
+		return
+	}
+	w.records[w.next] = record
+	w.next = (w.next + 1) % size
+}
+
+// ordered helper function to list the records oldest first
+func (w *traceWindow) ordered() []MessageTraceRecord {
+	result := make([]MessageTraceRecord, 0, len(w.records))
+	result = append(result, w.records[w.next:]...)
+	return append(result, w.records[:w.next]...)
+}
+
+// messageTracerImpl implements MessageTracer
+type messageTracerImpl struct {
+	param   MessageTraceParam
+	lock    sync.Mutex
+	windows []*traceWindow
+}
+
+// GetMessageTracer define a new MessageTracer
+func GetMessageTracer(param MessageTraceParam) (MessageTracer, error) {
+	if err := validator.New().Struct(&param); err != nil {
+		return nil, err
+	}
+	if len(param.Subjects) == 0 && len(param.Consumers) == 0 {
+		return nil, fmt.Errorf("message trace has no subject or consumer to trace")
+	}
+	tracer := &messageTracerImpl{param: param}
+	for _, subject := range param.Subjects {
+		if _, err := (common.SubjectRules{}).ValidateSubjectFilter(subject); err != nil {
+			return nil, err
+		}
+		tracer.windows = append(tracer.windows, &traceWindow{subject: subject})
+	}
+	for _, consumer := range param.Consumers {
+		parts := strings.Split(consumer, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("traced consumer %s is not <stream>/<consumer>", consumer)
+		}
+		tracer.windows = append(tracer.windows, &traceWindow{consumer: consumer})
+	}
+	return tracer, nil
+}
+
+// Record traces a message, if its subject or consumer is traced
+func (t *messageTracerImpl) Record(msg *nats.Msg, outcome TraceOutcome) {
+	record := MessageTraceRecord{
+		Timestamp: time.Now(),
+		Outcome:   outcome,
+		Subject:   msg.Subject,
+		Size:      len(msg.Data),
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		record.Stream = meta.Stream
+		record.Consumer = meta.Consumer
+		record.StreamSeq = meta.Sequence.Stream
+		record.ConsumerSeq = meta.Sequence.Consumer
+		record.NumDelivered = meta.NumDelivered
+	}
+	consumer := fmt.Sprintf("%s/%s", record.Stream, record.Consumer)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	traced := false
+	for _, window := range t.windows {
+		if window.subject != "" && !common.SubjectMatches(window.subject, msg.Subject) {
+			continue
+		}
+		if window.consumer != "" && window.consumer != consumer {
+			continue
+		}
+		// The header and payload are only copied once the message is known to be traced
+		if !traced {
+			traced = true
+			if len(msg.Header) > 0 {
+				record.Header = nats.Header{}
+				for name, values := range msg.Header {
+					record.Header[name] = append([]string{}, values...)
+				}
+			}
+			if t.param.PayloadBytes > 0 {
+				keep := len(msg.Data)
+				if keep > t.param.PayloadBytes {
+					keep = t.param.PayloadBytes
+					record.Truncated = true
+				}
+				record.Payload = append([]byte{}, msg.Data[:keep]...)
+			}
+		}
+		window.add(record, t.param.WindowSize)
+	}
+}
+
+// Report returns the recent messages of each traced subject and consumer
+func (t *messageTracerImpl) Report() []MessageTrace {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := make([]MessageTrace, 0, len(t.windows))
+	for _, window := range t.windows {
+		result = append(result, MessageTrace{
+			Subject:  window.subject,
+			Consumer: window.consumer,
+			Records:  window.ordered(),
+		})
+	}
+	return result
+}
@@ -0,0 +1,127 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageTracer(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid settings
+	{
+		_, err := GetMessageTracer(MessageTraceParam{WindowSize: 2})
+		assert.NotNil(err)
+		_, err = GetMessageTracer(
+			MessageTraceParam{Consumers: []string{"stream-1"}, WindowSize: 2},
+		)
+		assert.NotNil(err)
+		_, err = GetMessageTracer(
+			MessageTraceParam{Subjects: []string{"test-subject"}, WindowSize: 0},
+		)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetMessageTracer(MessageTraceParam{
+		Subjects:     []string{"*"},
+		Consumers:    []string{"stream-1/consumer-1"},
+		WindowSize:   2,
+		PayloadBytes: 4,
+	})
+	assert.Nil(err)
+
+	// Case 1: nothing traced yet
+	{
+		report := uut.Report()
+		assert.Len(report, 2)
+		assert.Equal("*", report[0].Subject)
+		assert.Equal("stream-1/consumer-1", report[1].Consumer)
+		assert.Empty(report[0].Records)
+		assert.Empty(report[1].Records)
+	}
+
+	// Case 2: message matching both the subject and the consumer
+	{
+		msg := benchDeliveryMsg(
+			"stream-1", "consumer-1", []byte("hello"), nats.Header{"Trace": []string{"1"}},
+		)
+		uut.Record(msg, TraceDelivered)
+		report := uut.Report()
+		assert.Len(report[0].Records, 1)
+		assert.Len(report[1].Records, 1)
+		record := report[1].Records[0]
+		assert.Equal(TraceDelivered, record.Outcome)
+		assert.Equal("test-subject", record.Subject)
+		assert.Equal("stream-1", record.Stream)
+		assert.Equal("consumer-1", record.Consumer)
+		assert.Equal(uint64(27), record.StreamSeq)
+		assert.Equal(uint64(14), record.ConsumerSeq)
+		assert.Equal(uint64(1), record.NumDelivered)
+		assert.Equal("1", record.Header.Get("Trace"))
+		assert.Equal(5, record.Size)
+		assert.Equal([]byte("hell"), record.Payload)
+		assert.True(record.Truncated)
+		// The record does not share the message
+		msg.Data[0] = 'j'
+		assert.Equal([]byte("hell"), uut.Report()[1].Records[0].Payload)
+	}
+
+	// Case 3: message of another consumer, only matching the subject
+	{
+		uut.Record(benchDeliveryMsg("stream-1", "consumer-2", []byte("hi"), nil), TraceDropped)
+		report := uut.Report()
+		assert.Len(report[0].Records, 2)
+		assert.Len(report[1].Records, 1)
+		assert.Equal(TraceDropped, report[0].Records[1].Outcome)
+		assert.Equal([]byte("hi"), report[0].Records[1].Payload)
+		assert.False(report[0].Records[1].Truncated)
+	}
+
+	// Case 4: the window rolls over, oldest first
+	{
+		uut.Record(benchDeliveryMsg("stream-1", "consumer-3", nil, nil), TraceFailed)
+		report := uut.Report()
+		assert.Len(report[0].Records, 2)
+		assert.Equal("consumer-2", report[0].Records[0].Consumer)
+		assert.Equal("consumer-3", report[0].Records[1].Consumer)
+		assert.Len(report[1].Records, 1)
+	}
+
+	// Case 5: message matching nothing
+	{
+		msg := benchDeliveryMsg("stream-2", "consumer-1", nil, nil)
+		msg.Subject = "other.subject"
+		uut.Record(msg, TraceDelivered)
+		report := uut.Report()
+		assert.Equal("consumer-3", report[0].Records[1].Consumer)
+		assert.Len(report[1].Records, 1)
+	}
+
+	// Case 6: withholding the payload of a reported message leaves the trace untouched
+	{
+		report := uut.Report()
+		report[1].Records[0].WithholdPayload()
+		assert.Nil(report[1].Records[0].Payload)
+		assert.False(report[1].Records[0].Truncated)
+		assert.True(report[1].Records[0].PayloadWithheld)
+		report = uut.Report()
+		assert.Equal([]byte("hell"), report[1].Records[0].Payload)
+		assert.False(report[1].Records[0].PayloadWithheld)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// TransactionIDHeader is the header carrying the ID of the transaction a message, or a
+// tombstone, was published in
+const TransactionIDHeader = "Httpmq-Transaction-ID"
+
+// TombstoneHeader marks a tombstone, which compensates for a message stored by a failed
+// transaction. Its value is "<stream>:<sequence>" of the message it compensates for.
+const TombstoneHeader = "Httpmq-Tombstone"
+
+// streamLookupTimeout bounds looking up the stream of a subject without a deadline
+const streamLookupTimeout = time.Second * 5
+
+// ErrNoStreamForSubject is reported for a subject no stream stores
+var ErrNoStreamForSubject = errors.New("no stream stores the subject")
+
+// ErrTransactionAborted is reported for a message not published because the transaction
+// failed before publishing
+var ErrTransactionAborted = errors.New("not published as the transaction failed")
+
+// TransactionMessage is a message published as part of a transaction
+type TransactionMessage struct {
+	// Subject is the subject to publish the message to
+	Subject string
+	// Message is the message body
+	Message []byte
+	// Header is the optional headers of the message
+	Header nats.Header
+}
+
+// TransactionMessageResult is the outcome of publishing a message of a transaction
+type TransactionMessageResult struct {
+	PublishResult
+	// Tombstone is the outcome of publishing the tombstone for the message, if it was
+	// stored but the transaction failed
+	Tombstone *PublishResult
+}
+
+// TransactionResult is the outcome of publishing a transaction
+type TransactionResult struct {
+	// ID is the transaction ID, carried by every message and tombstone of the transaction
+	// in TransactionIDHeader
+	ID string
+	// Committed indicates whether every message of the transaction was stored
+	Committed bool
+	// Results are the per message outcomes, in the same order as the messages
+	Results []TransactionMessageResult
+}
+
+// Failed returns the results of the messages which were not stored, excluding those not
+// published as the transaction failed
+func (r TransactionResult) Failed() []TransactionMessageResult {
+	failed := []TransactionMessageResult{}
+	for _, result := range r.Results {
+		if result.Err != nil && !errors.Is(result.Err, ErrTransactionAborted) {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// streamNamesResponse is the response of the JetStream API listing stream names
+type streamNamesResponse struct {
+	Streams []string `json:"streams"`
+	Error   *struct {
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+// lookupSubjectStream helper function to find the stream storing a subject
+func (s *jetStreamPublisherImpl) lookupSubjectStream(
+	subject string, ctxt context.Context,
+) (string, error) {
+	return lookupSubjectStream(s.nats, subject, ctxt)
+}
+
+// lookupSubjectStream helper function to find the stream storing a subject through a client
+func lookupSubjectStream(
+	client *core.NatsClient, subject string, ctxt context.Context,
+) (string, error) {
+	if _, ok := ctxt.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctxt, cancel = context.WithTimeout(ctxt, streamLookupTimeout)
+		defer cancel()
+	}
+	request, err := common.JSON().Marshal(map[string]string{"subject": subject})
+	if err != nil {
+		return "", err
+	}
+	reply, err := client.NATs().RequestWithContext(
+		ctxt, client.JetStreamAPISubject("STREAM.NAMES"), request,
+	)
+	if err != nil {
+		return "", err
+	}
+	var resp streamNamesResponse
+	if err := common.JSON().Unmarshal(reply.Data, &resp); err != nil {
+		return "", err
+	}
+	if resp.Error != nil {
+		return "", fmt.Errorf("%s", resp.Error.Description)
+	}
+	if len(resp.Streams) == 0 {
+		return "", ErrNoStreamForSubject
+	}
+	return resp.Streams[0], nil
+}
+
+// PublishTransaction publishes a set of messages to their subjects, all or nothing on a
+// best effort basis.
+//
+// The streams of all subjects are looked up first; if any subject has no stream, or the
+// publish hooks reject any message, nothing is published. Each message is then published
+// expecting the stream found for it. If any publish fails, a tombstone is published for
+// each message which was stored, to the same subject. The tombstones pass through no
+// publish hooks.
+func (s *jetStreamPublisherImpl) PublishTransaction(
+	msgs []TransactionMessage, ctxt context.Context,
+) TransactionResult {
+	result := TransactionResult{
+		ID: uuid.New().String(), Results: make([]TransactionMessageResult, len(msgs)),
+	}
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		localLogTags = s.LogTags
+	}
+
+	// Validate before publishing anything
+	streams := map[string]string{}
+	toSend := make([]*nats.Msg, len(msgs))
+	aborted := false
+	for idx, msg := range msgs {
+		result.Results[idx].Subject = msg.Subject
+		stream, ok := streams[msg.Subject]
+		if !ok {
+			if stream, err = s.lookupSubjectStream(msg.Subject, ctxt); err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf(
+					"Unable to find the stream of %s", msg.Subject,
+				)
+				result.Results[idx].Err = err
+				aborted = true
+				continue
+			}
+			streams[msg.Subject] = stream
+		}
+		body, err := s.applyPublishHooks(msg.Subject, msg.Message, localLogTags, ctxt)
+		if err != nil {
+			result.Results[idx].Err = err
+			aborted = true
+			continue
+		}
+		toSend[idx] = nats.NewMsg(msg.Subject)
+		toSend[idx].Data = body
+		for name, values := range msg.Header {
+			toSend[idx].Header[name] = values
+		}
+		toSend[idx].Header.Set(TransactionIDHeader, result.ID)
+		PublishExpectations{Stream: stream}.Apply(toSend[idx])
+	}
+	if aborted {
+		for idx := range result.Results {
+			if result.Results[idx].Err == nil {
+				result.Results[idx].Err = ErrTransactionAborted
+			}
+		}
+		return result
+	}
+
+	// Send all messages before waiting for any of the ACKs
+	acks := make([]nats.PubAckFuture, len(msgs))
+	for idx, msg := range toSend {
+		ack, err := s.nats.JetStream().PublishMsgAsync(msg)
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf(
+				"Unable to send message to %s", msg.Subject,
+			)
+			result.Results[idx].Err = err
+			continue
+		}
+		acks[idx] = ack
+	}
+	result.Committed = true
+	for idx, ack := range acks {
+		if ack == nil {
+			result.Committed = false
+			continue
+		}
+		pubAck, err := s.waitForPubAck(msgs[idx].Subject, ack, localLogTags, ctxt)
+		if err != nil {
+			result.Results[idx].Err = err
+			result.Committed = false
+			continue
+		}
+		result.Results[idx].Stream = pubAck.Stream
+		result.Results[idx].Sequence = pubAck.Sequence
+	}
+	if result.Committed {
+		common.ThrottledDebugf(
+			log.WithFields(localLogTags), "Committed transaction %s of %d messages", result.ID, len(msgs),
+		)
+		return result
+	}
+
+	// Compensate for the messages stored
+	log.WithFields(localLogTags).Warnf("Transaction %s failed, publishing tombstones", result.ID)
+	for idx := range result.Results {
+		if result.Results[idx].Err != nil {
+			continue
+		}
+		tombstone := s.publishTombstone(
+			result.ID, result.Results[idx].PublishResult, localLogTags, ctxt,
+		)
+		result.Results[idx].Tombstone = &tombstone
+	}
+	return result
+}
+
+// publishTombstone helper function to publish the tombstone of a stored message
+func (s *jetStreamPublisherImpl) publishTombstone(
+	transactionID string, stored PublishResult, localLogTags log.Fields, ctxt context.Context,
+) PublishResult {
+	result := PublishResult{Subject: stored.Subject}
+	msg := nats.NewMsg(stored.Subject)
+	msg.Header.Set(TransactionIDHeader, transactionID)
+	msg.Header.Set(
+		TombstoneHeader, stored.Stream+":"+strconv.FormatUint(stored.Sequence, 10),
+	)
+	ack, err := s.nats.JetStream().PublishMsgAsync(msg)
+	if err == nil {
+		var pubAck *nats.PubAck
+		if pubAck, err = s.waitForPubAck(stored.Subject, ack, localLogTags, ctxt); err == nil {
+			result.Stream = pubAck.Stream
+			result.Sequence = pubAck.Sequence
+			return result
+		}
+	}
+	log.WithError(err).WithFields(localLogTags).Errorf(
+		"Unable to publish tombstone for [%d] of %s", stored.Sequence, stored.Stream,
+	)
+	result.Err = err
+	return result
+}
@@ -0,0 +1,179 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionResultFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	uut := TransactionResult{
+		Results: []TransactionMessageResult{
+			{PublishResult: PublishResult{Subject: "s1", Err: ErrTransactionAborted}},
+			{PublishResult: PublishResult{Subject: "s2", Err: ErrNoStreamForSubject}},
+			{PublishResult: PublishResult{Subject: "s3", Stream: "stream", Sequence: 1}},
+		},
+	}
+	failed := uut.Failed()
+	assert.Len(failed, 1)
+	assert.Equal("s2", failed[0].Subject)
+	assert.True(IsNoStreamError(failed[0].Err))
+}
+
+func TestPublishTransaction(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-js-msg-transaction"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "dataplane_test",
+		"component": "JetStreamPublisher",
+		"instance":  "transaction",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	jsCtrl, err := management.GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	// Define streams for testing. Messages over 64 bytes are refused by stream2.
+	stream1 := uuid.New().String()
+	stream2 := uuid.New().String()
+	subject1 := uuid.New().String()
+	subject2 := uuid.New().String()
+	{
+		maxAge := time.Second * 10
+		maxMsgSize := int32(64)
+		streamParam := management.JSStreamParam{
+			Name:           stream1,
+			Subjects:       []string{subject1},
+			JSStreamLimits: management.JSStreamLimits{MaxAge: &maxAge},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+		streamParam = management.JSStreamParam{
+			Name:     stream2,
+			Subjects: []string{subject2},
+			JSStreamLimits: management.JSStreamLimits{
+				MaxAge: &maxAge, MaxMsgSize: &maxMsgSize,
+			},
+		}
+		assert.Nil(jsCtrl.CreateStream(streamParam, utCtxt))
+	}
+
+	publisher, err := GetJetStreamPublisher(js, testName)
+	assert.Nil(err)
+
+	// Case 0: all messages are stored
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		result := publisher.PublishTransaction([]TransactionMessage{
+			{Subject: subject1, Message: []byte("msg-1")},
+			{Subject: subject2, Message: []byte("msg-2")},
+		}, ctxt)
+		assert.True(result.Committed)
+		assert.NotEmpty(result.ID)
+		assert.Len(result.Results, 2)
+		assert.Nil(result.Results[0].Err)
+		assert.Equal(stream1, result.Results[0].Stream)
+		assert.Equal(uint64(1), result.Results[0].Sequence)
+		assert.Nil(result.Results[0].Tombstone)
+		assert.Nil(result.Results[1].Err)
+		assert.Equal(stream2, result.Results[1].Stream)
+		stored, err := js.JetStream().GetMsg(stream2, 1)
+		assert.Nil(err)
+		assert.Equal(result.ID, stored.Header.Get(TransactionIDHeader))
+	}
+
+	// Case 1: a subject without stream aborts the transaction before publishing
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		result := publisher.PublishTransaction([]TransactionMessage{
+			{Subject: subject1, Message: []byte("msg-3")},
+			{Subject: uuid.New().String(), Message: []byte("msg-4")},
+		}, ctxt)
+		assert.False(result.Committed)
+		assert.ErrorIs(result.Results[0].Err, ErrTransactionAborted)
+		assert.ErrorIs(result.Results[1].Err, ErrNoStreamForSubject)
+		info, err := js.JetStream().StreamInfo(stream1)
+		assert.Nil(err)
+		assert.Equal(uint64(1), info.State.LastSeq)
+	}
+
+	// Case 2: a message refused by its stream, the stored messages are compensated
+	{
+		ctxt, cancel := context.WithTimeout(utCtxt, time.Second*2)
+		defer cancel()
+		result := publisher.PublishTransaction([]TransactionMessage{
+			{Subject: subject1, Message: []byte("msg-5")},
+			{Subject: subject2, Message: make([]byte, 128)},
+		}, ctxt)
+		assert.False(result.Committed)
+		assert.Nil(result.Results[0].Err)
+		assert.Equal(uint64(2), result.Results[0].Sequence)
+		assert.NotNil(result.Results[0].Tombstone)
+		assert.Nil(result.Results[0].Tombstone.Err)
+		assert.Equal(uint64(3), result.Results[0].Tombstone.Sequence)
+		assert.NotNil(result.Results[1].Err)
+		assert.Nil(result.Results[1].Tombstone)
+		assert.Len(result.Failed(), 1)
+
+		tombstone, err := js.JetStream().GetMsg(stream1, 3)
+		assert.Nil(err)
+		assert.Equal(result.ID, tombstone.Header.Get(TransactionIDHeader))
+		assert.Equal(fmt.Sprintf("%s:2", stream1), tombstone.Header.Get(TombstoneHeader))
+		assert.Empty(tombstone.Data)
+	}
+}
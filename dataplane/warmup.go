@@ -0,0 +1,144 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultWarmUpDoubling is how often the warm-up delivery rate doubles, if not given
+const defaultWarmUpDoubling = time.Second * 10
+
+// WarmUpProgress is the progress of a subscription draining its backlog while warming up
+type WarmUpProgress struct {
+	// Active is whether delivery is still rate limited
+	Active bool `json:"active"`
+	// Rate is the current delivery rate limit, in messages per second
+	Rate float64 `json:"rate"`
+	// Backlog is the number of messages pending when delivery started
+	Backlog uint64 `json:"backlog"`
+	// Delivered is the number of messages forwarded since delivery started
+	Delivered uint64 `json:"delivered"`
+	// Pending is the number of messages still pending
+	Pending uint64 `json:"pending"`
+}
+
+// warmUpLimiter rate limits delivery with a token bucket whose rate doubles periodically,
+// until the backlog of the consumer is drained
+type warmUpLimiter struct {
+	initialRate float64
+	doubling    time.Duration
+	lock        sync.Mutex
+	// started is when the first message was forwarded
+	started time.Time
+	// refilled is when tokens were last added
+	refilled time.Time
+	tokens   float64
+	progress WarmUpProgress
+}
+
+// defineWarmUpLimiter define a new warmUpLimiter. Returns nil if warm-up is disabled.
+func defineWarmUpLimiter(concurrency DeliveryConcurrency) (*warmUpLimiter, error) {
+	if concurrency.WarmUpRate < 0 {
+		return nil, fmt.Errorf("warm-up rate can not be negative")
+	}
+	if concurrency.WarmUpDoubling < 0 {
+		return nil, fmt.Errorf("warm-up doubling interval can not be negative")
+	}
+	if concurrency.WarmUpRate == 0 {
+		return nil, nil
+	}
+	doubling := concurrency.WarmUpDoubling
+	if doubling == 0 {
+		doubling = defaultWarmUpDoubling
+	}
+	return &warmUpLimiter{
+		initialRate: concurrency.WarmUpRate,
+		doubling:    doubling,
+		progress:    WarmUpProgress{Active: true, Rate: concurrency.WarmUpRate},
+	}, nil
+}
+
+// rateAt helper function to compute the delivery rate limit at a point in time
+func (l *warmUpLimiter) rateAt(now time.Time) float64 {
+	if l.started.IsZero() {
+		return l.initialRate
+	}
+	return l.initialRate * math.Pow(2, float64(now.Sub(l.started))/float64(l.doubling))
+}
+
+// wait until a message can be forwarded. numPending is the number of messages pending for
+// the consumer after this one; warm-up ends once it reaches zero.
+func (l *warmUpLimiter) wait(numPending uint64, ctxt context.Context) error {
+	for {
+		l.lock.Lock()
+		now := time.Now()
+		if l.started.IsZero() {
+			l.started = now
+			l.refilled = now
+			l.tokens = 1
+			l.progress.Backlog = numPending + 1
+		}
+		if !l.progress.Active {
+			l.record(numPending)
+			l.lock.Unlock()
+			return nil
+		}
+		rate := l.rateAt(now)
+		// Bursts are bounded to a tenth of a second of delivery
+		l.tokens = math.Min(
+			math.Max(1, rate/10), l.tokens+now.Sub(l.refilled).Seconds()*rate,
+		)
+		l.refilled = now
+		l.progress.Rate = rate
+		if l.tokens >= 1 {
+			l.tokens--
+			l.record(numPending)
+			l.lock.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - l.tokens) / rate * float64(time.Second))
+		l.lock.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-ctxt.Done():
+			return ctxt.Err()
+		}
+	}
+}
+
+// record helper function to update the progress once a message is let through
+func (l *warmUpLimiter) record(numPending uint64) {
+	l.progress.Delivered++
+	l.progress.Pending = numPending
+	if numPending == 0 {
+		l.progress.Active = false
+	}
+}
+
+// report returns the current progress
+func (l *warmUpLimiter) report() WarmUpProgress {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	progress := l.progress
+	if progress.Active {
+		progress.Rate = l.rateAt(time.Now())
+	}
+	return progress
+}
@@ -0,0 +1,90 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmUpLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	// Case 0: invalid or disabled warm-up
+	{
+		_, err := defineWarmUpLimiter(DeliveryConcurrency{WarmUpRate: -1})
+		assert.NotNil(err)
+		_, err = defineWarmUpLimiter(DeliveryConcurrency{WarmUpRate: 1, WarmUpDoubling: -1})
+		assert.NotNil(err)
+		uut, err := defineWarmUpLimiter(DeliveryConcurrency{})
+		assert.Nil(err)
+		assert.Nil(uut)
+	}
+
+	// Case 1: delivery starts at the warm-up rate
+	{
+		uut, err := defineWarmUpLimiter(DeliveryConcurrency{WarmUpRate: 20, WarmUpDoubling: time.Hour})
+		assert.Nil(err)
+		started := time.Now()
+		for pending := uint64(9); pending > 4; pending-- {
+			assert.Nil(uut.wait(pending, utCtxt))
+		}
+		// The first message passes at once; the rest at 20 per second
+		assert.GreaterOrEqual(time.Since(started), time.Millisecond*190)
+		progress := uut.report()
+		assert.True(progress.Active)
+		assert.Equal(uint64(10), progress.Backlog)
+		assert.Equal(uint64(5), progress.Delivered)
+		assert.Equal(uint64(5), progress.Pending)
+		assert.InDelta(20, progress.Rate, 1)
+
+		// Case 2: giving up while waiting
+		{
+			lctxt, lcancel := context.WithTimeout(utCtxt, time.Millisecond)
+			defer lcancel()
+			time.Sleep(time.Millisecond * 5)
+			assert.NotNil(uut.wait(4, lctxt))
+		}
+
+		// Case 3: warm-up ends once the backlog is drained
+		assert.Nil(uut.wait(0, utCtxt))
+		started = time.Now()
+		for itr := 0; itr < 10; itr++ {
+			assert.Nil(uut.wait(0, utCtxt))
+		}
+		assert.Less(time.Since(started), time.Millisecond*50)
+		progress = uut.report()
+		assert.False(progress.Active)
+		assert.Equal(uint64(16), progress.Delivered)
+		assert.Equal(uint64(0), progress.Pending)
+	}
+
+	// Case 4: the rate doubles every doubling interval
+	{
+		uut, err := defineWarmUpLimiter(
+			DeliveryConcurrency{WarmUpRate: 10, WarmUpDoubling: time.Millisecond * 100},
+		)
+		assert.Nil(err)
+		assert.Nil(uut.wait(100, utCtxt))
+		time.Sleep(time.Millisecond * 200)
+		assert.Greater(uut.report().Rate, 35.0)
+	}
+}
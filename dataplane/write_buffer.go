@@ -0,0 +1,216 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// SlowClientPolicy is what a subscription session does with a message which does not fit in
+// its write buffer, because the client is not reading fast enough
+type SlowClientPolicy string
+
+const (
+	// SlowClientDisconnect ends the session. Its unACKed messages are redelivered by JetStream.
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+	// SlowClientPause stops reading messages for the session until the buffer has room
+	SlowClientPause SlowClientPolicy = "pause"
+	// SlowClientDropNAK drops the message, and NAKs it so JetStream redelivers it
+	SlowClientDropNAK SlowClientPolicy = "drop-nak"
+)
+
+// ErrWriteBufferFull is returned when a frame does not fit in a session write buffer
+var ErrWriteBufferFull = errors.New("session write buffer is full")
+
+// SessionWriteBufferStats are the usage counters of a SessionWriteBuffer
+type SessionWriteBufferStats struct {
+	// Buffered is the number of bytes queued, and not yet written to the client
+	Buffered int
+	// HighWater is the most bytes ever queued at once
+	HighWater int
+	// Overflows is the number of frames rejected for not fitting in the buffer
+	Overflows uint64
+}
+
+// SessionWriteBuffer is a bounded queue of frames to send to a subscription client. The
+// frames are written to the client by a goroutine of the buffer, so a client which stops
+// reading does not block the session.
+type SessionWriteBuffer interface {
+	// Write queue one frame. The frame is copied. Returns ErrWriteBufferFull if the frame does
+	// not fit; a frame is always accepted by an empty buffer.
+	Write(frame []byte) (int, error)
+	// Drained is signaled whenever frames are written to the client
+	Drained() <-chan struct{}
+	// Done is closed once the buffer stops writing to the client, either after Close, or
+	// because a write failed
+	Done() <-chan struct{}
+	// Err returns the error of the failed write to the client, if any
+	Err() error
+	// Close stop accepting frames, and wait up to timeout for the queued frames to be written.
+	// Returns false if a write to the client is still blocked.
+	Close(timeout time.Duration) bool
+	// Stats return the buffer usage counters
+	Stats() SessionWriteBufferStats
+}
+
+// sessionWriteBufferImpl implements SessionWriteBuffer
+type sessionWriteBufferImpl struct {
+	output   io.Writer
+	flush    func()
+	maxBytes int
+	lock     sync.Mutex
+	frames   [][]byte
+	stats    SessionWriteBufferStats
+	closed   bool
+	err      error
+	// queued signals the writer of new frames, or of the buffer closing
+	queued  chan struct{}
+	drained chan struct{}
+	done    chan struct{}
+}
+
+// GetSessionWriteBuffer define a new SessionWriteBuffer, and start writing to output
+//
+// flush is called whenever the queue empties, so a burst of frames is sent together.
+func GetSessionWriteBuffer(
+	output io.Writer, flush func(), maxBytes int,
+) (SessionWriteBuffer, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("session write buffer size must be positive")
+	}
+	instance := &sessionWriteBufferImpl{
+		output:   output,
+		flush:    flush,
+		maxBytes: maxBytes,
+		queued:   make(chan struct{}, 1),
+		drained:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go instance.run()
+	return instance, nil
+}
+
+// Write queue one frame
+func (b *sessionWriteBufferImpl) Write(frame []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.closed {
+		return 0, fmt.Errorf("session write buffer is closed")
+	}
+	if b.stats.Buffered > 0 && b.stats.Buffered+len(frame) > b.maxBytes {
+		b.stats.Overflows++
+		return 0, ErrWriteBufferFull
+	}
+	b.frames = append(b.frames, append([]byte(nil), frame...))
+	b.stats.Buffered += len(frame)
+	if b.stats.Buffered > b.stats.HighWater {
+		b.stats.HighWater = b.stats.Buffered
+	}
+	wake(b.queued)
+	return len(frame), nil
+}
+
+// wake helper function to signal a channel with a buffer of one, without blocking
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// run write the queued frames to the client until closed, or a write fails
+func (b *sessionWriteBufferImpl) run() {
+	defer close(b.done)
+	for {
+		b.lock.Lock()
+		if len(b.frames) == 0 {
+			closed := b.closed
+			b.lock.Unlock()
+			if closed {
+				return
+			}
+			<-b.queued
+			continue
+		}
+		frame := b.frames[0]
+		b.frames[0] = nil
+		b.frames = b.frames[1:]
+		b.lock.Unlock()
+
+		_, err := b.output.Write(frame)
+
+		b.lock.Lock()
+		b.stats.Buffered -= len(frame)
+		empty := len(b.frames) == 0
+		if err != nil {
+			b.err = err
+		}
+		b.lock.Unlock()
+		wake(b.drained)
+		if err != nil {
+			return
+		}
+		if empty {
+			b.flush()
+		}
+	}
+}
+
+// Drained is signaled whenever frames are written to the client
+func (b *sessionWriteBufferImpl) Drained() <-chan struct{} {
+	return b.drained
+}
+
+// Done is closed once the buffer stops writing to the client
+func (b *sessionWriteBufferImpl) Done() <-chan struct{} {
+	return b.done
+}
+
+// Err returns the error of the failed write to the client, if any
+func (b *sessionWriteBufferImpl) Err() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+// Close stop accepting frames, and wait up to timeout for the queued frames to be written
+func (b *sessionWriteBufferImpl) Close(timeout time.Duration) bool {
+	b.lock.Lock()
+	b.closed = true
+	b.lock.Unlock()
+	wake(b.queued)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-b.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Stats return the buffer usage counters
+func (b *sessionWriteBufferImpl) Stats() SessionWriteBufferStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stats
+}
@@ -0,0 +1,94 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionWriteBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: invalid settings
+	{
+		_, err := GetSessionWriteBuffer(io.Discard, func() {}, 0)
+		assert.NotNil(err)
+	}
+
+	// Case 1: a client which stops reading fills the buffer, without blocking the writer
+	{
+		reader, writer := io.Pipe()
+		flushes := 0
+		uut, err := GetSessionWriteBuffer(writer, func() { flushes++ }, 8)
+		assert.Nil(err)
+
+		// The first frame is taken by the blocked write to the client
+		_, err = uut.Write([]byte("frame-0\n"))
+		assert.Nil(err)
+		assert.Eventually(func() bool {
+			return uut.Stats().Buffered == 8
+		}, time.Second, time.Millisecond*10)
+		// The frame being written still counts against the buffer, so no more frames fit
+		_, err = uut.Write([]byte("x"))
+		assert.Equal(ErrWriteBufferFull, err)
+		assert.Equal(uint64(1), uut.Stats().Overflows)
+
+		// Once the client reads, the buffer drains
+		read := make([]byte, 8)
+		_, err = io.ReadFull(reader, read)
+		assert.Nil(err)
+		assert.Equal("frame-0\n", string(read))
+		select {
+		case <-uut.Drained():
+		case <-time.After(time.Second):
+			assert.Fail("buffer not drained")
+		}
+		assert.Eventually(func() bool {
+			return uut.Stats().Buffered == 0
+		}, time.Second, time.Millisecond*10)
+		_, err = uut.Write([]byte("frame-1\n"))
+		assert.Nil(err)
+		_, err = io.ReadFull(reader, read)
+		assert.Nil(err)
+		assert.Equal("frame-1\n", string(read))
+		assert.True(uut.Close(time.Second))
+		assert.Equal(2, flushes)
+		assert.Equal(8, uut.Stats().HighWater)
+		_, err = uut.Write([]byte("late"))
+		assert.NotNil(err)
+	}
+
+	// Case 2: closing gives up on a client which never reads
+	{
+		_, writer := io.Pipe()
+		uut, err := GetSessionWriteBuffer(writer, func() {}, 8)
+		assert.Nil(err)
+		_, err = uut.Write([]byte("frame-0\n"))
+		assert.Nil(err)
+		assert.False(uut.Close(time.Millisecond * 50))
+		// Once the connection ends, so does the blocked write
+		assert.Nil(writer.CloseWithError(io.ErrClosedPipe))
+		select {
+		case <-uut.Done():
+		case <-time.After(time.Second):
+			assert.Fail("buffer still writing")
+		}
+		assert.Equal(io.ErrClosedPipe, uut.Err())
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filters
+
+// UnitTestFilterModule is a filter module for testing, which acts on the first byte of a
+// message: "d" drops the message, "t" forwards the rest of the message, "l" loops forever,
+// and anything else forwards the message. Compiled from:
+//
+//	(module
+//	  (import "httpmq" "set_output" (func $set_output (param i32 i32)))
+//	  (memory (export "memory") 1)
+//	  (func (export "alloc") (param i32) (result i32) (i32.const 1024))
+//	  (func (export "filter") (param $ptr i32) (param $len i32) (result i32)
+//	    (local $c i32)
+//	    (local.set $c (i32.load8_u (local.get $ptr)))
+//	    (if (i32.eq (local.get $c) (i32.const 100)) (then (return (i32.const 1))))
+//	    (if (i32.eq (local.get $c) (i32.const 116)) (then
+//	      (call $set_output
+//	        (i32.add (local.get $ptr) (i32.const 1)) (i32.sub (local.get $len) (i32.const 1)))
+//	      (return (i32.const 2))))
+//	    (if (i32.eq (local.get $c) (i32.const 108)) (then (loop (br 0))))
+//	    (i32.const 0)))
+var UnitTestFilterModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x11, 0x03, 0x60,
+	0x02, 0x7f, 0x7f, 0x00, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f,
+	0x7f, 0x01, 0x7f, 0x02, 0x15, 0x01, 0x06, 0x68, 0x74, 0x74, 0x70, 0x6d,
+	0x71, 0x0a, 0x73, 0x65, 0x74, 0x5f, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74,
+	0x00, 0x00, 0x03, 0x03, 0x02, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x1b, 0x03, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00,
+	0x05, 0x61, 0x6c, 0x6c, 0x6f, 0x63, 0x00, 0x01, 0x06, 0x66, 0x69, 0x6c,
+	0x74, 0x65, 0x72, 0x00, 0x02, 0x0a, 0x47, 0x02, 0x05, 0x00, 0x41, 0x80,
+	0x08, 0x0b, 0x3f, 0x01, 0x01, 0x7f, 0x20, 0x00, 0x2d, 0x00, 0x00, 0x21,
+	0x02, 0x20, 0x02, 0x41, 0xe4, 0x00, 0x46, 0x04, 0x40, 0x41, 0x01, 0x0f,
+	0x0b, 0x20, 0x02, 0x41, 0xf4, 0x00, 0x46, 0x04, 0x40, 0x20, 0x00, 0x41,
+	0x01, 0x6a, 0x20, 0x01, 0x41, 0x01, 0x6b, 0x10, 0x00, 0x41, 0x02, 0x0f,
+	0x0b, 0x20, 0x02, 0x41, 0xec, 0x00, 0x46, 0x04, 0x40, 0x03, 0x40, 0x0c,
+	0x00, 0x0b, 0x0b, 0x41, 0x00, 0x0b,
+}
@@ -0,0 +1,531 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filters runs user-defined WASM modules which decide per message whether a
+// consumer's messages are forwarded, dropped, or transformed.
+//
+// A filter module must export:
+//
+//   - "memory": the module's memory
+//   - "alloc(size i32) -> i32": returns the offset of size bytes of memory the message is
+//     written to before calling "filter"
+//   - "filter(offset i32, size i32) -> i32": returns the decision for the message; 0 to
+//     forward, 1 to drop, 2 to transform
+//
+// To transform a message, the module calls the imported "httpmq.set_output(offset i32,
+// size i32)" with the transformed message before returning 2. A module may also import WASI,
+// but has no access to the file system, environment, or network. Modules are instantiated
+// as WASI reactors: "_initialize" is called if exported, but "_start" is not.
+package filters
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/storage"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// ErrNoFilter returned when a consumer has no filter
+var ErrNoFilter = errors.New("no filter defined")
+
+// ErrInvalidModule returned when a WASM module can not be used as a filter
+var ErrInvalidModule = errors.New("invalid filter module")
+
+// MaxModuleSize is the largest filter module accepted, in bytes
+const MaxModuleSize = 512 * 1024
+
+// hostModuleName is the name of the module providing host functions to filters
+const hostModuleName = "httpmq"
+
+// maxCompiledModules is the number of compiled modules kept for reuse
+const maxCompiledModules = 64
+
+// Action is the decision of a filter for a message
+type Action uint32
+
+const (
+	// ActionForward forwards the message unchanged
+	ActionForward Action = 0
+	// ActionDrop drops the message
+	ActionDrop Action = 1
+	// ActionTransform forwards the message given by the filter instead
+	ActionTransform Action = 2
+)
+
+// Limits are the resource limits of a running filter
+type Limits struct {
+	// MaxMemoryMB is the max memory of a filter instance in MiB. "0" means no limit beyond
+	// the WASM limit of 4 GiB.
+	MaxMemoryMB uint32 `validate:"lte=4096"`
+	// Timeout is how long a filter can run for one message. "0" means no limit.
+	Timeout time.Duration `validate:"gte=0"`
+}
+
+// ModuleInfo describes the filter module of a consumer
+type ModuleInfo struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Size is the size of the module in bytes
+	Size int `json:"size"`
+	// SHA256 is the hex encoded SHA256 digest of the module
+	SHA256 string `json:"sha256"`
+	// Uploaded is when the module was stored
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// storedModule the persisted record of a filter module
+type storedModule struct {
+	ModuleInfo
+	Module []byte `json:"module"`
+}
+
+// Filter is a running instance of a filter module. Concurrent calls to Apply run one at a
+// time.
+type Filter interface {
+	// Apply runs the filter on a message body. Returns the filter's decision, and the
+	// message body to forward.
+	Apply(msg []byte, ctxt context.Context) (Action, []byte, error)
+	// Close stops the filter instance
+	Close(ctxt context.Context) error
+}
+
+// Registry stores the filter modules of consumers, and runs them
+type Registry interface {
+	// PutFilter validates and stores the filter module of a consumer, replacing any existing
+	// module
+	PutFilter(stream, consumer string, module []byte, ctxt context.Context) (ModuleInfo, error)
+	// GetFilter describes the filter module of a consumer. Returns ErrNoFilter if the
+	// consumer has none.
+	GetFilter(stream, consumer string, ctxt context.Context) (ModuleInfo, error)
+	// DeleteFilter removes the filter module of a consumer
+	DeleteFilter(stream, consumer string, ctxt context.Context) error
+	// LoadFilter starts an instance of the filter module of a consumer. Returns ErrNoFilter
+	// if the consumer has none.
+	LoadFilter(stream, consumer string, ctxt context.Context) (Filter, error)
+	// Close stops the WASM runtime
+	Close(ctxt context.Context) error
+}
+
+// wasmRegistryImpl implements Registry
+type wasmRegistryImpl struct {
+	common.Component
+	store   storage.KeyValueStore
+	runtime wazero.Runtime
+	timeout time.Duration
+	lock    sync.Mutex
+	// compiled the compiled modules, by SHA256 digest
+	compiled map[string]wazero.CompiledModule
+}
+
+// GetRegistry define a new Registry, storing modules in store
+func GetRegistry(
+	store storage.KeyValueStore, limits Limits, instance string, ctxt context.Context,
+) (Registry, error) {
+	logTags := log.Fields{
+		"module": "filters", "component": "wasm-registry", "instance": instance,
+	}
+	if err := validator.New().Struct(&limits); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Filter limits invalid")
+		return nil, err
+	}
+	config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if limits.MaxMemoryMB > 0 {
+		// WASM memory is allocated in 64 KiB pages
+		config = config.WithMemoryLimitPages(limits.MaxMemoryMB * 16)
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctxt, config)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctxt, runtime); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define WASI")
+		_ = runtime.Close(ctxt)
+		return nil, err
+	}
+	if _, err := runtime.NewHostModuleBuilder(hostModuleName).
+		NewFunctionBuilder().
+		WithFunc(setOutput).
+		Export("set_output").
+		Instantiate(ctxt); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define host functions")
+		_ = runtime.Close(ctxt)
+		return nil, err
+	}
+	return &wasmRegistryImpl{
+		Component: common.Component{LogTags: logTags},
+		store:     store,
+		runtime:   runtime,
+		timeout:   limits.Timeout,
+		compiled:  make(map[string]wazero.CompiledModule),
+	}, nil
+}
+
+// filterKey helper function to define the store key of a consumer's filter module
+func filterKey(stream, consumer string) string {
+	return fmt.Sprintf("%s.%s", stream, consumer)
+}
+
+// PutFilter validates and stores the filter module of a consumer
+func (r *wasmRegistryImpl) PutFilter(
+	stream, consumer string, module []byte, ctxt context.Context,
+) (ModuleInfo, error) {
+	localLogTags, err := common.UpdateLogTags(r.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to update logtags")
+		return ModuleInfo{}, err
+	}
+	if len(module) > MaxModuleSize {
+		return ModuleInfo{}, fmt.Errorf(
+			"%w: larger than %d bytes", ErrInvalidModule, MaxModuleSize,
+		)
+	}
+	digest := sha256.Sum256(module)
+	record := storedModule{
+		ModuleInfo: ModuleInfo{
+			Stream:   stream,
+			Consumer: consumer,
+			Size:     len(module),
+			SHA256:   hex.EncodeToString(digest[:]),
+			Uploaded: time.Now().UTC(),
+		},
+		Module: module,
+	}
+	// Verify the module can be instantiated
+	instance, err := r.instantiate(record, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Filter module for %s@%s rejected", consumer, stream,
+		)
+		return ModuleInfo{}, err
+	}
+	if err := instance.Close(ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Failed to close filter instance")
+	}
+	serialized, err := json.Marshal(&record)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to serialize filter module")
+		return ModuleInfo{}, err
+	}
+	if err := r.store.Put(filterKey(stream, consumer), serialized, ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to store filter module for %s@%s", consumer, stream,
+		)
+		return ModuleInfo{}, err
+	}
+	log.WithFields(localLogTags).Infof(
+		"Stored filter module %s for %s@%s", record.SHA256, consumer, stream,
+	)
+	return record.ModuleInfo, nil
+}
+
+// readFilter helper function to read the stored filter module of a consumer
+func (r *wasmRegistryImpl) readFilter(
+	stream, consumer string, ctxt context.Context,
+) (storedModule, error) {
+	serialized, err := r.store.Get(filterKey(stream, consumer), ctxt)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return storedModule{}, ErrNoFilter
+	} else if err != nil {
+		return storedModule{}, err
+	}
+	var record storedModule
+	if err := json.Unmarshal(serialized, &record); err != nil {
+		return storedModule{}, err
+	}
+	return record, nil
+}
+
+// GetFilter describes the filter module of a consumer
+func (r *wasmRegistryImpl) GetFilter(
+	stream, consumer string, ctxt context.Context,
+) (ModuleInfo, error) {
+	record, err := r.readFilter(stream, consumer, ctxt)
+	if err != nil {
+		return ModuleInfo{}, err
+	}
+	return record.ModuleInfo, nil
+}
+
+// DeleteFilter removes the filter module of a consumer
+func (r *wasmRegistryImpl) DeleteFilter(stream, consumer string, ctxt context.Context) error {
+	localLogTags, err := common.UpdateLogTags(r.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	if _, err := r.readFilter(stream, consumer, ctxt); err != nil {
+		return err
+	}
+	if err := r.store.Delete(filterKey(stream, consumer), ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to delete filter module for %s@%s", consumer, stream,
+		)
+		return err
+	}
+	log.WithFields(localLogTags).Infof("Deleted filter module for %s@%s", consumer, stream)
+	return nil
+}
+
+// LoadFilter starts an instance of the filter module of a consumer
+func (r *wasmRegistryImpl) LoadFilter(
+	stream, consumer string, ctxt context.Context,
+) (Filter, error) {
+	record, err := r.readFilter(stream, consumer, ctxt)
+	if err != nil {
+		return nil, err
+	}
+	return r.instantiate(record, ctxt)
+}
+
+// Close stops the WASM runtime
+func (r *wasmRegistryImpl) Close(ctxt context.Context) error {
+	return r.runtime.Close(ctxt)
+}
+
+// instantiate helper function to start an instance of a filter module
+func (r *wasmRegistryImpl) instantiate(record storedModule, ctxt context.Context) (Filter, error) {
+	if _, err := r.compile(record); err != nil {
+		return nil, err
+	}
+	filter := &wasmFilter{
+		start: func(ctxt context.Context) (api.Module, error) {
+			// The compiled module may have been evicted since
+			compiled, err := r.compile(record)
+			if err != nil {
+				return nil, err
+			}
+			return r.runtime.InstantiateModule(
+				ctxt, compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"),
+			)
+		},
+		timeout: r.timeout,
+	}
+	if err := filter.restart(ctxt); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidModule, err)
+	}
+	return filter, nil
+}
+
+// compile helper function to compile a filter module, and verify it implements the filter
+// ABI. Compiled modules are reused.
+func (r *wasmRegistryImpl) compile(record storedModule) (wazero.CompiledModule, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if compiled, ok := r.compiled[record.SHA256]; ok {
+		return compiled, nil
+	}
+	// Compiling does not run the module, so it is not bound by a caller's context
+	compiled, err := r.runtime.CompileModule(context.Background(), record.Module)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidModule, err)
+	}
+	if err := checkFilterABI(compiled); err != nil {
+		_ = compiled.Close(context.Background())
+		return nil, fmt.Errorf("%w: %s", ErrInvalidModule, err)
+	}
+	// Closing a compiled module does not affect its running instances
+	if len(r.compiled) >= maxCompiledModules {
+		for digest, old := range r.compiled {
+			_ = old.Close(context.Background())
+			delete(r.compiled, digest)
+			break
+		}
+	}
+	r.compiled[record.SHA256] = compiled
+	return compiled, nil
+}
+
+// checkFilterABI helper function to verify a compiled module implements the filter ABI
+func checkFilterABI(compiled wazero.CompiledModule) error {
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return fmt.Errorf("does not export memory")
+	}
+	signatures := map[string]struct{ params, results []api.ValueType }{
+		"alloc":  {[]api.ValueType{api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}},
+		"filter": {[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}},
+	}
+	exported := compiled.ExportedFunctions()
+	for name, signature := range signatures {
+		function, ok := exported[name]
+		if !ok {
+			return fmt.Errorf("does not export function %s", name)
+		}
+		if !sameValueTypes(function.ParamTypes(), signature.params) ||
+			!sameValueTypes(function.ResultTypes(), signature.results) {
+			return fmt.Errorf("function %s has the wrong signature", name)
+		}
+	}
+	for _, function := range compiled.ImportedFunctions() {
+		moduleName, name, _ := function.Import()
+		if moduleName == wasi_snapshot_preview1.ModuleName {
+			continue
+		}
+		if moduleName != hostModuleName || name != "set_output" {
+			return fmt.Errorf("imports unknown function %s.%s", moduleName, name)
+		}
+	}
+	return nil
+}
+
+// sameValueTypes helper function to compare WASM value type lists
+func sameValueTypes(a, b []api.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// ==============================================================================
+
+// filterOutputKey context key for the output of a filter call
+type filterOutputKey struct{}
+
+// filterOutput the transformed message given by a filter
+type filterOutput struct {
+	set  bool
+	data []byte
+}
+
+// setOutput host function for filters to give the transformed message
+func setOutput(ctxt context.Context, module api.Module, offset, size uint32) {
+	output, ok := ctxt.Value(filterOutputKey{}).(*filterOutput)
+	if !ok {
+		panic(fmt.Errorf("set_output called outside of filter"))
+	}
+	data, ok := module.Memory().Read(offset, size)
+	if !ok {
+		panic(fmt.Errorf("set_output range [%d, %d) outside of memory", offset, offset+size))
+	}
+	// The view of memory is only valid until the module runs again
+	output.data = append([]byte{}, data...)
+	output.set = true
+}
+
+// wasmFilter implements Filter
+//
+// A filter call which traps, or runs past the timeout, leaves the module instance closed or
+// in an unknown state, so the instance is discarded, and a new one is started for the next
+// call.
+type wasmFilter struct {
+	// start starts a new instance of the filter module
+	start   func(ctxt context.Context) (api.Module, error)
+	timeout time.Duration
+	lock    sync.Mutex
+	closed  bool
+	// module is the running instance of the filter module, or nil if it was discarded
+	module api.Module
+	alloc  api.Function
+	filter api.Function
+}
+
+// restart helper function to start a new instance of the filter module. The lock must be
+// held, unless the filter is not yet shared.
+func (f *wasmFilter) restart(ctxt context.Context) error {
+	module, err := f.start(ctxt)
+	if err != nil {
+		return err
+	}
+	f.module = module
+	f.alloc = module.ExportedFunction("alloc")
+	f.filter = module.ExportedFunction("filter")
+	return nil
+}
+
+// discard helper function to stop the instance of the filter module after a failed call.
+// The lock must be held.
+func (f *wasmFilter) discard() {
+	// The instance is already closed if the call timed out
+	_ = f.module.Close(context.Background())
+	f.module = nil
+}
+
+// Apply runs the filter on a message body
+func (f *wasmFilter) Apply(msg []byte, ctxt context.Context) (Action, []byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return ActionForward, nil, fmt.Errorf("filter closed")
+	}
+	if f.module == nil {
+		if err := f.restart(ctxt); err != nil {
+			return ActionForward, nil, fmt.Errorf("filter restart failed: %w", err)
+		}
+	}
+
+	callCtxt := ctxt
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtxt, cancel = context.WithTimeout(ctxt, f.timeout)
+		defer cancel()
+	}
+	output := &filterOutput{}
+	callCtxt = context.WithValue(callCtxt, filterOutputKey{}, output)
+
+	results, err := f.alloc.Call(callCtxt, uint64(len(msg)))
+	if err != nil {
+		f.discard()
+		return ActionForward, nil, fmt.Errorf("filter alloc failed: %w", err)
+	}
+	offset := api.DecodeU32(results[0])
+	if !f.module.Memory().Write(offset, msg) {
+		return ActionForward, nil, fmt.Errorf("filter alloc gave memory outside of range")
+	}
+	results, err = f.filter.Call(callCtxt, uint64(offset), uint64(len(msg)))
+	if err != nil {
+		f.discard()
+		return ActionForward, nil, fmt.Errorf("filter failed: %w", err)
+	}
+	switch action := Action(api.DecodeU32(results[0])); action {
+	case ActionForward:
+		return ActionForward, msg, nil
+	case ActionDrop:
+		return ActionDrop, nil, nil
+	case ActionTransform:
+		if !output.set {
+			return ActionForward, nil, fmt.Errorf("filter transformed without calling set_output")
+		}
+		return ActionTransform, output.data, nil
+	default:
+		return ActionForward, nil, fmt.Errorf("filter returned unknown action %d", action)
+	}
+}
+
+// Close stops the filter instance
+func (f *wasmFilter) Close(ctxt context.Context) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	if f.module == nil {
+		return nil
+	}
+	err := f.module.Close(ctxt)
+	f.module = nil
+	return err
+}
@@ -0,0 +1,183 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filters
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/storage"
+	"github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLargeMemoryModule is UnitTestFilterModule, but with 32 pages (2 MiB) of memory
+var testLargeMemoryModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x11, 0x03, 0x60,
+	0x02, 0x7f, 0x7f, 0x00, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f,
+	0x7f, 0x01, 0x7f, 0x02, 0x15, 0x01, 0x06, 0x68, 0x74, 0x74, 0x70, 0x6d,
+	0x71, 0x0a, 0x73, 0x65, 0x74, 0x5f, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74,
+	0x00, 0x00, 0x03, 0x03, 0x02, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00, 0x20,
+	0x07, 0x1b, 0x03, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00,
+	0x05, 0x61, 0x6c, 0x6c, 0x6f, 0x63, 0x00, 0x01, 0x06, 0x66, 0x69, 0x6c,
+	0x74, 0x65, 0x72, 0x00, 0x02, 0x0a, 0x47, 0x02, 0x05, 0x00, 0x41, 0x80,
+	0x08, 0x0b, 0x3f, 0x01, 0x01, 0x7f, 0x20, 0x00, 0x2d, 0x00, 0x00, 0x21,
+	0x02, 0x20, 0x02, 0x41, 0xe4, 0x00, 0x46, 0x04, 0x40, 0x41, 0x01, 0x0f,
+	0x0b, 0x20, 0x02, 0x41, 0xf4, 0x00, 0x46, 0x04, 0x40, 0x20, 0x00, 0x41,
+	0x01, 0x6a, 0x20, 0x01, 0x41, 0x01, 0x6b, 0x10, 0x00, 0x41, 0x02, 0x0f,
+	0x0b, 0x20, 0x02, 0x41, 0xec, 0x00, 0x46, 0x04, 0x40, 0x03, 0x40, 0x0c,
+	0x00, 0x0b, 0x0b, 0x41, 0x00, 0x0b,
+}
+
+// testMissingExportModule is UnitTestFilterModule, but without exporting "filter"
+var testMissingExportModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x11, 0x03, 0x60,
+	0x02, 0x7f, 0x7f, 0x00, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f,
+	0x7f, 0x01, 0x7f, 0x02, 0x15, 0x01, 0x06, 0x68, 0x74, 0x74, 0x70, 0x6d,
+	0x71, 0x0a, 0x73, 0x65, 0x74, 0x5f, 0x6f, 0x75, 0x74, 0x70, 0x75, 0x74,
+	0x00, 0x00, 0x03, 0x03, 0x02, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x12, 0x02, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00,
+	0x05, 0x61, 0x6c, 0x6c, 0x6f, 0x63, 0x00, 0x01, 0x0a, 0x47, 0x02, 0x05,
+	0x00, 0x41, 0x80, 0x08, 0x0b, 0x3f, 0x01, 0x01, 0x7f, 0x20, 0x00, 0x2d,
+	0x00, 0x00, 0x21, 0x02, 0x20, 0x02, 0x41, 0xe4, 0x00, 0x46, 0x04, 0x40,
+	0x41, 0x01, 0x0f, 0x0b, 0x20, 0x02, 0x41, 0xf4, 0x00, 0x46, 0x04, 0x40,
+	0x20, 0x00, 0x41, 0x01, 0x6a, 0x20, 0x01, 0x41, 0x01, 0x6b, 0x10, 0x00,
+	0x41, 0x02, 0x0f, 0x0b, 0x20, 0x02, 0x41, 0xec, 0x00, 0x46, 0x04, 0x40,
+	0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b, 0x41, 0x00, 0x0b,
+}
+
+func TestWASMFilterRegistry(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-wasm-filter-registry"
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	store, err := storage.GetMemoryKeyValueStore(testName, 0)
+	assert.Nil(err)
+	defer store.Close()
+
+	// Case 0: invalid limits
+	{
+		_, err := GetRegistry(store, Limits{MaxMemoryMB: 8192}, testName, utCtxt)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetRegistry(
+		store, Limits{MaxMemoryMB: 1, Timeout: time.Millisecond * 100}, testName, utCtxt,
+	)
+	assert.Nil(err)
+	defer func() {
+		assert.Nil(uut.Close(utCtxt))
+	}()
+
+	// Case 1: consumer without filter
+	{
+		_, err := uut.GetFilter("stream1", "consumer1", utCtxt)
+		assert.True(errors.Is(err, ErrNoFilter))
+		_, err = uut.LoadFilter("stream1", "consumer1", utCtxt)
+		assert.True(errors.Is(err, ErrNoFilter))
+		assert.True(errors.Is(uut.DeleteFilter("stream1", "consumer1", utCtxt), ErrNoFilter))
+	}
+
+	// Case 2: invalid modules are rejected
+	{
+		for _, module := range [][]byte{
+			[]byte("not a module"),
+			testMissingExportModule,
+			testLargeMemoryModule,
+			make([]byte, MaxModuleSize+1),
+		} {
+			_, err := uut.PutFilter("stream1", "consumer1", module, utCtxt)
+			assert.True(errors.Is(err, ErrInvalidModule))
+		}
+		_, err := uut.GetFilter("stream1", "consumer1", utCtxt)
+		assert.True(errors.Is(err, ErrNoFilter))
+	}
+
+	// Case 3: store a filter
+	{
+		info, err := uut.PutFilter("stream1", "consumer1", UnitTestFilterModule, utCtxt)
+		assert.Nil(err)
+		assert.Equal(len(UnitTestFilterModule), info.Size)
+		assert.Len(info.SHA256, 64)
+		stored, err := uut.GetFilter("stream1", "consumer1", utCtxt)
+		assert.Nil(err)
+		assert.Equal(info.SHA256, stored.SHA256)
+		_, err = uut.GetFilter("stream1", "consumer2", utCtxt)
+		assert.True(errors.Is(err, ErrNoFilter))
+	}
+
+	// Case 4: run the filter
+	{
+		filter, err := uut.LoadFilter("stream1", "consumer1", utCtxt)
+		assert.Nil(err)
+		action, msg, err := filter.Apply([]byte("keep"), utCtxt)
+		assert.Nil(err)
+		assert.Equal(ActionForward, action)
+		assert.Equal("keep", string(msg))
+		action, _, err = filter.Apply([]byte("drop"), utCtxt)
+		assert.Nil(err)
+		assert.Equal(ActionDrop, action)
+		action, msg, err = filter.Apply([]byte("transform"), utCtxt)
+		assert.Nil(err)
+		assert.Equal(ActionTransform, action)
+		assert.Equal("ransform", string(msg))
+		// Message larger than the filter's memory
+		_, _, err = filter.Apply(make([]byte, 1<<17), utCtxt)
+		assert.NotNil(err)
+		assert.Nil(filter.Close(utCtxt))
+	}
+
+	// Case 5: filter which runs too long is stopped, and still runs for later messages
+	{
+		filter, err := uut.LoadFilter("stream1", "consumer1", utCtxt)
+		assert.Nil(err)
+		start := time.Now()
+		_, _, err = filter.Apply([]byte("loop"), utCtxt)
+		assert.NotNil(err)
+		assert.Less(time.Since(start), time.Second)
+		action, msg, err := filter.Apply([]byte("keep"), utCtxt)
+		assert.Nil(err)
+		assert.Equal(ActionForward, action)
+		assert.Equal("keep", string(msg))
+		// Concurrent calls
+		wg := sync.WaitGroup{}
+		for itr := 0; itr < 4; itr++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				action, _, err := filter.Apply([]byte("drop"), utCtxt)
+				assert.Nil(err)
+				assert.Equal(ActionDrop, action)
+			}()
+		}
+		wg.Wait()
+		assert.Nil(filter.Close(utCtxt))
+		_, _, err = filter.Apply([]byte("keep"), utCtxt)
+		assert.NotNil(err)
+	}
+
+	// Case 6: delete the filter
+	{
+		assert.Nil(uut.DeleteFilter("stream1", "consumer1", utCtxt))
+		_, err := uut.LoadFilter("stream1", "consumer1", utCtxt)
+		assert.True(errors.Is(err, ErrNoFilter))
+	}
+}
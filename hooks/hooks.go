@@ -0,0 +1,227 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hooks lets code outside of the dataplane and management components observe and
+// act on message lifecycle events, without modifying those components.
+//
+// Plugins are registered with Register, either from the init() of a package compiled into
+// the binary, or by loading a Go plugin with LoadPlugin. Registered plugins are called in
+// the order they were registered.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrRejected is wrapped by errors of plugins rejecting an operation
+var ErrRejected = errors.New("rejected by plugin")
+
+// PublishEvent is a message about to be published
+type PublishEvent struct {
+	// Subject is the subject the message is published to
+	Subject string
+	// Message is the message body. A plugin may replace it, but must not keep it after
+	// the hook returns, as the body buffer is reused once the publish completes.
+	Message []byte
+}
+
+// DeliverEvent is a message about to be delivered to a client
+type DeliverEvent struct {
+	// Stream is the name of the stream
+	Stream string
+	// Consumer is the name of the consumer delivering the message
+	Consumer string
+	// Message is the message to deliver. A plugin may replace it, but must not modify the
+	// original message, as it is still used to ACK the message.
+	Message *nats.Msg
+}
+
+// AckEvent is the ACK of a delivered message
+type AckEvent struct {
+	// Stream is the name of the stream
+	Stream string
+	// Consumer is the name of the consumer which delivered the message
+	Consumer string
+	// StreamSeq is the message sequence number within the stream
+	StreamSeq uint64
+	// ConsumerSeq is the message sequence number for the consumer
+	ConsumerSeq uint64
+	// Type is the kind of ACK: ack, nak, or term
+	Type string
+	// Domain is the JetStream domain of the stream, if any
+	Domain string
+}
+
+// Plugin is called on message lifecycle events
+type Plugin interface {
+	// OnPublish is called before a message is published. Returning an error stops the
+	// publish; wrap ErrRejected to reject the message on policy grounds.
+	OnPublish(event *PublishEvent, ctxt context.Context) error
+	// OnDeliver is called before a message is delivered to a client
+	OnDeliver(event *DeliverEvent, ctxt context.Context)
+	// OnAck is called after a delivered message is ACKed
+	OnAck(event AckEvent, ctxt context.Context)
+	// OnStreamCreate is called before a stream is created. The plugin may change the
+	// config. Returning an error stops the stream from being created; wrap ErrRejected to
+	// reject the stream on policy grounds.
+	OnStreamCreate(config *nats.StreamConfig, ctxt context.Context) error
+}
+
+// BasePlugin implements Plugin, doing nothing on every event. Embed it to only implement
+// the hooks of interest.
+type BasePlugin struct{}
+
+// OnPublish is called before a message is published
+func (BasePlugin) OnPublish(*PublishEvent, context.Context) error { return nil }
+
+// OnDeliver is called before a message is delivered to a client
+func (BasePlugin) OnDeliver(*DeliverEvent, context.Context) {}
+
+// OnAck is called after a delivered message is ACKed
+func (BasePlugin) OnAck(AckEvent, context.Context) {}
+
+// OnStreamCreate is called before a stream is created
+func (BasePlugin) OnStreamCreate(*nats.StreamConfig, context.Context) error { return nil }
+
+// ==============================================================================
+
+// namedPlugin a registered plugin
+type namedPlugin struct {
+	name   string
+	plugin Plugin
+}
+
+var logTags = log.Fields{"module": "hooks", "component": "registry"}
+
+var registry = struct {
+	lock    sync.RWMutex
+	plugins []namedPlugin
+}{}
+
+// Register registers a plugin under a unique name
+func Register(name string, plugin Plugin) error {
+	if plugin == nil {
+		return fmt.Errorf("plugin %s is nil", name)
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for _, entry := range registry.plugins {
+		if entry.name == name {
+			return fmt.Errorf("plugin %s already registered", name)
+		}
+	}
+	registry.plugins = append(registry.plugins, namedPlugin{name: name, plugin: plugin})
+	log.WithFields(logTags).Infof("Registered plugin %s", name)
+	return nil
+}
+
+// Unregister removes a registered plugin
+func Unregister(name string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	// Callers may still be iterating the current list
+	remaining := make([]namedPlugin, 0, len(registry.plugins))
+	for _, entry := range registry.plugins {
+		if entry.name != name {
+			remaining = append(remaining, entry)
+		}
+	}
+	registry.plugins = remaining
+}
+
+// Registered returns the names of the registered plugins, in the order they are called
+func Registered() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	names := make([]string, len(registry.plugins))
+	for idx, entry := range registry.plugins {
+		names[idx] = entry.name
+	}
+	return names
+}
+
+// current the registered plugins
+func current() []namedPlugin {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return registry.plugins
+}
+
+// call helper function to call a plugin hook, converting a panic into an error
+func call(name, hook string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("plugin %s panicked in %s: %v", name, hook, r)
+			log.WithError(err).WithFields(logTags).Errorf("Plugin failure")
+		}
+	}()
+	if err := fn(); err != nil {
+		return fmt.Errorf("plugin %s: %w", name, err)
+	}
+	return nil
+}
+
+// ==============================================================================
+
+// OnPublish calls the OnPublish hook of the registered plugins, stopping at the first
+// error
+func OnPublish(event *PublishEvent, ctxt context.Context) error {
+	for _, entry := range current() {
+		if err := call(entry.name, "OnPublish", func() error {
+			return entry.plugin.OnPublish(event, ctxt)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnDeliver calls the OnDeliver hook of the registered plugins
+func OnDeliver(event *DeliverEvent, ctxt context.Context) {
+	for _, entry := range current() {
+		_ = call(entry.name, "OnDeliver", func() error {
+			entry.plugin.OnDeliver(event, ctxt)
+			return nil
+		})
+	}
+}
+
+// OnAck calls the OnAck hook of the registered plugins
+func OnAck(event AckEvent, ctxt context.Context) {
+	for _, entry := range current() {
+		_ = call(entry.name, "OnAck", func() error {
+			entry.plugin.OnAck(event, ctxt)
+			return nil
+		})
+	}
+}
+
+// OnStreamCreate calls the OnStreamCreate hook of the registered plugins, stopping at the
+// first error
+func OnStreamCreate(config *nats.StreamConfig, ctxt context.Context) error {
+	for _, entry := range current() {
+		if err := call(entry.name, "OnStreamCreate", func() error {
+			return entry.plugin.OnStreamCreate(config, ctxt)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
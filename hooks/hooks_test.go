@@ -0,0 +1,133 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPlugin records the events it is called with
+type testPlugin struct {
+	BasePlugin
+	name     string
+	calls    *[]string
+	rejectOn string
+	panicOn  string
+}
+
+func (p testPlugin) OnPublish(event *PublishEvent, ctxt context.Context) error {
+	*p.calls = append(*p.calls, p.name)
+	if event.Subject == p.panicOn {
+		panic("bad plugin")
+	}
+	if event.Subject == p.rejectOn {
+		return fmt.Errorf("%w: subject %s not allowed", ErrRejected, event.Subject)
+	}
+	event.Message = append(event.Message, []byte(p.name)...)
+	return nil
+}
+
+func (p testPlugin) OnAck(event AckEvent, ctxt context.Context) {
+	*p.calls = append(*p.calls, fmt.Sprintf("%s:%d", p.name, event.StreamSeq))
+	if event.Stream == p.panicOn {
+		panic("bad plugin")
+	}
+}
+
+func TestPluginRegistry(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	calls := []string{}
+	plugin1 := testPlugin{name: "p1", calls: &calls, rejectOn: "deny", panicOn: "crash"}
+	plugin2 := testPlugin{name: "p2", calls: &calls}
+
+	// Case 0: register plugins
+	assert.NotNil(Register("nil", nil))
+	assert.Nil(Register("p1", plugin1))
+	defer Unregister("p1")
+	assert.Nil(Register("p2", plugin2))
+	defer Unregister("p2")
+	assert.NotNil(Register("p1", plugin2))
+	assert.Equal([]string{"p1", "p2"}, Registered())
+
+	// Case 1: plugins are called in order
+	{
+		calls = []string{}
+		event := PublishEvent{Subject: "allow", Message: []byte("msg-")}
+		assert.Nil(OnPublish(&event, utCtxt))
+		assert.Equal("msg-p1p2", string(event.Message))
+		assert.Equal([]string{"p1", "p2"}, calls)
+	}
+
+	// Case 2: rejection stops later plugins
+	{
+		calls = []string{}
+		event := PublishEvent{Subject: "deny", Message: []byte("msg-")}
+		err := OnPublish(&event, utCtxt)
+		assert.NotNil(err)
+		assert.True(errors.Is(err, ErrRejected))
+		assert.Equal([]string{"p1"}, calls)
+	}
+
+	// Case 3: panic is reported as an error, but not as a rejection
+	{
+		calls = []string{}
+		event := PublishEvent{Subject: "crash", Message: []byte("msg-")}
+		err := OnPublish(&event, utCtxt)
+		assert.NotNil(err)
+		assert.False(errors.Is(err, ErrRejected))
+		assert.Equal([]string{"p1"}, calls)
+	}
+
+	// Case 4: panic does not stop other plugins observing events
+	{
+		calls = []string{}
+		OnAck(AckEvent{Stream: "crash", Consumer: "c1", StreamSeq: 4, ConsumerSeq: 2}, utCtxt)
+		assert.Equal([]string{"p1:4", "p2:4"}, calls)
+	}
+
+	// Case 5: plugins which do not implement a hook
+	{
+		calls = []string{}
+		OnDeliver(&DeliverEvent{Stream: "s1", Consumer: "c1", Message: nats.NewMsg("s1")}, utCtxt)
+		config := nats.StreamConfig{Name: "s1"}
+		assert.Nil(OnStreamCreate(&config, utCtxt))
+		assert.Empty(calls)
+	}
+
+	// Case 6: unregister
+	{
+		Unregister("p1")
+		assert.Equal([]string{"p2"}, Registered())
+		calls = []string{}
+		event := PublishEvent{Subject: "deny", Message: []byte("msg-")}
+		assert.Nil(OnPublish(&event, utCtxt))
+		assert.Equal([]string{"p2"}, calls)
+	}
+
+	// Case 7: load an invalid Go plugin
+	assert.NotNil(LoadPlugin("/does/not/exist.so"))
+}
@@ -0,0 +1,48 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hooks
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// PluginSymbol is the name of the symbol a Go plugin exports its Plugin as
+const PluginSymbol = "Plugin"
+
+// LoadPlugin opens a Go plugin, and registers the Plugin it exports as PluginSymbol.
+// The plugin is registered under its path.
+//
+// The Go plugin must be built with the same Go version, and the same versions of the
+// packages it shares with httpmq.
+func LoadPlugin(path string) error {
+	opened, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	symbol, err := opened.Lookup(PluginSymbol)
+	if err != nil {
+		return err
+	}
+	// Lookup of a variable returns a pointer to it
+	switch exported := symbol.(type) {
+	case *Plugin:
+		return Register(path, *exported)
+	case Plugin:
+		return Register(path, exported)
+	default:
+		return fmt.Errorf("%s of %s is %T, not a hooks.Plugin", PluginSymbol, path, symbol)
+	}
+}
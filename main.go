@@ -17,13 +17,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/alwitt/httpmq/cmd"
+	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/hooks"
 	"github.com/apex/log"
 	apexJSON "github.com/apex/log/handlers/json"
 	"github.com/go-playground/validator/v10"
@@ -36,16 +40,25 @@ type natsArgs struct {
 	ConnectTimeout      time.Duration
 	MaxReconnectAttempt int `validate:"gte=-1"`
 	ReconnectWait       time.Duration
+	PublishMaxPending   int `validate:"gte=0"`
+	JetStreamDomain     string
+	JetStreamAPIPrefix  string `validate:"excluded_with=JetStreamDomain"`
 }
 
 type cliArgs struct {
-	JSONLog  bool
-	LogLevel string   `validate:"required,oneof=debug info warn error"`
-	NATS     natsArgs `validate:"required,dive"`
-	Hostname string
+	JSONLog           bool
+	LogLevel          string        `validate:"required,oneof=debug info warn error"`
+	LogThrottleBurst  int           `validate:"gte=0"`
+	LogThrottlePeriod time.Duration `validate:"gt=0"`
+	NATS              natsArgs      `validate:"required,dive"`
+	Hostname          string
+	Plugins           string
+	JSONCodec         string
 	// For various subcommands
 	Management cmd.ManagementCLIArgs `validate:"-"`
 	Dataplane  cmd.DataplaneCLIArgs  `validate:"-"`
+	Bench      cmd.BenchCLIArgs      `validate:"-"`
+	DecryptLog cmd.DecryptLogCLIArgs `validate:"-"`
 }
 
 var cmdArgs cliArgs
@@ -94,6 +107,48 @@ func main() {
 				Destination: &cmdArgs.LogLevel,
 				Required:    false,
 			},
+			&cli.IntFlag{
+				Name:        "log-throttle-burst",
+				Usage:       "Most per message debug log lines of a kind written per throttle period (0: no limit)",
+				Aliases:     []string{"ltb"},
+				EnvVars:     []string{"LOG_THROTTLE_BURST"},
+				Value:       0,
+				DefaultText: "0",
+				Destination: &cmdArgs.LogThrottleBurst,
+				Required:    false,
+			},
+			&cli.DurationFlag{
+				Name:        "log-throttle-period",
+				Usage:       "Period of the per message debug log throttle, after which suppressed lines are summarized",
+				Aliases:     []string{"ltp"},
+				EnvVars:     []string{"LOG_THROTTLE_PERIOD"},
+				Value:       time.Second * 10,
+				DefaultText: "10s",
+				Destination: &cmdArgs.LogThrottlePeriod,
+				Required:    false,
+			},
+			// PLUGINS
+			&cli.StringFlag{
+				Name:        "plugins",
+				Usage:       "Comma separated list of Go plugin files to load",
+				Aliases:     []string{"pl"},
+				EnvVars:     []string{"HTTPMQ_PLUGINS"},
+				Value:       "",
+				DefaultText: "",
+				Destination: &cmdArgs.Plugins,
+				Required:    false,
+			},
+			// SERIALIZATION
+			&cli.StringFlag{
+				Name:        "json-codec",
+				Usage:       "JSON serialization engine to use. Empty keeps the default of the build.",
+				Aliases:     []string{"jc"},
+				EnvVars:     []string{"HTTPMQ_JSON_CODEC"},
+				Value:       "",
+				DefaultText: "",
+				Destination: &cmdArgs.JSONCodec,
+				Required:    false,
+			},
 			// NATs
 			&cli.StringFlag{
 				Name:        "nats-server-uri",
@@ -135,6 +190,36 @@ func main() {
 				Destination: &cmdArgs.NATS.MaxReconnectAttempt,
 				Required:    false,
 			},
+			&cli.IntFlag{
+				Name:        "nats-publish-max-pending",
+				Usage:       "NATS maximum publishes awaiting JetStream ACK (0: no limit)",
+				Aliases:     []string{"npmp"},
+				EnvVars:     []string{"NATS_PUBLISH_MAX_PENDING"},
+				Value:       0,
+				DefaultText: "0",
+				Destination: &cmdArgs.NATS.PublishMaxPending,
+				Required:    false,
+			},
+			&cli.StringFlag{
+				Name:        "nats-jetstream-domain",
+				Usage:       "JetStream domain to operate in, e.g. of a leafnode connected cluster",
+				Aliases:     []string{"njd"},
+				EnvVars:     []string{"NATS_JETSTREAM_DOMAIN"},
+				Value:       "",
+				DefaultText: "",
+				Destination: &cmdArgs.NATS.JetStreamDomain,
+				Required:    false,
+			},
+			&cli.StringFlag{
+				Name:        "nats-jetstream-api-prefix",
+				Usage:       "Prefix of the JetStream API subjects (can not be used with a domain)",
+				Aliases:     []string{"njap"},
+				EnvVars:     []string{"NATS_JETSTREAM_API_PREFIX"},
+				Value:       "",
+				DefaultText: "",
+				Destination: &cmdArgs.NATS.JetStreamAPIPrefix,
+				Required:    false,
+			},
 		},
 		// Components
 		Commands: []*cli.Command{
@@ -150,6 +235,19 @@ func main() {
 				Flags:  cmd.GetDataplaneCLIFlags(&cmdArgs.Dataplane),
 				Action: startDataplaneServer,
 			},
+			{
+				Name:   "bench",
+				Usage:  "Generate publish and subscribe load against a running dataplane server",
+				Flags:  cmd.GetBenchCLIFlags(&cmdArgs.Bench),
+				Action: runBench,
+			},
+			{
+				Name:      "decrypt-log",
+				Usage:     "Decrypt the encrypted access log files of tenants to stdout",
+				ArgsUsage: "<log file>...",
+				Flags:     cmd.GetDecryptLogCLIFlags(&cmdArgs.DecryptLog),
+				Action:    runDecryptLog,
+			},
 		},
 	}
 
@@ -178,6 +276,22 @@ func setupLogging() {
 	}
 }
 
+// setupLogThrottle helper function to throttle the per message logs, if enabled
+func setupLogThrottle(ctxt context.Context, wg *sync.WaitGroup) error {
+	if cmdArgs.LogThrottleBurst == 0 {
+		return nil
+	}
+	throttle, err := common.GetLogThrottle(common.LogThrottleParam{
+		Burst: cmdArgs.LogThrottleBurst, Period: cmdArgs.LogThrottlePeriod,
+	}, ctxt, wg)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Unable to define log throttle")
+		return err
+	}
+	common.UseLogThrottle(throttle)
+	return nil
+}
+
 // initialCmdArgsProcessing perform initial CMD arg processing
 func initialCmdArgsProcessing() error {
 	validate := validator.New()
@@ -193,16 +307,59 @@ func initialCmdArgsProcessing() error {
 		return err
 	}
 	log.Debugf("Starting params %s", tmp)
+	if err := loadPlugins(); err != nil {
+		return err
+	}
+	return selectJSONCodec()
+}
+
+// selectJSONCodec select the JSON codec given on the command line. Done after loading the
+// plugins, as a plugin may register the codec.
+func selectJSONCodec() error {
+	if cmdArgs.JSONCodec == "" {
+		return nil
+	}
+	if err := common.UseJSONCodec(cmdArgs.JSONCodec); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf(
+			"Unknown JSON codec, registered: %s", strings.Join(common.RegisteredJSONCodecs(), ","),
+		)
+		return err
+	}
+	log.WithFields(logTags).Infof("Using JSON codec %s", cmdArgs.JSONCodec)
+	return nil
+}
+
+// loadPlugins load the Go plugins given on the command line
+func loadPlugins() error {
+	for _, path := range strings.Split(cmdArgs.Plugins, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if err := hooks.LoadPlugin(path); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to load plugin %s", path)
+			return err
+		}
+		log.WithFields(logTags).Infof("Loaded plugin %s", path)
+	}
 	return nil
 }
 
 // prepareJetStreamClient define the NATS client
 func prepareJetStreamClient(ctxtCancel context.CancelFunc) (*core.NatsClient, error) {
-	natsParam := core.NATSConnectParams{
-		ServerURI:           cmdArgs.NATS.ServerURI,
-		ConnectTimeout:      cmdArgs.NATS.ConnectTimeout,
-		MaxReconnectAttempt: cmdArgs.NATS.MaxReconnectAttempt,
-		ReconnectWait:       cmdArgs.NATS.ReconnectWait,
+	return core.GetJetStream(defineNATSParams(ctxtCancel))
+}
+
+// defineNATSParams define the NATS connection parameters
+func defineNATSParams(ctxtCancel context.CancelFunc) core.NATSConnectParams {
+	return core.NATSConnectParams{
+		ServerURI:              cmdArgs.NATS.ServerURI,
+		ConnectTimeout:         cmdArgs.NATS.ConnectTimeout,
+		MaxReconnectAttempt:    cmdArgs.NATS.MaxReconnectAttempt,
+		ReconnectWait:          cmdArgs.NATS.ReconnectWait,
+		PublishAsyncMaxPending: cmdArgs.NATS.PublishMaxPending,
+		JetStreamDomain:        cmdArgs.NATS.JetStreamDomain,
+		JetStreamAPIPrefix:     cmdArgs.NATS.JetStreamAPIPrefix,
 		OnDisconnectCallback: func(_ *nats.Conn, e error) {
 			log.WithError(e).WithFields(logTags).Errorf(
 				"NATS client disconnected from server %s", cmdArgs.NATS.ServerURI,
@@ -218,7 +375,6 @@ func prepareJetStreamClient(ctxtCancel context.CancelFunc) (*core.NatsClient, er
 			ctxtCancel()
 		},
 	}
-	return core.GetJetStream(natsParam)
 }
 
 func defineControlVars() (*sync.WaitGroup, context.Context, context.CancelFunc) {
@@ -226,8 +382,12 @@ func defineControlVars() (*sync.WaitGroup, context.Context, context.CancelFunc)
 	return &sync.WaitGroup{}, runTimeContext, rtCancel
 }
 
-// signalRecvSetup helper function for setting up the SIG receive handler
-func signalRecvSetup(wg *sync.WaitGroup, ctxtCancel context.CancelFunc) {
+// signalRecvSetup helper function for setting up the SIG receive handler. The handler
+// exits once ctxt ends, so a server which stops on its own, e.g. after only running the
+// preflight checks, is not held up.
+func signalRecvSetup(
+	wg *sync.WaitGroup, ctxt context.Context, ctxtCancel context.CancelFunc,
+) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -235,8 +395,12 @@ func signalRecvSetup(wg *sync.WaitGroup, ctxtCancel context.CancelFunc) {
 		// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
 		// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
 		signal.Notify(cc, os.Interrupt)
-		<-cc
-		ctxtCancel()
+		defer signal.Stop(cc)
+		select {
+		case <-cc:
+			ctxtCancel()
+		case <-ctxt.Done():
+		}
 	}()
 }
 
@@ -253,15 +417,19 @@ func startManagementServer(c *cli.Context) error {
 	defer wg.Wait()
 	defer rtCancel()
 
+	if err := setupLogThrottle(runTimeContext, wg); err != nil {
+		return err
+	}
+
 	js, err := prepareJetStreamClient(rtCancel)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf(
 			"Failed to define NATS client with %s", cmdArgs.NATS.ServerURI,
 		)
-		return nil
+		return err
 	}
 
-	signalRecvSetup(wg, rtCancel)
+	signalRecvSetup(wg, runTimeContext, rtCancel)
 
 	return cmd.RunManagementServer(cmdArgs.Management, cmdArgs.Hostname, js, runTimeContext)
 }
@@ -279,17 +447,70 @@ func startDataplaneServer(c *cli.Context) error {
 	defer wg.Wait()
 	defer rtCancel()
 
+	if err := setupLogThrottle(runTimeContext, wg); err != nil {
+		return err
+	}
+
 	js, err := prepareJetStreamClient(rtCancel)
 	if err != nil {
 		log.WithError(err).WithFields(logTags).Errorf(
 			"Failed to define NATS client with %s", cmdArgs.NATS.ServerURI,
 		)
-		return nil
+		return err
 	}
 
-	signalRecvSetup(wg, rtCancel)
+	signalRecvSetup(wg, runTimeContext, rtCancel)
 
 	return cmd.RunDataplaneServer(
-		cmdArgs.Dataplane, cmdArgs.Hostname, js, runTimeContext, wg,
+		cmdArgs.Dataplane, cmdArgs.Hostname, js, defineNATSParams(rtCancel), runTimeContext, wg,
 	)
 }
+
+// ============================================================================
+// Bench subcommand
+
+// runBench run a bench against the dataplane server, and print the report
+func runBench(c *cli.Context) error {
+	if err := initialCmdArgsProcessing(); err != nil {
+		return err
+	}
+
+	wg, runTimeContext, rtCancel := defineControlVars()
+	defer wg.Wait()
+	defer rtCancel()
+
+	// Unlike the servers, the bench ends on its own, so the signal handler must not hold it
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cc := make(chan os.Signal, 1)
+		signal.Notify(cc, os.Interrupt)
+		defer signal.Stop(cc)
+		select {
+		case <-cc:
+			rtCancel()
+		case <-runTimeContext.Done():
+		}
+	}()
+
+	report, err := cmd.RunBench(cmdArgs.Bench, cmdArgs.Hostname, runTimeContext)
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(&report, "", "  ")
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Error("Failed to marshal bench report")
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+// ============================================================================
+// Decrypt log subcommand
+
+// runDecryptLog decrypt the encrypted access log files given as arguments to stdout
+func runDecryptLog(c *cli.Context) error {
+	setupLogging()
+	return cmd.RunDecryptLog(cmdArgs.DecryptLog, c.Args().Slice(), os.Stdout, c.Context)
+}
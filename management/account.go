@@ -0,0 +1,68 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import "github.com/nats-io/nats.go"
+
+// AccountResourceUsage is the usage of one JetStream account resource relative to its limit
+type AccountResourceUsage struct {
+	// Used is the amount of the resource in use
+	Used uint64 `json:"used"`
+	// Limit is the max amount of the resource the account may use (-1: unlimited)
+	Limit int64 `json:"limit"`
+	// Ratio is Used / Limit. Not set if Limit is unlimited.
+	Ratio *float64 `json:"ratio,omitempty"`
+}
+
+// AccountUsage is the JetStream usage of the connected account relative to its limits
+type AccountUsage struct {
+	// Domain is the JetStream domain of the account
+	Domain string `json:"domain,omitempty"`
+	// Memory is the bytes of memory storage in use
+	Memory AccountResourceUsage `json:"memory"`
+	// Storage is the bytes of file storage in use
+	Storage AccountResourceUsage `json:"storage"`
+	// Streams is the number of streams defined
+	Streams AccountResourceUsage `json:"streams"`
+	// Consumers is the number of consumers defined
+	Consumers AccountResourceUsage `json:"consumers"`
+	// APICalls is the number of JetStream API calls made by the account
+	APICalls uint64 `json:"api_calls"`
+	// APIErrors is the number of JetStream API calls made by the account which failed
+	APIErrors uint64 `json:"api_errors"`
+}
+
+// getAccountResourceUsage compute the usage of one account resource
+func getAccountResourceUsage(used uint64, limit int64) AccountResourceUsage {
+	result := AccountResourceUsage{Used: used, Limit: limit}
+	if limit > 0 {
+		ratio := float64(used) / float64(limit)
+		result.Ratio = &ratio
+	}
+	return result
+}
+
+// GetAccountUsage compute the JetStream usage of an account
+func GetAccountUsage(info *nats.AccountInfo) AccountUsage {
+	return AccountUsage{
+		Domain:    info.Domain,
+		Memory:    getAccountResourceUsage(info.Memory, info.Limits.MaxMemory),
+		Storage:   getAccountResourceUsage(info.Store, info.Limits.MaxStore),
+		Streams:   getAccountResourceUsage(uint64(info.Streams), int64(info.Limits.MaxStreams)),
+		Consumers: getAccountResourceUsage(uint64(info.Consumers), int64(info.Limits.MaxConsumers)),
+		APICalls:  info.API.Total,
+		APIErrors: info.API.Errors,
+	}
+}
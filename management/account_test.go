@@ -0,0 +1,62 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: account without limits
+	{
+		info := nats.AccountInfo{
+			Memory: 100, Store: 2000, Streams: 2, Consumers: 5,
+			Limits: nats.AccountLimits{MaxMemory: -1, MaxStore: -1, MaxStreams: -1, MaxConsumers: -1},
+		}
+		usage := GetAccountUsage(&info)
+		assert.Equal(uint64(100), usage.Memory.Used)
+		assert.Equal(int64(-1), usage.Memory.Limit)
+		assert.Nil(usage.Memory.Ratio)
+		assert.Nil(usage.Storage.Ratio)
+		assert.Nil(usage.Streams.Ratio)
+		assert.Nil(usage.Consumers.Ratio)
+	}
+
+	// Case 1: account with limits
+	{
+		info := nats.AccountInfo{
+			Memory: 100, Store: 2000, Streams: 2, Consumers: 5, Domain: "hub",
+			API:    nats.APIStats{Total: 10, Errors: 1},
+			Limits: nats.AccountLimits{MaxMemory: 400, MaxStore: 8000, MaxStreams: 4, MaxConsumers: 10},
+		}
+		usage := GetAccountUsage(&info)
+		assert.Equal("hub", usage.Domain)
+		assert.NotNil(usage.Memory.Ratio)
+		assert.InDelta(0.25, *usage.Memory.Ratio, 1e-9)
+		assert.NotNil(usage.Storage.Ratio)
+		assert.InDelta(0.25, *usage.Storage.Ratio, 1e-9)
+		assert.NotNil(usage.Streams.Ratio)
+		assert.InDelta(0.5, *usage.Streams.Ratio, 1e-9)
+		assert.NotNil(usage.Consumers.Ratio)
+		assert.InDelta(0.5, *usage.Consumers.Ratio, 1e-9)
+		assert.Equal(uint64(10), usage.APICalls)
+		assert.Equal(uint64(1), usage.APIErrors)
+	}
+}
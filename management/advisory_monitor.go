@@ -0,0 +1,156 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"strings"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// alertedAdvisories the event types of the JetStream advisories raised as alerts
+var alertedAdvisories = map[string]bool{
+	EventTypeStreamDeleted:      true,
+	EventTypeConsumerDeleted:    true,
+	EventTypeStreamQuorumLost:   true,
+	EventTypeConsumerQuorumLost: true,
+	EventTypeJetStreamAPIError:  true,
+}
+
+// JetStreamAdvisoryMonitor follows the JetStream advisories, counting them by kind, and
+// raising alerts for the advisories of deleted streams and consumers, lost quorums, and
+// failed API calls
+type JetStreamAdvisoryMonitor interface {
+	// Close stops following the advisories
+	Close() error
+}
+
+// jetStreamAdvisoryMonitorImpl implements JetStreamAdvisoryMonitor
+type jetStreamAdvisoryMonitorImpl struct {
+	common.Component
+	instance     string
+	sink         alerts.AlertSink
+	advisories   *prometheus.CounterVec
+	rootContext  context.Context
+	subscription *nats.Subscription
+}
+
+// GetJetStreamAdvisoryMonitor define a new JetStreamAdvisoryMonitor
+//
+// If sink is not nil, alerts are raised for the advisories of interest. If registerer is not
+// nil, the advisories received are counted as the Prometheus counter
+// "httpmq_jetstream_advisories_total".
+func GetJetStreamAdvisoryMonitor(
+	natsClient *core.NatsClient,
+	sink alerts.AlertSink,
+	registerer prometheus.Registerer,
+	instance string,
+	rootCtxt context.Context,
+) (JetStreamAdvisoryMonitor, error) {
+	monitor, err := newJetStreamAdvisoryMonitor(sink, registerer, instance, rootCtxt)
+	if err != nil {
+		return nil, err
+	}
+	subscription, err := natsClient.NATs().Subscribe(jsAdvisoryPrefix+">", monitor.receive)
+	if err != nil {
+		log.WithError(err).WithFields(monitor.LogTags).Errorf("Unable to subscribe to advisories")
+		return nil, err
+	}
+	monitor.subscription = subscription
+	return monitor, nil
+}
+
+// newJetStreamAdvisoryMonitor helper function to define the monitor, without following the
+// advisories
+func newJetStreamAdvisoryMonitor(
+	sink alerts.AlertSink,
+	registerer prometheus.Registerer,
+	instance string,
+	rootCtxt context.Context,
+) (*jetStreamAdvisoryMonitorImpl, error) {
+	logTags := log.Fields{
+		"module": "management", "component": "advisory-monitor", "instance": instance,
+	}
+	advisories := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpmq",
+		Subsystem: "jetstream",
+		Name:      "advisories_total",
+		Help:      "Number of JetStream advisories received, by kind",
+	}, []string{"kind"})
+	if registerer != nil {
+		if err := registerer.Register(advisories); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to register advisory metrics")
+			return nil, err
+		}
+	}
+	return &jetStreamAdvisoryMonitorImpl{
+		Component:   common.Component{LogTags: logTags},
+		instance:    instance,
+		sink:        sink,
+		advisories:  advisories,
+		rootContext: rootCtxt,
+	}, nil
+}
+
+// advisoryKind helper function to name the kind of an advisory from its subject, without
+// the stream and consumer names, e.g. "consumer.max_deliveries"
+func advisoryKind(subject string) string {
+	tokens := strings.SplitN(strings.TrimPrefix(subject, jsAdvisoryPrefix), ".", 3)
+	if len(tokens) > 2 {
+		tokens = tokens[:2]
+	}
+	return strings.ToLower(strings.Join(tokens, "."))
+}
+
+// receive handle one JetStream advisory
+func (m *jetStreamAdvisoryMonitorImpl) receive(msg *nats.Msg) {
+	m.advisories.WithLabelValues(advisoryKind(msg.Subject)).Inc()
+	if m.sink == nil {
+		return
+	}
+	event, ok := parseAdvisory(msg)
+	if !ok || !alertedAdvisories[event.Type] {
+		return
+	}
+	alert := alerts.Alert{
+		Type:      event.Type,
+		Source:    m.instance,
+		Stream:    event.Stream,
+		Consumer:  event.Consumer,
+		Message:   event.Message,
+		Timestamp: event.Timestamp,
+	}
+	if alert.Message == "" {
+		alert.Message = strings.ReplaceAll(event.Type, "-", " ")
+	}
+	log.WithFields(m.LogTags).Warnf("Raising %s", alert)
+	if err := m.sink.Send(alert, m.rootContext); err != nil {
+		log.WithError(err).WithFields(m.LogTags).Errorf("Failed to send %s", alert)
+	}
+}
+
+// Close stops following the advisories
+func (m *jetStreamAdvisoryMonitorImpl) Close() error {
+	if m.subscription == nil {
+		return nil
+	}
+	return m.subscription.Unsubscribe()
+}
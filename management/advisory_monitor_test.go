@@ -0,0 +1,97 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingAlertSink an AlertSink keeping the alerts sent
+type recordingAlertSink struct {
+	alerts []alerts.Alert
+}
+
+func (s *recordingAlertSink) Send(alert alerts.Alert, _ context.Context) error {
+	s.alerts = append(s.alerts, alert)
+	return nil
+}
+
+func TestJetStreamAdvisoryMonitor(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &recordingAlertSink{}
+	registry := prometheus.NewRegistry()
+	uut, err := newJetStreamAdvisoryMonitor(sink, registry, "ut", context.Background())
+	assert.Nil(err)
+
+	// Case 0: the metrics can not be registered twice
+	{
+		_, err := newJetStreamAdvisoryMonitor(sink, registry, "ut", context.Background())
+		assert.NotNil(err)
+	}
+
+	// Case 1: advisories of interest raise alerts
+	{
+		uut.receive(&nats.Msg{Subject: "$JS.EVENT.ADVISORY.CONSUMER.DELETED.s0.c0"})
+		uut.receive(&nats.Msg{
+			Subject: "$JS.EVENT.ADVISORY.API",
+			Data: []byte(`{"subject":"$JS.API.STREAM.CREATE.s1",` +
+				`"response":"{\"error\":{\"code\":500,\"description\":\"insufficient resources\"}}"}`),
+		})
+		assert.Len(sink.alerts, 2)
+		assert.Equal(EventTypeConsumerDeleted, sink.alerts[0].Type)
+		assert.Equal("s0", sink.alerts[0].Stream)
+		assert.Equal("c0", sink.alerts[0].Consumer)
+		assert.Equal("consumer deleted", sink.alerts[0].Message)
+		assert.Equal("ut", sink.alerts[0].Source)
+		assert.Equal(EventTypeJetStreamAPIError, sink.alerts[1].Type)
+		assert.Equal("s1", sink.alerts[1].Stream)
+		assert.Equal("STREAM.CREATE.s1 failed with 500: insufficient resources", sink.alerts[1].Message)
+	}
+
+	// Case 2: other advisories are only counted
+	{
+		uut.receive(&nats.Msg{Subject: "$JS.EVENT.ADVISORY.CONSUMER.CREATED.s0.c1"})
+		uut.receive(&nats.Msg{Subject: "$JS.EVENT.ADVISORY.STREAM.LEADER_ELECTED.s0"})
+		uut.receive(&nats.Msg{
+			Subject: "$JS.EVENT.ADVISORY.API",
+			Data: []byte(`{"subject":"$JS.API.STREAM.INFO.s2",` +
+				`"response":"{\"error\":{\"code\":404,\"description\":\"stream not found\"}}"}`),
+		})
+		assert.Len(sink.alerts, 2)
+
+		families, err := registry.Gather()
+		assert.Nil(err)
+		counts := map[string]float64{}
+		for _, family := range families {
+			assert.Equal("httpmq_jetstream_advisories_total", family.GetName())
+			for _, metric := range family.GetMetric() {
+				counts[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+		assert.Equal(map[string]float64{
+			"consumer.deleted":      1,
+			"consumer.created":      1,
+			"stream.leader_elected": 1,
+			"api":                   2,
+		}, counts)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// jsConsumerConfig is a JetStream consumer configuration, including the options the
+// JetStream client does not expose
+type jsConsumerConfig struct {
+	nats.ConsumerConfig
+	// BackOff is the delay before each redelivery of a message which was not ACKed. It
+	// replaces the ACK wait.
+	BackOff []time.Duration `json:"backoff,omitempty"`
+}
+
+// jsConsumerCreateRequest is the request of the JetStream consumer create API
+type jsConsumerCreateRequest struct {
+	Stream string           `json:"stream_name"`
+	Config jsConsumerConfig `json:"config"`
+}
+
+// jsConsumerInfoResponse is the response of the JetStream consumer create and info APIs
+type jsConsumerInfoResponse struct {
+	jsAPIResponse
+	Config jsConsumerConfig `json:"config"`
+}
+
+// ValidateConsumerBackoff verify a consumer redelivery backoff schedule against the max
+// number of deliveries of a message. Every message must be delivered at least once more
+// than there are backoff delays, so each delay is used.
+func ValidateConsumerBackoff(backoff []time.Duration, maxDeliver int) error {
+	for idx, delay := range backoff {
+		if delay <= 0 {
+			return fmt.Errorf("backoff delay %d is not positive", idx)
+		}
+	}
+	if len(backoff) > 0 && maxDeliver > 0 && maxDeliver <= len(backoff) {
+		return fmt.Errorf(
+			"max_retry %d must be above the %d backoff delays", maxDeliver, len(backoff),
+		)
+	}
+	return nil
+}
+
+// addConsumer define a consumer. A consumer with a backoff schedule is defined through the
+// JetStream API directly.
+func (js jetStreamControllerImpl) addConsumer(
+	stream string, config jsConsumerConfig, ctxt context.Context,
+) error {
+	if len(config.BackOff) == 0 {
+		_, err := js.core.JetStream().AddConsumer(stream, &config.ConsumerConfig)
+		return err
+	}
+	var resp jsConsumerInfoResponse
+	return js.callJetStreamAPI(
+		fmt.Sprintf("CONSUMER.DURABLE.CREATE.%s.%s", stream, config.Durable),
+		jsConsumerCreateRequest{Stream: stream, Config: config},
+		&resp,
+		ctxt,
+	)
+}
+
+// GetConsumerBackoff queries for the redelivery backoff schedule of one consumer of a stream
+func (js jetStreamControllerImpl) GetConsumerBackoff(
+	stream, consumerName string, ctxt context.Context,
+) ([]time.Duration, error) {
+	var resp jsConsumerInfoResponse
+	if err := js.callJetStreamAPI(
+		fmt.Sprintf("CONSUMER.INFO.%s.%s", stream, consumerName), nil, &resp, ctxt,
+	); err != nil {
+		return nil, err
+	}
+	return resp.Config.BackOff, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	schedule := []time.Duration{time.Second, time.Second * 10, time.Minute}
+
+	// Case 0: no backoff schedule
+	{
+		assert.Nil(ValidateConsumerBackoff(nil, 0))
+		assert.Nil(ValidateConsumerBackoff(nil, 1))
+	}
+
+	// Case 1: valid backoff schedules
+	{
+		assert.Nil(ValidateConsumerBackoff(schedule, 0))
+		assert.Nil(ValidateConsumerBackoff(schedule, 4))
+		assert.Nil(ValidateConsumerBackoff(schedule, 10))
+	}
+
+	// Case 2: not enough deliveries to use every delay
+	{
+		assert.NotNil(ValidateConsumerBackoff(schedule, 3))
+		assert.NotNil(ValidateConsumerBackoff(schedule, 1))
+	}
+
+	// Case 3: delays which are not positive
+	{
+		assert.NotNil(ValidateConsumerBackoff([]time.Duration{time.Second, 0}, 0))
+		assert.NotNil(ValidateConsumerBackoff([]time.Duration{-time.Second}, 0))
+	}
+
+	// Case 4: the schedule is sent along with the client consumer config
+	{
+		config := jsConsumerConfig{
+			ConsumerConfig: nats.ConsumerConfig{Durable: "c0", MaxDeliver: 4},
+			BackOff:        schedule,
+		}
+		encoded, err := json.Marshal(jsConsumerCreateRequest{Stream: "s0", Config: config})
+		assert.Nil(err)
+		var parsed map[string]interface{}
+		assert.Nil(json.Unmarshal(encoded, &parsed))
+		assert.Equal("s0", parsed["stream_name"])
+		sent, ok := parsed["config"].(map[string]interface{})
+		assert.True(ok)
+		assert.Equal("c0", sent["durable_name"])
+		assert.EqualValues(4, sent["max_deliver"])
+		assert.Equal(
+			[]interface{}{float64(time.Second), float64(time.Second * 10), float64(time.Minute)},
+			sent["backoff"],
+		)
+	}
+}
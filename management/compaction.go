@@ -0,0 +1,183 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// JSStreamCompactionParam are the parameters for compacting a stream
+type JSStreamCompactionParam struct {
+	// Keep is the number of latest messages to keep for each subject
+	Keep uint64 `json:"keep" validate:"required,gte=1"`
+	// Subjects limits the compaction to these subjects. All subjects if empty.
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+// StreamCompactionResult is the outcome of compacting a stream
+type StreamCompactionResult struct {
+	// Scanned is the number of messages read from the stream
+	Scanned uint64 `json:"scanned"`
+	// Subjects is the number of subjects with superseded messages
+	Subjects int `json:"subjects"`
+	// Purged is the number of superseded messages removed
+	Purged uint64 `json:"purged"`
+}
+
+// streamCompactionPlan tracks the sequence numbers of the latest messages of each subject,
+// to find where the superseded messages of each subject end
+type streamCompactionPlan struct {
+	keep   uint64
+	only   map[string]bool
+	counts map[string]uint64
+	latest map[string][]uint64
+}
+
+// defineStreamCompactionPlan define a new streamCompactionPlan
+func defineStreamCompactionPlan(param JSStreamCompactionParam) *streamCompactionPlan {
+	plan := &streamCompactionPlan{
+		keep:   param.Keep,
+		counts: map[string]uint64{},
+		latest: map[string][]uint64{},
+	}
+	if len(param.Subjects) > 0 {
+		plan.only = map[string]bool{}
+		for _, subject := range param.Subjects {
+			plan.only[subject] = true
+		}
+	}
+	return plan
+}
+
+// record a message of the stream. Messages must be recorded in sequence order.
+func (p *streamCompactionPlan) record(subject string, seq uint64) {
+	if p.only != nil && !p.only[subject] {
+		return
+	}
+	p.counts[subject]++
+	latest := append(p.latest[subject], seq)
+	if uint64(len(latest)) > p.keep {
+		latest = latest[1:]
+	}
+	p.latest[subject] = latest
+}
+
+// purgeBefore returns, for each subject with superseded messages, the sequence number below
+// which its messages are superseded
+func (p *streamCompactionPlan) purgeBefore() map[string]uint64 {
+	result := map[string]uint64{}
+	for subject, count := range p.counts {
+		if count > p.keep {
+			result[subject] = p.latest[subject][0]
+		}
+	}
+	return result
+}
+
+// jsStreamPurgeRequest is the request of the JetStream stream purge API
+type jsStreamPurgeRequest struct {
+	Sequence uint64 `json:"seq,omitempty"`
+	Subject  string `json:"filter,omitempty"`
+}
+
+// jsStreamPurgeResponse is the response of the JetStream stream purge API
+type jsStreamPurgeResponse struct {
+	jsAPIResponse
+	Purged uint64 `json:"purged"`
+}
+
+// purgeSubjectBefore purge the messages of one subject of a stream below a sequence number
+//
+// The JetStream client does not expose the purge options, so the API is called directly.
+func (js jetStreamControllerImpl) purgeSubjectBefore(
+	stream, subject string, seq uint64, ctxt context.Context,
+) (uint64, error) {
+	var resp jsStreamPurgeResponse
+	if err := js.callJetStreamAPI(
+		fmt.Sprintf("STREAM.PURGE.%s", stream),
+		jsStreamPurgeRequest{Sequence: seq, Subject: subject},
+		&resp,
+		ctxt,
+	); err != nil {
+		return 0, err
+	}
+	return resp.Purged, nil
+}
+
+// CompactStream removes the superseded messages of each subject of a stream, keeping only
+// the latest messages of each subject
+func (js jetStreamControllerImpl) CompactStream(
+	stream string, param JSStreamCompactionParam, ctxt context.Context,
+) (StreamCompactionResult, error) {
+	localLogTags, err := common.UpdateLogTags(js.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(js.LogTags).Errorf("Failed to update logtags")
+	}
+	result := StreamCompactionResult{}
+	if err := js.validate.Struct(&param); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Invalid compaction parameters")
+		return result, err
+	}
+	info, err := js.core.JetStream().StreamInfo(stream, nats.Context(ctxt))
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to get stream %s info", stream)
+		return result, err
+	}
+
+	// Find the sequence number of the latest messages of each subject. Messages published
+	// during the scan are newer, so they are never superseded by this compaction.
+	plan := defineStreamCompactionPlan(param)
+	if info.State.Msgs > 0 {
+		for seq := info.State.FirstSeq; seq <= info.State.LastSeq; seq++ {
+			msg, err := js.core.JetStream().GetMsg(stream, seq, nats.Context(ctxt))
+			if err == nats.ErrMsgNotFound {
+				// Already deleted
+				continue
+			} else if err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf(
+					"Unable to read message %d of stream %s", seq, stream,
+				)
+				return result, err
+			}
+			result.Scanned++
+			plan.record(msg.Subject, seq)
+		}
+	}
+
+	purgeBefore := plan.purgeBefore()
+	result.Subjects = len(purgeBefore)
+	for subject, seq := range purgeBefore {
+		purged, err := js.purgeSubjectBefore(stream, subject, seq, ctxt)
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf(
+				"Unable to purge subject %s of stream %s", subject, stream,
+			)
+			return result, err
+		}
+		result.Purged += purged
+	}
+	log.WithFields(localLogTags).Infof(
+		"Compacted stream %s: purged %d messages across %d subjects",
+		stream,
+		result.Purged,
+		result.Subjects,
+	)
+	return result, nil
+}
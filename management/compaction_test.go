@@ -0,0 +1,59 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamCompactionPlan(t *testing.T) {
+	assert := assert.New(t)
+
+	// Case 0: keep the latest message of every subject
+	{
+		uut := defineStreamCompactionPlan(JSStreamCompactionParam{Keep: 1})
+		uut.record("a", 1)
+		uut.record("b", 2)
+		uut.record("a", 3)
+		uut.record("c", 5)
+		uut.record("a", 6)
+		uut.record("b", 7)
+		assert.Equal(map[string]uint64{"a": 6, "b": 7}, uut.purgeBefore())
+	}
+
+	// Case 1: keep the latest two messages of every subject
+	{
+		uut := defineStreamCompactionPlan(JSStreamCompactionParam{Keep: 2})
+		uut.record("a", 1)
+		uut.record("b", 2)
+		uut.record("a", 3)
+		uut.record("a", 4)
+		uut.record("b", 5)
+		uut.record("a", 8)
+		assert.Equal(map[string]uint64{"a": 4}, uut.purgeBefore())
+	}
+
+	// Case 2: only compact some subjects
+	{
+		uut := defineStreamCompactionPlan(JSStreamCompactionParam{Keep: 1, Subjects: []string{"b"}})
+		uut.record("a", 1)
+		uut.record("b", 2)
+		uut.record("a", 3)
+		uut.record("b", 4)
+		assert.Equal(map[string]uint64{"b": 4}, uut.purgeBefore())
+	}
+}
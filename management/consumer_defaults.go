@@ -0,0 +1,61 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import "time"
+
+// ConsumerDefaults are operator defined settings of new consumers, used where a consumer
+// definition omits them. A zero value means no default.
+type ConsumerDefaults struct {
+	// MaxInflight is the default max number of un-ACKed messages in-flight
+	MaxInflight int `validate:"gte=0"`
+	// MaxRetry is the default max number of times an un-ACKed message is resent (-1: infinite)
+	MaxRetry int `validate:"gte=-1"`
+	// AckWait is the default duration to wait for an ACK before retry
+	AckWait time.Duration `validate:"gte=0"`
+	// ReplayPolicy is the default replay policy
+	ReplayPolicy string `validate:"omitempty,oneof=instant original"`
+	// Mode is the default consumer mode
+	Mode string `validate:"omitempty,oneof=push pull"`
+}
+
+// ApplyDefaults set the settings of a consumer definition which are not set, and have a
+// default, to the default
+//
+// The redeliver settings are left alone if the consumer has a backoff, as the backoff
+// replaces the ACK wait, and implies the max retry.
+func (d ConsumerDefaults) ApplyDefaults(param *JetStreamConsumerParam) {
+	if d.MaxInflight > 0 && param.MaxInflight == 0 {
+		param.MaxInflight = d.MaxInflight
+	}
+	if d.Mode != "" && param.Mode == "" {
+		param.Mode = d.Mode
+	}
+	if d.ReplayPolicy != "" && param.ReplayPolicy == nil {
+		replayPolicy := d.ReplayPolicy
+		param.ReplayPolicy = &replayPolicy
+	}
+	if len(param.Backoff) > 0 {
+		return
+	}
+	if d.MaxRetry != 0 && param.MaxRetry == nil {
+		maxRetry := d.MaxRetry
+		param.MaxRetry = &maxRetry
+	}
+	if d.AckWait > 0 && param.AckWait == nil {
+		ackWait := d.AckWait
+		param.AckWait = &ackWait
+	}
+}
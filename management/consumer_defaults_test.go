@@ -0,0 +1,85 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	uut := ConsumerDefaults{
+		MaxInflight:  16,
+		MaxRetry:     5,
+		AckWait:      time.Second * 30,
+		ReplayPolicy: "instant",
+		Mode:         "push",
+	}
+
+	// Case 0: partial definition takes the defaults
+	{
+		param := JetStreamConsumerParam{Name: "consumer"}
+		uut.ApplyDefaults(&param)
+		assert.Equal(16, param.MaxInflight)
+		assert.Equal("push", param.Mode)
+		assert.NotNil(param.MaxRetry)
+		assert.Equal(5, *param.MaxRetry)
+		assert.NotNil(param.AckWait)
+		assert.Equal(time.Second*30, *param.AckWait)
+		assert.NotNil(param.ReplayPolicy)
+		assert.Equal("instant", *param.ReplayPolicy)
+	}
+
+	// Case 1: specified settings are kept
+	{
+		maxRetry := -1
+		ackWait := time.Second
+		replayPolicy := "original"
+		param := JetStreamConsumerParam{
+			Name:         "consumer",
+			MaxInflight:  1,
+			MaxRetry:     &maxRetry,
+			AckWait:      &ackWait,
+			ReplayPolicy: &replayPolicy,
+			Mode:         "pull",
+		}
+		uut.ApplyDefaults(&param)
+		assert.Equal(1, param.MaxInflight)
+		assert.Equal("pull", param.Mode)
+		assert.Equal(-1, *param.MaxRetry)
+		assert.Equal(time.Second, *param.AckWait)
+		assert.Equal("original", *param.ReplayPolicy)
+	}
+
+	// Case 2: a backoff replaces the redeliver defaults
+	{
+		param := JetStreamConsumerParam{Name: "consumer", Backoff: []time.Duration{time.Second}}
+		uut.ApplyDefaults(&param)
+		assert.Nil(param.MaxRetry)
+		assert.Nil(param.AckWait)
+		assert.Equal(16, param.MaxInflight)
+	}
+
+	// Case 3: no defaults
+	{
+		param := JetStreamConsumerParam{Name: "consumer"}
+		ConsumerDefaults{}.ApplyDefaults(&param)
+		assert.Equal(JetStreamConsumerParam{Name: "consumer"}, param)
+	}
+}
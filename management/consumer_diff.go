@@ -0,0 +1,122 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// SequenceRange is an inclusive range of stream sequence numbers
+type SequenceRange struct {
+	// First is the first sequence number of the range
+	First uint64 `json:"first"`
+	// Last is the last sequence number of the range
+	Last uint64 `json:"last"`
+}
+
+// ConsumerProgress is how far one consumer has processed its stream
+type ConsumerProgress struct {
+	// Name is the consumer name
+	Name string `json:"name"`
+	// FilterSubject is the subject filter of the consumer. All subjects if empty.
+	FilterSubject string `json:"filter_subject,omitempty"`
+	// AckFloor is the stream sequence number up to which every message is ACKed
+	AckFloor uint64 `json:"ack_floor"`
+	// Delivered is the stream sequence number of the last delivered message
+	Delivered uint64 `json:"delivered"`
+	// NumPending is the number of messages not yet delivered
+	NumPending uint64 `json:"num_pending"`
+	// NumAckPending is the number of messages delivered but not yet ACKed
+	NumAckPending int `json:"num_ack_pending"`
+	// NumRedelivered is the number of messages redelivered
+	NumRedelivered int `json:"num_redelivered"`
+	// AckedOnly is the range of messages ACKed by this consumer, but not by the other. Messages
+	// above the ACK floor of the other may have been ACKed individually by the other.
+	AckedOnly *SequenceRange `json:"acked_only,omitempty"`
+	// DeliveredOnly is the range of messages delivered by this consumer, but not by the other
+	DeliveredOnly *SequenceRange `json:"delivered_only,omitempty"`
+}
+
+// ConsumerDiff compares the progress of two consumers of the same stream
+type ConsumerDiff struct {
+	// Consumer is the progress of the consumer compared
+	Consumer ConsumerProgress `json:"consumer"`
+	// Other is the progress of the consumer compared against
+	Other ConsumerProgress `json:"other"`
+	// SameFilter indicates both consumers select the same subjects. If not, the ranges may
+	// include messages only one of them receives.
+	SameFilter bool `json:"same_filter"`
+	// CaughtUp indicates Other has ACKed, and been delivered, every message Consumer has
+	CaughtUp bool `json:"caught_up"`
+}
+
+// progressRange returns the range of messages after other up to and including this, if any
+func progressRange(this, other uint64) *SequenceRange {
+	if this <= other {
+		return nil
+	}
+	return &SequenceRange{First: other + 1, Last: this}
+}
+
+// diffConsumers compares the progress of two consumers of the same stream
+func diffConsumers(consumer, other *nats.ConsumerInfo) ConsumerDiff {
+	progress := func(this, that *nats.ConsumerInfo) ConsumerProgress {
+		return ConsumerProgress{
+			Name:           this.Name,
+			FilterSubject:  this.Config.FilterSubject,
+			AckFloor:       this.AckFloor.Stream,
+			Delivered:      this.Delivered.Stream,
+			NumPending:     this.NumPending,
+			NumAckPending:  this.NumAckPending,
+			NumRedelivered: this.NumRedelivered,
+			AckedOnly:      progressRange(this.AckFloor.Stream, that.AckFloor.Stream),
+			DeliveredOnly:  progressRange(this.Delivered.Stream, that.Delivered.Stream),
+		}
+	}
+	diff := ConsumerDiff{
+		Consumer:   progress(consumer, other),
+		Other:      progress(other, consumer),
+		SameFilter: consumer.Config.FilterSubject == other.Config.FilterSubject,
+	}
+	diff.CaughtUp = diff.Consumer.AckedOnly == nil && diff.Consumer.DeliveredOnly == nil
+	return diff
+}
+
+// DiffConsumers compares the progress of two consumers of a stream, reporting the ranges of
+// messages one has processed but the other has not
+func (js jetStreamControllerImpl) DiffConsumers(
+	stream, consumerName, otherConsumer string, ctxt context.Context,
+) (ConsumerDiff, error) {
+	localLogTags, err := common.UpdateLogTags(js.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(js.LogTags).Errorf("Failed to update logtags")
+	}
+	infos := make([]*nats.ConsumerInfo, 0, 2)
+	for _, name := range []string{consumerName, otherConsumer} {
+		info, err := js.core.JetStream().ConsumerInfo(stream, name, nats.Context(ctxt))
+		if err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf(
+				"Unable to get consumer %s of stream %s info", name, stream,
+			)
+			return ConsumerDiff{}, err
+		}
+		infos = append(infos, info)
+	}
+	return diffConsumers(infos[0], infos[1]), nil
+}
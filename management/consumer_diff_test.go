@@ -0,0 +1,79 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffConsumers(t *testing.T) {
+	assert := assert.New(t)
+
+	consumerInfo := func(name, filter string, ackFloor, delivered uint64) *nats.ConsumerInfo {
+		return &nats.ConsumerInfo{
+			Name:      name,
+			Config:    nats.ConsumerConfig{FilterSubject: filter},
+			AckFloor:  nats.SequenceInfo{Stream: ackFloor},
+			Delivered: nats.SequenceInfo{Stream: delivered},
+		}
+	}
+
+	// Case 0: consumers at the same position
+	{
+		diff := diffConsumers(consumerInfo("a", "", 10, 12), consumerInfo("b", "", 10, 12))
+		assert.True(diff.CaughtUp)
+		assert.True(diff.SameFilter)
+		assert.Nil(diff.Consumer.AckedOnly)
+		assert.Nil(diff.Consumer.DeliveredOnly)
+		assert.Nil(diff.Other.AckedOnly)
+		assert.Nil(diff.Other.DeliveredOnly)
+	}
+
+	// Case 1: the other consumer is behind
+	{
+		diff := diffConsumers(consumerInfo("a", "", 10, 12), consumerInfo("b", "", 4, 6))
+		assert.False(diff.CaughtUp)
+		assert.Equal("a", diff.Consumer.Name)
+		assert.Equal(uint64(10), diff.Consumer.AckFloor)
+		assert.Equal(uint64(12), diff.Consumer.Delivered)
+		assert.Equal(&SequenceRange{First: 5, Last: 10}, diff.Consumer.AckedOnly)
+		assert.Equal(&SequenceRange{First: 7, Last: 12}, diff.Consumer.DeliveredOnly)
+		assert.Nil(diff.Other.AckedOnly)
+		assert.Nil(diff.Other.DeliveredOnly)
+	}
+
+	// Case 2: the other consumer is ahead, with a different filter
+	{
+		diff := diffConsumers(consumerInfo("a", "orders.*", 3, 3), consumerInfo("b", "", 8, 9))
+		assert.True(diff.CaughtUp)
+		assert.False(diff.SameFilter)
+		assert.Nil(diff.Consumer.AckedOnly)
+		assert.Equal(&SequenceRange{First: 4, Last: 8}, diff.Other.AckedOnly)
+		assert.Equal(&SequenceRange{First: 4, Last: 9}, diff.Other.DeliveredOnly)
+	}
+
+	// Case 3: the other consumer has ACKed more, but been delivered less
+	{
+		diff := diffConsumers(consumerInfo("a", "", 2, 9), consumerInfo("b", "", 5, 5))
+		assert.False(diff.CaughtUp)
+		assert.Nil(diff.Consumer.AckedOnly)
+		assert.Equal(&SequenceRange{First: 6, Last: 9}, diff.Consumer.DeliveredOnly)
+		assert.Equal(&SequenceRange{First: 3, Last: 5}, diff.Other.AckedOnly)
+		assert.Nil(diff.Other.DeliveredOnly)
+	}
+}
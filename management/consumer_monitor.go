@@ -0,0 +1,212 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// AlertTypeConsumerLagging alert type for a consumer with too many undelivered messages
+	AlertTypeConsumerLagging = "consumer-lagging"
+	// AlertTypeConsumerAckStalled alert type for a consumer not ACKing its pending messages
+	AlertTypeConsumerAckStalled = "consumer-ack-stalled"
+)
+
+// ConsumerMonitorParam are the thresholds for alerting on consumer inactivity
+type ConsumerMonitorParam struct {
+	// MaxLag is the number of undelivered messages a consumer may have before it is
+	// considered lagging. "0" disables the check.
+	MaxLag uint64
+	// MaxAckSilence is the duration a consumer with pending ACKs may go without ACKing
+	// any message before it is considered stalled. "0" disables the check.
+	MaxAckSilence time.Duration
+}
+
+// ConsumerActivityMonitor periodically inspects the state of all consumers, and alerts
+// when a consumer is lagging or has stopped ACKing messages
+type ConsumerActivityMonitor interface {
+	// Start begins periodically checking the consumers
+	Start(interval time.Duration) error
+	// Stop stops checking the consumers
+	Stop() error
+}
+
+// consumerActivityState the tracked activity state of one consumer
+type consumerActivityState struct {
+	lagging      bool
+	stalled      bool
+	lastAckFloor uint64
+	lastProgress time.Time
+	seenInRound  bool
+}
+
+// consumerActivityMonitorImpl implements ConsumerActivityMonitor
+type consumerActivityMonitorImpl struct {
+	common.Component
+	instance     string
+	controller   JetStreamController
+	sink         alerts.AlertSink
+	param        ConsumerMonitorParam
+	timer        common.IntervalTimer
+	queryTimeout time.Duration
+	rootContext  context.Context
+	consumers    map[string]*consumerActivityState
+}
+
+// GetConsumerActivityMonitor define a new ConsumerActivityMonitor
+func GetConsumerActivityMonitor(
+	controller JetStreamController,
+	sink alerts.AlertSink,
+	param ConsumerMonitorParam,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (ConsumerActivityMonitor, error) {
+	logTags := log.Fields{
+		"module":    "management",
+		"component": "consumer-monitor",
+		"instance":  instance,
+	}
+	timer, err := common.GetIntervalTimerInstance(
+		fmt.Sprintf("%s.consumer-monitor", instance), rootCtxt, wg,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		return nil, err
+	}
+	return &consumerActivityMonitorImpl{
+		Component:    common.Component{LogTags: logTags},
+		instance:     instance,
+		controller:   controller,
+		sink:         sink,
+		param:        param,
+		timer:        timer,
+		queryTimeout: time.Second * 5,
+		rootContext:  rootCtxt,
+		consumers:    make(map[string]*consumerActivityState),
+	}, nil
+}
+
+// Start begins periodically checking the consumers
+func (m *consumerActivityMonitorImpl) Start(interval time.Duration) error {
+	return m.timer.Start(interval, m.checkConsumers, false)
+}
+
+// Stop stops checking the consumers
+func (m *consumerActivityMonitorImpl) Stop() error {
+	return m.timer.Stop()
+}
+
+// checkConsumers support IntervalTimer, query all consumers and raise alerts as needed
+func (m *consumerActivityMonitorImpl) checkConsumers() error {
+	ctxt, cancel := context.WithTimeout(m.rootContext, m.queryTimeout)
+	defer cancel()
+	for _, state := range m.consumers {
+		state.seenInRound = false
+	}
+	now := time.Now()
+	for streamName := range m.controller.GetAllStreams(ctxt) {
+		for _, info := range m.controller.GetAllConsumersForStream(streamName, ctxt) {
+			for _, alert := range m.evaluateConsumer(info, now) {
+				log.WithFields(m.LogTags).Warnf("Raising %s", alert)
+				if err := m.sink.Send(alert, ctxt); err != nil {
+					log.WithError(err).WithFields(m.LogTags).Errorf("Failed to send %s", alert)
+				}
+			}
+		}
+	}
+	// Forget consumers which no longer exist
+	for key, state := range m.consumers {
+		if !state.seenInRound {
+			delete(m.consumers, key)
+		}
+	}
+	return nil
+}
+
+// evaluateConsumer update the activity state of a consumer, and return the alerts to raise
+// due to consumer entering / leaving lagging or stalled conditions.
+func (m *consumerActivityMonitorImpl) evaluateConsumer(
+	info *nats.ConsumerInfo, now time.Time,
+) []alerts.Alert {
+	key := fmt.Sprintf("%s/%s", info.Stream, info.Name)
+	state, ok := m.consumers[key]
+	if !ok {
+		state = &consumerActivityState{lastAckFloor: info.AckFloor.Consumer, lastProgress: now}
+		m.consumers[key] = state
+	}
+	state.seenInRound = true
+
+	// ACK progress is made when the ACK floor moves, or nothing is pending
+	if info.AckFloor.Consumer != state.lastAckFloor || info.NumAckPending == 0 {
+		state.lastAckFloor = info.AckFloor.Consumer
+		state.lastProgress = now
+	}
+
+	newAlert := func(alertType string, resolved bool, msg string) alerts.Alert {
+		return alerts.Alert{
+			Type:      alertType,
+			Resolved:  resolved,
+			Source:    m.instance,
+			Stream:    info.Stream,
+			Consumer:  info.Name,
+			Message:   msg,
+			Timestamp: now,
+		}
+	}
+
+	result := []alerts.Alert{}
+	if m.param.MaxLag > 0 {
+		lagging := info.NumPending > m.param.MaxLag
+		if lagging != state.lagging {
+			var msg string
+			if lagging {
+				msg = fmt.Sprintf(
+					"%d undelivered messages exceeds threshold %d", info.NumPending, m.param.MaxLag,
+				)
+			} else {
+				msg = fmt.Sprintf("%d undelivered messages within threshold", info.NumPending)
+			}
+			result = append(result, newAlert(AlertTypeConsumerLagging, !lagging, msg))
+			state.lagging = lagging
+		}
+	}
+	if m.param.MaxAckSilence > 0 {
+		silence := now.Sub(state.lastProgress)
+		stalled := silence > m.param.MaxAckSilence
+		if stalled != state.stalled {
+			var msg string
+			if stalled {
+				msg = fmt.Sprintf(
+					"no ACK in %s with %d messages pending ACK", silence, info.NumAckPending,
+				)
+			} else {
+				msg = "ACK progress resumed"
+			}
+			result = append(result, newAlert(AlertTypeConsumerAckStalled, !stalled, msg))
+			state.stalled = stalled
+		}
+	}
+	return result
+}
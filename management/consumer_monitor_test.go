@@ -0,0 +1,96 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerActivityEvaluation(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	uut, err := GetConsumerActivityMonitor(
+		nil, nil, ConsumerMonitorParam{MaxLag: 10, MaxAckSilence: time.Minute},
+		"ut-consumer-monitor", utCtxt, &wg,
+	)
+	assert.Nil(err)
+	uutc := uut.(*consumerActivityMonitorImpl)
+
+	start := time.Now()
+	info := nats.ConsumerInfo{Stream: "stream", Name: "consumer"}
+
+	// Case 0: idle consumer
+	{
+		assert.Len(uutc.evaluateConsumer(&info, start), 0)
+	}
+
+	// Case 1: consumer lagging
+	{
+		info.NumPending = 11
+		result := uutc.evaluateConsumer(&info, start.Add(time.Second))
+		assert.Len(result, 1)
+		assert.Equal(AlertTypeConsumerLagging, result[0].Type)
+		assert.False(result[0].Resolved)
+		assert.Equal("stream", result[0].Stream)
+		assert.Equal("consumer", result[0].Consumer)
+		// No repeated alert while still lagging
+		assert.Len(uutc.evaluateConsumer(&info, start.Add(time.Second*2)), 0)
+	}
+
+	// Case 2: consumer caught up
+	{
+		info.NumPending = 2
+		result := uutc.evaluateConsumer(&info, start.Add(time.Second*3))
+		assert.Len(result, 1)
+		assert.Equal(AlertTypeConsumerLagging, result[0].Type)
+		assert.True(result[0].Resolved)
+	}
+
+	// Case 3: messages pending ACK, but within the silence limit
+	{
+		info.NumAckPending = 2
+		assert.Len(uutc.evaluateConsumer(&info, start.Add(time.Second*30)), 0)
+	}
+
+	// Case 4: messages pending ACK past the silence limit
+	{
+		result := uutc.evaluateConsumer(&info, start.Add(time.Second*4+time.Minute))
+		assert.Len(result, 1)
+		assert.Equal(AlertTypeConsumerAckStalled, result[0].Type)
+		assert.False(result[0].Resolved)
+	}
+
+	// Case 5: ACK floor moves
+	{
+		info.AckFloor.Consumer = 1
+		result := uutc.evaluateConsumer(&info, start.Add(time.Second*5+time.Minute))
+		assert.Len(result, 1)
+		assert.Equal(AlertTypeConsumerAckStalled, result[0].Type)
+		assert.True(result[0].Resolved)
+	}
+}
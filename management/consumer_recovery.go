@@ -0,0 +1,326 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// OrphanedConsumerUnbound a push consumer no session is bound to. A client can still
+	// subscribe through a durable one; an ephemeral one is deleted once it stays unbound
+	// for the grace period.
+	OrphanedConsumerUnbound = "unbound"
+	// OrphanedConsumerDeleted an ephemeral consumer no session is bound to, which was deleted
+	OrphanedConsumerDeleted = "deleted"
+	// OrphanedConsumerDeleteFailed an ephemeral consumer no session is bound to, which could
+	// not be deleted
+	OrphanedConsumerDeleteFailed = "delete-failed"
+)
+
+// OrphanedConsumer is a push consumer httpmq created, which no session was bound to on
+// recovery
+type OrphanedConsumer struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Durable is whether the consumer is durable
+	Durable bool `json:"durable"`
+	// State is what recovery did with the consumer: unbound, deleted, or delete-failed
+	State string `json:"state"`
+	// Found is when recovery first found the consumer without a session
+	Found time.Time `json:"found"`
+	// Reporter is the replica which found the consumer, if another replica found it
+	Reporter string `json:"reporter,omitempty"`
+	// Error is why the consumer could not be deleted, if it could not
+	Error string `json:"error,omitempty"`
+}
+
+// ConsumerSessionRegistry is the part of the cluster session registry of the dataplane
+// replicas ConsumerRecovery uses
+type ConsumerSessionRegistry interface {
+	// ConsumerReplicas returns the replicas running sessions of a consumer
+	ConsumerReplicas(stream, consumer string) []string
+	// ReportUnbound replaces the durable consumers this replica found without a session
+	ReportUnbound(consumers []common.UnboundConsumer)
+	// UnboundConsumers returns the durable consumers any replica found without a session,
+	// except the ones with sessions running on a replica since
+	UnboundConsumers() []common.UnboundConsumer
+}
+
+// ConsumerRecovery recovers the consumers httpmq created which were left without a
+// session, e.g. by a dataplane replica which crashed. The consumers are recognized by the
+// httpmq mark in their description.
+//
+// A consumer is bound if NATS reports a subscription on its deliver subject, or, with a
+// cluster session registry, if a dataplane replica reports a session of it, e.g. while the
+// replica reconnects to NATS. An ephemeral consumer is only deleted once it stayed unbound
+// for the grace period. The durable consumers without a session are reported to the
+// cluster session registry, to share them with the other replicas.
+type ConsumerRecovery interface {
+	// Reconcile lists the push consumers httpmq created, records the ones no session is
+	// bound to, and deletes the ephemeral ones which stayed unbound for the grace period.
+	// Returns the orphaned consumers found.
+	Reconcile(ctxt context.Context) ([]OrphanedConsumer, error)
+	// Orphans lists the orphaned consumers found, including the durable consumers other
+	// replicas found. Consumers which a session bound to since, or which were deleted
+	// since, are dropped.
+	Orphans(ctxt context.Context) []OrphanedConsumer
+	// Start begins periodically reconciling the consumers
+	Start(interval time.Duration) error
+	// Stop stops reconciling the consumers
+	Stop() error
+}
+
+// consumerRecoveryImpl implements ConsumerRecovery
+type consumerRecoveryImpl struct {
+	common.Component
+	controller   JetStreamController
+	sessions     ConsumerSessionRegistry
+	grace        time.Duration
+	timer        common.IntervalTimer
+	queryTimeout time.Duration
+	rootContext  context.Context
+	lock         sync.Mutex
+	orphans      map[string]OrphanedConsumer
+}
+
+// GetConsumerRecovery define a new ConsumerRecovery
+//
+// If sessions is nil, only NATS decides whether a consumer is bound, and the orphaned
+// consumers are only known to this replica.
+func GetConsumerRecovery(
+	controller JetStreamController,
+	sessions ConsumerSessionRegistry,
+	grace time.Duration,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (ConsumerRecovery, error) {
+	logTags := log.Fields{
+		"module":    "management",
+		"component": "consumer-recovery",
+		"instance":  instance,
+	}
+	if grace <= 0 {
+		return nil, fmt.Errorf("consumer recovery grace period must be positive")
+	}
+	timer, err := common.GetIntervalTimerInstance(
+		fmt.Sprintf("%s.consumer-recovery", instance), rootCtxt, wg,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		return nil, err
+	}
+	return &consumerRecoveryImpl{
+		Component:    common.Component{LogTags: logTags},
+		controller:   controller,
+		sessions:     sessions,
+		grace:        grace,
+		timer:        timer,
+		queryTimeout: time.Second * 30,
+		rootContext:  rootCtxt,
+		orphans:      make(map[string]OrphanedConsumer),
+	}, nil
+}
+
+// Start begins periodically reconciling the consumers
+func (r *consumerRecoveryImpl) Start(interval time.Duration) error {
+	return r.timer.Start(interval, r.reconcileRound, false)
+}
+
+// Stop stops reconciling the consumers
+func (r *consumerRecoveryImpl) Stop() error {
+	return r.timer.Stop()
+}
+
+// reconcileRound support IntervalTimer, reconcile the consumers
+func (r *consumerRecoveryImpl) reconcileRound() error {
+	ctxt, cancel := context.WithTimeout(r.rootContext, r.queryTimeout)
+	defer cancel()
+	_, err := r.Reconcile(ctxt)
+	return err
+}
+
+// bound whether a session is bound to a consumer
+func (r *consumerRecoveryImpl) bound(stream, consumer string, info *nats.ConsumerInfo) bool {
+	if info.PushBound {
+		return true
+	}
+	return r.sessions != nil && len(r.sessions.ConsumerReplicas(stream, consumer)) > 0
+}
+
+// Reconcile recovers the consumers httpmq created which have no session bound
+func (r *consumerRecoveryImpl) Reconcile(ctxt context.Context) ([]OrphanedConsumer, error) {
+	return r.reconcile(ctxt, time.Now())
+}
+
+// reconcile recovers the consumers httpmq created which have no session bound at now
+func (r *consumerRecoveryImpl) reconcile(
+	ctxt context.Context, now time.Time,
+) ([]OrphanedConsumer, error) {
+	localLogTags, err := common.UpdateLogTags(r.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(r.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	streams := []string{}
+	for stream := range r.controller.GetAllStreams(ctxt) {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	r.lock.Lock()
+	previous := make(map[string]OrphanedConsumer, len(r.orphans))
+	for key, orphan := range r.orphans {
+		previous[key] = orphan
+	}
+	r.lock.Unlock()
+
+	found := []OrphanedConsumer{}
+	for _, stream := range streams {
+		consumers := r.controller.GetAllConsumersForStream(stream, ctxt)
+		names := make([]string, 0, len(consumers))
+		for name := range consumers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			info := consumers[name]
+			if !common.IsGatewayConsumer(info.Config.Description) ||
+				info.Config.DeliverSubject == "" || r.bound(stream, name, info) {
+				continue
+			}
+			orphan, ok := previous[stream+"/"+name]
+			if !ok || orphan.State == OrphanedConsumerDeleted {
+				orphan = OrphanedConsumer{
+					Stream:   stream,
+					Consumer: name,
+					Durable:  info.Config.Durable != "",
+					State:    OrphanedConsumerUnbound,
+					Found:    now,
+				}
+				if orphan.Durable {
+					log.WithFields(localLogTags).Warnf(
+						"Durable consumer %s of stream %s has no session bound", name, stream,
+					)
+				}
+			}
+			// A dataplane replica may still bind to its ephemeral consumer, e.g. once it
+			// reconnects to NATS, so it is only deleted after the grace period
+			if !orphan.Durable && now.Sub(orphan.Found) >= r.grace {
+				if err := r.controller.DeleteConsumerOnStream(stream, name, ctxt); err != nil {
+					log.WithError(err).WithFields(localLogTags).Errorf(
+						"Unable to delete orphaned ephemeral consumer %s of stream %s", name, stream,
+					)
+					orphan.State = OrphanedConsumerDeleteFailed
+					orphan.Error = err.Error()
+				} else {
+					log.WithFields(localLogTags).Infof(
+						"Deleted orphaned ephemeral consumer %s of stream %s", name, stream,
+					)
+					orphan.State = OrphanedConsumerDeleted
+					orphan.Error = ""
+				}
+			}
+			found = append(found, orphan)
+		}
+	}
+
+	// Consumers found before which are now bound, or gone, are dropped, except the ones
+	// recovery deleted
+	current := make(map[string]OrphanedConsumer, len(found))
+	for key, orphan := range previous {
+		if orphan.State == OrphanedConsumerDeleted {
+			current[key] = orphan
+		}
+	}
+	unbound := []common.UnboundConsumer{}
+	for _, orphan := range found {
+		current[orphan.Stream+"/"+orphan.Consumer] = orphan
+		if orphan.Durable {
+			unbound = append(unbound, common.UnboundConsumer{
+				Stream: orphan.Stream, Consumer: orphan.Consumer, Since: orphan.Found,
+			})
+		}
+	}
+	r.lock.Lock()
+	r.orphans = current
+	r.lock.Unlock()
+	if r.sessions != nil {
+		r.sessions.ReportUnbound(unbound)
+	}
+	return found, nil
+}
+
+// Orphans lists the orphaned consumers found
+func (r *consumerRecoveryImpl) Orphans(ctxt context.Context) []OrphanedConsumer {
+	r.lock.Lock()
+	known := make(map[string]OrphanedConsumer, len(r.orphans))
+	for key, orphan := range r.orphans {
+		known[key] = orphan
+	}
+	r.lock.Unlock()
+
+	// Include the durable consumers other replicas found
+	if r.sessions != nil {
+		for _, consumer := range r.sessions.UnboundConsumers() {
+			key := consumer.Stream + "/" + consumer.Consumer
+			if _, ok := known[key]; ok {
+				continue
+			}
+			known[key] = OrphanedConsumer{
+				Stream:   consumer.Stream,
+				Consumer: consumer.Consumer,
+				Durable:  true,
+				State:    OrphanedConsumerUnbound,
+				Found:    consumer.Since,
+				Reporter: consumer.Reporter,
+			}
+		}
+	}
+
+	result := []OrphanedConsumer{}
+	for key, orphan := range known {
+		if orphan.State == OrphanedConsumerUnbound {
+			info, err := r.controller.GetConsumerForStream(orphan.Stream, orphan.Consumer, ctxt)
+			if errors.Is(err, nats.ErrConsumerNotFound) ||
+				(err == nil && r.bound(orphan.Stream, orphan.Consumer, info)) {
+				r.lock.Lock()
+				delete(r.orphans, key)
+				r.lock.Unlock()
+				continue
+			}
+		}
+		result = append(result, orphan)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Stream != result[j].Stream {
+			return result[i].Stream < result[j].Stream
+		}
+		return result[i].Consumer < result[j].Consumer
+	})
+	return result
+}
@@ -0,0 +1,215 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubRecoveryController implements the parts of JetStreamController ConsumerRecovery uses
+type stubRecoveryController struct {
+	JetStreamController
+	consumers map[string]map[string]*nats.ConsumerInfo
+	deleteErr error
+	deleted   []string
+}
+
+func (c *stubRecoveryController) GetAllStreams(ctxt context.Context) map[string]*nats.StreamInfo {
+	streams := map[string]*nats.StreamInfo{}
+	for stream := range c.consumers {
+		streams[stream] = &nats.StreamInfo{Config: nats.StreamConfig{Name: stream}}
+	}
+	return streams
+}
+
+func (c *stubRecoveryController) GetAllConsumersForStream(
+	stream string, ctxt context.Context,
+) map[string]*nats.ConsumerInfo {
+	return c.consumers[stream]
+}
+
+func (c *stubRecoveryController) GetConsumerForStream(
+	stream, consumerName string, ctxt context.Context,
+) (*nats.ConsumerInfo, error) {
+	if info, ok := c.consumers[stream][consumerName]; ok {
+		return info, nil
+	}
+	return nil, nats.ErrConsumerNotFound
+}
+
+func (c *stubRecoveryController) DeleteConsumerOnStream(
+	stream, consumerName string, ctxt context.Context,
+) error {
+	if c.deleteErr != nil {
+		return c.deleteErr
+	}
+	c.deleted = append(c.deleted, stream+"/"+consumerName)
+	delete(c.consumers[stream], consumerName)
+	return nil
+}
+
+// stubRecoverySessions implements ConsumerSessionRegistry
+type stubRecoverySessions struct {
+	running  map[string][]string
+	reported []common.UnboundConsumer
+	remote   []common.UnboundConsumer
+}
+
+func (s *stubRecoverySessions) ConsumerReplicas(stream, consumer string) []string {
+	return s.running[stream+"/"+consumer]
+}
+
+func (s *stubRecoverySessions) ReportUnbound(consumers []common.UnboundConsumer) {
+	s.reported = consumers
+}
+
+func (s *stubRecoverySessions) UnboundConsumers() []common.UnboundConsumer {
+	return append(append([]common.UnboundConsumer{}, s.reported...), s.remote...)
+}
+
+func TestConsumerRecovery(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := func(durable, description, deliverSubject string, bound bool) *nats.ConsumerInfo {
+		return &nats.ConsumerInfo{
+			Config: nats.ConsumerConfig{
+				Durable: durable, Description: description, DeliverSubject: deliverSubject,
+			},
+			PushBound: bound,
+		}
+	}
+	tagged := common.TagGatewayConsumer("")
+	controller := &stubRecoveryController{
+		consumers: map[string]map[string]*nats.ConsumerInfo{
+			"s1": {
+				"durable-idle":  consumer("durable-idle", tagged, "inbox.1", false),
+				"durable-bound": consumer("durable-bound", tagged, "inbox.2", true),
+				"durable-pull":  consumer("durable-pull", tagged, "", false),
+				"foreign":       consumer("foreign", "other client", "inbox.3", false),
+				"eph-left":      consumer("", tagged, "inbox.4", false),
+				"eph-bound":     consumer("", tagged, "inbox.5", true),
+				"eph-gossip":    consumer("", tagged, "inbox.8", false),
+			},
+			"s2": {
+				"durable-idle": consumer("durable-idle", tagged, "inbox.6", false),
+			},
+		},
+	}
+	sessions := &stubRecoverySessions{running: map[string][]string{"s1/eph-gossip": {"dp-1"}}}
+	wg := sync.WaitGroup{}
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer wg.Wait()
+	defer cancel()
+
+	// Case 0: invalid grace period
+	{
+		_, err := GetConsumerRecovery(controller, nil, 0, "ut-consumer-recovery", ctxt, &wg)
+		assert.NotNil(err)
+	}
+
+	grace := time.Minute
+	uut, err := GetConsumerRecovery(
+		controller, sessions, grace, "ut-consumer-recovery", ctxt, &wg,
+	)
+	assert.Nil(err)
+	recovery := uut.(*consumerRecoveryImpl)
+	start := time.Now()
+
+	// Case 1: consumers left without a session are recorded, but not deleted yet
+	{
+		found, err := recovery.reconcile(ctxt, start)
+		assert.Nil(err)
+		assert.Len(found, 3)
+		assert.Equal("s1", found[0].Stream)
+		assert.Equal("durable-idle", found[0].Consumer)
+		assert.True(found[0].Durable)
+		assert.Equal(OrphanedConsumerUnbound, found[0].State)
+		assert.Equal("eph-left", found[1].Consumer)
+		assert.False(found[1].Durable)
+		assert.Equal(OrphanedConsumerUnbound, found[1].State)
+		assert.Equal("s2", found[2].Stream)
+		assert.Empty(controller.deleted)
+		assert.Len(sessions.reported, 2)
+		assert.Equal("durable-idle", sessions.reported[0].Consumer)
+		assert.Equal(start, sessions.reported[0].Since)
+	}
+
+	// Case 2: ephemeral consumers still unbound after the grace period are deleted
+	{
+		found, err := recovery.reconcile(ctxt, start.Add(grace))
+		assert.Nil(err)
+		assert.Len(found, 3)
+		assert.Equal(start, found[0].Found)
+		assert.Equal(OrphanedConsumerDeleted, found[1].State)
+		assert.Equal([]string{"s1/eph-left"}, controller.deleted)
+	}
+
+	// Case 3: orphans drop the durable consumers a session bound to, or which were deleted,
+	// and include the ones other replicas found
+	{
+		controller.consumers["s1"]["durable-idle"].PushBound = true
+		delete(controller.consumers["s2"], "durable-idle")
+		controller.consumers["s3"] = map[string]*nats.ConsumerInfo{
+			"durable-remote": consumer("durable-remote", tagged, "inbox.9", false),
+		}
+		sessions.reported = nil
+		sessions.remote = []common.UnboundConsumer{
+			{Stream: "s3", Consumer: "durable-remote", Since: start, Reporter: "management/b"},
+		}
+		orphans := uut.Orphans(ctxt)
+		assert.Len(orphans, 2)
+		assert.Equal("eph-left", orphans[0].Consumer)
+		assert.Equal("durable-remote", orphans[1].Consumer)
+		assert.Equal("management/b", orphans[1].Reporter)
+		sessions.remote = nil
+		delete(controller.consumers, "s3")
+	}
+
+	// Case 4: an ephemeral consumer which binds again within the grace period is kept
+	{
+		controller.consumers["s2"]["eph-late"] = consumer("", tagged, "inbox.7", false)
+		_, err := recovery.reconcile(ctxt, start.Add(grace*2))
+		assert.Nil(err)
+		controller.consumers["s2"]["eph-late"].PushBound = true
+		found, err := recovery.reconcile(ctxt, start.Add(grace*3))
+		assert.Nil(err)
+		assert.Empty(found)
+		assert.Equal([]string{"s1/eph-left"}, controller.deleted)
+	}
+
+	// Case 5: ephemeral consumers which can not be deleted are reported
+	{
+		controller.consumers["s2"]["eph-late"].PushBound = false
+		controller.deleteErr = fmt.Errorf("no responders")
+		found, err := recovery.reconcile(ctxt, start.Add(grace*4))
+		assert.Nil(err)
+		assert.Len(found, 1)
+		assert.Equal(OrphanedConsumerUnbound, found[0].State)
+		found, err = recovery.reconcile(ctxt, start.Add(grace*5))
+		assert.Nil(err)
+		assert.Len(found, 1)
+		assert.Equal(OrphanedConsumerDeleteFailed, found[0].State)
+		assert.Equal("no responders", found[0].Error)
+		assert.Len(uut.Orphans(ctxt), 2)
+	}
+}
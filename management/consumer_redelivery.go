@@ -0,0 +1,129 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrConsumerDeleted returned when a consumer was deleted to redeliver its pending
+// messages, but could not be recreated
+var ErrConsumerDeleted = errors.New("consumer deleted, but not recreated")
+
+// JetStreamConsumerRedeliverParam parameters for forcing a consumer to redeliver its
+// pending messages
+type JetStreamConsumerRedeliverParam struct {
+	// Confirm must repeat the consumer name, to confirm the consumer is to be recreated
+	Confirm string `json:"confirm" validate:"required"`
+}
+
+// ConsumerRedelivery is the outcome of forcing a consumer to redeliver its pending messages
+type ConsumerRedelivery struct {
+	// AckFloor is the stream sequence number up to which every message was ACKed. The
+	// consumer restarts after it.
+	AckFloor uint64 `json:"ack_floor"`
+	// NumAckPending is the number of messages delivered but not ACKed
+	NumAckPending int `json:"num_ack_pending"`
+	// Redelivered is the range of messages delivered again. Messages in the range which were
+	// individually ACKed are delivered again as well. Absent if nothing was pending.
+	Redelivered *SequenceRange `json:"redelivered,omitempty"`
+}
+
+// redeliveryConfig helper function to define the config of a consumer restarted after its
+// ACK floor, so the messages it has pending are delivered again
+func redeliveryConfig(info *nats.ConsumerInfo) (nats.ConsumerConfig, ConsumerRedelivery) {
+	redelivery := ConsumerRedelivery{
+		AckFloor:      info.AckFloor.Stream,
+		NumAckPending: info.NumAckPending,
+		Redelivered:   progressRange(info.Delivered.Stream, info.AckFloor.Stream),
+	}
+	config := info.Config
+	config.DeliverPolicy = nats.DeliverByStartSequencePolicy
+	config.OptStartSeq = info.AckFloor.Stream + 1
+	config.OptStartTime = nil
+	return config, redelivery
+}
+
+// RedeliverConsumerPending forces a consumer to redeliver its pending messages at once,
+// by recreating it to start after its ACK floor. The consumer keeps its name and
+// configuration. Nothing is changed if the consumer has no pending messages.
+//
+// Returns ErrConsumerDeleted if the consumer could not be recreated. It is not recreated
+// with its original configuration, as that would restart it from its original start
+// position instead of its ACK floor.
+func (js jetStreamControllerImpl) RedeliverConsumerPending(
+	stream, consumerName string, ctxt context.Context,
+) (ConsumerRedelivery, error) {
+	localLogTags, err := common.UpdateLogTags(js.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(js.LogTags).Errorf("Failed to update logtags")
+	}
+	info, err := js.core.JetStream().ConsumerInfo(stream, consumerName, nats.Context(ctxt))
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to get consumer %s of stream %s info", consumerName, stream,
+		)
+		return ConsumerRedelivery{}, err
+	}
+	backoff, err := js.GetConsumerBackoff(stream, consumerName, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to get consumer %s of stream %s backoff", consumerName, stream,
+		)
+		return ConsumerRedelivery{}, err
+	}
+	config, redelivery := redeliveryConfig(info)
+	if redelivery.Redelivered == nil {
+		return redelivery, nil
+	}
+
+	if err := js.core.JetStream().DeleteConsumer(stream, consumerName); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to delete consumer %s from stream %s", consumerName, stream,
+		)
+		return ConsumerRedelivery{}, err
+	}
+	if err := js.addConsumer(
+		stream, jsConsumerConfig{ConsumerConfig: config, BackOff: backoff}, ctxt,
+	); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to recreate consumer %s of stream %s, retrying", consumerName, stream,
+		)
+		// Do not leave the consumer deleted
+		if retryErr := js.addConsumer(
+			stream, jsConsumerConfig{ConsumerConfig: config, BackOff: backoff}, ctxt,
+		); retryErr != nil {
+			log.WithError(retryErr).WithFields(localLogTags).Errorf(
+				"Consumer %s of stream %s left deleted, it should restart at stream sequence %d",
+				consumerName, stream, config.OptStartSeq,
+			)
+			return redelivery, fmt.Errorf(
+				"%w: restart %s at stream sequence %d: %s",
+				ErrConsumerDeleted, consumerName, config.OptStartSeq, retryErr.Error(),
+			)
+		}
+	}
+	log.WithFields(localLogTags).Infof(
+		"Recreated consumer %s of stream %s after ACK floor %d to redeliver %d pending messages",
+		consumerName, stream, redelivery.AckFloor, redelivery.NumAckPending,
+	)
+	return redelivery, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedeliveryConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	startTime := time.Now()
+	consumerInfo := func(ackFloor, delivered uint64, ackPending int) *nats.ConsumerInfo {
+		return &nats.ConsumerInfo{
+			Name: "a",
+			Config: nats.ConsumerConfig{
+				Durable:        "a",
+				DeliverPolicy:  nats.DeliverByStartTimePolicy,
+				OptStartTime:   &startTime,
+				AckWait:        time.Second * 30,
+				MaxAckPending:  10,
+				DeliverSubject: "_INBOX.abc",
+			},
+			AckFloor:      nats.SequenceInfo{Stream: ackFloor},
+			Delivered:     nats.SequenceInfo{Stream: delivered},
+			NumAckPending: ackPending,
+		}
+	}
+
+	// Case 0: messages pending
+	{
+		config, redelivery := redeliveryConfig(consumerInfo(10, 14, 3))
+		assert.Equal(nats.DeliverByStartSequencePolicy, config.DeliverPolicy)
+		assert.Equal(uint64(11), config.OptStartSeq)
+		assert.Nil(config.OptStartTime)
+		assert.Equal("a", config.Durable)
+		assert.Equal("_INBOX.abc", config.DeliverSubject)
+		assert.Equal(time.Second*30, config.AckWait)
+		assert.Equal(10, config.MaxAckPending)
+		assert.Equal(uint64(10), redelivery.AckFloor)
+		assert.Equal(3, redelivery.NumAckPending)
+		assert.Equal(&SequenceRange{First: 11, Last: 14}, redelivery.Redelivered)
+	}
+
+	// Case 1: nothing pending
+	{
+		config, redelivery := redeliveryConfig(consumerInfo(14, 14, 0))
+		assert.Equal(uint64(15), config.OptStartSeq)
+		assert.Nil(redelivery.Redelivered)
+	}
+}
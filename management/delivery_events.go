@@ -0,0 +1,208 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// jsAckMetricPrefix is the subject prefix of the JetStream consumer ACK samples
+const jsAckMetricPrefix = "$JS.EVENT.METRIC.CONSUMER.ACK."
+
+// EventTypeConsumerAckSample event type for a sampled message ACK of a consumer
+const EventTypeConsumerAckSample = "consumer-ack-sample"
+
+// ValidateConsumerSampleFrequency verify a consumer ACK sampling frequency, the percentage
+// of ACKs sampled, e.g. "50%" or "50"
+func ValidateConsumerSampleFrequency(frequency string) error {
+	percent, err := strconv.Atoi(strings.TrimSuffix(frequency, "%"))
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("sample frequency '%s' is not a percentage between 0 and 100", frequency)
+	}
+	return nil
+}
+
+// ConsumerDeliveryEvent is a delivery failure, or a sampled ACK, of a message delivered
+// by a consumer
+type ConsumerDeliveryEvent struct {
+	// Type is the event type
+	Type string `json:"type"`
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// StreamSeq is the message sequence number within the stream
+	StreamSeq uint64 `json:"stream_seq"`
+	// ConsumerSeq is the message sequence number for the consumer, if known
+	ConsumerSeq uint64 `json:"consumer_seq,omitempty"`
+	// Deliveries is the number of times the message was delivered
+	Deliveries uint64 `json:"deliveries"`
+	// AckTime is the duration (ns) from the delivery of a sampled message to its ACK
+	AckTime time.Duration `json:"ack_time,omitempty" swaggertype:"primitive,integer"`
+	// Timestamp is when the event occurred
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ConsumerDeliveryMonitor follows the JetStream advisories of messages a consumer failed to
+// deliver, and the ACK samples of the consumer
+type ConsumerDeliveryMonitor interface {
+	// Watch returns a channel of the delivery events of a consumer. The channel is closed if
+	// the watcher falls too far behind. Call cancel once done.
+	Watch(stream, consumer string) (events <-chan ConsumerDeliveryEvent, cancel func(), err error)
+}
+
+// consumerDeliveryMonitorImpl implements ConsumerDeliveryMonitor
+type consumerDeliveryMonitorImpl struct {
+	common.Component
+	natsClient *core.NatsClient
+}
+
+// GetConsumerDeliveryMonitor define a new ConsumerDeliveryMonitor
+func GetConsumerDeliveryMonitor(
+	natsClient *core.NatsClient, instance string,
+) (ConsumerDeliveryMonitor, error) {
+	logTags := log.Fields{
+		"module": "management", "component": "delivery-monitor", "instance": instance,
+	}
+	return &consumerDeliveryMonitorImpl{
+		Component: common.Component{LogTags: logTags}, natsClient: natsClient,
+	}, nil
+}
+
+// deliveryWatcher forwards the delivery events of one consumer to a watcher
+type deliveryWatcher struct {
+	lock          sync.Mutex
+	events        chan ConsumerDeliveryEvent
+	subscriptions []*nats.Subscription
+	closed        bool
+}
+
+// receive handle one advisory or ACK sample
+func (w *deliveryWatcher) receive(msg *nats.Msg) {
+	event, ok := parseDeliveryEvent(msg)
+	if !ok {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.events <- event:
+	default:
+		// Too far behind
+		w.close()
+	}
+}
+
+// close stop forwarding events. The caller must hold the lock.
+func (w *deliveryWatcher) close() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for _, subscription := range w.subscriptions {
+		_ = subscription.Unsubscribe()
+	}
+	close(w.events)
+}
+
+// Watch returns a channel of the delivery events of a consumer
+func (m *consumerDeliveryMonitorImpl) Watch(
+	stream, consumer string,
+) (<-chan ConsumerDeliveryEvent, func(), error) {
+	watcher := &deliveryWatcher{events: make(chan ConsumerDeliveryEvent, subscriberBuffer)}
+	cancel := func() {
+		watcher.lock.Lock()
+		defer watcher.lock.Unlock()
+		watcher.close()
+	}
+	for _, subject := range []string{
+		fmt.Sprintf("%sCONSUMER.MAX_DELIVERIES.%s.%s", jsAdvisoryPrefix, stream, consumer),
+		fmt.Sprintf("%sCONSUMER.MSG_TERMINATED.%s.%s", jsAdvisoryPrefix, stream, consumer),
+		fmt.Sprintf("%s%s.%s", jsAckMetricPrefix, stream, consumer),
+	} {
+		subscription, err := m.natsClient.NATs().Subscribe(subject, watcher.receive)
+		if err != nil {
+			log.WithError(err).WithFields(m.LogTags).Errorf("Unable to subscribe to %s", subject)
+			cancel()
+			return nil, nil, err
+		}
+		watcher.lock.Lock()
+		if watcher.closed {
+			_ = subscription.Unsubscribe()
+		} else {
+			watcher.subscriptions = append(watcher.subscriptions, subscription)
+		}
+		watcher.lock.Unlock()
+	}
+	return watcher.events, cancel, nil
+}
+
+// parseDeliveryEvent helper function to convert a JetStream consumer advisory, or ACK
+// sample, into a delivery event. Returns false if it is not one reported.
+func parseDeliveryEvent(msg *nats.Msg) (ConsumerDeliveryEvent, bool) {
+	var eventType string
+	switch {
+	case strings.HasPrefix(msg.Subject, jsAckMetricPrefix):
+		eventType = EventTypeConsumerAckSample
+	case strings.HasPrefix(msg.Subject, jsAdvisoryPrefix):
+		advisory, ok := parseAdvisory(msg)
+		if !ok || (advisory.Type != EventTypeConsumerMaxDeliveries &&
+			advisory.Type != EventTypeConsumerMsgTerminated) {
+			return ConsumerDeliveryEvent{}, false
+		}
+		eventType = advisory.Type
+	default:
+		return ConsumerDeliveryEvent{}, false
+	}
+	var detail struct {
+		Stream      string    `json:"stream"`
+		Consumer    string    `json:"consumer"`
+		StreamSeq   uint64    `json:"stream_seq"`
+		ConsumerSeq uint64    `json:"consumer_seq"`
+		Deliveries  uint64    `json:"deliveries"`
+		AckTime     int64     `json:"ack_time"`
+		Timestamp   time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(msg.Data, &detail); err != nil {
+		return ConsumerDeliveryEvent{}, false
+	}
+	event := ConsumerDeliveryEvent{
+		Type:        eventType,
+		Stream:      detail.Stream,
+		Consumer:    detail.Consumer,
+		StreamSeq:   detail.StreamSeq,
+		ConsumerSeq: detail.ConsumerSeq,
+		Deliveries:  detail.Deliveries,
+		AckTime:     time.Duration(detail.AckTime),
+		Timestamp:   detail.Timestamp,
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	return event, true
+}
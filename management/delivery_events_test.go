@@ -0,0 +1,132 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerSampleFrequencyValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, frequency := range []string{"0", "50", "50%", "100%"} {
+		assert.Nil(ValidateConsumerSampleFrequency(frequency), frequency)
+	}
+	for _, frequency := range []string{"", "%", "-1", "101%", "half", "50%%"} {
+		assert.NotNil(ValidateConsumerSampleFrequency(frequency), frequency)
+	}
+}
+
+func TestConsumerDeliveryEventParsing(t *testing.T) {
+	assert := assert.New(t)
+
+	timestamp := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	type testCase struct {
+		subject  string
+		data     string
+		expected *ConsumerDeliveryEvent
+	}
+	testCases := []testCase{
+		// Case 0: ACK sample
+		{
+			subject: "$JS.EVENT.METRIC.CONSUMER.ACK.s0.c0",
+			data: `{"stream":"s0","consumer":"c0","consumer_seq":3,"stream_seq":12,` +
+				`"ack_time":2500000,"deliveries":1,"timestamp":"2022-03-01T12:00:00Z"}`,
+			expected: &ConsumerDeliveryEvent{
+				Type:        EventTypeConsumerAckSample,
+				Stream:      "s0",
+				Consumer:    "c0",
+				StreamSeq:   12,
+				ConsumerSeq: 3,
+				Deliveries:  1,
+				AckTime:     time.Microsecond * 2500,
+				Timestamp:   timestamp,
+			},
+		},
+		// Case 1: message reaching the max deliveries
+		{
+			subject: "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.s0.c0",
+			data: `{"stream":"s0","consumer":"c0","stream_seq":12,"deliveries":5,` +
+				`"timestamp":"2022-03-01T12:00:00Z"}`,
+			expected: &ConsumerDeliveryEvent{
+				Type:       EventTypeConsumerMaxDeliveries,
+				Stream:     "s0",
+				Consumer:   "c0",
+				StreamSeq:  12,
+				Deliveries: 5,
+				Timestamp:  timestamp,
+			},
+		},
+		// Case 2: message terminated by the client
+		{
+			subject: "$JS.EVENT.ADVISORY.CONSUMER.MSG_TERMINATED.s0.c0",
+			data: `{"stream":"s0","consumer":"c0","consumer_seq":4,"stream_seq":13,` +
+				`"deliveries":2,"timestamp":"2022-03-01T12:00:00Z"}`,
+			expected: &ConsumerDeliveryEvent{
+				Type:        EventTypeConsumerMsgTerminated,
+				Stream:      "s0",
+				Consumer:    "c0",
+				StreamSeq:   13,
+				ConsumerSeq: 4,
+				Deliveries:  2,
+				Timestamp:   timestamp,
+			},
+		},
+		// Case 3: not delivery events
+		{subject: "$JS.EVENT.ADVISORY.CONSUMER.CREATED.s0.c0", data: `{}`},
+		{subject: "$JS.EVENT.METRIC.CONSUMER.ACK.s0.c0", data: "not JSON"},
+		{subject: "other.subject", data: `{}`},
+	}
+	for idx, oneCase := range testCases {
+		event, ok := parseDeliveryEvent(&nats.Msg{Subject: oneCase.subject, Data: []byte(oneCase.data)})
+		if oneCase.expected == nil {
+			assert.False(ok, "Case %d", idx)
+			continue
+		}
+		assert.True(ok, "Case %d", idx)
+		assert.Equal(*oneCase.expected, event, "Case %d", idx)
+	}
+}
+
+func TestConsumerDeliveryWatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	watcher := &deliveryWatcher{events: make(chan ConsumerDeliveryEvent, 1)}
+	sample := &nats.Msg{
+		Subject: "$JS.EVENT.METRIC.CONSUMER.ACK.s0.c0",
+		Data:    []byte(`{"stream":"s0","consumer":"c0","stream_seq":12,"deliveries":1}`),
+	}
+
+	// Case 0: events are forwarded
+	{
+		watcher.receive(sample)
+		assert.Len(watcher.events, 1)
+	}
+
+	// Case 1: watcher falling behind is closed
+	{
+		watcher.receive(sample)
+		assert.True(watcher.closed)
+		<-watcher.events
+		_, ok := <-watcher.events
+		assert.False(ok)
+		// Events after closing are dropped
+		watcher.receive(sample)
+	}
+}
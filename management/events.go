@@ -0,0 +1,325 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// jsAdvisoryPrefix is the subject prefix of the JetStream advisories
+const jsAdvisoryPrefix = "$JS.EVENT.ADVISORY."
+
+const (
+	// EventTypeStreamCreated event type for a stream being defined
+	EventTypeStreamCreated = "stream-created"
+	// EventTypeStreamUpdated event type for a stream config changing
+	EventTypeStreamUpdated = "stream-updated"
+	// EventTypeStreamDeleted event type for a stream being deleted
+	EventTypeStreamDeleted = "stream-deleted"
+	// EventTypeConsumerCreated event type for a consumer being defined
+	EventTypeConsumerCreated = "consumer-created"
+	// EventTypeConsumerDeleted event type for a consumer being deleted
+	EventTypeConsumerDeleted = "consumer-deleted"
+	// EventTypeConsumerMaxDeliveries event type for a message reaching the max deliveries of
+	// a consumer
+	EventTypeConsumerMaxDeliveries = "consumer-max-deliveries"
+	// EventTypeConsumerMsgTerminated event type for a consumer client terminating a message
+	EventTypeConsumerMsgTerminated = "consumer-msg-terminated"
+	// EventTypeStreamSnapshotCompleted event type for a stream snapshot being taken
+	EventTypeStreamSnapshotCompleted = "stream-snapshot-completed"
+	// EventTypeStreamRestoreCompleted event type for a stream being restored from a snapshot
+	EventTypeStreamRestoreCompleted = "stream-restore-completed"
+	// EventTypeStreamQuorumLost event type for a clustered stream losing its quorum
+	EventTypeStreamQuorumLost = "stream-quorum-lost"
+	// EventTypeConsumerQuorumLost event type for a clustered consumer losing its quorum
+	EventTypeConsumerQuorumLost = "consumer-quorum-lost"
+	// EventTypeJetStreamAPIError event type for a JetStream API call failing
+	EventTypeJetStreamAPIError = "jetstream-api-error"
+)
+
+// jsAdvisoryEventTypes the event types of the JetStream advisories reported, by the
+// advisory subject tokens after the prefix, without the stream and consumer names
+var jsAdvisoryEventTypes = map[string]string{
+	"STREAM.CREATED":           EventTypeStreamCreated,
+	"STREAM.UPDATED":           EventTypeStreamUpdated,
+	"STREAM.DELETED":           EventTypeStreamDeleted,
+	"CONSUMER.CREATED":         EventTypeConsumerCreated,
+	"CONSUMER.DELETED":         EventTypeConsumerDeleted,
+	"CONSUMER.MAX_DELIVERIES":  EventTypeConsumerMaxDeliveries,
+	"CONSUMER.MSG_TERMINATED":  EventTypeConsumerMsgTerminated,
+	"STREAM.SNAPSHOT_COMPLETE": EventTypeStreamSnapshotCompleted,
+	"STREAM.RESTORE_COMPLETE":  EventTypeStreamRestoreCompleted,
+	"STREAM.QUORUM_LOST":       EventTypeStreamQuorumLost,
+	"CONSUMER.QUORUM_LOST":     EventTypeConsumerQuorumLost,
+}
+
+// TopologyEvent is a change to the streams or consumers, or a consumer error
+type TopologyEvent struct {
+	// ID orders the events of the feed
+	ID uint64 `json:"id"`
+	// Type is the event type. Consumer errors detected by the gateway have the type of the
+	// alert raised.
+	Type string `json:"type"`
+	// Stream is the name of the stream the event is about
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer the event is about, if any
+	Consumer string `json:"consumer,omitempty"`
+	// Resolved indicates a consumer error reported by an earlier event has cleared
+	Resolved bool `json:"resolved,omitempty"`
+	// Message is a human readable description of the event, if any
+	Message string `json:"message,omitempty"`
+	// Timestamp is when the event occurred
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TopologyEventFeed gathers the JetStream advisories on streams and consumers, and the
+// consumer alerts raised by the gateway, into one feed of events. The latest events are
+// retained, so a subscriber which reconnects can catch up on the events it missed.
+type TopologyEventFeed interface {
+	// AlertSink takes the consumer alerts raised by the gateway as events
+	alerts.AlertSink
+	// Subscribe returns the retained events after afterID, and a channel of the new events.
+	// The channel is closed if the subscriber falls too far behind. Call cancel once done.
+	Subscribe(afterID uint64) (backlog []TopologyEvent, events <-chan TopologyEvent, cancel func())
+	// Close stops gathering events
+	Close() error
+}
+
+// topologyEventFeedImpl implements TopologyEventFeed
+type topologyEventFeedImpl struct {
+	common.Component
+	lock         sync.Mutex
+	retain       int
+	retained     []TopologyEvent
+	lastID       uint64
+	subscribers  map[chan TopologyEvent]bool
+	subscription *nats.Subscription
+}
+
+// subscriberBuffer is the number of events queued for a subscriber before it is dropped
+const subscriberBuffer = 64
+
+// GetTopologyEventFeed define a new TopologyEventFeed, retaining the latest retain events
+func GetTopologyEventFeed(
+	natsClient *core.NatsClient, retain int, instance string,
+) (TopologyEventFeed, error) {
+	feed, err := newTopologyEventFeed(retain, instance)
+	if err != nil {
+		return nil, err
+	}
+	subscription, err := natsClient.NATs().Subscribe(jsAdvisoryPrefix+">", feed.receive)
+	if err != nil {
+		log.WithError(err).WithFields(feed.LogTags).Errorf("Unable to subscribe to advisories")
+		return nil, err
+	}
+	feed.subscription = subscription
+	return feed, nil
+}
+
+// newTopologyEventFeed helper function to define the feed, without gathering advisories
+func newTopologyEventFeed(retain int, instance string) (*topologyEventFeedImpl, error) {
+	if retain <= 0 {
+		return nil, fmt.Errorf("number of events retained must be positive")
+	}
+	logTags := log.Fields{
+		"module": "management", "component": "topology-events", "instance": instance,
+	}
+	return &topologyEventFeedImpl{
+		Component:   common.Component{LogTags: logTags},
+		retain:      retain,
+		subscribers: make(map[chan TopologyEvent]bool),
+	}, nil
+}
+
+// parseAdvisory helper function to convert a JetStream advisory into an event. Returns false
+// if the advisory is not one reported.
+func parseAdvisory(msg *nats.Msg) (TopologyEvent, bool) {
+	tokens := strings.Split(strings.TrimPrefix(msg.Subject, jsAdvisoryPrefix), ".")
+	if len(tokens) == 1 && tokens[0] == "API" {
+		return parseAPIAudit(msg)
+	}
+	if len(tokens) < 3 {
+		return TopologyEvent{}, false
+	}
+	eventType, ok := jsAdvisoryEventTypes[tokens[0]+"."+tokens[1]]
+	if !ok {
+		return TopologyEvent{}, false
+	}
+	event := TopologyEvent{Type: eventType, Stream: tokens[2], Timestamp: time.Now().UTC()}
+	if tokens[0] == "CONSUMER" {
+		if len(tokens) < 4 {
+			return TopologyEvent{}, false
+		}
+		event.Consumer = tokens[3]
+	}
+	// The message advisories identify the message
+	var detail struct {
+		StreamSeq  uint64 `json:"stream_seq"`
+		Deliveries uint64 `json:"deliveries"`
+	}
+	switch eventType {
+	case EventTypeConsumerMaxDeliveries:
+		if err := json.Unmarshal(msg.Data, &detail); err == nil {
+			event.Message = fmt.Sprintf(
+				"message %d not ACKed after %d deliveries", detail.StreamSeq, detail.Deliveries,
+			)
+		}
+	case EventTypeConsumerMsgTerminated:
+		if err := json.Unmarshal(msg.Data, &detail); err == nil {
+			event.Message = fmt.Sprintf("message %d terminated by client", detail.StreamSeq)
+		}
+	}
+	return event, true
+}
+
+// jsTwoTokenAPIOperations the first tokens of the JetStream API operations named by two
+// subject tokens
+var jsTwoTokenAPIOperations = map[string]bool{
+	"DURABLE": true, "MSG": true, "PEER": true, "LEADER": true,
+}
+
+// parseAPIAudit helper function to convert a JetStream API audit advisory into an event.
+// Returns false unless the API call failed. Calls failing to find a stream or consumer are
+// routine lookups, so they are not reported.
+func parseAPIAudit(msg *nats.Msg) (TopologyEvent, bool) {
+	var audit struct {
+		Subject  string `json:"subject"`
+		Response string `json:"response"`
+	}
+	if err := json.Unmarshal(msg.Data, &audit); err != nil {
+		return TopologyEvent{}, false
+	}
+	var response struct {
+		Error *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(audit.Response), &response); err != nil {
+		return TopologyEvent{}, false
+	}
+	if response.Error == nil || response.Error.Code == 404 {
+		return TopologyEvent{}, false
+	}
+	// The API subject is $JS.API.<kind>.<operation>[.<stream>...], where some operations
+	// take two tokens, e.g. STREAM.MSG.GET
+	apiCall := strings.TrimPrefix(audit.Subject, "$JS.API.")
+	var stream string
+	if tokens := strings.Split(apiCall, "."); tokens[0] == "STREAM" || tokens[0] == "CONSUMER" {
+		streamIdx := 2
+		if len(tokens) > 1 && jsTwoTokenAPIOperations[tokens[1]] {
+			streamIdx = 3
+		}
+		if len(tokens) > streamIdx {
+			stream = tokens[streamIdx]
+		}
+	}
+	description := fmt.Sprintf("%s failed with %d", apiCall, response.Error.Code)
+	if response.Error.Description != "" {
+		description = fmt.Sprintf("%s: %s", description, response.Error.Description)
+	}
+	return TopologyEvent{
+		Type:      EventTypeJetStreamAPIError,
+		Stream:    stream,
+		Message:   description,
+		Timestamp: time.Now().UTC(),
+	}, true
+}
+
+// receive handle one JetStream advisory
+func (f *topologyEventFeedImpl) receive(msg *nats.Msg) {
+	if event, ok := parseAdvisory(msg); ok {
+		f.publish(event)
+	}
+}
+
+// Send takes a consumer alert raised by the gateway as an event
+func (f *topologyEventFeedImpl) Send(alert alerts.Alert, _ context.Context) error {
+	f.publish(TopologyEvent{
+		Type:      alert.Type,
+		Stream:    alert.Stream,
+		Consumer:  alert.Consumer,
+		Resolved:  alert.Resolved,
+		Message:   alert.Message,
+		Timestamp: alert.Timestamp,
+	})
+	return nil
+}
+
+// publish record an event, and send it to the subscribers
+func (f *topologyEventFeedImpl) publish(event TopologyEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lastID++
+	event.ID = f.lastID
+	f.retained = append(f.retained, event)
+	if len(f.retained) > f.retain {
+		f.retained = f.retained[len(f.retained)-f.retain:]
+	}
+	for subscriber := range f.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// Too far behind. The subscriber can catch up from the retained events.
+			log.WithFields(f.LogTags).Warn("Dropping topology event subscriber falling behind")
+			delete(f.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Subscribe returns the retained events after afterID, and a channel of the new events
+func (f *topologyEventFeedImpl) Subscribe(
+	afterID uint64,
+) ([]TopologyEvent, <-chan TopologyEvent, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	backlog := []TopologyEvent{}
+	for _, event := range f.retained {
+		if event.ID > afterID {
+			backlog = append(backlog, event)
+		}
+	}
+	subscriber := make(chan TopologyEvent, subscriberBuffer)
+	f.subscribers[subscriber] = true
+	cancel := func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.subscribers[subscriber] {
+			delete(f.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return backlog, subscriber, cancel
+}
+
+// Close stops gathering events
+func (f *topologyEventFeedImpl) Close() error {
+	if f.subscription == nil {
+		return nil
+	}
+	return f.subscription.Unsubscribe()
+}
@@ -0,0 +1,151 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopologyEventFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newTopologyEventFeed(0, "ut")
+	assert.NotNil(err)
+
+	feed, err := newTopologyEventFeed(3, "ut")
+	assert.Nil(err)
+
+	// Case 0: advisories converted to events
+	{
+		type testCase struct {
+			subject  string
+			data     string
+			expected *TopologyEvent
+		}
+		testCases := []testCase{
+			{
+				subject:  "$JS.EVENT.ADVISORY.STREAM.CREATED.s0",
+				expected: &TopologyEvent{Type: EventTypeStreamCreated, Stream: "s0"},
+			},
+			{
+				subject:  "$JS.EVENT.ADVISORY.CONSUMER.DELETED.s0.c0",
+				expected: &TopologyEvent{Type: EventTypeConsumerDeleted, Stream: "s0", Consumer: "c0"},
+			},
+			{
+				subject: "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.s0.c0",
+				data:    `{"stream":"s0","consumer":"c0","stream_seq":12,"deliveries":5}`,
+				expected: &TopologyEvent{
+					Type:     EventTypeConsumerMaxDeliveries,
+					Stream:   "s0",
+					Consumer: "c0",
+					Message:  "message 12 not ACKed after 5 deliveries",
+				},
+			},
+			{
+				subject:  "$JS.EVENT.ADVISORY.STREAM.QUORUM_LOST.s0",
+				expected: &TopologyEvent{Type: EventTypeStreamQuorumLost, Stream: "s0"},
+			},
+			{
+				subject: "$JS.EVENT.ADVISORY.API",
+				data: `{"subject":"$JS.API.CONSUMER.DURABLE.CREATE.s0.c0",` +
+					`"response":"{\"error\":{\"code\":400,\"description\":\"bad config\"}}"}`,
+				expected: &TopologyEvent{
+					Type:    EventTypeJetStreamAPIError,
+					Stream:  "s0",
+					Message: "CONSUMER.DURABLE.CREATE.s0.c0 failed with 400: bad config",
+				},
+			},
+			{
+				subject: "$JS.EVENT.ADVISORY.API",
+				data:    `{"subject":"$JS.API.STREAM.NAMES","response":"{\"error\":{\"code\":503}}"}`,
+				expected: &TopologyEvent{
+					Type: EventTypeJetStreamAPIError, Message: "STREAM.NAMES failed with 503",
+				},
+			},
+			{subject: "$JS.EVENT.ADVISORY.API"},
+			{
+				subject: "$JS.EVENT.ADVISORY.API",
+				data:    `{"subject":"$JS.API.STREAM.INFO.s0","response":"{\"total\":1}"}`,
+			},
+			{subject: "$JS.EVENT.ADVISORY.STREAM.LEADER_ELECTED.s0"},
+			{subject: "$JS.EVENT.ADVISORY.CONSUMER.CREATED.s0"},
+		}
+		for idx, oneCase := range testCases {
+			event, ok := parseAdvisory(&nats.Msg{Subject: oneCase.subject, Data: []byte(oneCase.data)})
+			if oneCase.expected == nil {
+				assert.False(ok, "Case %d", idx)
+				continue
+			}
+			assert.True(ok, "Case %d", idx)
+			event.Timestamp = time.Time{}
+			assert.Equal(*oneCase.expected, event, "Case %d", idx)
+		}
+	}
+
+	// Case 1: subscribers receive new events
+	backlog, events, cancel := feed.Subscribe(0)
+	assert.Empty(backlog)
+	{
+		feed.receive(&nats.Msg{Subject: "$JS.EVENT.ADVISORY.STREAM.UPDATED.s0"})
+		feed.receive(&nats.Msg{Subject: "$JS.EVENT.ADVISORY.STREAM.LEADER_ELECTED.s0"})
+		assert.Nil(feed.Send(alerts.Alert{
+			Type: AlertTypeConsumerLagging, Stream: "s0", Consumer: "c0", Message: "lagging",
+		}, context.Background()))
+		event := <-events
+		assert.Equal(uint64(1), event.ID)
+		assert.Equal(EventTypeStreamUpdated, event.Type)
+		event = <-events
+		assert.Equal(uint64(2), event.ID)
+		assert.Equal(AlertTypeConsumerLagging, event.Type)
+		assert.Equal("c0", event.Consumer)
+	}
+
+	// Case 2: a reconnecting subscriber catches up from the retained events
+	{
+		for _, stream := range []string{"s1", "s2", "s3"} {
+			feed.receive(&nats.Msg{Subject: "$JS.EVENT.ADVISORY.STREAM.DELETED." + stream})
+		}
+		backlog, _, cancelOther := feed.Subscribe(2)
+		defer cancelOther()
+		assert.Len(backlog, 3)
+		assert.Equal(uint64(3), backlog[0].ID)
+		assert.Equal("s1", backlog[0].Stream)
+		// Only the latest are retained
+		backlog, _, cancelAll := feed.Subscribe(0)
+		defer cancelAll()
+		assert.Len(backlog, 3)
+		assert.Equal(uint64(3), backlog[0].ID)
+	}
+
+	// Case 3: a subscriber falling behind is dropped
+	{
+		for idx := 0; idx < subscriberBuffer+1; idx++ {
+			feed.receive(&nats.Msg{Subject: "$JS.EVENT.ADVISORY.STREAM.UPDATED.s0"})
+		}
+		received := 0
+		for range events {
+			received++
+		}
+		assert.Equal(subscriberBuffer, received)
+		// Cancel after being dropped is safe
+		cancel()
+	}
+}
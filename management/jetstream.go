@@ -22,6 +22,7 @@ import (
 
 	"github.com/alwitt/httpmq/common"
 	"github.com/alwitt/httpmq/core"
+	"github.com/alwitt/httpmq/hooks"
 	"github.com/apex/log"
 	"github.com/go-playground/validator/v10"
 	"github.com/nats-io/nats.go"
@@ -75,20 +76,42 @@ type JetStreamConsumerParam struct {
 	// and group name tuple. For subjects this consumer listens to, the messages will be shared
 	// amongst the connected clients.
 	DeliveryGroup *string `json:"delivery_group,omitempty"`
-	// MaxInflight is max number of un-ACKed message permitted in-flight (must be >= 1)
-	MaxInflight int `json:"max_inflight" validate:"required,gte=1"`
+	// MaxInflight is max number of un-ACKed message permitted in-flight (must be >= 1). When
+	// creating a consumer through the API, the server default is used if not specified.
+	MaxInflight int `json:"max_inflight,omitempty" validate:"gte=1"`
 	// MaxRetry max number of times an un-ACKed message is resent (-1: infinite)
 	MaxRetry *int `json:"max_retry,omitempty" validate:"omitempty,gte=-1"`
 	// AckWait when specified, the number of ns to wait for ACK before retry
 	AckWait *time.Duration `json:"ack_wait,omitempty" swaggertype:"primitive,integer"`
-	// Mode whether the consumer is push or pull consumer
-	Mode string `json:"mode" validate:"required,oneof=push pull"`
+	// Backoff when specified, the number of ns to wait for ACK before each retry, replacing
+	// AckWait. If MaxRetry is not set, a message is given up on after the last delay.
+	Backoff []time.Duration `json:"backoff,omitempty" swaggertype:"array,integer"`
+	// ReplayPolicy when specified, whether messages are sent as fast as possible (instant), or
+	// at the rate they were published (original)
+	ReplayPolicy *string `json:"replay_policy,omitempty" validate:"omitempty,oneof=instant original"`
+	// SampleFrequency when specified, the percentage of ACKs JetStream samples, e.g. "50%".
+	// The samples are reported on the consumer delivery event stream.
+	SampleFrequency *string `json:"sample_frequency,omitempty"`
+	// Mode whether the consumer is push or pull consumer. When creating a consumer through
+	// the API, the server default is used if not specified.
+	Mode string `json:"mode,omitempty" validate:"oneof=push pull"`
+}
+
+// JetStreamConsumerCloneParam are the parameters for cloning a consumer on a stream
+type JetStreamConsumerCloneParam struct {
+	// Name is the name of the new consumer
+	Name string `json:"name" validate:"required"`
+	// FromAckFloor whether the new consumer starts after the source consumer's ACK floor,
+	// instead of from the source consumer's deliver policy.
+	FromAckFloor bool `json:"from_ack_floor,omitempty"`
 }
 
 // JetStreamController is a JetStream controller instance. It proxes the commands to JetStream.
 type JetStreamController interface {
 	// Ready indicates whether the system is considered ready
 	Ready() (bool, error)
+	// GetAccountInfo queries for the JetStream usage and limits of the connected account
+	GetAccountInfo(ctxt context.Context) (*nats.AccountInfo, error)
 	// ========================================================
 	// Stream related management
 
@@ -104,18 +127,46 @@ type JetStreamController interface {
 	UpdateStreamLimits(stream string, newLimits JSStreamLimits, ctxt context.Context) error
 	// Deletestream deletes a stream by name
 	DeleteStream(name string, ctxt context.Context) error
+	// CompactStream removes the superseded messages of each subject of a stream, keeping only
+	// the latest messages of each subject
+	CompactStream(
+		stream string, param JSStreamCompactionParam, ctxt context.Context,
+	) (StreamCompactionResult, error)
+	// PreviewStreamPurge reports how many messages, and bytes, of a stream a purge of the
+	// selected messages would remove, without removing them
+	PreviewStreamPurge(
+		stream string, param JSStreamPurgePreviewParam, ctxt context.Context,
+	) (StreamPurgePreview, error)
 
 	// ========================================================
 	// Consumer related management
 
 	// CreateConsumerForStream creates a new consumer for a stream
 	CreateConsumerForStream(stream string, param JetStreamConsumerParam, ctxt context.Context) error
+	// CloneConsumerForStream creates a new consumer for a stream with the configuration of an
+	// existing consumer
+	CloneConsumerForStream(
+		stream, sourceConsumer string, param JetStreamConsumerCloneParam, ctxt context.Context,
+	) error
 	// GetAllConsumersForStream queries for info on all consumers of a stream
 	GetAllConsumersForStream(stream string, ctxt context.Context) map[string]*nats.ConsumerInfo
 	// GetConsumerForStream queries for info of one consumer of a stream
 	GetConsumerForStream(
 		stream, consumerName string, ctxt context.Context,
 	) (*nats.ConsumerInfo, error)
+	// GetConsumerBackoff queries for the redelivery backoff schedule of one consumer of a
+	// stream. Empty if the consumer has none.
+	GetConsumerBackoff(stream, consumerName string, ctxt context.Context) ([]time.Duration, error)
+	// DiffConsumers compares the progress of two consumers of a stream, reporting the ranges
+	// of messages one has processed but the other has not
+	DiffConsumers(
+		stream, consumerName, otherConsumer string, ctxt context.Context,
+	) (ConsumerDiff, error)
+	// RedeliverConsumerPending forces a consumer of a stream to redeliver its pending
+	// messages at once, by recreating it to start after its ACK floor
+	RedeliverConsumerPending(
+		stream, consumerName string, ctxt context.Context,
+	) (ConsumerRedelivery, error)
 	// DeleteConsumerOnStream deletes one consumer of a stream
 	DeleteConsumerOnStream(stream, consumerName string, ctxt context.Context) error
 }
@@ -148,6 +199,19 @@ func (js jetStreamControllerImpl) Ready() (bool, error) {
 	return js.core.NATs().Status() == nats.CONNECTED, nil
 }
 
+// GetAccountInfo queries for the JetStream usage and limits of the connected account
+func (js jetStreamControllerImpl) GetAccountInfo(ctxt context.Context) (*nats.AccountInfo, error) {
+	localLogTags, err := common.UpdateLogTags(js.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(js.LogTags).Errorf("Failed to update logtags")
+	}
+	info, err := js.core.JetStream().AccountInfo(nats.Context(ctxt))
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to get account info")
+	}
+	return info, err
+}
+
 // =======================================================================
 // Stream related controls
 
@@ -234,6 +298,12 @@ func (js jetStreamControllerImpl) CreateStream(param JSStreamParam, ctxt context
 		Subjects: param.Subjects,
 	}
 	applyStreamLimits(&param.JSStreamLimits, &jsParams)
+	if err := hooks.OnStreamCreate(&jsParams, ctxt); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Plugin stopped defining new stream %s", param.Name,
+		)
+		return err
+	}
 	if _, err := js.core.JetStream().AddStream(&jsParams); err != nil {
 		log.WithError(err).WithFields(localLogTags).Errorf(
 			"Unable to define new stream %s", param.Name,
@@ -373,7 +443,7 @@ func (js jetStreamControllerImpl) CreateConsumerForStream(
 	// Convert to JetStream structure
 	jsParams := nats.ConsumerConfig{
 		Durable:       param.Name,
-		Description:   param.Notes,
+		Description:   common.TagGatewayConsumer(param.Notes),
 		MaxAckPending: param.MaxInflight,
 		DeliverPolicy: nats.DeliverAllPolicy,
 		AckPolicy:     nats.AckExplicitPolicy,
@@ -381,10 +451,31 @@ func (js jetStreamControllerImpl) CreateConsumerForStream(
 	// Redeliver settings
 	if param.MaxRetry != nil {
 		jsParams.MaxDeliver = *param.MaxRetry
+	} else if len(param.Backoff) > 0 {
+		jsParams.MaxDeliver = len(param.Backoff) + 1
 	}
 	if param.AckWait != nil {
 		jsParams.AckWait = *param.AckWait
 	}
+	if param.ReplayPolicy != nil && *param.ReplayPolicy == "original" {
+		jsParams.ReplayPolicy = nats.ReplayOriginalPolicy
+	}
+	if err := ValidateConsumerBackoff(param.Backoff, jsParams.MaxDeliver); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to define new consumer %s for stream %s", param.Name, stream,
+		)
+		return err
+	}
+	// ACK sampling
+	if param.SampleFrequency != nil {
+		if err := ValidateConsumerSampleFrequency(*param.SampleFrequency); err != nil {
+			log.WithError(err).WithFields(localLogTags).Errorf(
+				"Unable to define new consumer %s for stream %s", param.Name, stream,
+			)
+			return err
+		}
+		jsParams.SampleFrequency = *param.SampleFrequency
+	}
 	// Verify the configuration made sense
 	if param.Mode == "pull" && param.DeliveryGroup != nil {
 		err := fmt.Errorf("pull consumer can't use delivery group")
@@ -406,7 +497,9 @@ func (js jetStreamControllerImpl) CreateConsumerForStream(
 		jsParams.FilterSubject = *param.FilterSubject
 	}
 	// Define the consumer
-	if _, err := js.core.JetStream().AddConsumer(stream, &jsParams); err != nil {
+	if err := js.addConsumer(
+		stream, jsConsumerConfig{ConsumerConfig: jsParams, BackOff: param.Backoff}, ctxt,
+	); err != nil {
 		log.WithError(err).WithFields(localLogTags).Errorf(
 			"Unable to define new consumer %s for stream %s", param.Name, stream,
 		)
@@ -418,6 +511,63 @@ func (js jetStreamControllerImpl) CreateConsumerForStream(
 	return nil
 }
 
+// CloneConsumerForStream creates a new consumer for a stream with the configuration of an
+// existing consumer
+func (js jetStreamControllerImpl) CloneConsumerForStream(
+	stream, sourceConsumer string, param JetStreamConsumerCloneParam, ctxt context.Context,
+) error {
+	localLogTags, err := common.UpdateLogTags(js.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(js.LogTags).Errorf("Failed to update logtags")
+	}
+	if err := js.validate.Struct(&param); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to clone consumer %s of stream %s", sourceConsumer, stream,
+		)
+		return err
+	}
+	info, err := js.core.JetStream().ConsumerInfo(stream, sourceConsumer)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to get consumer %s of stream %s info", sourceConsumer, stream,
+		)
+		return err
+	}
+	backoff, err := js.GetConsumerBackoff(stream, sourceConsumer, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to get consumer %s of stream %s backoff", sourceConsumer, stream,
+		)
+		return err
+	}
+	jsParams := info.Config
+	jsParams.Durable = param.Name
+	jsParams.Description = common.TagGatewayConsumer(
+		common.GatewayConsumerNotes(info.Config.Description),
+	)
+	// The clone must not share the source's push delivery subject
+	if jsParams.DeliverSubject != "" {
+		jsParams.DeliverSubject = nats.NewInbox()
+	}
+	if param.FromAckFloor {
+		jsParams.DeliverPolicy = nats.DeliverByStartSequencePolicy
+		jsParams.OptStartSeq = info.AckFloor.Stream + 1
+		jsParams.OptStartTime = nil
+	}
+	if err := js.addConsumer(
+		stream, jsConsumerConfig{ConsumerConfig: jsParams, BackOff: backoff}, ctxt,
+	); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf(
+			"Unable to clone consumer %s of stream %s as %s", sourceConsumer, stream, param.Name,
+		)
+		return err
+	}
+	log.WithFields(localLogTags).Infof(
+		"Cloned consumer %s of stream %s as %s", sourceConsumer, stream, param.Name,
+	)
+	return nil
+}
+
 // DeleteConsumerOnStream deletes one consumer of a stream
 func (js jetStreamControllerImpl) DeleteConsumerOnStream(
 	stream, consumerName string, ctxt context.Context,
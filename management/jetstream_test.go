@@ -357,3 +357,129 @@ func TestJetStreamControllerConsumers(t *testing.T) {
 		assert.NotNil(uut.CreateConsumerForStream(stream2, param, utCtxt))
 	}
 }
+
+func TestJetStreamControllerConsumerClone(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := uuid.New().String()
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "management_test",
+		"component": "JetStreamController",
+		"instance":  "consumer-clone",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	uut, err := GetJetStreamController(js, testName)
+	assert.Nil(err)
+
+	stream := fmt.Sprintf("%s-01", testName)
+	subject := fmt.Sprintf("%s-1-0", testName)
+	{
+		maxAge := time.Minute
+		streamParam := JSStreamParam{
+			Name:           stream,
+			Subjects:       []string{subject},
+			JSStreamLimits: JSStreamLimits{MaxAge: &maxAge},
+		}
+		assert.Nil(uut.CreateStream(streamParam, utCtxt))
+	}
+	defer func() {
+		assert.Nil(uut.DeleteStream(stream, utCtxt))
+	}()
+
+	// Case 0: clone unknown consumer
+	{
+		param := JetStreamConsumerCloneParam{Name: uuid.New().String()}
+		assert.NotNil(uut.CloneConsumerForStream(stream, uuid.New().String(), param, utCtxt))
+	}
+
+	// Define source consumers
+	pushConsumer := uuid.New().String()
+	pullConsumer := uuid.New().String()
+	{
+		filter := subject
+		param := JetStreamConsumerParam{
+			Name: pushConsumer, MaxInflight: 3, Mode: "push", FilterSubject: &filter,
+		}
+		assert.Nil(uut.CreateConsumerForStream(stream, param, utCtxt))
+		param = JetStreamConsumerParam{Name: pullConsumer, MaxInflight: 3, Mode: "pull"}
+		assert.Nil(uut.CreateConsumerForStream(stream, param, utCtxt))
+	}
+
+	// Case 1: clone a push consumer
+	{
+		clone := uuid.New().String()
+		param := JetStreamConsumerCloneParam{Name: clone}
+		assert.Nil(uut.CloneConsumerForStream(stream, pushConsumer, param, utCtxt))
+		source, err := uut.GetConsumerForStream(stream, pushConsumer, utCtxt)
+		assert.Nil(err)
+		info, err := uut.GetConsumerForStream(stream, clone, utCtxt)
+		assert.Nil(err)
+		assert.Equal(clone, info.Config.Durable)
+		assert.Equal(3, info.Config.MaxAckPending)
+		assert.Equal(subject, info.Config.FilterSubject)
+		assert.Equal(nats.DeliverAllPolicy, info.Config.DeliverPolicy)
+		assert.NotEmpty(info.Config.DeliverSubject)
+		assert.NotEqual(source.Config.DeliverSubject, info.Config.DeliverSubject)
+	}
+
+	// Case 2: clone with invalid param
+	{
+		param := JetStreamConsumerCloneParam{}
+		assert.NotNil(uut.CloneConsumerForStream(stream, pushConsumer, param, utCtxt))
+	}
+
+	// Case 3: clone a pull consumer, starting from its ACK floor
+	{
+		for itr := 0; itr < 4; itr++ {
+			_, err := js.JetStream().Publish(subject, []byte(uuid.New().String()))
+			assert.Nil(err)
+		}
+		sub, err := js.JetStream().PullSubscribe(subject, pullConsumer, nats.Bind(stream, pullConsumer))
+		assert.Nil(err)
+		msgs, err := sub.Fetch(2, nats.MaxWait(time.Second))
+		assert.Nil(err)
+		assert.Len(msgs, 2)
+		for _, msg := range msgs {
+			assert.Nil(msg.AckSync())
+		}
+
+		clone := uuid.New().String()
+		param := JetStreamConsumerCloneParam{Name: clone, FromAckFloor: true}
+		assert.Nil(uut.CloneConsumerForStream(stream, pullConsumer, param, utCtxt))
+		info, err := uut.GetConsumerForStream(stream, clone, utCtxt)
+		assert.Nil(err)
+		assert.Equal(nats.DeliverByStartSequencePolicy, info.Config.DeliverPolicy)
+		assert.Equal(uint64(3), info.Config.OptStartSeq)
+		assert.Empty(info.Config.DeliverSubject)
+		assert.Equal(uint64(2), info.NumPending)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+)
+
+// jsAPITimeout bounds a JetStream API call made without a deadline, same as the JetStream
+// client does
+const jsAPITimeout = time.Second * 5
+
+// jsAPIError is the error reported by a JetStream API call
+type jsAPIError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+// jsAPIResponse is the common part of the JetStream API responses
+type jsAPIResponse struct {
+	Error *jsAPIError `json:"error,omitempty"`
+}
+
+// apiError returns the error reported by the call, if any
+func (r jsAPIResponse) apiError() error {
+	if r.Error == nil {
+		return nil
+	}
+	return fmt.Errorf("%s", r.Error.Description)
+}
+
+// jsAPIResult is a JetStream API response
+type jsAPIResult interface {
+	apiError() error
+}
+
+// callJetStreamAPI call a JetStream API directly, for the options the JetStream client
+// does not expose
+func (js jetStreamControllerImpl) callJetStreamAPI(
+	api string, request interface{}, response jsAPIResult, ctxt context.Context,
+) error {
+	if _, ok := ctxt.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctxt, cancel = context.WithTimeout(ctxt, jsAPITimeout)
+		defer cancel()
+	}
+	var payload []byte
+	if request != nil {
+		var err error
+		if payload, err = common.JSON().Marshal(request); err != nil {
+			return err
+		}
+	}
+	reply, err := js.core.NATs().RequestWithContext(ctxt, js.core.JetStreamAPISubject(api), payload)
+	if err != nil {
+		return err
+	}
+	if err := common.JSON().Unmarshal(reply.Data, response); err != nil {
+		return err
+	}
+	return response.apiError()
+}
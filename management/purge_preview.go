@@ -0,0 +1,212 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// JSStreamPurgePreviewParam selects the messages of a stream a purge would remove
+type JSStreamPurgePreviewParam struct {
+	// Subject limits the preview to the subjects matching this subject filter. All subjects
+	// if empty.
+	Subject string `json:"subject,omitempty"`
+	// FromSeq is the first sequence number of the range. From the first message if zero.
+	FromSeq uint64 `json:"from_seq,omitempty"`
+	// ToSeq is the last sequence number of the range. Up to the last message if zero.
+	ToSeq uint64 `json:"to_seq,omitempty" validate:"omitempty,gtefield=FromSeq"`
+}
+
+// StreamPurgePreview is how much of a stream a purge would remove
+type StreamPurgePreview struct {
+	// Messages is the number of messages which would be removed
+	Messages uint64 `json:"messages"`
+	// Bytes is the number of bytes which would be freed
+	Bytes uint64 `json:"bytes"`
+	// BytesEstimated indicates Bytes is estimated from the average message size of the
+	// stream, as JetStream only tracks the size of the whole stream
+	BytesEstimated bool `json:"bytes_estimated"`
+	// Subjects is the number of messages of each subject which would be removed, if the
+	// preview is limited to a subject filter
+	Subjects map[string]uint64 `json:"subjects,omitempty"`
+	// Scanned is the number of messages read to count the messages of the sequence range
+	Scanned uint64 `json:"scanned"`
+}
+
+// jsStreamInfoRequest is the request of the JetStream stream info API
+type jsStreamInfoRequest struct {
+	SubjectsFilter string `json:"subjects_filter,omitempty"`
+}
+
+// jsStreamState is the stream state reported by the JetStream stream info API, with the
+// message count of each subject matching the subject filter of the request
+type jsStreamState struct {
+	Msgs       uint64            `json:"messages"`
+	Bytes      uint64            `json:"bytes"`
+	FirstSeq   uint64            `json:"first_seq"`
+	LastSeq    uint64            `json:"last_seq"`
+	NumDeleted int               `json:"num_deleted"`
+	Subjects   map[string]uint64 `json:"subjects"`
+}
+
+// jsStreamInfoResponse is the response of the JetStream stream info API
+type jsStreamInfoResponse struct {
+	jsAPIResponse
+	State jsStreamState `json:"state"`
+}
+
+// streamPurgePreviewPlan counts the messages of a stream a purge would remove
+type streamPurgePreviewPlan struct {
+	state    jsStreamState
+	filtered bool
+	// first and last bound the sequence range, if ranged
+	ranged      bool
+	first, last uint64
+	scanned     uint64
+	counts      map[string]uint64
+}
+
+// defineStreamPurgePreviewPlan define a new streamPurgePreviewPlan. If the preview is
+// limited to a subject filter, state must list the subjects matching the filter.
+func defineStreamPurgePreviewPlan(
+	state jsStreamState, param JSStreamPurgePreviewParam,
+) *streamPurgePreviewPlan {
+	plan := &streamPurgePreviewPlan{
+		state:    state,
+		filtered: param.Subject != "",
+		ranged:   param.FromSeq > 0 || param.ToSeq > 0,
+		first:    state.FirstSeq,
+		last:     state.LastSeq,
+		counts:   map[string]uint64{},
+	}
+	if param.FromSeq > plan.first {
+		plan.first = param.FromSeq
+	}
+	if param.ToSeq > 0 && param.ToSeq < plan.last {
+		plan.last = param.ToSeq
+	}
+	return plan
+}
+
+// empty whether no message is selected
+func (p *streamPurgePreviewPlan) empty() bool {
+	return p.state.Msgs == 0 || p.first > p.last
+}
+
+// scanRange returns the sequence range to read to count the selected messages, if the
+// counts of the stream state are not enough
+func (p *streamPurgePreviewPlan) scanRange() (uint64, uint64, bool) {
+	if p.empty() || !p.ranged {
+		return 0, 0, false
+	}
+	// Without deleted messages, every sequence number in range is a message
+	if !p.filtered && p.state.NumDeleted == 0 {
+		return 0, 0, false
+	}
+	return p.first, p.last, true
+}
+
+// record a message of the scanned range
+func (p *streamPurgePreviewPlan) record(subject string) {
+	p.scanned++
+	if p.filtered {
+		if _, ok := p.state.Subjects[subject]; !ok {
+			return
+		}
+	}
+	p.counts[subject]++
+}
+
+// result returns the preview
+func (p *streamPurgePreviewPlan) result() StreamPurgePreview {
+	result := StreamPurgePreview{Scanned: p.scanned}
+	if p.empty() {
+		return result
+	}
+	if !p.ranged && !p.filtered {
+		result.Messages = p.state.Msgs
+		result.Bytes = p.state.Bytes
+		return result
+	}
+	counts := p.counts
+	if !p.ranged {
+		counts = p.state.Subjects
+	}
+	if _, _, scanned := p.scanRange(); p.ranged && !scanned {
+		result.Messages = p.last - p.first + 1
+	} else {
+		for _, count := range counts {
+			result.Messages += count
+		}
+	}
+	if p.filtered {
+		result.Subjects = map[string]uint64{}
+		for subject, count := range counts {
+			result.Subjects[subject] = count
+		}
+	}
+	result.Bytes = result.Messages * p.state.Bytes / p.state.Msgs
+	result.BytesEstimated = true
+	return result
+}
+
+// PreviewStreamPurge reports how many messages, and bytes, of a stream a purge of the
+// selected messages would remove, without removing them
+func (js jetStreamControllerImpl) PreviewStreamPurge(
+	stream string, param JSStreamPurgePreviewParam, ctxt context.Context,
+) (StreamPurgePreview, error) {
+	localLogTags, err := common.UpdateLogTags(js.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(js.LogTags).Errorf("Failed to update logtags")
+	}
+	if err := js.validate.Struct(&param); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Invalid purge preview parameters")
+		return StreamPurgePreview{}, err
+	}
+	// The JetStream client does not expose the subject filter, so the API is called directly
+	var info jsStreamInfoResponse
+	if err := js.callJetStreamAPI(
+		fmt.Sprintf("STREAM.INFO.%s", stream),
+		jsStreamInfoRequest{SubjectsFilter: param.Subject},
+		&info,
+		ctxt,
+	); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to get stream %s info", stream)
+		return StreamPurgePreview{}, err
+	}
+
+	plan := defineStreamPurgePreviewPlan(info.State, param)
+	if first, last, ok := plan.scanRange(); ok {
+		for seq := first; seq <= last; seq++ {
+			msg, err := js.core.JetStream().GetMsg(stream, seq, nats.Context(ctxt))
+			if err == nats.ErrMsgNotFound {
+				// Already deleted
+				continue
+			} else if err != nil {
+				log.WithError(err).WithFields(localLogTags).Errorf(
+					"Unable to read message %d of stream %s", seq, stream,
+				)
+				return StreamPurgePreview{}, err
+			}
+			plan.record(msg.Subject)
+		}
+	}
+	return plan.result(), nil
+}
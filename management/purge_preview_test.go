@@ -0,0 +1,117 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamPurgePreviewPlan(t *testing.T) {
+	assert := assert.New(t)
+
+	state := jsStreamState{Msgs: 8, Bytes: 800, FirstSeq: 3, LastSeq: 10}
+
+	// Case 0: the whole stream is counted from the stream state
+	{
+		uut := defineStreamPurgePreviewPlan(state, JSStreamPurgePreviewParam{})
+		_, _, scan := uut.scanRange()
+		assert.False(scan)
+		assert.Equal(StreamPurgePreview{Messages: 8, Bytes: 800}, uut.result())
+	}
+
+	// Case 1: a subject filter is counted from the subject counts
+	{
+		filtered := state
+		filtered.Subjects = map[string]uint64{"orders.eu": 2, "orders.us": 3}
+		uut := defineStreamPurgePreviewPlan(filtered, JSStreamPurgePreviewParam{Subject: "orders.*"})
+		_, _, scan := uut.scanRange()
+		assert.False(scan)
+		assert.Equal(
+			StreamPurgePreview{
+				Messages:       5,
+				Bytes:          500,
+				BytesEstimated: true,
+				Subjects:       map[string]uint64{"orders.eu": 2, "orders.us": 3},
+			},
+			uut.result(),
+		)
+	}
+
+	// Case 2: a range without deleted messages is counted from its bounds, clamped to the
+	// stream
+	{
+		uut := defineStreamPurgePreviewPlan(state, JSStreamPurgePreviewParam{FromSeq: 1, ToSeq: 5})
+		_, _, scan := uut.scanRange()
+		assert.False(scan)
+		assert.Equal(
+			StreamPurgePreview{Messages: 3, Bytes: 300, BytesEstimated: true}, uut.result(),
+		)
+	}
+
+	// Case 3: a range with deleted messages is scanned
+	{
+		deleted := state
+		deleted.Msgs = 7
+		deleted.NumDeleted = 1
+		uut := defineStreamPurgePreviewPlan(deleted, JSStreamPurgePreviewParam{FromSeq: 8})
+		first, last, scan := uut.scanRange()
+		assert.True(scan)
+		assert.Equal(uint64(8), first)
+		assert.Equal(uint64(10), last)
+		uut.record("orders.eu")
+		uut.record("orders.us")
+		assert.Equal(
+			StreamPurgePreview{Messages: 2, Bytes: 228, BytesEstimated: true, Scanned: 2},
+			uut.result(),
+		)
+	}
+
+	// Case 4: a subject filter over a range is scanned for the matching subjects
+	{
+		filtered := state
+		filtered.Subjects = map[string]uint64{"orders.eu": 2}
+		uut := defineStreamPurgePreviewPlan(
+			filtered, JSStreamPurgePreviewParam{Subject: "orders.eu", ToSeq: 6},
+		)
+		first, last, scan := uut.scanRange()
+		assert.True(scan)
+		assert.Equal(uint64(3), first)
+		assert.Equal(uint64(6), last)
+		uut.record("orders.eu")
+		uut.record("orders.us")
+		uut.record("orders.us")
+		uut.record("orders.eu")
+		assert.Equal(
+			StreamPurgePreview{
+				Messages:       2,
+				Bytes:          200,
+				BytesEstimated: true,
+				Subjects:       map[string]uint64{"orders.eu": 2},
+				Scanned:        4,
+			},
+			uut.result(),
+		)
+	}
+
+	// Case 5: a range past the end of the stream selects nothing
+	{
+		uut := defineStreamPurgePreviewPlan(state, JSStreamPurgePreviewParam{FromSeq: 11})
+		_, _, scan := uut.scanRange()
+		assert.False(scan)
+		assert.Equal(StreamPurgePreview{}, uut.result())
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// TopologyRequirements are the streams, and the consumers on them, a server needs to operate
+type TopologyRequirements struct {
+	Streams []StreamRequirement `json:"streams" validate:"dive"`
+}
+
+// StreamRequirement is a stream, and the consumers on it, which must exist
+type StreamRequirement struct {
+	JSStreamParam
+	// Consumers are the consumers which must exist on the stream
+	Consumers []JetStreamConsumerParam `json:"consumers,omitempty" validate:"dive"`
+}
+
+// LoadTopologyRequirements read the TopologyRequirements from a JSON file
+func LoadTopologyRequirements(path string) (TopologyRequirements, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return TopologyRequirements{}, err
+	}
+	var required TopologyRequirements
+	if err := json.Unmarshal(content, &required); err != nil {
+		return TopologyRequirements{}, fmt.Errorf(
+			"unable to parse topology requirements %s: %w", path, err,
+		)
+	}
+	if err := validator.New().Struct(&required); err != nil {
+		return TopologyRequirements{}, err
+	}
+	return required, nil
+}
+
+// EnsureTopology verify the required streams and consumers exist. If create, the missing
+// ones are created; otherwise, they are reported together as one error.
+//
+// Only existence is checked. The settings of existing streams and consumers are not
+// compared against the requirements.
+func EnsureTopology(
+	controller JetStreamController,
+	required TopologyRequirements,
+	create bool,
+	ctxt context.Context,
+) error {
+	missing := []string{}
+	for _, stream := range required.Streams {
+		_, err := controller.GetStream(stream.Name, ctxt)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			if !create {
+				missing = append(missing, fmt.Sprintf("stream %s", stream.Name))
+				continue
+			}
+			if err := controller.CreateStream(stream.JSStreamParam, ctxt); err != nil {
+				return fmt.Errorf("unable to create stream %s: %w", stream.Name, err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("unable to read stream %s: %w", stream.Name, err)
+		}
+		for _, consumer := range stream.Consumers {
+			_, err := controller.GetConsumerForStream(stream.Name, consumer.Name, ctxt)
+			if errors.Is(err, nats.ErrConsumerNotFound) {
+				if !create {
+					missing = append(missing, fmt.Sprintf("consumer %s@%s", consumer.Name, stream.Name))
+					continue
+				}
+				if err := controller.CreateConsumerForStream(stream.Name, consumer, ctxt); err != nil {
+					return fmt.Errorf(
+						"unable to create consumer %s@%s: %w", consumer.Name, stream.Name, err,
+					)
+				}
+			} else if err != nil {
+				return fmt.Errorf("unable to read consumer %s@%s: %w", consumer.Name, stream.Name, err)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %v", missing)
+	}
+	return nil
+}
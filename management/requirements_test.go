@@ -0,0 +1,133 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubTopologyController implements the parts of JetStreamController EnsureTopology uses
+type stubTopologyController struct {
+	JetStreamController
+	streams   map[string]bool
+	consumers map[string]bool
+	calls     []string
+}
+
+func (c *stubTopologyController) GetStream(
+	name string, ctxt context.Context,
+) (*nats.StreamInfo, error) {
+	if c.streams[name] {
+		return &nats.StreamInfo{Config: nats.StreamConfig{Name: name}}, nil
+	}
+	return nil, nats.ErrStreamNotFound
+}
+
+func (c *stubTopologyController) CreateStream(param JSStreamParam, ctxt context.Context) error {
+	c.calls = append(c.calls, "create-stream "+param.Name)
+	c.streams[param.Name] = true
+	return nil
+}
+
+func (c *stubTopologyController) GetConsumerForStream(
+	stream, consumerName string, ctxt context.Context,
+) (*nats.ConsumerInfo, error) {
+	if c.consumers[stream+"/"+consumerName] {
+		return &nats.ConsumerInfo{Name: consumerName}, nil
+	}
+	return nil, nats.ErrConsumerNotFound
+}
+
+func (c *stubTopologyController) CreateConsumerForStream(
+	stream string, param JetStreamConsumerParam, ctxt context.Context,
+) error {
+	c.calls = append(c.calls, "create-consumer "+stream+"/"+param.Name)
+	c.consumers[stream+"/"+param.Name] = true
+	return nil
+}
+
+func TestTopologyRequirements(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	writeRequirements := func(content string) string {
+		path := filepath.Join(dir, "requirements.json")
+		assert.Nil(os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	// Case 0: invalid requirements files
+	{
+		_, err := LoadTopologyRequirements(filepath.Join(dir, "missing.json"))
+		assert.NotNil(err)
+		_, err = LoadTopologyRequirements(writeRequirements(`{"streams":`))
+		assert.NotNil(err)
+		_, err = LoadTopologyRequirements(writeRequirements(
+			`{"streams":[{"name":"orders","consumers":[{"name":"billing","mode":"push"}]}]}`,
+		))
+		assert.NotNil(err)
+	}
+
+	required, err := LoadTopologyRequirements(writeRequirements(
+		`{"streams":[{"name":"orders","subjects":["orders.*"],"consumers":[` +
+			`{"name":"billing","max_inflight":1,"mode":"push"},` +
+			`{"name":"audit","max_inflight":4,"mode":"pull"}]}]}`,
+	))
+	assert.Nil(err)
+	assert.Len(required.Streams, 1)
+	assert.Equal([]string{"orders.*"}, required.Streams[0].Subjects)
+	assert.Len(required.Streams[0].Consumers, 2)
+
+	controller := &stubTopologyController{
+		streams: map[string]bool{"orders": true}, consumers: map[string]bool{"orders/billing": true},
+	}
+
+	// Case 1: missing consumer is reported without create
+	{
+		err := EnsureTopology(controller, required, false, context.Background())
+		assert.NotNil(err)
+		assert.Contains(err.Error(), "audit@orders")
+		assert.NotContains(err.Error(), "billing@orders")
+		assert.Empty(controller.calls)
+	}
+
+	// Case 2: missing consumer is created
+	{
+		assert.Nil(EnsureTopology(controller, required, true, context.Background()))
+		assert.Equal([]string{"create-consumer orders/audit"}, controller.calls)
+	}
+
+	// Case 3: missing stream is created, along with its consumers
+	{
+		controller := &stubTopologyController{
+			streams: map[string]bool{}, consumers: map[string]bool{},
+		}
+		assert.NotNil(EnsureTopology(controller, required, false, context.Background()))
+		assert.Nil(EnsureTopology(controller, required, true, context.Background()))
+		assert.Equal(
+			[]string{
+				"create-stream orders", "create-consumer orders/billing", "create-consumer orders/audit",
+			},
+			controller.calls,
+		)
+		assert.Nil(EnsureTopology(controller, required, false, context.Background()))
+	}
+}
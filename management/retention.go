@@ -0,0 +1,100 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"fmt"
+	"time"
+)
+
+// JSStreamRetention is the subset of stream data retention limits which control how much
+// data a stream stores
+type JSStreamRetention struct {
+	// MaxMsgs is the max number of messages the stream will store.
+	//
+	// Oldest messages are removed once limit breached.
+	MaxMsgs *int64 `json:"max_msgs,omitempty"`
+	// MaxBytes is the max number of message bytes the stream will store.
+	//
+	// Oldest messages are removed once limit breached.
+	MaxBytes *int64 `json:"max_bytes,omitempty"`
+	// MaxAge is the max duration (ns) the stream will store a message
+	//
+	// Messages breaching the limit will be removed.
+	MaxAge *time.Duration `json:"max_age,omitempty" swaggertype:"primitive,integer"`
+}
+
+// StreamLimits convert into the equivalent JSStreamLimits
+func (r JSStreamRetention) StreamLimits() JSStreamLimits {
+	return JSStreamLimits{MaxMsgs: r.MaxMsgs, MaxBytes: r.MaxBytes, MaxAge: r.MaxAge}
+}
+
+// StreamRetentionGuardrails are operator defined upper bounds on the data retention limits
+// of a stream. A zero value means no bound.
+type StreamRetentionGuardrails struct {
+	// MaxMsgs is the highest permitted max_msgs of a stream
+	MaxMsgs int64 `validate:"gte=0"`
+	// MaxBytes is the highest permitted max_bytes of a stream
+	MaxBytes int64 `validate:"gte=0"`
+	// MaxAge is the highest permitted max_age of a stream
+	MaxAge time.Duration `validate:"gte=0"`
+}
+
+// Check verify the provided limits against the guardrails, and return a description of each
+// violation. Limits which are not set are not checked.
+//
+// JetStream treats a limit <= 0 as unlimited, which violates a set guardrail.
+func (g StreamRetentionGuardrails) Check(limits JSStreamLimits) []string {
+	violations := []string{}
+	if g.MaxMsgs > 0 && limits.MaxMsgs != nil {
+		if *limits.MaxMsgs <= 0 || *limits.MaxMsgs > g.MaxMsgs {
+			violations = append(violations, fmt.Sprintf(
+				"max_msgs %d is outside the permitted range [1, %d]", *limits.MaxMsgs, g.MaxMsgs,
+			))
+		}
+	}
+	if g.MaxBytes > 0 && limits.MaxBytes != nil {
+		if *limits.MaxBytes <= 0 || *limits.MaxBytes > g.MaxBytes {
+			violations = append(violations, fmt.Sprintf(
+				"max_bytes %d is outside the permitted range [1, %d]", *limits.MaxBytes, g.MaxBytes,
+			))
+		}
+	}
+	if g.MaxAge > 0 && limits.MaxAge != nil {
+		if *limits.MaxAge <= 0 || *limits.MaxAge > g.MaxAge {
+			violations = append(violations, fmt.Sprintf(
+				"max_age %s is outside the permitted range (0s, %s]", *limits.MaxAge, g.MaxAge,
+			))
+		}
+	}
+	return violations
+}
+
+// ApplyDefaults set the limits which are not set, and have a guardrail, to the guardrail.
+// This is used when defining a new stream, which would otherwise be unlimited.
+func (g StreamRetentionGuardrails) ApplyDefaults(limits *JSStreamLimits) {
+	if g.MaxMsgs > 0 && limits.MaxMsgs == nil {
+		maxMsgs := g.MaxMsgs
+		limits.MaxMsgs = &maxMsgs
+	}
+	if g.MaxBytes > 0 && limits.MaxBytes == nil {
+		maxBytes := g.MaxBytes
+		limits.MaxBytes = &maxBytes
+	}
+	if g.MaxAge > 0 && limits.MaxAge == nil {
+		maxAge := g.MaxAge
+		limits.MaxAge = &maxAge
+	}
+}
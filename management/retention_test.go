@@ -0,0 +1,67 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamRetentionGuardrails(t *testing.T) {
+	assert := assert.New(t)
+
+	uut := StreamRetentionGuardrails{MaxBytes: 1024, MaxAge: time.Hour}
+
+	// Case 0: limits within the guardrails
+	{
+		maxBytes := int64(1024)
+		maxAge := time.Minute
+		maxMsgs := int64(-1)
+		limits := JSStreamRetention{MaxMsgs: &maxMsgs, MaxBytes: &maxBytes, MaxAge: &maxAge}
+		assert.Empty(uut.Check(limits.StreamLimits()))
+	}
+
+	// Case 1: limits exceed the guardrails
+	{
+		maxBytes := int64(1025)
+		maxAge := time.Hour * 2
+		limits := JSStreamRetention{MaxBytes: &maxBytes, MaxAge: &maxAge}
+		violations := uut.Check(limits.StreamLimits())
+		assert.Len(violations, 2)
+		assert.Contains(violations[0], "max_bytes")
+		assert.Contains(violations[1], "max_age")
+	}
+
+	// Case 2: unlimited is not permitted when a guardrail is set
+	{
+		maxBytes := int64(-1)
+		limits := JSStreamRetention{MaxBytes: &maxBytes}
+		assert.Len(uut.Check(limits.StreamLimits()), 1)
+	}
+
+	// Case 3: unset limits default to the guardrails
+	{
+		maxAge := time.Minute
+		limits := JSStreamLimits{MaxAge: &maxAge}
+		uut.ApplyDefaults(&limits)
+		assert.Nil(limits.MaxMsgs)
+		assert.NotNil(limits.MaxBytes)
+		assert.Equal(int64(1024), *limits.MaxBytes)
+		assert.Equal(time.Minute, *limits.MaxAge)
+		assert.Empty(uut.Check(limits))
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AlertTypeStreamStorageHigh alert type for a stream approaching its storage limits
+const AlertTypeStreamStorageHigh = "stream-storage-high"
+
+// StreamUtilization is the storage utilization of a stream relative to its limits
+type StreamUtilization struct {
+	// Msgs is the number of messages in the stream
+	Msgs uint64 `json:"messages"`
+	// MaxMsgs is the max number of messages the stream will store (-1: unlimited)
+	MaxMsgs int64 `json:"max_msgs"`
+	// MsgsRatio is Msgs / MaxMsgs. Not set if MaxMsgs is unlimited.
+	MsgsRatio *float64 `json:"msgs_ratio,omitempty"`
+	// Bytes is the number of message bytes in the stream
+	Bytes uint64 `json:"bytes"`
+	// MaxBytes is the max number of message bytes the stream will store (-1: unlimited)
+	MaxBytes int64 `json:"max_bytes"`
+	// BytesRatio is Bytes / MaxBytes. Not set if MaxBytes is unlimited.
+	BytesRatio *float64 `json:"bytes_ratio,omitempty"`
+}
+
+// HighestRatio returns the higher of MsgsRatio and BytesRatio, or 0 if both are unlimited
+func (u StreamUtilization) HighestRatio() float64 {
+	highest := 0.0
+	if u.MsgsRatio != nil && *u.MsgsRatio > highest {
+		highest = *u.MsgsRatio
+	}
+	if u.BytesRatio != nil && *u.BytesRatio > highest {
+		highest = *u.BytesRatio
+	}
+	return highest
+}
+
+// GetStreamUtilization compute the storage utilization of a stream
+func GetStreamUtilization(info *nats.StreamInfo) StreamUtilization {
+	result := StreamUtilization{
+		Msgs:     info.State.Msgs,
+		MaxMsgs:  info.Config.MaxMsgs,
+		Bytes:    info.State.Bytes,
+		MaxBytes: info.Config.MaxBytes,
+	}
+	if info.Config.MaxMsgs > 0 {
+		ratio := float64(info.State.Msgs) / float64(info.Config.MaxMsgs)
+		result.MsgsRatio = &ratio
+	}
+	if info.Config.MaxBytes > 0 {
+		ratio := float64(info.State.Bytes) / float64(info.Config.MaxBytes)
+		result.BytesRatio = &ratio
+	}
+	return result
+}
+
+// ==============================================================================
+
+// StreamUsageMonitor periodically inspects the storage utilization of all streams, and
+// warns when a stream approaches its storage limits
+type StreamUsageMonitor interface {
+	// Start begins periodically checking the streams
+	Start(interval time.Duration) error
+	// Stop stops checking the streams
+	Stop() error
+}
+
+// streamUsageMonitorImpl implements StreamUsageMonitor
+type streamUsageMonitorImpl struct {
+	common.Component
+	instance     string
+	controller   JetStreamController
+	sink         alerts.AlertSink
+	utilization  *prometheus.GaugeVec
+	warnRatio    float64
+	timer        common.IntervalTimer
+	queryTimeout time.Duration
+	rootContext  context.Context
+	// highUsage the set of streams currently above the warning ratio
+	highUsage map[string]bool
+	// reported the set of streams with utilization reported in the metrics
+	reported map[string]bool
+}
+
+// GetStreamUsageMonitor define a new StreamUsageMonitor
+//
+// A stream is considered to be approaching its storage limits if its message count or
+// message bytes is above warnRatio of the max. If sink is nil, warnings are only logged.
+// If registerer is not nil, the utilization of each stream is reported as the Prometheus
+// gauge "httpmq_stream_utilization_ratio", by stream and limit (messages or bytes).
+func GetStreamUsageMonitor(
+	controller JetStreamController,
+	sink alerts.AlertSink,
+	registerer prometheus.Registerer,
+	warnRatio float64,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (StreamUsageMonitor, error) {
+	logTags := log.Fields{
+		"module":    "management",
+		"component": "stream-usage-monitor",
+		"instance":  instance,
+	}
+	if warnRatio <= 0 || warnRatio > 1 {
+		return nil, fmt.Errorf("stream usage warn ratio must be in (0, 1]")
+	}
+	utilization := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "httpmq",
+		Subsystem: "stream",
+		Name:      "utilization_ratio",
+		Help:      "Storage of each stream relative to its limit, by limit",
+	}, []string{"stream", "limit"})
+	if registerer != nil {
+		if err := registerer.Register(utilization); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to register stream usage metrics")
+			return nil, err
+		}
+	}
+	timer, err := common.GetIntervalTimerInstance(
+		fmt.Sprintf("%s.stream-usage-monitor", instance), rootCtxt, wg,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		return nil, err
+	}
+	return &streamUsageMonitorImpl{
+		Component:    common.Component{LogTags: logTags},
+		instance:     instance,
+		controller:   controller,
+		sink:         sink,
+		utilization:  utilization,
+		warnRatio:    warnRatio,
+		timer:        timer,
+		queryTimeout: time.Second * 5,
+		rootContext:  rootCtxt,
+		highUsage:    make(map[string]bool),
+		reported:     make(map[string]bool),
+	}, nil
+}
+
+// Start begins periodically checking the streams
+func (m *streamUsageMonitorImpl) Start(interval time.Duration) error {
+	return m.timer.Start(interval, m.checkStreams, false)
+}
+
+// Stop stops checking the streams
+func (m *streamUsageMonitorImpl) Stop() error {
+	return m.timer.Stop()
+}
+
+// checkStreams support IntervalTimer, query all streams and raise alerts as needed
+func (m *streamUsageMonitorImpl) checkStreams() error {
+	ctxt, cancel := context.WithTimeout(m.rootContext, m.queryTimeout)
+	defer cancel()
+	now := time.Now()
+	allStreams := m.controller.GetAllStreams(ctxt)
+	for _, info := range allStreams {
+		alert := m.evaluateStream(info, now)
+		if alert == nil {
+			continue
+		}
+		log.WithFields(m.LogTags).Warnf("Raising %s: %s", alert, alert.Message)
+		if m.sink != nil {
+			if err := m.sink.Send(*alert, ctxt); err != nil {
+				log.WithError(err).WithFields(m.LogTags).Errorf("Failed to send %s", alert)
+			}
+		}
+	}
+	// Forget streams which no longer exist
+	for streamName := range m.highUsage {
+		if _, ok := allStreams[streamName]; !ok {
+			delete(m.highUsage, streamName)
+		}
+	}
+	for streamName := range m.reported {
+		if _, ok := allStreams[streamName]; !ok {
+			m.utilization.DeletePartialMatch(prometheus.Labels{"stream": streamName})
+			delete(m.reported, streamName)
+		}
+	}
+	return nil
+}
+
+// reportUtilization update the utilization metrics of a stream. Limits which are unlimited
+// are not reported.
+func (m *streamUsageMonitorImpl) reportUtilization(stream string, usage StreamUtilization) {
+	m.reported[stream] = true
+	for limit, ratio := range map[string]*float64{
+		"messages": usage.MsgsRatio, "bytes": usage.BytesRatio,
+	} {
+		if ratio == nil {
+			m.utilization.DeleteLabelValues(stream, limit)
+		} else {
+			m.utilization.WithLabelValues(stream, limit).Set(*ratio)
+		}
+	}
+}
+
+// evaluateStream update the usage state of a stream, and return the alert to raise if the
+// stream crossed the warning ratio in either direction.
+func (m *streamUsageMonitorImpl) evaluateStream(
+	info *nats.StreamInfo, now time.Time,
+) *alerts.Alert {
+	usage := GetStreamUtilization(info)
+	m.reportUtilization(info.Config.Name, usage)
+	highest := usage.HighestRatio()
+	high := highest >= m.warnRatio
+	if high == m.highUsage[info.Config.Name] {
+		return nil
+	}
+	m.highUsage[info.Config.Name] = high
+	var msg string
+	if high {
+		msg = fmt.Sprintf(
+			"storage at %.1f%% of limit (%d/%d msgs, %d/%d bytes)",
+			highest*100, usage.Msgs, usage.MaxMsgs, usage.Bytes, usage.MaxBytes,
+		)
+	} else {
+		msg = fmt.Sprintf("storage at %.1f%% of limit", highest*100)
+	}
+	return &alerts.Alert{
+		Type:      AlertTypeStreamStorageHigh,
+		Resolved:  !high,
+		Source:    m.instance,
+		Stream:    info.Config.Name,
+		Message:   msg,
+		Timestamp: now,
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package management
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamUsageEvaluation(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	// Case 0: invalid warn ratio
+	{
+		_, err := GetStreamUsageMonitor(nil, nil, nil, 0, "ut-stream-monitor", utCtxt, &wg)
+		assert.NotNil(err)
+		_, err = GetStreamUsageMonitor(nil, nil, nil, 1.5, "ut-stream-monitor", utCtxt, &wg)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetStreamUsageMonitor(nil, nil, prometheus.NewRegistry(), 0.8, "ut-stream-monitor", utCtxt, &wg)
+	assert.Nil(err)
+	uutc := uut.(*streamUsageMonitorImpl)
+
+	start := time.Now()
+	info := nats.StreamInfo{
+		Config: nats.StreamConfig{Name: "stream", MaxMsgs: 100, MaxBytes: -1},
+	}
+
+	// Case 1: stream usage well within limits
+	{
+		info.State.Msgs = 10
+		info.State.Bytes = 1000
+		usage := GetStreamUtilization(&info)
+		assert.NotNil(usage.MsgsRatio)
+		assert.InDelta(0.1, *usage.MsgsRatio, 1e-9)
+		assert.Nil(usage.BytesRatio)
+		assert.InDelta(0.1, usage.HighestRatio(), 1e-9)
+		assert.Nil(uutc.evaluateStream(&info, start))
+		assert.InDelta(
+			0.1, testutil.ToFloat64(uutc.utilization.WithLabelValues("stream", "messages")), 1e-9,
+		)
+	}
+
+	// Case 2: stream message count above warn ratio
+	{
+		info.State.Msgs = 85
+		alert := uutc.evaluateStream(&info, start.Add(time.Second))
+		assert.NotNil(alert)
+		assert.Equal(AlertTypeStreamStorageHigh, alert.Type)
+		assert.False(alert.Resolved)
+		assert.Equal("stream", alert.Stream)
+		// No repeated alert while still high
+		assert.Nil(uutc.evaluateStream(&info, start.Add(time.Second*2)))
+	}
+
+	// Case 3: stream bytes limit dominates
+	{
+		info.State.Msgs = 20
+		info.Config.MaxBytes = 1100
+		usage := GetStreamUtilization(&info)
+		assert.NotNil(usage.BytesRatio)
+		assert.InDelta(1000.0/1100.0, usage.HighestRatio(), 1e-9)
+		assert.Nil(uutc.evaluateStream(&info, start.Add(time.Second*3)))
+		assert.InDelta(
+			1000.0/1100.0,
+			testutil.ToFloat64(uutc.utilization.WithLabelValues("stream", "bytes")),
+			1e-9,
+		)
+	}
+
+	// Case 4: stream usage falls back below warn ratio
+	{
+		info.State.Bytes = 100
+		alert := uutc.evaluateStream(&info, start.Add(time.Second*4))
+		assert.NotNil(alert)
+		assert.Equal(AlertTypeStreamStorageHigh, alert.Type)
+		assert.True(alert.Resolved)
+	}
+
+	// Case 5: stream with no limits
+	{
+		info.Config.MaxMsgs = -1
+		info.Config.MaxBytes = -1
+		usage := GetStreamUtilization(&info)
+		assert.Nil(usage.MsgsRatio)
+		assert.Nil(usage.BytesRatio)
+		assert.Equal(0.0, usage.HighestRatio())
+		assert.Nil(uutc.evaluateStream(&info, start.Add(time.Second*5)))
+		assert.Equal(0, testutil.CollectAndCount(uutc.utilization))
+	}
+}
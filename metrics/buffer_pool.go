@@ -0,0 +1,64 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/alwitt/httpmq/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterBufferPoolMetrics registers the usage counters of a buffer pool as Prometheus
+// metrics, labeled with the pool's name
+func RegisterBufferPoolMetrics(
+	pool common.BufferPool, name string, registerer prometheus.Registerer,
+) error {
+	labels := prometheus.Labels{"pool": name}
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "httpmq",
+			Subsystem:   "buffer_pool",
+			Name:        "gets_total",
+			Help:        "Number of buffers taken from the pool",
+			ConstLabels: labels,
+		}, func() float64 { return float64(pool.Stats().Gets) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "httpmq",
+			Subsystem:   "buffer_pool",
+			Name:        "allocations_total",
+			Help:        "Number of buffers allocated because the pool was empty",
+			ConstLabels: labels,
+		}, func() float64 { return float64(pool.Stats().Allocations) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "httpmq",
+			Subsystem:   "buffer_pool",
+			Name:        "discards_total",
+			Help:        "Number of returned buffers dropped for being over the retained size",
+			ConstLabels: labels,
+		}, func() float64 { return float64(pool.Stats().Discards) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "httpmq",
+			Subsystem:   "buffer_pool",
+			Name:        "in_use",
+			Help:        "Number of buffers taken from the pool and not yet returned",
+			ConstLabels: labels,
+		}, func() float64 { return float64(pool.Stats().InUse) }),
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPoolMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := prometheus.NewRegistry()
+	pool, err := common.GetBufferPool(1024)
+	assert.Nil(err)
+	assert.Nil(RegisterBufferPoolMetrics(pool, "ut-pool", registry))
+
+	// Case 0: the same pool name can not be registered twice
+	assert.NotNil(RegisterBufferPoolMetrics(pool, "ut-pool", registry))
+
+	// Case 1: metrics follow the pool usage
+	{
+		held := pool.Get()
+		pool.Put(pool.Get())
+		families, err := registry.Gather()
+		assert.Nil(err)
+		values := map[string]float64{}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				assert.Equal("ut-pool", metric.GetLabel()[0].GetValue())
+				if metric.GetCounter() != nil {
+					values[family.GetName()] = metric.GetCounter().GetValue()
+				} else {
+					values[family.GetName()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+		assert.Equal(2.0, values["httpmq_buffer_pool_gets_total"])
+		assert.Equal(0.0, values["httpmq_buffer_pool_discards_total"])
+		assert.Equal(1.0, values["httpmq_buffer_pool_in_use"])
+		assert.Contains(values, "httpmq_buffer_pool_allocations_total")
+		pool.Put(held)
+	}
+}
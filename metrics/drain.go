@@ -0,0 +1,69 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DrainMetrics records the progress of draining the sessions on shutdown
+type DrainMetrics interface {
+	// ObserveDrain records the sessions and the messages awaiting ACK left to drain, and the
+	// estimated time until the drain completes
+	ObserveDrain(sessions, inflight int, remaining time.Duration)
+}
+
+// drainMetricsImpl implements DrainMetrics
+type drainMetricsImpl struct {
+	draining  prometheus.Gauge
+	sessions  prometheus.Gauge
+	inflight  prometheus.Gauge
+	remaining prometheus.Gauge
+}
+
+// GetDrainMetrics define a new DrainMetrics, registered with registerer
+func GetDrainMetrics(registerer prometheus.Registerer) (DrainMetrics, error) {
+	gauge := func(name, help string) prometheus.Gauge {
+		return prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "httpmq", Subsystem: "shutdown", Name: name, Help: help,
+		})
+	}
+	m := &drainMetricsImpl{
+		draining: gauge("draining", "1 while the sessions are draining for shutdown"),
+		sessions: gauge("sessions_remaining", "Number of sessions left to drain on shutdown"),
+		inflight: gauge(
+			"inflight_messages", "Number of messages awaiting ACK on the draining sessions",
+		),
+		remaining: gauge(
+			"estimated_remaining_seconds", "Estimated seconds until the drain for shutdown completes",
+		),
+	}
+	for _, collector := range []prometheus.Collector{m.draining, m.sessions, m.inflight, m.remaining} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ObserveDrain records the progress of the drain
+func (m *drainMetricsImpl) ObserveDrain(sessions, inflight int, remaining time.Duration) {
+	m.draining.Set(1)
+	m.sessions.Set(float64(sessions))
+	m.inflight.Set(float64(inflight))
+	m.remaining.Set(remaining.Seconds())
+}
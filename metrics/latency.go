@@ -0,0 +1,356 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics tracks the operating metrics of httpmq, and exposes them to Prometheus
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyBuckets upper bounds, in seconds, of the ACK latency histogram buckets
+var latencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300,
+}
+
+// ConsumerLatencyParam settings for tracking the ACK latency of consumers
+type ConsumerLatencyParam struct {
+	// Window is the recent period over which the latency of a consumer is summarized
+	Window time.Duration `validate:"gt=0"`
+	// SlowThreshold is the p99 latency above which a consumer is slow. "0" disables slow
+	// consumer detection.
+	SlowThreshold time.Duration `validate:"gte=0"`
+	// MinSamples is the min number of ACKs within the window for a consumer to be slow
+	MinSamples uint64 `validate:"gte=1"`
+	// ThrottleRate is the max number of messages per second forwarded to a slow consumer's
+	// subscriptions. "0" disables throttling.
+	ThrottleRate float64 `validate:"gte=0"`
+}
+
+// ConsumerLatencyReport summarizes the recent latency from publish to ACK of the messages
+// of a consumer, as seen by one dataplane instance
+type ConsumerLatencyReport struct {
+	// Stream is the name of the stream
+	Stream string `json:"stream"`
+	// Consumer is the name of the consumer
+	Consumer string `json:"consumer"`
+	// Instance is the dataplane instance which tracked the latency
+	Instance string `json:"instance"`
+	// Samples is the number of ACKs within the window
+	Samples uint64 `json:"samples"`
+	// P50 is the estimated median latency
+	P50 time.Duration `json:"p50" swaggertype:"primitive,integer"`
+	// P99 is the estimated 99th percentile latency
+	P99 time.Duration `json:"p99" swaggertype:"primitive,integer"`
+	// Slow is whether P99 is above the slow consumer threshold
+	Slow bool `json:"slow"`
+	// Throttled is whether deliveries to the consumer are throttled for being slow
+	Throttled bool `json:"throttled"`
+	// Reported is when the report was made
+	Reported time.Time `json:"reported"`
+}
+
+// ConsumerLatencyTracker tracks the time from publish to ACK of the messages of each
+// consumer, and flags consumers whose recent p99 latency is above a threshold as slow
+type ConsumerLatencyTracker interface {
+	// RecordACK records the ACK of a message of a consumer, which was published at published
+	RecordACK(stream, consumer string, published time.Time)
+	// Throttle blocks until another message may be forwarded for the consumer. This returns
+	// at once unless the consumer is slow, and throttling is enabled.
+	Throttle(stream, consumer string, ctxt context.Context) error
+	// Reports returns the latency reports of all consumers with recent ACKs
+	Reports() []ConsumerLatencyReport
+}
+
+// consumerKey identifies a consumer
+type consumerKey struct {
+	stream, consumer string
+}
+
+// consumerLatency the recent latency records of a consumer
+type consumerLatency struct {
+	// current and previous are the bucket counts of the current and the previous half
+	// window. The last entry counts latencies above every bucket.
+	current, previous []uint64
+	slotStart         time.Time
+	samples           uint64
+	p50, p99          time.Duration
+	slow              bool
+	// nextForward is when the next message may be forwarded, if throttled
+	nextForward time.Time
+}
+
+// consumerLatencyTrackerImpl implements ConsumerLatencyTracker
+type consumerLatencyTrackerImpl struct {
+	common.Component
+	instance  string
+	param     ConsumerLatencyParam
+	lock      sync.Mutex
+	consumers map[consumerKey]*consumerLatency
+	histogram *prometheus.HistogramVec
+	slowGauge *prometheus.GaugeVec
+}
+
+// GetConsumerLatencyTracker define a new ConsumerLatencyTracker
+//
+// If registerer is not nil, the latency histograms, and whether each consumer is slow, are
+// registered as Prometheus metrics.
+func GetConsumerLatencyTracker(
+	param ConsumerLatencyParam, registerer prometheus.Registerer, instance string,
+) (ConsumerLatencyTracker, error) {
+	logTags := log.Fields{
+		"module": "metrics", "component": "consumer-latency", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Consumer latency settings invalid")
+		return nil, err
+	}
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "httpmq",
+		Subsystem: "consumer",
+		Name:      "ack_latency_seconds",
+		Help:      "Time from publish to ACK of the messages delivered through each consumer",
+		Buckets:   latencyBuckets,
+	}, []string{"stream", "consumer"})
+	slowGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "httpmq",
+		Subsystem: "consumer",
+		Name:      "slow",
+		Help:      "Whether each consumer's recent p99 ACK latency is above the slow threshold",
+	}, []string{"stream", "consumer"})
+	if registerer != nil {
+		for _, collector := range []prometheus.Collector{histogram, slowGauge} {
+			if err := registerer.Register(collector); err != nil {
+				log.WithError(err).WithFields(logTags).Errorf("Unable to register metrics")
+				return nil, err
+			}
+		}
+	}
+	return &consumerLatencyTrackerImpl{
+		Component: common.Component{LogTags: logTags},
+		instance:  instance,
+		param:     param,
+		consumers: make(map[consumerKey]*consumerLatency),
+		histogram: histogram,
+		slowGauge: slowGauge,
+	}, nil
+}
+
+// RecordACK records the ACK of a message of a consumer, which was published at published
+func (t *consumerLatencyTrackerImpl) RecordACK(stream, consumer string, published time.Time) {
+	now := time.Now()
+	latency := now.Sub(published)
+	if latency < 0 {
+		// Clocks of the NATS server and this instance differ
+		latency = 0
+	}
+	t.histogram.WithLabelValues(stream, consumer).Observe(latency.Seconds())
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := consumerKey{stream: stream, consumer: consumer}
+	stats, ok := t.consumers[key]
+	if !ok {
+		stats = &consumerLatency{
+			current:   make([]uint64, len(latencyBuckets)+1),
+			previous:  make([]uint64, len(latencyBuckets)+1),
+			slotStart: now,
+		}
+		t.consumers[key] = stats
+	}
+	t.rotate(stats, now)
+	stats.current[sort.SearchFloat64s(latencyBuckets, latency.Seconds())]++
+	t.evaluate(key, stats)
+}
+
+// rotate helper function to move the consumer's records on to the next half window, if
+// the current one has passed
+func (t *consumerLatencyTrackerImpl) rotate(stats *consumerLatency, now time.Time) bool {
+	halfWindow := t.param.Window / 2
+	elapsed := now.Sub(stats.slotStart)
+	if elapsed < halfWindow {
+		return false
+	}
+	if elapsed < halfWindow*2 {
+		copy(stats.previous, stats.current)
+	} else {
+		for idx := range stats.previous {
+			stats.previous[idx] = 0
+		}
+	}
+	for idx := range stats.current {
+		stats.current[idx] = 0
+	}
+	stats.slotStart = now
+	return true
+}
+
+// evaluate helper function to update the latency summary of a consumer, and whether it
+// is slow
+func (t *consumerLatencyTrackerImpl) evaluate(key consumerKey, stats *consumerLatency) {
+	counts := make([]uint64, len(stats.current))
+	stats.samples = 0
+	for idx := range counts {
+		counts[idx] = stats.current[idx] + stats.previous[idx]
+		stats.samples += counts[idx]
+	}
+	stats.p50 = estimateQuantile(counts, stats.samples, 0.5)
+	stats.p99 = estimateQuantile(counts, stats.samples, 0.99)
+	slow := t.param.SlowThreshold > 0 &&
+		stats.samples >= t.param.MinSamples &&
+		stats.p99 > t.param.SlowThreshold
+	if slow == stats.slow {
+		return
+	}
+	stats.slow = slow
+	if slow {
+		log.WithFields(t.LogTags).Warnf(
+			"Consumer %s@%s is slow: p99 ACK latency %s over %d ACKs",
+			key.consumer, key.stream, stats.p99, stats.samples,
+		)
+		t.slowGauge.WithLabelValues(key.stream, key.consumer).Set(1)
+	} else {
+		log.WithFields(t.LogTags).Infof("Consumer %s@%s is no longer slow", key.consumer, key.stream)
+		t.slowGauge.WithLabelValues(key.stream, key.consumer).Set(0)
+	}
+}
+
+// estimateQuantile helper function to estimate a quantile from bucket counts, by linear
+// interpolation within the bucket holding the quantile
+func estimateQuantile(counts []uint64, total uint64, quantile float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	rank := quantile * float64(total)
+	cumulative := uint64(0)
+	for idx, count := range counts {
+		if count == 0 || float64(cumulative+count) < rank {
+			cumulative += count
+			continue
+		}
+		if idx >= len(latencyBuckets) {
+			// Latencies above every bucket are reported as the largest bound
+			return time.Duration(latencyBuckets[len(latencyBuckets)-1] * float64(time.Second))
+		}
+		lower := 0.0
+		if idx > 0 {
+			lower = latencyBuckets[idx-1]
+		}
+		upper := latencyBuckets[idx]
+		fraction := (rank - float64(cumulative)) / float64(count)
+		return time.Duration((lower + (upper-lower)*fraction) * float64(time.Second))
+	}
+	return time.Duration(latencyBuckets[len(latencyBuckets)-1] * float64(time.Second))
+}
+
+// refresh helper function to rotate a consumer's records to the current time, and forget
+// consumers without recent ACKs
+func (t *consumerLatencyTrackerImpl) refresh(
+	key consumerKey, stats *consumerLatency, now time.Time,
+) {
+	if !t.rotate(stats, now) {
+		return
+	}
+	t.evaluate(key, stats)
+	if stats.samples == 0 {
+		delete(t.consumers, key)
+		t.slowGauge.DeleteLabelValues(key.stream, key.consumer)
+	}
+}
+
+// Throttle blocks until another message may be forwarded for the consumer. This returns
+// at once unless the consumer is slow, and throttling is enabled.
+func (t *consumerLatencyTrackerImpl) Throttle(
+	stream, consumer string, ctxt context.Context,
+) error {
+	if t.param.ThrottleRate <= 0 {
+		return nil
+	}
+	wait := t.reserveForward(consumerKey{stream: stream, consumer: consumer}, time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctxt.Done():
+		return fmt.Errorf("throttled consumer %s@%s: %w", consumer, stream, ctxt.Err())
+	}
+}
+
+// reserveForward helper function to reserve the next forwarding slot of a slow consumer.
+// Returns how long to wait for the slot.
+func (t *consumerLatencyTrackerImpl) reserveForward(key consumerKey, now time.Time) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stats, ok := t.consumers[key]
+	if !ok {
+		return 0
+	}
+	t.refresh(key, stats, now)
+	if !stats.slow {
+		return 0
+	}
+	if stats.nextForward.Before(now) {
+		stats.nextForward = now
+	}
+	wait := stats.nextForward.Sub(now)
+	stats.nextForward = stats.nextForward.Add(
+		time.Duration(float64(time.Second) / t.param.ThrottleRate),
+	)
+	return wait
+}
+
+// Reports returns the latency reports of all consumers with recent ACKs
+func (t *consumerLatencyTrackerImpl) Reports() []ConsumerLatencyReport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	reports := []ConsumerLatencyReport{}
+	for key, stats := range t.consumers {
+		t.refresh(key, stats, now)
+		if stats.samples == 0 {
+			continue
+		}
+		reports = append(reports, ConsumerLatencyReport{
+			Stream:    key.stream,
+			Consumer:  key.consumer,
+			Instance:  t.instance,
+			Samples:   stats.samples,
+			P50:       stats.p50,
+			P99:       stats.p99,
+			Slow:      stats.slow,
+			Throttled: stats.slow && t.param.ThrottleRate > 0,
+			Reported:  now,
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Stream != reports[j].Stream {
+			return reports[i].Stream < reports[j].Stream
+		}
+		return reports[i].Consumer < reports[j].Consumer
+	})
+	return reports
+}
@@ -0,0 +1,196 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerLatencyTracker(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	registry := prometheus.NewRegistry()
+	window := time.Millisecond * 400
+	uut, err := GetConsumerLatencyTracker(ConsumerLatencyParam{
+		Window:        window,
+		SlowThreshold: time.Second,
+		MinSamples:    10,
+		ThrottleRate:  20,
+	}, registry, "ut-latency-tracker")
+	assert.Nil(err)
+
+	// Case 0: invalid settings
+	{
+		_, err := GetConsumerLatencyTracker(ConsumerLatencyParam{}, nil, "ut-latency-tracker")
+		assert.NotNil(err)
+	}
+
+	// Case 1: fast consumer
+	{
+		for itr := 0; itr < 20; itr++ {
+			uut.RecordACK("stream-1", "fast", time.Now().Add(-time.Millisecond*20))
+		}
+		reports := uut.Reports()
+		assert.Len(reports, 1)
+		assert.Equal("stream-1", reports[0].Stream)
+		assert.Equal("fast", reports[0].Consumer)
+		assert.Equal("ut-latency-tracker", reports[0].Instance)
+		assert.Equal(uint64(20), reports[0].Samples)
+		assert.False(reports[0].Slow)
+		assert.Greater(reports[0].P99, time.Millisecond*10)
+		assert.LessOrEqual(reports[0].P99, time.Millisecond*25)
+		// Not slow, so not throttled
+		start := time.Now()
+		for itr := 0; itr < 5; itr++ {
+			assert.Nil(uut.Throttle("stream-1", "fast", context.Background()))
+		}
+		assert.Less(time.Since(start), time.Millisecond*50)
+	}
+
+	// Case 2: too few samples to be slow
+	{
+		for itr := 0; itr < 5; itr++ {
+			uut.RecordACK("stream-1", "slow", time.Now().Add(-time.Second*3))
+		}
+		reports := uut.Reports()
+		assert.Len(reports, 2)
+		assert.Equal("slow", reports[1].Consumer)
+		assert.False(reports[1].Slow)
+	}
+
+	// Case 3: slow consumer
+	{
+		for itr := 0; itr < 5; itr++ {
+			uut.RecordACK("stream-1", "slow", time.Now().Add(-time.Second*3))
+		}
+		reports := uut.Reports()
+		assert.Len(reports, 2)
+		assert.True(reports[1].Slow)
+		assert.True(reports[1].Throttled)
+		assert.Greater(reports[1].P99, time.Second*2)
+		// Throttled to 20 per second
+		start := time.Now()
+		for itr := 0; itr < 4; itr++ {
+			assert.Nil(uut.Throttle("stream-1", "slow", context.Background()))
+		}
+		assert.GreaterOrEqual(time.Since(start), time.Millisecond*140)
+		// Waiting for the throttle ends with the context
+		ctxt, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.NotNil(uut.Throttle("stream-1", "slow", ctxt))
+	}
+
+	// Case 4: metrics
+	{
+		families, err := registry.Gather()
+		assert.Nil(err)
+		names := map[string]bool{}
+		for _, family := range families {
+			names[family.GetName()] = true
+			if family.GetName() == "httpmq_consumer_ack_latency_seconds" {
+				assert.Len(family.GetMetric(), 2)
+			}
+		}
+		assert.True(names["httpmq_consumer_ack_latency_seconds"])
+		assert.True(names["httpmq_consumer_slow"])
+	}
+
+	// Case 5: consumers are forgotten once the window passes without ACKs
+	{
+		time.Sleep(window + time.Millisecond*50)
+		assert.Len(uut.Reports(), 0)
+		start := time.Now()
+		for itr := 0; itr < 4; itr++ {
+			assert.Nil(uut.Throttle("stream-1", "slow", context.Background()))
+		}
+		assert.Less(time.Since(start), time.Millisecond*50)
+	}
+}
+
+func TestConsumerLatencyReports(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	testName := "ut-consumer-latency-reports"
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+	}
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	subject := uuid.New().String()
+	collector, err := GetConsumerLatencyCollector(js, subject, time.Millisecond*300, testName)
+	assert.Nil(err)
+	defer func() {
+		assert.Nil(collector.Close())
+	}()
+
+	tracker1, err := GetConsumerLatencyTracker(ConsumerLatencyParam{
+		Window: time.Minute, MinSamples: 1,
+	}, nil, "instance-1")
+	assert.Nil(err)
+	tracker2, err := GetConsumerLatencyTracker(ConsumerLatencyParam{
+		Window: time.Minute, MinSamples: 1,
+	}, nil, "instance-2")
+	assert.Nil(err)
+	tracker1.RecordACK("stream-1", "consumer-1", time.Now())
+	tracker2.RecordACK("stream-1", "consumer-1", time.Now())
+	tracker2.RecordACK("stream-2", "consumer-1", time.Now())
+
+	reporterCtxt, reporterCancel := context.WithCancel(utCtxt)
+	for _, tracker := range []ConsumerLatencyTracker{tracker1, tracker2} {
+		reporter, err := GetConsumerLatencyReporter(js, tracker, subject, testName, reporterCtxt, &wg)
+		assert.Nil(err)
+		assert.Nil(reporter.Start(time.Millisecond * 50))
+	}
+
+	// Case 0: reports from each instance are gathered
+	assert.Eventually(func() bool {
+		return len(collector.Reports("")) == 3
+	}, time.Second, time.Millisecond*20)
+	{
+		reports := collector.Reports("stream-1")
+		assert.Len(reports, 2)
+		assert.Equal("instance-1", reports[0].Instance)
+		assert.Equal("instance-2", reports[1].Instance)
+		assert.Equal(uint64(1), reports[1].Samples)
+	}
+
+	// Case 1: reports expire once no longer refreshed
+	reporterCancel()
+	assert.Eventually(func() bool {
+		return len(collector.Reports("")) == 0
+	}, time.Second*2, time.Millisecond*50)
+}
@@ -0,0 +1,50 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PIIDetectionMetrics records the PII found in published messages
+type PIIDetectionMetrics interface {
+	// RecordDetection records a published message in which a detector found PII, and the
+	// action taken for the stream
+	RecordDetection(stream, detector, action string)
+}
+
+// piiDetectionMetricsImpl implements PIIDetectionMetrics
+type piiDetectionMetricsImpl struct {
+	detections *prometheus.CounterVec
+}
+
+// GetPIIDetectionMetrics define a new PIIDetectionMetrics, registered with registerer
+func GetPIIDetectionMetrics(registerer prometheus.Registerer) (PIIDetectionMetrics, error) {
+	detections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpmq",
+		Subsystem: "publish",
+		Name:      "pii_detections_total",
+		Help:      "Number of published messages in which PII was found, by stream, detector, and action",
+	}, []string{"stream", "detector", "action"})
+	if err := registerer.Register(detections); err != nil {
+		return nil, err
+	}
+	return &piiDetectionMetricsImpl{detections: detections}, nil
+}
+
+// RecordDetection records a published message in which a detector found PII
+func (m *piiDetectionMetricsImpl) RecordDetection(stream, detector, action string) {
+	m.detections.WithLabelValues(stream, detector, action).Inc()
+}
@@ -0,0 +1,321 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// AlertTypePublishSpike alert type for a subject published to much faster than usual
+	AlertTypePublishSpike = "publish-spike"
+	// AlertTypePublishDrought alert type for a subject published to much slower than usual
+	AlertTypePublishDrought = "publish-drought"
+)
+
+// PublishAnomalyParam settings for detecting anomalies in the publish rate of subjects
+type PublishAnomalyParam struct {
+	// Alpha is the smoothing factor of the exponentially weighted moving average of the
+	// publish rate of each subject. Higher values follow recent rates more closely.
+	Alpha float64 `validate:"gt=0,lte=1"`
+	// SpikeFactor is how many times the average rate a subject's rate must exceed to spike
+	SpikeFactor float64 `validate:"gt=1"`
+	// DroughtFactor is the fraction of the average rate a subject's rate must fall below to
+	// be in a drought
+	DroughtFactor float64 `validate:"gte=0,lt=1"`
+	// MinRate is the average rate, in messages per second, below which a subject is too quiet
+	// to judge
+	MinRate float64 `validate:"gte=0"`
+	// Warmup is the number of samples of a subject taken before it is judged
+	Warmup int `validate:"gte=1"`
+	// MaxSubjects is the max number of subjects tracked. Subjects beyond it are ignored.
+	MaxSubjects int `validate:"gte=1"`
+}
+
+// PublishAnomalyDetector tracks the publish rate of each subject, and flags sudden spikes
+// and droughts against the subject's moving average rate
+type PublishAnomalyDetector interface {
+	// Record records a message published to a subject
+	Record(subject string)
+	// Start begins sampling the publish rates
+	Start(interval time.Duration) error
+	// Stop stops sampling the publish rates
+	Stop() error
+}
+
+// publishRateState the tracked publish rate of one subject
+type publishRateState struct {
+	// count is the number of messages published since the last sample
+	count uint64
+	// rate is the rate of the last sample
+	rate float64
+	// average is the moving average rate
+	average float64
+	samples int
+	// anomaly is the type of the ongoing anomaly, if any
+	anomaly string
+}
+
+// publishAnomalyDetectorImpl implements PublishAnomalyDetector
+type publishAnomalyDetectorImpl struct {
+	common.Component
+	instance    string
+	param       PublishAnomalyParam
+	sink        alerts.AlertSink
+	timer       common.IntervalTimer
+	rootContext context.Context
+	lock        sync.Mutex
+	lastSample  time.Time
+	subjects    map[string]*publishRateState
+}
+
+// GetPublishAnomalyDetector define a new PublishAnomalyDetector
+//
+// If sink is not nil, alerts are raised when a subject starts or stops being anomalous. If
+// registerer is not nil, the rates are registered as the Prometheus gauges
+// "httpmq_publish_rate", "httpmq_publish_rate_average", and "httpmq_publish_anomaly".
+func GetPublishAnomalyDetector(
+	param PublishAnomalyParam,
+	sink alerts.AlertSink,
+	registerer prometheus.Registerer,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (PublishAnomalyDetector, error) {
+	logTags := log.Fields{
+		"module": "metrics", "component": "publish-anomaly", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Publish anomaly settings invalid")
+		return nil, err
+	}
+	timer, err := common.GetIntervalTimerInstance(
+		fmt.Sprintf("%s.publish-anomaly", instance), rootCtxt, wg,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		return nil, err
+	}
+	detector := &publishAnomalyDetectorImpl{
+		Component:   common.Component{LogTags: logTags},
+		instance:    instance,
+		param:       param,
+		sink:        sink,
+		timer:       timer,
+		rootContext: rootCtxt,
+		lastSample:  time.Now(),
+		subjects:    make(map[string]*publishRateState),
+	}
+	if registerer != nil {
+		if err := registerer.Register(&publishAnomalyCollector{detector: detector}); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to register publish rate metrics")
+			return nil, err
+		}
+	}
+	return detector, nil
+}
+
+// Record records a message published to a subject
+func (d *publishAnomalyDetectorImpl) Record(subject string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	state, ok := d.subjects[subject]
+	if !ok {
+		if len(d.subjects) >= d.param.MaxSubjects {
+			return
+		}
+		state = &publishRateState{}
+		d.subjects[subject] = state
+	}
+	state.count++
+}
+
+// Start begins sampling the publish rates
+func (d *publishAnomalyDetectorImpl) Start(interval time.Duration) error {
+	d.lock.Lock()
+	d.lastSample = time.Now()
+	d.lock.Unlock()
+	if err := d.timer.SetMode(common.FixedRate); err != nil {
+		return err
+	}
+	return d.timer.Start(interval, d.sample, false)
+}
+
+// Stop stops sampling the publish rates
+func (d *publishAnomalyDetectorImpl) Stop() error {
+	return d.timer.Stop()
+}
+
+// sample support IntervalTimer, sample the publish rates and raise alerts as needed
+func (d *publishAnomalyDetectorImpl) sample() error {
+	for _, alert := range d.evaluate(time.Now()) {
+		log.WithFields(d.LogTags).Warnf("Raising %s", alert)
+		if d.sink == nil {
+			continue
+		}
+		if err := d.sink.Send(alert, d.rootContext); err != nil {
+			log.WithError(err).WithFields(d.LogTags).Errorf("Failed to send %s", alert)
+		}
+	}
+	return nil
+}
+
+// evaluate update the publish rate of each subject, and return the alerts to raise due to
+// subjects starting or stopping being anomalous
+//
+// A sustained spike becomes the new normal as the average catches up with it. The average is
+// held during a drought instead, so a dead upstream stays flagged until it publishes again.
+func (d *publishAnomalyDetectorImpl) evaluate(now time.Time) []alerts.Alert {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	elapsed := now.Sub(d.lastSample).Seconds()
+	d.lastSample = now
+	if elapsed <= 0 {
+		return nil
+	}
+
+	result := []alerts.Alert{}
+	for subject, state := range d.subjects {
+		rate := float64(state.count) / elapsed
+		state.count = 0
+		state.rate = rate
+
+		anomaly := ""
+		if state.samples >= d.param.Warmup && state.average >= d.param.MinRate {
+			if rate > state.average*d.param.SpikeFactor {
+				anomaly = AlertTypePublishSpike
+			} else if rate < state.average*d.param.DroughtFactor {
+				anomaly = AlertTypePublishDrought
+			}
+		}
+		if anomaly != state.anomaly {
+			if state.anomaly != "" {
+				result = append(result, d.newAlert(
+					state.anomaly, true, subject, rate, state.average, now,
+				))
+			}
+			if anomaly != "" {
+				result = append(result, d.newAlert(anomaly, false, subject, rate, state.average, now))
+			}
+			state.anomaly = anomaly
+		}
+
+		if anomaly != AlertTypePublishDrought {
+			if state.samples == 0 {
+				state.average = rate
+			} else {
+				state.average = d.param.Alpha*rate + (1-d.param.Alpha)*state.average
+			}
+		}
+		state.samples++
+
+		// Forget subjects which went quiet, to make room for others
+		if rate == 0 && state.anomaly == "" && state.samples > d.param.Warmup &&
+			state.average < d.param.MinRate {
+			delete(d.subjects, subject)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Message < result[j].Message })
+	return result
+}
+
+// newAlert helper function to define an alert on a subject's publish rate
+func (d *publishAnomalyDetectorImpl) newAlert(
+	alertType string, resolved bool, subject string, rate, average float64, now time.Time,
+) alerts.Alert {
+	state := "started"
+	if resolved {
+		state = "ended"
+	}
+	return alerts.Alert{
+		Type:     alertType,
+		Resolved: resolved,
+		Source:   d.instance,
+		Subject:  subject,
+		Message: fmt.Sprintf(
+			"%s %s: %.2f msg/s against average %.2f msg/s", subject, state, rate, average,
+		),
+		Timestamp: now,
+	}
+}
+
+// ==============================================================================
+
+var (
+	publishRateDesc = prometheus.NewDesc(
+		"httpmq_publish_rate",
+		"Publish rate of each subject over the last sample, in messages per second",
+		[]string{"subject"}, nil,
+	)
+	publishRateAverageDesc = prometheus.NewDesc(
+		"httpmq_publish_rate_average",
+		"Moving average publish rate of each subject, in messages per second",
+		[]string{"subject"}, nil,
+	)
+	publishAnomalyDesc = prometheus.NewDesc(
+		"httpmq_publish_anomaly",
+		"Whether each subject has an ongoing publish rate anomaly of each type",
+		[]string{"subject", "type"}, nil,
+	)
+)
+
+// publishAnomalyCollector exports the publish rates of a PublishAnomalyDetector as
+// Prometheus metrics on collection
+type publishAnomalyCollector struct {
+	detector *publishAnomalyDetectorImpl
+}
+
+// Describe support prometheus.Collector
+func (c *publishAnomalyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- publishRateDesc
+	ch <- publishRateAverageDesc
+	ch <- publishAnomalyDesc
+}
+
+// Collect support prometheus.Collector
+func (c *publishAnomalyCollector) Collect(ch chan<- prometheus.Metric) {
+	c.detector.lock.Lock()
+	defer c.detector.lock.Unlock()
+	for subject, state := range c.detector.subjects {
+		if state.samples == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			publishRateDesc, prometheus.GaugeValue, state.rate, subject,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			publishRateAverageDesc, prometheus.GaugeValue, state.average, subject,
+		)
+		for _, anomaly := range []string{AlertTypePublishSpike, AlertTypePublishDrought} {
+			value := 0.0
+			if state.anomaly == anomaly {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				publishAnomalyDesc, prometheus.GaugeValue, value, subject, anomaly,
+			)
+		}
+	}
+}
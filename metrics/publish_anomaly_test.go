@@ -0,0 +1,138 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/alerts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishAnomalyDetector(t *testing.T) {
+	assert := assert.New(t)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	param := PublishAnomalyParam{
+		Alpha:         0.5,
+		SpikeFactor:   3,
+		DroughtFactor: 0.2,
+		MinRate:       1,
+		Warmup:        2,
+		MaxSubjects:   2,
+	}
+
+	// Case 0: invalid settings
+	{
+		invalid := param
+		invalid.SpikeFactor = 1
+		_, err := GetPublishAnomalyDetector(invalid, nil, nil, "ut-anomaly", ctxt, &wg)
+		assert.NotNil(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	detector, err := GetPublishAnomalyDetector(param, nil, registry, "ut-anomaly", ctxt, &wg)
+	assert.Nil(err)
+	uut, ok := detector.(*publishAnomalyDetectorImpl)
+	assert.True(ok)
+	now := uut.lastSample
+
+	// sample helper function to publish count messages to a subject over one second, and
+	// take a sample
+	sample := func(subject string, count int) []alerts.Alert {
+		for i := 0; i < count; i++ {
+			uut.Record(subject)
+		}
+		now = now.Add(time.Second)
+		return uut.evaluate(now)
+	}
+
+	// Case 1: subjects are not judged during the warmup
+	{
+		assert.Empty(sample("orders", 10))
+		assert.Empty(sample("orders", 10))
+		assert.Equal(10.0, uut.subjects["orders"].average)
+	}
+
+	// Case 2: spike
+	{
+		raised := sample("orders", 50)
+		assert.Len(raised, 1)
+		assert.Equal(AlertTypePublishSpike, raised[0].Type)
+		assert.False(raised[0].Resolved)
+		assert.Equal("orders", raised[0].Subject)
+		assert.Equal("ut-anomaly", raised[0].Source)
+		// The spike is folded into the average
+		assert.Equal(30.0, uut.subjects["orders"].average)
+	}
+
+	// Case 3: spike ends
+	{
+		raised := sample("orders", 10)
+		assert.Len(raised, 1)
+		assert.Equal(AlertTypePublishSpike, raised[0].Type)
+		assert.True(raised[0].Resolved)
+		assert.Equal(20.0, uut.subjects["orders"].average)
+	}
+
+	// Case 4: drought, during which the average is held
+	{
+		raised := sample("orders", 0)
+		assert.Len(raised, 1)
+		assert.Equal(AlertTypePublishDrought, raised[0].Type)
+		assert.False(raised[0].Resolved)
+		assert.Empty(sample("orders", 0))
+		assert.Equal(20.0, uut.subjects["orders"].average)
+		raised = sample("orders", 20)
+		assert.Len(raised, 1)
+		assert.Equal(AlertTypePublishDrought, raised[0].Type)
+		assert.True(raised[0].Resolved)
+	}
+
+	// Case 5: Prometheus gauges
+	{
+		families, err := registry.Gather()
+		assert.Nil(err)
+		names := []string{}
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		assert.Equal(
+			[]string{"httpmq_publish_anomaly", "httpmq_publish_rate", "httpmq_publish_rate_average"},
+			names,
+		)
+	}
+
+	// Case 6: subjects beyond the max are ignored, and quiet subjects are forgotten
+	{
+		uut.Record("payments")
+		uut.Record("refunds")
+		assert.Empty(sample("orders", 20))
+		assert.Len(uut.subjects, 2)
+		assert.NotContains(uut.subjects, "refunds")
+		assert.Empty(sample("orders", 20))
+		assert.Empty(sample("orders", 20))
+		assert.Len(uut.subjects, 1)
+		assert.NotContains(uut.subjects, "payments")
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ConsumerLatencyReporter periodically publishes the reports of a ConsumerLatencyTracker
+// over NATS, so they can be gathered from every dataplane instance
+type ConsumerLatencyReporter interface {
+	// Start begins periodically publishing the reports
+	Start(interval time.Duration) error
+	// Stop stops publishing the reports
+	Stop() error
+}
+
+// consumerLatencyReporterImpl implements ConsumerLatencyReporter
+type consumerLatencyReporterImpl struct {
+	common.Component
+	nats    *core.NatsClient
+	tracker ConsumerLatencyTracker
+	subject string
+	timer   common.IntervalTimer
+}
+
+// GetConsumerLatencyReporter define a new ConsumerLatencyReporter
+//
+// The report of each consumer is published on "<subject>.<stream>.<consumer>".
+func GetConsumerLatencyReporter(
+	natsClient *core.NatsClient,
+	tracker ConsumerLatencyTracker,
+	subject string,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (ConsumerLatencyReporter, error) {
+	logTags := log.Fields{
+		"module": "metrics", "component": "consumer-latency-reporter", "instance": instance,
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("latency report subject not specified")
+	}
+	timer, err := common.GetIntervalTimerInstance(
+		fmt.Sprintf("%s.consumer-latency-reporter", instance), rootCtxt, wg,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		return nil, err
+	}
+	return &consumerLatencyReporterImpl{
+		Component: common.Component{LogTags: logTags},
+		nats:      natsClient,
+		tracker:   tracker,
+		subject:   subject,
+		timer:     timer,
+	}, nil
+}
+
+// Start begins periodically publishing the reports
+func (r *consumerLatencyReporterImpl) Start(interval time.Duration) error {
+	return r.timer.Start(interval, r.publishReports, false)
+}
+
+// Stop stops publishing the reports
+func (r *consumerLatencyReporterImpl) Stop() error {
+	return r.timer.Stop()
+}
+
+// publishReports support IntervalTimer, publish the current reports of the tracker
+func (r *consumerLatencyReporterImpl) publishReports() error {
+	for _, report := range r.tracker.Reports() {
+		payload, err := json.Marshal(&report)
+		if err != nil {
+			log.WithError(err).WithFields(r.LogTags).Errorf("Unable to serialize latency report")
+			return err
+		}
+		subject := fmt.Sprintf("%s.%s.%s", r.subject, report.Stream, report.Consumer)
+		if err := r.nats.NATs().Publish(subject, payload); err != nil {
+			log.WithError(err).WithFields(r.LogTags).Errorf("Failed to send latency report on %s", subject)
+			return err
+		}
+	}
+	return nil
+}
+
+// ==============================================================================
+
+// ConsumerLatencyCollector gathers the latency reports published by the
+// ConsumerLatencyReporter of each dataplane instance
+type ConsumerLatencyCollector interface {
+	// Reports returns the latest report of each consumer from each instance. If stream is
+	// not empty, only reports on consumers of that stream are returned.
+	Reports(stream string) []ConsumerLatencyReport
+	// Close stops gathering reports
+	Close() error
+}
+
+// receivedLatencyReport a gathered report, and when it was received
+type receivedLatencyReport struct {
+	report   ConsumerLatencyReport
+	received time.Time
+}
+
+// reportKey identifies the reports of one consumer from one instance
+type reportKey struct {
+	stream, consumer, instance string
+}
+
+// consumerLatencyCollectorImpl implements ConsumerLatencyCollector
+type consumerLatencyCollectorImpl struct {
+	common.Component
+	expiry       time.Duration
+	lock         sync.Mutex
+	reports      map[reportKey]receivedLatencyReport
+	subscription *nats.Subscription
+}
+
+// GetConsumerLatencyCollector define a new ConsumerLatencyCollector, gathering the reports
+// published under subject. Reports are dropped once not refreshed within expiry.
+func GetConsumerLatencyCollector(
+	natsClient *core.NatsClient, subject string, expiry time.Duration, instance string,
+) (ConsumerLatencyCollector, error) {
+	logTags := log.Fields{
+		"module": "metrics", "component": "consumer-latency-collector", "instance": instance,
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("latency report subject not specified")
+	}
+	if expiry <= 0 {
+		return nil, fmt.Errorf("latency report expiry must be positive")
+	}
+	collector := &consumerLatencyCollectorImpl{
+		Component: common.Component{LogTags: logTags},
+		expiry:    expiry,
+		reports:   make(map[reportKey]receivedLatencyReport),
+	}
+	subscription, err := natsClient.NATs().Subscribe(subject+".>", collector.receive)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to subscribe to %s", subject)
+		return nil, err
+	}
+	collector.subscription = subscription
+	return collector, nil
+}
+
+// receive handle one published report
+func (c *consumerLatencyCollectorImpl) receive(msg *nats.Msg) {
+	var report ConsumerLatencyReport
+	if err := json.Unmarshal(msg.Data, &report); err != nil {
+		log.WithError(err).WithFields(c.LogTags).Errorf("Unable to parse report on %s", msg.Subject)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := reportKey{stream: report.Stream, consumer: report.Consumer, instance: report.Instance}
+	// Expiry is by receive time, so it is not affected by the instances' clocks
+	c.reports[key] = receivedLatencyReport{report: report, received: time.Now()}
+}
+
+// Reports returns the latest report of each consumer from each instance. If stream is
+// not empty, only reports on consumers of that stream are returned.
+func (c *consumerLatencyCollectorImpl) Reports(stream string) []ConsumerLatencyReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	reports := []ConsumerLatencyReport{}
+	for key, entry := range c.reports {
+		if now.Sub(entry.received) > c.expiry {
+			delete(c.reports, key)
+			continue
+		}
+		if stream != "" && key.stream != stream {
+			continue
+		}
+		reports = append(reports, entry.report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		a, b := reports[i], reports[j]
+		if a.Stream != b.Stream {
+			return a.Stream < b.Stream
+		}
+		if a.Consumer != b.Consumer {
+			return a.Consumer < b.Consumer
+		}
+		return a.Instance < b.Instance
+	})
+	return reports
+}
+
+// Close stops gathering reports
+func (c *consumerLatencyCollectorImpl) Close() error {
+	return c.subscription.Unsubscribe()
+}
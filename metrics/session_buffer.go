@@ -0,0 +1,67 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SessionBufferMetrics records how full the write buffers of subscription sessions get
+type SessionBufferMetrics interface {
+	// ObserveHighWater records the most bytes the write buffer of an ended session held
+	ObserveHighWater(bytes int)
+	// RecordOverflow records a message which did not fit in the write buffer of a session,
+	// and was handled according to policy
+	RecordOverflow(policy string)
+}
+
+// sessionBufferMetricsImpl implements SessionBufferMetrics
+type sessionBufferMetricsImpl struct {
+	highWater prometheus.Histogram
+	overflows *prometheus.CounterVec
+}
+
+// GetSessionBufferMetrics define a new SessionBufferMetrics, registered with registerer
+func GetSessionBufferMetrics(registerer prometheus.Registerer) (SessionBufferMetrics, error) {
+	highWater := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "httpmq",
+		Subsystem: "session",
+		Name:      "write_buffer_high_water_bytes",
+		Help:      "Most bytes held by the write buffer of each ended subscription session",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	})
+	overflows := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpmq",
+		Subsystem: "session",
+		Name:      "write_buffer_overflows_total",
+		Help:      "Number of messages which did not fit in a session write buffer, by policy applied",
+	}, []string{"policy"})
+	for _, collector := range []prometheus.Collector{highWater, overflows} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return &sessionBufferMetricsImpl{highWater: highWater, overflows: overflows}, nil
+}
+
+// ObserveHighWater records the most bytes the write buffer of an ended session held
+func (m *sessionBufferMetricsImpl) ObserveHighWater(bytes int) {
+	m.highWater.Observe(float64(bytes))
+}
+
+// RecordOverflow records a message which did not fit in the write buffer of a session
+func (m *sessionBufferMetricsImpl) RecordOverflow(policy string) {
+	m.overflows.WithLabelValues(policy).Inc()
+}
@@ -0,0 +1,286 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SLOPath is a request path whose service level is tracked
+type SLOPath string
+
+const (
+	// SLOPathPublish publishing messages
+	SLOPathPublish SLOPath = "publish"
+	// SLOPathDelivery delivering messages to subscription sessions
+	SLOPathDelivery SLOPath = "delivery"
+)
+
+// SLOParam the service level objectives, and the windows over which they are evaluated
+type SLOParam struct {
+	// AvailabilityObjective is the target ratio of events which succeed, e.g. 0.999
+	AvailabilityObjective float64 `validate:"gt=0,lt=1"`
+	// LatencyThreshold is the latency above which a successful event is slow
+	LatencyThreshold time.Duration `validate:"gt=0"`
+	// LatencyObjective is the target ratio of successful events which are not slow
+	LatencyObjective float64 `validate:"gt=0,lt=1"`
+	// Windows are the sliding windows the objectives are evaluated over, e.g. 5m and 1h
+	Windows []time.Duration `validate:"min=1,dive,gt=0"`
+	// Resolution is the granularity of the sliding windows
+	Resolution time.Duration `validate:"gt=0"`
+}
+
+// SLIReport the compliance of one service level indicator over a window
+type SLIReport struct {
+	// Objective is the target ratio of good events
+	Objective float64 `json:"objective"`
+	// Ratio is the ratio of good events. It is 1 without events.
+	Ratio float64 `json:"ratio"`
+	// BurnRate is how fast the error budget is spent: the ratio of bad events over the ratio
+	// allowed. Above 1, the budget runs out before the end of the window.
+	BurnRate float64 `json:"burn_rate"`
+	// BudgetRemaining is the fraction of the error budget of the window not spent. It is
+	// negative once the budget is exceeded.
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// Compliant is whether Ratio meets Objective
+	Compliant bool `json:"compliant"`
+}
+
+// SLOWindowReport the service level of a path over one window
+type SLOWindowReport struct {
+	// Window is the length of the window
+	Window time.Duration `json:"window" swaggertype:"primitive,integer"`
+	// Events is the number of events within the window
+	Events uint64 `json:"events"`
+	// Failures is the number of events which failed
+	Failures uint64 `json:"failures"`
+	// Slow is the number of successful events above the latency threshold
+	Slow uint64 `json:"slow"`
+	// Availability is the compliance of the availability indicator
+	Availability SLIReport `json:"availability"`
+	// Latency is the compliance of the latency indicator
+	Latency SLIReport `json:"latency"`
+}
+
+// SLOPathReport the service level of a path over each window
+type SLOPathReport struct {
+	// Path is the request path
+	Path SLOPath `json:"path"`
+	// Windows are the reports of each window, shortest first
+	Windows []SLOWindowReport `json:"windows"`
+}
+
+// SLOTracker tracks the success and latency of the events of request paths over sliding
+// windows, and reports their compliance with the service level objectives
+type SLOTracker interface {
+	// Record records an event of a path, whether it succeeded, and its latency
+	Record(path SLOPath, success bool, latency time.Duration)
+	// Report returns the service level of each path with events over the longest window
+	Report() []SLOPathReport
+}
+
+// sloSlot the events of one slot of the sliding windows
+type sloSlot struct {
+	start    time.Time
+	events   uint64
+	failures uint64
+	slow     uint64
+}
+
+// sloTrackerImpl implements SLOTracker
+type sloTrackerImpl struct {
+	common.Component
+	param SLOParam
+	// retain is the longest window
+	retain time.Duration
+	lock   sync.Mutex
+	// paths the slots of each path, oldest first
+	paths map[SLOPath][]*sloSlot
+}
+
+// GetSLOTracker define a new SLOTracker
+//
+// If registerer is not nil, the ratio and burn rate of each indicator, path, and window are
+// registered as the Prometheus gauges "httpmq_slo_ratio" and "httpmq_slo_burn_rate".
+func GetSLOTracker(
+	param SLOParam, registerer prometheus.Registerer, instance string,
+) (SLOTracker, error) {
+	logTags := log.Fields{"module": "metrics", "component": "slo-tracker", "instance": instance}
+	if err := validator.New().Struct(&param); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("SLO settings invalid")
+		return nil, err
+	}
+	windows := append([]time.Duration{}, param.Windows...)
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	if windows[0] < param.Resolution {
+		return nil, fmt.Errorf("SLO windows can not be shorter than the resolution")
+	}
+	param.Windows = windows
+	tracker := &sloTrackerImpl{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		retain:    windows[len(windows)-1],
+		paths:     make(map[SLOPath][]*sloSlot),
+	}
+	if registerer != nil {
+		if err := registerer.Register(&sloCollector{tracker: tracker}); err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to register SLO metrics")
+			return nil, err
+		}
+	}
+	return tracker, nil
+}
+
+// Record records an event of a path, whether it succeeded, and its latency
+func (t *sloTrackerImpl) Record(path SLOPath, success bool, latency time.Duration) {
+	t.recordAt(path, success, latency, time.Now())
+}
+
+// recordAt records an event at a time
+func (t *sloTrackerImpl) recordAt(path SLOPath, success bool, latency time.Duration, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	slots := t.prune(path, now)
+	start := now.Truncate(t.param.Resolution)
+	if len(slots) == 0 || slots[len(slots)-1].start.Before(start) {
+		slots = append(slots, &sloSlot{start: start})
+	}
+	slot := slots[len(slots)-1]
+	slot.events++
+	if !success {
+		slot.failures++
+	} else if latency > t.param.LatencyThreshold {
+		slot.slow++
+	}
+	t.paths[path] = slots
+}
+
+// prune drop the slots of a path older than the longest window
+func (t *sloTrackerImpl) prune(path SLOPath, now time.Time) []*sloSlot {
+	slots := t.paths[path]
+	expired := 0
+	for expired < len(slots) && now.Sub(slots[expired].start) >= t.retain+t.param.Resolution {
+		expired++
+	}
+	return slots[expired:]
+}
+
+// Report returns the service level of each path with events over the longest window
+func (t *sloTrackerImpl) Report() []SLOPathReport {
+	return t.reportAt(time.Now())
+}
+
+// reportAt returns the service level of each path at a time
+func (t *sloTrackerImpl) reportAt(now time.Time) []SLOPathReport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	reports := []SLOPathReport{}
+	for path := range t.paths {
+		slots := t.prune(path, now)
+		if len(slots) == 0 {
+			delete(t.paths, path)
+			continue
+		}
+		t.paths[path] = slots
+		report := SLOPathReport{Path: path, Windows: []SLOWindowReport{}}
+		for _, window := range t.param.Windows {
+			entry := SLOWindowReport{Window: window}
+			// A slot counts toward a window once it began within the window
+			for _, slot := range slots {
+				if now.Sub(slot.start) < window {
+					entry.Events += slot.events
+					entry.Failures += slot.failures
+					entry.Slow += slot.slow
+				}
+			}
+			entry.Availability = defineSLIReport(
+				entry.Events, entry.Failures, t.param.AvailabilityObjective,
+			)
+			entry.Latency = defineSLIReport(
+				entry.Events-entry.Failures, entry.Slow, t.param.LatencyObjective,
+			)
+			report.Windows = append(report.Windows, entry)
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Path < reports[j].Path })
+	return reports
+}
+
+// defineSLIReport helper function to evaluate an indicator given the number of events, and
+// how many of them were bad
+func defineSLIReport(events, bad uint64, objective float64) SLIReport {
+	report := SLIReport{Objective: objective, Ratio: 1}
+	if events > 0 {
+		report.Ratio = 1 - float64(bad)/float64(events)
+	}
+	report.BurnRate = (1 - report.Ratio) / (1 - objective)
+	report.BudgetRemaining = 1 - report.BurnRate
+	report.Compliant = report.Ratio >= objective
+	return report
+}
+
+// ==============================================================================
+
+var (
+	sloRatioDesc = prometheus.NewDesc(
+		"httpmq_slo_ratio",
+		"Ratio of good events of each service level indicator over each window",
+		[]string{"path", "sli", "window"}, nil,
+	)
+	sloBurnRateDesc = prometheus.NewDesc(
+		"httpmq_slo_burn_rate",
+		"Error budget burn rate of each service level indicator over each window",
+		[]string{"path", "sli", "window"}, nil,
+	)
+)
+
+// sloCollector exports the reports of a SLOTracker as Prometheus metrics on collection
+type sloCollector struct {
+	tracker SLOTracker
+}
+
+// Describe support prometheus.Collector
+func (c *sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sloRatioDesc
+	ch <- sloBurnRateDesc
+}
+
+// Collect support prometheus.Collector
+func (c *sloCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, report := range c.tracker.Report() {
+		for _, window := range report.Windows {
+			for sli, entry := range map[string]SLIReport{
+				"availability": window.Availability, "latency": window.Latency,
+			} {
+				labels := []string{string(report.Path), sli, window.Window.String()}
+				ch <- prometheus.MustNewConstMetric(
+					sloRatioDesc, prometheus.GaugeValue, entry.Ratio, labels...,
+				)
+				ch <- prometheus.MustNewConstMetric(
+					sloBurnRateDesc, prometheus.GaugeValue, entry.BurnRate, labels...,
+				)
+			}
+		}
+	}
+}
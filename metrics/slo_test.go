@@ -0,0 +1,119 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSLOTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	param := SLOParam{
+		AvailabilityObjective: 0.9,
+		LatencyThreshold:      time.Millisecond * 100,
+		LatencyObjective:      0.5,
+		Windows:               []time.Duration{time.Minute * 10, time.Minute},
+		Resolution:            time.Second * 10,
+	}
+
+	// Case 0: invalid settings
+	{
+		invalid := param
+		invalid.AvailabilityObjective = 1
+		_, err := GetSLOTracker(invalid, nil, "ut-slo")
+		assert.NotNil(err)
+		invalid = param
+		invalid.Windows = []time.Duration{time.Second}
+		_, err = GetSLOTracker(invalid, nil, "ut-slo")
+		assert.NotNil(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	tracker, err := GetSLOTracker(param, registry, "ut-slo")
+	assert.Nil(err)
+	uut, ok := tracker.(*sloTrackerImpl)
+	assert.True(ok)
+	start := time.Now().Truncate(param.Resolution)
+
+	// Case 1: no events
+	assert.Empty(uut.reportAt(start))
+
+	// Case 2: events spread over both windows
+	{
+		// 5 minutes ago: 10 good events
+		for i := 0; i < 10; i++ {
+			uut.recordAt(SLOPathPublish, true, time.Millisecond, start.Add(-time.Minute*5))
+		}
+		// Now: 5 good, 2 slow, 3 failed
+		for i := 0; i < 5; i++ {
+			uut.recordAt(SLOPathPublish, true, time.Millisecond, start)
+		}
+		for i := 0; i < 2; i++ {
+			uut.recordAt(SLOPathPublish, true, time.Second, start)
+		}
+		for i := 0; i < 3; i++ {
+			uut.recordAt(SLOPathPublish, false, time.Second, start)
+		}
+		reports := uut.reportAt(start.Add(time.Second))
+		assert.Len(reports, 1)
+		assert.Equal(SLOPathPublish, reports[0].Path)
+		assert.Len(reports[0].Windows, 2)
+
+		short := reports[0].Windows[0]
+		assert.Equal(time.Minute, short.Window)
+		assert.Equal(uint64(10), short.Events)
+		assert.Equal(uint64(3), short.Failures)
+		assert.Equal(uint64(2), short.Slow)
+		assert.InDelta(0.7, short.Availability.Ratio, 1e-9)
+		assert.InDelta(3, short.Availability.BurnRate, 1e-9)
+		assert.InDelta(-2, short.Availability.BudgetRemaining, 1e-9)
+		assert.False(short.Availability.Compliant)
+		assert.InDelta(5.0/7, short.Latency.Ratio, 1e-9)
+		assert.True(short.Latency.Compliant)
+
+		long := reports[0].Windows[1]
+		assert.Equal(uint64(20), long.Events)
+		assert.InDelta(0.85, long.Availability.Ratio, 1e-9)
+		assert.InDelta(1.5, long.Availability.BurnRate, 1e-9)
+	}
+
+	// Case 3: Prometheus gauges
+	{
+		families, err := registry.Gather()
+		assert.Nil(err)
+		names := []string{}
+		for _, family := range families {
+			names = append(names, family.GetName())
+			// 2 windows and 2 indicators of one path
+			assert.Len(family.Metric, 4)
+		}
+		assert.Equal([]string{"httpmq_slo_burn_rate", "httpmq_slo_ratio"}, names)
+	}
+
+	// Case 4: events age out of the windows
+	{
+		reports := uut.reportAt(start.Add(time.Minute * 2))
+		assert.Len(reports, 1)
+		assert.Equal(uint64(0), reports[0].Windows[0].Events)
+		assert.Equal(1.0, reports[0].Windows[0].Availability.Ratio)
+		assert.Equal(uint64(20), reports[0].Windows[1].Events)
+		assert.Empty(uut.reportAt(start.Add(time.Minute * 11)))
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricsExporter periodically pushes the metrics gathered from a Prometheus registry to
+// another metrics backend
+type MetricsExporter interface {
+	// Start begins periodically pushing the metrics
+	Start(interval time.Duration) error
+	// Stop stops pushing the metrics
+	Stop() error
+}
+
+// StatsDFlavor is the dialect of the StatsD protocol spoken
+type StatsDFlavor string
+
+const (
+	// StatsDFlavorPlain plain StatsD, without tags
+	StatsDFlavorPlain StatsDFlavor = "statsd"
+	// StatsDFlavorDogStatsD Datadog's DogStatsD, with tags
+	StatsDFlavorDogStatsD StatsDFlavor = "dogstatsd"
+)
+
+// StatsDParam settings for pushing metrics to a StatsD server
+type StatsDParam struct {
+	// Address is the host:port of the StatsD server, reached over UDP
+	Address string `validate:"required,hostname_port"`
+	// Flavor is the dialect of the StatsD server
+	Flavor StatsDFlavor `validate:"oneof=statsd dogstatsd"`
+	// Prefix is prepended to the metric names
+	Prefix string
+	// Tags are the "key:value" tags added to all metrics. Only DogStatsD supports tags.
+	Tags []string `validate:"dive,required"`
+	// MaxPacketSize is the most bytes sent in one UDP packet
+	MaxPacketSize int `validate:"gte=64"`
+}
+
+// statsDExporterImpl implements MetricsExporter for StatsD
+type statsDExporterImpl struct {
+	common.Component
+	param    StatsDParam
+	gatherer prometheus.Gatherer
+	conn     net.Conn
+	timer    common.IntervalTimer
+	lock     sync.Mutex
+	// counters the last value pushed of each counter, as StatsD counters are deltas
+	counters map[string]float64
+}
+
+// GetStatsDExporter define a new MetricsExporter, pushing the metrics of gatherer to a
+// StatsD server
+//
+// Counters are sent as the increase since the last push, and gauges as their current value.
+// Histograms and summaries are sent as the counters "<name>.count" and "<name>.sum". With
+// plain StatsD, the label values of a metric are appended to its name; with DogStatsD, they
+// are sent as tags.
+func GetStatsDExporter(
+	param StatsDParam,
+	gatherer prometheus.Gatherer,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (MetricsExporter, error) {
+	logTags := log.Fields{
+		"module": "metrics", "component": "statsd-exporter", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		return nil, err
+	}
+	if param.Flavor == StatsDFlavorPlain && len(param.Tags) > 0 {
+		return nil, fmt.Errorf("tags are only supported by DogStatsD")
+	}
+	conn, err := net.Dial("udp", param.Address)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to reach StatsD at %s", param.Address)
+		return nil, err
+	}
+	timer, err := common.GetIntervalTimerInstance(
+		fmt.Sprintf("%s.statsd-exporter", instance), rootCtxt, wg,
+	)
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define timer")
+		_ = conn.Close()
+		return nil, err
+	}
+	return &statsDExporterImpl{
+		Component: common.Component{LogTags: logTags},
+		param:     param,
+		gatherer:  gatherer,
+		conn:      conn,
+		timer:     timer,
+		counters:  make(map[string]float64),
+	}, nil
+}
+
+// Start begins periodically pushing the metrics
+func (e *statsDExporterImpl) Start(interval time.Duration) error {
+	// Push on a steady schedule, however long each push takes
+	if err := e.timer.SetMode(common.FixedRate); err != nil {
+		return err
+	}
+	return e.timer.Start(interval, e.push, false)
+}
+
+// Stop stops pushing the metrics
+func (e *statsDExporterImpl) Stop() error {
+	if err := e.timer.Stop(); err != nil {
+		return err
+	}
+	return e.conn.Close()
+}
+
+// push support IntervalTimer, send the current metrics
+func (e *statsDExporterImpl) push() error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		// Gather returns what it could gather along with the error
+		log.WithError(err).WithFields(e.LogTags).Warn("Metrics gathered with errors")
+	}
+	e.lock.Lock()
+	lines := e.format(families)
+	e.lock.Unlock()
+	// Lines are packed into as few packets as possible
+	packet := []byte{}
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > e.param.MaxPacketSize {
+			if _, err := e.conn.Write(packet); err != nil {
+				log.WithError(err).WithFields(e.LogTags).Errorf("Failed to send metrics")
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		if _, err := e.conn.Write(packet); err != nil {
+			log.WithError(err).WithFields(e.LogTags).Errorf("Failed to send metrics")
+			return err
+		}
+	}
+	return nil
+}
+
+// format define the StatsD lines of the metric families
+func (e *statsDExporterImpl) format(families []*dto.MetricFamily) []string {
+	lines := []string{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			name, tags := e.identify(family.GetName(), metric.Label)
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				lines = append(lines, e.counter(name, tags, metric.Counter.GetValue()))
+			case dto.MetricType_GAUGE:
+				lines = append(lines, e.line(name, metric.Gauge.GetValue(), "g", tags))
+			case dto.MetricType_UNTYPED:
+				lines = append(lines, e.line(name, metric.Untyped.GetValue(), "g", tags))
+			case dto.MetricType_HISTOGRAM:
+				lines = append(
+					lines,
+					e.counter(name+".count", tags, float64(metric.Histogram.GetSampleCount())),
+					e.counter(name+".sum", tags, metric.Histogram.GetSampleSum()),
+				)
+			case dto.MetricType_SUMMARY:
+				lines = append(
+					lines,
+					e.counter(name+".count", tags, float64(metric.Summary.GetSampleCount())),
+					e.counter(name+".sum", tags, metric.Summary.GetSampleSum()),
+				)
+			}
+		}
+	}
+	return lines
+}
+
+// identify define the StatsD name and tags of a metric
+func (e *statsDExporterImpl) identify(name string, labels []*dto.LabelPair) (string, string) {
+	name = e.param.Prefix + sanitizeStatsD(name)
+	sorted := make([]*dto.LabelPair, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+	if e.param.Flavor == StatsDFlavorPlain {
+		for _, label := range sorted {
+			name += "." + sanitizeStatsD(label.GetValue())
+		}
+		return name, ""
+	}
+	tags := append([]string{}, e.param.Tags...)
+	for _, label := range sorted {
+		tags = append(tags, sanitizeStatsD(label.GetName())+":"+sanitizeStatsD(label.GetValue()))
+	}
+	return name, strings.Join(tags, ",")
+}
+
+// counter define the line of a counter, sending its increase since the last push
+func (e *statsDExporterImpl) counter(name, tags string, value float64) string {
+	key := name + "|" + tags
+	delta := value
+	// A counter below its last value was reset
+	if last, ok := e.counters[key]; ok && value >= last {
+		delta = value - last
+	}
+	e.counters[key] = value
+	return e.line(name, delta, "c", tags)
+}
+
+// line define one StatsD line
+func (e *statsDExporterImpl) line(name string, value float64, kind, tags string) string {
+	result := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if tags != "" {
+		result += "|#" + tags
+	}
+	return result
+}
+
+// sanitizeStatsD replace the characters with a meaning in the StatsD protocol
+func sanitizeStatsD(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, value)
+}
@@ -0,0 +1,124 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsDExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer server.Close()
+	// readLines read the lines of the packets sent by one push
+	readLines := func() []string {
+		lines := []string{}
+		buf := make([]byte, 2048)
+		for {
+			assert.Nil(server.SetReadDeadline(time.Now().Add(time.Millisecond * 100)))
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "ut_msgs_total", Help: "ut"}, []string{"stream"},
+	)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ut_inflight", Help: "ut"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "ut_latency", Help: "ut"})
+	registry.MustRegister(counter, gauge, histogram)
+
+	utCtxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	// Case 0: invalid settings
+	{
+		_, err := GetStatsDExporter(StatsDParam{
+			Address: server.LocalAddr().String(), Flavor: "graphite", MaxPacketSize: 1432,
+		}, registry, "ut-statsd", utCtxt, &wg)
+		assert.NotNil(err)
+		_, err = GetStatsDExporter(StatsDParam{
+			Address:       server.LocalAddr().String(),
+			Flavor:        StatsDFlavorPlain,
+			Tags:          []string{"env:ut"},
+			MaxPacketSize: 1432,
+		}, registry, "ut-statsd", utCtxt, &wg)
+		assert.NotNil(err)
+	}
+
+	// Case 1: DogStatsD with tags
+	{
+		uut, err := GetStatsDExporter(StatsDParam{
+			Address:       server.LocalAddr().String(),
+			Flavor:        StatsDFlavorDogStatsD,
+			Prefix:        "httpmq.",
+			Tags:          []string{"env:ut"},
+			MaxPacketSize: 64,
+		}, registry, "ut-statsd", utCtxt, &wg)
+		assert.Nil(err)
+		impl, ok := uut.(*statsDExporterImpl)
+		assert.True(ok)
+
+		counter.WithLabelValues("orders").Add(3)
+		gauge.Set(5)
+		histogram.Observe(0.5)
+		assert.Nil(impl.push())
+		assert.Equal([]string{
+			"httpmq.ut_inflight:5|g|#env:ut",
+			"httpmq.ut_latency.count:1|c|#env:ut",
+			"httpmq.ut_latency.sum:0.5|c|#env:ut",
+			"httpmq.ut_msgs_total:3|c|#env:ut,stream:orders",
+		}, readLines())
+
+		// Counters are sent as the increase since the last push
+		counter.WithLabelValues("orders").Add(2)
+		assert.Nil(impl.push())
+		assert.Contains(readLines(), "httpmq.ut_msgs_total:2|c|#env:ut,stream:orders")
+		assert.Nil(uut.Stop())
+	}
+
+	// Case 2: plain StatsD, pushed periodically
+	{
+		uut, err := GetStatsDExporter(StatsDParam{
+			Address:       server.LocalAddr().String(),
+			Flavor:        StatsDFlavorPlain,
+			MaxPacketSize: 1432,
+		}, registry, "ut-statsd", utCtxt, &wg)
+		assert.Nil(err)
+		assert.Nil(uut.Start(time.Millisecond * 50))
+		time.Sleep(time.Millisecond * 80)
+		assert.Nil(uut.Stop())
+		assert.Contains(readLines(), "ut_msgs_total.orders:5|c")
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/alwitt/httpmq/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterTaskProcessorMetrics registers the number of panics recovered from task handlers
+// by all task processors as a Prometheus metric
+func RegisterTaskProcessorMetrics(registerer prometheus.Registerer) error {
+	return registerer.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "httpmq",
+		Subsystem: "task_processor",
+		Name:      "panics_total",
+		Help:      "Number of panics recovered from task handlers",
+	}, func() float64 { return float64(common.TaskPanics()) }))
+}
@@ -0,0 +1,264 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+)
+
+// serviceAccountDir is where Kubernetes mounts the credentials of the pod service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ErrResourceVersionExpired is returned when a watch starts from a resource version the
+// Kubernetes API no longer has. The resources must be listed again.
+var ErrResourceVersionExpired = errors.New("resource version expired")
+
+// KubeConfig is how to reach the Kubernetes API
+type KubeConfig struct {
+	// Host is the base URL of the Kubernetes API
+	Host string
+	// Token is the bearer token to authenticate with
+	Token string
+	// CAFile is the PEM file of the CA certs to verify the API server with
+	CAFile string
+}
+
+// GetInClusterKubeConfig define the KubeConfig of a pod reaching the Kubernetes API with its
+// service account
+func GetInClusterKubeConfig() (KubeConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return KubeConfig{}, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return KubeConfig{}, err
+	}
+	return KubeConfig{
+		Host:   "https://" + net.JoinHostPort(host, port),
+		Token:  strings.TrimSpace(string(token)),
+		CAFile: serviceAccountDir + "/ca.crt",
+	}, nil
+}
+
+// KubeWatchEvent is one change of a resource reported by a watch
+type KubeWatchEvent struct {
+	// Type is ADDED, MODIFIED, DELETED, BOOKMARK, or ERROR
+	Type string `json:"type"`
+	// Object is the resource, or a Status for an ERROR
+	Object json.RawMessage `json:"object"`
+}
+
+// KubeClient accesses the custom resources of the Kubernetes API
+type KubeClient interface {
+	// List returns all resources of a kind, and the resource version to watch them from.
+	// namespace "" lists the resources of all namespaces.
+	List(
+		plural, namespace string, ctxt context.Context,
+	) (items []json.RawMessage, resourceVersion string, err error)
+	// Watch calls handler with each change of the resources of a kind after resourceVersion,
+	// until the watch times out after timeout, or handler fails.
+	Watch(
+		plural, namespace, resourceVersion string,
+		timeout time.Duration,
+		handler func(event KubeWatchEvent) error,
+		ctxt context.Context,
+	) error
+	// UpdateStatus replaces the status of a resource
+	UpdateStatus(
+		plural, namespace, name string, status interface{}, ctxt context.Context,
+	) error
+}
+
+// kubeClientImpl implements KubeClient over the Kubernetes REST API
+type kubeClientImpl struct {
+	common.Component
+	host   string
+	token  string
+	client *http.Client
+}
+
+// GetKubeClient define a new KubeClient
+func GetKubeClient(config KubeConfig, instance string) (KubeClient, error) {
+	logTags := log.Fields{
+		"module": "operator", "component": "kube-client", "instance": instance,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CAFile != "" {
+		caPEM, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			log.WithError(err).WithFields(logTags).Errorf("Unable to read CA file")
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no CA cert found in %s", config.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &kubeClientImpl{
+		Component: common.Component{LogTags: logTags},
+		host:      strings.TrimRight(config.Host, "/"),
+		token:     config.Token,
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// resourcePath helper function to get the API path of the custom resources of a kind
+func resourcePath(plural, namespace string) string {
+	if namespace == "" {
+		return fmt.Sprintf("/apis/%s/%s/%s", APIGroup, APIVersion, plural)
+	}
+	return fmt.Sprintf(
+		"/apis/%s/%s/namespaces/%s/%s", APIGroup, APIVersion, url.PathEscape(namespace), plural,
+	)
+}
+
+// kubeStatus is the body of a failed Kubernetes API call
+type kubeStatus struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// call helper function to make a Kubernetes API call
+func (k *kubeClientImpl) call(
+	method, path, contentType string, body []byte, ctxt context.Context,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctxt, method, k.host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var status kubeStatus
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		if resp.StatusCode == http.StatusGone {
+			return nil, ErrResourceVersionExpired
+		}
+		return nil, fmt.Errorf("%s %s failed with %d: %s", method, path, resp.StatusCode, status.Message)
+	}
+	return resp, nil
+}
+
+// List returns all resources of a kind, and the resource version to watch them from
+func (k *kubeClientImpl) List(
+	plural, namespace string, ctxt context.Context,
+) ([]json.RawMessage, string, error) {
+	resp, err := k.call(http.MethodGet, resourcePath(plural, namespace), "", nil, ctxt)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	return list.Items, list.Metadata.ResourceVersion, nil
+}
+
+// Watch calls handler with each change of the resources of a kind after resourceVersion
+func (k *kubeClientImpl) Watch(
+	plural, namespace, resourceVersion string,
+	timeout time.Duration,
+	handler func(event KubeWatchEvent) error,
+	ctxt context.Context,
+) error {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", fmt.Sprintf("%d", int(timeout.Seconds())))
+	resp, err := k.call(
+		http.MethodGet, resourcePath(plural, namespace)+"?"+query.Encode(), "", nil, ctxt,
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Each event is one JSON document
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event KubeWatchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			var status kubeStatus
+			_ = json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return ErrResourceVersionExpired
+			}
+			return fmt.Errorf("watch of %s failed: %s", plural, status.Message)
+		}
+		if err := handler(event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// UpdateStatus replaces the status of a resource
+func (k *kubeClientImpl) UpdateStatus(
+	plural, namespace, name string, status interface{}, ctxt context.Context,
+) error {
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	resp, err := k.call(
+		http.MethodPatch,
+		fmt.Sprintf("%s/%s/status", resourcePath(plural, namespace), url.PathEscape(name)),
+		"application/merge-patch+json",
+		patch,
+		ctxt,
+	)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,113 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubeClient(t *testing.T) {
+	assert := assert.New(t)
+
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	var lastRequest *http.Request
+	var lastBody []byte
+	responses := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastRequest = r
+		lastBody, _ = io.ReadAll(r.Body)
+		resp, ok := responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"not found","code":404}`)
+			return
+		}
+		fmt.Fprint(w, resp)
+	}))
+	defer server.Close()
+
+	uut, err := GetKubeClient(KubeConfig{Host: server.URL, Token: "secret"}, "ut-kube")
+	assert.Nil(err)
+
+	streamsPath := "/apis/httpmq.alwitt.github.io/v1alpha1/namespaces/ns/streams"
+
+	// Case 0: list resources
+	{
+		responses["GET "+streamsPath] = `{"metadata":{"resourceVersion":"42"},` +
+			`"items":[{"metadata":{"name":"a"}},{"metadata":{"name":"b"}}]}`
+		items, version, err := uut.List(StreamResourcePlural, "ns", utCtxt)
+		assert.Nil(err)
+		assert.Equal("42", version)
+		assert.Len(items, 2)
+		assert.Equal("Bearer secret", lastRequest.Header.Get("Authorization"))
+
+		_, _, err = uut.List(ConsumerResourcePlural, "ns", utCtxt)
+		assert.NotNil(err)
+	}
+
+	// Case 1: watch resources
+	{
+		responses["GET "+streamsPath] = `{"type":"ADDED","object":{"metadata":{"name":"a"}}}` +
+			"\n" + `{"type":"DELETED","object":{"metadata":{"name":"b"}}}` + "\n"
+		events := []string{}
+		err := uut.Watch(
+			StreamResourcePlural, "ns", "42", time.Minute,
+			func(event KubeWatchEvent) error {
+				events = append(events, event.Type)
+				return nil
+			},
+			utCtxt,
+		)
+		assert.Nil(err)
+		assert.Equal([]string{"ADDED", "DELETED"}, events)
+		query := lastRequest.URL.Query()
+		assert.Equal("true", query.Get("watch"))
+		assert.Equal("42", query.Get("resourceVersion"))
+		assert.Equal("60", query.Get("timeoutSeconds"))
+	}
+
+	// Case 2: watch from an expired resource version
+	{
+		responses["GET "+streamsPath] = `{"type":"ERROR","object":{"message":"too old","code":410}}`
+		err := uut.Watch(
+			StreamResourcePlural, "ns", "1", time.Minute,
+			func(event KubeWatchEvent) error { return nil },
+			utCtxt,
+		)
+		assert.ErrorIs(err, ErrResourceVersionExpired)
+	}
+
+	// Case 3: update the status of a resource
+	{
+		responses["PATCH "+streamsPath+"/a/status"] = `{}`
+		status := ResourceStatus{Ready: false, Message: "oops", ObservedGeneration: 2}
+		assert.Nil(uut.UpdateStatus(StreamResourcePlural, "ns", "a", status, utCtxt))
+		assert.Equal("application/merge-patch+json", lastRequest.Header.Get("Content-Type"))
+		var patch map[string]ResourceStatus
+		assert.Nil(json.Unmarshal(lastBody, &patch))
+		assert.Equal(status, patch["status"])
+	}
+}
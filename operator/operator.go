@@ -0,0 +1,387 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+)
+
+// OperatorParam settings for the topology operator
+type OperatorParam struct {
+	// Namespace is the namespace whose custom resources are reconciled ("": all namespaces)
+	Namespace string
+	// Resync is the interval at which every custom resource is reconciled again
+	Resync time.Duration `validate:"gte=1s"`
+	// RetryDelay is the delay before listing the custom resources again after a failure
+	RetryDelay time.Duration `validate:"gt=0"`
+}
+
+// TopologyOperator watches the Stream and Consumer custom resources of a Kubernetes
+// cluster, and reconciles the JetStream streams and consumers to match them
+type TopologyOperator interface {
+	// Start begins watching and reconciling the custom resources, until the root context
+	// is cancelled
+	Start() error
+}
+
+// managedObject is the JetStream stream or consumer of a custom resource
+type managedObject struct {
+	stream   string
+	consumer string
+}
+
+// watchedKind is the handling of the custom resources of one kind
+type watchedKind struct {
+	plural string
+	// reconcile bring JetStream in line with a resource
+	reconcile func(
+		item json.RawMessage, ctxt context.Context,
+	) (ObjectMeta, ResourceStatus, managedObject, error)
+	// remove delete the JetStream object of a deleted resource
+	remove func(target managedObject, ctxt context.Context) error
+	// managed is the JetStream object of each reconciled resource, by namespaced name. A
+	// resource deleted while not being watched is found missing on the next list.
+	managed map[string]managedObject
+}
+
+// topologyOperatorImpl implements TopologyOperator
+type topologyOperatorImpl struct {
+	common.Component
+	kube        KubeClient
+	controller  management.JetStreamController
+	param       OperatorParam
+	callTimeout time.Duration
+	rootContext context.Context
+	wg          *sync.WaitGroup
+	streams     *watchedKind
+	consumers   *watchedKind
+}
+
+// GetTopologyOperator define a new TopologyOperator
+func GetTopologyOperator(
+	kube KubeClient,
+	controller management.JetStreamController,
+	param OperatorParam,
+	instance string,
+	rootCtxt context.Context,
+	wg *sync.WaitGroup,
+) (TopologyOperator, error) {
+	logTags := log.Fields{
+		"module": "operator", "component": "topology-operator", "instance": instance,
+	}
+	if err := validator.New().Struct(&param); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Invalid operator parameters")
+		return nil, err
+	}
+	op := &topologyOperatorImpl{
+		Component:   common.Component{LogTags: logTags},
+		kube:        kube,
+		controller:  controller,
+		param:       param,
+		callTimeout: time.Second * 10,
+		rootContext: rootCtxt,
+		wg:          wg,
+	}
+	op.streams = &watchedKind{
+		plural:    StreamResourcePlural,
+		reconcile: op.reconcileStreamResource,
+		remove: func(target managedObject, ctxt context.Context) error {
+			return controller.DeleteStream(target.stream, ctxt)
+		},
+		managed: make(map[string]managedObject),
+	}
+	op.consumers = &watchedKind{
+		plural:    ConsumerResourcePlural,
+		reconcile: op.reconcileConsumerResource,
+		remove: func(target managedObject, ctxt context.Context) error {
+			return controller.DeleteConsumerOnStream(target.stream, target.consumer, ctxt)
+		},
+		managed: make(map[string]managedObject),
+	}
+	return op, nil
+}
+
+// Start begins watching and reconciling the custom resources
+func (o *topologyOperatorImpl) Start() error {
+	for _, kind := range []*watchedKind{o.streams, o.consumers} {
+		o.wg.Add(1)
+		go o.run(kind)
+	}
+	return nil
+}
+
+// run keep the resources of a kind reconciled until the root context is cancelled
+func (o *topologyOperatorImpl) run(kind *watchedKind) {
+	defer o.wg.Done()
+	for {
+		err := o.sync(kind)
+		if o.rootContext.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+		log.WithError(err).WithFields(o.LogTags).Errorf("Failed to watch %s", kind.plural)
+		select {
+		case <-o.rootContext.Done():
+			return
+		case <-time.After(o.param.RetryDelay):
+		}
+	}
+}
+
+// sync reconcile all resources of a kind, then follow their changes until the watch times
+// out after the resync interval
+func (o *topologyOperatorImpl) sync(kind *watchedKind) error {
+	items, version, err := o.kube.List(kind.plural, o.param.Namespace, o.rootContext)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, item := range items {
+		if key, ok := o.apply(kind, item); ok {
+			listed[key] = true
+		}
+	}
+	for key := range kind.managed {
+		if !listed[key] {
+			o.delete(kind, key)
+		}
+	}
+	err = o.kube.Watch(
+		kind.plural, o.param.Namespace, version, o.param.Resync,
+		func(event KubeWatchEvent) error {
+			switch event.Type {
+			case "ADDED", "MODIFIED":
+				o.apply(kind, event.Object)
+			case "DELETED":
+				var resource struct {
+					Metadata ObjectMeta `json:"metadata"`
+				}
+				if err := json.Unmarshal(event.Object, &resource); err != nil {
+					return err
+				}
+				o.delete(kind, resource.Metadata.key())
+			}
+			return nil
+		},
+		o.rootContext,
+	)
+	if errors.Is(err, ErrResourceVersionExpired) {
+		// Catch up by listing again
+		return nil
+	}
+	return err
+}
+
+// apply reconcile one resource, and record the outcome in its status. Returns the
+// namespaced name of the resource, and whether it was readable.
+func (o *topologyOperatorImpl) apply(kind *watchedKind, item json.RawMessage) (string, bool) {
+	ctxt, cancel := context.WithTimeout(o.rootContext, o.callTimeout)
+	defer cancel()
+	meta, current, target, err := kind.reconcile(item, ctxt)
+	if meta.Name == "" {
+		log.WithError(err).WithFields(o.LogTags).Errorf("Unable to read %s resource", kind.plural)
+		return "", false
+	}
+	key := meta.key()
+	kind.managed[key] = target
+	status := ResourceStatus{Ready: err == nil, ObservedGeneration: meta.Generation}
+	if err != nil {
+		status.Message = err.Error()
+		log.WithError(err).WithFields(o.LogTags).Errorf("Unable to reconcile %s %s", kind.plural, key)
+	}
+	if status == current {
+		return key, true
+	}
+	if err := o.kube.UpdateStatus(kind.plural, meta.Namespace, meta.Name, status, ctxt); err != nil {
+		log.WithError(err).WithFields(o.LogTags).Errorf(
+			"Unable to update status of %s %s", kind.plural, key,
+		)
+	}
+	return key, true
+}
+
+// delete remove the JetStream object of a deleted resource
+func (o *topologyOperatorImpl) delete(kind *watchedKind, key string) {
+	target, ok := kind.managed[key]
+	if !ok {
+		return
+	}
+	delete(kind.managed, key)
+	ctxt, cancel := context.WithTimeout(o.rootContext, o.callTimeout)
+	defer cancel()
+	err := kind.remove(target, ctxt)
+	if err != nil && !errors.Is(err, nats.ErrStreamNotFound) &&
+		!errors.Is(err, nats.ErrConsumerNotFound) {
+		log.WithError(err).WithFields(o.LogTags).Errorf(
+			"Unable to remove JetStream object of deleted %s %s", kind.plural, key,
+		)
+		return
+	}
+	log.WithFields(o.LogTags).Infof("Removed JetStream object of deleted %s %s", kind.plural, key)
+}
+
+// ==============================================================================
+
+// reconcileStreamResource support watchedKind, reconcile a Stream resource
+func (o *topologyOperatorImpl) reconcileStreamResource(
+	item json.RawMessage, ctxt context.Context,
+) (ObjectMeta, ResourceStatus, managedObject, error) {
+	var resource StreamResource
+	if err := json.Unmarshal(item, &resource); err != nil {
+		return ObjectMeta{}, ResourceStatus{}, managedObject{}, err
+	}
+	target := managedObject{stream: resource.StreamName()}
+	return resource.Metadata, resource.Status, target, o.reconcileStream(resource, ctxt)
+}
+
+// reconcileStream define or update the stream of a Stream resource
+func (o *topologyOperatorImpl) reconcileStream(resource StreamResource, ctxt context.Context) error {
+	param, err := resource.ToParam()
+	if err != nil {
+		return err
+	}
+	info, err := o.controller.GetStream(param.Name, ctxt)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return o.controller.CreateStream(param, ctxt)
+	} else if err != nil {
+		return err
+	}
+	if len(param.Subjects) > 0 && !sameSubjects(info.Config.Subjects, param.Subjects) {
+		if err := o.controller.ChangeStreamSubjects(param.Name, param.Subjects, ctxt); err != nil {
+			return err
+		}
+	}
+	if streamLimitsDiffer(info.Config, param.JSStreamLimits) {
+		return o.controller.UpdateStreamLimits(param.Name, param.JSStreamLimits, ctxt)
+	}
+	return nil
+}
+
+// sameSubjects helper function to compare two sets of subjects
+func sameSubjects(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// streamLimitsDiffer helper function to check whether any limit set differs from a stream
+func streamLimitsDiffer(config nats.StreamConfig, limits management.JSStreamLimits) bool {
+	return (limits.MaxConsumers != nil && *limits.MaxConsumers != config.MaxConsumers) ||
+		(limits.MaxMsgs != nil && *limits.MaxMsgs != config.MaxMsgs) ||
+		(limits.MaxBytes != nil && *limits.MaxBytes != config.MaxBytes) ||
+		(limits.MaxAge != nil && *limits.MaxAge != config.MaxAge) ||
+		(limits.MaxMsgsPerSubject != nil && *limits.MaxMsgsPerSubject != config.MaxMsgsPerSubject) ||
+		(limits.MaxMsgSize != nil && *limits.MaxMsgSize != config.MaxMsgSize)
+}
+
+// reconcileConsumerResource support watchedKind, reconcile a Consumer resource
+func (o *topologyOperatorImpl) reconcileConsumerResource(
+	item json.RawMessage, ctxt context.Context,
+) (ObjectMeta, ResourceStatus, managedObject, error) {
+	var resource ConsumerResource
+	if err := json.Unmarshal(item, &resource); err != nil {
+		return ObjectMeta{}, ResourceStatus{}, managedObject{}, err
+	}
+	target := managedObject{stream: resource.Spec.Stream, consumer: resource.ConsumerName()}
+	return resource.Metadata, resource.Status, target, o.reconcileConsumer(resource, ctxt)
+}
+
+// reconcileConsumer define the consumer of a Consumer resource, or verify it matches
+//
+// JetStream consumers can not be updated, so a consumer differing from its resource is only
+// reported.
+func (o *topologyOperatorImpl) reconcileConsumer(
+	resource ConsumerResource, ctxt context.Context,
+) error {
+	param, err := resource.ToParam()
+	if err != nil {
+		return err
+	}
+	stream := resource.Spec.Stream
+	info, err := o.controller.GetConsumerForStream(stream, param.Name, ctxt)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return o.controller.CreateConsumerForStream(stream, param, ctxt)
+	} else if err != nil {
+		return err
+	}
+	var backoff []time.Duration
+	if len(param.Backoff) > 0 {
+		if backoff, err = o.controller.GetConsumerBackoff(stream, param.Name, ctxt); err != nil {
+			return err
+		}
+	}
+	if diff := consumerDiff(info.Config, backoff, param); diff != "" {
+		return fmt.Errorf("consumer %s differs from the spec; recreate the resource to apply", diff)
+	}
+	return nil
+}
+
+// consumerDiff helper function to name the first setting of a consumer differing from its
+// parameters, or "" if none
+func consumerDiff(
+	config nats.ConsumerConfig, backoff []time.Duration, param management.JetStreamConsumerParam,
+) string {
+	switch {
+	case common.GatewayConsumerNotes(config.Description) != param.Notes:
+		return "notes"
+	case config.MaxAckPending != param.MaxInflight:
+		return "maxInflight"
+	case (config.DeliverSubject != "") != (param.Mode == "push"):
+		return "mode"
+	case param.FilterSubject != nil && *param.FilterSubject != config.FilterSubject:
+		return "filterSubject"
+	case param.DeliveryGroup != nil && *param.DeliveryGroup != config.DeliverGroup:
+		return "deliveryGroup"
+	case param.MaxRetry != nil && *param.MaxRetry != config.MaxDeliver:
+		return "maxRetry"
+	case param.AckWait != nil && *param.AckWait != config.AckWait:
+		return "ackWait"
+	case param.ReplayPolicy != nil &&
+		(*param.ReplayPolicy == "original") != (config.ReplayPolicy == nats.ReplayOriginalPolicy):
+		return "replayPolicy"
+	}
+	if len(backoff) != len(param.Backoff) {
+		return "backoff"
+	}
+	for idx := range backoff {
+		if backoff[idx] != param.Backoff[idx] {
+			return "backoff"
+		}
+	}
+	return ""
+}
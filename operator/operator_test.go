@@ -0,0 +1,282 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/management"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKubeClient implements KubeClient with a fixed set of resources and watch events
+type fakeKubeClient struct {
+	items    map[string][]json.RawMessage
+	events   map[string][]KubeWatchEvent
+	statuses map[string]ResourceStatus
+}
+
+func (k *fakeKubeClient) List(
+	plural, namespace string, ctxt context.Context,
+) ([]json.RawMessage, string, error) {
+	return k.items[plural], "1", nil
+}
+
+func (k *fakeKubeClient) Watch(
+	plural, namespace, resourceVersion string,
+	timeout time.Duration,
+	handler func(event KubeWatchEvent) error,
+	ctxt context.Context,
+) error {
+	for _, event := range k.events[plural] {
+		if err := handler(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *fakeKubeClient) UpdateStatus(
+	plural, namespace, name string, status interface{}, ctxt context.Context,
+) error {
+	k.statuses[fmt.Sprintf("%s/%s/%s", plural, namespace, name)] = status.(ResourceStatus)
+	return nil
+}
+
+// stubJetStreamController implements the parts of JetStreamController the operator uses
+type stubJetStreamController struct {
+	management.JetStreamController
+	streams   map[string]*nats.StreamInfo
+	consumers map[string]*nats.ConsumerInfo
+	calls     []string
+}
+
+func (c *stubJetStreamController) GetStream(
+	name string, ctxt context.Context,
+) (*nats.StreamInfo, error) {
+	if info, ok := c.streams[name]; ok {
+		return info, nil
+	}
+	return nil, nats.ErrStreamNotFound
+}
+
+func (c *stubJetStreamController) CreateStream(
+	param management.JSStreamParam, ctxt context.Context,
+) error {
+	c.calls = append(c.calls, "create-stream "+param.Name)
+	c.streams[param.Name] = &nats.StreamInfo{
+		Config: nats.StreamConfig{Name: param.Name, Subjects: param.Subjects},
+	}
+	return nil
+}
+
+func (c *stubJetStreamController) ChangeStreamSubjects(
+	stream string, newSubjects []string, ctxt context.Context,
+) error {
+	c.calls = append(c.calls, "change-subjects "+stream)
+	c.streams[stream].Config.Subjects = newSubjects
+	return nil
+}
+
+func (c *stubJetStreamController) UpdateStreamLimits(
+	stream string, newLimits management.JSStreamLimits, ctxt context.Context,
+) error {
+	c.calls = append(c.calls, "update-limits "+stream)
+	if newLimits.MaxMsgs != nil {
+		c.streams[stream].Config.MaxMsgs = *newLimits.MaxMsgs
+	}
+	return nil
+}
+
+func (c *stubJetStreamController) DeleteStream(name string, ctxt context.Context) error {
+	c.calls = append(c.calls, "delete-stream "+name)
+	delete(c.streams, name)
+	return nil
+}
+
+func (c *stubJetStreamController) GetConsumerForStream(
+	stream, consumerName string, ctxt context.Context,
+) (*nats.ConsumerInfo, error) {
+	if info, ok := c.consumers[stream+"/"+consumerName]; ok {
+		return info, nil
+	}
+	return nil, nats.ErrConsumerNotFound
+}
+
+func (c *stubJetStreamController) CreateConsumerForStream(
+	stream string, param management.JetStreamConsumerParam, ctxt context.Context,
+) error {
+	c.calls = append(c.calls, "create-consumer "+stream+"/"+param.Name)
+	c.consumers[stream+"/"+param.Name] = &nats.ConsumerInfo{
+		Config: nats.ConsumerConfig{
+			Durable: param.Name, MaxAckPending: param.MaxInflight, DeliverSubject: "_INBOX.x",
+		},
+	}
+	return nil
+}
+
+func (c *stubJetStreamController) GetConsumerBackoff(
+	stream, consumerName string, ctxt context.Context,
+) ([]time.Duration, error) {
+	return nil, nil
+}
+
+func (c *stubJetStreamController) DeleteConsumerOnStream(
+	stream, consumerName string, ctxt context.Context,
+) error {
+	c.calls = append(c.calls, "delete-consumer "+stream+"/"+consumerName)
+	delete(c.consumers, stream+"/"+consumerName)
+	return nil
+}
+
+func TestTopologyOperator(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	kube := &fakeKubeClient{
+		items:    make(map[string][]json.RawMessage),
+		events:   make(map[string][]KubeWatchEvent),
+		statuses: make(map[string]ResourceStatus),
+	}
+	controller := &stubJetStreamController{
+		streams:   make(map[string]*nats.StreamInfo),
+		consumers: make(map[string]*nats.ConsumerInfo),
+	}
+	param := OperatorParam{Resync: time.Minute, RetryDelay: time.Second}
+
+	// Case 0: invalid parameters
+	{
+		_, err := GetTopologyOperator(
+			kube, controller, OperatorParam{RetryDelay: time.Second}, "ut-operator", utCtxt, &wg,
+		)
+		assert.NotNil(err)
+	}
+
+	uut, err := GetTopologyOperator(kube, controller, param, "ut-operator", utCtxt, &wg)
+	assert.Nil(err)
+	uutc := uut.(*topologyOperatorImpl)
+
+	// Case 1: a new stream resource is created, with the resource name as default
+	{
+		kube.items[StreamResourcePlural] = []json.RawMessage{
+			json.RawMessage(`{"metadata":{"name":"orders","namespace":"ns","generation":1},` +
+				`"spec":{"subjects":["orders.*"]}}`),
+			json.RawMessage(`{"metadata":{"name":"bad","namespace":"ns","generation":3},` +
+				`"spec":{"maxAge":"1 day"}}`),
+		}
+		assert.Nil(uutc.sync(uutc.streams))
+		assert.Equal([]string{"create-stream orders"}, controller.calls)
+		assert.Equal(
+			ResourceStatus{Ready: true, ObservedGeneration: 1},
+			kube.statuses["streams/ns/orders"],
+		)
+		status := kube.statuses["streams/ns/bad"]
+		assert.False(status.Ready)
+		assert.Equal(int64(3), status.ObservedGeneration)
+		assert.Contains(status.Message, "maxAge")
+	}
+
+	// Case 2: the stream is updated to match a changed resource
+	{
+		controller.calls = nil
+		kube.statuses = make(map[string]ResourceStatus)
+		kube.events[StreamResourcePlural] = []KubeWatchEvent{
+			{
+				Type: "MODIFIED",
+				Object: json.RawMessage(`{"metadata":{"name":"orders","namespace":"ns",` +
+					`"generation":2},"spec":{"subjects":["orders.>"],"maxMsgs":100},` +
+					`"status":{"ready":true,"observedGeneration":1}}`),
+			},
+		}
+		// The resources listed are the ones seen before the watch; "bad" is gone
+		kube.items[StreamResourcePlural] = []json.RawMessage{
+			json.RawMessage(`{"metadata":{"name":"orders","namespace":"ns","generation":1},` +
+				`"spec":{"subjects":["orders.*"]},"status":{"ready":true,"observedGeneration":1}}`),
+		}
+		assert.Nil(uutc.sync(uutc.streams))
+		assert.Equal(
+			[]string{"delete-stream bad", "change-subjects orders", "update-limits orders"},
+			controller.calls,
+		)
+		// Unchanged status is not updated
+		assert.Equal(
+			map[string]ResourceStatus{"streams/ns/orders": {Ready: true, ObservedGeneration: 2}},
+			kube.statuses,
+		)
+		assert.Equal([]string{"orders.>"}, controller.streams["orders"].Config.Subjects)
+		assert.Equal(int64(100), controller.streams["orders"].Config.MaxMsgs)
+	}
+
+	// Case 3: consumer resources
+	{
+		controller.calls = nil
+		kube.items[ConsumerResourcePlural] = []json.RawMessage{
+			json.RawMessage(`{"metadata":{"name":"billing","namespace":"ns","generation":1},` +
+				`"spec":{"stream":"orders","maxInflight":4,"mode":"push"}}`),
+		}
+		assert.Nil(uutc.sync(uutc.consumers))
+		assert.Equal([]string{"create-consumer orders/billing"}, controller.calls)
+		assert.True(kube.statuses["consumers/ns/billing"].Ready)
+
+		// A consumer can not be updated
+		controller.calls = nil
+		kube.items[ConsumerResourcePlural] = []json.RawMessage{
+			json.RawMessage(`{"metadata":{"name":"billing","namespace":"ns","generation":2},` +
+				`"spec":{"stream":"orders","maxInflight":8,"mode":"push"}}`),
+		}
+		assert.Nil(uutc.sync(uutc.consumers))
+		assert.Empty(controller.calls)
+		status := kube.statuses["consumers/ns/billing"]
+		assert.False(status.Ready)
+		assert.Contains(status.Message, "maxInflight")
+	}
+
+	// Case 4: deleted resources
+	{
+		controller.calls = nil
+		kube.items[ConsumerResourcePlural] = nil
+		kube.events[ConsumerResourcePlural] = nil
+		assert.Nil(uutc.sync(uutc.consumers))
+		assert.Equal([]string{"delete-consumer orders/billing"}, controller.calls)
+
+		controller.calls = nil
+		kube.items[StreamResourcePlural] = []json.RawMessage{
+			json.RawMessage(`{"metadata":{"name":"orders","namespace":"ns","generation":2},` +
+				`"spec":{"subjects":["orders.>"],"maxMsgs":100},` +
+				`"status":{"ready":true,"observedGeneration":2}}`),
+		}
+		kube.events[StreamResourcePlural] = []KubeWatchEvent{
+			{
+				Type:   "DELETED",
+				Object: json.RawMessage(`{"metadata":{"name":"orders","namespace":"ns"}}`),
+			},
+		}
+		assert.Nil(uutc.sync(uutc.streams))
+		assert.Equal([]string{"delete-stream orders"}, controller.calls)
+		assert.Empty(controller.streams)
+	}
+}
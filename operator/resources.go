@@ -0,0 +1,196 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alwitt/httpmq/management"
+)
+
+const (
+	// APIGroup is the API group of the httpmq custom resources
+	APIGroup = "httpmq.alwitt.github.io"
+	// APIVersion is the version of the httpmq custom resources
+	APIVersion = "v1alpha1"
+	// StreamResourcePlural is the plural name of the Stream custom resource
+	StreamResourcePlural = "streams"
+	// ConsumerResourcePlural is the plural name of the Consumer custom resource
+	ConsumerResourcePlural = "consumers"
+)
+
+// ObjectMeta is the part of the Kubernetes object metadata the operator uses
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+	Generation      int64  `json:"generation"`
+}
+
+// key returns the namespaced name of the resource
+func (m ObjectMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+// ResourceStatus is the reconciliation status of a custom resource
+type ResourceStatus struct {
+	// Ready is whether JetStream matches the spec of the resource
+	Ready bool `json:"ready"`
+	// Message describes why the resource is not ready
+	Message string `json:"message,omitempty"`
+	// ObservedGeneration is the generation of the spec last reconciled
+	ObservedGeneration int64 `json:"observedGeneration"`
+}
+
+// parseDuration helper function to parse an optional duration of a spec
+func parseDuration(field, value string) (*time.Duration, error) {
+	if value == "" {
+		return nil, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", field, err)
+	}
+	return &duration, nil
+}
+
+// ==============================================================================
+
+// StreamSpec is the spec of a Stream custom resource
+type StreamSpec struct {
+	// Name is the stream name. Defaults to the resource name.
+	Name string `json:"name,omitempty"`
+	// Subjects is the list of subjects of interest for this stream
+	Subjects []string `json:"subjects,omitempty"`
+	// MaxConsumers is the max number of consumers allowed on the stream
+	MaxConsumers *int `json:"maxConsumers,omitempty"`
+	// MaxMsgs is the max number of messages the stream will store
+	MaxMsgs *int64 `json:"maxMsgs,omitempty"`
+	// MaxBytes is the max number of message bytes the stream will store
+	MaxBytes *int64 `json:"maxBytes,omitempty"`
+	// MaxAge is the max duration the stream will store a message, e.g. "24h"
+	MaxAge string `json:"maxAge,omitempty"`
+	// MaxMsgsPerSubject is the max number of messages stored per subject
+	MaxMsgsPerSubject *int64 `json:"maxMsgsPerSubject,omitempty"`
+	// MaxMsgSize is the max size of a message allowed in this stream
+	MaxMsgSize *int32 `json:"maxMsgSize,omitempty"`
+}
+
+// StreamResource is a Stream custom resource
+type StreamResource struct {
+	Metadata ObjectMeta     `json:"metadata"`
+	Spec     StreamSpec     `json:"spec"`
+	Status   ResourceStatus `json:"status"`
+}
+
+// StreamName returns the name of the JetStream stream of the resource
+func (s StreamResource) StreamName() string {
+	if s.Spec.Name != "" {
+		return s.Spec.Name
+	}
+	return s.Metadata.Name
+}
+
+// ToParam convert the spec into the parameters for defining the stream
+func (s StreamResource) ToParam() (management.JSStreamParam, error) {
+	maxAge, err := parseDuration("maxAge", s.Spec.MaxAge)
+	if err != nil {
+		return management.JSStreamParam{}, err
+	}
+	return management.JSStreamParam{
+		Name:     s.StreamName(),
+		Subjects: s.Spec.Subjects,
+		JSStreamLimits: management.JSStreamLimits{
+			MaxConsumers:      s.Spec.MaxConsumers,
+			MaxMsgs:           s.Spec.MaxMsgs,
+			MaxBytes:          s.Spec.MaxBytes,
+			MaxAge:            maxAge,
+			MaxMsgsPerSubject: s.Spec.MaxMsgsPerSubject,
+			MaxMsgSize:        s.Spec.MaxMsgSize,
+		},
+	}, nil
+}
+
+// ==============================================================================
+
+// ConsumerSpec is the spec of a Consumer custom resource
+type ConsumerSpec struct {
+	// Stream is the name of the JetStream stream of the consumer
+	Stream string `json:"stream"`
+	// Name is the consumer name. Defaults to the resource name.
+	Name string `json:"name,omitempty"`
+	// Notes are descriptions regarding this consumer
+	Notes string `json:"notes,omitempty"`
+	// FilterSubject sets the consumer to filter for subjects matching this subject
+	FilterSubject *string `json:"filterSubject,omitempty"`
+	// DeliveryGroup is the delivery group of a push consumer
+	DeliveryGroup *string `json:"deliveryGroup,omitempty"`
+	// MaxInflight is max number of un-ACKed message permitted in-flight
+	MaxInflight int `json:"maxInflight"`
+	// MaxRetry max number of times an un-ACKed message is resent (-1: infinite)
+	MaxRetry *int `json:"maxRetry,omitempty"`
+	// AckWait is the duration to wait for ACK before retry, e.g. "30s"
+	AckWait string `json:"ackWait,omitempty"`
+	// Backoff are the durations to wait for ACK before each retry, replacing AckWait
+	Backoff []string `json:"backoff,omitempty"`
+	// Mode whether the consumer is push or pull consumer
+	Mode string `json:"mode"`
+}
+
+// ConsumerResource is a Consumer custom resource
+type ConsumerResource struct {
+	Metadata ObjectMeta     `json:"metadata"`
+	Spec     ConsumerSpec   `json:"spec"`
+	Status   ResourceStatus `json:"status"`
+}
+
+// ConsumerName returns the name of the JetStream consumer of the resource
+func (c ConsumerResource) ConsumerName() string {
+	if c.Spec.Name != "" {
+		return c.Spec.Name
+	}
+	return c.Metadata.Name
+}
+
+// ToParam convert the spec into the parameters for defining the consumer
+func (c ConsumerResource) ToParam() (management.JetStreamConsumerParam, error) {
+	ackWait, err := parseDuration("ackWait", c.Spec.AckWait)
+	if err != nil {
+		return management.JetStreamConsumerParam{}, err
+	}
+	var backoff []time.Duration
+	for idx, value := range c.Spec.Backoff {
+		delay, err := parseDuration(fmt.Sprintf("backoff[%d]", idx), value)
+		if err != nil {
+			return management.JetStreamConsumerParam{}, err
+		}
+		if delay == nil {
+			return management.JetStreamConsumerParam{}, fmt.Errorf("backoff[%d] is empty", idx)
+		}
+		backoff = append(backoff, *delay)
+	}
+	return management.JetStreamConsumerParam{
+		Name:          c.ConsumerName(),
+		Notes:         c.Spec.Notes,
+		FilterSubject: c.Spec.FilterSubject,
+		DeliveryGroup: c.Spec.DeliveryGroup,
+		MaxInflight:   c.Spec.MaxInflight,
+		MaxRetry:      c.Spec.MaxRetry,
+		AckWait:       ackWait,
+		Backoff:       backoff,
+		Mode:          c.Spec.Mode,
+	}, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltKeyValueStore implements KeyValueStore with a bbolt database file
+//
+// Each value is prefixed with its expiry as 8 bytes of big-endian Unix nanoseconds, where
+// "0" means the value does not expire.
+type boltKeyValueStore struct {
+	common.Component
+	db     *bolt.DB
+	bucket []byte
+	ttl    time.Duration
+}
+
+// GetBoltKeyValueStore define a KeyValueStore stored in a bbolt database file. The
+// database file and bucket are created if they do not exist.
+func GetBoltKeyValueStore(path, bucket string, ttl time.Duration) (KeyValueStore, error) {
+	logTags := log.Fields{
+		"module":    "storage",
+		"component": "bolt-store",
+		"instance":  bucket,
+		"path":      path,
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to open database")
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	}); err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to define bucket")
+		_ = db.Close()
+		return nil, err
+	}
+	return &boltKeyValueStore{
+		Component: common.Component{LogTags: logTags},
+		db:        db,
+		bucket:    []byte(bucket),
+		ttl:       ttl,
+	}, nil
+}
+
+// expired helper function to check whether a stored value has expired
+func (s *boltKeyValueStore) expired(stored []byte, now time.Time) bool {
+	if len(stored) < 8 {
+		return true
+	}
+	expire := int64(binary.BigEndian.Uint64(stored[:8]))
+	return expire != 0 && now.UnixNano() >= expire
+}
+
+// Put stores a value under a key, replacing any previous value
+func (s *boltKeyValueStore) Put(key string, value []byte, ctxt context.Context) error {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	stored := make([]byte, 8+len(value))
+	if s.ttl > 0 {
+		binary.BigEndian.PutUint64(stored[:8], uint64(time.Now().Add(s.ttl).UnixNano()))
+	}
+	copy(stored[8:], value)
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(key), stored)
+	}); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to store %s", key)
+		return err
+	}
+	return nil
+}
+
+// Get fetches the value stored under a key
+func (s *boltKeyValueStore) Get(key string, ctxt context.Context) ([]byte, error) {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	var result []byte
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(s.bucket).Get([]byte(key))
+		if stored == nil || s.expired(stored, time.Now()) {
+			return ErrKeyNotFound
+		}
+		// The returned slice is only valid during the transaction
+		result = append([]byte{}, stored[8:]...)
+		return nil
+	}); err != nil {
+		if err != ErrKeyNotFound {
+			log.WithError(err).WithFields(localLogTags).Errorf("Unable to read %s", key)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// Delete removes a key
+func (s *boltKeyValueStore) Delete(key string, ctxt context.Context) error {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(key))
+	}); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to delete %s", key)
+		return err
+	}
+	return nil
+}
+
+// Keys lists the keys starting with prefix. Expired entries found are removed.
+func (s *boltKeyValueStore) Keys(prefix string, ctxt context.Context) ([]string, error) {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	result := []string{}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		expired := [][]byte{}
+		cursor := tx.Bucket(s.bucket).Cursor()
+		bytePrefix := []byte(prefix)
+		k, v := cursor.Seek(bytePrefix)
+		for ; k != nil && bytes.HasPrefix(k, bytePrefix); k, v = cursor.Next() {
+			if s.expired(v, now) {
+				expired = append(expired, append([]byte{}, k...))
+				continue
+			}
+			result = append(result, string(k))
+		}
+		for _, k := range expired {
+			if err := tx.Bucket(s.bucket).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to list keys with prefix %s", prefix)
+		return nil, err
+	}
+	return result, nil
+}
+
+// Close releases the resources held by the store
+func (s *boltKeyValueStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,135 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/nats-io/nats.go"
+)
+
+// jetStreamKeyValueStore implements KeyValueStore with a JetStream KV bucket
+type jetStreamKeyValueStore struct {
+	common.Component
+	kv nats.KeyValue
+}
+
+// GetJetStreamKeyValueStore define a KeyValueStore backed by a JetStream KV bucket. The
+// bucket is created if it does not exist.
+//
+// Keys must be valid JetStream KV keys.
+func GetJetStreamKeyValueStore(
+	natsClient *core.NatsClient, bucket string, ttl time.Duration,
+) (KeyValueStore, error) {
+	logTags := log.Fields{
+		"module":    "storage",
+		"component": "jetstream-store",
+		"instance":  bucket,
+	}
+	kv, err := natsClient.JetStream().KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = natsClient.JetStream().CreateKeyValue(&nats.KeyValueConfig{
+			Bucket: bucket,
+			TTL:    ttl,
+		})
+	}
+	if err != nil {
+		log.WithError(err).WithFields(logTags).Errorf("Unable to open KV bucket")
+		return nil, err
+	}
+	return &jetStreamKeyValueStore{
+		Component: common.Component{LogTags: logTags},
+		kv:        kv,
+	}, nil
+}
+
+// Put stores a value under a key, replacing any previous value
+func (s *jetStreamKeyValueStore) Put(key string, value []byte, ctxt context.Context) error {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	if _, err := s.kv.Put(key, value); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to store %s", key)
+		return err
+	}
+	return nil
+}
+
+// Get fetches the value stored under a key
+func (s *jetStreamKeyValueStore) Get(key string, ctxt context.Context) ([]byte, error) {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	entry, err := s.kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to read %s", key)
+		return nil, err
+	}
+	return entry.Value(), nil
+}
+
+// Delete removes a key
+func (s *jetStreamKeyValueStore) Delete(key string, ctxt context.Context) error {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return err
+	}
+	if err := s.kv.Purge(key); err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to delete %s", key)
+		return err
+	}
+	return nil
+}
+
+// Keys lists the keys starting with prefix
+func (s *jetStreamKeyValueStore) Keys(prefix string, ctxt context.Context) ([]string, error) {
+	localLogTags, err := common.UpdateLogTags(s.LogTags, ctxt)
+	if err != nil {
+		log.WithError(err).WithFields(s.LogTags).Errorf("Failed to update logtags")
+		return nil, err
+	}
+	result := []string{}
+	keys, err := s.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return result, nil
+	} else if err != nil {
+		log.WithError(err).WithFields(localLogTags).Errorf("Unable to list keys")
+		return nil, err
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// Close releases the resources held by the store
+func (s *jetStreamKeyValueStore) Close() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/apex/log"
+)
+
+// memoryEntry one entry in the memory store
+type memoryEntry struct {
+	value  []byte
+	expire time.Time
+}
+
+// memoryKeyValueStore implements KeyValueStore in memory
+type memoryKeyValueStore struct {
+	common.Component
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]memoryEntry
+}
+
+// GetMemoryKeyValueStore define a KeyValueStore held in memory. Entries are lost when the
+// process exits.
+func GetMemoryKeyValueStore(name string, ttl time.Duration) (KeyValueStore, error) {
+	logTags := log.Fields{
+		"module":    "storage",
+		"component": "memory-store",
+		"instance":  name,
+	}
+	return &memoryKeyValueStore{
+		Component: common.Component{LogTags: logTags},
+		ttl:       ttl,
+		entries:   make(map[string]memoryEntry),
+	}, nil
+}
+
+// expired helper function to check whether an entry has expired
+func (s *memoryKeyValueStore) expired(entry memoryEntry, now time.Time) bool {
+	return !entry.expire.IsZero() && !now.Before(entry.expire)
+}
+
+// Put stores a value under a key, replacing any previous value
+func (s *memoryKeyValueStore) Put(key string, value []byte, ctxt context.Context) error {
+	entry := memoryEntry{value: append([]byte{}, value...)}
+	if s.ttl > 0 {
+		entry.expire = time.Now().Add(s.ttl)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[key] = entry
+	return nil
+}
+
+// Get fetches the value stored under a key
+func (s *memoryKeyValueStore) Get(key string, ctxt context.Context) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if s.expired(entry, time.Now()) {
+		delete(s.entries, key)
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, entry.value...), nil
+}
+
+// Delete removes a key
+func (s *memoryKeyValueStore) Delete(key string, ctxt context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Keys lists the keys starting with prefix
+func (s *memoryKeyValueStore) Keys(prefix string, ctxt context.Context) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	result := []string{}
+	for key, entry := range s.entries {
+		if s.expired(entry, now) {
+			delete(s.entries, key)
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// Close releases the resources held by the store
+func (s *memoryKeyValueStore) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage provides key-value stores for state local to a gateway instance
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alwitt/httpmq/core"
+)
+
+// ErrKeyNotFound returned when a key is not present in the store
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyValueStore a key-value store
+type KeyValueStore interface {
+	// Put stores a value under a key, replacing any previous value
+	Put(key string, value []byte, ctxt context.Context) error
+	// Get fetches the value stored under a key. Returns ErrKeyNotFound if the key is not
+	// present, or has expired.
+	Get(key string, ctxt context.Context) ([]byte, error)
+	// Delete removes a key. Deleting an unknown key is not an error.
+	Delete(key string, ctxt context.Context) error
+	// Keys lists the keys starting with prefix
+	Keys(prefix string, ctxt context.Context) ([]string, error)
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// Supported KeyValueStore backends
+const (
+	BackendMemory    = "memory"
+	BackendBolt      = "bolt"
+	BackendJetStream = "jetstream"
+)
+
+// KeyValueStoreParam settings for defining a KeyValueStore
+type KeyValueStoreParam struct {
+	// Backend is the store backend
+	Backend string `validate:"required,oneof=memory bolt jetstream"`
+	// Bucket is the bucket name. For the "jetstream" backend, this is the KV bucket name.
+	Bucket string `validate:"required"`
+	// Path is the database file path for the "bolt" backend
+	Path string
+	// TTL is how long entries are kept before expiring. "0" means entries never expire.
+	TTL time.Duration `validate:"gte=0"`
+}
+
+// GetKeyValueStore define a KeyValueStore based on the settings
+//
+// natsClient is only needed for the "jetstream" backend.
+func GetKeyValueStore(
+	param KeyValueStoreParam, natsClient *core.NatsClient,
+) (KeyValueStore, error) {
+	switch param.Backend {
+	case BackendMemory:
+		return GetMemoryKeyValueStore(param.Bucket, param.TTL)
+	case BackendBolt:
+		if param.Path == "" {
+			return nil, fmt.Errorf("bolt store requires a database file path")
+		}
+		return GetBoltKeyValueStore(param.Path, param.Bucket, param.TTL)
+	case BackendJetStream:
+		if natsClient == nil {
+			return nil, fmt.Errorf("jetstream store requires a NATS client")
+		}
+		return GetJetStreamKeyValueStore(natsClient, param.Bucket, param.TTL)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %s", param.Backend)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alwitt/httpmq/common"
+	"github.com/alwitt/httpmq/core"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyKeyValueStore helper function to verify the common KeyValueStore behavior
+func verifyKeyValueStore(t *testing.T, uut KeyValueStore, ctxt context.Context) {
+	assert := assert.New(t)
+
+	// Case 0: read unknown key
+	{
+		_, err := uut.Get("unknown", ctxt)
+		assert.ErrorIs(err, ErrKeyNotFound)
+	}
+
+	// Case 1: write and read back
+	{
+		assert.Nil(uut.Put("a.1", []byte("hello"), ctxt))
+		assert.Nil(uut.Put("a.2", []byte("world"), ctxt))
+		assert.Nil(uut.Put("b.1", []byte("other"), ctxt))
+		value, err := uut.Get("a.1", ctxt)
+		assert.Nil(err)
+		assert.Equal([]byte("hello"), value)
+	}
+
+	// Case 2: replace value
+	{
+		assert.Nil(uut.Put("a.1", []byte("again"), ctxt))
+		value, err := uut.Get("a.1", ctxt)
+		assert.Nil(err)
+		assert.Equal([]byte("again"), value)
+	}
+
+	// Case 3: list keys by prefix
+	{
+		keys, err := uut.Keys("a.", ctxt)
+		assert.Nil(err)
+		sort.Strings(keys)
+		assert.Equal([]string{"a.1", "a.2"}, keys)
+	}
+
+	// Case 4: delete
+	{
+		assert.Nil(uut.Delete("a.1", ctxt))
+		_, err := uut.Get("a.1", ctxt)
+		assert.ErrorIs(err, ErrKeyNotFound)
+		keys, err := uut.Keys("a.", ctxt)
+		assert.Nil(err)
+		assert.Equal([]string{"a.2"}, keys)
+	}
+}
+
+func TestMemoryKeyValueStore(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	utCtxt := context.Background()
+
+	uut, err := GetMemoryKeyValueStore("ut-memory-store", 0)
+	assert.Nil(err)
+	verifyKeyValueStore(t, uut, utCtxt)
+	assert.Nil(uut.Close())
+
+	// Case: entries expire
+	uut, err = GetMemoryKeyValueStore("ut-memory-store", time.Millisecond*50)
+	assert.Nil(err)
+	assert.Nil(uut.Put("a", []byte("a"), utCtxt))
+	time.Sleep(time.Millisecond * 100)
+	_, err = uut.Get("a", utCtxt)
+	assert.ErrorIs(err, ErrKeyNotFound)
+}
+
+func TestBoltKeyValueStore(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	utCtxt := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "ut.db")
+
+	uut, err := GetBoltKeyValueStore(dbPath, "ut-bolt-store", 0)
+	assert.Nil(err)
+	verifyKeyValueStore(t, uut, utCtxt)
+	assert.Nil(uut.Close())
+
+	// Case: entries survive re-opening the database
+	uut, err = GetBoltKeyValueStore(dbPath, "ut-bolt-store", time.Millisecond*50)
+	assert.Nil(err)
+	value, err := uut.Get("a.2", utCtxt)
+	assert.Nil(err)
+	assert.Equal([]byte("world"), value)
+
+	// Case: entries expire
+	assert.Nil(uut.Put("c", []byte("c"), utCtxt))
+	time.Sleep(time.Millisecond * 100)
+	_, err = uut.Get("c", utCtxt)
+	assert.ErrorIs(err, ErrKeyNotFound)
+	keys, err := uut.Keys("c", utCtxt)
+	assert.Nil(err)
+	assert.Empty(keys)
+	assert.Nil(uut.Close())
+}
+
+func TestJetStreamKeyValueStore(t *testing.T) {
+	assert := assert.New(t)
+	log.SetLevel(log.DebugLevel)
+	utCtxt, utCtxtCancel := context.WithCancel(context.Background())
+	defer utCtxtCancel()
+
+	logTags := log.Fields{
+		"module":    "storage_test",
+		"component": "JetStreamKeyValueStore",
+		"instance":  "basic",
+	}
+
+	// Define NATS connection params
+	natsParam := core.NATSConnectParams{
+		ServerURI:           common.GetUnitTestNatsURI(),
+		ConnectTimeout:      time.Second,
+		MaxReconnectAttempt: 0,
+		ReconnectWait:       time.Second,
+		OnDisconnectCallback: func(_ *nats.Conn, e error) {
+			if e != nil {
+				log.WithError(e).WithFields(logTags).Error(
+					"Disconnect callback triggered with failure",
+				)
+			}
+		},
+		OnReconnectCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Reconnected with NATs server")
+		},
+		OnCloseCallback: func(_ *nats.Conn) {
+			log.WithFields(logTags).Debug("Disconnected from NATs server")
+		},
+	}
+
+	js, err := core.GetJetStream(natsParam)
+	assert.Nil(err)
+	defer js.Close(utCtxt)
+
+	// Case 0: empty bucket
+	uut, err := GetKeyValueStore(
+		KeyValueStoreParam{Backend: BackendJetStream, Bucket: uuid.New().String()}, js,
+	)
+	assert.Nil(err)
+	{
+		keys, err := uut.Keys("", utCtxt)
+		assert.Nil(err)
+		assert.Empty(keys)
+	}
+	verifyKeyValueStore(t, uut, utCtxt)
+	assert.Nil(uut.Close())
+}
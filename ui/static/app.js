@@ -0,0 +1,346 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+"use strict";
+
+// The UI is served at <prefix>/ui/, next to the versioned APIs
+const apiBase = "../v2/admin";
+const refreshInterval = 5000;
+const eventsKept = 50;
+const eventsRetryDelay = 5000;
+// Event types of the stream and consumer lifecycle; every other event reports a problem
+const lifecycleEvents = new Set([
+  "stream-created", "stream-updated", "stream-deleted", "consumer-created", "consumer-deleted",
+  "stream-snapshot-completed", "stream-restore-completed",
+]);
+
+let spec = null;
+let selectedStream = null;
+let lastEventID = 0;
+
+const tokenInput = document.getElementById("token");
+tokenInput.value = sessionStorage.getItem("httpmq-token") || "";
+tokenInput.addEventListener("change", () => {
+  sessionStorage.setItem("httpmq-token", tokenInput.value);
+  refresh();
+});
+
+// apiFetch call the management API, returning the parsed JSON response
+async function apiFetch(path, options = {}) {
+  const headers = options.headers || {};
+  if (tokenInput.value) {
+    headers["Authorization"] = "Bearer " + tokenInput.value;
+  }
+  const resp = await fetch(apiBase + path, { ...options, headers });
+  const body = await resp.json().catch(() => ({}));
+  if (!resp.ok || body.success === false) {
+    const msg = body.error && body.error.message ? body.error.message : resp.statusText;
+    throw new Error(`${resp.status} ${msg}`);
+  }
+  return body;
+}
+
+function setStatus(msg, isError) {
+  const status = document.getElementById("status");
+  status.textContent = msg;
+  status.className = isError ? "error" : "";
+}
+
+function cell(row, text) {
+  const td = row.insertCell();
+  td.textContent = text;
+  return td;
+}
+
+function deleteButton(row, what, path) {
+  const button = document.createElement("button");
+  button.textContent = "Delete";
+  button.addEventListener("click", async (event) => {
+    event.stopPropagation();
+    if (!confirm(`Delete ${what}?`)) {
+      return;
+    }
+    try {
+      await apiFetch(path, { method: "DELETE" });
+      refresh();
+    } catch (err) {
+      setStatus(`Failed to delete ${what}: ${err.message}`, true);
+    }
+  });
+  row.insertCell().appendChild(button);
+}
+
+// ----------------------------------------------------------------------------------------
+// Streams and consumers
+
+async function loadStreams() {
+  const body = await apiFetch("/stream");
+  const streams = body.streams || {};
+  const tbody = document.querySelector("#streams tbody");
+  tbody.replaceChildren();
+  for (const name of Object.keys(streams).sort()) {
+    const info = streams[name];
+    const row = tbody.insertRow();
+    row.className = name === selectedStream ? "selected" : "";
+    cell(row, name);
+    cell(row, (info.config.subjects || []).join(", "));
+    cell(row, info.state.messages);
+    cell(row, info.state.bytes);
+    cell(row, info.state.consumer_count);
+    deleteButton(row, `stream ${name}`, `/stream/${encodeURIComponent(name)}`);
+    row.addEventListener("click", () => {
+      selectedStream = name;
+      refresh();
+    });
+  }
+  if (selectedStream !== null && !(selectedStream in streams)) {
+    selectedStream = null;
+  }
+}
+
+async function loadConsumers() {
+  const tbody = document.querySelector("#consumers tbody");
+  document.getElementById("selected-stream").textContent = selectedStream ? `of ${selectedStream}` : "";
+  document.getElementById("consumer-create").hidden = selectedStream === null;
+  if (selectedStream === null) {
+    tbody.replaceChildren();
+    return;
+  }
+  const stream = encodeURIComponent(selectedStream);
+  const body = await apiFetch(`/stream/${stream}/consumer`);
+  const consumers = body.consumers || {};
+  tbody.replaceChildren();
+  for (const name of Object.keys(consumers).sort()) {
+    const info = consumers[name];
+    const row = tbody.insertRow();
+    cell(row, name);
+    cell(row, info.num_pending);
+    cell(row, info.num_ack_pending);
+    cell(row, info.num_redelivered);
+    cell(row, info.push_bound ? "yes" : "no");
+    deleteButton(
+      row, `consumer ${name}`, `/stream/${stream}/consumer/${encodeURIComponent(name)}`,
+    );
+  }
+}
+
+async function refresh() {
+  try {
+    await loadStreams();
+    await loadConsumers();
+    setStatus(`Updated ${new Date().toLocaleTimeString()}`, false);
+  } catch (err) {
+    setStatus(`Failed to refresh: ${err.message}`, true);
+  }
+}
+
+// ----------------------------------------------------------------------------------------
+// Forms generated from the OpenAPI spec
+
+// requestSchema find the schema of the JSON body of an API call in the spec
+function requestSchema(path, method) {
+  const operation = spec && spec.paths && spec.paths[path] && spec.paths[path][method];
+  if (!operation) {
+    return null;
+  }
+  const param = (operation.parameters || []).find((p) => p.in === "body");
+  return param ? resolveSchema(param.schema) : null;
+}
+
+// resolveSchema follow the references of a schema, and merge its allOf parts
+function resolveSchema(schema) {
+  if (schema && schema.$ref) {
+    schema = spec.definitions[schema.$ref.replace("#/definitions/", "")];
+  }
+  if (schema && schema.allOf) {
+    const merged = { type: "object", properties: {}, required: [] };
+    for (const part of schema.allOf.map(resolveSchema)) {
+      Object.assign(merged.properties, part.properties || {});
+      merged.required.push(...(part.required || []));
+    }
+    return merged;
+  }
+  return schema;
+}
+
+// buildForm define the inputs of form from schema, or a single JSON input without one.
+// Returns a function collecting the request from the inputs.
+function buildForm(form, schema, submitLabel, onSubmit) {
+  form.replaceChildren();
+  const collectors = [];
+  const addInput = (name, input, hint) => {
+    const label = document.createElement("label");
+    label.textContent = name;
+    label.htmlFor = input.id = `${form.id}-${name}`;
+    form.append(label, input);
+    if (hint) {
+      const div = document.createElement("div");
+      div.className = "hint";
+      div.textContent = hint;
+      form.append(div);
+    }
+  };
+
+  if (!schema || !schema.properties) {
+    const input = document.createElement("textarea");
+    input.placeholder = "{}";
+    addInput("request", input, "Request JSON");
+    collectors.push((request) => Object.assign(request, JSON.parse(input.value || "{}")));
+  } else {
+    const required = new Set(schema.required || []);
+    for (const [name, property] of Object.entries(schema.properties)) {
+      const prop = resolveSchema(property);
+      let input;
+      let parse;
+      if (prop.type === "boolean") {
+        input = document.createElement("input");
+        input.type = "checkbox";
+        parse = () => input.checked || undefined;
+      } else if (prop.type === "integer" || prop.type === "number") {
+        input = document.createElement("input");
+        input.type = "number";
+        parse = () => (input.value === "" ? undefined : Number(input.value));
+      } else if (prop.type === "array" && prop.items && prop.items.type === "string") {
+        input = document.createElement("input");
+        parse = () => {
+          const items = input.value.split(",").map((s) => s.trim()).filter((s) => s);
+          return items.length ? items : undefined;
+        };
+      } else if (prop.type === "string") {
+        input = document.createElement("input");
+        parse = () => input.value || undefined;
+      } else {
+        input = document.createElement("textarea");
+        parse = () => (input.value ? JSON.parse(input.value) : undefined);
+      }
+      input.required = required.has(name);
+      addInput(name, input, prop.description);
+      collectors.push((request) => {
+        const value = parse();
+        if (value !== undefined) {
+          request[name] = value;
+        }
+      });
+    }
+  }
+
+  const submit = document.createElement("button");
+  submit.type = "submit";
+  submit.textContent = submitLabel;
+  form.append(submit);
+  form.onsubmit = async (event) => {
+    event.preventDefault();
+    try {
+      const request = {};
+      collectors.forEach((collect) => collect(request));
+      await onSubmit(request);
+      form.reset();
+      refresh();
+    } catch (err) {
+      setStatus(`${submitLabel} failed: ${err.message}`, true);
+    }
+  };
+}
+
+async function loadForms() {
+  try {
+    const resp = await fetch("openapi.json");
+    spec = resp.ok ? await resp.json() : null;
+  } catch (err) {
+    spec = null;
+  }
+  const post = (path, request) => apiFetch(path, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(request),
+  });
+  buildForm(
+    document.getElementById("stream-form"),
+    requestSchema("/v1/admin/stream", "post"),
+    "Create stream",
+    (request) => post("/stream", request),
+  );
+  buildForm(
+    document.getElementById("consumer-form"),
+    requestSchema("/v1/admin/stream/{streamName}/consumer", "post"),
+    "Create consumer",
+    (request) => post(`/stream/${encodeURIComponent(selectedStream)}/consumer`, request),
+  );
+}
+
+// ----------------------------------------------------------------------------------------
+// Event feed
+
+function showEvent(event) {
+  const list = document.getElementById("events");
+  const item = document.createElement("li");
+  const subject = event.consumer ? `${event.stream}/${event.consumer}` : event.stream;
+  const resolved = event.resolved ? " (resolved)" : "";
+  item.textContent = `${new Date(event.timestamp).toLocaleString()} ${event.type}${resolved} ` +
+    `${subject}${event.message ? ": " + event.message : ""}`;
+  item.className = lifecycleEvents.has(event.type) ? "" : "error";
+  list.prepend(item);
+  while (list.children.length > eventsKept) {
+    list.lastChild.remove();
+  }
+}
+
+// followEvents read the server-sent event feed. EventSource is not used, as it can not
+// send the API token.
+async function followEvents() {
+  const note = document.getElementById("events-note");
+  const headers = { "Last-Event-ID": String(lastEventID) };
+  if (tokenInput.value) {
+    headers["Authorization"] = "Bearer " + tokenInput.value;
+  }
+  try {
+    const resp = await fetch(apiBase + "/events", { headers });
+    if (resp.status === 501) {
+      note.textContent = "The event feed is not enabled on this server.";
+      return;
+    }
+    if (!resp.ok) {
+      throw new Error(resp.statusText);
+    }
+    note.textContent = "";
+    const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+    let buffer = "";
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) {
+        break;
+      }
+      buffer += value;
+      let end;
+      while ((end = buffer.indexOf("\n\n")) >= 0) {
+        const block = buffer.slice(0, end);
+        buffer = buffer.slice(end + 2);
+        const data = block.split("\n").find((line) => line.startsWith("data: "));
+        if (data) {
+          const event = JSON.parse(data.slice(6));
+          lastEventID = event.id;
+          showEvent(event);
+        }
+      }
+    }
+  } catch (err) {
+    note.textContent = `Event feed disconnected: ${err.message}`;
+  }
+  setTimeout(followEvents, eventsRetryDelay);
+}
+
+loadForms();
+refresh();
+setInterval(refresh, refreshInterval);
+followEvents();
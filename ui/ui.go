@@ -0,0 +1,59 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// staticFiles are the files of the admin UI
+//
+//go:embed static
+var staticFiles embed.FS
+
+// SpecFile is the path, relative to the UI, which the OpenAPI spec of the management API
+// is served at
+const SpecFile = "openapi.json"
+
+// GetHandler define the HTTP handler serving the embedded admin UI under pathPrefix
+//
+// spec is the OpenAPI spec of the management API, which the UI builds its stream and
+// consumer creation forms from. If nil, the forms take the raw JSON of the request instead.
+func GetHandler(pathPrefix string, spec []byte) (http.Handler, error) {
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		return nil, err
+	}
+	files := http.StripPrefix(pathPrefix, http.FileServer(http.FS(static)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.TrimPrefix(r.URL.Path, pathPrefix) != SpecFile {
+			files.ServeHTTP(w, r)
+			return
+		}
+		if spec == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(spec)
+	}), nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2021-2022 The httpmq Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminUIHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	get := func(handler http.Handler, method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	// Case 0: the UI files are served under the prefix
+	{
+		uut, err := GetHandler("/mgmt/ui/", nil)
+		assert.Nil(err)
+		resp := get(uut, http.MethodGet, "/mgmt/ui/")
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.True(strings.Contains(resp.Body.String(), `<script src="app.js">`))
+		resp = get(uut, http.MethodGet, "/mgmt/ui/app.js")
+		assert.Equal(http.StatusOK, resp.Code)
+		resp = get(uut, http.MethodGet, "/mgmt/ui/unknown.js")
+		assert.Equal(http.StatusNotFound, resp.Code)
+		resp = get(uut, http.MethodPost, "/mgmt/ui/")
+		assert.Equal(http.StatusMethodNotAllowed, resp.Code)
+	}
+
+	// Case 1: no OpenAPI spec
+	{
+		uut, err := GetHandler("/ui/", nil)
+		assert.Nil(err)
+		resp := get(uut, http.MethodGet, "/ui/"+SpecFile)
+		assert.Equal(http.StatusNotFound, resp.Code)
+	}
+
+	// Case 2: OpenAPI spec is served next to the UI
+	{
+		spec := []byte(`{"swagger":"2.0","paths":{}}`)
+		uut, err := GetHandler("/ui/", spec)
+		assert.Nil(err)
+		resp := get(uut, http.MethodGet, "/ui/"+SpecFile)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("application/json", resp.Header().Get("Content-Type"))
+		assert.Equal(spec, resp.Body.Bytes())
+	}
+}